@@ -20,56 +20,126 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
+// 引入其他配置文件
+const INCLUDE_KEY = "include"
+
+// 选择 profile 覆盖文件的环境变量
+const PROFILE_ENV = "BUBOD_PROFILE"
+
 var MyConf map[string]map[string]string
 
 func init() {
 	MyConf = make(map[string]map[string]string)
 }
 
-// 加载配置文件
+// 加载配置文件，profile 取环境变量 BUBOD_PROFILE
 func LoadConf(conf_file string) map[string]map[string]string {
+	return LoadConfProfile(conf_file, os.Getenv(PROFILE_ENV))
+}
+
+// 加载配置文件及 profile 覆盖文件
+// 覆盖文件与配置文件同目录，bubod.ini 的 prod 覆盖文件为 bubod.prod.ini，不存在时忽略
+// 覆盖文件中的配置项逐项覆盖基础配置，未出现的配置项保持不变
+func LoadConfProfile(conf_file string, profile string) map[string]map[string]string {
 	per := make(map[string]map[string]string)
-	
-	f, _ := os.Open(conf_file)
-    defer f.Close()
+
+	if err := parseConfFile(conf_file, per, nil); err != nil {
+		fmt.Println("config file isn't exsit or file is nothing!", err)
+		os.Exit(1)
+	}
+	if profile != "" {
+		ext := filepath.Ext(conf_file)
+		profile_file := strings.TrimSuffix(conf_file, ext) + "." + profile + ext
+		if _, err := os.Stat(profile_file); err == nil {
+			if err := parseConfFile(profile_file, per, nil); err != nil {
+				fmt.Println("config profile file error!", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// ${ENV}/${file:...}/${vault:...} 插值
+	if err := interpolateConf(per); err != nil {
+		fmt.Println("config file interpolate error:", err)
+		os.Exit(1)
+	}
+
+	MyConf = per
+	return MyConf
+}
+
+// 解析配置文件并合并到 per，后出现的配置项覆盖先出现的
+// include = a.ini,b.ini 在出现的位置加载其他配置文件，相对路径相对于当前文件所在目录
+func parseConfFile(conf_file string, per map[string]map[string]string, including []string) error {
+	abs, _ := filepath.Abs(conf_file)
+	for _, f := range including {
+		if f == abs {
+			return fmt.Errorf("config include cycle: %s", strings.Join(append(including, abs), " -> "))
+		}
+	}
+	including = append(including, abs)
+
+	f, err := os.Open(conf_file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
 	buf := bufio.NewReader(f)
 	stringKey := ""
 	for {
 		//逐行解析
 		l, err := buf.ReadString('\n')
-		line := strings.TrimSpace(l)
-		if err != nil {
-			if err != io.EOF {
-				fmt.Println("config file isn't exsit or file is nothing!", err)
-				os.Exit(1)
-				// panic(err)
-				break
-			} else {
-				break
-			}
+		if err != nil && err != io.EOF {
+			return err
 		}
+		line := strings.TrimSpace(l)
 
 		switch {
 		case len(line) == 0:
 		//[xxx]: 配置组名称
 		case line[0] == '[' && line[len(line)-1] == ']':
 			stringKey = strings.TrimSpace(line[1 : len(line)-1])
-			per[stringKey] = make(map[string]string)
+			if _, ok := per[stringKey]; !ok {
+				per[stringKey] = make(map[string]string)
+			}
 		case line[0] == '#':
 		case line[0] == ';':
 		default:
 			//a=xxx: 配置项
 			i := strings.IndexAny(line, "=")
-			per[stringKey][strings.TrimSpace(line[0:i])] = strings.TrimSpace(line[i+1:])
+			if i < 0 {
+				return fmt.Errorf("%s: invalid line %q", conf_file, line)
+			}
+			key, val := strings.TrimSpace(line[0:i]), strings.TrimSpace(line[i+1:])
+			if key == INCLUDE_KEY {
+				for _, inc := range strings.Split(val, ",") {
+					if inc = strings.TrimSpace(inc); inc == "" {
+						continue
+					}
+					if !filepath.IsAbs(inc) {
+						inc = filepath.Join(filepath.Dir(conf_file), inc)
+					}
+					if err := parseConfFile(inc, per, including); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if _, ok := per[stringKey]; !ok {
+				per[stringKey] = make(map[string]string)
+			}
+			per[stringKey][key] = val
+		}
+		if err == io.EOF {
+			break
 		}
 	}
-
-	MyConf = per
-	return MyConf
+	return nil
 }
 
 func GetConf(module string) map[string]string {
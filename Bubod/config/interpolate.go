@@ -0,0 +1,201 @@
+// 配置值插值，密码、DSN 等无需明文写入配置文件
+//
+//	${NAME} / ${env:NAME}       环境变量，未设置时报错；${NAME:-default} 未设置或为空时使用默认值
+//	${file:/path/to/secret}     文件内容，去掉末尾换行，如 docker/k8s secret
+//	${vault:secret/data/bubod#password}  从 HashiCorp Vault 读取，路径#字段，支持 kv v1/v2
+//	$${...}                     转义，原样输出 ${...}
+//
+// Vault 地址和 token 取自 [Vault] addr/token/namespace 配置，未配置时使用环境变量 VAULT_ADDR/VAULT_TOKEN/VAULT_NAMESPACE。
+// [Vault] 配置本身只支持环境变量和文件插值。
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const VAULT_SECTION = "Vault"
+
+type vaultClient struct {
+	addr      string
+	token     string
+	namespace string
+	client    *http.Client
+	cache     map[string]map[string]interface{} // path => data
+}
+
+// 对所有配置值做插值，先处理 [Vault]
+func interpolateConf(conf map[string]map[string]string) error {
+	if section, ok := conf[VAULT_SECTION]; ok {
+		for key, value := range section {
+			v, err := interpolate(value, nil)
+			if err != nil {
+				return fmt.Errorf("[%s] %s: %s", VAULT_SECTION, key, err)
+			}
+			section[key] = v
+		}
+	}
+	vault := newVaultClient(conf[VAULT_SECTION])
+	for name, section := range conf {
+		if name == VAULT_SECTION {
+			continue
+		}
+		for key, value := range section {
+			v, err := interpolate(value, vault)
+			if err != nil {
+				return fmt.Errorf("[%s] %s: %s", name, key, err)
+			}
+			section[key] = v
+		}
+	}
+	return nil
+}
+
+// 替换 value 中的 ${...}，vault 为 nil 时不支持 vault: 引用
+func interpolate(value string, vault *vaultClient) (string, error) {
+	if !strings.Contains(value, "${") {
+		return value, nil
+	}
+	var result strings.Builder
+	for {
+		i := strings.Index(value, "${")
+		if i < 0 {
+			result.WriteString(value)
+			break
+		}
+		// $${ 转义
+		if i > 0 && value[i-1] == '$' {
+			result.WriteString(value[:i-1])
+			j := strings.IndexByte(value[i:], '}')
+			if j < 0 {
+				result.WriteString(value[i:])
+				break
+			}
+			result.WriteString(value[i : i+j+1])
+			value = value[i+j+1:]
+			continue
+		}
+		j := strings.IndexByte(value[i:], '}')
+		if j < 0 {
+			return "", fmt.Errorf("unclosed ${ in %q", value)
+		}
+		result.WriteString(value[:i])
+		v, err := resolve(value[i+2:i+j], vault)
+		if err != nil {
+			return "", err
+		}
+		result.WriteString(v)
+		value = value[i+j+1:]
+	}
+	return result.String(), nil
+}
+
+func resolve(ref string, vault *vaultClient) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "file:"):
+		path := strings.TrimPrefix(ref, "file:")
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(ref, "vault:"):
+		if vault == nil {
+			return "", fmt.Errorf("vault is not configured: ${%s}", ref)
+		}
+		return vault.get(strings.TrimPrefix(ref, "vault:"))
+	}
+	name := strings.TrimPrefix(ref, "env:")
+	def, hasDefault := "", false
+	if i := strings.Index(name, ":-"); i >= 0 {
+		name, def, hasDefault = name[:i], name[i+2:], true
+	}
+	v, ok := os.LookupEnv(name)
+	if hasDefault && v == "" {
+		return def, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
+// 未配置地址时返回 nil
+func newVaultClient(section map[string]string) *vaultClient {
+	get := func(key string, env string) string {
+		if v := section[key]; v != "" {
+			return v
+		}
+		return os.Getenv(env)
+	}
+	addr := get("addr", "VAULT_ADDR")
+	if addr == "" {
+		return nil
+	}
+	return &vaultClient{
+		addr:      strings.TrimRight(addr, "/"),
+		token:     get("token", "VAULT_TOKEN"),
+		namespace: get("namespace", "VAULT_NAMESPACE"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		cache:     make(map[string]map[string]interface{}),
+	}
+}
+
+// ref 格式 path#field，kv v2 路径需包含 data/，如 secret/data/bubod#password
+func (vault *vaultClient) get(ref string) (string, error) {
+	i := strings.LastIndexByte(ref, '#')
+	if i < 0 {
+		return "", fmt.Errorf("vault reference %q must be path#field", ref)
+	}
+	path, field := strings.Trim(ref[:i], "/"), ref[i+1:]
+	data, ok := vault.cache[path]
+	if !ok {
+		var err error
+		if data, err = vault.read(path); err != nil {
+			return "", err
+		}
+		vault.cache[path] = data
+	}
+	v, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+	return fmt.Sprint(v), nil
+}
+
+func (vault *vaultClient) read(path string) (map[string]interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, vault.addr+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", vault.token)
+	if vault.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vault.namespace)
+	}
+	resp, err := vault.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault read %s: %s", path, resp.Status)
+	}
+	secret := &struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(secret); err != nil {
+		return nil, err
+	}
+	// kv v2: {"data":{"data":{...},"metadata":{...}}}
+	if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return inner, nil
+		}
+	}
+	return secret.Data, nil
+}
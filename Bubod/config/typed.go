@@ -0,0 +1,140 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 配置值格式错误
+type ValueError struct {
+	Module string
+	Key    string
+	Value  string
+	Type   string
+}
+
+func (e *ValueError) Error() string {
+	if e.Module == "" {
+		return fmt.Sprintf("config %s=%q is not a valid %s", e.Key, e.Value, e.Type)
+	}
+	return fmt.Sprintf("config [%s] %s=%q is not a valid %s", e.Module, e.Key, e.Value, e.Type)
+}
+
+// 配置组，提供带默认值的类型转换
+// 配置项不存在或为空时返回默认值；格式错误时返回默认值和 *ValueError，由调用方决定报错还是忽略
+type Section map[string]string
+
+func (section Section) GetString(key string, def string) string {
+	if val := strings.TrimSpace(section[key]); val != "" {
+		return val
+	}
+	return def
+}
+
+func (section Section) GetInt(key string, def int64) (int64, error) {
+	val := strings.TrimSpace(section[key])
+	if val == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return def, &ValueError{Key: key, Value: val, Type: "integer"}
+	}
+	return v, nil
+}
+
+func (section Section) GetFloat(key string, def float64) (float64, error) {
+	val := strings.TrimSpace(section[key])
+	if val == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return def, &ValueError{Key: key, Value: val, Type: "number"}
+	}
+	return v, nil
+}
+
+// true/false/1/0/yes/no/on/off
+func (section Section) GetBool(key string, def bool) (bool, error) {
+	val := strings.TrimSpace(section[key])
+	switch strings.ToLower(val) {
+	case "":
+		return def, nil
+	case "1", "t", "true", "yes", "y", "on":
+		return true, nil
+	case "0", "f", "false", "no", "n", "off":
+		return false, nil
+	}
+	return def, &ValueError{Key: key, Value: val, Type: "bool"}
+}
+
+// 支持 10s/1m30s/500ms 等格式，纯数字为秒
+func (section Section) GetDuration(key string, def time.Duration) (time.Duration, error) {
+	val := strings.TrimSpace(section[key])
+	if val == "" {
+		return def, nil
+	}
+	if v, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Duration(v) * time.Second, nil
+	}
+	v, err := time.ParseDuration(val)
+	if err != nil {
+		return def, &ValueError{Key: key, Value: val, Type: "duration"}
+	}
+	return v, nil
+}
+
+// 逗号分隔，去掉空白和空项
+func (section Section) GetStringSlice(key string, def []string) []string {
+	val := strings.TrimSpace(section[key])
+	if val == "" {
+		return def
+	}
+	list := make([]string, 0)
+	for _, v := range strings.Split(val, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// 以下读取 MyConf，错误信息带配置组名
+
+func GetString(module string, key string, def string) string {
+	return Section(MyConf[module]).GetString(key, def)
+}
+
+func GetInt(module string, key string, def int64) (int64, error) {
+	v, err := Section(MyConf[module]).GetInt(key, def)
+	return v, withModule(err, module)
+}
+
+func GetFloat(module string, key string, def float64) (float64, error) {
+	v, err := Section(MyConf[module]).GetFloat(key, def)
+	return v, withModule(err, module)
+}
+
+func GetBool(module string, key string, def bool) (bool, error) {
+	v, err := Section(MyConf[module]).GetBool(key, def)
+	return v, withModule(err, module)
+}
+
+func GetDuration(module string, key string, def time.Duration) (time.Duration, error) {
+	v, err := Section(MyConf[module]).GetDuration(key, def)
+	return v, withModule(err, module)
+}
+
+func GetStringSlice(module string, key string, def []string) []string {
+	return Section(MyConf[module]).GetStringSlice(key, def)
+}
+
+func withModule(err error, module string) error {
+	if e, ok := err.(*ValueError); ok {
+		e.Module = module
+	}
+	return err
+}
@@ -0,0 +1,343 @@
+// 管理接口
+//   GET    /instances                       所有实例状态
+//   POST   /instances                       添加实例 {"name":"source.3","config":{...},"start":true}
+//   GET    /instances/{name}                实例状态
+//   DELETE /instances/{name}                停止并删除实例
+//   POST   /instances/{name}/start          开始同步
+//   POST   /instances/{name}/stop           停止同步(关闭 dump 连接)
+//   POST   /instances/{name}/pause          暂停同步
+//   POST   /instances/{name}/resume         恢复同步
+//   POST   /instances/{name}/ddl_ack        确认等待中的 DDL 并恢复同步，见 ddl_pause.go
+//   POST   /instances/{name}/flush          立即保存位点
+//   POST   /instances/{name}/seek           修改起始位点，实例需已停止 {"file":"mysql-bin.000003","position":4}
+//                                            或 {"gtid":"3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5"}
+//   POST   /instances/{name}/snapshot       全量导出表数据写入输出，实例需运行中 {"table":"db.t1"}
+//   GET    /instances/{name}/filters        表过滤
+//   PUT    /instances/{name}/filters        修改表过滤 {"tables":"db.t1,t2","filter_tables":""}
+//   GET    /instances/{name}/schemas        缓存的表结构
+//   GET    /instances/{name}/schemas/snapshot  表结构快照，可写入文件后用 schema_snapshot 导入，
+//                                            ?all=true 时查询 master 上所有同步的表，与缓存合并
+//   GET    /instances/{name}/tables?limit=N 按表统计的事件数、行数、字节数(启动以来和最近 1m/5m/15m)，按字节数排序
+//   GET    /instances/{name}/binlogs        master 上的 binlog 文件、最早位点、保留时间和已同步位点的清除状态
+//   GET    /instances/{name}/checkpoints    最近保存的位点，最新的在前
+//   GET    /instances/{name}/savepoints     保存点
+//   POST   /instances/{name}/savepoints     创建保存点 {"name":"before-deploy"}，默认为最近保存的位点，
+//                                            {"name":"...","time":"2006-01-02 15:04:05"} 为该时间之前最后保存的位点
+//   DELETE /instances/{name}/savepoints/{savepoint}  删除保存点
+//   POST   /instances/{name}/rewind         回退到保存点或某个时间之前最后保存的位点，运行中的实例重新启动
+//                                            {"savepoint":"before-deploy"} 或 {"time":"2006-01-02 15:04:05"}
+//   GET    /instances/{name}/faults         剩余的故障注入
+//   PUT    /instances/{name}/faults         设置故障注入，需要 [Bubod] fault_injection=true，全部为 0 时关闭
+//                                            {"drop_after_events":100,"packet_delay_ms":0,"corrupt_checksums":1,"fail_schema_lookups":0}
+//
+// [Bubod] admin_token 不为空时，GET 之外的修改类请求需要请求头 Authorization: Bearer <admin_token>，否则返回 401；
+// 未配置时不鉴权，listen 只写端口时仅监听 127.0.0.1，见 http.go。
+// 修改类操作记录审计日志，见 audit.go
+package lib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bubod/Bubod/mysql"
+)
+
+type apiResponse struct {
+	Code int         `json:"code"` // 0 成功，其他为 http 状态码
+	Msg  string      `json:"msg"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+func writeJson(w http.ResponseWriter, code int, data interface{}, err error) {
+	resp := &apiResponse{Msg: "ok", Data: data}
+	if err != nil {
+		resp.Code = code
+		resp.Msg = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func registerAdminApi(mux *http.ServeMux) {
+	mux.HandleFunc("/instances", requireAdminToken(handleInstances))
+	mux.HandleFunc("/instances/", requireAdminToken(handleInstance))
+}
+
+// [Bubod] admin_token 配置
+func adminToken() string {
+	if Instances == nil {
+		return ""
+	}
+	return Instances.conf["Bubod"]["admin_token"]
+}
+
+// 配置了 admin_token 时，修改类请求需要携带该 token
+func requireAdminToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := adminToken()
+		if token == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bubod"`)
+			writeJson(w, http.StatusUnauthorized, nil, fmt.Errorf("unauthorized, set header Authorization: Bearer <admin_token>"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func handleInstances(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, Instances.List(), nil)
+	case http.MethodPost:
+		req := &struct {
+			Name   string            `json:"name"`
+			Config map[string]string `json:"config"`
+			Start  bool              `json:"start"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeJson(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if req.Name == "" {
+			writeJson(w, http.StatusBadRequest, nil, fmt.Errorf("name is required"))
+			return
+		}
+		actor := requestActor(r)
+		err := Instances.Add(req.Name, req.Config)
+		auditInstance(actor, AUDIT_ACTION_ADD, req.Name, "", err)
+		if err != nil {
+			writeJson(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if req.Start {
+			err := Instances.Start(req.Name)
+			auditInstance(actor, AUDIT_ACTION_START, req.Name, "", err)
+			if err != nil {
+				writeJson(w, http.StatusInternalServerError, nil, err)
+				return
+			}
+		}
+		status, err := Instances.Status(req.Name)
+		writeJson(w, http.StatusOK, status, err)
+	default:
+		writeJson(w, http.StatusMethodNotAllowed, nil, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// 接口中的时间，本地时区，为空时返回零值
+func parseApiTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, must be 2006-01-02 15:04:05", s)
+	}
+	return t, nil
+}
+
+func handleInstance(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/instances/"), "/")
+	parts := strings.SplitN(path, "/", 2)
+	name := parts[0]
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	ins, err := Instances.get(name)
+	if err != nil {
+		writeJson(w, http.StatusNotFound, nil, err)
+		return
+	}
+
+	var data interface{}
+	auditAction, auditDetail := "", ""
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		data, err = Instances.Status(name)
+	case action == "" && r.Method == http.MethodDelete:
+		err = Instances.Remove(name)
+		auditAction = AUDIT_ACTION_REMOVE
+	case action == "filters" && r.Method == http.MethodGet:
+		if status, e := Instances.Status(name); e == nil {
+			data = map[string][]string{"tables": status.Tables, "filter_tables": status.FilterTables}
+		}
+	case action == "filters" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		req := &struct {
+			Tables       string `json:"tables"`
+			FilterTables string `json:"filter_tables"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeJson(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		err = Instances.SetFilter(name, req.Tables, req.FilterTables)
+		auditAction, auditDetail = AUDIT_ACTION_FILTER, fmt.Sprintf("tables=%s filter_tables=%s", req.Tables, req.FilterTables)
+	case action == "schemas" && r.Method == http.MethodGet:
+		data, err = Instances.TableSchemas(name)
+	case action == "schemas/snapshot" && r.Method == http.MethodGet:
+		all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+		data, err = Instances.SchemaSnapshot(name, all)
+	case action == "tables" && r.Method == http.MethodGet:
+		limit := 0
+		if s := r.URL.Query().Get("limit"); s != "" {
+			if limit, err = strconv.Atoi(s); err != nil {
+				writeJson(w, http.StatusBadRequest, nil, fmt.Errorf("invalid limit %q", s))
+				return
+			}
+		}
+		data, err = Instances.TableStats(name, limit)
+	case action == "binlogs" && r.Method == http.MethodGet:
+		data, err = Instances.BinaryLogs(name)
+	case action == "checkpoints" && r.Method == http.MethodGet:
+		data, err = Instances.Checkpoints(name)
+	case action == "savepoints" && r.Method == http.MethodGet:
+		data, err = Instances.Savepoints(name)
+	case action == "savepoints" && r.Method == http.MethodPost:
+		req := &struct {
+			Name string `json:"name"`
+			Time string `json:"time"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeJson(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		at, e := parseApiTime(req.Time)
+		if e != nil {
+			writeJson(w, http.StatusBadRequest, nil, e)
+			return
+		}
+		var savepoint *Checkpoint
+		savepoint, err = Instances.CreateSavepoint(name, req.Name, at)
+		data = savepoint
+		auditAction, auditDetail = AUDIT_ACTION_SAVEPOINT, "create "+req.Name
+		if savepoint != nil {
+			auditDetail = fmt.Sprintf("create %s at %s:%d", req.Name, savepoint.File, savepoint.Position)
+		}
+	case strings.HasPrefix(action, "savepoints/") && r.Method == http.MethodDelete:
+		savepointName := strings.TrimPrefix(action, "savepoints/")
+		err = Instances.RemoveSavepoint(name, savepointName)
+		auditAction, auditDetail = AUDIT_ACTION_SAVEPOINT, "remove "+savepointName
+	case action == "rewind" && r.Method == http.MethodPost:
+		req := &struct {
+			Savepoint string `json:"savepoint"`
+			Time      string `json:"time"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeJson(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		at, e := parseApiTime(req.Time)
+		if e == nil && req.Savepoint == "" && at.IsZero() {
+			e = fmt.Errorf("savepoint or time is required")
+		}
+		if e != nil {
+			writeJson(w, http.StatusBadRequest, nil, e)
+			return
+		}
+		from := fmt.Sprintf("%s:%d", ins.dumpConfig.BinlogDumpFileName, ins.dumpConfig.BinlogDumpPosition)
+		var checkpoint *Checkpoint
+		checkpoint, err = Instances.Rewind(name, req.Savepoint, at)
+		data = checkpoint
+		auditAction, auditDetail = AUDIT_ACTION_REWIND, fmt.Sprintf("from %s to savepoint=%q time=%q", from, req.Savepoint, req.Time)
+		if checkpoint != nil {
+			auditDetail = fmt.Sprintf("from %s to %s:%d gtid=%s", from, checkpoint.File, checkpoint.Position, checkpoint.GTIDSet)
+		}
+	case action == "faults" && r.Method == http.MethodGet:
+		data, err = Instances.Faults(name)
+	case action == "faults" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		faults := mysql.Faults{}
+		if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+			writeJson(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		err = Instances.SetFaults(name, faults)
+		data = faults
+		auditAction, auditDetail = AUDIT_ACTION_FAULTS, fmt.Sprintf("drop_after_events=%d packet_delay_ms=%d corrupt_checksums=%d fail_schema_lookups=%d",
+			faults.DropAfterEvents, faults.PacketDelayMs, faults.CorruptChecksums, faults.FailSchemaLookups)
+	case r.Method == http.MethodPost:
+		switch action {
+		case "start":
+			err = Instances.Start(name)
+			auditAction = AUDIT_ACTION_START
+		case "stop":
+			err = Instances.Stop(name)
+			auditAction = AUDIT_ACTION_STOP
+		case "pause":
+			err = Instances.Pause(name)
+			auditAction = AUDIT_ACTION_PAUSE
+		case "resume":
+			err = Instances.Resume(name)
+			auditAction = AUDIT_ACTION_RESUME
+		case "ddl_ack":
+			var pending *PendingDDL
+			pending, err = Instances.AckDDL(name)
+			auditAction = AUDIT_ACTION_DDL_ACK
+			if pending != nil {
+				auditDetail = fmt.Sprintf("%s:%d %s", pending.BinlogFile, pending.BinlogPosition, pending.Statement)
+			}
+		case "flush":
+			data, err = Instances.Flush(name)
+		case "snapshot":
+			req := &struct {
+				Table string `json:"table"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				writeJson(w, http.StatusBadRequest, nil, err)
+				return
+			}
+			var rows int
+			rows, err = Instances.Snapshot(name, req.Table)
+			data = map[string]interface{}{"table": req.Table, "rows": rows}
+			auditAction, auditDetail = AUDIT_ACTION_SNAPSHOT, fmt.Sprintf("%s %d rows", req.Table, rows)
+		case "seek":
+			req := &struct {
+				File     string `json:"file"`
+				Position uint32 `json:"position"`
+				GTID     string `json:"gtid"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				writeJson(w, http.StatusBadRequest, nil, err)
+				return
+			}
+			if req.GTID != "" {
+				auditAction, auditDetail = AUDIT_ACTION_SEEK, fmt.Sprintf("from gtid %s to gtid %s", ins.dumpConfig.GTIDSet, req.GTID)
+				err = Instances.SeekGTID(name, req.GTID)
+				break
+			}
+			auditAction, auditDetail = AUDIT_ACTION_SEEK, fmt.Sprintf("from %s:%d to %s:%d",
+				ins.dumpConfig.BinlogDumpFileName, ins.dumpConfig.BinlogDumpPosition, req.File, req.Position)
+			err = Instances.Seek(name, req.File, req.Position)
+		default:
+			writeJson(w, http.StatusNotFound, nil, fmt.Errorf("unknown action %s", action))
+			return
+		}
+	default:
+		writeJson(w, http.StatusMethodNotAllowed, nil, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	if auditAction != "" {
+		Audit(requestActor(r), auditAction, ins.dumpConfig, auditDetail, err)
+	}
+
+	if err != nil {
+		writeJson(w, http.StatusConflict, nil, err)
+		return
+	}
+	if data == nil && action != "flush" {
+		data, _ = Instances.Status(name)
+	}
+	writeJson(w, http.StatusOK, data, nil)
+}
@@ -0,0 +1,164 @@
+// 审计日志
+// 实例的添加、删除、启动、停止、暂停、恢复、修改位点、修改表过滤、故障注入，zk 重新选举，以及同步到的 DDL 和 DDL 暂停、确认，
+// 都以 json 行追加写入审计文件，记录时间、操作者、实例和当时的位点。
+//
+//	{"time":"2018-09-14 12:00:00","timestamp":1536897600,"actor":"admin@127.0.0.1:52312","action":"seek","instance":"source.1","binlog_file":"mysql-bin.000003","binlog_pos":4}
+//
+// 管理接口调用方通过 X-Bubod-Actor 请求头或 basic auth 用户名标识，未提供时为客户端地址；
+// 进程内部触发的操作为 system。
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"bubod/Bubod/logger"
+)
+
+const (
+	AUDIT_ACTION_ADD       = "add"
+	AUDIT_ACTION_REMOVE    = "remove"
+	AUDIT_ACTION_START     = "start"
+	AUDIT_ACTION_STOP      = "stop"
+	AUDIT_ACTION_PAUSE     = "pause"
+	AUDIT_ACTION_RESUME    = "resume"
+	AUDIT_ACTION_SEEK      = "seek"
+	AUDIT_ACTION_SNAPSHOT  = "snapshot"
+	AUDIT_ACTION_FILTER    = "filter"
+	AUDIT_ACTION_FAILOVER  = "failover"
+	AUDIT_ACTION_RESTART   = "restart"
+	AUDIT_ACTION_DDL       = "ddl"
+	AUDIT_ACTION_DDL_PAUSE = "ddl_pause"
+	AUDIT_ACTION_DDL_ACK   = "ddl_ack"
+	AUDIT_ACTION_FAULTS    = "faults"
+	AUDIT_ACTION_SAVEPOINT = "savepoint"
+	AUDIT_ACTION_REWIND    = "rewind"
+)
+
+// 进程内部触发的操作
+const AUDIT_ACTOR_SYSTEM = "system"
+
+// 管理接口调用方标识
+const AUDIT_ACTOR_HEADER = "X-Bubod-Actor"
+
+type AuditRecord struct {
+	Time       string `json:"time"`
+	Timestamp  int64  `json:"timestamp"`
+	Actor      string `json:"actor"`
+	Action     string `json:"action"`
+	Instance   string `json:"instance,omitempty"`
+	BinlogFile string `json:"binlog_file,omitempty"`
+	BinlogPos  uint32 `json:"binlog_pos,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type auditLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+// Run 启动时初始化，为 nil 时不记录；auditLock 保护 audit 的读写，退出时关闭与记录并发
+var (
+	audit     *auditLog
+	auditLock sync.RWMutex
+)
+
+// 根据 [Bubod] audit_log 配置打开审计文件，默认为 data_dir/audit-{node_name}.log，off 为关闭
+func initAudit(conf map[string]string) {
+	path := conf["audit_log"]
+	if path == "off" {
+		return
+	}
+	if path == "" {
+		path = conf["data_dir"] + "/audit-" + conf["node_name"] + ".log"
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logger.With(logger.Fields{"file": path}).WithError(err).Error("open audit log")
+		return
+	}
+	auditLock.Lock()
+	audit = &auditLog{file: f}
+	auditLock.Unlock()
+}
+
+func (a *auditLog) write(record *AuditRecord) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.file == nil {
+		return
+	}
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		logger.WithError(err).Error("write audit log")
+	}
+}
+
+// 关闭审计文件，之后的记录丢弃
+func closeAudit() {
+	auditLock.Lock()
+	a := audit
+	audit = nil
+	auditLock.Unlock()
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.file.Close()
+	a.file = nil
+}
+
+// 记录一条审计日志，dumpConfig 不为 nil 时记录实例名和当前位点
+func Audit(actor string, action string, dumpConfig *DumpConfig, detail string, err error) {
+	now := time.Now()
+	record := &AuditRecord{
+		Time:      now.Format("2006-01-02 15:04:05"),
+		Timestamp: now.Unix(),
+		Actor:     actor,
+		Action:    action,
+		Detail:    detail,
+	}
+	if dumpConfig != nil {
+		record.Instance = dumpConfig.Name
+		record.BinlogFile = dumpConfig.BinlogDumpFileName
+		record.BinlogPos = dumpConfig.BinlogDumpPosition
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	auditLock.RLock()
+	a := audit
+	auditLock.RUnlock()
+	if a != nil {
+		a.write(record)
+	}
+}
+
+// 按实例名记录，实例不存在时只记录名称
+func auditInstance(actor string, action string, name string, detail string, err error) {
+	if ins, e := Instances.get(name); e == nil {
+		Audit(actor, action, ins.dumpConfig, detail, err)
+		return
+	}
+	Audit(actor, action, &DumpConfig{Name: name}, detail, err)
+}
+
+// 管理接口调用方
+func requestActor(r *http.Request) string {
+	actor := r.Header.Get(AUDIT_ACTOR_HEADER)
+	if actor == "" {
+		actor, _, _ = r.BasicAuth()
+	}
+	if actor == "" {
+		return r.RemoteAddr
+	}
+	return actor + "@" + r.RemoteAddr
+}
@@ -1,8 +1,12 @@
 package lib
 
 import (
+	"bubod/Bubod/logger"
 	"bubod/Bubod/mysql"
-	"log"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
 	// "fmt"
 )
 
@@ -10,9 +14,31 @@ import (
 // 1、将数据写入mq
 // 2、更新同步位点信息 file/zookeeper
 func (dump *dump) Callback(data *mysql.EventReslut) {
-	if len(data.Rows) == 0 {
+	dump.writeLock.Lock()
+	defer dump.writeLock.Unlock()
+	if data.Failover != nil {
+		dump.failoverCallback(data)
 		return
 	}
+	if data.Restart != nil {
+		dump.restartCallback(data)
+		return
+	}
+	if data.RowCount() == 0 && data.DDL == nil {
+		data.Trace.Drop()
+		return
+	}
+	filterSpan := data.Trace.StartChild("bubod.filter")
+	schemaName, tableName := data.SchemaName, data.TableName
+	if data.DDL != nil {
+		schemaName, tableName = data.DDL.SchemaName, data.DDL.TableName
+	}
+	if !dump.dumpConfig.IsSyncTable(schemaName, tableName) {
+		data.Trace.Drop()
+		return
+	}
+	filterSpan.Finish()
+	dump.dumpConfig.tableStats.add(schemaName, tableName, data, time.Now())
 	
 	// key := data.SchemaName + "-" + data.TableName
 	// fmt.Printf(key)
@@ -26,12 +52,24 @@ func (dump *dump) Callback(data *mysql.EventReslut) {
 	// log.Println("===BinlogPosition:", data.BinlogPosition)
 	// log.Println("===Rows:", data)
 
+	transformSpan := data.Trace.StartChild("bubod.transform")
 	jsonDatas := mysql.FormatEventData(data)
-	if dump.dumpConfig.Conf["Bubod"]["debug"] == "true" {
-		log.Println(jsonDatas)
+	transformSpan.SetAttribute("messages", len(jsonDatas))
+	transformSpan.Finish()
+
+	// 写入下游时通过 data.Trace.Headers() 传递 trace 上下文(如 kafka header)
+	sinkSpan := data.Trace.StartChild("bubod.sink")
+	if dump.dumpConfig.debug {
+		logger.With(data.LogFields()).Info("messages", jsonDatas)
 	}
+	dump.writeSinks(data, jsonDatas)
+	sinkSpan.Finish()
 	dump.dumpConfig.BinlogDumpFileName = data.BinlogFileName
 	dump.dumpConfig.BinlogDumpPosition = data.BinlogPosition
+	dump.dumpConfig.BinlogDumpTimestamp = data.Header.Timestamp
+	if data.DDL != nil {
+		Audit(AUDIT_ACTOR_SYSTEM, AUDIT_ACTION_DDL, dump.dumpConfig, data.DDL.Statement, nil)
+	}
 
 	// go func(){ 
 		// 这里交给异步服务做
@@ -56,4 +94,51 @@ func (dump *dump) Callback(data *mysql.EventReslut) {
 	// }()
 
 	return
-}
\ No newline at end of file
+}
+
+// master 切换，通知所有输出
+// 切换事件没有位点，不更新已同步位点，新 master 上的事件到达后再更新
+func (dump *dump) failoverCallback(data *mysql.EventReslut) {
+	failover := data.Failover
+	detail := failover.OldMaster + " -> " + failover.NewMaster + ", gtid: " + failover.GTIDSet
+	Audit(AUDIT_ACTOR_SYSTEM, AUDIT_ACTION_FAILOVER, dump.dumpConfig, detail, nil)
+	dump.writeSinks(data, mysql.FormatEventData(data))
+	// 新 master 的文件位点与已保存的位点不可比较
+	dump.dumpConfig.syncLock.Lock()
+	dump.dumpConfig.SyncPos = ""
+	dump.dumpConfig.syncLock.Unlock()
+}
+
+// master 重启，通知所有输出，同时更新已同步位点
+func (dump *dump) restartCallback(data *mysql.EventReslut) {
+	restart := data.Restart
+	detail := fmt.Sprintf("%s -> %s, clean: %t", restart.PrevFile, restart.BinlogFile, restart.Clean)
+	Audit(AUDIT_ACTOR_SYSTEM, AUDIT_ACTION_RESTART, dump.dumpConfig, detail, nil)
+	dump.writeSinks(data, mysql.FormatEventData(data))
+	dump.dumpConfig.BinlogDumpFileName = data.BinlogFileName
+	dump.dumpConfig.BinlogDumpPosition = data.BinlogPosition
+	dump.dumpConfig.BinlogDumpTimestamp = data.Header.Timestamp
+}
+
+// 事件解析失败回调
+// dlq 策略下将失败事件以 json 行追加写入死信文件 bubod_dlq
+func (dump *dump) ErrorCallback(data *mysql.ErrorEvent) {
+	if dump.binlogDump.ErrorPolicy != mysql.ERROR_POLICY_DLQ {
+		return
+	}
+	bubod_dlq := dump.dumpConfig.DlqFile
+	b, err := json.Marshal(data)
+	if err != nil {
+		dump.dumpConfig.logEntry().WithError(err).Error("encode error event")
+		return
+	}
+	f, err := os.OpenFile(bubod_dlq, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0777)
+	if err != nil {
+		dump.dumpConfig.logEntry().With(logger.Fields{"file": bubod_dlq}).WithError(err).Error("open dlq file")
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		dump.dumpConfig.logEntry().With(logger.Fields{"file": bubod_dlq}).WithError(err).Error("write dlq file")
+	}
+}
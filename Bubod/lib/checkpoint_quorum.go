@@ -0,0 +1,138 @@
+// 位点来源的优先级
+// 位点同时写入本地文件、选举后端(zookeeper/etcd/consul/kubernetes，single 不保存)和对象存储([ObjectStorage] checkpoint=true)，
+// 配置 recover_from_sink 时还从输出中读取最后写入的位点，
+// 启动时按数据源或 [Bubod] 的 checkpoint_quorum 从各来源中选择:
+//
+//	newest    默认，使用最大的位点
+//	file      本地文件优先，没有时使用其他来源中最大的
+//	election  选举后端优先，用于切换节点后本地文件可能落后的部署
+//	all       所有来源必须一致(都没有保存也算一致)，否则拒绝启动，由人工确认后 seek 或 binlog_dump_force
+//	sink      recover_from_sink 输出中最后写入的位点优先，配置 recover_from_sink 时为默认值，见 sink_recovery.go
+//
+// 各来源不一致时输出告警并记录指标 bubod_checkpoint_divergence。配置的起始位点和 binlog_dump_force 的处理不变。
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"bubod/Bubod/logger"
+	"bubod/Bubod/metrics"
+)
+
+const (
+	CHECKPOINT_QUORUM_NEWEST   = "newest"
+	CHECKPOINT_QUORUM_FILE     = "file"
+	CHECKPOINT_QUORUM_ELECTION = "election"
+	CHECKPOINT_QUORUM_ALL      = "all"
+	CHECKPOINT_QUORUM_SINK     = "sink"
+)
+
+const (
+	CHECKPOINT_SOURCE_FILE     = "file"
+	CHECKPOINT_SOURCE_ELECTION = "election"
+	CHECKPOINT_SOURCE_OBJECT   = "object"
+	CHECKPOINT_SOURCE_SINK     = "sink"
+)
+
+// 一个来源保存的位点，pos 为空表示没有保存
+type checkpointSource struct {
+	name string
+	pos  string
+}
+
+func checkCheckpointQuorum(quorum string) error {
+	switch quorum {
+	case CHECKPOINT_QUORUM_NEWEST, CHECKPOINT_QUORUM_FILE, CHECKPOINT_QUORUM_ELECTION, CHECKPOINT_QUORUM_ALL, CHECKPOINT_QUORUM_SINK:
+		return nil
+	}
+	return fmt.Errorf("unknown checkpoint_quorum %q, must be newest, file, election, all or sink", quorum)
+}
+
+// 各来源是否不一致
+func checkpointDiverges(sources []checkpointSource) bool {
+	for _, source := range sources[1:] {
+		if source.pos != sources[0].pos {
+			return true
+		}
+	}
+	return false
+}
+
+func newestCheckpoint(sources []checkpointSource) string {
+	var pos string
+	for _, source := range sources {
+		if source.pos != "" && (pos == "" || laterBinlogFilePos(source.pos, pos)) {
+			pos = source.pos
+		}
+	}
+	return pos
+}
+
+// 按 quorum 从各来源的位点中选择，都没有保存时返回空
+func chooseCheckpoint(quorum string, sources []checkpointSource) (string, error) {
+	switch quorum {
+	case CHECKPOINT_QUORUM_FILE, CHECKPOINT_QUORUM_ELECTION, CHECKPOINT_QUORUM_SINK:
+		for _, source := range sources {
+			if source.name == quorum && source.pos != "" {
+				return source.pos, nil
+			}
+		}
+	case CHECKPOINT_QUORUM_ALL:
+		if checkpointDiverges(sources) {
+			return "", fmt.Errorf("checkpoint_quorum=all but saved positions diverge: %s", formatCheckpointSources(sources))
+		}
+	}
+	return newestCheckpoint(sources), nil
+}
+
+func formatCheckpointSources(sources []checkpointSource) string {
+	parts := make([]string, 0, len(sources))
+	for _, source := range sources {
+		pos := source.pos
+		if pos == "" {
+			pos = "none"
+		}
+		parts = append(parts, source.name+"="+pos)
+	}
+	return strings.Join(parts, " ")
+}
+
+// 读取各来源保存的位点，无效的位点视为没有保存
+func (dumpConfig *DumpConfig) checkpointSources(filePos string) []checkpointSource {
+	sources := []checkpointSource{{name: CHECKPOINT_SOURCE_FILE, pos: filePos}}
+	if _, single := dumpConfig.ElectionManager.(*singleNodeElection); dumpConfig.ElectionManager != nil && !single {
+		sources = append(sources, checkpointSource{name: CHECKPOINT_SOURCE_ELECTION, pos: dumpConfig.ElectionManager.GetData(dumpConfig.Name)})
+	}
+	if dumpConfig.objectCheckpoint != nil {
+		sources = append(sources, checkpointSource{name: CHECKPOINT_SOURCE_OBJECT, pos: dumpConfig.loadObjectCheckpoint(OBJECT_CHECKPOINT_POSITION)})
+	}
+	if dumpConfig.recoverSink != nil {
+		sources = append(sources, checkpointSource{name: CHECKPOINT_SOURCE_SINK, pos: dumpConfig.loadSinkPosition()})
+	}
+	for i := range sources {
+		sources[i].pos = strings.TrimSpace(sources[i].pos)
+		if sources[i].pos != "" && !CheckBinlogFilePos(sources[i].pos) {
+			dumpConfig.logEntry().With(logger.Fields{"source": sources[i].name, "position": sources[i].pos}).Warn("invalid saved position, ignored")
+			sources[i].pos = ""
+		}
+	}
+	return sources
+}
+
+// 按 checkpoint_quorum 选择已保存的位点，各来源不一致时告警
+func (dumpConfig *DumpConfig) savedCheckpoint(filePos string) (string, error) {
+	sources := dumpConfig.checkpointSources(filePos)
+	pos, err := chooseCheckpoint(dumpConfig.checkpointQuorum, sources)
+	if checkpointDiverges(sources) {
+		metrics.CheckpointDivergence.Set(1, dumpConfig.Name)
+		dumpConfig.logEntry().With(logger.Fields{
+			"positions": formatCheckpointSources(sources),
+			"quorum":    dumpConfig.checkpointQuorum,
+			"chosen":    pos,
+		}).Warn("saved positions diverge")
+	} else {
+		metrics.CheckpointDivergence.Set(0, dumpConfig.Name)
+	}
+	return pos, err
+}
@@ -0,0 +1,155 @@
+// 计算字段
+// 数据源或 [Bubod] 配置 computed_fields 时，写入输出的每条消息的 fields 中追加计算字段，下游不需要单独的补全任务。
+// 逗号分隔的 名称:表达式，按配置顺序计算:
+//
+//	computed_fields=ingest_time:now,cluster:const:prod,shard:table_suffix,bucket:key_hash:16
+//
+//	now            bubod 处理事件的时间，unix 毫秒；now_rfc3339 为 rfc3339 格式
+//	parse_time     解析事件的时间，unix 毫秒，与消息的 timestamp(binlog 事件时间)一起用于计算端到端延迟，见 latency.go
+//	const:VALUE    固定值，如集群名称
+//	source         数据源名称(Database 或 source.N)
+//	cluster        [Bubod] cluster_name
+//	table_suffix   分表后缀: 表名最后一个 _ 之后的部分(orders_07 -> 07)，没有 _ 时为 null
+//	key_hash       主键 key 的 crc32，key_hash:N 时对 N 取模，用于分桶；没有主键时为 null
+//
+// 同一事件写入各输出的消息使用相同的处理时间。在输出的渲染方案之后、aggregate_window 等转换之前追加，
+// 合并后的消息使用最后一次变更的计算字段。
+package lib
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+
+	"bubod/Bubod/mysql"
+)
+
+const (
+	COMPUTED_NOW          = "now"
+	COMPUTED_NOW_RFC3339  = "now_rfc3339"
+	COMPUTED_PARSE_TIME   = "parse_time"
+	COMPUTED_CONST        = "const"
+	COMPUTED_SOURCE       = "source"
+	COMPUTED_CLUSTER      = "cluster"
+	COMPUTED_TABLE_SUFFIX = "table_suffix"
+	COMPUTED_KEY_HASH     = "key_hash"
+)
+
+type computedField struct {
+	name   string
+	expr   string
+	value  string // const 的值
+	modulo uint32 // key_hash 取模，0 时不取模
+}
+
+// 解析 computed_fields，未配置时返回 nil
+func parseComputedFields(s string) ([]*computedField, error) {
+	var fields []*computedField
+	names := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 3)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid computed field %q, must be name:expr", item)
+		}
+		if names[parts[0]] {
+			return nil, fmt.Errorf("duplicate computed field %q", parts[0])
+		}
+		names[parts[0]] = true
+		field := &computedField{name: parts[0], expr: parts[1]}
+		switch field.expr {
+		case COMPUTED_NOW, COMPUTED_NOW_RFC3339, COMPUTED_PARSE_TIME, COMPUTED_SOURCE, COMPUTED_CLUSTER, COMPUTED_TABLE_SUFFIX:
+			if len(parts) > 2 {
+				return nil, fmt.Errorf("invalid computed field %q, %s takes no argument", item, field.expr)
+			}
+		case COMPUTED_CONST:
+			if len(parts) < 3 {
+				return nil, fmt.Errorf("invalid computed field %q, must be name:const:value", item)
+			}
+			field.value = parts[2]
+		case COMPUTED_KEY_HASH:
+			if len(parts) > 2 {
+				modulo, err := strconv.ParseUint(parts[2], 10, 32)
+				if err != nil || modulo == 0 {
+					return nil, fmt.Errorf("invalid computed field %q, modulo must be a positive integer", item)
+				}
+				field.modulo = uint32(modulo)
+			}
+		default:
+			return nil, fmt.Errorf("invalid computed field %q, unknown expression %q", item, field.expr)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// 分表后缀，没有 _ 时返回 nil
+func tableSuffix(table string) driver.Value {
+	i := strings.LastIndexByte(table, '_')
+	if i < 0 || i == len(table)-1 {
+		return nil
+	}
+	return table[i+1:]
+}
+
+func (field *computedField) compute(dumpConfig *DumpConfig, data *mysql.EventReslut, message *mysql.FormatDataJsonStruct, now time.Time) driver.Value {
+	switch field.expr {
+	case COMPUTED_NOW:
+		return now.UnixNano() / int64(time.Millisecond)
+	case COMPUTED_NOW_RFC3339:
+		return now.Format(time.RFC3339Nano)
+	case COMPUTED_PARSE_TIME:
+		if data.ParsedAt.IsZero() {
+			return nil
+		}
+		return data.ParsedAt.UnixNano() / int64(time.Millisecond)
+	case COMPUTED_CONST:
+		return field.value
+	case COMPUTED_SOURCE:
+		return dumpConfig.Name
+	case COMPUTED_CLUSTER:
+		return dumpConfig.ClusterName
+	case COMPUTED_TABLE_SUFFIX:
+		return tableSuffix(message.Table)
+	case COMPUTED_KEY_HASH:
+		if message.Key == "" {
+			return nil
+		}
+		hash := crc32.ChecksumIEEE([]byte(message.Key))
+		if field.modulo > 0 {
+			hash %= field.modulo
+		}
+		return hash
+	}
+	return nil
+}
+
+// 在消息中追加计算字段，无法解析的消息原样返回
+func (dumpConfig *DumpConfig) appendComputedFields(data *mysql.EventReslut, messages []string, now time.Time) []string {
+	appended := make([]string, 0, len(messages))
+	for _, message := range messages {
+		parsed := new(mysql.FormatDataJsonStruct)
+		decoder := json.NewDecoder(bytes.NewReader([]byte(message)))
+		decoder.UseNumber()
+		if err := decoder.Decode(parsed); err != nil {
+			appended = append(appended, message)
+			continue
+		}
+		if parsed.Fields == nil {
+			parsed.Fields = make(map[string]driver.Value, len(dumpConfig.computedFields))
+		}
+		for _, field := range dumpConfig.computedFields {
+			parsed.Fields[field.name] = field.compute(dumpConfig, data, parsed, now)
+		}
+		appended = append(appended, mysql.FormatEventDataJson(parsed))
+	}
+	return appended
+}
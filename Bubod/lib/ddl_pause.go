@@ -0,0 +1,157 @@
+// DDL 暂停
+// 数据源配置 ddl_pause=true 时，同步的表的 DDL 投递前暂停同步，输出不会收到该 DDL 及之后的事件，
+// 下游完成表结构变更后调用 POST /instances/{name}/ddl_ack 确认，从该 DDL 开始继续投递；等待确认期间 resume 返回错误。
+// RENAME 的新旧表、DROP TABLE 的多个表任一同步时暂停，库级 DDL(CREATE/DROP DATABASE 等)不暂停。
+// 暂停时记录日志和审计，调用 DDLPauseCallback，配置了 ddl_pause_webhook 时同时 POST 到该地址；
+// 等待确认的 DDL 见实例状态的 pending_ddl 和指标 bubod_ddl_paused。
+// 已确认的 DDL 在重连后再次读取时不再暂停；停止实例后等待确认的 DDL 未投递，重新启动后再次暂停。
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"bubod/Bubod/logger"
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+// 等待确认的 DDL
+type PendingDDL struct {
+	SchemaName     string `json:"db"`
+	TableName      string `json:"table"`
+	Statement      string `json:"statement"`
+	BinlogFile     string `json:"binlog_file"`
+	BinlogPosition uint32 `json:"binlog_position"`
+	Time           int64  `json:"time"` // 暂停的时间
+}
+
+// DDL 暂停告警
+type DDLPauseAlert struct {
+	Source string `json:"source"`
+	*PendingDDL
+}
+
+// DDL 暂停回调，供内嵌使用
+var DDLPauseCallback func(alert *DDLPauseAlert)
+
+type ddlPause struct {
+	lock    sync.Mutex
+	pending *PendingDDL
+	acked   string // 最后确认的 DDL 位点 file:pos
+}
+
+func ddlPauseKey(file string, position uint32) string {
+	return fmt.Sprintf("%s:%d", file, position)
+}
+
+// 等待确认的 DDL，没有时返回 nil
+func (pause *ddlPause) get() *PendingDDL {
+	pause.lock.Lock()
+	defer pause.lock.Unlock()
+	return pause.pending
+}
+
+// 重新启动实例时丢弃等待确认的 DDL，未投递，再次读取时重新暂停
+func (pause *ddlPause) reset(name string) {
+	pause.lock.Lock()
+	pause.pending = nil
+	pause.lock.Unlock()
+	metrics.DDLPaused.Set(0, name)
+}
+
+// ddl_pause=true 时返回 BinlogDump.PauseBefore，已在 checkConf 中检查
+func (dumpConfig *DumpConfig) ddlPauseHook() func(event *mysql.EventReslut) bool {
+	if enabled, _ := dumpConfig.sourceConf().GetBool("ddl_pause", false); !enabled {
+		return nil
+	}
+	return dumpConfig.pauseBeforeDDL
+}
+
+// DDL 是否涉及同步的表
+func (dumpConfig *DumpConfig) isSyncDDL(ddl *mysql.DDLEvent) bool {
+	if ddl.TableName != "" && dumpConfig.IsSyncTable(ddl.SchemaName, ddl.TableName) {
+		return true
+	}
+	for _, rename := range ddl.Renames {
+		if dumpConfig.IsSyncTable(rename.SchemaName, rename.TableName) || dumpConfig.IsSyncTable(rename.NewSchemaName, rename.NewTableName) {
+			return true
+		}
+	}
+	for _, table := range ddl.Tables {
+		if dumpConfig.IsSyncTable(table.SchemaName, table.TableName) {
+			return true
+		}
+	}
+	return false
+}
+
+// 投递前调用，同步的表的 DDL 未确认时暂停
+func (dumpConfig *DumpConfig) pauseBeforeDDL(event *mysql.EventReslut) bool {
+	if event.DDL == nil || !dumpConfig.isSyncDDL(event.DDL) {
+		return false
+	}
+	pause := dumpConfig.ddlPause
+	pending := &PendingDDL{
+		SchemaName:     event.DDL.SchemaName,
+		TableName:      event.DDL.TableName,
+		Statement:      event.DDL.Statement,
+		BinlogFile:     event.BinlogFileName,
+		BinlogPosition: event.BinlogPosition,
+		Time:           time.Now().Unix(),
+	}
+	pause.lock.Lock()
+	if pause.acked == ddlPauseKey(pending.BinlogFile, pending.BinlogPosition) {
+		pause.lock.Unlock()
+		return false
+	}
+	pause.pending = pending
+	pause.lock.Unlock()
+
+	metrics.DDLPaused.Set(1, dumpConfig.Name)
+	dumpConfig.logEntry().With(logger.Fields{
+		"binlog_file": pending.BinlogFile,
+		"binlog_pos":  pending.BinlogPosition,
+		"db":          pending.SchemaName,
+		"table":       pending.TableName,
+		"statement":   pending.Statement,
+	}).Warn("pause before ddl, waiting for acknowledgement")
+	Audit(AUDIT_ACTOR_SYSTEM, AUDIT_ACTION_DDL_PAUSE, dumpConfig, pending.Statement, nil)
+	alert := &DDLPauseAlert{Source: dumpConfig.Name, PendingDDL: pending}
+	if DDLPauseCallback != nil {
+		go DDLPauseCallback(alert)
+	}
+	if webhook := dumpConfig.GetSourceVal("ddl_pause_webhook"); webhook != "" {
+		go postAlert(webhook, dumpConfig.Name, alert)
+	}
+	return true
+}
+
+// 确认等待中的 DDL 并恢复同步
+func (manager *InstanceManager) AckDDL(name string) (*PendingDDL, error) {
+	dump, err := manager.running(name)
+	if err != nil {
+		return nil, err
+	}
+	dumpConfig := dump.dumpConfig
+	pause := dumpConfig.ddlPause
+	pause.lock.Lock()
+	pending := pause.pending
+	if pending == nil {
+		pause.lock.Unlock()
+		return nil, fmt.Errorf("instance %s has no ddl waiting for acknowledgement", name)
+	}
+	pause.acked = ddlPauseKey(pending.BinlogFile, pending.BinlogPosition)
+	pause.pending = nil
+	pause.lock.Unlock()
+
+	metrics.DDLPaused.Set(0, dumpConfig.Name)
+	dumpConfig.logEntry().With(logger.Fields{
+		"binlog_file": pending.BinlogFile,
+		"binlog_pos":  pending.BinlogPosition,
+		"statement":   pending.Statement,
+	}).Info("ddl acknowledged, resume")
+	dump.binlogDump.Start()
+	return pending, nil
+}
@@ -0,0 +1,341 @@
+// 主备选举
+// 高可用部署时多个 bubod 进程使用相同的 cluster_name，只有选举为 leader 的进程启动数据源，其余进程等待；
+// leader 失去租约时停止所有数据源，重新当选后再启动。leader 保存位点时同时写入选举后端，
+// 新的 leader 启动时取本地文件和选举后端中较大的位点。
+//
+// [Election] type 选择后端，通过 RegisterElection 可以扩展:
+//
+//   - none(默认): 单节点，始终为 leader，不在后端保存位点
+//   - zookeeper: 临时节点 /{cluster_name}/master，servers 未配置时使用 [Zookeeper] server
+//   - etcd: etcd v3 HTTP 接口，租约 + 事务创建 key，见 election_etcd.go
+//   - consul: session + KV acquire，见 election_consul.go
+//   - kubernetes: coordination.k8s.io Lease，见 election_kubernetes.go
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+)
+
+const (
+	ELECTION_NONE       = "none"
+	ELECTION_ZOOKEEPER  = "zookeeper"
+	ELECTION_ETCD       = "etcd"
+	ELECTION_CONSUL     = "consul"
+	ELECTION_KUBERNETES = "kubernetes"
+)
+
+// 默认租约时长，leader 异常退出后其他进程最迟在该时长后接管
+const DEFAULT_ELECTION_TTL = 15 * time.Second
+
+// 选举后端
+type ElectionManager interface {
+	// 参与选举，阻塞直到 Close
+	Run()
+	// leader 状态变化，只保留最新的状态
+	Changes() <-chan bool
+	IsLeader() bool
+	// 与后端的连接是否正常，用于健康检查
+	Connected() bool
+	// 保存和读取数据源的位点，key 为数据源名称
+	SetData(key string, data string) error
+	GetData(key string) string
+	Close() error
+}
+
+// 选举配置，[Election] 配置组
+type ElectionConfig struct {
+	Type    string
+	Servers []string      // 后端地址
+	Prefix  string        // key 前缀，默认为 /bubod/{cluster_name}
+	Node    string        // 本进程标识，默认为 node_name
+	TTL     time.Duration // 租约时长
+	Conf    map[string]string
+}
+
+// 根据 [Election] 配置创建后端
+type ElectionFactory func(conf *ElectionConfig) (ElectionManager, error)
+
+var (
+	electionFactoryLock sync.RWMutex
+	electionFactories   = make(map[string]ElectionFactory)
+)
+
+// 注册选举后端
+func RegisterElection(typ string, factory ElectionFactory) {
+	electionFactoryLock.Lock()
+	electionFactories[typ] = factory
+	electionFactoryLock.Unlock()
+}
+
+func init() {
+	RegisterElection(ELECTION_NONE, newSingleNodeElection)
+	RegisterElection(ELECTION_ZOOKEEPER, newZookeeperElection)
+	RegisterElection(ELECTION_ETCD, newEtcdElection)
+	RegisterElection(ELECTION_CONSUL, newConsulElection)
+	RegisterElection(ELECTION_KUBERNETES, newKubernetesElection)
+}
+
+// 进程的选举后端，Run 启动时初始化，数据源通过 DumpConfig.ElectionManager 使用
+var Election ElectionManager = &singleNodeElection{quit: make(chan struct{})}
+
+func newElectionConfig(conf map[string]map[string]string) (*ElectionConfig, error) {
+	section := config.Section(conf["Election"])
+	ttl, err := section.GetDuration("ttl", DEFAULT_ELECTION_TTL)
+	if err != nil {
+		return nil, err
+	}
+	if ttl < 3*time.Second {
+		return nil, fmt.Errorf("election ttl %s is too short, must be at least 3s", ttl)
+	}
+	electionConfig := &ElectionConfig{
+		Type:    section.GetString("type", ELECTION_NONE),
+		Servers: section.GetStringSlice("servers", nil),
+		Prefix:  strings.TrimRight(section.GetString("prefix", "/bubod/"+conf["Bubod"]["cluster_name"]), "/"),
+		Node:    section.GetString("node", conf["Bubod"]["node_name"]),
+		TTL:     ttl,
+		Conf:    conf["Election"],
+	}
+	// 兼容 [Zookeeper] server 配置
+	if electionConfig.Type == ELECTION_ZOOKEEPER && len(electionConfig.Servers) == 0 {
+		electionConfig.Servers = config.Section(conf["Zookeeper"]).GetStringSlice("server", nil)
+	}
+	// kubernetes 默认使用集群内的 API Server 地址
+	if electionConfig.Type != ELECTION_NONE && electionConfig.Type != ELECTION_KUBERNETES && len(electionConfig.Servers) == 0 {
+		return nil, fmt.Errorf("election %s requires servers", electionConfig.Type)
+	}
+	return electionConfig, nil
+}
+
+// 根据 [Election] 配置创建选举后端
+func NewElection(conf map[string]map[string]string) (ElectionManager, error) {
+	electionConfig, err := newElectionConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	electionFactoryLock.RLock()
+	factory, ok := electionFactories[electionConfig.Type]
+	electionFactoryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown election type %q", electionConfig.Type)
+	}
+	return factory(electionConfig)
+}
+
+// leader 状态，各后端共用
+type electionState struct {
+	sync.Mutex
+	leader    int32
+	connected int32
+	once      sync.Once
+	changes   chan bool
+}
+
+func (state *electionState) Changes() <-chan bool {
+	return state.changesChan()
+}
+
+func (state *electionState) changesChan() chan bool {
+	state.once.Do(func() { state.changes = make(chan bool, 1) })
+	return state.changes
+}
+
+func (state *electionState) IsLeader() bool {
+	return atomic.LoadInt32(&state.leader) == 1
+}
+
+func (state *electionState) Connected() bool {
+	return atomic.LoadInt32(&state.connected) == 1
+}
+
+func (state *electionState) setConnected(connected bool) {
+	var v int32
+	if connected {
+		v = 1
+	}
+	atomic.StoreInt32(&state.connected, v)
+}
+
+// 更新 leader 状态，变化时通知，未读取的旧状态被替换
+func (state *electionState) setLeader(leader bool) {
+	state.Lock()
+	defer state.Unlock()
+	var v int32
+	if leader {
+		v = 1
+	}
+	if atomic.SwapInt32(&state.leader, v) == v {
+		return
+	}
+	changes := state.changesChan()
+	select {
+	case <-changes:
+	default:
+	}
+	changes <- leader
+}
+
+// 单节点，始终为 leader
+type singleNodeElection struct {
+	electionState
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSingleNodeElection(conf *ElectionConfig) (ElectionManager, error) {
+	return &singleNodeElection{quit: make(chan struct{})}, nil
+}
+
+func (election *singleNodeElection) Run() {
+	election.setConnected(true)
+	election.setLeader(true)
+	<-election.quit
+}
+
+func (election *singleNodeElection) SetData(key string, data string) error { return nil }
+func (election *singleNodeElection) GetData(key string) string             { return "" }
+
+func (election *singleNodeElection) Close() error {
+	election.closeOnce.Do(func() { close(election.quit) })
+	return nil
+}
+
+// 基于租约的后端: 定期续约，失败时失去 leader；非 leader 时定期尝试获取
+type leaseBackend interface {
+	// 创建租约并尝试成为 leader
+	acquire() (bool, error)
+	// 续约
+	renew() error
+	// 释放租约，其他进程可以立即当选
+	release() error
+	setData(key string, data string) error
+	getData(key string) (string, error)
+}
+
+type leaseElection struct {
+	electionState
+	name      string // 后端类型，用于日志
+	backend   leaseBackend
+	interval  time.Duration
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLeaseElection(name string, backend leaseBackend, ttl time.Duration) *leaseElection {
+	return &leaseElection{
+		name:     name,
+		backend:  backend,
+		interval: ttl / 3,
+		quit:     make(chan struct{}),
+	}
+}
+
+func (election *leaseElection) logEntry() *logger.Entry {
+	return logger.With(logger.Fields{"election": election.name})
+}
+
+func (election *leaseElection) Run() {
+	ticker := time.NewTicker(election.interval)
+	defer ticker.Stop()
+	for {
+		election.tick()
+		select {
+		case <-election.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (election *leaseElection) tick() {
+	if election.IsLeader() {
+		if err := election.backend.renew(); err != nil {
+			election.logEntry().WithError(err).Warn("renew lease, lost leadership")
+			election.setConnected(false)
+			election.setLeader(false)
+		}
+		return
+	}
+	leader, err := election.backend.acquire()
+	election.setConnected(err == nil)
+	if err != nil {
+		election.logEntry().WithError(err).Warn("acquire leadership")
+		return
+	}
+	if leader {
+		election.logEntry().Info("elected as leader")
+	}
+	election.setLeader(leader)
+}
+
+func (election *leaseElection) SetData(key string, data string) error {
+	return election.backend.setData(key, data)
+}
+
+func (election *leaseElection) GetData(key string) string {
+	data, err := election.backend.getData(key)
+	if err != nil {
+		election.logEntry().With(logger.Fields{"key": key}).WithError(err).Error("get data")
+	}
+	return data
+}
+
+func (election *leaseElection) Close() error {
+	var err error
+	election.closeOnce.Do(func() {
+		close(election.quit)
+		if election.IsLeader() {
+			err = election.backend.release()
+			election.setLeader(false)
+		}
+	})
+	return err
+}
+
+// 选举后端 HTTP 请求超时
+const ELECTION_HTTP_TIMEOUT = 3 * time.Second
+
+var electionHTTPClient = &http.Client{Timeout: ELECTION_HTTP_TIMEOUT}
+
+// 依次请求各个地址，返回第一个有响应的结果，状态码由调用方判断
+// 地址不带 scheme 时使用 http://，client 为 nil 时使用 electionHTTPClient
+func electionHTTP(client *http.Client, servers []string, method string, path string, header map[string]string, body []byte) (int, []byte, error) {
+	if client == nil {
+		client = electionHTTPClient
+	}
+	lastErr := fmt.Errorf("no election servers")
+	for _, server := range servers {
+		if !strings.Contains(server, "://") {
+			server = "http://" + server
+		}
+		req, err := http.NewRequest(method, strings.TrimRight(server, "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return 0, nil, err
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp.StatusCode, data, nil
+	}
+	return 0, nil, lastErr
+}
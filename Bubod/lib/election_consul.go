@@ -0,0 +1,154 @@
+// consul 选举
+// 通过 consul HTTP API 实现:
+//
+//   - 创建 ttl 的 session(Behavior=delete)，以该 session acquire {prefix}/master，成功即为 leader
+//   - leader 每 ttl/3 续约 session，session 失效时失去 leader，key 随 session 删除
+//   - 位点保存在 {prefix}/positions/{数据源名称}
+//
+// consul 要求 session ttl 在 10s 到 24h 之间；配置 token 时通过 X-Consul-Token 传递。
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type consulBackend struct {
+	sync.Mutex
+	servers []string
+	header  map[string]string
+	key     string // leader key
+	prefix  string
+	node    string
+	ttl     time.Duration
+	session string // 当前 session，为空表示没有
+}
+
+func newConsulElection(conf *ElectionConfig) (ElectionManager, error) {
+	if conf.TTL < 10*time.Second || conf.TTL > 24*time.Hour {
+		return nil, fmt.Errorf("consul election ttl %s must be between 10s and 24h", conf.TTL)
+	}
+	backend := &consulBackend{
+		servers: conf.Servers,
+		header:  make(map[string]string),
+		// consul key 不以 / 开头
+		key:    strings.TrimLeft(conf.Prefix, "/") + "/master",
+		prefix: strings.TrimLeft(conf.Prefix, "/") + "/positions/",
+		node:   conf.Node,
+		ttl:    conf.TTL,
+	}
+	if token := conf.Conf["token"]; token != "" {
+		backend.header["X-Consul-Token"] = token
+	}
+	return newLeaseElection(ELECTION_CONSUL, backend, conf.TTL), nil
+}
+
+func (backend *consulBackend) call(method string, path string, body []byte) (int, []byte, error) {
+	status, data, err := electionHTTP(nil, backend.servers, method, path, backend.header, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return status, nil, fmt.Errorf("consul %s %s: %d %s", method, path, status, data)
+	}
+	return status, data, nil
+}
+
+// 续约，session 已失效时返回错误
+func (backend *consulBackend) renewSession(session string) error {
+	status, _, err := backend.call("PUT", "/v1/session/renew/"+session, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		return fmt.Errorf("consul session %s expired", session)
+	}
+	return nil
+}
+
+// 获取可用的 session: 已有 session 时续约，失效时重新创建
+func (backend *consulBackend) ensureSession() (string, error) {
+	if backend.session != "" {
+		if err := backend.renewSession(backend.session); err == nil {
+			return backend.session, nil
+		}
+		backend.session = ""
+	}
+	body, _ := json.Marshal(map[string]string{
+		"Name":     "bubod-" + backend.node,
+		"TTL":      backend.ttl.String(),
+		"Behavior": "delete",
+	})
+	_, data, err := backend.call("PUT", "/v1/session/create", body)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", err
+	}
+	if resp.ID == "" {
+		return "", fmt.Errorf("consul session create: empty session id")
+	}
+	backend.session = resp.ID
+	return resp.ID, nil
+}
+
+func (backend *consulBackend) acquire() (bool, error) {
+	backend.Lock()
+	defer backend.Unlock()
+	session, err := backend.ensureSession()
+	if err != nil {
+		return false, err
+	}
+	_, data, err := backend.call("PUT", "/v1/kv/"+backend.key+"?acquire="+url.QueryEscape(session), []byte(backend.node))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) == "true", nil
+}
+
+func (backend *consulBackend) renew() error {
+	backend.Lock()
+	defer backend.Unlock()
+	if backend.session == "" {
+		return fmt.Errorf("consul session not created")
+	}
+	if err := backend.renewSession(backend.session); err != nil {
+		backend.session = ""
+		return err
+	}
+	return nil
+}
+
+func (backend *consulBackend) release() error {
+	backend.Lock()
+	defer backend.Unlock()
+	if backend.session == "" {
+		return nil
+	}
+	session := backend.session
+	backend.session = ""
+	_, _, err := backend.call("PUT", "/v1/session/destroy/"+session, nil)
+	return err
+}
+
+func (backend *consulBackend) setData(key string, data string) error {
+	_, _, err := backend.call("PUT", "/v1/kv/"+backend.prefix+key, []byte(data))
+	return err
+}
+
+func (backend *consulBackend) getData(key string) (string, error) {
+	status, data, err := backend.call("GET", "/v1/kv/"+backend.prefix+key+"?raw", nil)
+	if err != nil || status == http.StatusNotFound {
+		return "", err
+	}
+	return string(data), nil
+}
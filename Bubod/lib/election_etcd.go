@@ -0,0 +1,173 @@
+// etcd 选举
+// 通过 etcd v3 的 HTTP 网关(/v3/...，etcd 3.4 及以上)实现，不依赖 etcd 客户端:
+//
+//   - 创建 ttl 租约，事务在 {prefix}/master 不存在时写入本进程标识并绑定租约，成功即为 leader
+//   - leader 每 ttl/3 续约，续约失败或租约过期时失去 leader，key 随租约删除
+//   - 位点保存在 {prefix}/positions/{数据源名称}
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+type etcdBackend struct {
+	sync.Mutex
+	servers []string
+	key     string // leader key
+	prefix  string
+	node    string
+	ttl     int64 // 秒
+	lease   int64 // 当前租约，0 表示没有
+}
+
+func newEtcdElection(conf *ElectionConfig) (ElectionManager, error) {
+	backend := &etcdBackend{
+		servers: conf.Servers,
+		key:     conf.Prefix + "/master",
+		prefix:  conf.Prefix + "/positions/",
+		node:    conf.Node,
+		ttl:     int64(conf.TTL.Seconds()),
+	}
+	return newLeaseElection(ELECTION_ETCD, backend, conf.TTL), nil
+}
+
+func etcdEncode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// 请求 etcd 网关，int64 字段在 JSON 中为字符串
+func (backend *etcdBackend) call(path string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	status, data, err := electionHTTP(nil, backend.servers, "POST", path, nil, body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("etcd %s: %d %s", path, status, data)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(data, resp)
+}
+
+// 续约，租约已过期时返回错误
+func (backend *etcdBackend) keepAlive(lease int64) error {
+	var resp struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	err := backend.call("/v3/lease/keepalive", map[string]string{"ID": strconv.FormatInt(lease, 10)}, &resp)
+	if err != nil {
+		return err
+	}
+	if ttl, _ := strconv.ParseInt(resp.Result.TTL, 10, 64); ttl <= 0 {
+		return fmt.Errorf("etcd lease %d expired", lease)
+	}
+	return nil
+}
+
+// 获取可用的租约: 已有租约时续约，过期时重新创建
+func (backend *etcdBackend) ensureLease() (int64, error) {
+	if backend.lease != 0 {
+		if err := backend.keepAlive(backend.lease); err == nil {
+			return backend.lease, nil
+		}
+		backend.lease = 0
+	}
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	err := backend.call("/v3/lease/grant", map[string]string{"TTL": strconv.FormatInt(backend.ttl, 10)}, &resp)
+	if err != nil {
+		return 0, err
+	}
+	lease, err := strconv.ParseInt(resp.ID, 10, 64)
+	if err != nil || lease == 0 {
+		return 0, fmt.Errorf("etcd lease grant: invalid lease id %q", resp.ID)
+	}
+	backend.lease = lease
+	return lease, nil
+}
+
+func (backend *etcdBackend) acquire() (bool, error) {
+	backend.Lock()
+	defer backend.Unlock()
+	lease, err := backend.ensureLease()
+	if err != nil {
+		return false, err
+	}
+	key := etcdEncode(backend.key)
+	req := map[string]interface{}{
+		"compare": []map[string]string{
+			{"key": key, "target": "CREATE", "create_revision": "0"},
+		},
+		"success": []map[string]interface{}{
+			{"request_put": map[string]string{"key": key, "value": etcdEncode(backend.node), "lease": strconv.FormatInt(lease, 10)}},
+		},
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := backend.call("/v3/kv/txn", req, &resp); err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (backend *etcdBackend) renew() error {
+	backend.Lock()
+	defer backend.Unlock()
+	if backend.lease == 0 {
+		return fmt.Errorf("etcd lease not granted")
+	}
+	if err := backend.keepAlive(backend.lease); err != nil {
+		backend.lease = 0
+		return err
+	}
+	return nil
+}
+
+func (backend *etcdBackend) release() error {
+	backend.Lock()
+	defer backend.Unlock()
+	if backend.lease == 0 {
+		return nil
+	}
+	lease := backend.lease
+	backend.lease = 0
+	return backend.call("/v3/lease/revoke", map[string]string{"ID": strconv.FormatInt(lease, 10)}, nil)
+}
+
+func (backend *etcdBackend) setData(key string, data string) error {
+	req := map[string]string{"key": etcdEncode(backend.prefix + key), "value": etcdEncode(data)}
+	return backend.call("/v3/kv/put", req, nil)
+}
+
+func (backend *etcdBackend) getData(key string) (string, error) {
+	var resp struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := backend.call("/v3/kv/range", map[string]string{"key": etcdEncode(backend.prefix + key)}, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	value, err := base64.StdEncoding.DecodeString(resp.Kvs[0].Value)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
@@ -0,0 +1,316 @@
+// kubernetes 选举
+// 通过 API Server 的 coordination.k8s.io/v1 Lease 实现，与 client-go leaderelection 的语义相同，不依赖 client-go:
+//
+//   - Lease 不存在时创建，holderIdentity 为本进程标识；已存在时 holder 为自己或 renewTime 超过
+//     leaseDurationSeconds 未更新才接管，更新带 resourceVersion，冲突时表示被其他副本抢先
+//   - leader 每 ttl/3 更新 renewTime，Lease 被其他副本接管或更新失败时失去 leader
+//   - 退出时清空 holderIdentity，其他副本可以立即接管
+//   - 位点保存在 ConfigMap {lease}-positions，key 为数据源名称
+//
+// 默认使用 Pod 内的 ServiceAccount 访问 API Server，需要 leases 和 configmaps 的 get/create/update/patch 权限。
+// 同一 Deployment 的副本配置相同，node 未配置时使用主机名(Pod 名称)作为本进程标识。
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KUBERNETES_SERVICE_ACCOUNT_DIR = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubernetesTimeFormat           = "2006-01-02T15:04:05.000000Z07:00" // MicroTime
+)
+
+// ConfigMap 的 key 只能包含字母、数字和 -._
+var kubernetesKeyInvalid = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+var kubernetesNameInvalid = regexp.MustCompile(`[^-.a-z0-9]+`)
+
+type kubernetesBackend struct {
+	sync.Mutex
+	client    *http.Client
+	servers   []string
+	tokenFile string
+	leasePath string // Lease 的 API 路径
+	dataPath  string // 保存位点的 ConfigMap 的 API 路径
+	dataName  string
+	namespace string
+	lease     string
+	node      string
+	ttl       int
+}
+
+type kubernetesLeaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+	LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+}
+
+type kubernetesLease struct {
+	ApiVersion string                 `json:"apiVersion"`
+	Kind       string                 `json:"kind"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	Spec       kubernetesLeaseSpec    `json:"spec"`
+}
+
+func newKubernetesElection(conf *ElectionConfig) (ElectionManager, error) {
+	section := conf.Conf
+	backend := &kubernetesBackend{
+		servers:   conf.Servers,
+		tokenFile: section["token_file"],
+		namespace: section["namespace"],
+		lease:     section["lease"],
+		node:      section["node"],
+		ttl:       int(conf.TTL.Seconds()),
+	}
+	if backend.tokenFile == "" {
+		backend.tokenFile = KUBERNETES_SERVICE_ACCOUNT_DIR + "/token"
+	}
+	// 集群内的 API Server 地址
+	if len(backend.servers) == 0 {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("kubernetes election requires servers outside the cluster")
+		}
+		backend.servers = []string{"https://" + net.JoinHostPort(host, port)}
+	}
+	if backend.namespace == "" {
+		namespace, err := ioutil.ReadFile(KUBERNETES_SERVICE_ACCOUNT_DIR + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes election namespace: %s", err)
+		}
+		backend.namespace = strings.TrimSpace(string(namespace))
+	}
+	if backend.lease == "" {
+		// 对象名只能包含小写字母、数字和 -.
+		backend.lease = strings.Trim(kubernetesNameInvalid.ReplaceAllString(strings.ToLower(conf.Prefix), "-"), "-.")
+	}
+	if backend.node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		backend.node = hostname
+	}
+
+	tlsConfig := &tls.Config{}
+	caFile := section["ca_file"]
+	if caFile == "" {
+		caFile = KUBERNETES_SERVICE_ACCOUNT_DIR + "/ca.crt"
+	}
+	if ca, err := ioutil.ReadFile(caFile); err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("kubernetes election ca_file %s: no certificate found", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	} else if section["ca_file"] != "" {
+		return nil, fmt.Errorf("kubernetes election ca_file: %s", err)
+	}
+	backend.client = &http.Client{
+		Timeout:   ELECTION_HTTP_TIMEOUT,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	backend.leasePath = fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", backend.namespace)
+	backend.dataName = backend.lease + "-positions"
+	backend.dataPath = fmt.Sprintf("/api/v1/namespaces/%s/configmaps", backend.namespace)
+	return newLeaseElection(ELECTION_KUBERNETES, backend, conf.TTL), nil
+}
+
+// 请求 API Server，每次读取 token 文件以支持自动轮换的 token
+func (backend *kubernetesBackend) call(method string, path string, contentType string, req interface{}, resp interface{}) (int, error) {
+	header := map[string]string{"Accept": "application/json"}
+	if token, err := ioutil.ReadFile(backend.tokenFile); err == nil {
+		header["Authorization"] = "Bearer " + strings.TrimSpace(string(token))
+	}
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return 0, err
+		}
+		header["Content-Type"] = contentType
+	}
+	status, data, err := electionHTTP(backend.client, backend.servers, method, path, header, body)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case status == http.StatusNotFound || status == http.StatusConflict:
+		return status, nil
+	case status < 200 || status >= 300:
+		return status, fmt.Errorf("kubernetes %s %s: %d %s", method, path, status, data)
+	}
+	if resp != nil {
+		if err := json.Unmarshal(data, resp); err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+func (backend *kubernetesBackend) getLease() (*kubernetesLease, error) {
+	lease := &kubernetesLease{}
+	status, err := backend.call("GET", backend.leasePath+"/"+backend.lease, "", nil, lease)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	return lease, nil
+}
+
+// 租约是否已过期
+func (backend *kubernetesBackend) expired(spec *kubernetesLeaseSpec, now time.Time) bool {
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil {
+		return true
+	}
+	renewTime, err := time.Parse(time.RFC3339Nano, *spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	duration := backend.ttl
+	if spec.LeaseDurationSeconds != nil {
+		duration = *spec.LeaseDurationSeconds
+	}
+	return now.After(renewTime.Add(time.Duration(duration) * time.Second))
+}
+
+// 创建或更新 Lease，冲突时返回 false
+func (backend *kubernetesBackend) tryAcquireOrRenew(renew bool) (bool, error) {
+	now := time.Now()
+	nowStr := now.Format(kubernetesTimeFormat)
+	lease, err := backend.getLease()
+	if err != nil {
+		return false, err
+	}
+	if lease == nil {
+		if renew {
+			return false, fmt.Errorf("kubernetes lease %s deleted", backend.lease)
+		}
+		transitions := 0
+		lease = &kubernetesLease{
+			ApiVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   map[string]interface{}{"name": backend.lease, "namespace": backend.namespace},
+			Spec: kubernetesLeaseSpec{
+				HolderIdentity:       &backend.node,
+				LeaseDurationSeconds: &backend.ttl,
+				AcquireTime:          &nowStr,
+				RenewTime:            &nowStr,
+				LeaseTransitions:     &transitions,
+			},
+		}
+		status, err := backend.call("POST", backend.leasePath, "application/json", lease, nil)
+		return err == nil && status != http.StatusConflict, err
+	}
+
+	spec := &lease.Spec
+	holder := spec.HolderIdentity != nil && *spec.HolderIdentity == backend.node
+	if !holder {
+		if renew {
+			return false, fmt.Errorf("kubernetes lease %s taken over", backend.lease)
+		}
+		if !backend.expired(spec, now) {
+			return false, nil
+		}
+		// 接管其他副本的租约
+		transitions := 1
+		if spec.LeaseTransitions != nil {
+			transitions = *spec.LeaseTransitions + 1
+		}
+		spec.HolderIdentity = &backend.node
+		spec.AcquireTime = &nowStr
+		spec.LeaseTransitions = &transitions
+	}
+	spec.LeaseDurationSeconds = &backend.ttl
+	spec.RenewTime = &nowStr
+	// metadata 带 resourceVersion，被其他副本修改后返回 409
+	status, err := backend.call("PUT", backend.leasePath+"/"+backend.lease, "application/json", lease, nil)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound || status == http.StatusConflict {
+		if renew {
+			return false, fmt.Errorf("kubernetes lease %s update conflict", backend.lease)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+func (backend *kubernetesBackend) acquire() (bool, error) {
+	backend.Lock()
+	defer backend.Unlock()
+	return backend.tryAcquireOrRenew(false)
+}
+
+func (backend *kubernetesBackend) renew() error {
+	backend.Lock()
+	defer backend.Unlock()
+	_, err := backend.tryAcquireOrRenew(true)
+	return err
+}
+
+// 清空 holderIdentity，与 client-go 的 ReleaseOnCancel 相同
+func (backend *kubernetesBackend) release() error {
+	backend.Lock()
+	defer backend.Unlock()
+	lease, err := backend.getLease()
+	if err != nil || lease == nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != backend.node {
+		return nil
+	}
+	empty, duration, now := "", 1, time.Now().Format(kubernetesTimeFormat)
+	lease.Spec.HolderIdentity = &empty
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+	_, err = backend.call("PUT", backend.leasePath+"/"+backend.lease, "application/json", lease, nil)
+	return err
+}
+
+func (backend *kubernetesBackend) setData(key string, data string) error {
+	key = kubernetesKeyInvalid.ReplaceAllString(key, "_")
+	patch := map[string]interface{}{"data": map[string]string{key: data}}
+	status, err := backend.call("PATCH", backend.dataPath+"/"+backend.dataName, "application/merge-patch+json", patch, nil)
+	if err != nil || status != http.StatusNotFound {
+		return err
+	}
+	configMap := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]string{"name": backend.dataName, "namespace": backend.namespace},
+		"data":       map[string]string{key: data},
+	}
+	status, err = backend.call("POST", backend.dataPath, "application/json", configMap, nil)
+	if err == nil && status == http.StatusConflict {
+		// 其他副本同时创建，重新写入
+		_, err = backend.call("PATCH", backend.dataPath+"/"+backend.dataName, "application/merge-patch+json", patch, nil)
+	}
+	return err
+}
+
+func (backend *kubernetesBackend) getData(key string) (string, error) {
+	var configMap struct {
+		Data map[string]string `json:"data"`
+	}
+	status, err := backend.call("GET", backend.dataPath+"/"+backend.dataName, "", nil, &configMap)
+	if err != nil || status == http.StatusNotFound {
+		return "", err
+	}
+	return configMap.Data[kubernetesKeyInvalid.ReplaceAllString(key, "_")], nil
+}
@@ -0,0 +1,72 @@
+// 健康检查
+//   /healthz  进程存活，且与选举后端的连接正常([Election] type=none 时始终正常)
+//   /readyz   所有已启动实例的 dump 连接已建立，且复制延迟不超过 [Bubod] ready_max_delay 秒
+package lib
+
+import (
+	"fmt"
+	"net/http"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/mysql"
+)
+
+type healthCheck struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, checks []*healthCheck) {
+	code := http.StatusOK
+	var err error
+	for _, check := range checks {
+		if !check.Ok {
+			code = http.StatusServiceUnavailable
+			err = fmt.Errorf("%s: %s", check.Name, check.Error)
+			break
+		}
+	}
+	writeJson(w, code, checks, err)
+}
+
+func registerHealthApi(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	checks := []*healthCheck{{Name: "process", Ok: true}}
+	check := &healthCheck{Name: "election", Ok: Election.Connected()}
+	if !check.Ok {
+		check.Error = "election backend disconnected"
+	}
+	checks = append(checks, check)
+	writeHealth(w, checks)
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	maxDelay, _ := config.Section(Instances.conf["Bubod"]).GetInt("ready_max_delay", 0)
+	checks := make([]*healthCheck, 0)
+	for _, status := range Instances.List() {
+		// 通过管理接口停止的实例和已完成有界回放的实例不参与检查
+		if status.State == mysql.STATE_CLOSED.String() || status.State == mysql.STATE_COMPLETED.String() {
+			continue
+		}
+		check := &healthCheck{Name: status.Name, Ok: true}
+		switch {
+		case status.State != mysql.STATE_RUNNING.String() && status.State != mysql.STATE_PAUSED.String():
+			check.Ok = false
+			check.Error = "dump connection is " + status.State
+		// master 空闲时没有新事件，延迟会持续增长
+		case maxDelay > 0 && status.Delay > maxDelay:
+			check.Ok = false
+			check.Error = fmt.Sprintf("replication delay %ds exceeds %ds", status.Delay, maxDelay)
+		}
+		checks = append(checks, check)
+	}
+	if len(checks) == 0 {
+		checks = append(checks, &healthCheck{Name: "instances", Error: "no running instance"})
+	}
+	writeHealth(w, checks)
+}
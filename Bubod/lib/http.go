@@ -0,0 +1,39 @@
+// 内置 http 服务
+package lib
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"bubod/Bubod/logger"
+	"bubod/Bubod/metrics"
+)
+
+// 启动 http 服务，listen 为 [Bubod] listen 配置，只写端口(如 :9167)时仅监听 127.0.0.1
+//   /metrics     Prometheus 指标
+//   /instances   管理接口，见 admin.go
+//   /healthz     存活检查，见 health.go
+//   /readyz      就绪检查
+func StartHttpServer(listen string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	registerAdminApi(mux)
+	registerHealthApi(mux)
+
+	if strings.HasPrefix(listen, ":") {
+		listen = "127.0.0.1" + listen
+	}
+	if host, _, err := net.SplitHostPort(listen); err == nil && adminToken() == "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			logger.With(logger.Fields{"listen": listen}).Warn("admin api is reachable from other hosts without authentication, set [Bubod] admin_token")
+		}
+	}
+
+	go func() {
+		logger.Info("http server listen", listen)
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			logger.WithError(err).Error("http server")
+		}
+	}()
+}
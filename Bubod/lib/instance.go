@@ -0,0 +1,497 @@
+// 数据源实例管理
+// 每个数据源是一个具名实例，可在运行时添加、删除、启动、停止，无需重启进程。
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+// 停止实例时等待 dump 协程退出的最长时间
+const INSTANCE_STOP_TIMEOUT = 30 * time.Second
+
+// 所有数据源实例，Run 启动时初始化
+var Instances *InstanceManager
+
+type instance struct {
+	sync.Mutex
+	dumpConfig *DumpConfig
+	dump       *dump // 未启动或已停止时为 nil
+	seeked     bool  // 已通过 Seek 指定起始位点，下次启动不再取最大位点
+}
+
+type InstanceManager struct {
+	sync.RWMutex
+	conf      map[string]map[string]string // 所有配置
+	names     []string                     // 按添加顺序
+	instances map[string]*instance
+}
+
+func NewInstanceManager(conf map[string]map[string]string) *InstanceManager {
+	return &InstanceManager{
+		conf:      conf,
+		names:     make([]string, 0),
+		instances: make(map[string]*instance, 0),
+	}
+}
+
+func (manager *InstanceManager) get(name string) (*instance, error) {
+	manager.RLock()
+	defer manager.RUnlock()
+	ins, ok := manager.instances[name]
+	if !ok {
+		return nil, fmt.Errorf("instance %s not found", name)
+	}
+	return ins, nil
+}
+
+// 添加实例，source 为数据源配置，配置项与 [Database] 相同；添加后需要 Start 才开始同步
+func (manager *InstanceManager) Add(name string, source map[string]string) error {
+	dumpConfig, err := NewDumpConfig(manager.conf, name, source)
+	if err != nil {
+		return err
+	}
+	manager.Lock()
+	defer manager.Unlock()
+	if _, ok := manager.instances[name]; ok {
+		return fmt.Errorf("instance %s already exists", name)
+	}
+	manager.names = append(manager.names, name)
+	manager.instances[name] = &instance{dumpConfig: dumpConfig}
+	return nil
+}
+
+// 停止并删除实例，位点文件保留
+func (manager *InstanceManager) Remove(name string) error {
+	ins, err := manager.get(name)
+	if err != nil {
+		return err
+	}
+	if err := ins.stop(); err != nil {
+		return err
+	}
+	metrics.DefaultRegistry.DeleteByFirstLabel(name)
+
+	manager.Lock()
+	defer manager.Unlock()
+	delete(manager.instances, name)
+	for i, n := range manager.names {
+		if n == name {
+			manager.names = append(manager.names[:i], manager.names[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// 从最新位点开始同步
+func (manager *InstanceManager) Start(name string) error {
+	ins, err := manager.get(name)
+	if err != nil {
+		return err
+	}
+	return ins.start()
+}
+
+// 停止同步并保存位点，可再次 Start
+func (manager *InstanceManager) Stop(name string) error {
+	ins, err := manager.get(name)
+	if err != nil {
+		return err
+	}
+	return ins.stop()
+}
+
+func (manager *InstanceManager) Status(name string) (*SourceStatus, error) {
+	ins, err := manager.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return ins.status(), nil
+}
+
+// 所有实例的状态，按添加顺序排列
+func (manager *InstanceManager) List() []*SourceStatus {
+	list := manager.instanceList()
+	status := make([]*SourceStatus, 0, len(list))
+	for _, ins := range list {
+		status = append(status, ins.status())
+	}
+	return status
+}
+
+// 停止所有实例，各实例并行停止，ctx 结束时返回未停止的实例错误
+func (manager *InstanceManager) Shutdown(ctx context.Context) error {
+	list := manager.instanceList()
+	errs := make(chan error, len(list))
+	for _, ins := range list {
+		go func(ins *instance) {
+			err := ins.shutdown(ctx)
+			Audit(AUDIT_ACTOR_SYSTEM, AUDIT_ACTION_STOP, ins.dumpConfig, "shutdown", err)
+			errs <- err
+		}(ins)
+	}
+	var err error
+	for range list {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 暂停同步，连接保持
+func (manager *InstanceManager) Pause(name string) error {
+	dump, err := manager.running(name)
+	if err != nil {
+		return err
+	}
+	dump.binlogDump.Stop()
+	return nil
+}
+
+// 恢复同步，DDL 等待确认时需要调用 AckDDL
+func (manager *InstanceManager) Resume(name string) error {
+	dump, err := manager.running(name)
+	if err != nil {
+		return err
+	}
+	if pending := dump.dumpConfig.ddlPause.get(); pending != nil {
+		return fmt.Errorf("instance %s is paused before ddl at %s:%d, acknowledge it with ddl_ack", name, pending.BinlogFile, pending.BinlogPosition)
+	}
+	dump.binlogDump.Start()
+	return nil
+}
+
+// 修改表过滤，格式同 tables/filter_tables 配置，立即生效
+func (manager *InstanceManager) SetFilter(name string, tables string, filterTables string) error {
+	ins, err := manager.get(name)
+	if err != nil {
+		return err
+	}
+	return ins.dumpConfig.SetFilter(tables, filterTables)
+}
+
+// 立即保存位点
+func (manager *InstanceManager) Flush(name string) (string, error) {
+	ins, err := manager.get(name)
+	if err != nil {
+		return "", err
+	}
+	return ins.dumpConfig.syncLastPos(), nil
+}
+
+// 修改起始位点，实例需要先停止，下次 Start 从该位点开始
+func (manager *InstanceManager) Seek(name string, file string, position uint32) error {
+	ins, err := manager.get(name)
+	if err != nil {
+		return err
+	}
+	return ins.seek(file, position)
+}
+
+// 修改起始 GTID 集合，实例需要先停止，下次 Start 从该集合之后开始
+func (manager *InstanceManager) SeekGTID(name string, gtidSet string) error {
+	ins, err := manager.get(name)
+	if err != nil {
+		return err
+	}
+	return ins.seekGTID(gtidSet)
+}
+
+// 全量导出表数据写入输出，实例需要运行中，返回导出的行数
+// table 格式为 database.table，表需要在同步范围内
+func (manager *InstanceManager) Snapshot(name string, table string) (int, error) {
+	dump, err := manager.running(name)
+	if err != nil {
+		return 0, err
+	}
+	i := strings.IndexByte(table, '.')
+	if i <= 0 || i == len(table)-1 {
+		return 0, fmt.Errorf("invalid table %s, must be database.table", table)
+	}
+	schemaName, tableName := table[:i], table[i+1:]
+	if !dump.dumpConfig.IsSyncTable(schemaName, tableName) {
+		return 0, fmt.Errorf("table %s is not synced", table)
+	}
+	// 与 binlog 回调串行写入输出，导出的行与同步的事件不会交错写入同一输出
+	return dump.binlogDump.SnapshotTable(schemaName, tableName, func(data *mysql.EventReslut) error {
+		dump.writeLock.Lock()
+		defer dump.writeLock.Unlock()
+		dump.writeSinks(data, mysql.FormatEventData(data))
+		return nil
+	})
+}
+
+// 缓存的表结构
+func (manager *InstanceManager) TableSchemas(name string) ([]*mysql.TableSchema, error) {
+	dump, err := manager.running(name)
+	if err != nil {
+		return nil, err
+	}
+	return dump.binlogDump.TableSchemas(), nil
+}
+
+// 表结构快照，all 为 true 时查询 master 上所有同步的表，否则为缓存和导入的表结构
+func (manager *InstanceManager) SchemaSnapshot(name string, all bool) (*mysql.SchemaSnapshot, error) {
+	dump, err := manager.running(name)
+	if err != nil {
+		return nil, err
+	}
+	if all {
+		return dump.binlogDump.QuerySchemaSnapshot()
+	}
+	return dump.binlogDump.SchemaSnapshot(), nil
+}
+
+// 按表统计，limit 大于 0 时只返回字节数最多的 limit 张表
+func (manager *InstanceManager) TableStats(name string, limit int) (*TableStatsReport, error) {
+	ins, err := manager.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return ins.dumpConfig.tableStats.report(time.Now(), limit), nil
+}
+
+// master 上的 binlog 文件、保留时间和已同步位点的清除状态，实例停止时连接配置的 master
+func (manager *InstanceManager) BinaryLogs(name string) (*PurgeStatus, error) {
+	ins, err := manager.get(name)
+	if err != nil {
+		return nil, err
+	}
+	var binlogDump *mysql.BinlogDump
+	ins.Lock()
+	if ins.dump != nil {
+		binlogDump = ins.dump.binlogDump
+	}
+	ins.Unlock()
+	return ins.dumpConfig.purgeStatus(binlogDump)
+}
+
+// 设置故障注入，实例需要运行中，[Bubod] fault_injection=true 时才允许
+func (manager *InstanceManager) SetFaults(name string, faults mysql.Faults) error {
+	if enabled, _ := config.Section(manager.conf["Bubod"]).GetBool("fault_injection", false); !enabled {
+		return fmt.Errorf("fault injection is disabled, set [Bubod] fault_injection=true")
+	}
+	dump, err := manager.running(name)
+	if err != nil {
+		return err
+	}
+	return dump.binlogDump.SetFaults(faults)
+}
+
+// 剩余的故障
+func (manager *InstanceManager) Faults(name string) (mysql.Faults, error) {
+	dump, err := manager.running(name)
+	if err != nil {
+		return mysql.Faults{}, err
+	}
+	return dump.binlogDump.Faults(), nil
+}
+
+// 获取运行中的 dump
+func (manager *InstanceManager) running(name string) (*dump, error) {
+	ins, err := manager.get(name)
+	if err != nil {
+		return nil, err
+	}
+	ins.Lock()
+	defer ins.Unlock()
+	if ins.dump == nil {
+		return nil, fmt.Errorf("instance %s is not running", name)
+	}
+	return ins.dump, nil
+}
+
+// 未停止的实例使用的输出，Shutdown 超时后这些实例的 dump 协程可能仍在写入
+func (manager *InstanceManager) runningSinks() map[*sinkEntry]bool {
+	inUse := make(map[*sinkEntry]bool)
+	for _, ins := range manager.instanceList() {
+		ins.Lock()
+		if ins.dump != nil {
+			for _, entry := range ins.dumpConfig.Sinks {
+				inUse[entry] = true
+			}
+		}
+		ins.Unlock()
+	}
+	return inUse
+}
+
+func (manager *InstanceManager) instanceList() []*instance {
+	manager.RLock()
+	defer manager.RUnlock()
+	list := make([]*instance, 0, len(manager.names))
+	for _, name := range manager.names {
+		list = append(list, manager.instances[name])
+	}
+	return list
+}
+
+func (ins *instance) start() error {
+	ins.Lock()
+	defer ins.Unlock()
+	if ins.dump != nil {
+		return fmt.Errorf("instance %s is running", ins.dumpConfig.Name)
+	}
+	// 高可用环境下非 leader 不启动
+	if !Election.IsLeader() {
+		return fmt.Errorf("instance %s: this node is not the leader", ins.dumpConfig.Name)
+	}
+	// 获取最新位点
+	if !ins.seeked {
+		if _, err := ins.dumpConfig.GetLastPosition(); err != nil {
+			return fmt.Errorf("instance %s: %s", ins.dumpConfig.Name, err)
+		}
+	}
+	if err := ins.dumpConfig.preflight(); err != nil {
+		return err
+	}
+	ins.dumpConfig.resolveLowerCase()
+	ins.seeked = false
+	// 从保存的位点重新开始，之前未确认的事件会重新写入
+	ins.dumpConfig.sinkProgress.reset()
+	ins.dumpConfig.ddlPause.reset(ins.dumpConfig.Name)
+
+	ins.dump = ins.dumpConfig.AddDump()
+	// 启动sync 位点同步服务
+	go ins.dumpConfig.InstantSync(ins.dump.quit)
+	// 延迟监控
+	go ins.dumpConfig.MonitorLag(ins.dump.binlogDump, ins.dump.quit)
+	// binlog 清除预警
+	go ins.dumpConfig.MonitorPurge(ins.dump.binlogDump, ins.dump.quit)
+	// 在启动协程前重置状态，紧接着的 stop 设置的 closing 不会被协程覆盖
+	ins.dump.binlogDump.ResetState()
+	go ins.dump.Start()
+	return nil
+}
+
+func (ins *instance) stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), INSTANCE_STOP_TIMEOUT)
+	defer cancel()
+	return ins.shutdown(ctx)
+}
+
+// 停止读取，等待正在处理的事件写入输出，保存最后的位点
+func (ins *instance) shutdown(ctx context.Context) error {
+	ins.Lock()
+	defer ins.Unlock()
+	if ins.dump == nil {
+		return nil
+	}
+	binlogDump := ins.dump.binlogDump
+
+	// 等待 dump 协程退出，避免退出后仍有事件回调修改位点
+	if err := binlogDump.Shutdown(ctx); err != nil {
+		return fmt.Errorf("instance %s stop: %s, state: %s", ins.dumpConfig.Name, err, binlogDump.State())
+	}
+	// 输出中缓冲的数据写入后再保存位点
+	if err := flushSinks(ins.dumpConfig.Sinks); err != nil {
+		ins.dumpConfig.logEntry().WithError(err).Error("flush sinks")
+	}
+	ins.dumpConfig.syncLastPos()
+	ins.dumpConfig.flushObjectCheckpoint(true)
+
+	// 停止位点同步服务
+	close(ins.dump.quit)
+	ins.dump = nil
+	return nil
+}
+
+func (ins *instance) seek(file string, position uint32) error {
+	ins.Lock()
+	defer ins.Unlock()
+	if ins.dump != nil {
+		return fmt.Errorf("instance %s is running, stop it first", ins.dumpConfig.Name)
+	}
+	if err := (mysql.BinlogPosition{File: file, Pos: position}).Validate(); err != nil {
+		return err
+	}
+	ins.dumpConfig.syncLock.Lock()
+	defer ins.dumpConfig.syncLock.Unlock()
+	filePos := fmt.Sprintf("%s:%d", file, position)
+	if err := ins.dumpConfig.SyncBinlogFilenamePos(filePos); err != nil {
+		return err
+	}
+	ins.dumpConfig.BinlogDumpFileName = file
+	ins.dumpConfig.BinlogDumpPosition = position
+	ins.dumpConfig.BinlogDumpTimestamp = 0
+	// 按文件位点重新定位，已保存的 GTID 集合不再适用
+	ins.dumpConfig.GTIDSet = ""
+	ins.dumpConfig.removeGTIDCheckpoint()
+	ins.dumpConfig.SyncTimestamp = 0
+	ins.dumpConfig.SyncPos = filePos
+	ins.dumpConfig.delivered.Reset()
+	ins.dumpConfig.sinkProgress.reset()
+	ins.seeked = true
+	return nil
+}
+
+// 从 GTID 集合之后开始同步，开启 gtid_checkpoint 时同时保存，重启后仍然生效
+func (ins *instance) seekGTID(gtidSet string) error {
+	ins.Lock()
+	defer ins.Unlock()
+	if ins.dump != nil {
+		return fmt.Errorf("instance %s is running, stop it first", ins.dumpConfig.Name)
+	}
+	if err := mysql.ValidateGTIDSet(gtidSet); err != nil {
+		return err
+	}
+	ins.dumpConfig.syncLock.Lock()
+	defer ins.dumpConfig.syncLock.Unlock()
+	if ins.dumpConfig.gtidCheckpoint() {
+		if err := ins.dumpConfig.writeGTIDCheckpoint(gtidSet); err != nil {
+			return err
+		}
+	}
+	ins.dumpConfig.GTIDSet = gtidSet
+	ins.dumpConfig.BinlogDumpTimestamp = 0
+	ins.dumpConfig.SyncTimestamp = 0
+	ins.dumpConfig.delivered.Reset()
+	ins.dumpConfig.sinkProgress.reset()
+	ins.seeked = true
+	return nil
+}
+
+func (ins *instance) status() *SourceStatus {
+	ins.Lock()
+	dump := ins.dump
+	ins.Unlock()
+
+	dumpConfig := ins.dumpConfig
+	status := &SourceStatus{
+		Name:               dumpConfig.Name,
+		Host:               dumpConfig.Source["host"],
+		ServerId:           dumpConfig.ServerId,
+		BinlogDumpFileName: dumpConfig.BinlogDumpFileName,
+		BinlogDumpPosition: dumpConfig.BinlogDumpPosition,
+		State:              mysql.STATE_CLOSED.String(),
+	}
+	status.Tables, status.FilterTables = dumpConfig.GetFilter()
+	for _, entry := range dumpConfig.Sinks {
+		status.Sinks = append(status.Sinks, entry.Name)
+	}
+	status.SinkPositions = dumpConfig.SinkPositions()
+	status.PendingDDL = dumpConfig.ddlPause.get()
+	status.Delay = dumpConfig.Delay()
+	status.LagBytes = dumpConfig.LagBytes
+	status.MasterFileName = dumpConfig.MasterFileName
+	status.MasterPosition = dumpConfig.MasterPosition
+	if dump != nil {
+		status.GTIDSet = dump.binlogDump.GTIDSet
+		status.ExecutedGTIDSet, _ = dump.binlogDump.ExecutedGTIDSet()
+		status.State = dump.binlogDump.State().String()
+		status.BinlogFormat = dump.binlogDump.BinlogFormat()
+		dump.Lock()
+		status.ConnErr = dump.ConnErr
+		dump.Unlock()
+	}
+	return status
+}
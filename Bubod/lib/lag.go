@@ -0,0 +1,142 @@
+// 复制延迟监控
+// 延迟有两种计算方式:
+//
+//	时间延迟: 当前时间 - 已同步事件的时间
+//	位点延迟: 定期 SHOW BINARY LOGS 获取 master 当前位点，计算已同步位点之后未消费的字节数
+//
+// 任一延迟超过阈值时触发告警，恢复后再触发一次 resolved。
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"bubod/Bubod/logger"
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+const (
+	LAG_ALERT_FIRING   = "firing"
+	LAG_ALERT_RESOLVED = "resolved"
+)
+
+// 默认每 10 秒检查一次
+const DEFAULT_LAG_CHECK_INTERVAL = 10 * time.Second
+
+// 延迟告警
+type LagAlert struct {
+	Source         string `json:"source"`
+	Status         string `json:"status"`    // firing/resolved
+	Delay          int64  `json:"delay"`     // 时间延迟(秒)
+	LagBytes       uint64 `json:"lag_bytes"` // 位点延迟(字节)
+	BinlogFile     string `json:"binlog_file"`
+	BinlogPosition uint32 `json:"binlog_position"`
+	MasterFile     string `json:"master_file"`
+	MasterPosition uint64 `json:"master_position"`
+	Time           int64  `json:"time"`
+}
+
+// 延迟告警回调，供内嵌使用；配置了 lag_alert_webhook 时同时 POST 到该地址
+var LagAlertCallback func(alert *LagAlert)
+
+// 时间延迟(秒)
+// 已追上 master 时 master 空闲不会产生新事件，此时延迟为 0
+func (dumpConfig *DumpConfig) Delay() int64 {
+	timestamp := dumpConfig.BinlogDumpTimestamp
+	if timestamp == 0 || (dumpConfig.MasterFileName != "" && dumpConfig.LagBytes == 0) {
+		return 0
+	}
+	return time.Now().Unix() - int64(timestamp)
+}
+
+// 定期检查延迟，quit 关闭时退出
+func (dumpConfig *DumpConfig) MonitorLag(binlogDump *mysql.BinlogDump, quit <-chan struct{}) {
+	// 配置已在 NewDumpConfig 中检查
+	interval, _ := dumpConfig.sourceConf().GetDuration("lag_check_interval", DEFAULT_LAG_CHECK_INTERVAL)
+	if interval <= 0 {
+		return
+	}
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(interval):
+		}
+		dumpConfig.checkLag(binlogDump)
+	}
+}
+
+func (dumpConfig *DumpConfig) checkLag(binlogDump *mysql.BinlogDump) {
+	if state := binlogDump.State(); state != mysql.STATE_RUNNING && state != mysql.STATE_PAUSED {
+		return
+	}
+	masterFile, masterPosition, lag, err := binlogDump.MasterLag(dumpConfig.BinlogDumpFileName, dumpConfig.BinlogDumpPosition)
+	if err != nil {
+		dumpConfig.logEntry().WithError(err).Warn("check replication lag")
+		return
+	}
+	dumpConfig.MasterFileName = masterFile
+	dumpConfig.MasterPosition = masterPosition
+	dumpConfig.LagBytes = lag
+
+	delay := dumpConfig.Delay()
+	metrics.ReplicationLagBytes.Set(float64(lag), dumpConfig.Name)
+
+	section := dumpConfig.sourceConf()
+	alertDelay, _ := section.GetInt("lag_alert_delay", 0)
+	alertBytes, _ := section.GetInt("lag_alert_bytes", 0)
+	exceeded := (alertDelay > 0 && delay > alertDelay) || (alertBytes > 0 && lag > uint64(alertBytes))
+	if exceeded == dumpConfig.lagAlerting {
+		return
+	}
+	dumpConfig.lagAlerting = exceeded
+
+	alert := &LagAlert{
+		Source:         dumpConfig.Name,
+		Status:         LAG_ALERT_RESOLVED,
+		Delay:          delay,
+		LagBytes:       lag,
+		BinlogFile:     dumpConfig.BinlogDumpFileName,
+		BinlogPosition: dumpConfig.BinlogDumpPosition,
+		MasterFile:     masterFile,
+		MasterPosition: masterPosition,
+		Time:           time.Now().Unix(),
+	}
+	if exceeded {
+		alert.Status = LAG_ALERT_FIRING
+	}
+	dumpConfig.logEntry().With(logger.Fields{
+		"status":          alert.Status,
+		"delay":           alert.Delay,
+		"lag_bytes":       alert.LagBytes,
+		"master_file":     masterFile,
+		"master_position": masterPosition,
+	}).Warn("replication lag")
+	if LagAlertCallback != nil {
+		LagAlertCallback(alert)
+	}
+	if webhook := dumpConfig.GetSourceVal("lag_alert_webhook"); webhook != "" {
+		go postAlert(webhook, dumpConfig.Name, alert)
+	}
+}
+
+// POST 告警到 webhook
+func postAlert(webhook string, source string, alert interface{}) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.With(logger.Fields{"instance": source, "webhook": webhook}).WithError(err).Error("post alert")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.With(logger.Fields{"instance": source, "webhook": webhook}).Error("post alert", resp.Status)
+	}
+}
@@ -0,0 +1,36 @@
+// 端到端延迟
+// 每个事件带有 binlog 事件时间(data.Header.Timestamp，秒)和解析完成的时间(data.ParsedAt)，
+// 输出写入成功时(同步写入的输出 Write 返回时，异步写入的输出由后台协程写入时，缓存事件的输出确认时)按数据源、输出、库表记录两个直方图:
+//
+//	bubod_e2e_latency_seconds       写入时间 - binlog 事件时间，包含 master 到 bubod 的延迟；事件时间为语句开始执行的时间，精度为秒
+//	bubod_pipeline_latency_seconds  写入时间 - 解析时间，bubod 内部队列和输出的延迟
+//
+// 分位数用 histogram_quantile 计算，如各表 e2e 延迟的 p99:
+//
+//	histogram_quantile(0.99, sum by (le, schema, table) (rate(bubod_e2e_latency_seconds_bucket[5m])))
+//
+// 溢出到磁盘的事件在从磁盘写入输出时记录，写入死信文件或被丢弃的事件不记录。
+// 消息中的 timestamp 为 binlog 事件时间，computed_fields 的 parse_time 为解析时间，下游可据此计算到达下游的延迟。
+package lib
+
+import (
+	"time"
+
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+// 事件已写入输出，记录端到端延迟
+func observeLatency(sink string, data *mysql.EventReslut, at time.Time) {
+	if data.ParsedAt.IsZero() {
+		return
+	}
+	metrics.PipelineLatency.Observe(at.Sub(data.ParsedAt).Seconds(), data.Source, sink, data.SchemaName, data.TableName)
+	if data.Header.Timestamp > 0 {
+		latency := at.Sub(time.Unix(int64(data.Header.Timestamp), 0)).Seconds()
+		if latency < 0 {
+			latency = 0
+		}
+		metrics.E2ELatency.Observe(latency, data.Source, sink, data.SchemaName, data.TableName)
+	}
+}
@@ -1,74 +1,103 @@
 package lib
 
 import (
-	"bubod/Bubod/config"
 	"os"
-	"log"
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/mysql"
 	"io/ioutil"
 	"strings"
-	"strconv"
 )
 
 
 // 从 conf/本地文件data_file/zk 获取最新的filename+position
 // return file_name:position
-func (dumpConfig *DumpConfig) GetLastPosition() string{
+// 启动时的位点: 配置的位点和已保存的位点(按 checkpoint_quorum 选择)中较大的一个，binlog_dump_force 时使用配置的位点
+// checkpoint_quorum=all 且各来源不一致时返回错误
+func (dumpConfig *DumpConfig) GetLastPosition() (string, error) {
 
 	var file_pos string
 	var config_pos string	 // 配置文件提供的pos
 	var data_file_pos string // 文件记录的pos
-	var zk_pos string		 // zk上保存的pos
+	var saved_pos string	 // 文件、选举后端、对象存储中按 checkpoint_quorum 选择的pos
 
 	config_pos = ""
-	if config.GetConfigVal("Database","binlog_dump_file_name")!="" && config.GetConfigVal("Database","binlog_dump_position")!="" {
-		config_pos = config.GetConfigVal("Database","binlog_dump_file_name")+":"+config.GetConfigVal("Database","binlog_dump_position")
+	// 配置了 start_datetime 时由 master 按时间定位，忽略配置的位点
+	if dumpConfig.Source["start_datetime"]=="" && dumpConfig.Source["binlog_dump_file_name"]!="" && dumpConfig.Source["binlog_dump_position"]!="" {
+		config_pos = dumpConfig.Source["binlog_dump_file_name"]+":"+dumpConfig.Source["binlog_dump_position"]
 	}
 	// 从data file获取当前位点
-	bubod_dump_pos := config.GetConfigVal("Bubod","bubod_dump_pos")
-	// bubod_dump_pos := dumpConfig.Conf["Bubod"]["bubod_dump_pos"]
+	bubod_dump_pos := dumpConfig.PosFile
 
 	f, err2 := os.OpenFile(bubod_dump_pos, os.O_CREATE|os.O_RDWR, 0777)
 	defer f.Close()
 	if err2 !=nil {
-		log.Println("[info] Open bubod_dump_pos:", bubod_dump_pos,"; Error:",err2)
+		dumpConfig.logEntry().With(logger.Fields{"file": bubod_dump_pos}).WithError(err2).Info("open position file")
 	}else{
 		content, err2 := ioutil.ReadAll(f)
 		if err2 != nil {
-			log.Println("[info] Read bubod_dump_pos:", bubod_dump_pos,"; Error:",err2)
+			dumpConfig.logEntry().With(logger.Fields{"file": bubod_dump_pos}).WithError(err2).Info("read position file")
 		}else{
 			data_file_pos = string(content)
 		}
 	}
 
-	// // 从zookeeper获取位点信息，待实现。。。
-	// if (config.GetConfigVal("Zookeeper","server") != ""){
-	// 	zk_pos = dumpConfig.ElectionManager.GetData()
-	// }
-
-	// 使用最大位点
+	// 使用最大位点，binlog_dump_force 时使用配置的位点
+	force, _ := config.Section(dumpConfig.Source).GetBool("binlog_dump_force", false)
 	if config_pos != "" && CheckBinlogFilePos(config_pos) {
 		file_pos = config_pos
 	}
-	if CheckBinlogFilePos(data_file_pos) && (file_pos == "" || file_pos < data_file_pos) {
-		file_pos = data_file_pos
+	if !force || file_pos == "" {
+		var err error
+		// 选举后端由其他节点为 leader 时保存，对象存储用于没有持久磁盘时本地文件在重启后丢失
+		saved_pos, err = dumpConfig.savedCheckpoint(data_file_pos)
+		if err != nil {
+			return "", err
+		}
+		if saved_pos != "" && (file_pos == "" || laterBinlogFilePos(saved_pos, file_pos)) {
+			file_pos = saved_pos
+		}
 	}
-	if CheckBinlogFilePos(zk_pos) && (file_pos =="" || file_pos < zk_pos) {
-		file_pos = zk_pos
+
+	if position, err := mysql.ParseBinlogPosition(file_pos); err == nil {
+		dumpConfig.BinlogDumpFileName = position.File
+		dumpConfig.BinlogDumpPosition = position.Pos
 	}
-	
-	if CheckBinlogFilePos(file_pos){
-		filepos := strings.Split(file_pos, ":")
-		pos, _ := strconv.ParseUint(filepos[1], 10, 64)
-		dumpConfig.BinlogDumpFileName = filepos[0]
-		dumpConfig.BinlogDumpPosition = uint32(pos)
+
+	// 已保存的 GTID 集合优先于 gtid_set 配置和文件位点，binlog_dump_force 时使用配置
+	dumpConfig.GTIDSet = dumpConfig.Source["gtid_set"]
+	if gtidSet := dumpConfig.loadGTIDCheckpoint(); gtidSet != "" && !force {
+		dumpConfig.GTIDSet = gtidSet
 	}
-	return file_pos
+	return file_pos, nil
 }
 
-// 检测字符串是否为位点 filename:position
-func CheckBinlogFilePos(file_pos string) bool {
-	if file_pos != "" && strings.ContainsRune(file_pos, ':'){
-		return true
+// 读取已保存的 GTID 集合，未开启 gtid_checkpoint 或没有保存时返回空
+func (dumpConfig *DumpConfig) loadGTIDCheckpoint() string {
+	if !dumpConfig.gtidCheckpoint() {
+		return ""
 	}
-	return false
+	content, err := ioutil.ReadFile(dumpConfig.GTIDFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dumpConfig.logEntry().With(logger.Fields{"file": dumpConfig.GTIDFile}).WithError(err).Warn("read gtid file")
+			return ""
+		}
+		// 本地文件不存在时使用对象存储中的集合
+		return dumpConfig.loadObjectCheckpoint(OBJECT_CHECKPOINT_GTID)
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// 检测字符串是否为位点 filename:position，文件名为 basename.序号，position 不小于 4
+func CheckBinlogFilePos(file_pos string) bool {
+	_, err := mysql.ParseBinlogPosition(file_pos)
+	return err == nil
+}
+
+// 位点 a 是否晚于 b，按文件序号和偏移比较
+func laterBinlogFilePos(a string, b string) bool {
+	posA, errA := mysql.ParseBinlogPosition(a)
+	posB, errB := mysql.ParseBinlogPosition(b)
+	return errA == nil && (errB != nil || posA.Compare(posB) > 0)
 }
@@ -0,0 +1,304 @@
+// 压测事件生成
+// 不连接 MySQL，按配置生成合成的行变更事件，经过同步时的回调(表过滤、消息生成、写入输出、更新位点)，
+// 由位点同步服务定时保存位点，用于单独测试输出吞吐和位点保存。
+// 位点写入单独的文件 filepos-bench-<node_name>.bubod，不影响数据源已保存的位点。
+package lib
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"bubod/Bubod/mysql"
+)
+
+// 合成 binlog 文件大小，超过后切换到下一个文件
+const LOAD_BINLOG_FILE_SIZE = 1 << 30
+
+// 压测参数
+type LoadOptions struct {
+	Database     string        // 库名，表名为 t1...tN
+	Tables       int           // 表的个数
+	Columns      int           // 每行除 id、k、created_at 外的字符串字段个数
+	RowSize      int           // 每行字符串字段的总字节数
+	RowsPerEvent int           // 每个事件的行数
+	UpdateRatio  float64       // update 事件的比例
+	DeleteRatio  float64       // delete 事件的比例，其余为 insert
+	Events       int           // 生成的事件数，0 为不限
+	Duration     time.Duration // 持续时间，0 为不限
+	Rate         int           // 每秒事件数，0 为最快速度
+	Seed         int64         // 随机数种子，相同的种子生成相同的数据
+	RowFormat    string        // 行格式 map/slice，为空时使用数据源的 row_format 配置
+}
+
+func (opts *LoadOptions) validate() error {
+	if opts.Database == "" {
+		return fmt.Errorf("database is required")
+	}
+	if opts.Tables <= 0 || opts.Columns <= 0 || opts.RowsPerEvent <= 0 {
+		return fmt.Errorf("tables, columns and rows per event must be positive")
+	}
+	if opts.RowSize < opts.Columns {
+		return fmt.Errorf("row size must be at least %d", opts.Columns)
+	}
+	if opts.UpdateRatio < 0 || opts.DeleteRatio < 0 || opts.UpdateRatio+opts.DeleteRatio > 1 {
+		return fmt.Errorf("invalid update/delete ratio %v/%v", opts.UpdateRatio, opts.DeleteRatio)
+	}
+	if opts.Events < 0 || opts.Duration < 0 || opts.Rate < 0 {
+		return fmt.Errorf("events, duration and rate must not be negative")
+	}
+	switch opts.RowFormat {
+	case "", mysql.ROW_FORMAT_MAP, mysql.ROW_FORMAT_SLICE:
+	default:
+		return fmt.Errorf("invalid row format %q, must be map or slice", opts.RowFormat)
+	}
+	return nil
+}
+
+// 压测结果
+type LoadStats struct {
+	Events   int           `json:"events"`
+	Rows     int           `json:"rows"`
+	Inserts  int           `json:"inserts"`
+	Updates  int           `json:"updates"`
+	Deletes  int           `json:"deletes"`
+	Bytes    int64         `json:"bytes"` // 合成 binlog 的字节数
+	Elapsed  time.Duration `json:"elapsed"`
+	Position string        `json:"position"` // 最后保存的位点
+}
+
+func (stats *LoadStats) String() string {
+	seconds := stats.Elapsed.Seconds()
+	if seconds <= 0 {
+		seconds = 1e-9
+	}
+	return fmt.Sprintf("%d events (%d insert, %d update, %d delete), %d rows in %s: %.0f events/s, %.0f rows/s, %.2f MB/s, position %s",
+		stats.Events, stats.Inserts, stats.Updates, stats.Deletes, stats.Rows, stats.Elapsed.Round(time.Millisecond),
+		float64(stats.Events)/seconds, float64(stats.Rows)/seconds, float64(stats.Bytes)/seconds/(1<<20), stats.Position)
+}
+
+// 生成的表，ids 为当前存在的行，用于生成 update/delete
+type loadTable struct {
+	name    string
+	columns []*mysql.ColumnInfo
+	nextId  int64
+	ids     []int64
+	values  map[int64][]driver.Value
+}
+
+// 事件生成器，非并发安全
+type LoadGenerator struct {
+	opts     LoadOptions
+	rand     *rand.Rand
+	tables   []*loadTable
+	fileSeq  int
+	position uint32
+}
+
+func NewLoadGenerator(opts LoadOptions) (*LoadGenerator, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	gen := &LoadGenerator{
+		opts:     opts,
+		rand:     rand.New(rand.NewSource(opts.Seed)),
+		fileSeq:  1,
+		position: 4,
+	}
+	for i := 1; i <= opts.Tables; i++ {
+		t := &loadTable{name: "t" + strconv.Itoa(i), nextId: 1, values: make(map[int64][]driver.Value)}
+		t.columns = []*mysql.ColumnInfo{
+			{Name: "id", Type: "bigint(20)", Key: "PRI", IsPrimary: true},
+			{Name: "k", Type: "int(11)"},
+			{Name: "created_at", Type: "datetime"},
+		}
+		for k := 1; k <= opts.Columns; k++ {
+			t.columns = append(t.columns, &mysql.ColumnInfo{Name: "c" + strconv.Itoa(k), Type: "varchar(" + strconv.Itoa(opts.RowSize) + ")"})
+		}
+		gen.tables = append(gen.tables, t)
+	}
+	return gen, nil
+}
+
+// 生成下一个事件，表随机选择，事件类型按比例选择，表中没有行时生成 insert
+func (gen *LoadGenerator) Next() *mysql.EventReslut {
+	t := gen.tables[gen.rand.Intn(len(gen.tables))]
+	eventType := mysql.WRITE_ROWS_EVENTv2
+	if len(t.ids) > 0 {
+		switch r := gen.rand.Float64(); {
+		case r < gen.opts.UpdateRatio:
+			eventType = mysql.UPDATE_ROWS_EVENTv2
+		case r < gen.opts.UpdateRatio+gen.opts.DeleteRatio:
+			eventType = mysql.DELETE_ROWS_EVENTv2
+		}
+	}
+
+	values := make([][]driver.Value, 0, gen.opts.RowsPerEvent*2)
+	for i := 0; i < gen.opts.RowsPerEvent; i++ {
+		switch eventType {
+		case mysql.WRITE_ROWS_EVENTv2:
+			row := gen.newRow(t, t.nextId)
+			t.ids = append(t.ids, t.nextId)
+			t.values[t.nextId] = row
+			t.nextId++
+			values = append(values, row)
+		case mysql.UPDATE_ROWS_EVENTv2:
+			id := t.ids[gen.rand.Intn(len(t.ids))]
+			after := gen.newRow(t, id)
+			after[2] = t.values[id][2]
+			values = append(values, t.values[id], after)
+			t.values[id] = after
+		case mysql.DELETE_ROWS_EVENTv2:
+			if len(t.ids) == 0 {
+				break
+			}
+			k := gen.rand.Intn(len(t.ids))
+			id := t.ids[k]
+			t.ids[k] = t.ids[len(t.ids)-1]
+			t.ids = t.ids[:len(t.ids)-1]
+			values = append(values, t.values[id])
+			delete(t.values, id)
+		}
+	}
+
+	// 事件大小按行数据估算，用于推进位点
+	size := uint32(19+10) + uint32(len(values)*(8+4+5+gen.opts.RowSize+gen.opts.Columns))
+	if gen.position+size > LOAD_BINLOG_FILE_SIZE {
+		gen.fileSeq++
+		gen.position = 4
+	}
+	gen.position += size
+
+	event := &mysql.EventReslut{
+		Header: mysql.EventHeader{
+			Timestamp: uint32(time.Now().Unix()),
+			EventType: eventType,
+			EventSize: size,
+			LogPos:    gen.position,
+		},
+		SchemaName:     gen.opts.Database,
+		TableName:      t.name,
+		BinlogFileName: fmt.Sprintf("bench-bin.%06d", gen.fileSeq),
+		BinlogPosition: gen.position,
+		Primary:        "id",
+		PrimaryKeys:    []string{"id"},
+	}
+	if gen.opts.RowFormat == mysql.ROW_FORMAT_SLICE {
+		event.Values, event.Columns = values, t.columns
+	} else {
+		event.Rows = make([]map[string]driver.Value, 0, len(values))
+		for _, row := range values {
+			m := make(map[string]driver.Value, len(row))
+			for i, column := range t.columns {
+				m[column.Name] = row[i]
+			}
+			event.Rows = append(event.Rows, m)
+		}
+	}
+	return event
+}
+
+// 生成一行，字符串字段平分 RowSize
+func (gen *LoadGenerator) newRow(t *loadTable, id int64) []driver.Value {
+	row := make([]driver.Value, 0, len(t.columns))
+	row = append(row, id, int64(gen.rand.Int31()), time.Now().Format("2006-01-02 15:04:05"))
+	size := gen.opts.RowSize / gen.opts.Columns
+	for k := 0; k < gen.opts.Columns; k++ {
+		n := size
+		if k == gen.opts.Columns-1 {
+			n = gen.opts.RowSize - size*(gen.opts.Columns-1)
+		}
+		row = append(row, gen.randomString(n))
+	}
+	return row
+}
+
+const loadLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func (gen *LoadGenerator) randomString(n int) string {
+	var b strings.Builder
+	b.Grow(n)
+	for i := 0; i < n; i++ {
+		b.WriteByte(loadLetters[gen.rand.Intn(len(loadLetters))])
+	}
+	return b.String()
+}
+
+// 使用数据源 name 的表过滤和输出运行压测，quit 关闭时提前结束
+// 事件经过同步时的回调写入输出，位点按同步时的方式每秒保存，结束时写入输出缓冲的数据并保存最后的位点
+func RunLoad(conf map[string]map[string]string, name string, opts LoadOptions, quit <-chan struct{}) (*LoadStats, error) {
+	if err := initSinks(conf); err != nil {
+		return nil, err
+	}
+	defer closeSinks()
+	dumpConfig, err := NewDumpConfig(conf, name, conf[name])
+	if err != nil {
+		return nil, err
+	}
+	if len(dumpConfig.Sinks) == 0 {
+		return nil, fmt.Errorf("instance %s has no sink configured", name)
+	}
+	if opts.RowFormat == "" {
+		opts.RowFormat = dumpConfig.sourceConf().GetString("row_format", mysql.ROW_FORMAT_MAP)
+	}
+	gen, err := NewLoadGenerator(opts)
+	if err != nil {
+		return nil, err
+	}
+	dumpConfig.PosFile = conf["Bubod"]["data_dir"] + "/filepos-bench-" + dumpConfig.NodeName + ".bubod"
+
+	d := &dump{dumpConfig: dumpConfig, quit: make(chan struct{})}
+	synced := make(chan struct{})
+	go func() {
+		dumpConfig.InstantSync(d.quit)
+		close(synced)
+	}()
+
+	stats := &LoadStats{}
+	start := time.Now()
+	var deadline <-chan time.Time
+	if opts.Duration > 0 {
+		timer := time.NewTimer(opts.Duration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+loop:
+	for opts.Events == 0 || stats.Events < opts.Events {
+		select {
+		case <-quit:
+			break loop
+		case <-deadline:
+			break loop
+		default:
+		}
+		if opts.Rate > 0 {
+			// 按事件序号计算应发送的时间
+			if wait := time.Duration(stats.Events)*time.Second/time.Duration(opts.Rate) - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		event := gen.Next()
+		stats.Events++
+		stats.Rows += event.RowCount()
+		stats.Bytes += int64(event.Header.EventSize)
+		switch event.Header.EventType {
+		case mysql.WRITE_ROWS_EVENTv2:
+			stats.Inserts++
+		case mysql.UPDATE_ROWS_EVENTv2:
+			stats.Updates++
+		case mysql.DELETE_ROWS_EVENTv2:
+			stats.Deletes++
+		}
+		d.Callback(event)
+	}
+
+	err = flushSinks(dumpConfig.Sinks)
+	close(d.quit)
+	<-synced
+	stats.Elapsed = time.Since(start)
+	stats.Position = dumpConfig.syncLastPos()
+	return stats, err
+}
@@ -0,0 +1,14 @@
+package lib
+
+import (
+	"bubod/Bubod/logger"
+)
+
+// 日志上下文: 实例名、已同步位点
+func (dumpConfig *DumpConfig) logEntry() *logger.Entry {
+	return logger.With(logger.Fields{
+		"instance":    dumpConfig.Name,
+		"binlog_file": dumpConfig.BinlogDumpFileName,
+		"binlog_pos":  dumpConfig.BinlogDumpPosition,
+	})
+}
@@ -0,0 +1,146 @@
+// 对象存储中的位点
+// [ObjectStorage] 配置 checkpoint=true 时，位点和 GTID 集合在写入本地文件的同时上传到
+// {prefix}/positions/{node}.pos 和 {prefix}/positions/{node}.gtid，node 为数据源的节点名称。
+// 启动时位点按 checkpoint_quorum 从本地文件、选举后端和对象存储中选择，见 checkpoint_quorum.go；本地没有 GTID 文件时使用对象存储中的集合。
+// 没有持久磁盘时重启后本地文件丢失，从对象存储恢复。
+//
+// 每次上传一个请求，checkpoint_interval 内只上传最新的位点，停止实例时立即上传。
+// 进程崩溃时最多丢失 checkpoint_interval 内的位点，恢复后从更早的位点重新同步。
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/objstore"
+)
+
+const DEFAULT_OBJECT_CHECKPOINT_INTERVAL = 10 * time.Second
+
+const (
+	OBJECT_CHECKPOINT_POSITION = ".pos"
+	OBJECT_CHECKPOINT_GTID     = ".gtid"
+)
+
+// 进程的对象存储，未配置 [ObjectStorage] bucket 时为 nil，Run 启动时初始化
+var ObjectStore *objstore.Client
+
+func initObjectStore(conf map[string]map[string]string) error {
+	section := conf["ObjectStorage"]
+	if config.Section(section).GetString("bucket", "") == "" {
+		return nil
+	}
+	client, err := objstore.New(section)
+	if err != nil {
+		return err
+	}
+	ObjectStore = client
+	return nil
+}
+
+type objectCheckpoint struct {
+	sync.Mutex
+	client   *objstore.Client
+	key      string // positions/{node}，加上 OBJECT_CHECKPOINT_* 后缀
+	interval time.Duration
+	pending  map[string]string    // 未上传的值
+	uploaded map[string]time.Time // 上次上传的时间
+}
+
+// [ObjectStorage] checkpoint=true 时创建，否则返回 nil
+func newObjectCheckpoint(conf map[string]map[string]string, nodeName string) (*objectCheckpoint, error) {
+	section := config.Section(conf["ObjectStorage"])
+	enabled, err := section.GetBool("checkpoint", false)
+	if err != nil || !enabled {
+		return nil, err
+	}
+	if ObjectStore == nil {
+		return nil, fmt.Errorf("object storage checkpoint requires [ObjectStorage] bucket")
+	}
+	interval, err := section.GetDuration("checkpoint_interval", DEFAULT_OBJECT_CHECKPOINT_INTERVAL)
+	if err != nil {
+		return nil, err
+	}
+	return &objectCheckpoint{
+		client:   ObjectStore,
+		key:      "positions/" + nodeName,
+		interval: interval,
+		pending:  make(map[string]string),
+		uploaded: make(map[string]time.Time),
+	}, nil
+}
+
+// 记录待上传的值，由 flush 上传
+func (checkpoint *objectCheckpoint) save(ext string, value string) {
+	checkpoint.Lock()
+	checkpoint.pending[ext] = value
+	checkpoint.Unlock()
+}
+
+// 上传距上次上传已超过 checkpoint_interval 的值，force 时全部上传
+func (checkpoint *objectCheckpoint) flush(force bool) error {
+	checkpoint.Lock()
+	defer checkpoint.Unlock()
+	var err error
+	now := time.Now()
+	for ext, value := range checkpoint.pending {
+		if !force && now.Sub(checkpoint.uploaded[ext]) < checkpoint.interval {
+			continue
+		}
+		if e := checkpoint.client.Put(checkpoint.key+ext, []byte(value)); e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		delete(checkpoint.pending, ext)
+		checkpoint.uploaded[ext] = now
+	}
+	return err
+}
+
+// 读取已上传的值，不存在时返回空
+func (checkpoint *objectCheckpoint) load(ext string) (string, error) {
+	data, err := checkpoint.client.Get(checkpoint.key + ext)
+	if err == objstore.ErrNotExist {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (dumpConfig *DumpConfig) flushObjectCheckpoint(force bool) {
+	checkpoint := dumpConfig.objectCheckpoint
+	if checkpoint == nil {
+		return
+	}
+	if err := checkpoint.flush(force); err != nil {
+		dumpConfig.logEntry().With(logger.Fields{"key": checkpoint.client.URL(checkpoint.key)}).WithError(err).Error("upload checkpoint")
+	}
+}
+
+// 删除已上传的值
+func (checkpoint *objectCheckpoint) remove(ext string) error {
+	checkpoint.Lock()
+	delete(checkpoint.pending, ext)
+	checkpoint.Unlock()
+	return checkpoint.client.Delete(checkpoint.key + ext)
+}
+
+func (dumpConfig *DumpConfig) loadObjectCheckpoint(ext string) string {
+	checkpoint := dumpConfig.objectCheckpoint
+	if checkpoint == nil {
+		return ""
+	}
+	value, err := checkpoint.load(ext)
+	if err != nil {
+		dumpConfig.logEntry().With(logger.Fields{"key": checkpoint.client.URL(checkpoint.key + ext)}).WithError(err).Warn("download checkpoint")
+	}
+	return value
+}
@@ -0,0 +1,106 @@
+// binlog 清除预警
+// 定期查询 master 的 binlog 文件和保留时间，已同步位点所在的文件即将被自动清除时告警，
+// 同步停滞(暂停、输出阻塞、延迟过大)时运维可以在数据丢失前处理。
+// RDS 等托管实例的保留时间不在系统变量中，可以通过 binlog_retention 配置；RDS/Aurora 模式(rds=true)下从 mysql.rds_show_configuration 读取。
+package lib
+
+import (
+	"time"
+
+	"bubod/Bubod/logger"
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+const (
+	DEFAULT_PURGE_CHECK_INTERVAL = 5 * time.Minute
+	DEFAULT_PURGE_ALERT_MARGIN   = time.Hour
+)
+
+// master 的 binlog 文件和已同步位点的清除状态
+type PurgeStatus struct {
+	*mysql.BinlogRetention
+	BinlogFile     string `json:"binlog_file"` // 已同步位点
+	BinlogPosition uint32 `json:"binlog_position"`
+	Purged         bool   `json:"purged"`   // 已同步位点所在的文件已被清除
+	PurgeIn        int64  `json:"purge_in"` // 已同步位点所在的文件最早被清除的剩余秒数，-1 为不会被清除
+}
+
+// 查询 master 的 binlog 文件和已同步位点的清除状态，binlogDump 为 nil 时连接配置的 master
+func (dumpConfig *DumpConfig) purgeStatus(binlogDump *mysql.BinlogDump) (*PurgeStatus, error) {
+	var retention *mysql.BinlogRetention
+	var err error
+	if binlogDump != nil {
+		retention, err = binlogDump.BinlogRetention()
+	} else {
+		retention, err = mysql.ShowBinlogRetention(dumpConfig.ConnectUri)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 配置已在 NewDumpConfig 中检查
+	if expire, _ := dumpConfig.sourceConf().GetDuration("binlog_retention", 0); expire > 0 {
+		retention.ExpireSeconds = int64(expire / time.Second)
+	}
+	status := &PurgeStatus{
+		BinlogRetention: retention,
+		BinlogFile:      dumpConfig.BinlogDumpFileName,
+		BinlogPosition:  dumpConfig.BinlogDumpPosition,
+		PurgeIn:         -1,
+	}
+	if status.BinlogFile == "" {
+		return status, nil
+	}
+	status.Purged = !retention.Contains(status.BinlogFile)
+	if purgeTime := retention.PurgeTime(status.BinlogFile, dumpConfig.BinlogDumpTimestamp); !purgeTime.IsZero() {
+		status.PurgeIn = int64(time.Until(purgeTime) / time.Second)
+		if status.PurgeIn < 0 {
+			status.PurgeIn = 0
+		}
+	}
+	return status, nil
+}
+
+// 定期检查已同步位点是否即将被清除，quit 关闭时退出
+func (dumpConfig *DumpConfig) MonitorPurge(binlogDump *mysql.BinlogDump, quit <-chan struct{}) {
+	// 配置已在 NewDumpConfig 中检查
+	interval, _ := dumpConfig.sourceConf().GetDuration("purge_check_interval", DEFAULT_PURGE_CHECK_INTERVAL)
+	if interval <= 0 {
+		return
+	}
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(interval):
+		}
+		dumpConfig.checkPurge(binlogDump)
+	}
+}
+
+func (dumpConfig *DumpConfig) checkPurge(binlogDump *mysql.BinlogDump) {
+	if state := binlogDump.State(); state != mysql.STATE_RUNNING && state != mysql.STATE_PAUSED {
+		return
+	}
+	status, err := dumpConfig.purgeStatus(binlogDump)
+	if err != nil {
+		dumpConfig.logEntry().WithError(err).Warn("check binlog purge")
+		return
+	}
+	metrics.CheckpointPurgeSeconds.Set(float64(status.PurgeIn), dumpConfig.Name)
+
+	margin, _ := dumpConfig.sourceConf().GetDuration("purge_alert_margin", DEFAULT_PURGE_ALERT_MARGIN)
+	entry := dumpConfig.logEntry().With(logger.Fields{
+		"binlog_file":      status.BinlogFile,
+		"binlog_pos":       status.BinlogPosition,
+		"earliest_file":    status.EarliestFile,
+		"expire_seconds":   status.ExpireSeconds,
+		"purge_in_seconds": status.PurgeIn,
+	})
+	switch {
+	case status.Purged:
+		entry.Error("synced binlog has been purged")
+	case status.PurgeIn >= 0 && status.PurgeIn < int64(margin/time.Second):
+		entry.Warn("synced binlog will be purged soon")
+	}
+}
@@ -1,20 +1,19 @@
 package lib
 import (
 	"sync"
-	"log"
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
 	"time"
 	"fmt"
-	"strconv"
-	"strings"
-	"bubod/Bubod/config"
 	"bubod/Bubod/mysql"
-	"bubod/Bubod/mq/disque"
-	"bubod/Bubod/mq/rabbit"
 )
 
 // 配置属性
 type DumpConfig struct {
+	Name					string `json:"Name"`					 // 数据源名称，即配置组名 Database/source.N
+	Source					map[string]string `json:"-"`			 // 数据源配置
 	ConnectUri 				string `json:"ConnectUri"`
+	Candidates				[]string `json:"-"`					 // 候选 master 连接串，数据源 masters 配置
 	ClusterName				string `json:"ClusterName"`				 
 	NodeName               	string `json:"NodeName"`				 // 服务名称
 	ServerId				uint32 `json:"ServerId"`				 // 节点唯一
@@ -23,10 +22,37 @@ type DumpConfig struct {
 	BinlogDumpFileName 		string `json:"BinlogDumpFileName"`		 // 需要注意的问题是一个binlog事件占几行，起始位置需要正确，否则解析失败
 	BinlogDumpPosition 		uint32 `json:"BinlogDumpPosition"`		 // pos
 	Conf					map[string]map[string]string 			 // 所有配置
-	// ElectionManager 		*ElectionManager						 // zk
+	ElectionManager 		ElectionManager							 // 选举后端，同时保存位点
 	// ZkErrorChan				chan bool								 // 用于实时获取zk状态
 	// MqClass 				MqClass									 // mq
 	SyncPos					string									 // 已同步位点。
+	BinlogDumpTimestamp		uint32									 // 已同步位点的事件时间
+	SyncTimestamp			uint32									 // 已保存位点的事件时间
+	MasterFileName			string									 // master 当前位点，定期获取
+	MasterPosition			uint64
+	LagBytes				uint64									 // 位点延迟，已同步位点之后未消费的 binlog 字节数
+	lagAlerting				bool									 // 是否处于延迟告警中
+	debug					bool									 // [Bubod] debug，输出同步的数据
+	Sinks					[]*sinkEntry							 // 写入的输出，数据源 sinks 配置
+	PosFile					string									 // 位点文件
+	DlqFile					string									 // 死信文件
+	GTIDSet					string									 // 启动时的 GTID 集合，gtid_set 配置或已保存的 GTID 集合
+	GTIDFile				string									 // GTID 集合文件，gtid_checkpoint 时保存
+	binlogDump				*mysql.BinlogDump						 // 运行中的 dump，用于获取已执行的 GTID 集合
+	objectCheckpoint		*objectCheckpoint						 // 对象存储中的位点，[ObjectStorage] checkpoint=true 时
+	checkpoints				*checkpointHistory						 // 位点历史和保存点
+	checkpointQuorum		string									 // 启动时位点来源的优先级，checkpoint_quorum 配置
+	recoverSink				*sinkEntry								 // 启动时从该输出读取最后写入的位点，recover_from_sink 配置
+	computedFields			[]*computedField						 // 消息中追加的计算字段，computed_fields 配置
+	importSchema			*mysql.SchemaSnapshot					 // 启动时导入的表结构快照，schema_snapshot 配置
+	syncGTIDSet				string									 // 已保存的 GTID 集合
+	ignoreCase				bool									 // 库名、表名匹配不区分大小写，启动时按 lower_case_table_names 确定
+	tableStats				*tableStats								 // 按表统计
+	delivered				*mysql.DeliveredPosition				 // 最后投递的事件，实例重启后用于去重
+	sinkProgress			*sinkProgress							 // 各输出已投递的位点，保存的位点为其最小值
+	ddlPause				*ddlPause								 // 等待确认的 DDL，见 ddl_pause.go
+	filterLock				sync.RWMutex							 // TableMap/FilterTableMap 可在运行时修改
+	syncLock				sync.Mutex								 // 保存位点
 }
 
 type Table struct {
@@ -47,6 +73,8 @@ type dump struct {
 	// maxBinlogDumpFileName 	string
 	// maxBinlogDumpPosition 	uint32
 	dumpConfig				*DumpConfig
+	quit					chan struct{}		// 关闭后停止 Start 和 InstantSync
+	writeLock				sync.Mutex			// 串行写入输出，binlog 回调与管理接口的全量导出并发
 }
 
 //队列类实现方法
@@ -56,56 +84,40 @@ type MqClass interface {
 }
 
 func Run(conf map[string]map[string]string){
-	database := config.GetConf("Database")
-	connectUri := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", database["user"], database["pass"], database["host"], database["port"], database["db"] ) 
-	server_id, err := strconv.ParseUint(database["server_id"], 10, 64)
+	// 链路追踪
+	initTrace(conf["Bubod"])
+	// 审计日志
+	initAudit(conf["Bubod"])
+
+	// 先检查所有数据源配置，任一配置错误则不启动
+	if _, err := config.Section(conf["Bubod"]).GetInt("ready_max_delay", 0); err != nil {
+		logger.WithError(err).Error("config file error")
+		return
+	}
+	if err := initObjectStore(conf); err != nil {
+		logger.WithError(err).Error("config file error")
+		return
+	}
+	if err := initSinks(conf); err != nil {
+		logger.WithError(err).Error("config file error")
+		return
+	}
+	// 选举后端，需在创建数据源之前初始化
+	election, err := NewElection(conf)
 	if err != nil {
-		log.Println("[error] config file server_id error:", err)
+		logger.WithError(err).Error("config file error")
 		return
 	}
-
-	dumpConfig := &DumpConfig{
-		ClusterName:		config.GetConfigVal("Bubod","cluster_name"),
-		NodeName:			config.GetConfigVal("Bubod","node_name"),
-		ConnectUri:			connectUri,
-		ServerId:			uint32(server_id),
-		TableMap:			make(map[string]*Table, 0),
-		FilterTableMap:		make(map[string]*Table, 0),
-		BinlogDumpFileName:	"", //"mysql-bin.000003",
-		BinlogDumpPosition:	0,  // 120,
-		Conf:				conf,
+	Election = election
+	Instances = NewInstanceManager(conf)
+	names := GetSourceNames(conf)
+	for _, name := range names {
+		if err := Instances.Add(name, conf[name]); err != nil {
+			logger.WithError(err).Error("config file error")
+			return
+		}
 	}
 
-	// // 高可用环境下 注册服务
-	// // var electionManager *ElectionManager
-	// dumpConfig.ZkErrorChan = make(chan bool)
-	// if (config.GetConfigVal("Zookeeper","server") != ""){
-	// 	zkserv := strings.Split(config.GetConfigVal("Zookeeper","server"), ",")
-
-	// 	// zookeeper配置
-	// 	zkConfig := &ZookeeperConfig{
-	// 		Servers:    zkserv, // []string{"127.0.0.1:2181"},
-	// 		RootPath:   "/"+dumpConfig.ClusterName,
-	// 		MasterPath: "/master",
-	// 	}
-	// 	isMasterChan := make(chan bool)
-	// 	var isMaster bool
-	// 	// 选举
-	// 	dumpConfig.ElectionManager = NewElectionManager(zkConfig, isMasterChan, dumpConfig.ZkErrorChan)
-	// 	go dumpConfig.ElectionManager.Run()
-
-	// 	log.Println("zookeeper elect master Waiting ...")
-
-	// 	for {
-	// 		isMaster = <-isMasterChan
-	// 		if isMaster {
-	// 			log.Println("zookeeper elect master success.")
-	// 			break
-	// 		}
-	// 		time.Sleep(1 * time.Second)
-	// 	}
-	// }
-
 	// // 初始化消息队列
 	// // var mqClass MqClass
 	// qname := config.GetConfigVal("Channel","qname")
@@ -137,35 +149,107 @@ func Run(conf map[string]map[string]string){
 	// 	return 
 	// }
 
-	// 获取最新位点
-	dumpConfig.GetLastPosition()
+	// 高可用环境下只有 leader 启动数据源，单节点时立即当选
+	go Election.Run()
+	logger.Info("waiting for election")
 
-	// 启动sync 位点同步服务
-	go dumpConfig.InstantSync()
+	// metrics / 管理接口
+	if listen := conf["Bubod"]["listen"]; listen != "" {
+		StartHttpServer(listen)
+	}
 
-	// started...
-	dumpConfig.AddDump().Start()
+	// 主进程阻塞，定时输出所有数据源状态，Shutdown 后返回
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			logSources()
+		case leader := <-Election.Changes():
+			if leader {
+				logger.Info("elected as leader, start instances")
+				startInstances()
+			} else {
+				logger.Warn("lost leadership, stop instances")
+				stopInstances()
+			}
+		case <-shutdownDone:
+			return
+		}
+	}
+}
+
+// 启动所有实例
+func startInstances() {
+	for _, ins := range Instances.instanceList() {
+		err := ins.start()
+		auditInstance(AUDIT_ACTOR_SYSTEM, AUDIT_ACTION_START, ins.dumpConfig.Name, "", err)
+		if err != nil {
+			ins.dumpConfig.logEntry().WithError(err).Error("start instance")
+		}
+	}
+}
+
+// 失去 leader 时停止所有实例，位点已保存，重新当选后从该位点继续
+func stopInstances() {
+	for _, ins := range Instances.instanceList() {
+		err := ins.stop()
+		auditInstance(AUDIT_ACTOR_SYSTEM, AUDIT_ACTION_STOP, ins.dumpConfig.Name, "lost leadership", err)
+		if err != nil {
+			ins.dumpConfig.logEntry().WithError(err).Error("stop instance")
+		}
+	}
 }
 
 // 参数生成配置
 func (dumpConfig *DumpConfig) AddDump() *dump {
 	
+	// 已在 checkConf 中检查
+	sessionTimeout, _ := dumpConfig.sourceConf().GetDuration("dump_session_timeout", 0)
+	heartbeatPeriod, _ := dumpConfig.sourceConf().GetDuration("heartbeat_period", 0)
+	dedupWindow, _ := dumpConfig.sourceConf().GetDuration("dedup_window", 0)
+	pipelineDepth, _ := dumpConfig.sourceConf().GetInt("pipeline_depth", 0)
+	maxTxnRows, _ := dumpConfig.sourceConf().GetInt("max_txn_rows", 0)
+	maxTxnBytes, _ := dumpConfig.sourceConf().GetInt("max_txn_bytes", 0)
+	preloadSchema, _ := dumpConfig.sourceConf().GetBool("preload_schema", false)
+	stopAt, _ := dumpConfig.stopCondition()
+	// 没有已保存的位点和 GTID 集合时按时间定位
+	startTime, _ := dumpConfig.datetime("start_datetime")
 	binlogDump := &mysql.BinlogDump{
+		Name: dumpConfig.Name,
 		DataSource: dumpConfig.ConnectUri,
-		ReplicateDoDb: make(map[string]uint8, 0),
-		OnlyEvent: []mysql.EventType{				//只关注 RowEvent 类型的同步事件
-						mysql.WRITE_ROWS_EVENTv1, 
-						mysql.UPDATE_ROWS_EVENTv1, 
-						mysql.DELETE_ROWS_EVENTv1,
-						mysql.WRITE_ROWS_EVENTv0, 
-						mysql.UPDATE_ROWS_EVENTv0, 
-						mysql.DELETE_ROWS_EVENTv0,
-						mysql.WRITE_ROWS_EVENTv2, 
-						mysql.UPDATE_ROWS_EVENTv2, 
-						mysql.DELETE_ROWS_EVENTv2,
-					},
+		Candidates: dumpConfig.Candidates,
+		SessionTimeout: int(sessionTimeout / time.Second),
+		HeartbeatPeriod: heartbeatPeriod,
+		InitSQL: dumpConfig.initSQL(),
+		SlaveUUID: dumpConfig.sourceConf().GetString("slave_uuid", ""),
+		PurgedPolicy: dumpConfig.Source["binlog_purged_policy"],
+		InvalidPositionPolicy: dumpConfig.Source["invalid_position_policy"],
+		ErrorPolicy: dumpConfig.GetSourceVal("error_policy"),
+		RowFormat: dumpConfig.sourceConf().GetString("row_format", mysql.ROW_FORMAT_MAP),
+		PipelineDepth: int(pipelineDepth),
+		MaxTransactionRows: maxTxnRows,
+		MaxTransactionBytes: maxTxnBytes,
+		LargeTransactionPolicy: dumpConfig.sourceConf().GetString("large_txn_policy", mysql.TXN_POLICY_STREAM),
+		TransactionAlert: dumpConfig.transactionThreshold(),
+		TransactionAlertFun: dumpConfig.transactionAlert,
+		LoopMarkerTable: dumpConfig.sourceConf().GetString("loop_marker_table", ""),
+		PauseBefore: dumpConfig.ddlPauseHook(),
+		PreloadSchema: preloadSchema,
+		ImportSchema: dumpConfig.importSchema,
+		StopAt: stopAt,
+		StartTime: startTime,
+		DedupWindow: dedupWindow,
+		Delivered: dumpConfig.delivered,
+		GTIDSet: dumpConfig.GTIDSet,
+		AllowReplica: dumpConfig.replica(),
+		ReplicateDoDb: dumpConfig.replicateDoDb(),
+		IgnoreCase: dumpConfig.IgnoreCase(),
+		TableFilter: dumpConfig.IsSyncTable,		// 不同步的表在解析时跳过，不解码行数据
+		OnlyEvent: dumpConfig.onlyEvent(),			// 默认只关注 RowEvent 类型的同步事件, 以及 DDL 所在的 QueryEvent
 	}
 
+	dumpConfig.binlogDump = binlogDump
 	return &dump{
 		ConnStatus:         	"starting",
 		ConnErr:            	"starting", 
@@ -175,6 +259,7 @@ func (dumpConfig *DumpConfig) AddDump() *dump {
 		replicateDoDb: 			make(map[string]uint8, 0),
 		killStatus:				0,
 		dumpConfig:				dumpConfig,
+		quit:					make(chan struct{}),
 	}
 }
 
@@ -182,6 +267,7 @@ func (dumpConfig *DumpConfig) AddDump() *dump {
 func (dump *dump) Start() {
 	reslut := make(chan error, 1)
 	dump.binlogDump.CallbackFun = dump.Callback
+	dump.binlogDump.ErrorCallbackFun = dump.ErrorCallback
 	go dump.binlogDump.StartDumpBinlog(dump.dumpConfig.BinlogDumpFileName, dump.dumpConfig.BinlogDumpPosition, dump.dumpConfig.ServerId, reslut, "", 0)
 
 	// 主进程阻塞
@@ -189,7 +275,13 @@ func (dump *dump) Start() {
 		select {
 		// 错误信息输出
 		case msg := <-reslut:
-			log.Printf("monitor reslut:%s \r\n", msg)
+			dump.dumpConfig.logEntry().WithError(msg).Warn("monitor reslut")
+			dump.Lock()
+			dump.ConnErr = fmt.Sprint(msg)
+			dump.Unlock()
+		// 实例已停止
+		case <-dump.quit:
+			return
 		// // zk状态监控
 		// case zkStatus := <-dump.dumpConfig.ZkErrorChan:
 		// 	if !zkStatus{
@@ -197,8 +289,7 @@ func (dump *dump) Start() {
 		// 		log.Printf("ZkErrorChan error\r\n")
 		// 		break
 		// 	}
-		// }
-		time.Sleep(1 * time.Second)
+		}
 	}
 
 }
\ No newline at end of file
@@ -0,0 +1,303 @@
+// 位点历史和保存点
+// 每次保存位点时记录一条历史(保存时间、位点、事件时间、已执行的 GTID 集合)，最多保留 [Bubod] checkpoint_history 条(默认 3600)，
+// 只在内存中，重启后清空。保存点是具名的位点，从当前已保存的位点或历史中某个时间之前的最后一条创建，
+// 保存在 data_dir/savepoints-{node}.json，重启后仍然有效。
+//
+// 回退(rewind)到保存点或某个时间: 运行中的实例先停止，按保存点的 GTID 集合(数据源按 GTID 同步时)或文件位点重新定位后启动，
+// 用于下游发布错误后重新处理一段数据。回退后该位点之后的事件会再次投递。
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/mysql"
+)
+
+const DEFAULT_CHECKPOINT_HISTORY = 3600
+
+// 保存点名称
+var savepointNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// 已保存的位点
+type Checkpoint struct {
+	Name      string `json:"name,omitempty"` // 保存点名称，历史记录为空
+	Time      string `json:"time"`           // 保存时间
+	File      string `json:"file"`
+	Position  uint32 `json:"position"`
+	Timestamp uint32 `json:"timestamp,omitempty"` // 位点对应事件的时间
+	GTIDSet   string `json:"gtid_set,omitempty"`  // 已执行的 GTID 集合
+	savedAt   time.Time
+}
+
+type checkpointHistory struct {
+	sync.Mutex
+	limit      int
+	entries    []*Checkpoint // 按保存时间排列
+	savepoints map[string]*Checkpoint
+	file       string // 保存点文件
+}
+
+func newCheckpointHistory(conf map[string]map[string]string, nodeName string) (*checkpointHistory, error) {
+	limit, err := config.Section(conf["Bubod"]).GetInt("checkpoint_history", DEFAULT_CHECKPOINT_HISTORY)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 0 {
+		return nil, fmt.Errorf("checkpoint_history must not be negative")
+	}
+	history := &checkpointHistory{
+		limit:      int(limit),
+		savepoints: make(map[string]*Checkpoint),
+		file:       conf["Bubod"]["data_dir"] + "/savepoints-" + nodeName + ".json",
+	}
+	data, err := ioutil.ReadFile(history.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return history, nil
+		}
+		return nil, err
+	}
+	savepoints := make([]*Checkpoint, 0)
+	if err := json.Unmarshal(data, &savepoints); err != nil {
+		return nil, fmt.Errorf("savepoint file %s: %s", history.file, err)
+	}
+	for _, savepoint := range savepoints {
+		history.savepoints[savepoint.Name] = savepoint
+	}
+	return history, nil
+}
+
+// 记录一次保存的位点
+func (history *checkpointHistory) record(checkpoint *Checkpoint) {
+	history.Lock()
+	defer history.Unlock()
+	if history.limit == 0 {
+		return
+	}
+	checkpoint.savedAt = time.Now()
+	checkpoint.Time = checkpoint.savedAt.Format("2006-01-02 15:04:05")
+	if len(history.entries) >= history.limit {
+		copy(history.entries, history.entries[1:])
+		history.entries = history.entries[:len(history.entries)-1]
+	}
+	history.entries = append(history.entries, checkpoint)
+}
+
+// 历史记录，最新的在前
+func (history *checkpointHistory) list() []*Checkpoint {
+	history.Lock()
+	defer history.Unlock()
+	list := make([]*Checkpoint, 0, len(history.entries))
+	for i := len(history.entries) - 1; i >= 0; i-- {
+		list = append(list, history.entries[i])
+	}
+	return list
+}
+
+// 保存时间不晚于 at 的最后一条历史
+func (history *checkpointHistory) before(at time.Time) (*Checkpoint, error) {
+	history.Lock()
+	defer history.Unlock()
+	for i := len(history.entries) - 1; i >= 0; i-- {
+		if !history.entries[i].savedAt.After(at) {
+			checkpoint := *history.entries[i]
+			return &checkpoint, nil
+		}
+	}
+	return nil, fmt.Errorf("no checkpoint before %s in history", at.Format("2006-01-02 15:04:05"))
+}
+
+func (history *checkpointHistory) savepointList() []*Checkpoint {
+	history.Lock()
+	defer history.Unlock()
+	return history.sortedSavepoints()
+}
+
+func (history *checkpointHistory) sortedSavepoints() []*Checkpoint {
+	list := make([]*Checkpoint, 0, len(history.savepoints))
+	for _, savepoint := range history.savepoints {
+		list = append(list, savepoint)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (history *checkpointHistory) savepoint(name string) (*Checkpoint, error) {
+	history.Lock()
+	defer history.Unlock()
+	savepoint, ok := history.savepoints[name]
+	if !ok {
+		return nil, fmt.Errorf("savepoint %s not found", name)
+	}
+	return savepoint, nil
+}
+
+// 添加或删除保存点后写入文件，先写临时文件再改名
+func (history *checkpointHistory) save() error {
+	data, err := json.MarshalIndent(history.sortedSavepoints(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := history.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, history.file)
+}
+
+func (history *checkpointHistory) addSavepoint(savepoint *Checkpoint) error {
+	if !savepointNamePattern.MatchString(savepoint.Name) {
+		return fmt.Errorf("invalid savepoint name %q", savepoint.Name)
+	}
+	history.Lock()
+	defer history.Unlock()
+	if _, ok := history.savepoints[savepoint.Name]; ok {
+		return fmt.Errorf("savepoint %s already exists", savepoint.Name)
+	}
+	history.savepoints[savepoint.Name] = savepoint
+	if err := history.save(); err != nil {
+		delete(history.savepoints, savepoint.Name)
+		return err
+	}
+	return nil
+}
+
+func (history *checkpointHistory) removeSavepoint(name string) error {
+	history.Lock()
+	defer history.Unlock()
+	savepoint, ok := history.savepoints[name]
+	if !ok {
+		return fmt.Errorf("savepoint %s not found", name)
+	}
+	delete(history.savepoints, name)
+	if err := history.save(); err != nil {
+		history.savepoints[name] = savepoint
+		return err
+	}
+	return nil
+}
+
+// 记录保存的位点，在 syncLock 中调用
+func (dumpConfig *DumpConfig) recordCheckpoint(file string, position uint32, timestamp uint32) {
+	checkpoint := &Checkpoint{File: file, Position: position, Timestamp: timestamp}
+	if binlogDump := dumpConfig.binlogDump; binlogDump != nil {
+		if gtidSet, ok := binlogDump.ExecutedGTIDSet(); ok {
+			checkpoint.GTIDSet = gtidSet
+		}
+	}
+	dumpConfig.checkpoints.record(checkpoint)
+}
+
+// 位点历史，最新的在前
+func (manager *InstanceManager) Checkpoints(name string) ([]*Checkpoint, error) {
+	ins, err := manager.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return ins.dumpConfig.checkpoints.list(), nil
+}
+
+func (manager *InstanceManager) Savepoints(name string) ([]*Checkpoint, error) {
+	ins, err := manager.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return ins.dumpConfig.checkpoints.savepointList(), nil
+}
+
+// 创建保存点，使用历史中不晚于 at 的最后一条，at 为零值时为最近保存的位点
+func (manager *InstanceManager) CreateSavepoint(name string, savepointName string, at time.Time) (*Checkpoint, error) {
+	ins, err := manager.get(name)
+	if err != nil {
+		return nil, err
+	}
+	dumpConfig := ins.dumpConfig
+	current := at.IsZero()
+	if current {
+		at = time.Now()
+	}
+	savepoint, err := dumpConfig.checkpoints.before(at)
+	// 还没有历史(未保留历史或重启后尚未保存)时使用当前已保存的位点
+	if err != nil && current {
+		dumpConfig.syncLock.Lock()
+		position, e := mysql.ParseBinlogPosition(dumpConfig.SyncPos)
+		savepoint = &Checkpoint{
+			Time:      time.Now().Format("2006-01-02 15:04:05"),
+			File:      position.File,
+			Position:  position.Pos,
+			Timestamp: dumpConfig.SyncTimestamp,
+			GTIDSet:   dumpConfig.syncGTIDSet,
+		}
+		dumpConfig.syncLock.Unlock()
+		if e != nil {
+			return nil, fmt.Errorf("no saved checkpoint: %s", e)
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	savepoint.Name = savepointName
+	if err := dumpConfig.checkpoints.addSavepoint(savepoint); err != nil {
+		return nil, err
+	}
+	return savepoint, nil
+}
+
+func (manager *InstanceManager) RemoveSavepoint(name string, savepointName string) error {
+	ins, err := manager.get(name)
+	if err != nil {
+		return err
+	}
+	return ins.dumpConfig.checkpoints.removeSavepoint(savepointName)
+}
+
+// 回退到保存点，savepointName 为空时回退到历史中不晚于 at 的最后一条，返回回退到的位点
+// 运行中的实例停止后重新定位并启动，已停止的实例只修改起始位点
+func (manager *InstanceManager) Rewind(name string, savepointName string, at time.Time) (*Checkpoint, error) {
+	ins, err := manager.get(name)
+	if err != nil {
+		return nil, err
+	}
+	var checkpoint *Checkpoint
+	if savepointName != "" {
+		checkpoint, err = ins.dumpConfig.checkpoints.savepoint(savepointName)
+	} else {
+		checkpoint, err = ins.dumpConfig.checkpoints.before(at)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ins.Lock()
+	running := ins.dump != nil
+	ins.Unlock()
+	if running {
+		if err := ins.stop(); err != nil {
+			return nil, err
+		}
+	}
+	// 数据源按 GTID 同步时按 GTID 集合定位，否则按文件位点
+	if checkpoint.GTIDSet != "" && ins.dumpConfig.GTIDSet != "" {
+		err = ins.seekGTID(checkpoint.GTIDSet)
+	} else {
+		err = ins.seek(checkpoint.File, checkpoint.Position)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if running {
+		if err := ins.start(); err != nil {
+			return checkpoint, fmt.Errorf("rewound but start failed: %s", err)
+		}
+	}
+	return checkpoint, nil
+}
@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"context"
+	"sync"
+
+	"bubod/Bubod/logger"
+)
+
+var (
+	shutdownOnce sync.Once
+	shutdownDone = make(chan struct{})
+)
+
+// 优雅退出
+// 停止读取 binlog，等待正在处理的事件写入输出，保存最后的位点，kill 服务端 dump 连接，
+// 之后关闭输出和审计日志，Run 返回。ctx 结束时不再等待未停止的实例，返回 ctx 错误，这些实例使用的输出不关闭。
+func Shutdown(ctx context.Context) error {
+	var err error
+	shutdownOnce.Do(func() {
+		if Instances != nil {
+			err = Instances.Shutdown(ctx)
+		}
+		if err != nil {
+			logger.WithError(err).Error("shutdown instances")
+		}
+		// 退出选举，其他节点可以立即接管
+		if e := Election.Close(); e != nil {
+			logger.WithError(e).Warn("close election")
+		}
+		// 超时未停止的实例仍可能写入输出，不关闭其使用的输出
+		var inUse map[*sinkEntry]bool
+		if Instances != nil {
+			inUse = Instances.runningSinks()
+		}
+		closeSinksExcept(inUse)
+		closeAudit()
+		close(shutdownDone)
+	})
+	return err
+}
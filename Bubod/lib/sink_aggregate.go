@@ -0,0 +1,262 @@
+// 按主键合并变更
+// [sink.N] 配置 aggregate_window 大于 0 时，窗口内同一行(库、表、主键 key 相同)的多次变更合并为一条，只输出最终状态，
+// 用于计数器等频繁更新的热点行，减少写入输出的消息数:
+//
+//	insert + update -> insert(更新后的行)    update + update -> update(第一次的 before，最后一次的 after)
+//	update + delete -> delete(第一次的 before) delete + insert -> update
+//	insert + delete -> 不输出
+//
+// 其他组合(如漏掉事件导致的 insert + insert)不合并。没有主键的表、修改主键的 update 不合并，之后的变更重新开始合并。
+// 窗口结束或合并的行数达到 aggregate_max_rows 时按每行第一次变更的顺序写入输出，不同行之间的顺序可能与 binlog 不同；
+// DDL、master 切换等其他事件先写入已合并的变更再写入。
+//
+// 合并后的消息中 binlog、gtid、timestamp 为最后一次变更的值，写入输出的事件由消息解析得到(见 mysql.ParseEventDataJson)。
+// 事件在其所有行合并后的消息写入输出(下层输出确认)后确认，窗口内的事件确认前位点不越过它们；停止实例时(Flush)写入已合并的变更。
+package lib
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+const DEFAULT_AGGREGATE_MAX_ROWS = 10000
+
+// 合并中的一行，message 为 nil 时已抵消(insert + delete)
+type aggregateRow struct {
+	key     string // 库、表、主键，不合并的消息为空
+	message *mysql.FormatDataJsonStruct
+	raw     string   // 不合并的消息原样写入
+	acks    []func() // 合并到该行的事件的确认，写入后调用
+}
+
+// 该行写入后的确认
+func (row *aggregateRow) ack() func() {
+	if len(row.acks) == 0 {
+		return nil
+	}
+	acks := row.acks
+	return func() {
+		for _, ack := range acks {
+			ack()
+		}
+	}
+}
+
+type aggregateSink struct {
+	sync.Mutex
+	name    string
+	sink    Sink
+	window  time.Duration
+	maxRows int
+	rows    []*aggregateRow
+	keys    map[string]*aggregateRow // 可以继续合并的行
+	started time.Time                // 窗口内第一次变更的时间
+	quit    chan struct{}
+}
+
+// aggregate_window 大于 0 时包装为合并变更的输出
+func newAggregateSink(name string, sink Sink, conf map[string]string) (Sink, error) {
+	section := config.Section(conf)
+	window, err := section.GetDuration("aggregate_window", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxRows, err := section.GetInt("aggregate_max_rows", DEFAULT_AGGREGATE_MAX_ROWS)
+	if err != nil {
+		return nil, err
+	}
+	if window <= 0 {
+		return sink, nil
+	}
+	if maxRows <= 0 {
+		maxRows = DEFAULT_AGGREGATE_MAX_ROWS
+	}
+	aggregate := &aggregateSink{
+		name:    name,
+		sink:    sink,
+		window:  window,
+		maxRows: int(maxRows),
+		keys:    make(map[string]*aggregateRow),
+		quit:    make(chan struct{}),
+	}
+	go aggregate.run()
+	return aggregate, nil
+}
+
+func (sink *aggregateSink) logEntry() *logger.Entry {
+	return logger.With(logger.Fields{"sink": sink.name})
+}
+
+// 窗口结束时写入
+func (sink *aggregateSink) run() {
+	interval := sink.window / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sink.quit:
+			return
+		case <-ticker.C:
+			sink.Lock()
+			if len(sink.rows) > 0 && time.Since(sink.started) >= sink.window {
+				if err := sink.flush(); err != nil {
+					sink.logEntry().WithError(err).Error("write aggregated rows, will retry")
+				}
+			}
+			sink.Unlock()
+		}
+	}
+}
+
+func (sink *aggregateSink) Write(data *mysql.EventReslut, messages []string) error {
+	return sink.WriteAck(data, messages, nil)
+}
+
+// 合并到窗口中，ack 在该事件所有行合并后的消息写入后调用
+func (sink *aggregateSink) WriteAck(data *mysql.EventReslut, messages []string, ack func()) error {
+	sink.Lock()
+	defer sink.Unlock()
+	if data.RowCount() == 0 || data.DDL != nil {
+		// DDL 等事件之前的变更先写入，不跨越表结构变更合并
+		if err := sink.flush(); err != nil {
+			return err
+		}
+		return writeAck(sink.sink, data, messages, ack)
+	}
+	if len(messages) == 0 {
+		if ack != nil {
+			ack()
+		}
+		return nil
+	}
+	if len(sink.rows) == 0 {
+		sink.started = time.Now()
+	}
+	ack = splitAck(ack, len(messages))
+	for _, message := range messages {
+		sink.add(data, message, ack)
+	}
+	if len(sink.rows) >= sink.maxRows {
+		return sink.flush()
+	}
+	return nil
+}
+
+func (sink *aggregateSink) add(data *mysql.EventReslut, message string, ack func()) {
+	var acks []func()
+	if ack != nil {
+		acks = []func(){ack}
+	}
+	parsed := new(mysql.FormatDataJsonStruct)
+	decoder := json.NewDecoder(bytes.NewReader([]byte(message)))
+	decoder.UseNumber()
+	if err := decoder.Decode(parsed); err != nil || parsed.Key == "" {
+		sink.rows = append(sink.rows, &aggregateRow{raw: message, acks: acks})
+		return
+	}
+	key := data.SchemaName + "\x00" + data.TableName + "\x00" + parsed.Key
+	if parsed.OldKey != "" && parsed.OldKey != parsed.Key {
+		// 修改主键，新旧主键之后的变更重新开始合并
+		delete(sink.keys, data.SchemaName+"\x00"+data.TableName+"\x00"+parsed.OldKey)
+		delete(sink.keys, key)
+		sink.rows = append(sink.rows, &aggregateRow{message: parsed, acks: acks})
+		return
+	}
+	if row, ok := sink.keys[key]; ok && mergeRowMessage(row, parsed) {
+		row.acks = append(row.acks, acks...)
+		metrics.SinkRowsAggregated.Inc(sink.name)
+		if row.message == nil {
+			delete(sink.keys, key)
+		}
+		return
+	}
+	row := &aggregateRow{key: key, message: parsed, acks: acks}
+	sink.rows = append(sink.rows, row)
+	sink.keys[key] = row
+}
+
+// 将同一行的下一次变更合并到 row，不能合并时返回 false
+func mergeRowMessage(row *aggregateRow, next *mysql.FormatDataJsonStruct) bool {
+	prev := row.message
+	merged := *next
+	switch prev.EventType + "+" + next.EventType {
+	case "insert+update":
+		merged.EventType, merged.Before, merged.After = "insert", next.After, make(map[string]driver.Value)
+	case "update+update":
+		merged.Before = prev.Before
+	case "update+delete":
+		merged.Before = prev.Before
+	case "delete+insert":
+		merged.EventType, merged.Before, merged.After = "update", prev.Before, next.Before
+	case "insert+delete":
+		row.message = nil
+		return true
+	default:
+		return false
+	}
+	row.message = &merged
+	return true
+}
+
+// 按顺序写入已合并的行，失败时保留未写入的行；抵消的行直接确认
+func (sink *aggregateSink) flush() error {
+	for len(sink.rows) > 0 {
+		row := sink.rows[0]
+		message := row.raw
+		if row.message != nil {
+			message = mysql.FormatEventDataJson(row.message)
+		}
+		if message != "" {
+			data, err := mysql.ParseEventDataJson([]byte(message))
+			if err != nil {
+				sink.logEntry().With(logger.Fields{"message": message}).WithError(err).Error("parse aggregated message")
+				data = &mysql.EventReslut{}
+			}
+			if err := writeAck(sink.sink, data, []string{message}, row.ack()); err != nil {
+				return err
+			}
+		} else if ack := row.ack(); ack != nil {
+			ack()
+		}
+		if row.key != "" && sink.keys[row.key] == row {
+			delete(sink.keys, row.key)
+		}
+		sink.rows[0] = nil
+		sink.rows = sink.rows[1:]
+	}
+	sink.rows = nil
+	return nil
+}
+
+func (sink *aggregateSink) Flush() error {
+	sink.Lock()
+	err := sink.flush()
+	sink.Unlock()
+	if err != nil {
+		return err
+	}
+	if flusher, ok := sink.sink.(SinkFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (sink *aggregateSink) Close() error {
+	close(sink.quit)
+	err := sink.Flush()
+	if e := sink.sink.Close(); err == nil {
+		err = e
+	}
+	return err
+}
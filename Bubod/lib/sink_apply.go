@@ -0,0 +1,525 @@
+// applier 输出
+// [sink.N] type=mysql 将行变更写入目标 MySQL(见 sink_mysql.go)，type=clickhouse 写入 ClickHouse(见 sink_clickhouse.go)，
+// type=sqlite 写入本地 SQLite 文件(见 sink_sqlite.go)，目标库表名与源库相同。
+// auto_ddl 为 off(默认)/generate(只生成 DDL)/execute(生成并执行)，按表结构缓存同步目标表结构，见 target_ddl.go；
+// 生成的 DDL 追加到 ddl_file，未配置时输出到日志。
+//
+// parallel 大于 1 时按库表名分配到 parallel 个协程并行写入，每个协程使用独立的连接:
+// 同一张表的事件由同一个协程按顺序写入，同一主键的变更顺序不变；不同表之间不保证顺序，跨表的事务不保证原子性。
+// DDL 事件是屏障，等待之前的所有事件写入后再执行，之后的事件在 DDL 之后写入；有协程写入失败时不等待，DDL 返回该错误。
+// 并行写入时事件进入协程队列后返回，写入目标库后确认(SinkAcker)，写入失败时每隔 retry_interval 重试直到成功；
+// 停止实例时(Flush)等待队列中的事件写入，未写入的事件不确认，重启后从其之前的位点重新同步(insert 幂等)。
+//
+// applier 使用事件中的行数据，render、computed_fields、sample、soft_delete_column、aggregate_window 等消息转换不生效；
+// 溢出到磁盘的事件没有行数据，不支持 spill_dir。
+package lib
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/mysql"
+)
+
+// auto_ddl
+const (
+	AUTO_DDL_OFF      = "off"
+	AUTO_DDL_GENERATE = "generate"
+	AUTO_DDL_EXECUTE  = "execute"
+)
+
+func init() {
+	RegisterSink("mysql", newMysqlApplySink)
+	RegisterSink("clickhouse", newClickhouseApplySink)
+	RegisterSink("sqlite", newSqliteApplySink)
+}
+
+// applier 的目标库
+type applyTarget interface {
+	dialect() string
+	// 依次执行语句
+	exec(statements []string) error
+	// 目标表已有的字段名，表不存在时返回空
+	tableColumns(schemaName string, tableName string) ([]string, error)
+	// 写入一个行事件
+	applyRows(data *mysql.EventReslut) error
+	Close() error
+}
+
+type applySink struct {
+	sync.Mutex               // tables、ddlFile
+	applyLock     sync.Mutex // target
+	name          string
+	target        applyTarget // 串行写入和执行 DDL 事件
+	autoDDL       string
+	dropColumns   bool
+	dropTables    bool
+	ddlFile       *os.File                       // 为 nil 时 DDL 输出到日志
+	tables        map[string]*appliedTableSchema // db.table => 目标表对应的表结构
+	workers       []*applyWorker                 // parallel 大于 1 时并行写入
+	retryInterval time.Duration
+	flushTimeout  time.Duration
+
+	pendingLock sync.Mutex
+	pendingCond *sync.Cond
+	pending     int // 已进入协程队列未写入的事件数
+	closed      bool
+	quit        chan struct{}
+	done        sync.WaitGroup
+}
+
+// 并行写入的协程
+type applyWorker struct {
+	target  applyTarget
+	events  chan *applyEvent
+	failure error // 当前事件写入失败的错误，写入成功后清除，pendingLock 保护
+}
+
+// 协程队列中的事件，写入后调用 ack
+type applyEvent struct {
+	data *mysql.EventReslut
+	ack  func()
+}
+
+// 目标表已同步到的表结构
+type appliedTableSchema struct {
+	version uint64
+	columns []*mysql.ColumnInfo
+}
+
+// newTarget 创建目标库的连接，并行写入时每个协程一个
+func newApplySink(name string, newTarget func() applyTarget, conf map[string]string) (Sink, error) {
+	section := config.Section(conf)
+	target := newTarget()
+	if section.GetString("spill_dir", "") != "" {
+		return nil, fmt.Errorf("spill_dir is not supported by %s sink", target.dialect())
+	}
+	sink := &applySink{
+		name:    name,
+		target:  target,
+		autoDDL: section.GetString("auto_ddl", AUTO_DDL_OFF),
+		tables:  make(map[string]*appliedTableSchema),
+		quit:    make(chan struct{}),
+	}
+	sink.pendingCond = sync.NewCond(&sink.pendingLock)
+	switch sink.autoDDL {
+	case AUTO_DDL_OFF, AUTO_DDL_GENERATE, AUTO_DDL_EXECUTE:
+	default:
+		return nil, fmt.Errorf("invalid auto_ddl %q, must be off, generate or execute", sink.autoDDL)
+	}
+	var err error
+	if sink.dropColumns, err = section.GetBool("drop_columns", false); err != nil {
+		return nil, err
+	}
+	if sink.dropTables, err = section.GetBool("drop_tables", false); err != nil {
+		return nil, err
+	}
+	parallel, err := section.GetInt("parallel", 1)
+	if err != nil {
+		return nil, err
+	}
+	if sink.retryInterval, err = section.GetDuration("retry_interval", DEFAULT_SINK_RETRY_INTERVAL); err != nil {
+		return nil, err
+	}
+	if sink.retryInterval <= 0 {
+		sink.retryInterval = DEFAULT_SINK_RETRY_INTERVAL
+	}
+	if sink.flushTimeout, err = section.GetDuration("flush_timeout", DEFAULT_SINK_FLUSH_TIMEOUT); err != nil {
+		return nil, err
+	}
+	if path := section.GetString("ddl_file", ""); path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if sink.ddlFile, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return nil, err
+		}
+	}
+	if parallel > 1 {
+		sink.workers = make([]*applyWorker, parallel)
+		for i := range sink.workers {
+			sink.workers[i] = &applyWorker{target: newTarget(), events: make(chan *applyEvent, 64)}
+			sink.done.Add(1)
+			go sink.run(sink.workers[i])
+		}
+	}
+	return sink, nil
+}
+
+func (sink *applySink) logEntry() *logger.Entry {
+	return logger.With(logger.Fields{"sink": sink.name})
+}
+
+func (sink *applySink) Write(data *mysql.EventReslut, messages []string) error {
+	return sink.WriteAck(data, messages, nil)
+}
+
+// 串行写入和 DDL 在写入后确认，并行写入由协程写入后确认
+func (sink *applySink) WriteAck(data *mysql.EventReslut, messages []string, ack func()) error {
+	if len(sink.workers) > 0 && data.DDL == nil && data.RowCount() > 0 && data.TableName != "" {
+		if err := checkApplyColumns(data); err != nil {
+			return err
+		}
+		return sink.dispatch(data, ack)
+	}
+	if err := sink.apply(data); err != nil {
+		return err
+	}
+	if ack != nil {
+		ack()
+	}
+	return nil
+}
+
+// 事件的字段名未知时不能写入
+func checkApplyColumns(data *mysql.EventReslut) error {
+	for _, column := range data.Columns {
+		if strings.HasPrefix(column.Name, "@") {
+			return fmt.Errorf("table %s.%s schema unknown", data.SchemaName, data.TableName)
+		}
+	}
+	return nil
+}
+
+// 串行写入行事件或执行 DDL
+func (sink *applySink) apply(data *mysql.EventReslut) error {
+	if data.DDL != nil {
+		// 屏障: 之前的事件写入后再执行 DDL
+		if err := sink.wait(0); err != nil {
+			return err
+		}
+		sink.applyLock.Lock()
+		defer sink.applyLock.Unlock()
+		return sink.applyDDL(data.DDL)
+	}
+	if data.RowCount() == 0 || data.TableName == "" {
+		return nil
+	}
+	if err := checkApplyColumns(data); err != nil {
+		return err
+	}
+	sink.applyLock.Lock()
+	defer sink.applyLock.Unlock()
+	return sink.applyRows(sink.target, data)
+}
+
+// 按库表分配到协程
+func (sink *applySink) dispatch(data *mysql.EventReslut, ack func()) error {
+	worker := sink.workers[crc32.ChecksumIEEE([]byte(data.SchemaName+"."+data.TableName))%uint32(len(sink.workers))]
+	sink.pendingLock.Lock()
+	if sink.closed {
+		sink.pendingLock.Unlock()
+		return fmt.Errorf("sink %s closed", sink.name)
+	}
+	sink.pending++
+	sink.pendingLock.Unlock()
+	data.Retain()
+	select {
+	case worker.events <- &applyEvent{data: data, ack: ack}:
+		return nil
+	case <-sink.quit:
+		sink.release()
+		return fmt.Errorf("sink %s closed", sink.name)
+	}
+}
+
+// 同步目标表结构后写入行事件
+func (sink *applySink) applyRows(target applyTarget, data *mysql.EventReslut) error {
+	if err := sink.syncTableSchema(target, data); err != nil {
+		return err
+	}
+	return target.applyRows(data)
+}
+
+// 按顺序写入分配到协程的事件，写入后确认，失败时重试
+func (sink *applySink) run(worker *applyWorker) {
+	defer sink.done.Done()
+	for {
+		select {
+		case <-sink.quit:
+			return
+		case event := <-worker.events:
+			data := event.data
+			for {
+				err := sink.applyRows(worker.target, data)
+				if err == nil {
+					break
+				}
+				sink.setFailure(worker, err)
+				sink.logEntry().With(data.LogFields()).WithError(err).Error("apply rows, retry in ", sink.retryInterval)
+				select {
+				case <-sink.quit:
+					return
+				case <-time.After(sink.retryInterval):
+				}
+			}
+			if event.ack != nil {
+				event.ack()
+			}
+			sink.setFailure(worker, nil)
+			sink.release()
+		}
+	}
+}
+
+// 记录协程写入失败，唤醒等待的 DDL
+func (sink *applySink) setFailure(worker *applyWorker, err error) {
+	sink.pendingLock.Lock()
+	worker.failure = err
+	sink.pendingCond.Broadcast()
+	sink.pendingLock.Unlock()
+}
+
+// 写入失败的协程的错误，调用时持有 pendingLock
+func (sink *applySink) failure() error {
+	for _, worker := range sink.workers {
+		if worker.failure != nil {
+			return worker.failure
+		}
+	}
+	return nil
+}
+
+// 一个事件写入完成
+func (sink *applySink) release() {
+	sink.pendingLock.Lock()
+	sink.pending--
+	sink.pendingCond.Broadcast()
+	sink.pendingLock.Unlock()
+}
+
+// 等待协程队列中的事件写入，timeout 为 0 时一直等待；有协程写入失败时返回该错误
+func (sink *applySink) wait(timeout time.Duration) error {
+	if len(sink.workers) == 0 {
+		return nil
+	}
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			sink.pendingLock.Lock()
+			sink.pendingCond.Broadcast()
+			sink.pendingLock.Unlock()
+		})
+		defer timer.Stop()
+	}
+	deadline := time.Now().Add(timeout)
+	sink.pendingLock.Lock()
+	defer sink.pendingLock.Unlock()
+	for sink.pending > 0 && sink.failure() == nil && !sink.closed && (timeout == 0 || time.Now().Before(deadline)) {
+		sink.pendingCond.Wait()
+	}
+	if err := sink.failure(); sink.pending > 0 && err != nil {
+		return fmt.Errorf("%d events not applied: %s", sink.pending, err)
+	}
+	if sink.pending > 0 {
+		return fmt.Errorf("%d events not applied", sink.pending)
+	}
+	return nil
+}
+
+// 首次写入或表结构版本变化时同步目标表结构
+func (sink *applySink) syncTableSchema(target applyTarget, data *mysql.EventReslut) error {
+	if sink.autoDDL == AUTO_DDL_OFF {
+		return nil
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	name := data.SchemaName + "." + data.TableName
+	applied, ok := sink.tables[name]
+	if ok && applied.version == data.SchemaVersion {
+		return nil
+	}
+	dialect := sink.target.dialect()
+	var statements []string
+	switch {
+	case ok:
+		statements = alterTableSQL(dialect, data.SchemaName, data.TableName, applied.columns, data.Columns, sink.dropColumns)
+	case sink.autoDDL == AUTO_DDL_EXECUTE:
+		existing, err := target.tableColumns(data.SchemaName, data.TableName)
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			statements = createTableSQL(dialect, data.SchemaName, data.TableName, data.Columns)
+		} else {
+			statements = addMissingColumnsSQL(dialect, data.SchemaName, data.TableName, data.Columns, existing)
+		}
+	default:
+		statements = createTableSQL(dialect, data.SchemaName, data.TableName, data.Columns)
+	}
+	if err := sink.ddl(target, statements); err != nil {
+		return err
+	}
+	sink.tables[name] = &appliedTableSchema{version: data.SchemaVersion, columns: data.Columns}
+	return nil
+}
+
+// 重命名、删除、清空表，其他 DDL 在之后的行事件中按表结构差异处理
+func (sink *applySink) applyDDL(ddl *mysql.DDLEvent) error {
+	if sink.autoDDL == AUTO_DDL_OFF {
+		return nil
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	dialect := sink.target.dialect()
+	var statements []string
+	switch ddl.Operation {
+	case mysql.DDL_RENAME_TABLE:
+		for _, rename := range ddl.Renames {
+			statements = append(statements, renameTableSQL(dialect, rename)...)
+		}
+	case mysql.DDL_DROP_TABLE:
+		if sink.dropTables {
+			for _, table := range ddl.DropTables() {
+				statements = append(statements, dropTableSQL(dialect, table.SchemaName, table.TableName))
+			}
+		}
+	case mysql.DDL_TRUNCATE_TABLE:
+		if sink.dropTables {
+			statements = append(statements, truncateTableSQL(dialect, ddl.SchemaName, ddl.TableName))
+		}
+	default:
+		return nil
+	}
+	if err := sink.ddl(sink.target, statements); err != nil {
+		return err
+	}
+	switch ddl.Operation {
+	case mysql.DDL_RENAME_TABLE:
+		for _, rename := range ddl.Renames {
+			old := rename.SchemaName + "." + rename.TableName
+			if applied, ok := sink.tables[old]; ok {
+				delete(sink.tables, old)
+				sink.tables[rename.NewSchemaName+"."+rename.NewTableName] = applied
+			}
+		}
+	case mysql.DDL_DROP_TABLE:
+		for _, table := range ddl.DropTables() {
+			delete(sink.tables, table.SchemaName+"."+table.TableName)
+		}
+	}
+	return nil
+}
+
+// 记录生成的 DDL，auto_ddl=execute 时执行
+func (sink *applySink) ddl(target applyTarget, statements []string) error {
+	if len(statements) == 0 {
+		return nil
+	}
+	if sink.ddlFile != nil {
+		if _, err := sink.ddlFile.WriteString(strings.Join(statements, ";\n") + ";\n"); err != nil {
+			return err
+		}
+	} else {
+		for _, statement := range statements {
+			sink.logEntry().With(logger.Fields{"auto_ddl": sink.autoDDL}).Info(statement)
+		}
+	}
+	if sink.autoDDL != AUTO_DDL_EXECUTE {
+		return nil
+	}
+	return target.exec(statements)
+}
+
+// 等待并行写入的事件
+func (sink *applySink) Flush() error {
+	return sink.wait(sink.flushTimeout)
+}
+
+func (sink *applySink) Close() error {
+	sink.pendingLock.Lock()
+	if sink.closed {
+		sink.pendingLock.Unlock()
+		return nil
+	}
+	sink.closed = true
+	close(sink.quit)
+	sink.pendingCond.Broadcast()
+	sink.pendingLock.Unlock()
+	sink.done.Wait()
+
+	sink.applyLock.Lock()
+	defer sink.applyLock.Unlock()
+	if sink.ddlFile != nil {
+		sink.ddlFile.Close()
+	}
+	for _, worker := range sink.workers {
+		worker.target.Close()
+	}
+	return sink.target.Close()
+}
+
+// 每个行变更的变更前、变更后的行，insert 没有变更前的行，delete 没有变更后的行
+func rowChanges(data *mysql.EventReslut) (before []map[string]driver.Value, after []map[string]driver.Value) {
+	rows := data.RowMaps()
+	switch mysql.EvenTypeName(data.Header.EventType) {
+	case "insert":
+		return make([]map[string]driver.Value, len(rows)), rows
+	case "delete":
+		return rows, make([]map[string]driver.Value, len(rows))
+	}
+	for i := 0; i+1 < len(rows); i += 2 {
+		before, after = append(before, rows[i]), append(after, rows[i+1])
+	}
+	return before, after
+}
+
+// SQL 字面量
+func targetValue(dialect string, value driver.Value) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if dialect == TARGET_POSTGRES {
+			if v {
+				return "TRUE"
+			}
+			return "FALSE"
+		}
+		if v {
+			return "1"
+		}
+		return "0"
+	case string:
+		return quoteTargetString(dialect, v)
+	case []byte:
+		if dialect == TARGET_MYSQL || dialect == TARGET_SQLITE {
+			return fmt.Sprintf("X'%X'", v)
+		}
+		return quoteTargetString(dialect, string(v))
+	case []string:
+		// SET 类型
+		return quoteTargetString(dialect, strings.Join(v, ","))
+	}
+	return fmt.Sprint(value)
+}
+
+// 定位行的条件，有主键时按主键，否则按所有字段
+func targetWhere(dialect string, columns []*mysql.ColumnInfo, row map[string]driver.Value) string {
+	conds := make([]string, 0)
+	keys := primaryColumns(columns)
+	if len(keys) == 0 {
+		for _, column := range columns {
+			keys = append(keys, column.Name)
+		}
+	}
+	for _, key := range keys {
+		value, ok := row[key]
+		if !ok {
+			continue
+		}
+		if value == nil {
+			conds = append(conds, quoteTargetName(dialect, key)+" IS NULL")
+		} else {
+			conds = append(conds, quoteTargetName(dialect, key)+"="+targetValue(dialect, value))
+		}
+	}
+	return strings.Join(conds, " AND ")
+}
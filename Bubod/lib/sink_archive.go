@@ -0,0 +1,201 @@
+// 归档到对象存储
+// [sink.N] type=archive 将消息按 ndjson(每行一条 json 消息)写入 [ObjectStorage] 配置的 bucket，
+// 归档文件可以直接用 bubod replay 回放。对象按写入时间(UTC)分目录，便于按前缀配置生命周期规则:
+//
+//	{prefix}/dt=2006-01-02/hour=15/{node}-20060102T150405Z-{seq}.ndjson[.gz]
+//
+// 对象通过分片上传写入，写满 roll_size 或打开超过 roll_interval 时完成上传并开始下一个对象，
+// 停止实例时(Flush)完成当前对象。未完成的对象不可见，其中的事件在对象上传完成后才确认，位点不越过它们；
+// 完成上传失败时对象被丢弃，其中的事件不确认，重新启动实例后从这些事件之前的位点重新同步。
+package lib
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/mysql"
+	"bubod/Bubod/objstore"
+)
+
+const (
+	DEFAULT_ARCHIVE_ROLL_SIZE     = 128 << 20
+	DEFAULT_ARCHIVE_ROLL_INTERVAL = 5 * time.Minute
+)
+
+func init() {
+	RegisterSink("archive", newArchiveSink)
+}
+
+type archiveSink struct {
+	sync.Mutex
+	name         string
+	client       *objstore.Client
+	prefix       string
+	node         string
+	compress     bool
+	rollSize     int64
+	rollInterval time.Duration
+
+	writer *objstore.Writer
+	gzip   *gzip.Writer
+	out    io.Writer // 写入当前对象，压缩时为 gzip
+	opened time.Time // 当前对象的创建时间
+	acks   []func()  // 当前对象中的事件的确认，上传完成后调用
+	seq    int
+	quit   chan struct{}
+}
+
+// prefix 默认为 archive/{输出名称去掉 sink. 前缀}，node 默认为主机名
+func newArchiveSink(name string, conf map[string]string) (Sink, error) {
+	if ObjectStore == nil {
+		return nil, fmt.Errorf("archive sink requires [ObjectStorage] bucket")
+	}
+	section := config.Section(conf)
+	sink := &archiveSink{
+		name:   name,
+		client: ObjectStore,
+		prefix: strings.Trim(section.GetString("prefix", "archive/"+strings.TrimPrefix(name, SINK_SECTION_PREFIX)), "/"),
+		node:   section.GetString("node", ""),
+		quit:   make(chan struct{}),
+	}
+	var err error
+	if sink.compress, err = section.GetBool("compress", false); err != nil {
+		return nil, err
+	}
+	if sink.rollSize, err = section.GetInt("roll_size", DEFAULT_ARCHIVE_ROLL_SIZE); err != nil {
+		return nil, err
+	}
+	if sink.rollInterval, err = section.GetDuration("roll_interval", DEFAULT_ARCHIVE_ROLL_INTERVAL); err != nil {
+		return nil, err
+	}
+	if sink.rollSize <= 0 || sink.rollInterval <= 0 {
+		return nil, fmt.Errorf("roll_size and roll_interval must be positive")
+	}
+	if sink.node == "" {
+		if sink.node, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	go sink.run()
+	return sink, nil
+}
+
+func (sink *archiveSink) logEntry() *logger.Entry {
+	return logger.With(logger.Fields{"sink": sink.name})
+}
+
+// 没有新消息时也按 roll_interval 完成对象
+func (sink *archiveSink) run() {
+	ticker := time.NewTicker(sink.rollInterval / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sink.quit:
+			return
+		case <-ticker.C:
+			sink.Lock()
+			if sink.writer != nil && time.Since(sink.opened) >= sink.rollInterval {
+				if err := sink.roll(); err != nil {
+					sink.logEntry().WithError(err).Error("roll archive")
+				}
+			}
+			sink.Unlock()
+		}
+	}
+}
+
+func (sink *archiveSink) objectKey(now time.Time) string {
+	now = now.UTC()
+	sink.seq++
+	key := fmt.Sprintf("%s/dt=%s/hour=%s/%s-%s-%d.ndjson",
+		sink.prefix, now.Format("2006-01-02"), now.Format("15"), sink.node, now.Format("20060102T150405Z"), sink.seq)
+	if sink.compress {
+		key += ".gz"
+	}
+	return key
+}
+
+func (sink *archiveSink) open() {
+	sink.opened = time.Now()
+	sink.writer = sink.client.NewWriter(sink.objectKey(sink.opened))
+	sink.out = sink.writer
+	if sink.compress {
+		sink.gzip = gzip.NewWriter(sink.writer)
+		sink.out = sink.gzip
+	}
+}
+
+// 完成当前对象
+func (sink *archiveSink) roll() error {
+	if sink.writer == nil {
+		return nil
+	}
+	writer, acks := sink.writer, sink.acks
+	sink.acks = nil
+	var err error
+	if sink.gzip != nil {
+		err = sink.gzip.Close()
+	}
+	if err == nil {
+		err = writer.Close()
+	} else {
+		writer.Abort()
+	}
+	sink.writer, sink.gzip, sink.out = nil, nil, nil
+	if err != nil {
+		sink.logEntry().With(logger.Fields{"key": writer.Key(), "events": len(acks)}).Error("archive object discarded, restart the instance to resync its events")
+		return fmt.Errorf("%s: %s", sink.client.URL(writer.Key()), err)
+	}
+	sink.logEntry().With(logger.Fields{"key": writer.Key(), "size": writer.Size()}).Info("archive object uploaded")
+	for _, ack := range acks {
+		ack()
+	}
+	return nil
+}
+
+func (sink *archiveSink) Write(data *mysql.EventReslut, messages []string) error {
+	return sink.WriteAck(data, messages, nil)
+}
+
+// 写入当前对象，ack 在对象上传完成后调用
+func (sink *archiveSink) WriteAck(data *mysql.EventReslut, messages []string, ack func()) error {
+	sink.Lock()
+	defer sink.Unlock()
+	if sink.writer == nil {
+		sink.open()
+	}
+	for _, message := range messages {
+		if _, err := io.WriteString(sink.out, message+"\n"); err != nil {
+			return err
+		}
+	}
+	if ack != nil {
+		sink.acks = append(sink.acks, ack)
+	}
+	// 分片上传失败时消息保留在缓冲中，之后重试，不返回错误避免重复写入
+	if err := sink.writer.Err(); err != nil {
+		sink.logEntry().WithError(err).Warn("upload archive part, will retry")
+	}
+	if sink.writer.Size() >= sink.rollSize {
+		return sink.roll()
+	}
+	return nil
+}
+
+func (sink *archiveSink) Flush() error {
+	sink.Lock()
+	defer sink.Unlock()
+	return sink.roll()
+}
+
+func (sink *archiveSink) Close() error {
+	close(sink.quit)
+	return sink.Flush()
+}
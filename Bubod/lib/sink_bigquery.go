@@ -0,0 +1,213 @@
+// BigQuery 微批载入
+// [sink.N] type=bigquery 通过 REST 接口提交作业，不依赖 SDK: staging 对象通过 load 作业从 gs://{bucket}/{key} 载入临时表，
+// [ObjectStorage] 需要为 type=gcs；再以查询作业 MERGE/INSERT 到 {project}.{db}.{table}，库为 dataset。
+// 访问令牌为 token 或 token_command 的输出(如 gcloud auth print-access-token)。
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/mysql"
+)
+
+const BIGQUERY_API = "https://bigquery.googleapis.com/bigquery/v2"
+
+type bigqueryLoader struct {
+	project  string
+	location string
+	token    *warehouseToken
+	client   *http.Client
+	dialect  *warehouseDialect
+	tables   map[string]map[string]bool // 目标表已有的字段
+}
+
+func newBigqueryWarehouseSink(name string, conf map[string]string) (Sink, error) {
+	section := config.Section(conf)
+	loader := &bigqueryLoader{
+		project:  section.GetString("project", ""),
+		location: section.GetString("location", ""),
+		tables:   make(map[string]map[string]bool),
+	}
+	if loader.project == "" {
+		return nil, fmt.Errorf("project is required")
+	}
+	var err error
+	if loader.token, err = newWarehouseToken(section); err != nil {
+		return nil, err
+	}
+	timeout, err := section.GetDuration("timeout", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	loader.client = &http.Client{Timeout: timeout}
+	loader.dialect = &warehouseDialect{
+		quoteName:  quoteBigqueryName,
+		columnType: bigqueryColumnType,
+		stringType: "STRING",
+		intType:    "INT64",
+		safeCast:   "SAFE_CAST",
+	}
+	return newWarehouseSink(name, conf, loader)
+}
+
+func quoteBigqueryName(name string) string {
+	return "`" + strings.Replace(name, "`", "\\`", -1) + "`"
+}
+
+func bigqueryColumnType(column *mysql.ColumnInfo) string {
+	base, _, unsigned := splitColumnType(column.Type)
+	switch base {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "year", "bit":
+		return "INT64"
+	case "bigint":
+		if unsigned {
+			return "BIGNUMERIC"
+		}
+		return "INT64"
+	case "float", "double", "real":
+		return "FLOAT64"
+	case "decimal", "numeric":
+		return "BIGNUMERIC"
+	case "date":
+		return "DATE"
+	case "datetime":
+		return "DATETIME"
+	case "timestamp":
+		return "TIMESTAMP"
+	}
+	return "STRING"
+}
+
+// project.dataset.table
+func (loader *bigqueryLoader) table(schemaName string, tableName string) string {
+	return quoteBigqueryName(loader.project + "." + schemaName + "." + tableName)
+}
+
+type bigqueryJob struct {
+	JobReference struct {
+		JobID    string `json:"jobId"`
+		Location string `json:"location"`
+	} `json:"jobReference"`
+	Status struct {
+		State       string `json:"state"`
+		ErrorResult *struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errorResult"`
+	} `json:"status"`
+}
+
+// 提交作业并等待完成
+func (loader *bigqueryLoader) runJob(configuration map[string]interface{}) error {
+	job := &bigqueryJob{}
+	request := map[string]interface{}{"configuration": configuration}
+	if loader.location != "" {
+		request["jobReference"] = map[string]string{"location": loader.location}
+	}
+	if _, err := warehouseRequest(loader.client, loader.token, http.MethodPost,
+		fmt.Sprintf("%s/projects/%s/jobs", BIGQUERY_API, url.PathEscape(loader.project)), nil, request, job); err != nil {
+		return err
+	}
+	for job.Status.State != "DONE" {
+		time.Sleep(time.Second)
+		query := url.Values{}
+		if job.JobReference.Location != "" {
+			query.Set("location", job.JobReference.Location)
+		}
+		if _, err := warehouseRequest(loader.client, loader.token, http.MethodGet,
+			fmt.Sprintf("%s/projects/%s/jobs/%s?%s", BIGQUERY_API, url.PathEscape(loader.project), url.PathEscape(job.JobReference.JobID), query.Encode()),
+			nil, nil, job); err != nil {
+			return err
+		}
+	}
+	if job.Status.ErrorResult != nil {
+		return fmt.Errorf("bigquery job %s: %s: %s", job.JobReference.JobID, job.Status.ErrorResult.Reason, job.Status.ErrorResult.Message)
+	}
+	return nil
+}
+
+func (loader *bigqueryLoader) query(statement string) error {
+	if err := loader.runJob(map[string]interface{}{
+		"query": map[string]interface{}{"query": statement, "useLegacySql": false},
+	}); err != nil {
+		return fmt.Errorf("%s: %s", statement, err)
+	}
+	return nil
+}
+
+// 创建 dataset 和目标表，添加缺少的字段
+func (loader *bigqueryLoader) syncTable(batch *warehouseBatch) error {
+	name := batch.schemaName + "." + batch.tableName
+	existing, ok := loader.tables[name]
+	definitions := loader.dialect.columnDefinitions(batch)
+	if !ok {
+		options := ""
+		if loader.location != "" {
+			options = fmt.Sprintf(" OPTIONS(location=%q)", loader.location)
+		}
+		if err := loader.query("CREATE SCHEMA IF NOT EXISTS " + quoteBigqueryName(loader.project+"."+batch.schemaName) + options); err != nil {
+			return err
+		}
+		if err := loader.query(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)",
+			loader.table(batch.schemaName, batch.tableName), strings.Join(definitions, ", "))); err != nil {
+			return err
+		}
+		existing = make(map[string]bool)
+	}
+	adds := make([]string, 0)
+	for i, column := range batch.columns {
+		if !existing[column.Name] {
+			adds = append(adds, "ADD COLUMN IF NOT EXISTS "+definitions[i])
+		}
+	}
+	if len(adds) > 0 {
+		if err := loader.query(fmt.Sprintf("ALTER TABLE %s %s", loader.table(batch.schemaName, batch.tableName), strings.Join(adds, ", "))); err != nil {
+			return err
+		}
+	}
+	for _, column := range batch.columns {
+		existing[column.Name] = true
+	}
+	loader.tables[name] = existing
+	return nil
+}
+
+func (loader *bigqueryLoader) load(batch *warehouseBatch) error {
+	if err := loader.syncTable(batch); err != nil {
+		return err
+	}
+	fields := make([]map[string]string, 0, len(batch.columns)+len(warehouseMetaColumns))
+	for _, column := range batch.columns {
+		fields = append(fields, map[string]string{"name": column.Name, "type": "STRING", "mode": "NULLABLE"})
+	}
+	for _, name := range warehouseMetaColumns {
+		fields = append(fields, map[string]string{"name": name, "type": "STRING", "mode": "NULLABLE"})
+	}
+	sourceFormat := "NEWLINE_DELIMITED_JSON"
+	if batch.format == WAREHOUSE_FORMAT_PARQUET {
+		sourceFormat = "PARQUET"
+	}
+	stageTable := batch.tableName + WAREHOUSE_STAGE_SUFFIX
+	if err := loader.runJob(map[string]interface{}{
+		"load": map[string]interface{}{
+			"sourceUris":        []string{"gs://" + ObjectStore.Bucket() + "/" + ObjectStore.Key(batch.key)},
+			"sourceFormat":      sourceFormat,
+			"schema":            map[string]interface{}{"fields": fields},
+			"destinationTable":  map[string]string{"projectId": loader.project, "datasetId": batch.schemaName, "tableId": stageTable},
+			"writeDisposition":  "WRITE_TRUNCATE",
+			"createDisposition": "CREATE_IF_NEEDED",
+		},
+	}); err != nil {
+		return fmt.Errorf("load %s: %s", ObjectStore.URL(batch.key), err)
+	}
+	stage := loader.table(batch.schemaName, stageTable)
+	if err := loader.query(loader.dialect.loadSQL(batch, loader.table(batch.schemaName, batch.tableName), stage)); err != nil {
+		return err
+	}
+	return loader.query("DROP TABLE IF EXISTS " + stage)
+}
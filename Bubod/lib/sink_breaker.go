@@ -0,0 +1,204 @@
+// 输出熔断
+// [sink.N] 配置 breaker_failures 大于 0 时(需要 queue_size)，连续写入失败 breaker_failures 次后熔断(open)，同步不再等待该输出:
+// 配置 spill_dir 时新事件追加到磁盘，恢复后按顺序写入；否则事件以 json 行追加到死信文件 dlq_file，视为已投递，不再写入输出。
+// 熔断期间每隔 breaker_probe_interval 用待写入的事件探测输出(half_open)，成功后恢复(closed)，失败时继续熔断。
+// 熔断和恢复时记录日志、调用 SinkBreakerCallback，配置了 breaker_webhook 时同时 POST 到该地址；
+// 当前状态见指标 bubod_sink_breaker_state。磁盘超过 spill_max_bytes 时仍然阻塞同步。
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+const (
+	SINK_BREAKER_CLOSED    = "closed"
+	SINK_BREAKER_OPEN      = "open"
+	SINK_BREAKER_HALF_OPEN = "half_open"
+)
+
+const DEFAULT_SINK_BREAKER_PROBE_INTERVAL = 30 * time.Second
+
+// 熔断状态变化通知
+type SinkBreakerEvent struct {
+	Sink     string `json:"sink"`
+	State    string `json:"state"`    // open/closed
+	Failures int    `json:"failures"` // 连续失败次数
+	Error    string `json:"error"`    // 最后一次失败的错误
+	Time     int64  `json:"time"`
+}
+
+// 熔断状态变化回调，供内嵌使用
+var SinkBreakerCallback func(event *SinkBreakerEvent)
+
+type sinkBreaker struct {
+	name          string
+	failures      int
+	probeInterval time.Duration
+	webhook       string
+
+	lock        sync.Mutex
+	state       string
+	consecutive int // 连续失败次数
+	lastError   error
+	nextProbe   time.Time
+}
+
+// breaker_failures 大于 0 时创建，否则返回 nil
+func newSinkBreaker(name string, section config.Section) (*sinkBreaker, error) {
+	failures, err := section.GetInt("breaker_failures", 0)
+	if err != nil || failures <= 0 {
+		return nil, err
+	}
+	probeInterval, err := section.GetDuration("breaker_probe_interval", DEFAULT_SINK_BREAKER_PROBE_INTERVAL)
+	if err != nil {
+		return nil, err
+	}
+	if probeInterval <= 0 {
+		probeInterval = DEFAULT_SINK_BREAKER_PROBE_INTERVAL
+	}
+	breaker := &sinkBreaker{
+		name:          name,
+		failures:      int(failures),
+		probeInterval: probeInterval,
+		webhook:       section.GetString("breaker_webhook", ""),
+		state:         SINK_BREAKER_CLOSED,
+	}
+	metrics.SinkBreakerState.Set(0, name)
+	return breaker, nil
+}
+
+// 是否熔断(包括探测中)
+func (breaker *sinkBreaker) isOpen() bool {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	return breaker.state != SINK_BREAKER_CLOSED
+}
+
+// 是否到达探测时间
+func (breaker *sinkBreaker) probeDue() bool {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	return breaker.state == SINK_BREAKER_OPEN && !time.Now().Before(breaker.nextProbe)
+}
+
+// 是否可以写入输出，不能写入时返回需要等待的时间；熔断时到达探测时间的第一个调用者开始探测
+func (breaker *sinkBreaker) allow(poll time.Duration) time.Duration {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	switch breaker.state {
+	case SINK_BREAKER_CLOSED:
+		return 0
+	case SINK_BREAKER_OPEN:
+		if wait := breaker.nextProbe.Sub(time.Now()); wait > 0 {
+			return wait
+		}
+		breaker.setState(SINK_BREAKER_HALF_OPEN)
+		return 0
+	}
+	// 其他写入协程等待探测结果
+	return poll
+}
+
+// 记录写入结果
+func (breaker *sinkBreaker) record(err error) {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	if err == nil {
+		breaker.consecutive = 0
+		if breaker.state != SINK_BREAKER_CLOSED {
+			breaker.lastError = nil
+			breaker.setState(SINK_BREAKER_CLOSED)
+			breaker.notify()
+		}
+		return
+	}
+	breaker.consecutive++
+	breaker.lastError = err
+	switch {
+	case breaker.state == SINK_BREAKER_HALF_OPEN:
+		breaker.setState(SINK_BREAKER_OPEN)
+		breaker.nextProbe = time.Now().Add(breaker.probeInterval)
+	case breaker.state == SINK_BREAKER_CLOSED && breaker.consecutive >= breaker.failures:
+		breaker.setState(SINK_BREAKER_OPEN)
+		breaker.nextProbe = time.Now().Add(breaker.probeInterval)
+		breaker.notify()
+	}
+}
+
+// 调用时持有锁
+func (breaker *sinkBreaker) setState(state string) {
+	breaker.state = state
+	value := map[string]float64{SINK_BREAKER_CLOSED: 0, SINK_BREAKER_OPEN: 1, SINK_BREAKER_HALF_OPEN: 2}[state]
+	metrics.SinkBreakerState.Set(value, breaker.name)
+}
+
+// 熔断和恢复时通知，调用时持有锁
+func (breaker *sinkBreaker) notify() {
+	event := &SinkBreakerEvent{
+		Sink:     breaker.name,
+		State:    breaker.state,
+		Failures: breaker.consecutive,
+		Time:     time.Now().Unix(),
+	}
+	if breaker.lastError != nil {
+		event.Error = breaker.lastError.Error()
+	}
+	entry := logger.With(logger.Fields{"sink": breaker.name, "state": event.State, "failures": event.Failures, "error": event.Error})
+	if event.State == SINK_BREAKER_OPEN {
+		entry.Warn("sink circuit open")
+	} else {
+		entry.Info("sink circuit closed")
+	}
+	if SinkBreakerCallback != nil {
+		go SinkBreakerCallback(event)
+	}
+	if breaker.webhook != "" {
+		go postAlert(breaker.webhook, breaker.name, event)
+	}
+}
+
+// 最后一次失败的错误
+func (breaker *sinkBreaker) err() error {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	return breaker.lastError
+}
+
+// 死信文件中的事件
+type sinkDeadLetter struct {
+	Sink  string `json:"sink"`
+	Error string `json:"error"`
+	Time  int64  `json:"time"`
+	*spillRecord
+}
+
+// 以 json 行追加到死信文件
+func (sink *queuedSink) deadLetter(data *mysql.EventReslut, messages []string, cause error) error {
+	letter := &sinkDeadLetter{Sink: sink.name, Time: time.Now().Unix(), spillRecord: newSpillRecord(data, messages)}
+	if cause != nil {
+		letter.Error = cause.Error()
+	}
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(sink.dlqFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open dlq file: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("write dlq file: %s", err)
+	}
+	metrics.SinkEventsDeadLettered.Inc(sink.name)
+	return nil
+}
@@ -0,0 +1,150 @@
+// ClickHouse applier
+// [sink.N] type=clickhouse 通过 HTTP 接口写入 ClickHouse，表引擎为 ReplacingMergeTree(_version)，按主键排序:
+// insert/update 写入变更后的行，delete 写入变更前的行并置 _is_deleted=1，update 修改了主键时同时删除旧主键的行；
+// _version 为写入时间(纳秒)，查询时使用 FINAL 并过滤 _is_deleted=0 得到最新状态。
+// 同一事件的所有行在一个 INSERT 中写入。
+package lib
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/mysql"
+)
+
+type clickhouseApplyTarget struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+	version  uint64 // 上次写入的 _version，保证单调递增
+}
+
+func newClickhouseApplySink(name string, conf map[string]string) (Sink, error) {
+	section := config.Section(conf)
+	timeout, err := section.GetDuration("timeout", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	url := strings.TrimRight(section.GetString("url", ""), "/") + "/"
+	if url == "/" {
+		return nil, fmt.Errorf("url is required")
+	}
+	client := &http.Client{Timeout: timeout}
+	return newApplySink(name, func() applyTarget {
+		return &clickhouseApplyTarget{
+			url:      url,
+			user:     section.GetString("user", ""),
+			password: section.GetString("password", ""),
+			client:   client,
+		}
+	}, conf)
+}
+
+func (target *clickhouseApplyTarget) dialect() string {
+	return TARGET_CLICKHOUSE
+}
+
+// 执行一条语句，返回结果
+func (target *clickhouseApplyTarget) query(statement string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, target.url, bytes.NewReader([]byte(statement)))
+	if err != nil {
+		return nil, err
+	}
+	if target.user != "" {
+		req.Header.Set("X-ClickHouse-User", target.user)
+		req.Header.Set("X-ClickHouse-Key", target.password)
+	}
+	resp, err := target.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("clickhouse: %s", strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func (target *clickhouseApplyTarget) exec(statements []string) error {
+	for _, statement := range statements {
+		if _, err := target.query(statement); err != nil {
+			return fmt.Errorf("%s: %s", statement, err)
+		}
+	}
+	return nil
+}
+
+func (target *clickhouseApplyTarget) tableColumns(schemaName string, tableName string) ([]string, error) {
+	dialect := TARGET_CLICKHOUSE
+	body, err := target.query(fmt.Sprintf("SELECT name FROM system.columns WHERE database=%s AND table=%s ORDER BY position FORMAT TabSeparated",
+		quoteTargetString(dialect, schemaName), quoteTargetString(dialect, tableName)))
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, 0)
+	for _, line := range strings.Split(string(body), "\n") {
+		if line != "" && line != CLICKHOUSE_VERSION_COLUMN && line != CLICKHOUSE_DELETED_COLUMN {
+			columns = append(columns, line)
+		}
+	}
+	return columns, nil
+}
+
+// 递增的 _version
+func (target *clickhouseApplyTarget) nextVersion() uint64 {
+	version := uint64(time.Now().UnixNano())
+	if version <= target.version {
+		version = target.version + 1
+	}
+	target.version = version
+	return version
+}
+
+func (target *clickhouseApplyTarget) applyRows(data *mysql.EventReslut) error {
+	dialect := TARGET_CLICKHOUSE
+	names := make([]string, 0, len(data.Columns)+2)
+	for _, column := range data.Columns {
+		names = append(names, quoteTargetName(dialect, column.Name))
+	}
+	names = append(names, quoteTargetName(dialect, CLICKHOUSE_VERSION_COLUMN), quoteTargetName(dialect, CLICKHOUSE_DELETED_COLUMN))
+	tuples := make([]string, 0, data.RowCount())
+	tuple := func(row map[string]driver.Value, deleted int) {
+		values := make([]string, 0, len(names))
+		for _, column := range data.Columns {
+			values = append(values, targetValue(dialect, row[column.Name]))
+		}
+		values = append(values, fmt.Sprint(target.nextVersion()), fmt.Sprint(deleted))
+		tuples = append(tuples, "("+strings.Join(values, ",")+")")
+	}
+	before, after := rowChanges(data)
+	for i := range after {
+		switch {
+		case after[i] == nil:
+			tuple(before[i], 1)
+		case before[i] == nil:
+			tuple(after[i], 0)
+		default:
+			if data.OldKey(i) != nil {
+				tuple(before[i], 1)
+			}
+			tuple(after[i], 0)
+		}
+	}
+	return target.exec([]string{fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", quoteTargetTable(dialect, data.SchemaName, data.TableName),
+		strings.Join(names, ","), strings.Join(tuples, ","))})
+}
+
+func (target *clickhouseApplyTarget) Close() error {
+	return nil
+}
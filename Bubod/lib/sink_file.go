@@ -0,0 +1,421 @@
+// 输出到本地文件
+// [sink.N] type=file 将消息按 ndjson(每行一条 json 消息)追加写入 path，可以直接用 bubod replay 回放。
+// 每条消息带有事件的位点 binlog 和所在事务的 gtid，数据源配置 recover_from_sink 时启动时从文件末尾读取最后写入的位点，
+// 不依赖位点文件、选举后端等外部位点，见 sink_recovery.go。
+//
+// 每次 Write 追加一次，sync=true 时 Flush(停止实例、保存位点前)调用 fsync。
+// 文件不轮转，使用 logrotate 时需要 copytruncate；截断后文件为空，从其他来源的位点恢复。
+//
+// format=parquet 时 path 为目录，行变更按表和事件日期(UTC)分区写入 Parquet 文件，可以直接作为 Spark、Trino 的 Hive 分区表:
+//
+//	{path}/{db}.{table}/dt=2006-01-02/{node}-20060102T150405Z-{seq}.parquet
+//
+// 字段为 _binlog、_timestamp、_event_type + 表字段，类型按表结构转换(见 ParquetColumns)，insert/update 为变更后的值，delete 为删除前的值。
+// 文件写满 roll_rows 行、打开超过 roll_interval、日期或表结构变化、Flush 时完成，写入中的文件以 .tmp 结尾，
+// 事件在所在文件完成后确认，位点不越过未完成文件中的事件，进程崩溃时未完成的文件丢失，重启后重新写入；不支持 recover_from_sink。
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/mysql"
+	"bubod/Bubod/parquet"
+)
+
+// 从文件末尾向前读取的块大小
+const FILE_SINK_TAIL_BLOCK = 64 << 10
+
+const (
+	FILE_FORMAT_NDJSON  = "ndjson"
+	FILE_FORMAT_PARQUET = "parquet"
+
+	DEFAULT_PARQUET_ROLL_ROWS     = 1000000
+	DEFAULT_PARQUET_ROLL_INTERVAL = 5 * time.Minute
+)
+
+// Parquet 文件中每行变更附带的字段
+var ParquetMetaColumns = []parquet.Column{
+	{Name: "_binlog", Type: parquet.STRING},
+	{Name: "_timestamp", Type: parquet.INT64},
+	{Name: "_event_type", Type: parquet.STRING},
+}
+
+func init() {
+	RegisterSink("file", newFileSink)
+}
+
+type fileSink struct {
+	sync.Mutex
+	name   string
+	path   string
+	sync   bool
+	format string
+	file   *os.File
+
+	// format=parquet
+	node         string
+	rollRows     int64
+	rollInterval time.Duration
+	parquetFiles map[string]*parquetFile // db.table
+	seq          int
+	quit         chan struct{}
+}
+
+// 一张表当前写入的 Parquet 文件
+type parquetFile struct {
+	path    string // 完成后的文件名，写入时加 .tmp
+	date    string
+	version uint64
+	file    *os.File
+	buf     *bufio.Writer
+	writer  *parquet.Writer
+	rows    int64
+	opened  time.Time
+	acks    []func() // 文件中的事件的确认，完成后调用
+}
+
+func newFileSink(name string, conf map[string]string) (Sink, error) {
+	section := config.Section(conf)
+	sink := &fileSink{name: name, path: section.GetString("path", ""), format: section.GetString("format", FILE_FORMAT_NDJSON)}
+	if sink.path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	var err error
+	if sink.sync, err = section.GetBool("sync", false); err != nil {
+		return nil, err
+	}
+	switch sink.format {
+	case FILE_FORMAT_NDJSON:
+	case FILE_FORMAT_PARQUET:
+		return newParquetFileSink(sink, section)
+	default:
+		return nil, fmt.Errorf("invalid format %q, must be ndjson or parquet", sink.format)
+	}
+	if err := os.MkdirAll(filepath.Dir(sink.path), 0755); err != nil {
+		return nil, err
+	}
+	if sink.file, err = os.OpenFile(sink.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// node 默认为主机名
+func newParquetFileSink(sink *fileSink, section config.Section) (Sink, error) {
+	var err error
+	if sink.rollRows, err = section.GetInt("roll_rows", DEFAULT_PARQUET_ROLL_ROWS); err != nil {
+		return nil, err
+	}
+	if sink.rollInterval, err = section.GetDuration("roll_interval", DEFAULT_PARQUET_ROLL_INTERVAL); err != nil {
+		return nil, err
+	}
+	if sink.rollRows <= 0 || sink.rollInterval <= 0 {
+		return nil, fmt.Errorf("roll_rows and roll_interval must be positive")
+	}
+	if sink.node = section.GetString("node", ""); sink.node == "" {
+		if sink.node, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(sink.path, 0755); err != nil {
+		return nil, err
+	}
+	sink.parquetFiles = make(map[string]*parquetFile)
+	sink.quit = make(chan struct{})
+	go sink.run()
+	return sink, nil
+}
+
+func (sink *fileSink) logEntry() *logger.Entry {
+	return logger.With(logger.Fields{"sink": sink.name})
+}
+
+// 没有新变更时也按 roll_interval 完成文件
+func (sink *fileSink) run() {
+	ticker := time.NewTicker(sink.rollInterval / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sink.quit:
+			return
+		case <-ticker.C:
+			sink.Lock()
+			for name, file := range sink.parquetFiles {
+				if time.Since(file.opened) < sink.rollInterval {
+					continue
+				}
+				if err := sink.closeParquet(name); err != nil {
+					sink.logEntry().WithError(err).Error("close parquet file")
+				}
+			}
+			sink.Unlock()
+		}
+	}
+}
+
+func (sink *fileSink) Write(data *mysql.EventReslut, messages []string) error {
+	return sink.WriteAck(data, messages, nil)
+}
+
+// ndjson 追加后确认，parquet 在所在文件完成后确认
+func (sink *fileSink) WriteAck(data *mysql.EventReslut, messages []string, ack func()) error {
+	if sink.format == FILE_FORMAT_PARQUET {
+		return sink.writeParquet(data, ack)
+	}
+	if len(messages) > 0 {
+		sink.Lock()
+		_, err := io.WriteString(sink.file, strings.Join(messages, "\n")+"\n")
+		sink.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if ack != nil {
+		ack()
+	}
+	return nil
+}
+
+func (sink *fileSink) writeParquet(data *mysql.EventReslut, ack func()) error {
+	if data.RowCount() == 0 || len(data.Columns) == 0 {
+		if ack != nil {
+			ack()
+		}
+		return nil
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	name := data.SchemaName + "." + data.TableName
+	date := time.Unix(int64(data.Header.Timestamp), 0).UTC().Format("2006-01-02")
+	file, ok := sink.parquetFiles[name]
+	if ok && (file.date != date || file.version != data.SchemaVersion) {
+		if err := sink.closeParquet(name); err != nil {
+			return err
+		}
+		ok = false
+	}
+	if !ok {
+		var err error
+		if file, err = sink.openParquet(data, date); err != nil {
+			return err
+		}
+		sink.parquetFiles[name] = file
+	}
+
+	binlog := fmt.Sprintf("%s:%d", data.BinlogFileName, data.Header.LogPos-data.Header.EventSize)
+	timestamp := strconv.FormatUint(uint64(data.Header.Timestamp), 10)
+	eventType := mysql.EvenTypeName(data.Header.EventType)
+	before, after := rowChanges(data)
+	for i := range after {
+		row := after[i]
+		if row == nil {
+			row = before[i]
+		}
+		values := make([]*string, 0, len(ParquetMetaColumns)+len(data.Columns))
+		values = append(values, &binlog, &timestamp, &eventType)
+		for _, column := range data.Columns {
+			values = append(values, stringValue(row[column.Name]))
+		}
+		if err := file.writer.Write(values); err != nil {
+			return err
+		}
+		file.rows++
+	}
+	if ack != nil {
+		file.acks = append(file.acks, ack)
+	}
+	if file.rows >= sink.rollRows {
+		return sink.closeParquet(name)
+	}
+	return nil
+}
+
+func (sink *fileSink) openParquet(data *mysql.EventReslut, date string) (*parquetFile, error) {
+	dir := filepath.Join(sink.path, data.SchemaName+"."+data.TableName, "dt="+date)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sink.seq++
+	file := &parquetFile{
+		path:    filepath.Join(dir, fmt.Sprintf("%s-%s-%d.parquet", sink.node, now.UTC().Format("20060102T150405Z"), sink.seq)),
+		date:    date,
+		version: data.SchemaVersion,
+		opened:  now,
+	}
+	var err error
+	if file.file, err = os.Create(file.path + ".tmp"); err != nil {
+		return nil, err
+	}
+	file.buf = bufio.NewWriterSize(file.file, 1<<20)
+	columns := append(append([]parquet.Column(nil), ParquetMetaColumns...), ParquetColumns(data.Columns)...)
+	if file.writer, err = parquet.NewTypedWriter(file.buf, columns); err != nil {
+		file.file.Close()
+		os.Remove(file.path + ".tmp")
+		return nil, err
+	}
+	return file, nil
+}
+
+// 写入文件尾，去掉 .tmp 后缀
+func (sink *fileSink) closeParquet(name string) error {
+	file := sink.parquetFiles[name]
+	delete(sink.parquetFiles, name)
+	err := file.writer.Close()
+	if err == nil {
+		err = file.buf.Flush()
+	}
+	if err == nil && sink.sync {
+		err = file.file.Sync()
+	}
+	if closeErr := file.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.path+".tmp", file.path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", file.path, err)
+	}
+	sink.logEntry().With(logger.Fields{"path": file.path, "rows": file.rows}).Info("parquet file completed")
+	for _, ack := range file.acks {
+		ack()
+	}
+	return nil
+}
+
+func (sink *fileSink) closeParquetFiles() error {
+	var err error
+	for name := range sink.parquetFiles {
+		if closeErr := sink.closeParquet(name); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (sink *fileSink) Flush() error {
+	if sink.format == FILE_FORMAT_PARQUET {
+		sink.Lock()
+		defer sink.Unlock()
+		return sink.closeParquetFiles()
+	}
+	if !sink.sync {
+		return nil
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	return sink.file.Sync()
+}
+
+func (sink *fileSink) Close() error {
+	if sink.format == FILE_FORMAT_PARQUET {
+		close(sink.quit)
+		return sink.Flush()
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	if sink.sync {
+		sink.file.Sync()
+	}
+	return sink.file.Close()
+}
+
+// Parquet 文件中表字段的类型: 整数为 INT64(BIGINT UNSIGNED 为 DECIMAL(20,0))，浮点数为 DOUBLE，DECIMAL 保留精度，
+// DATE 为 DATE，DATETIME/TIMESTAMP 为 TIMESTAMP(微秒)，二进制为 BYTES，其他为字符串
+func ParquetColumns(columns []*mysql.ColumnInfo) []parquet.Column {
+	typed := make([]parquet.Column, 0, len(columns))
+	for _, column := range columns {
+		typed = append(typed, parquetColumn(column))
+	}
+	return typed
+}
+
+func parquetColumn(column *mysql.ColumnInfo) parquet.Column {
+	typed := parquet.Column{Name: column.Name, Type: parquet.STRING}
+	base, args, unsigned := splitColumnType(column.Type)
+	switch base {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "year":
+		typed.Type = parquet.INT64
+	case "bigint":
+		typed.Type = parquet.INT64
+		if unsigned {
+			typed.Type, typed.Precision = parquet.DECIMAL, 20
+		}
+	case "float", "double", "real":
+		typed.Type = parquet.DOUBLE
+	case "decimal", "numeric":
+		typed.Type, typed.Precision = parquet.DECIMAL, 10
+		if args != "" {
+			parts := strings.SplitN(args, ",", 2)
+			typed.Precision, _ = strconv.Atoi(strings.TrimSpace(parts[0]))
+			if len(parts) == 2 {
+				typed.Scale, _ = strconv.Atoi(strings.TrimSpace(parts[1]))
+			}
+		}
+	case "date":
+		typed.Type = parquet.DATE
+	case "datetime", "timestamp":
+		typed.Type = parquet.TIMESTAMP
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		typed.Type = parquet.BYTES
+	}
+	return typed
+}
+
+// 文件中最后一条带位点的消息，文件为空时返回 nil
+// 进程崩溃时最后一行可能不完整，跳过无法解析的行
+func (sink *fileSink) LastPosition() (*SinkPosition, error) {
+	if sink.format == FILE_FORMAT_PARQUET {
+		return nil, fmt.Errorf("format=parquet does not record positions")
+	}
+	f, err := os.Open(sink.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := info.Size()
+	var rest []byte // 上一块开头不完整的行
+	for end > 0 {
+		start := end - FILE_SINK_TAIL_BLOCK
+		if start < 0 {
+			start = 0
+		}
+		block := make([]byte, end-start, int(end-start)+len(rest))
+		if _, err := f.ReadAt(block, start); err != nil {
+			return nil, err
+		}
+		block = append(block, rest...)
+		lines := bytes.Split(block, []byte("\n"))
+		// 未读到文件开头时第一行可能不完整，留到下一块
+		first := 0
+		if start > 0 {
+			first, rest = 1, lines[0]
+		}
+		for i := len(lines) - 1; i >= first; i-- {
+			if position := parseSinkPosition(lines[i]); position != nil {
+				return position, nil
+			}
+		}
+		end = start
+	}
+	return nil, nil
+}
@@ -0,0 +1,387 @@
+// MySQL applier
+// [sink.N] type=mysql 将行变更写入目标 MySQL，同一事件的所有行在一个事务中执行，失败时断开连接，下次写入时重新连接。
+// update/delete 按主键定位(没有主键时按变更前的所有字段)。
+//
+// conflict 为冲突(insert 主键重复、update/delete 的行不存在)的处理方式:
+//
+//	overwrite  默认，insert 为 INSERT ... ON DUPLICATE KEY UPDATE，update 的行不存在时按变更后的行插入，delete 的行不存在时忽略
+//	error      返回错误，写入失败(配置 queue_size 或 parallel 时重试)
+//	skip       跳过冲突的行，记录日志
+//	merge      按时间戳字段 conflict_column 保留较新的行: insert/update 仅在事件中的时间戳不早于目标行时覆盖，
+//	           delete 仅在目标行的时间戳不晚于变更前的行时删除；用于双向同步、从重叠的位点恢复，表中必须有该字段
+//
+// 连接使用 clientFoundRows，update 的影响行数为匹配的行数，值未变化的行不视为不存在。
+//
+// 双向同步时配置 loop_marker=db.table 防回环: 连接后创建标记表，每个事务先更新标记表中 origin 为输出名称的行，
+// 执行的 DDL 以 mysql.LOOP_QUERY_COMMENT 开头；同步目标库的数据源配置 loop_marker_table 为同一张表，
+// 不再读取 applier 写入的变更，见 mysql/loop.go。
+package lib
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+// conflict
+const (
+	CONFLICT_OVERWRITE = "overwrite"
+	CONFLICT_ERROR     = "error"
+	CONFLICT_SKIP      = "skip"
+	CONFLICT_MERGE     = "merge"
+)
+
+// 写入目标 MySQL
+type mysqlApplyTarget struct {
+	name           string
+	dsn            string
+	conflict       string
+	conflictColumn string
+	loopMarker     string                // 防回环标记表 db.table
+	conn           mysql.MysqlConnection // 为 nil 时在下次写入前连接
+}
+
+func newMysqlApplySink(name string, conf map[string]string) (Sink, error) {
+	section := config.Section(conf)
+	if section.GetString("dsn", "") == "" {
+		return nil, fmt.Errorf("dsn is required")
+	}
+	dsn, err := mysql.ParseDSN(section.GetString("dsn", ""))
+	if err != nil {
+		return nil, err
+	}
+	dsn.FoundRows = true
+	loopMarker := section.GetString("loop_marker", "")
+	if loopMarker != "" && strings.Count(loopMarker, ".") != 1 {
+		return nil, fmt.Errorf("invalid loop_marker %q, must be db.table", loopMarker)
+	}
+	conflict := section.GetString("conflict", CONFLICT_OVERWRITE)
+	conflictColumn := section.GetString("conflict_column", "")
+	switch conflict {
+	case CONFLICT_OVERWRITE, CONFLICT_ERROR, CONFLICT_SKIP:
+	case CONFLICT_MERGE:
+		if conflictColumn == "" {
+			return nil, fmt.Errorf("conflict_column is required by conflict=merge")
+		}
+	default:
+		return nil, fmt.Errorf("invalid conflict %q, must be overwrite, error, skip or merge", conflict)
+	}
+	return newApplySink(name, func() applyTarget {
+		return &mysqlApplyTarget{name: name, dsn: dsn.String(), conflict: conflict, conflictColumn: conflictColumn, loopMarker: loopMarker}
+	}, conf)
+}
+
+func (target *mysqlApplyTarget) dialect() string {
+	return TARGET_MYSQL
+}
+
+func (target *mysqlApplyTarget) connect() (mysql.MysqlConnection, error) {
+	if target.conn == nil {
+		conn, err := mysql.Connect(target.dsn)
+		if err != nil {
+			return nil, err
+		}
+		if target.loopMarker != "" {
+			for _, statement := range target.loopMarkerTableSQL() {
+				if _, err := conn.Exec(statement, nil); err != nil {
+					conn.Close()
+					return nil, fmt.Errorf("%s: %s", statement, err)
+				}
+			}
+		}
+		target.conn = conn
+	}
+	return target.conn, nil
+}
+
+// 创建防回环标记表
+func (target *mysqlApplyTarget) loopMarkerTableSQL() []string {
+	i := strings.IndexByte(target.loopMarker, '.')
+	schemaName, tableName := target.loopMarker[0:i], target.loopMarker[i+1:]
+	return []string{
+		mysql.LOOP_QUERY_COMMENT + " CREATE DATABASE IF NOT EXISTS " + quoteTargetName(TARGET_MYSQL, schemaName),
+		mysql.LOOP_QUERY_COMMENT + " CREATE TABLE IF NOT EXISTS " + quoteTargetTable(TARGET_MYSQL, schemaName, tableName) +
+			" (`origin` VARCHAR(64) NOT NULL PRIMARY KEY, `seq` BIGINT UNSIGNED NOT NULL, `updated_at` DATETIME(6) NOT NULL)",
+	}
+}
+
+// 更新标记表，事务中的第一条语句；seq 递增保证每次都有行变更
+func (target *mysqlApplyTarget) loopMarkerSQL() string {
+	i := strings.IndexByte(target.loopMarker, '.')
+	return fmt.Sprintf("INSERT INTO %s (`origin`,`seq`,`updated_at`) VALUES (%s,1,NOW(6)) ON DUPLICATE KEY UPDATE `seq`=`seq`+1,`updated_at`=VALUES(`updated_at`)",
+		quoteTargetTable(TARGET_MYSQL, target.loopMarker[0:i], target.loopMarker[i+1:]), quoteTargetString(TARGET_MYSQL, target.name))
+}
+
+// 出错后断开连接，下次重新连接
+func (target *mysqlApplyTarget) reset() {
+	if target.conn != nil {
+		target.conn.Close()
+		target.conn = nil
+	}
+}
+
+func (target *mysqlApplyTarget) exec(statements []string) error {
+	conn, err := target.connect()
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if target.loopMarker != "" {
+			statement = mysql.LOOP_QUERY_COMMENT + " " + statement
+		}
+		if _, err := conn.Exec(statement, nil); err != nil {
+			target.reset()
+			return fmt.Errorf("%s: %s", statement, err)
+		}
+	}
+	return nil
+}
+
+func (target *mysqlApplyTarget) tableColumns(schemaName string, tableName string) ([]string, error) {
+	conn, err := target.connect()
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := conn.Prepare("SELECT COLUMN_NAME FROM information_schema.columns WHERE table_schema=? AND table_name=? ORDER BY ORDINAL_POSITION")
+	if err != nil {
+		target.reset()
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query([]driver.Value{schemaName, tableName})
+	if err != nil {
+		target.reset()
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make([]string, 0)
+	dest := make([]driver.Value, 1)
+	for rows.Next(dest) == nil {
+		columns = append(columns, string(dest[0].([]byte)))
+	}
+	return columns, nil
+}
+
+func (target *mysqlApplyTarget) applyRows(data *mysql.EventReslut) error {
+	if target.conflict == CONFLICT_MERGE {
+		found := false
+		for _, column := range data.Columns {
+			found = found || column.Name == target.conflictColumn
+		}
+		if !found {
+			return fmt.Errorf("table %s.%s has no conflict_column %s", data.SchemaName, data.TableName, target.conflictColumn)
+		}
+	}
+	conn, err := target.connect()
+	if err != nil {
+		return err
+	}
+	before, after := rowChanges(data)
+	transaction := len(after) > 1 || target.conflict == CONFLICT_MERGE || target.loopMarker != ""
+	if transaction {
+		if _, err := conn.Exec("START TRANSACTION", nil); err != nil {
+			target.reset()
+			return err
+		}
+	}
+	if target.loopMarker != "" {
+		if _, err := conn.Exec(target.loopMarkerSQL(), nil); err != nil {
+			target.reset()
+			return err
+		}
+	}
+	for i := range after {
+		if err := target.applyRow(conn, data, i, before[i], after[i]); err != nil {
+			target.reset()
+			return err
+		}
+	}
+	if transaction {
+		if _, err := conn.Exec("COMMIT", nil); err != nil {
+			target.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+// 写入一行变更，按 conflict 处理冲突
+func (target *mysqlApplyTarget) applyRow(conn mysql.MysqlConnection, data *mysql.EventReslut, i int, before map[string]driver.Value, after map[string]driver.Value) error {
+	dialect := TARGET_MYSQL
+	table := quoteTargetTable(dialect, data.SchemaName, data.TableName)
+	var statement string
+	switch {
+	case before == nil:
+		switch target.conflict {
+		case CONFLICT_OVERWRITE, CONFLICT_MERGE:
+			statement = target.upsertSQL(table, data.Columns, after)
+			_, err := execAffected(conn, statement)
+			return statementError(statement, err)
+		}
+		statement = mysqlInsertSQL(table, data.Columns, after, nil, "")
+		if _, err := execAffected(conn, statement); err != nil {
+			if target.conflict == CONFLICT_SKIP && isDuplicateKeyError(err) {
+				target.conflictFound(data, "duplicate_key", err.Error())
+				return nil
+			}
+			return statementError(statement, err)
+		}
+		return nil
+
+	case after == nil:
+		where := targetWhere(dialect, data.Columns, before)
+		if target.conflict == CONFLICT_MERGE {
+			// 目标行被更新的变更修改过时保留
+			statement = fmt.Sprintf("DELETE FROM %s WHERE %s AND %s LIMIT 1", table, where, target.mergeCondition(before))
+			_, err := execAffected(conn, statement)
+			return statementError(statement, err)
+		}
+		statement = fmt.Sprintf("DELETE FROM %s WHERE %s LIMIT 1", table, where)
+		n, err := execAffected(conn, statement)
+		if err != nil {
+			return statementError(statement, err)
+		}
+		if n == 0 {
+			if target.conflict == CONFLICT_ERROR {
+				return fmt.Errorf("%s: row not found", statement)
+			}
+			target.conflictFound(data, "row_not_found", statement)
+		}
+		return nil
+	}
+
+	where := targetWhere(dialect, data.Columns, before)
+	if target.conflict == CONFLICT_MERGE {
+		// 修改了主键时删除旧主键的行，再按新主键合并
+		if data.OldKey(i) != nil {
+			statement = fmt.Sprintf("DELETE FROM %s WHERE %s AND %s LIMIT 1", table, where, target.mergeCondition(after))
+			if _, err := execAffected(conn, statement); err != nil {
+				return statementError(statement, err)
+			}
+		}
+		statement = target.upsertSQL(table, data.Columns, after)
+		_, err := execAffected(conn, statement)
+		return statementError(statement, err)
+	}
+	sets := make([]string, 0, len(data.Columns))
+	for _, column := range data.Columns {
+		if value, ok := after[column.Name]; ok {
+			sets = append(sets, quoteTargetName(dialect, column.Name)+"="+targetValue(dialect, value))
+		}
+	}
+	statement = fmt.Sprintf("UPDATE %s SET %s WHERE %s LIMIT 1", table, strings.Join(sets, ","), where)
+	n, err := execAffected(conn, statement)
+	if err != nil {
+		if target.conflict == CONFLICT_SKIP && isDuplicateKeyError(err) {
+			target.conflictFound(data, "duplicate_key", err.Error())
+			return nil
+		}
+		return statementError(statement, err)
+	}
+	if n > 0 {
+		return nil
+	}
+	if target.conflict == CONFLICT_ERROR {
+		return fmt.Errorf("%s: row not found", statement)
+	}
+	target.conflictFound(data, "row_not_found", statement)
+	if target.conflict == CONFLICT_SKIP {
+		return nil
+	}
+	statement = target.upsertSQL(table, data.Columns, after)
+	_, err = execAffected(conn, statement)
+	return statementError(statement, err)
+}
+
+// 记录冲突，跳过或覆盖时为警告
+func (target *mysqlApplyTarget) conflictFound(data *mysql.EventReslut, conflict string, detail string) {
+	metrics.SinkApplyConflicts.Inc(target.name, conflict)
+	logger.With(logger.Fields{"sink": target.name, "conflict": conflict, "policy": target.conflict}).With(data.LogFields()).Warn(detail)
+}
+
+// 主键冲突时按 conflict 覆盖或合并的 INSERT
+func (target *mysqlApplyTarget) upsertSQL(table string, columns []*mysql.ColumnInfo, row map[string]driver.Value) string {
+	if target.conflict != CONFLICT_MERGE {
+		return mysqlInsertSQL(table, columns, row, func(name string) string {
+			return name + "=VALUES(" + name + ")"
+		}, "")
+	}
+	// 赋值按顺序生效，时间戳字段最后赋值，之前的条件使用目标行原来的时间戳
+	column := quoteTargetName(TARGET_MYSQL, target.conflictColumn)
+	condition := fmt.Sprintf("%s IS NULL OR VALUES(%s)>=%s", column, column, column)
+	return mysqlInsertSQL(table, columns, row, func(name string) string {
+		return fmt.Sprintf("%s=IF(%s,VALUES(%s),%s)", name, condition, name, name)
+	}, target.conflictColumn)
+}
+
+// 目标行的时间戳不晚于 row 中的时间戳
+func (target *mysqlApplyTarget) mergeCondition(row map[string]driver.Value) string {
+	column := quoteTargetName(TARGET_MYSQL, target.conflictColumn)
+	return fmt.Sprintf("(%s IS NULL OR %s<=%s)", column, column, targetValue(TARGET_MYSQL, row[target.conflictColumn]))
+}
+
+func (target *mysqlApplyTarget) Close() error {
+	target.reset()
+	return nil
+}
+
+// INSERT 语句，onDuplicate 为主键冲突时字段的赋值，为 nil 时不处理冲突；last 字段最后赋值
+func mysqlInsertSQL(table string, columns []*mysql.ColumnInfo, row map[string]driver.Value, onDuplicate func(name string) string, last string) string {
+	dialect := TARGET_MYSQL
+	names := make([]string, 0, len(columns))
+	values := make([]string, 0, len(columns))
+	updates := make([]string, 0, len(columns))
+	var lastUpdate string
+	for _, column := range columns {
+		value, ok := row[column.Name]
+		if !ok {
+			continue
+		}
+		name := quoteTargetName(dialect, column.Name)
+		names, values = append(names, name), append(values, targetValue(dialect, value))
+		if onDuplicate == nil {
+			continue
+		}
+		if column.Name == last {
+			lastUpdate = onDuplicate(name)
+		} else {
+			updates = append(updates, onDuplicate(name))
+		}
+	}
+	statement := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(names, ","), strings.Join(values, ","))
+	if lastUpdate != "" {
+		updates = append(updates, lastUpdate)
+	}
+	if len(updates) > 0 {
+		statement += " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ",")
+	}
+	return statement
+}
+
+// 执行语句，返回匹配的行数
+func execAffected(conn mysql.MysqlConnection, statement string) (int64, error) {
+	result, err := conn.Exec(statement, nil)
+	if err != nil {
+		return 0, err
+	}
+	// 没有影响的行时为 driver.ResultNoRows，RowsAffected 返回错误
+	n, _ := result.RowsAffected()
+	return n, nil
+}
+
+func statementError(statement string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", statement, err)
+}
+
+// ER_DUP_ENTRY
+func isDuplicateKeyError(err error) bool {
+	return strings.HasPrefix(err.Error(), "Error 1062:")
+}
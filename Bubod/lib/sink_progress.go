@@ -0,0 +1,183 @@
+// 多输出的投递进度
+// 异步写入或缓存事件的输出(queue_size、aggregate_window、applier 并行写入、file 的 parquet、archive、bigquery/snowflake)实现 SinkAcker，
+// 在事件写入输出、持久化到磁盘、对象上传或载入完成后确认，包装的输出(sample 等)将确认传递给下层；每个数据源分别跟踪各输出已投递的位点:
+// 输出已投递的位点为其最早未确认的事件之前的位点，没有未确认的事件时为已读取的位点。
+// 保存的位点为各输出已投递位点的最小值，新增一个慢的输出不会使快的输出在重启后丢失事件，快的输出可能重复收到事件。
+// 同步写入的输出 Write 返回即视为已投递；写入失败(输出已关闭)的事件不确认，位点停在该事件之前。
+// 有未确认的事件时不保存 GTID 集合(已执行的集合包含未投递的事件)，全部确认后再保存。
+package lib
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+// 异步写入的输出实现 WriteAck，事件写入输出(或持久化到磁盘)后调用 ack
+type SinkAcker interface {
+	WriteAck(data *mysql.EventReslut, messages []string, ack func()) error
+}
+
+// 写入下层输出: 下层实现 SinkAcker 时由其确认，否则 Write 返回后确认；ack 为 nil 时不需要确认
+func writeAck(sink Sink, data *mysql.EventReslut, messages []string, ack func()) error {
+	if acker, ok := sink.(SinkAcker); ok {
+		return acker.WriteAck(data, messages, ack)
+	}
+	if err := sink.Write(data, messages); err != nil {
+		return err
+	}
+	if ack != nil {
+		ack()
+	}
+	return nil
+}
+
+// 将确认分为 n 份，全部调用后确认，用于一个事件拆分写入时
+func splitAck(ack func(), n int) func() {
+	if ack == nil {
+		return nil
+	}
+	remaining := int32(n)
+	return func() {
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			ack()
+		}
+	}
+}
+
+// 输出已投递的位点，见 SourceStatus.SinkPositions
+type SinkProgress struct {
+	Sink     string `json:"sink"`
+	File     string `json:"binlog_file"`
+	Position uint32 `json:"binlog_position"`
+	Pending  int    `json:"pending"` // 已写入未确认的事件数
+}
+
+// 有输出未确认的事件
+type progressEvent struct {
+	file        string // 事件之前的位点
+	position    uint32
+	timestamp   uint32
+	outstanding map[string]bool // 未确认的输出
+	open        bool            // 正在写入各输出，写完前不移除
+}
+
+// 数据源写入各输出的进度
+type sinkProgress struct {
+	lock   sync.Mutex
+	events []*progressEvent // 按读取顺序排列，第一个事件有输出未确认
+}
+
+func newSinkProgress() *sinkProgress {
+	return &sinkProgress{events: make([]*progressEvent, 0)}
+}
+
+// 开始写入一个事件，file/position/timestamp 为事件之前的位点
+func (progress *sinkProgress) begin(file string, position uint32, timestamp uint32) *progressEvent {
+	event := &progressEvent{
+		file:        file,
+		position:    position,
+		timestamp:   timestamp,
+		outstanding: make(map[string]bool),
+		open:        true,
+	}
+	progress.lock.Lock()
+	progress.events = append(progress.events, event)
+	progress.lock.Unlock()
+	return event
+}
+
+// 等待输出确认，返回确认函数
+func (progress *sinkProgress) wait(event *progressEvent, sink string) func() {
+	progress.lock.Lock()
+	event.outstanding[sink] = true
+	progress.lock.Unlock()
+	return func() {
+		progress.lock.Lock()
+		delete(event.outstanding, sink)
+		progress.trim()
+		progress.lock.Unlock()
+	}
+}
+
+// 事件已写入所有输出
+func (progress *sinkProgress) end(event *progressEvent) {
+	progress.lock.Lock()
+	event.open = false
+	progress.trim()
+	progress.lock.Unlock()
+}
+
+// 移除开头已全部确认的事件，调用时持有锁
+func (progress *sinkProgress) trim() {
+	for len(progress.events) > 0 && !progress.events[0].open && len(progress.events[0].outstanding) == 0 {
+		progress.events[0] = nil
+		progress.events = progress.events[1:]
+	}
+}
+
+// 所有输出已投递的位点，没有未确认的事件时为 file/position/timestamp(已读取的位点)
+func (progress *sinkProgress) checkpoint(file string, position uint32, timestamp uint32) (string, uint32, uint32, bool) {
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+	if len(progress.events) == 0 {
+		return file, position, timestamp, true
+	}
+	event := progress.events[0]
+	return event.file, event.position, event.timestamp, false
+}
+
+// 各输出已投递的位点
+func (progress *sinkProgress) positions(sinks []*sinkEntry, file string, position uint32, timestamp uint32) ([]*SinkProgress, []uint32) {
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+	positions := make([]*SinkProgress, len(sinks))
+	timestamps := make([]uint32, len(sinks))
+	for i, entry := range sinks {
+		positions[i] = &SinkProgress{Sink: entry.Name, File: file, Position: position}
+		timestamps[i] = timestamp
+		found := false
+		for _, event := range progress.events {
+			if !event.outstanding[entry.Name] {
+				continue
+			}
+			if !found {
+				positions[i].File, positions[i].Position, timestamps[i] = event.file, event.position, event.timestamp
+				found = true
+			}
+			positions[i].Pending++
+		}
+	}
+	return positions, timestamps
+}
+
+// 丢弃未确认的事件，重新开始同步或修改位点时调用，之前的事件确认时不再影响位点
+func (progress *sinkProgress) reset() {
+	progress.lock.Lock()
+	progress.events = make([]*progressEvent, 0)
+	progress.lock.Unlock()
+}
+
+// 各输出已投递的位点
+func (dumpConfig *DumpConfig) SinkPositions() []*SinkProgress {
+	positions, _ := dumpConfig.sinkProgress.positions(dumpConfig.Sinks,
+		dumpConfig.BinlogDumpFileName, dumpConfig.BinlogDumpPosition, dumpConfig.BinlogDumpTimestamp)
+	return positions
+}
+
+// 更新各输出的未确认事件数和投递延迟
+func (dumpConfig *DumpConfig) updateSinkMetrics() {
+	timestamp := dumpConfig.BinlogDumpTimestamp
+	positions, timestamps := dumpConfig.sinkProgress.positions(dumpConfig.Sinks,
+		dumpConfig.BinlogDumpFileName, dumpConfig.BinlogDumpPosition, timestamp)
+	for i, position := range positions {
+		metrics.SinkPendingEvents.Set(float64(position.Pending), dumpConfig.Name, position.Sink)
+		if timestamp > timestamps[i] && timestamps[i] > 0 {
+			metrics.SinkDeliveryLag.Set(float64(timestamp-timestamps[i]), dumpConfig.Name, position.Sink)
+		} else {
+			metrics.SinkDeliveryLag.Set(0, dumpConfig.Name, position.Sink)
+		}
+	}
+}
@@ -0,0 +1,665 @@
+// 输出队列和磁盘溢出
+// [sink.N] 配置 queue_size 大于 0 时异步写入: 事件进入内存队列后回调即返回，由后台协程按顺序写入输出，
+// 写入失败时每隔 retry_interval 重试直到成功，输出暂时不可用时不丢弃事件。
+// 每个输出可以单独配置写入参数，慢的输出(如 Elasticsearch)与 Kafka 不必使用相同的设置:
+//
+//	workers            写入协程数，默认 1；大于 1 时按库表哈希分配，同一张表的事件按顺序写入，DDL 等待之前的事件写入后单独写入
+//	max_in_flight      已分发未确认的事件上限，默认为 workers；按分发顺序确认，磁盘中的事件按确认的位置保存
+//	retry_max_interval 重试间隔从 retry_interval 开始加倍，最大为该值，默认不加倍
+//	max_retries        重试次数上限，超过时记录错误并丢弃事件(bubod_sink_events_dropped_total)，默认 0 一直重试
+//	write_timeout      单次写入的超时，超时按失败重试；超时的写入不会取消，重试可能重复写入(至少一次)
+//
+// 内存队列满时默认阻塞同步；配置 spill_dir 时将事件序列化后追加到磁盘文件 spill_dir/{sink}.spill，不阻塞同步，
+// 避免 master 因 net_write_timeout 断开连接。输出恢复后先写完内存队列，再按顺序写入磁盘中的事件，全部写入后清空文件。
+//
+// 磁盘中的事件只保留事件头、位点、库表、DDL 和消息，没有行数据(data.Rows 为空)。
+// 已写入的位置保存在 {sink}.spill.offset，重启后继续写入磁盘中剩余的事件。事件追加并 fsync 后才确认(视为已投递)。
+// 读取时发现文件损坏则输出停止: 之后的写入返回错误，位点不再前进，文件保留供排查，需要修复或删除文件后从更早的位点重新同步。
+// 内存队列中的事件在停止实例时等待写入(Flush)，写入输出后才确认(见 sink_progress.go)，进程崩溃后从其之前的位点重新同步。
+// spill_max_bytes 为磁盘文件的上限，超过时阻塞同步直到输出消费。
+package lib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+const (
+	DEFAULT_SINK_RETRY_INTERVAL = time.Second
+	DEFAULT_SINK_FLUSH_TIMEOUT  = 30 * time.Second
+)
+
+type queuedEvent struct {
+	data     *mysql.EventReslut
+	messages []string
+	size     int64 // 磁盘中的事件占用的字节数，内存中的事件为 0
+	fromDisk bool
+	done     bool
+	ack      func() // 写入后调用，为 nil 时不需要确认
+}
+
+// 带内存队列的输出
+type queuedSink struct {
+	name             string
+	sink             Sink
+	queueSize        int
+	workers          []chan *queuedEvent
+	maxInFlight      int
+	retryInterval    time.Duration
+	retryMaxInterval time.Duration // 重试间隔每次加倍，最大为该值
+	maxRetries       int           // 为 0 时一直重试，超过时丢弃事件
+	writeTimeout     time.Duration // 为 0 时不限制
+	flushTimeout     time.Duration
+	spill            *spillFile // 为 nil 时不溢出到磁盘
+	spillMaxBytes    int64
+	breaker          *sinkBreaker // 为 nil 时不熔断，见 sink_breaker.go
+	dlqFile          string       // 熔断且没有 spill_dir 时写入的死信文件
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queue    []*queuedEvent // 未分发的内存事件
+	inflight []*queuedEvent // 已分发的事件，按分发顺序确认
+	spilling bool           // 磁盘中有未写入的事件，新事件追加到磁盘以保证顺序
+	failed   error          // 磁盘文件损坏，输出停止
+	closed   bool
+	quit     chan struct{}
+	done     sync.WaitGroup
+}
+
+// queue_size 大于 0 时包装为异步写入的输出
+func newQueuedSink(name string, sink Sink, conf map[string]string) (Sink, error) {
+	section := config.Section(conf)
+	queueSize, err := section.GetInt("queue_size", 0)
+	if err != nil {
+		return nil, err
+	}
+	workers, err := section.GetInt("workers", 1)
+	if err != nil {
+		return nil, err
+	}
+	maxInFlight, err := section.GetInt("max_in_flight", 0)
+	if err != nil {
+		return nil, err
+	}
+	retryInterval, err := section.GetDuration("retry_interval", DEFAULT_SINK_RETRY_INTERVAL)
+	if err != nil {
+		return nil, err
+	}
+	retryMaxInterval, err := section.GetDuration("retry_max_interval", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxRetries, err := section.GetInt("max_retries", 0)
+	if err != nil {
+		return nil, err
+	}
+	writeTimeout, err := section.GetDuration("write_timeout", 0)
+	if err != nil {
+		return nil, err
+	}
+	flushTimeout, err := section.GetDuration("flush_timeout", DEFAULT_SINK_FLUSH_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	spillMaxBytes, err := section.GetInt("spill_max_bytes", 0)
+	if err != nil {
+		return nil, err
+	}
+	spillDir := section.GetString("spill_dir", "")
+	breaker, err := newSinkBreaker(name, section)
+	if err != nil {
+		return nil, err
+	}
+	if queueSize <= 0 {
+		if spillDir != "" {
+			return nil, fmt.Errorf("spill_dir requires queue_size")
+		}
+		if workers > 1 || maxInFlight > 0 || maxRetries > 0 || writeTimeout > 0 || breaker != nil {
+			return nil, fmt.Errorf("workers, max_in_flight, max_retries, write_timeout and breaker_failures require queue_size")
+		}
+		return sink, nil
+	}
+	dlqFile := section.GetString("dlq_file", "")
+	if breaker != nil && spillDir == "" && dlqFile == "" {
+		return nil, fmt.Errorf("breaker_failures requires spill_dir or dlq_file")
+	}
+	if retryInterval <= 0 {
+		retryInterval = DEFAULT_SINK_RETRY_INTERVAL
+	}
+	if retryMaxInterval < retryInterval {
+		retryMaxInterval = retryInterval
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if maxInFlight <= 0 {
+		maxInFlight = workers
+	}
+
+	queued := &queuedSink{
+		name:             name,
+		sink:             sink,
+		queueSize:        int(queueSize),
+		workers:          make([]chan *queuedEvent, workers),
+		maxInFlight:      int(maxInFlight),
+		retryInterval:    retryInterval,
+		retryMaxInterval: retryMaxInterval,
+		maxRetries:       int(maxRetries),
+		writeTimeout:     writeTimeout,
+		flushTimeout:     flushTimeout,
+		spillMaxBytes:    spillMaxBytes,
+		breaker:          breaker,
+		dlqFile:          dlqFile,
+		quit:             make(chan struct{}),
+	}
+	queued.cond = sync.NewCond(&queued.lock)
+	if spillDir != "" {
+		if err := os.MkdirAll(spillDir, 0755); err != nil {
+			return nil, err
+		}
+		if queued.spill, err = openSpillFile(filepath.Join(spillDir, name+".spill")); err != nil {
+			return nil, err
+		}
+		// 上次退出时磁盘中剩余的事件
+		queued.spilling = queued.spill.pending() > 0
+	}
+	for i := range queued.workers {
+		queued.workers[i] = make(chan *queuedEvent, queued.maxInFlight)
+		queued.done.Add(1)
+		go queued.work(queued.workers[i])
+	}
+	queued.done.Add(1)
+	go queued.run()
+	return queued, nil
+}
+
+func (sink *queuedSink) logEntry() *logger.Entry {
+	return logger.With(logger.Fields{"sink": sink.name})
+}
+
+func (sink *queuedSink) Write(data *mysql.EventReslut, messages []string) error {
+	return sink.WriteAck(data, messages, nil)
+}
+
+// 写入内存队列，队列满或熔断时写入磁盘或阻塞；ack 在事件写入输出或追加到磁盘后调用
+func (sink *queuedSink) WriteAck(data *mysql.EventReslut, messages []string, ack func()) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	for {
+		if sink.closed {
+			return fmt.Errorf("sink %s closed", sink.name)
+		}
+		if sink.failed != nil {
+			return sink.failed
+		}
+		open := sink.breaker != nil && sink.breaker.isOpen()
+		// 熔断且不溢出到磁盘时写入死信文件，到达探测时间时进入队列用于探测
+		if open && sink.spill == nil && !sink.breaker.probeDue() {
+			err := sink.deadLetter(data, messages, sink.breaker.err())
+			if err == nil && ack != nil {
+				ack()
+			}
+			return err
+		}
+		if !sink.spilling && (!open || sink.spill == nil) && len(sink.queue) < sink.queueSize {
+			data.Retain()
+			sink.queue = append(sink.queue, &queuedEvent{data: data, messages: messages, ack: ack})
+			sink.updateMetrics()
+			sink.cond.Broadcast()
+			return nil
+		}
+		if sink.spill != nil && (sink.spillMaxBytes <= 0 || sink.spill.pending() < sink.spillMaxBytes) {
+			if !sink.spilling && open {
+				sink.logEntry().With(logger.Fields{"file": sink.spill.path}).Warn("sink circuit open, spill to disk")
+			} else if !sink.spilling {
+				sink.logEntry().With(logger.Fields{"file": sink.spill.path}).Warn("sink queue full, spill to disk")
+			}
+			sink.spilling = true
+			err := sink.spill.append(data, messages)
+			// 磁盘中的事件重启后继续写入，视为已投递
+			if err == nil && ack != nil {
+				ack()
+			}
+			sink.updateMetrics()
+			sink.cond.Broadcast()
+			return err
+		}
+		sink.cond.Wait()
+	}
+}
+
+// 是否等待之前的事件写入后单独写入，DDL 等不属于某张表的事件
+func (item *queuedEvent) barrier() bool {
+	return item.data.DDL != nil || item.data.TableName == ""
+}
+
+// 下一个待分发的事件，先内存队列后磁盘，调用时持有锁
+func (sink *queuedSink) next() (*queuedEvent, error) {
+	if len(sink.queue) > 0 {
+		item := sink.queue[0]
+		sink.queue[0] = nil
+		sink.queue = sink.queue[1:]
+		return item, nil
+	}
+	if sink.spill == nil || !sink.spill.undispatched() {
+		return nil, nil
+	}
+	item, err := sink.spill.peek()
+	if err != nil {
+		return nil, err
+	}
+	sink.spill.dispatchOffset += item.size
+	return item, nil
+}
+
+// 按顺序分发内存队列和磁盘中的事件，同一张表的事件由同一个 worker 按顺序写入，
+// 已分发未确认的事件不超过 max_in_flight
+func (sink *queuedSink) run() {
+	defer sink.done.Done()
+	defer func() {
+		for _, worker := range sink.workers {
+			close(worker)
+		}
+	}()
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	for {
+		for !sink.closed && (len(sink.inflight) >= sink.maxInFlight ||
+			(len(sink.queue) == 0 && (sink.spill == nil || !sink.spill.undispatched()))) {
+			sink.cond.Wait()
+		}
+		if sink.closed {
+			return
+		}
+		item, err := sink.next()
+		if err != nil {
+			// 文件损坏时停止输出，磁盘中的事件已确认，丢弃会丢失事件
+			sink.failed = fmt.Errorf("sink %s stopped, spill file %s corrupt at offset %d: %s", sink.name, sink.spill.path, sink.spill.dispatchOffset, err)
+			sink.logEntry().With(logger.Fields{"file": sink.spill.path, "offset": sink.spill.dispatchOffset}).WithError(err).Error("read spill file, sink stopped")
+			sink.cond.Broadcast()
+			return
+		}
+		if item == nil {
+			continue
+		}
+		// DDL 等待之前的事件写入后单独写入
+		if item.barrier() && !sink.waitInFlight() {
+			return
+		}
+		sink.inflight = append(sink.inflight, item)
+		sink.updateMetrics()
+		worker := sink.workers[0]
+		if len(sink.workers) > 1 && !item.barrier() {
+			worker = sink.workers[crc32.ChecksumIEEE([]byte(item.data.SchemaName+"."+item.data.TableName))%uint32(len(sink.workers))]
+		}
+		worker <- item
+		if item.barrier() && !sink.waitInFlight() {
+			return
+		}
+	}
+}
+
+// 等待已分发的事件写入，关闭时返回 false，调用时持有锁
+func (sink *queuedSink) waitInFlight() bool {
+	for len(sink.inflight) > 0 && !sink.closed {
+		sink.cond.Wait()
+	}
+	return !sink.closed
+}
+
+func (sink *queuedSink) work(events chan *queuedEvent) {
+	defer sink.done.Done()
+	for item := range events {
+		if !sink.write(item) {
+			continue
+		}
+		sink.lock.Lock()
+		item.done = true
+		sink.ack()
+		sink.cond.Broadcast()
+		sink.lock.Unlock()
+	}
+}
+
+// 按分发顺序确认已写入的事件，磁盘中的事件保存已写入的位置，调用时持有锁
+func (sink *queuedSink) ack() {
+	for len(sink.inflight) > 0 && sink.inflight[0].done {
+		item := sink.inflight[0]
+		sink.inflight[0] = nil
+		sink.inflight = sink.inflight[1:]
+		if item.ack != nil {
+			item.ack()
+		}
+		if !item.fromDisk {
+			continue
+		}
+		sink.spill.commit(item.size)
+		if sink.spill.pending() == 0 {
+			sink.spill.reset()
+			sink.spilling = false
+			sink.logEntry().Info("spilled events drained")
+		}
+	}
+	sink.updateMetrics()
+}
+
+// 写入输出，失败时按 retry_interval 加倍重试，超过 max_retries 时丢弃；关闭时返回 false
+// 熔断时等待探测，不溢出到磁盘时写入死信文件
+func (sink *queuedSink) write(item *queuedEvent) bool {
+	interval := sink.retryInterval
+	for retries := 0; ; retries++ {
+		for sink.breaker != nil {
+			wait := sink.breaker.allow(sink.retryInterval)
+			if wait <= 0 {
+				break
+			}
+			if sink.spill == nil {
+				err := sink.deadLetter(item.data, item.messages, sink.breaker.err())
+				if err == nil {
+					return true
+				}
+				sink.logEntry().With(item.data.LogFields()).WithError(err).Error("write dead letter")
+			}
+			select {
+			case <-sink.quit:
+				return false
+			case <-time.After(wait):
+			}
+		}
+		err := sink.writeOnce(item)
+		if sink.breaker != nil {
+			sink.breaker.record(err)
+		}
+		if err == nil {
+			if _, ok := sink.sink.(SinkAcker); !ok {
+				observeLatency(sink.name, item.data, time.Now())
+			}
+			return true
+		}
+		if sink.maxRetries > 0 && retries >= sink.maxRetries {
+			sink.logEntry().With(item.data.LogFields()).WithError(err).Error("write sink, drop event after ", retries, " retries")
+			metrics.SinkEventsDropped.Inc(sink.name)
+			return true
+		}
+		metrics.SinkWriteRetries.Inc(sink.name)
+		// 熔断后等待探测
+		if sink.breaker != nil && sink.breaker.isOpen() {
+			sink.logEntry().With(item.data.LogFields()).WithError(err).Error("write sink, circuit open")
+			continue
+		}
+		sink.logEntry().With(item.data.LogFields()).WithError(err).Error("write sink, retry in ", interval)
+		select {
+		case <-sink.quit:
+			return false
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > sink.retryMaxInterval {
+			interval = sink.retryMaxInterval
+		}
+	}
+}
+
+// 写入一次，超过 write_timeout 时返回错误，超时的写入在后台继续，重试可能重复写入
+// 下层输出缓存事件(SinkAcker)时确认交给下层，写入成功后不再在 ack() 中确认
+func (sink *queuedSink) writeOnce(item *queuedEvent) error {
+	write := func() error {
+		return sink.sink.Write(item.data, item.messages)
+	}
+	acker, passAck := sink.sink.(SinkAcker)
+	if passAck {
+		// 确认时记录延迟
+		delivered := item.ack
+		ack := func() {
+			observeLatency(sink.name, item.data, time.Now())
+			if delivered != nil {
+				delivered()
+			}
+		}
+		write = func() error {
+			return acker.WriteAck(item.data, item.messages, ack)
+		}
+	}
+	err := sink.writeWithTimeout(write)
+	if err == nil && passAck {
+		sink.lock.Lock()
+		item.ack = nil
+		sink.lock.Unlock()
+	}
+	return err
+}
+
+func (sink *queuedSink) writeWithTimeout(write func() error) error {
+	if sink.writeTimeout <= 0 {
+		return write()
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- write()
+	}()
+	timer := time.NewTimer(sink.writeTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("write timeout after %s", sink.writeTimeout)
+	}
+}
+
+// 调用时持有锁
+func (sink *queuedSink) updateMetrics() {
+	metrics.SinkQueueDepth.Set(float64(len(sink.queue)), sink.name)
+	metrics.SinkInFlight.Set(float64(len(sink.inflight)), sink.name)
+	if sink.spill != nil {
+		metrics.SinkSpillBytes.Set(float64(sink.spill.pending()), sink.name)
+	}
+}
+
+// 内存中未写入的事件数
+func (sink *queuedSink) pendingInMemory() int {
+	pending := len(sink.queue)
+	for _, item := range sink.inflight {
+		if !item.fromDisk {
+			pending++
+		}
+	}
+	return pending
+}
+
+// 等待内存队列写入，磁盘中的事件重启后继续写入
+func (sink *queuedSink) Flush() error {
+	deadline := time.Now().Add(sink.flushTimeout)
+	sink.lock.Lock()
+	for sink.pendingInMemory() > 0 && !sink.closed && sink.failed == nil && time.Now().Before(deadline) {
+		sink.lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		sink.lock.Lock()
+	}
+	pending, failed := sink.pendingInMemory(), sink.failed
+	sink.lock.Unlock()
+	if failed != nil {
+		return failed
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d events in queue not written", pending)
+	}
+	if flusher, ok := sink.sink.(SinkFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (sink *queuedSink) Close() error {
+	sink.lock.Lock()
+	if sink.closed {
+		sink.lock.Unlock()
+		return nil
+	}
+	sink.closed = true
+	close(sink.quit)
+	sink.cond.Broadcast()
+	sink.lock.Unlock()
+	sink.done.Wait()
+
+	if sink.spill != nil {
+		sink.spill.close()
+	}
+	return sink.sink.Close()
+}
+
+// 磁盘中的事件
+type spillRecord struct {
+	Header         mysql.EventHeader         `json:"header"`
+	BinlogFileName string                    `json:"binlog_file"`
+	BinlogPosition uint32                    `json:"binlog_position"`
+	SchemaName     string                    `json:"db"`
+	TableName      string                    `json:"table"`
+	DDL            *mysql.DDLEvent           `json:"ddl,omitempty"`
+	Failover       *mysql.FailoverEvent      `json:"failover,omitempty"`
+	Restart        *mysql.MasterRestartEvent `json:"restart,omitempty"`
+	Source         string                    `json:"source,omitempty"`
+	ParsedAt       time.Time                 `json:"parsed_at"`
+	Messages       []string                  `json:"messages"`
+}
+
+func newSpillRecord(data *mysql.EventReslut, messages []string) *spillRecord {
+	return &spillRecord{
+		Header:         data.Header,
+		BinlogFileName: data.BinlogFileName,
+		BinlogPosition: data.BinlogPosition,
+		SchemaName:     data.SchemaName,
+		TableName:      data.TableName,
+		DDL:            data.DDL,
+		Failover:       data.Failover,
+		Restart:        data.Restart,
+		Source:         data.Source,
+		ParsedAt:       data.ParsedAt,
+		Messages:       messages,
+	}
+}
+
+// 磁盘队列，每个事件为 4 字节长度 + json
+type spillFile struct {
+	path           string
+	file           *os.File
+	readOffset     int64 // 已写入输出的位置
+	dispatchOffset int64 // 已分发的位置
+	writeOffset    int64
+}
+
+func openSpillFile(path string) (*spillFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	spill := &spillFile{path: path, file: file, writeOffset: info.Size()}
+	if b, err := os.ReadFile(path + ".offset"); err == nil {
+		offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err == nil && offset >= 0 && offset <= spill.writeOffset {
+			spill.readOffset = offset
+		}
+	}
+	spill.dispatchOffset = spill.readOffset
+	return spill, nil
+}
+
+// 未写入输出的字节数
+func (spill *spillFile) pending() int64 {
+	return spill.writeOffset - spill.readOffset
+}
+
+// 是否有未分发的事件
+func (spill *spillFile) undispatched() bool {
+	return spill.dispatchOffset < spill.writeOffset
+}
+
+func (spill *spillFile) append(data *mysql.EventReslut, messages []string) error {
+	b, err := json.Marshal(newSpillRecord(data, messages))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	if _, err := spill.file.WriteAt(buf, spill.writeOffset); err != nil {
+		return err
+	}
+	// 追加后即确认，fsync 后才视为已投递
+	if err := spill.file.Sync(); err != nil {
+		return err
+	}
+	spill.writeOffset += int64(len(buf))
+	return nil
+}
+
+// 读取下一个未分发的事件
+func (spill *spillFile) peek() (*queuedEvent, error) {
+	head := make([]byte, 4)
+	if _, err := spill.file.ReadAt(head, spill.dispatchOffset); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(head))
+	if _, err := spill.file.ReadAt(body, spill.dispatchOffset+4); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	record := &spillRecord{}
+	if err := json.Unmarshal(body, record); err != nil {
+		return nil, err
+	}
+	data := &mysql.EventReslut{
+		Header:         record.Header,
+		BinlogFileName: record.BinlogFileName,
+		BinlogPosition: record.BinlogPosition,
+		SchemaName:     record.SchemaName,
+		TableName:      record.TableName,
+		DDL:            record.DDL,
+		Failover:       record.Failover,
+		Restart:        record.Restart,
+		Source:         record.Source,
+		ParsedAt:       record.ParsedAt,
+	}
+	return &queuedEvent{data: data, messages: record.Messages, size: int64(4 + len(body)), fromDisk: true}, nil
+}
+
+// 事件已写入输出，保存已写入的位置
+func (spill *spillFile) commit(size int64) {
+	spill.readOffset += size
+	if err := os.WriteFile(spill.path+".offset", []byte(strconv.FormatInt(spill.readOffset, 10)), 0644); err != nil {
+		logger.With(logger.Fields{"file": spill.path}).WithError(err).Warn("save spill offset")
+	}
+}
+
+// 全部写入后清空
+func (spill *spillFile) reset() {
+	if err := spill.file.Truncate(0); err != nil {
+		logger.With(logger.Fields{"file": spill.path}).WithError(err).Warn("truncate spill file")
+	}
+	os.Remove(spill.path + ".offset")
+	spill.readOffset, spill.dispatchOffset, spill.writeOffset = 0, 0, 0
+}
+
+func (spill *spillFile) close() {
+	spill.file.Close()
+}
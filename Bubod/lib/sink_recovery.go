@@ -0,0 +1,75 @@
+// 从输出恢复位点
+// 输出写入的每条消息带有事件的位点 binlog 和所在事务的 gtid(见 mysql/format_data.go)，
+// 能读取已写入数据的输出(type=file)实现 SinkPositionReader。数据源配置 recover_from_sink=sink.N 时，
+// 启动时读取该输出最后写入的位点，作为位点来源 sink 参与 checkpoint_quorum 的选择，checkpoint_quorum 默认为 sink:
+// 输出中的位点就是最后投递的事件，位点文件、选举后端丢失或落后时也不会重复或遗漏投递太多事件。
+//
+// 该输出只能由这一个数据源写入，否则读到的可能是其他数据源的位点。
+// 按 GTID 同步时(gtid_set 或 gtid_checkpoint)以 GTID 集合定位，恢复的文件位点不生效，消息中的 gtid 只用于下游去重。
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"bubod/Bubod/logger"
+)
+
+// 能读取最后写入位点的输出
+type SinkPositionReader interface {
+	// 最后写入的消息的位点，没有写入过时返回 nil
+	LastPosition() (*SinkPosition, error)
+}
+
+// 输出中最后写入的位点
+type SinkPosition struct {
+	Position string // binlog 文件位点 mysql-bin.000003:4
+	GTID     string // 所在事务的 GTID，未开启 GTID 时为空
+}
+
+// 解析一条消息中的位点，不是带位点的消息时返回 nil
+func parseSinkPosition(message []byte) *SinkPosition {
+	data := &struct {
+		Binlog string `json:"binlog"`
+		GTID   string `json:"gtid"`
+	}{}
+	if err := json.Unmarshal(message, data); err != nil || !CheckBinlogFilePos(data.Binlog) {
+		return nil
+	}
+	return &SinkPosition{Position: data.Binlog, GTID: data.GTID}
+}
+
+// recover_from_sink 指定的输出，必须是数据源写入的输出且能读取位点
+func resolveRecoverSink(entries []*sinkEntry, name string) (*sinkEntry, error) {
+	for _, entry := range entries {
+		if entry.Name != name {
+			continue
+		}
+		if _, ok := entry.base.(SinkPositionReader); !ok {
+			return nil, fmt.Errorf("recover_from_sink: sink %s of type %s can not read back positions", name, entry.Type)
+		}
+		if file, ok := entry.base.(*fileSink); ok && file.format == FILE_FORMAT_PARQUET {
+			return nil, fmt.Errorf("recover_from_sink: sink %s of format parquet can not read back positions", name)
+		}
+		return entry, nil
+	}
+	return nil, fmt.Errorf("recover_from_sink: sink %s is not written by this source", name)
+}
+
+// 读取 recover_from_sink 最后写入的位点，未配置或读取失败时返回空
+func (dumpConfig *DumpConfig) loadSinkPosition() string {
+	entry := dumpConfig.recoverSink
+	if entry == nil {
+		return ""
+	}
+	position, err := entry.base.(SinkPositionReader).LastPosition()
+	if err != nil {
+		dumpConfig.logEntry().With(logger.Fields{"sink": entry.Name}).WithError(err).Warn("read position from sink")
+		return ""
+	}
+	if position == nil {
+		return ""
+	}
+	dumpConfig.logEntry().With(logger.Fields{"sink": entry.Name, "position": position.Position, "gtid": position.GTID}).Info("last position in sink")
+	return position.Position
+}
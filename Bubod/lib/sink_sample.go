@@ -0,0 +1,187 @@
+// 按表采样
+// 从大流量的生产库构建降采样的分析或预发布链路时，[sink.N] 配置 sample 只写入部分行，
+// 逗号分隔的 库.表:规则，名称可用通配符，先配置的优先，未匹配的表全部写入:
+//
+//	sample=shop.orders:100,shop.*:key:10/100
+//
+//	N         每 N 行写入 1 行，按表计数
+//	key:M/N   主键 key 的 crc32 对 N 取模小于 M 的行，同一行的所有变更一致地写入或丢弃；没有主键的行丢弃
+//
+// DDL、master 切换等非行事件全部写入。只过滤写入输出的消息，输出收到的原始事件(data)不变，
+// 消息全部被丢弃时不写入；在 aggregate_window 合并之前采样，丢弃的行数见 bubod_sink_rows_sampled_out_total。
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+// 一条采样规则，every 大于 0 时按计数采样，否则按主键分桶
+type sampleRule struct {
+	schema  string
+	table   string
+	every   uint64
+	buckets uint32 // 写入的桶数 M
+	modulo  uint32 // 总桶数 N
+}
+
+type sampleSink struct {
+	sync.Mutex
+	name     string
+	sink     Sink
+	rules    []*sampleRule
+	counters map[string]uint64 // 按表计数
+}
+
+// 配置 sample 时包装为采样的输出
+func newSampleSink(name string, sink Sink, conf map[string]string) (Sink, error) {
+	rules, err := parseSampleRules(conf["sample"])
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return sink, nil
+	}
+	sampled := &sampleSink{
+		name:     name,
+		sink:     sink,
+		rules:    rules,
+		counters: make(map[string]uint64),
+	}
+	if _, ok := sink.(SinkAcker); ok {
+		return &sampleAckSink{sampled}, nil
+	}
+	return sampled, nil
+}
+
+// 下层输出异步确认时将确认传递给下层
+type sampleAckSink struct {
+	*sampleSink
+}
+
+func (sink *sampleAckSink) WriteAck(data *mysql.EventReslut, messages []string, ack func()) error {
+	return sink.write(data, messages, ack)
+}
+
+// 解析 sample，格式见文件头
+func parseSampleRules(s string) ([]*sampleRule, error) {
+	var rules []*sampleRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.IndexByte(item, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid sample %q, must be db.table:rule", item)
+		}
+		names := strings.SplitN(item[:i], ".", 2)
+		if len(names) != 2 {
+			return nil, fmt.Errorf("invalid sample %q, must be db.table:rule", item)
+		}
+		rule := &sampleRule{schema: names[0], table: names[1]}
+		for _, pattern := range []string{rule.schema, rule.table} {
+			if err := mysql.ValidateNamePattern(pattern); err != nil || pattern == "" {
+				return nil, fmt.Errorf("invalid sample %q", item)
+			}
+		}
+		spec := item[i+1:]
+		if strings.HasPrefix(spec, "key:") {
+			parts := strings.SplitN(strings.TrimPrefix(spec, "key:"), "/", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid sample %q, must be db.table:key:M/N", item)
+			}
+			buckets, err1 := strconv.ParseUint(parts[0], 10, 32)
+			modulo, err2 := strconv.ParseUint(parts[1], 10, 32)
+			if err1 != nil || err2 != nil || modulo == 0 || buckets > modulo {
+				return nil, fmt.Errorf("invalid sample %q, must be db.table:key:M/N with M <= N", item)
+			}
+			rule.buckets, rule.modulo = uint32(buckets), uint32(modulo)
+		} else {
+			every, err := strconv.ParseUint(spec, 10, 64)
+			if err != nil || every == 0 {
+				return nil, fmt.Errorf("invalid sample %q, rate must be a positive integer", item)
+			}
+			rule.every = every
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// 表的采样规则，未匹配时返回 nil
+func (sink *sampleSink) rule(schemaName string, tableName string) *sampleRule {
+	for _, rule := range sink.rules {
+		if mysql.MatchName(rule.schema, schemaName, false) && mysql.MatchName(rule.table, tableName, false) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (sink *sampleSink) Write(data *mysql.EventReslut, messages []string) error {
+	return sink.write(data, messages, nil)
+}
+
+// 消息全部被丢弃时直接确认
+func (sink *sampleSink) write(data *mysql.EventReslut, messages []string, ack func()) error {
+	if data.RowCount() == 0 || data.DDL != nil {
+		return writeAck(sink.sink, data, messages, ack)
+	}
+	rule := sink.rule(data.SchemaName, data.TableName)
+	if rule == nil {
+		return writeAck(sink.sink, data, messages, ack)
+	}
+	sampled := make([]string, 0, len(messages))
+	sink.Lock()
+	for _, message := range messages {
+		if sink.keep(rule, data.SchemaName+"."+data.TableName, message) {
+			sampled = append(sampled, message)
+		}
+	}
+	sink.Unlock()
+	if dropped := len(messages) - len(sampled); dropped > 0 {
+		metrics.SinkRowsSampledOut.Add(float64(dropped), sink.name)
+	}
+	if len(sampled) == 0 {
+		if ack != nil {
+			ack()
+		}
+		return nil
+	}
+	return writeAck(sink.sink, data, sampled, ack)
+}
+
+// 是否写入该行
+func (sink *sampleSink) keep(rule *sampleRule, table string, message string) bool {
+	if rule.every > 0 {
+		n := sink.counters[table]
+		sink.counters[table] = n + 1
+		return n%rule.every == 0
+	}
+	parsed := &struct {
+		Key string `json:"key"`
+	}{}
+	if err := json.Unmarshal([]byte(message), parsed); err != nil || parsed.Key == "" {
+		return false
+	}
+	return crc32.ChecksumIEEE([]byte(parsed.Key))%rule.modulo < rule.buckets
+}
+
+func (sink *sampleSink) Flush() error {
+	if flusher, ok := sink.sink.(SinkFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (sink *sampleSink) Close() error {
+	return sink.sink.Close()
+}
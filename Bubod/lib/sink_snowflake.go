@@ -0,0 +1,180 @@
+// Snowflake 微批载入
+// [sink.N] type=snowflake 通过 SQL API(/api/v2/statements)执行语句，不依赖驱动: staging 对象通过 COPY INTO 从外部 stage 载入临时表，
+// stage 的 URL 需要指向 [ObjectStorage] 的 bucket 根目录；再 MERGE/INSERT 到 {database}.{db}.{table}，库为 schema。
+// 库表名、字段名加引号，与源库大小写一致。访问令牌为 token 或 token_command 的输出，token_type 为 OAUTH(默认)或 KEYPAIR_JWT。
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/mysql"
+)
+
+type snowflakeLoader struct {
+	url       string // https://{account}.snowflakecomputing.com
+	database  string
+	warehouse string
+	role      string
+	stage     string // @db.schema.stage
+	tokenType string
+	timeout   time.Duration
+	token     *warehouseToken
+	client    *http.Client
+	dialect   *warehouseDialect
+	tables    map[string]map[string]bool // 目标表已有的字段
+}
+
+func newSnowflakeWarehouseSink(name string, conf map[string]string) (Sink, error) {
+	section := config.Section(conf)
+	loader := &snowflakeLoader{
+		url:       strings.TrimRight(section.GetString("url", ""), "/"),
+		database:  section.GetString("database", ""),
+		warehouse: section.GetString("warehouse", ""),
+		role:      section.GetString("role", ""),
+		stage:     strings.TrimRight(section.GetString("stage", ""), "/"),
+		tokenType: section.GetString("token_type", "OAUTH"),
+		tables:    make(map[string]map[string]bool),
+	}
+	if loader.url == "" || loader.database == "" || loader.stage == "" {
+		return nil, fmt.Errorf("url, database and stage are required")
+	}
+	if !strings.HasPrefix(loader.stage, "@") {
+		loader.stage = "@" + loader.stage
+	}
+	var err error
+	if loader.token, err = newWarehouseToken(section); err != nil {
+		return nil, err
+	}
+	if loader.timeout, err = section.GetDuration("timeout", 30*time.Second); err != nil {
+		return nil, err
+	}
+	loader.client = &http.Client{Timeout: loader.timeout}
+	loader.dialect = &warehouseDialect{
+		quoteName:  quoteSnowflakeName,
+		columnType: snowflakeColumnType,
+		stringType: "VARCHAR",
+		intType:    "NUMBER(38,0)",
+		safeCast:   "TRY_CAST",
+	}
+	return newWarehouseSink(name, conf, loader)
+}
+
+func quoteSnowflakeName(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func snowflakeColumnType(column *mysql.ColumnInfo) string {
+	base, args, _ := splitColumnType(column.Type)
+	switch base {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "year", "bit":
+		return "NUMBER(38,0)"
+	case "float", "double", "real":
+		return "FLOAT"
+	case "decimal", "numeric":
+		if args != "" {
+			return "NUMBER(" + args + ")"
+		}
+		return "NUMBER(38,0)"
+	case "date":
+		return "DATE"
+	case "datetime", "timestamp":
+		return "TIMESTAMP_NTZ"
+	}
+	return "VARCHAR"
+}
+
+// database.schema.table
+func (loader *snowflakeLoader) table(schemaName string, tableName string) string {
+	return quoteSnowflakeName(loader.database) + "." + quoteSnowflakeName(schemaName) + "." + quoteSnowflakeName(tableName)
+}
+
+type snowflakeResponse struct {
+	Code               string `json:"code"`
+	Message            string `json:"message"`
+	StatementHandle    string `json:"statementHandle"`
+	StatementStatusURL string `json:"statementStatusUrl"`
+}
+
+// 执行一条语句，异步执行(202)时等待完成
+func (loader *snowflakeLoader) query(statement string) error {
+	header := map[string]string{"X-Snowflake-Authorization-Token-Type": loader.tokenType}
+	request := map[string]interface{}{
+		"statement": statement,
+		"timeout":   int(loader.timeout / time.Second),
+		"database":  loader.database,
+	}
+	if loader.warehouse != "" {
+		request["warehouse"] = loader.warehouse
+	}
+	if loader.role != "" {
+		request["role"] = loader.role
+	}
+	resp := &snowflakeResponse{}
+	status, err := warehouseRequest(loader.client, loader.token, http.MethodPost, loader.url+"/api/v2/statements", header, request, resp)
+	for err == nil && status == http.StatusAccepted {
+		time.Sleep(time.Second)
+		status, err = warehouseRequest(loader.client, loader.token, http.MethodGet,
+			loader.url+"/api/v2/statements/"+url.PathEscape(resp.StatementHandle), header, nil, resp)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", statement, err)
+	}
+	return nil
+}
+
+// 创建 schema 和目标表，添加缺少的字段
+func (loader *snowflakeLoader) syncTable(batch *warehouseBatch) error {
+	name := batch.schemaName + "." + batch.tableName
+	existing, ok := loader.tables[name]
+	definitions := loader.dialect.columnDefinitions(batch)
+	table := loader.table(batch.schemaName, batch.tableName)
+	if !ok {
+		if err := loader.query("CREATE SCHEMA IF NOT EXISTS " + quoteSnowflakeName(loader.database) + "." + quoteSnowflakeName(batch.schemaName)); err != nil {
+			return err
+		}
+		if err := loader.query(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, strings.Join(definitions, ", "))); err != nil {
+			return err
+		}
+		existing = make(map[string]bool)
+	}
+	for i, column := range batch.columns {
+		if existing[column.Name] {
+			continue
+		}
+		if err := loader.query(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", table, definitions[i])); err != nil {
+			return err
+		}
+		existing[column.Name] = true
+	}
+	loader.tables[name] = existing
+	return nil
+}
+
+func (loader *snowflakeLoader) load(batch *warehouseBatch) error {
+	if err := loader.syncTable(batch); err != nil {
+		return err
+	}
+	stage := loader.table(batch.schemaName, batch.tableName+WAREHOUSE_STAGE_SUFFIX)
+	fileFormat := "TYPE=JSON"
+	if batch.format == WAREHOUSE_FORMAT_PARQUET {
+		fileFormat = "TYPE=PARQUET"
+	}
+	statements := []string{
+		fmt.Sprintf("CREATE OR REPLACE TRANSIENT TABLE %s (%s)", stage, strings.Join(loader.dialect.stageDefinitions(batch), ", ")),
+		fmt.Sprintf("COPY INTO %s FROM %s/%s FILE_FORMAT=(%s) MATCH_BY_COLUMN_NAME=CASE_SENSITIVE FORCE=TRUE",
+			stage, loader.stage, ObjectStore.Key(batch.key), fileFormat),
+		loader.dialect.loadSQL(batch, loader.table(batch.schemaName, batch.tableName), stage),
+		"DROP TABLE IF EXISTS " + stage,
+	}
+	for _, statement := range statements {
+		if err := loader.query(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// 软删除转换
+// 不支持删除的下游(如数据仓库)需要把删除表示为标记删除的更新，或者反过来，源库使用软删除而下游需要真正的删除:
+//
+//	soft_delete_column=deleted_at   delete 转为 update，after 为删除前的行并设置该字段
+//	soft_delete_value=timestamp     字段值: timestamp(默认，事件时间 2006-01-02 15:04:05)/unix(事件时间戳)/true/1 或其他字符串
+//	hard_delete_column=is_deleted   update 将该字段从假值改为真值(非 null、0、false、空字符串、零值时间)时转为 delete，before 为更新前的行
+//
+// 两者可以同时配置。只转换写入输出的消息，输出收到的原始事件(data)不变；在 aggregate_window 合并之前转换。
+package lib
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/mysql"
+)
+
+const (
+	SOFT_DELETE_VALUE_TIMESTAMP = "timestamp"
+	SOFT_DELETE_VALUE_UNIX      = "unix"
+)
+
+type softDeleteSink struct {
+	sink             Sink
+	softDeleteColumn string
+	softDeleteValue  string
+	hardDeleteColumn string
+}
+
+// 配置 soft_delete_column 或 hard_delete_column 时包装为转换删除的输出
+func newSoftDeleteSink(sink Sink, conf map[string]string) (Sink, error) {
+	section := config.Section(conf)
+	softDelete := &softDeleteSink{
+		sink:             sink,
+		softDeleteColumn: section.GetString("soft_delete_column", ""),
+		softDeleteValue:  section.GetString("soft_delete_value", SOFT_DELETE_VALUE_TIMESTAMP),
+		hardDeleteColumn: section.GetString("hard_delete_column", ""),
+	}
+	if softDelete.softDeleteColumn == "" && softDelete.hardDeleteColumn == "" {
+		return sink, nil
+	}
+	if softDelete.softDeleteColumn != "" && softDelete.softDeleteColumn == softDelete.hardDeleteColumn {
+		return nil, fmt.Errorf("soft_delete_column and hard_delete_column must be different")
+	}
+	if _, ok := sink.(SinkAcker); ok {
+		return &softDeleteAckSink{softDelete}, nil
+	}
+	return softDelete, nil
+}
+
+// 下层输出异步确认时将确认传递给下层
+type softDeleteAckSink struct {
+	*softDeleteSink
+}
+
+func (sink *softDeleteAckSink) WriteAck(data *mysql.EventReslut, messages []string, ack func()) error {
+	return writeAck(sink.sink, data, sink.convertMessages(data, messages), ack)
+}
+
+func (sink *softDeleteSink) Write(data *mysql.EventReslut, messages []string) error {
+	return sink.sink.Write(data, sink.convertMessages(data, messages))
+}
+
+// 转换删除的消息
+func (sink *softDeleteSink) convertMessages(data *mysql.EventReslut, messages []string) []string {
+	eventType := mysql.EvenTypeName(data.Header.EventType)
+	if (eventType == "delete" && sink.softDeleteColumn != "") || (eventType == "update" && sink.hardDeleteColumn != "") {
+		converted := make([]string, 0, len(messages))
+		for _, message := range messages {
+			converted = append(converted, sink.convert(data, message))
+		}
+		messages = converted
+	}
+	return messages
+}
+
+// 转换一条消息，不需要转换或无法解析时原样返回
+func (sink *softDeleteSink) convert(data *mysql.EventReslut, message string) string {
+	parsed := new(mysql.FormatDataJsonStruct)
+	decoder := json.NewDecoder(bytes.NewReader([]byte(message)))
+	decoder.UseNumber()
+	if err := decoder.Decode(parsed); err != nil {
+		return message
+	}
+	switch {
+	case parsed.EventType == "delete" && sink.softDeleteColumn != "":
+		after := make(map[string]driver.Value, len(parsed.Before)+1)
+		for k, v := range parsed.Before {
+			after[k] = v
+		}
+		after[sink.softDeleteColumn] = sink.deletedValue(data.Header.Timestamp)
+		parsed.EventType, parsed.After = "update", after
+	case parsed.EventType == "update" && sink.hardDeleteColumn != "":
+		if deletedFlag(parsed.Before[sink.hardDeleteColumn]) || !deletedFlag(parsed.After[sink.hardDeleteColumn]) {
+			return message
+		}
+		parsed.EventType, parsed.After, parsed.OldKey = "delete", make(map[string]driver.Value), ""
+	default:
+		return message
+	}
+	return mysql.FormatEventDataJson(parsed)
+}
+
+func (sink *softDeleteSink) deletedValue(timestamp uint32) driver.Value {
+	switch sink.softDeleteValue {
+	case SOFT_DELETE_VALUE_TIMESTAMP:
+		return time.Unix(int64(timestamp), 0).Format("2006-01-02 15:04:05")
+	case SOFT_DELETE_VALUE_UNIX:
+		return timestamp
+	case "true":
+		return true
+	case "1":
+		return 1
+	}
+	return sink.softDeleteValue
+}
+
+// 字段值是否表示已删除: 非 null、0、false、空字符串、零值时间
+func deletedFlag(v driver.Value) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case json.Number:
+		f, err := v.Float64()
+		return err != nil || f != 0
+	case string:
+		return v != "" && v != "0" && v != "0000-00-00 00:00:00"
+	}
+	return true
+}
+
+func (sink *softDeleteSink) Flush() error {
+	if flusher, ok := sink.sink.(SinkFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (sink *softDeleteSink) Close() error {
+	return sink.sink.Close()
+}
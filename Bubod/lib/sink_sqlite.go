@@ -0,0 +1,291 @@
+// SQLite applier
+// [sink.N] type=sqlite 将行变更写入本地 SQLite 文件，每个库为 dir 下的一个文件 {db}.sqlite，表名与源表相同，
+// 用于边缘设备、选定表(tables/filter_tables)的本地物化视图。
+// 通过 sqlite3 命令行程序(sqlite_bin)写入，每个写入线程一个进程，库文件附加(ATTACH)到进程中，日志模式为 WAL；
+// 同一进程最多附加 10 个库(SQLITE_MAX_ATTACHED)。不依赖 cgo 的 SQLite 驱动，但需要安装 SQLITE_MIN_VERSION 以上的 sqlite3，
+// 创建输出时检查版本。每批语句后输出一个带随机串的结束标记，读到标记为止作为这批语句的输出。
+// insert/update 为 INSERT OR REPLACE，update 修改了主键时先删除旧主键的行，delete 按主键删除；
+// 没有主键的表 update/delete 按变更前的所有字段定位。同一事件的所有行在一个事务中执行，失败时重启进程。
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/mysql"
+)
+
+const (
+	SQLITE_FILE_SUFFIX = ".sqlite"
+	SQLITE_MIN_VERSION = "3.16.0" // pragma_table_info 等表值函数
+)
+
+// 写入 dir 下的 SQLite 文件
+type sqliteApplyTarget struct {
+	dir         string
+	bin         string
+	busyTimeout time.Duration
+	cmd         *exec.Cmd // 为 nil 时在下次写入前启动
+	stdin       io.WriteCloser
+	stdout      *bufio.Reader
+	stderr      *bytes.Buffer
+	attached    map[string]bool
+	nonce       string // 结束标记的随机串，每个进程不同，避免与查询结果相同
+	seq         uint64 // 每批语句结束标记的序号
+}
+
+func newSqliteApplySink(name string, conf map[string]string) (Sink, error) {
+	section := config.Section(conf)
+	dir := section.GetString("dir", "")
+	if dir == "" {
+		return nil, fmt.Errorf("dir is required")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	bin, err := exec.LookPath(section.GetString("sqlite_bin", "sqlite3"))
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3 command line shell is required: %s", err)
+	}
+	if err := checkSqliteVersion(bin); err != nil {
+		return nil, err
+	}
+	busyTimeout, err := section.GetDuration("busy_timeout", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return newApplySink(name, func() applyTarget {
+		return &sqliteApplyTarget{dir: dir, bin: bin, busyTimeout: busyTimeout}
+	}, conf)
+}
+
+// sqlite3 -version 输出如 3.31.1 2020-01-27 19:55:54 ...
+func checkSqliteVersion(bin string) error {
+	out, err := exec.Command(bin, "-version").Output()
+	if err != nil {
+		return fmt.Errorf("%s -version: %s", bin, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 || compareSqliteVersion(fields[0], SQLITE_MIN_VERSION) < 0 {
+		return fmt.Errorf("%s version %q is not supported, sqlite3 %s or later is required", bin, strings.TrimSpace(string(out)), SQLITE_MIN_VERSION)
+	}
+	return nil
+}
+
+// 按数字比较 x.y.z 格式的版本，无法解析的部分为 0
+func compareSqliteVersion(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func (target *sqliteApplyTarget) dialect() string {
+	return TARGET_SQLITE
+}
+
+// 启动 sqlite3，出错时立即退出(-bail)，未提交的事务回滚
+func (target *sqliteApplyTarget) start() error {
+	if target.cmd != nil {
+		return nil
+	}
+	cmd := exec.Command(target.bin, "-bail", "-batch", "-noheader", "-list", ":memory:")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	target.cmd, target.stdin, target.stdout, target.stderr = cmd, stdin, bufio.NewReader(stdout), stderr
+	target.attached = make(map[string]bool)
+	target.nonce = hex.EncodeToString(nonce)
+	_, err = target.run(fmt.Sprintf(".timeout %d", target.busyTimeout/time.Millisecond))
+	return err
+}
+
+// 执行一批语句，返回输出的行；sqlite3 退出时返回错误输出
+func (target *sqliteApplyTarget) run(script string) ([]string, error) {
+	target.seq++
+	marker := fmt.Sprintf("bubod-%s:%d", target.nonce, target.seq)
+	if _, err := io.WriteString(target.stdin, script+"\nSELECT '"+marker+"';\n"); err != nil {
+		return nil, target.reset(err)
+	}
+	lines := make([]string, 0)
+	for {
+		line, err := target.stdout.ReadString('\n')
+		if err != nil {
+			return nil, target.reset(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == marker {
+			return lines, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+// 结束进程，下次写入时重新启动
+func (target *sqliteApplyTarget) reset(err error) error {
+	if target.cmd == nil {
+		return err
+	}
+	target.stdin.Close()
+	target.cmd.Wait()
+	if message := strings.TrimSpace(target.stderr.String()); message != "" {
+		err = fmt.Errorf("sqlite: %s", message)
+	}
+	target.cmd = nil
+	return err
+}
+
+// 附加库文件，不存在时创建
+func (target *sqliteApplyTarget) attach(schemaName string) error {
+	if target.attached[schemaName] {
+		return nil
+	}
+	dialect := TARGET_SQLITE
+	path := filepath.Join(target.dir, schemaName+SQLITE_FILE_SUFFIX)
+	if _, err := target.run(fmt.Sprintf("ATTACH DATABASE %s AS %s;\nPRAGMA %s.journal_mode=WAL;",
+		quoteTargetString(dialect, path), quoteTargetName(dialect, schemaName), quoteTargetName(dialect, schemaName))); err != nil {
+		return err
+	}
+	target.attached[schemaName] = true
+	return nil
+}
+
+// 附加 dir 下已有的库文件，DDL 可能涉及本进程未写入过的库
+func (target *sqliteApplyTarget) attachExisting() error {
+	paths, err := filepath.Glob(filepath.Join(target.dir, "*"+SQLITE_FILE_SUFFIX))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := target.attach(strings.TrimSuffix(filepath.Base(path), SQLITE_FILE_SUFFIX)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (target *sqliteApplyTarget) exec(statements []string) error {
+	for _, statement := range statements {
+		if err := target.start(); err != nil {
+			return err
+		}
+		if err := target.attachExisting(); err != nil {
+			return err
+		}
+		if _, err := target.run(statement + ";"); err != nil {
+			// 库文件不存在时表也不存在，重命名、删除、清空表不需要执行
+			if strings.Contains(err.Error(), "unknown database") {
+				continue
+			}
+			return fmt.Errorf("%s: %s", statement, err)
+		}
+	}
+	return nil
+}
+
+func (target *sqliteApplyTarget) tableColumns(schemaName string, tableName string) ([]string, error) {
+	if err := target.start(); err != nil {
+		return nil, err
+	}
+	if err := target.attach(schemaName); err != nil {
+		return nil, err
+	}
+	dialect := TARGET_SQLITE
+	return target.run(fmt.Sprintf("SELECT name FROM pragma_table_info(%s, %s) ORDER BY cid;",
+		quoteTargetString(dialect, tableName), quoteTargetString(dialect, schemaName)))
+}
+
+func (target *sqliteApplyTarget) applyRows(data *mysql.EventReslut) error {
+	if err := target.start(); err != nil {
+		return err
+	}
+	if err := target.attach(data.SchemaName); err != nil {
+		return err
+	}
+	dialect := TARGET_SQLITE
+	table := quoteTargetTable(dialect, data.SchemaName, data.TableName)
+	keys := primaryColumns(data.Columns)
+	statements := []string{"BEGIN"}
+	before, after := rowChanges(data)
+	for i := range after {
+		switch {
+		case after[i] == nil:
+			statements = append(statements, fmt.Sprintf("DELETE FROM %s WHERE %s", table, targetWhere(dialect, data.Columns, before[i])))
+		case before[i] != nil && len(keys) == 0:
+			sets := make([]string, 0, len(data.Columns))
+			for _, column := range data.Columns {
+				if value, ok := after[i][column.Name]; ok {
+					sets = append(sets, quoteTargetName(dialect, column.Name)+"="+targetValue(dialect, value))
+				}
+			}
+			statements = append(statements, fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(sets, ","),
+				targetWhere(dialect, data.Columns, before[i])))
+		default:
+			if before[i] != nil && data.OldKey(i) != nil {
+				statements = append(statements, fmt.Sprintf("DELETE FROM %s WHERE %s", table, targetWhere(dialect, data.Columns, before[i])))
+			}
+			names := make([]string, 0, len(data.Columns))
+			values := make([]string, 0, len(data.Columns))
+			for _, column := range data.Columns {
+				if value, ok := after[i][column.Name]; ok {
+					names, values = append(names, quoteTargetName(dialect, column.Name)), append(values, targetValue(dialect, value))
+				}
+			}
+			statements = append(statements, fmt.Sprintf("INSERT OR REPLACE INTO %s (%s) VALUES (%s)", table,
+				strings.Join(names, ","), strings.Join(values, ",")))
+		}
+	}
+	statements = append(statements, "COMMIT")
+	_, err := target.run(strings.Join(statements, ";\n") + ";")
+	return err
+}
+
+func (target *sqliteApplyTarget) Close() error {
+	if target.cmd == nil {
+		return nil
+	}
+	target.stdin.Close()
+	err := target.cmd.Wait()
+	target.cmd = nil
+	return err
+}
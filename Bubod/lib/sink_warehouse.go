@@ -0,0 +1,585 @@
+// 数据仓库微批输出
+// [sink.N] type=bigquery/snowflake 将行变更按表缓存，每 batch_interval 或缓存 batch_rows 行时写入 [ObjectStorage] 的 staging 对象
+// (ndjson 或 parquet，所有字段为字符串)，再由仓库载入(见 sink_bigquery.go、sink_snowflake.go):
+//
+//	{prefix}/{db}.{table}/{node}-20060102T150405Z-{seq}.ndjson
+//
+// staging 对象先载入临时表 {table}__bubod_stage，再按 mode 写入目标表 {db}.{table}，字段按目标类型 SAFE_CAST/TRY_CAST:
+//
+//	merge   默认，按主键 MERGE，同一批次同一主键只保留最后一次变更，delete 删除目标行
+//	append  追加写入 CDC 表，每个变更一行，带 _op(insert/update/delete)、_ts(事件时间，unix 秒)、_seq(写入顺序)
+//
+// 没有主键的表总是 append。目标表不存在时创建，缺少的字段自动添加。
+// 载入失败时每隔 retry_interval 重试，最多 load_retries 次，仍失败时保留 staging 对象，下一批次前按顺序重新载入；
+// 载入成功后删除 staging 对象和临时表，并确认批次中的事件，缓存和未载入的变更不越过位点。停止实例时(Flush)载入所有缓存的变更。
+package lib
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/mysql"
+	"bubod/Bubod/objstore"
+	"bubod/Bubod/parquet"
+)
+
+const (
+	WAREHOUSE_MODE_MERGE  = "merge"
+	WAREHOUSE_MODE_APPEND = "append"
+
+	WAREHOUSE_FORMAT_NDJSON  = "ndjson"
+	WAREHOUSE_FORMAT_PARQUET = "parquet"
+
+	DEFAULT_WAREHOUSE_BATCH_INTERVAL = time.Minute
+	DEFAULT_WAREHOUSE_BATCH_ROWS     = 100000
+
+	WAREHOUSE_STAGE_SUFFIX = "__bubod_stage"
+)
+
+// staging 对象和 append 模式目标表中的 CDC 字段
+const (
+	WAREHOUSE_OP_COLUMN  = "_op"
+	WAREHOUSE_TS_COLUMN  = "_ts"
+	WAREHOUSE_SEQ_COLUMN = "_seq"
+)
+
+var warehouseMetaColumns = []string{WAREHOUSE_OP_COLUMN, WAREHOUSE_TS_COLUMN, WAREHOUSE_SEQ_COLUMN}
+
+func init() {
+	RegisterSink("bigquery", newBigqueryWarehouseSink)
+	RegisterSink("snowflake", newSnowflakeWarehouseSink)
+}
+
+// 将 staging 对象载入目标表
+type warehouseLoader interface {
+	load(batch *warehouseBatch) error
+}
+
+// 一个已上传的 staging 对象
+type warehouseBatch struct {
+	schemaName string
+	tableName  string
+	columns    []*mysql.ColumnInfo
+	mode       string
+	format     string
+	key        string // 不含对象存储的 prefix
+	rows       int
+	acks       []func() // 批次中的事件的确认，载入后调用
+}
+
+// 一张表缓存的变更，表结构变化时先上传之前的行
+type warehouseTable struct {
+	schemaName string
+	tableName  string
+	columns    []*mysql.ColumnInfo
+	version    uint64
+	rows       [][]*string // 字段值，之后为 warehouseMetaColumns
+	acks       []func()    // 缓存的事件的确认
+}
+
+type warehouseSink struct {
+	sync.Mutex
+	name          string
+	client        *objstore.Client
+	loader        warehouseLoader
+	prefix        string
+	node          string
+	mode          string
+	format        string
+	batchInterval time.Duration
+	batchRows     int
+	loadRetries   int
+	retryInterval time.Duration
+
+	tables  map[string]*warehouseTable // db.table
+	rows    int
+	opened  time.Time // 第一行缓存的时间
+	pending []*warehouseBatch
+	seq     int
+	version int64 // 上次写入的 _seq，保证单调递增
+	quit    chan struct{}
+}
+
+// prefix 默认为 staging/{输出名称去掉 sink.}，node 默认为主机名
+func newWarehouseSink(name string, conf map[string]string, loader warehouseLoader) (Sink, error) {
+	if ObjectStore == nil {
+		return nil, fmt.Errorf("%s sink requires [ObjectStorage] bucket for staging", conf["type"])
+	}
+	section := config.Section(conf)
+	sink := &warehouseSink{
+		name:   name,
+		client: ObjectStore,
+		loader: loader,
+		prefix: strings.Trim(section.GetString("prefix", "staging/"+strings.TrimPrefix(name, SINK_SECTION_PREFIX)), "/"),
+		node:   section.GetString("node", ""),
+		mode:   section.GetString("mode", WAREHOUSE_MODE_MERGE),
+		format: section.GetString("format", WAREHOUSE_FORMAT_NDJSON),
+		tables: make(map[string]*warehouseTable),
+		quit:   make(chan struct{}),
+	}
+	switch sink.mode {
+	case WAREHOUSE_MODE_MERGE, WAREHOUSE_MODE_APPEND:
+	default:
+		return nil, fmt.Errorf("invalid mode %q, must be merge or append", sink.mode)
+	}
+	switch sink.format {
+	case WAREHOUSE_FORMAT_NDJSON, WAREHOUSE_FORMAT_PARQUET:
+	default:
+		return nil, fmt.Errorf("invalid format %q, must be ndjson or parquet", sink.format)
+	}
+	var err error
+	if sink.batchInterval, err = section.GetDuration("batch_interval", DEFAULT_WAREHOUSE_BATCH_INTERVAL); err != nil {
+		return nil, err
+	}
+	batchRows, err := section.GetInt("batch_rows", DEFAULT_WAREHOUSE_BATCH_ROWS)
+	if err != nil {
+		return nil, err
+	}
+	if sink.batchInterval <= 0 || batchRows <= 0 {
+		return nil, fmt.Errorf("batch_interval and batch_rows must be positive")
+	}
+	sink.batchRows = int(batchRows)
+	loadRetries, err := section.GetInt("load_retries", 3)
+	if err != nil {
+		return nil, err
+	}
+	sink.loadRetries = int(loadRetries)
+	if sink.retryInterval, err = section.GetDuration("retry_interval", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if sink.node == "" {
+		if sink.node, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	go sink.run()
+	return sink, nil
+}
+
+func (sink *warehouseSink) logEntry() *logger.Entry {
+	return logger.With(logger.Fields{"sink": sink.name})
+}
+
+// 没有新变更时也按 batch_interval 载入
+func (sink *warehouseSink) run() {
+	ticker := time.NewTicker(sink.batchInterval / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sink.quit:
+			return
+		case <-ticker.C:
+			sink.Lock()
+			if (sink.rows > 0 && time.Since(sink.opened) >= sink.batchInterval) || (sink.rows == 0 && len(sink.pending) > 0) {
+				if err := sink.roll(); err != nil {
+					sink.logEntry().WithError(err).Error("load warehouse batch")
+				}
+			}
+			sink.Unlock()
+		}
+	}
+}
+
+// 递增的 _seq
+func (sink *warehouseSink) nextSeq() string {
+	version := time.Now().UnixNano()
+	if version <= sink.version {
+		version = sink.version + 1
+	}
+	sink.version = version
+	return strconv.FormatInt(version, 10)
+}
+
+func (sink *warehouseSink) Write(data *mysql.EventReslut, messages []string) error {
+	return sink.WriteAck(data, messages, nil)
+}
+
+// 缓存行变更，载入失败不返回错误，变更已缓存或已上传，之后重试；ack 在所在批次载入后调用
+func (sink *warehouseSink) WriteAck(data *mysql.EventReslut, messages []string, ack func()) error {
+	if data.RowCount() == 0 || len(data.Columns) == 0 {
+		if ack != nil {
+			ack()
+		}
+		return nil
+	}
+	sink.Lock()
+	defer sink.Unlock()
+	name := data.SchemaName + "." + data.TableName
+	table, ok := sink.tables[name]
+	if ok && table.version != data.SchemaVersion && len(table.rows) > 0 {
+		if err := sink.stage(table); err != nil {
+			return err
+		}
+	}
+	if !ok {
+		table = &warehouseTable{schemaName: data.SchemaName, tableName: data.TableName}
+		sink.tables[name] = table
+	}
+	table.columns, table.version = data.Columns, data.SchemaVersion
+
+	timestamp := strconv.FormatUint(uint64(data.Header.Timestamp), 10)
+	eventType := mysql.EvenTypeName(data.Header.EventType)
+	add := func(row map[string]driver.Value, op string) {
+		values := make([]*string, 0, len(table.columns)+len(warehouseMetaColumns))
+		for _, column := range table.columns {
+			values = append(values, stringValue(row[column.Name]))
+		}
+		seq := sink.nextSeq()
+		values = append(values, &op, &timestamp, &seq)
+		table.rows = append(table.rows, values)
+		if sink.rows == 0 {
+			sink.opened = time.Now()
+		}
+		sink.rows++
+	}
+	before, after := rowChanges(data)
+	for i := range after {
+		switch {
+		case after[i] == nil:
+			add(before[i], "delete")
+		default:
+			// 修改了主键时先删除旧主键的行
+			if before[i] != nil && data.OldKey(i) != nil {
+				add(before[i], "delete")
+			}
+			add(after[i], eventType)
+		}
+	}
+	if ack != nil {
+		table.acks = append(table.acks, ack)
+	}
+	if sink.rows >= sink.batchRows {
+		if err := sink.roll(); err != nil {
+			sink.logEntry().WithError(err).Error("load warehouse batch")
+		}
+	}
+	return nil
+}
+
+// 上传所有缓存的行，按顺序载入
+func (sink *warehouseSink) roll() error {
+	for _, table := range sink.tables {
+		if len(table.rows) == 0 {
+			continue
+		}
+		if err := sink.stage(table); err != nil {
+			return err
+		}
+	}
+	return sink.loadPending()
+}
+
+// 将表缓存的行上传为 staging 对象
+func (sink *warehouseSink) stage(table *warehouseTable) error {
+	now := time.Now().UTC()
+	sink.seq++
+	key := fmt.Sprintf("%s/%s.%s/%s-%s-%d.%s", sink.prefix, table.schemaName, table.tableName,
+		sink.node, now.Format("20060102T150405Z"), sink.seq, sink.format)
+	body, err := sink.encode(table)
+	if err != nil {
+		return err
+	}
+	if err := sink.client.Put(key, body); err != nil {
+		return fmt.Errorf("%s: %s", sink.client.URL(key), err)
+	}
+	mode := sink.mode
+	if len(primaryColumns(table.columns)) == 0 {
+		mode = WAREHOUSE_MODE_APPEND
+	}
+	sink.pending = append(sink.pending, &warehouseBatch{
+		schemaName: table.schemaName,
+		tableName:  table.tableName,
+		columns:    table.columns,
+		mode:       mode,
+		format:     sink.format,
+		key:        key,
+		rows:       len(table.rows),
+		acks:       table.acks,
+	})
+	sink.rows -= len(table.rows)
+	table.rows, table.acks = nil, nil
+	return nil
+}
+
+func (sink *warehouseSink) encode(table *warehouseTable) ([]byte, error) {
+	names := make([]string, 0, len(table.columns)+len(warehouseMetaColumns))
+	for _, column := range table.columns {
+		names = append(names, column.Name)
+	}
+	names = append(names, warehouseMetaColumns...)
+	buf := &bytes.Buffer{}
+	if sink.format == WAREHOUSE_FORMAT_PARQUET {
+		writer, err := parquet.NewWriter(buf, names)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range table.rows {
+			if err := writer.Write(row); err != nil {
+				return nil, err
+			}
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	encoder := json.NewEncoder(buf)
+	for _, row := range table.rows {
+		object := make(map[string]*string, len(names))
+		for i, name := range names {
+			object[name] = row[i]
+		}
+		if err := encoder.Encode(object); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// 按顺序载入 staging 对象，一张表载入失败时跳过该表之后的批次
+func (sink *warehouseSink) loadPending() error {
+	failed := make(map[string]error)
+	remaining := sink.pending[:0]
+	for _, batch := range sink.pending {
+		name := batch.schemaName + "." + batch.tableName
+		if _, ok := failed[name]; ok {
+			remaining = append(remaining, batch)
+			continue
+		}
+		if err := sink.load(batch); err != nil {
+			failed[name] = err
+			remaining = append(remaining, batch)
+			continue
+		}
+		for _, ack := range batch.acks {
+			ack()
+		}
+		if err := sink.client.Delete(batch.key); err != nil {
+			sink.logEntry().WithError(err).With(logger.Fields{"key": batch.key}).Warn("delete staging object")
+		}
+	}
+	sink.pending = remaining
+	for name, err := range failed {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+func (sink *warehouseSink) load(batch *warehouseBatch) error {
+	var err error
+	for i := 0; i <= sink.loadRetries; i++ {
+		if i > 0 {
+			sink.logEntry().WithError(err).With(logger.Fields{"key": batch.key, "retry": i}).Warn("load warehouse batch, will retry")
+			time.Sleep(sink.retryInterval)
+		}
+		if err = sink.loader.load(batch); err == nil {
+			sink.logEntry().With(logger.Fields{"key": batch.key, "rows": batch.rows, "mode": batch.mode}).Info("warehouse batch loaded")
+			return nil
+		}
+	}
+	return err
+}
+
+func (sink *warehouseSink) Flush() error {
+	sink.Lock()
+	defer sink.Unlock()
+	return sink.roll()
+}
+
+func (sink *warehouseSink) Close() error {
+	close(sink.quit)
+	return sink.Flush()
+}
+
+// 字段值转为字符串，NULL 为 nil，用于 staging 对象、parquet 文件
+func stringValue(value driver.Value) *string {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case []string:
+		s = strings.Join(v, ",")
+	default:
+		s = fmt.Sprint(v)
+	}
+	return &s
+}
+
+// 仓库的 SQL 方言
+type warehouseDialect struct {
+	quoteName  func(name string) string
+	columnType func(column *mysql.ColumnInfo) string
+	stringType string
+	intType    string
+	safeCast   string // SAFE_CAST/TRY_CAST，转换失败时为 NULL
+}
+
+// 从 staging 表读取并转为目标类型
+func (dialect *warehouseDialect) castValue(alias string, column *mysql.ColumnInfo) string {
+	name := alias + "." + dialect.quoteName(column.Name)
+	columnType := dialect.columnType(column)
+	if columnType == dialect.stringType {
+		return name
+	}
+	return fmt.Sprintf("%s(%s AS %s)", dialect.safeCast, name, columnType)
+}
+
+// 目标表的字段定义，append 模式带 CDC 字段
+func (dialect *warehouseDialect) columnDefinitions(batch *warehouseBatch) []string {
+	definitions := make([]string, 0, len(batch.columns)+len(warehouseMetaColumns))
+	for _, column := range batch.columns {
+		definitions = append(definitions, dialect.quoteName(column.Name)+" "+dialect.columnType(column))
+	}
+	if batch.mode == WAREHOUSE_MODE_APPEND {
+		definitions = append(definitions,
+			dialect.quoteName(WAREHOUSE_OP_COLUMN)+" "+dialect.stringType,
+			dialect.quoteName(WAREHOUSE_TS_COLUMN)+" "+dialect.intType,
+			dialect.quoteName(WAREHOUSE_SEQ_COLUMN)+" "+dialect.intType)
+	}
+	return definitions
+}
+
+// staging 表的字段定义，所有字段为字符串
+func (dialect *warehouseDialect) stageDefinitions(batch *warehouseBatch) []string {
+	definitions := make([]string, 0, len(batch.columns)+len(warehouseMetaColumns))
+	for _, column := range batch.columns {
+		definitions = append(definitions, dialect.quoteName(column.Name)+" "+dialect.stringType)
+	}
+	for _, name := range warehouseMetaColumns {
+		definitions = append(definitions, dialect.quoteName(name)+" "+dialect.stringType)
+	}
+	return definitions
+}
+
+// 从 staging 表写入目标表
+func (dialect *warehouseDialect) loadSQL(batch *warehouseBatch, table string, stage string) string {
+	names := make([]string, 0, len(batch.columns)+len(warehouseMetaColumns))
+	values := make([]string, 0, len(batch.columns)+len(warehouseMetaColumns))
+	for _, column := range batch.columns {
+		names, values = append(names, dialect.quoteName(column.Name)), append(values, dialect.castValue("S", column))
+	}
+	if batch.mode == WAREHOUSE_MODE_APPEND {
+		names = append(names, dialect.quoteName(WAREHOUSE_OP_COLUMN), dialect.quoteName(WAREHOUSE_TS_COLUMN), dialect.quoteName(WAREHOUSE_SEQ_COLUMN))
+		values = append(values, "S."+dialect.quoteName(WAREHOUSE_OP_COLUMN),
+			fmt.Sprintf("CAST(S.%s AS %s)", dialect.quoteName(WAREHOUSE_TS_COLUMN), dialect.intType),
+			fmt.Sprintf("CAST(S.%s AS %s)", dialect.quoteName(WAREHOUSE_SEQ_COLUMN), dialect.intType))
+		return fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s S", table, strings.Join(names, ","), strings.Join(values, ","), stage)
+	}
+
+	keys := primaryColumns(batch.columns)
+	partition := make([]string, 0, len(keys))
+	on := make([]string, 0, len(keys))
+	for _, column := range batch.columns {
+		for _, key := range keys {
+			if column.Name == key {
+				partition = append(partition, dialect.quoteName(key))
+				on = append(on, "T."+dialect.quoteName(key)+"="+dialect.castValue("S", column))
+			}
+		}
+	}
+	sets := make([]string, 0, len(batch.columns))
+	for i := range batch.columns {
+		sets = append(sets, names[i]+"="+values[i])
+	}
+	// 同一主键只保留最后一次变更
+	source := fmt.Sprintf("(SELECT * FROM %s WHERE TRUE QUALIFY ROW_NUMBER() OVER (PARTITION BY %s ORDER BY CAST(%s AS %s) DESC) = 1)",
+		stage, strings.Join(partition, ","), dialect.quoteName(WAREHOUSE_SEQ_COLUMN), dialect.intType)
+	op := "S." + dialect.quoteName(WAREHOUSE_OP_COLUMN)
+	return fmt.Sprintf("MERGE INTO %s T USING %s S ON %s "+
+		"WHEN MATCHED AND %s='delete' THEN DELETE "+
+		"WHEN MATCHED THEN UPDATE SET %s "+
+		"WHEN NOT MATCHED AND %s!='delete' THEN INSERT (%s) VALUES (%s)",
+		table, source, strings.Join(on, " AND "), op, strings.Join(sets, ","), op, strings.Join(names, ","), strings.Join(values, ","))
+}
+
+// 仓库 REST 接口的访问令牌，token_command 的输出缓存 token_ttl
+type warehouseToken struct {
+	sync.Mutex
+	token   string
+	command string
+	ttl     time.Duration
+	expires time.Time
+}
+
+func newWarehouseToken(section config.Section) (*warehouseToken, error) {
+	token := &warehouseToken{token: section.GetString("token", ""), command: section.GetString("token_command", "")}
+	if token.token == "" && token.command == "" {
+		return nil, fmt.Errorf("token or token_command is required")
+	}
+	var err error
+	if token.ttl, err = section.GetDuration("token_ttl", 30*time.Minute); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (token *warehouseToken) get() (string, error) {
+	token.Lock()
+	defer token.Unlock()
+	if token.command == "" || (token.token != "" && time.Now().Before(token.expires)) {
+		return token.token, nil
+	}
+	output, err := exec.Command("sh", "-c", token.command).Output()
+	if err != nil {
+		return "", fmt.Errorf("token_command: %s", err)
+	}
+	token.token, token.expires = strings.TrimSpace(string(output)), time.Now().Add(token.ttl)
+	return token.token, nil
+}
+
+// 发送 json 请求，非 2xx 时返回错误，返回状态码
+func warehouseRequest(client *http.Client, token *warehouseToken, method string, url string, header map[string]string, in interface{}, out interface{}) (int, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	bearer, err := token.get()
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%s %s: %s", resp.Status, url, strings.TrimSpace(string(data)))
+	}
+	if out != nil && len(data) > 0 {
+		return resp.StatusCode, json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,611 @@
+// 多数据源
+// 配置文件中存在 [source.N] 配置组时，每个配置组对应一个独立的 master，
+// 各自拥有独立的解析器、位点文件、表过滤和回调，在同一个进程内同时同步。
+// 不存在 [source.N] 时使用 [Database] 作为唯一的数据源，与单源配置兼容。
+package lib
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/mysql"
+)
+
+// 数据源配置组前缀
+const SOURCE_SECTION_PREFIX = "source."
+
+// 单数据源时使用的配置组
+const DEFAULT_SOURCE_SECTION = "Database"
+
+// 数据源状态
+type SourceStatus struct {
+	Name               string   `json:"name"` // 数据源名称(配置组名)
+	Host               string   `json:"host"`
+	ServerId           uint32   `json:"server_id"`
+	BinlogDumpFileName string   `json:"binlog_file"` // 已同步位点
+	BinlogDumpPosition uint32   `json:"binlog_position"`
+	GTIDSet            string   `json:"gtid_set"`    // 启动时的 GTID 集合
+	ExecutedGTIDSet    string   `json:"executed_gtid_set"` // 已执行的 GTID 集合
+	Delay              int64    `json:"delay"`       // 复制延迟(秒)，当前时间 - 已同步事件的时间
+	LagBytes           uint64   `json:"lag_bytes"`   // 复制延迟(字节)，master 当前位点 - 已同步位点
+	MasterFileName     string   `json:"master_file"` // master 当前位点
+	MasterPosition     uint64   `json:"master_position"`
+	State              string   `json:"state"`         // 同步状态 starting/running/paused/closing/closed
+	ConnErr            string   `json:"conn_err"`      // 最近一次 dump 输出的信息
+	Tables             []string `json:"tables"`        // 需要同步的表
+	FilterTables       []string `json:"filter_tables"` // 屏蔽同步的表
+	Sinks              []string `json:"sinks"`         // 写入的输出
+	SinkPositions      []*SinkProgress `json:"sink_positions"` // 各输出已投递的位点
+	PendingDDL         *PendingDDL     `json:"pending_ddl,omitempty"` // 等待确认的 DDL，见 ddl_pause.go
+	BinlogFormat       *mysql.BinlogFormat `json:"binlog_format,omitempty"` // FORMAT_DESCRIPTION_EVENT 中的版本和解码方式
+}
+
+// 获取配置中的数据源名称
+// 存在 [source.N] 时按 N 排序返回，否则返回 [Database]
+func GetSourceNames(conf map[string]map[string]string) []string {
+	names := sectionNames(conf, SOURCE_SECTION_PREFIX)
+	if len(names) == 0 {
+		return []string{DEFAULT_SOURCE_SECTION}
+	}
+	return names
+}
+
+// 以 prefix 开头的配置组，按后缀数字排序，非数字按字符串排序
+func sectionNames(conf map[string]map[string]string, prefix string) []string {
+	names := make([]string, 0)
+	for section := range conf {
+		if strings.HasPrefix(section, prefix) {
+			names = append(names, section)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, errA := strconv.Atoi(strings.TrimPrefix(names[i], prefix))
+		b, errB := strconv.Atoi(strings.TrimPrefix(names[j], prefix))
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// 根据数据源配置组生成 DumpConfig
+func NewDumpConfig(conf map[string]map[string]string, name string, source map[string]string) (*DumpConfig, error) {
+	if source == nil {
+		return nil, fmt.Errorf("config section [%s] not found", name)
+	}
+	server_id, err := config.Section(source).GetInt("server_id", 0)
+	if err != nil || server_id <= 0 || server_id > math.MaxUint32 {
+		return nil, fmt.Errorf("config [%s] server_id error: %q", name, source["server_id"])
+	}
+	dsn, err := newDSN(source)
+	if err != nil {
+		return nil, fmt.Errorf("config [%s] %s", name, err)
+	}
+	connectUri := dsn.String()
+	candidates, err := newCandidates(dsn, config.Section(source).GetStringSlice("masters", nil))
+	if err != nil {
+		return nil, fmt.Errorf("config [%s] %s", name, err)
+	}
+
+	dumpConfig := &DumpConfig{
+		Name:               name,
+		Source:             source,
+		ClusterName:        conf["Bubod"]["cluster_name"],
+		NodeName:           conf["Bubod"]["node_name"],
+		ConnectUri:         connectUri,
+		Candidates:         candidates,
+		ServerId:           uint32(server_id),
+		TableMap:           newTableMap(source["tables"]),
+		FilterTableMap:     newTableMap(source["filter_tables"]),
+		BinlogDumpFileName: "",
+		BinlogDumpPosition: 0,
+		PosFile:            conf["Bubod"]["bubod_dump_pos"],
+		DlqFile:            conf["Bubod"]["bubod_dlq"],
+		Conf:               conf,
+		ElectionManager:    Election,
+	}
+	if err := dumpConfig.checkConf(); err != nil {
+		return nil, fmt.Errorf("config [%s] %s", name, err)
+	}
+	dumpConfig.tableStats = newTableStats(name)
+	dumpConfig.delivered = &mysql.DeliveredPosition{}
+	dumpConfig.sinkProgress = newSinkProgress()
+	dumpConfig.ddlPause = &ddlPause{}
+	dumpConfig.debug, _ = config.Section(conf["Bubod"]).GetBool("debug", false)
+	if dumpConfig.Sinks, err = resolveSinks(config.Section(source).GetStringSlice("sinks", nil)); err != nil {
+		return nil, fmt.Errorf("config [%s] %s", name, err)
+	}
+
+	// 多数据源时各自使用独立的节点名称、位点文件和死信文件
+	if name != DEFAULT_SOURCE_SECTION {
+		dataDir := conf["Bubod"]["data_dir"]
+		dumpConfig.NodeName = fmt.Sprintf("bubod-%s-node-%s-%s", dumpConfig.ClusterName, source["server_id"], name)
+		dumpConfig.PosFile = dataDir + "/filepos-" + dumpConfig.NodeName + ".bubod"
+		dumpConfig.DlqFile = dataDir + "/dlq-" + dumpConfig.NodeName + ".bubod"
+	}
+	dumpConfig.GTIDFile = conf["Bubod"]["data_dir"] + "/gtid-" + dumpConfig.NodeName + ".bubod"
+	if dumpConfig.objectCheckpoint, err = newObjectCheckpoint(conf, dumpConfig.NodeName); err != nil {
+		return nil, fmt.Errorf("config [%s] %s", name, err)
+	}
+	if dumpConfig.checkpoints, err = newCheckpointHistory(conf, dumpConfig.NodeName); err != nil {
+		return nil, fmt.Errorf("config [%s] %s", name, err)
+	}
+	if sinkName := source["recover_from_sink"]; sinkName != "" {
+		if dumpConfig.recoverSink, err = resolveRecoverSink(dumpConfig.Sinks, sinkName); err != nil {
+			return nil, fmt.Errorf("config [%s] %s", name, err)
+		}
+	}
+	if dumpConfig.checkpointQuorum = dumpConfig.GetSourceVal("checkpoint_quorum"); dumpConfig.checkpointQuorum == "" {
+		dumpConfig.checkpointQuorum = CHECKPOINT_QUORUM_NEWEST
+		if dumpConfig.recoverSink != nil {
+			dumpConfig.checkpointQuorum = CHECKPOINT_QUORUM_SINK
+		}
+	}
+	if dumpConfig.computedFields, err = parseComputedFields(dumpConfig.GetSourceVal("computed_fields")); err != nil {
+		return nil, fmt.Errorf("config [%s] %s", name, err)
+	}
+	if path := dumpConfig.GetSourceVal("schema_snapshot"); path != "" {
+		if dumpConfig.importSchema, err = mysql.ReadSchemaSnapshot(path); err != nil {
+			return nil, fmt.Errorf("config [%s] %s", name, err)
+		}
+	}
+	if err := checkCheckpointQuorum(dumpConfig.checkpointQuorum); err != nil {
+		return nil, fmt.Errorf("config [%s] %s", name, err)
+	}
+	if dumpConfig.checkpointQuorum == CHECKPOINT_QUORUM_SINK && dumpConfig.recoverSink == nil {
+		return nil, fmt.Errorf("config [%s] checkpoint_quorum=sink requires recover_from_sink", name)
+	}
+	return dumpConfig, nil
+}
+
+// 数据源配置项，未配置时使用 [Bubod] 中的同名配置
+func (dumpConfig *DumpConfig) GetSourceVal(key string) string {
+	if val, ok := dumpConfig.Source[key]; ok && val != "" {
+		return val
+	}
+	return dumpConfig.Conf["Bubod"][key]
+}
+
+// 数据源连接参数
+// 配置了 dsn 时直接使用，否则由 host/port/user/pass/db/socket/charset/tls/timeout/read_timeout/write_timeout 生成
+func newDSN(source map[string]string) (*mysql.DSN, error) {
+	section := config.Section(source)
+	if dsn := section.GetString("dsn", ""); dsn != "" {
+		d, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		if err = setCredential(section, d); err != nil {
+			return nil, err
+		}
+		return d, d.Validate()
+	}
+	port, err := section.GetInt("port", mysql.DEFAULT_PORT)
+	if err != nil {
+		return nil, err
+	}
+	d := &mysql.DSN{
+		User:     source["user"],
+		Password: source["pass"],
+		Host:     section.GetString("host", mysql.DEFAULT_HOST),
+		Port:     int(port),
+		Socket:   source["socket"],
+		DBName:   source["db"],
+		Charset:  source["charset"],
+		Params:   make(map[string]string),
+	}
+	switch d.TLS = source["tls"]; d.TLS {
+	case "", "true", "false", "skip-verify":
+	default:
+		return nil, fmt.Errorf("invalid tls %q", d.TLS)
+	}
+	if d.Timeout, err = section.GetDuration("timeout", 0); err != nil {
+		return nil, err
+	}
+	if d.ReadTimeout, err = section.GetDuration("read_timeout", 0); err != nil {
+		return nil, err
+	}
+	if d.WriteTimeout, err = section.GetDuration("write_timeout", 0); err != nil {
+		return nil, err
+	}
+	if d.TCPKeepalive, err = section.GetDuration("tcp_keepalive", 0); err != nil {
+		return nil, err
+	}
+	if d.Proxy, err = section.GetBool("proxy", false); err != nil {
+		return nil, err
+	}
+	if d.RDS, err = section.GetBool("rds", false); err != nil {
+		return nil, err
+	}
+	if attrs := section.GetStringSlice("connection_attributes", nil); len(attrs) > 0 {
+		if d.ConnAttrs, err = mysql.ParseConnAttrs(strings.Join(attrs, ",")); err != nil {
+			return nil, err
+		}
+	}
+	// 会话超时(秒)，dump 连接和查询表结构等元数据连接均在建立连接后设置
+	for _, key := range []string{"wait_timeout", "net_read_timeout", "net_write_timeout"} {
+		if source[key] == "" {
+			continue
+		}
+		if val, err := section.GetInt(key, 0); err != nil || val <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", key, source[key])
+		}
+		d.Params[key] = source[key]
+	}
+	if err = setCredential(section, d); err != nil {
+		return nil, err
+	}
+	return d, d.Validate()
+}
+
+// 外部凭据: auth=password(默认)/rds_iam/cloudsql_iam/command
+// 凭据提供者按认证方式、账号和地址注册，DSN 中以 credentialProvider 引用
+func setCredential(section config.Section, d *mysql.DSN) error {
+	var provider mysql.CredentialProvider
+	_, addr := d.Addr()
+	auth := section.GetString("auth", "password")
+	switch auth {
+	case "password":
+		return nil
+	case "rds_iam":
+		provider = &mysql.RDSIAMProvider{Region: section.GetString("auth_region", ""), Addr: addr, User: d.User}
+	case "cloudsql_iam":
+		provider = &mysql.CloudSQLIAMProvider{ServiceAccount: section.GetString("auth_service_account", "")}
+	case "command":
+		command := section.GetString("auth_command", "")
+		if command == "" {
+			return fmt.Errorf("auth_command is required when auth=command")
+		}
+		ttl, err := section.GetDuration("auth_ttl", 0)
+		if err != nil {
+			return err
+		}
+		provider = &mysql.CommandProvider{Command: command, TTL: ttl}
+	default:
+		return fmt.Errorf("invalid auth %q", auth)
+	}
+	name := auth + ":" + d.User + "@" + addr
+	mysql.RegisterCredentialProvider(name, provider)
+	d.Credential = name
+	return nil
+}
+
+// 候选 master，masters=host1:3306,host2:3306，使用数据源相同的账号和连接参数
+func newCandidates(dsn *mysql.DSN, masters []string) ([]string, error) {
+	candidates := make([]string, 0, len(masters))
+	for _, master := range masters {
+		host, port, err := net.SplitHostPort(master)
+		if err != nil {
+			// 未指定端口
+			host, port = master, ""
+		}
+		d := *dsn
+		d.Host, d.Port, d.Socket = host, 0, ""
+		if port != "" {
+			if d.Port, err = strconv.Atoi(port); err != nil || d.Port <= 0 || d.Port > 65535 {
+				return nil, fmt.Errorf("invalid port in masters: %q", master)
+			}
+		}
+		candidates = append(candidates, d.String())
+	}
+	return candidates, nil
+}
+
+// 数据源配置，未配置的项使用 [Bubod] 中的同名配置
+func (dumpConfig *DumpConfig) sourceConf() config.Section {
+	section := make(config.Section, len(dumpConfig.Conf["Bubod"])+len(dumpConfig.Source))
+	for key, val := range dumpConfig.Conf["Bubod"] {
+		section[key] = val
+	}
+	for key, val := range dumpConfig.Source {
+		if val != "" {
+			section[key] = val
+		}
+	}
+	return section
+}
+
+// 检查数值类配置，格式错误时不启动，避免拼写错误被当作未配置
+func (dumpConfig *DumpConfig) checkConf() error {
+	section := dumpConfig.sourceConf()
+	for _, key := range []string{"lag_alert_delay", "lag_alert_bytes", "pipeline_depth", "max_txn_rows", "max_txn_bytes", "txn_alert_rows", "txn_alert_bytes"} {
+		if _, err := section.GetInt(key, 0); err != nil {
+			return err
+		}
+	}
+	for _, key := range []string{"lag_check_interval", "dump_session_timeout", "heartbeat_period", "purge_check_interval", "purge_alert_margin", "binlog_retention", "dedup_window", "txn_alert_duration"} {
+		if _, err := section.GetDuration(key, 0); err != nil {
+			return err
+		}
+	}
+	if _, err := config.Section(dumpConfig.Source).GetBool("binlog_dump_force", false); err != nil {
+		return err
+	}
+	switch policy := dumpConfig.Source["invalid_position_policy"]; policy {
+	case "", mysql.POSITION_INVALID_FAIL, mysql.POSITION_INVALID_REWIND, mysql.POSITION_INVALID_CURRENT:
+	default:
+		return fmt.Errorf("invalid invalid_position_policy %q, must be fail, rewind or current", policy)
+	}
+	switch policy := section.GetString("large_txn_policy", mysql.TXN_POLICY_STREAM); policy {
+	case mysql.TXN_POLICY_STREAM, mysql.TXN_POLICY_SKIP, mysql.TXN_POLICY_FAIL:
+	default:
+		return fmt.Errorf("invalid large_txn_policy %q, must be stream, skip or fail", policy)
+	}
+	switch val := section.GetString("lower_case_table_names", LOWER_CASE_AUTO); val {
+	case LOWER_CASE_AUTO, "0", "1", "2":
+	default:
+		return fmt.Errorf("invalid lower_case_table_names %q, must be auto, 0, 1 or 2", val)
+	}
+	for _, db := range section.GetStringSlice("databases", nil) {
+		if err := mysql.ValidateNamePattern(db); err != nil {
+			return err
+		}
+	}
+	if _, err := mysql.ParseEventTypes(section.GetStringSlice("events", nil)); err != nil {
+		return err
+	}
+	for _, key := range []string{"tables", "filter_tables"} {
+		if err := validateTableNames(dumpConfig.Source[key]); err != nil {
+			return err
+		}
+	}
+	for _, key := range []string{"preflight", "replica", "gtid_checkpoint", "preload_schema", "ddl_pause"} {
+		if _, err := section.GetBool(key, true); err != nil {
+			return err
+		}
+	}
+	if _, err := config.Section(dumpConfig.Conf["Bubod"]).GetBool("debug", false); err != nil {
+		return err
+	}
+	switch format := section.GetString("row_format", mysql.ROW_FORMAT_MAP); format {
+	case mysql.ROW_FORMAT_MAP, mysql.ROW_FORMAT_SLICE:
+	default:
+		return fmt.Errorf("invalid row_format %q, must be map or slice", format)
+	}
+	if _, err := dumpConfig.stopCondition(); err != nil {
+		return err
+	}
+	if _, err := dumpConfig.datetime("start_datetime"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 时间配置 2006-01-02 15:04:05，本地时区，未配置时返回零值
+func (dumpConfig *DumpConfig) datetime(key string) (time.Time, error) {
+	val := dumpConfig.sourceConf().GetString(key, "")
+	if val == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", val, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q, must be 2006-01-02 15:04:05", key, val)
+	}
+	return t, nil
+}
+
+// 有界回放的结束条件 stop_position/stop_datetime/stop_gtid_set，均未配置时返回 nil
+func (dumpConfig *DumpConfig) stopCondition() (*mysql.StopCondition, error) {
+	section := dumpConfig.sourceConf()
+	stop := &mysql.StopCondition{GTIDSet: section.GetString("stop_gtid_set", "")}
+	if filePos := section.GetString("stop_position", ""); filePos != "" {
+		i := strings.LastIndexByte(filePos, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid stop_position %q, must be filename:position", filePos)
+		}
+		pos, err := strconv.ParseUint(filePos[i+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop_position %q, must be filename:position", filePos)
+		}
+		stop.BinlogFileName, stop.BinlogPosition = filePos[0:i], uint32(pos)
+	}
+	t, err := dumpConfig.datetime("stop_datetime")
+	if err != nil {
+		return nil, err
+	}
+	stop.Time = t
+	if stop.BinlogFileName == "" && stop.GTIDSet == "" && stop.Time.IsZero() {
+		return nil, nil
+	}
+	if err := stop.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid stop_gtid_set: %s", err)
+	}
+	return stop, nil
+}
+
+// replica=true 时从只读的从库 dump，需要 log_slave_updates=ON 和 gtid_mode=ON
+func (dumpConfig *DumpConfig) replica() bool {
+	replica, _ := config.Section(dumpConfig.Source).GetBool("replica", false)
+	return replica
+}
+
+// 保存已执行的 GTID 集合，重启或切换到其他实例后按 GTID 续传，replica 模式下默认开启
+func (dumpConfig *DumpConfig) gtidCheckpoint() bool {
+	enabled, _ := config.Section(dumpConfig.Source).GetBool("gtid_checkpoint", dumpConfig.replica())
+	return enabled
+}
+
+// 启动前检查 master 复制条件，preflight=false 时跳过
+// 检查项不满足时返回错误，master 暂时无法连接时只记录日志，由 dump 重连
+func (dumpConfig *DumpConfig) preflight() error {
+	if ok, _ := dumpConfig.sourceConf().GetBool("preflight", true); !ok {
+		return nil
+	}
+	err := mysql.Preflight(dumpConfig.ConnectUri, &mysql.PreflightOptions{
+		GTID:    dumpConfig.GTIDSet != "",
+		Replica: dumpConfig.replica(),
+	})
+	if _, ok := err.(*mysql.PreflightError); ok {
+		return fmt.Errorf("instance %s %s", dumpConfig.Name, err)
+	}
+	if err != nil {
+		dumpConfig.logEntry().WithError(err).Warn("preflight check skipped")
+	}
+	return nil
+}
+
+// lower_case_table_names 配置为 auto 时按 master 的设置
+const LOWER_CASE_AUTO = "auto"
+
+// 按 lower_case_table_names 确定库名、表名匹配是否区分大小写
+// auto 时查询 master，master 暂时无法连接时沿用上次的结果(首次为区分大小写)，由下次启动重新确定
+func (dumpConfig *DumpConfig) resolveLowerCase() {
+	val := dumpConfig.sourceConf().GetString("lower_case_table_names", LOWER_CASE_AUTO)
+	if val == LOWER_CASE_AUTO {
+		n, err := mysql.LowerCaseTableNames(dumpConfig.ConnectUri)
+		if err != nil {
+			dumpConfig.logEntry().WithError(err).Warn("query lower_case_table_names")
+			return
+		}
+		val = strconv.Itoa(n)
+	}
+	dumpConfig.filterLock.Lock()
+	dumpConfig.ignoreCase = val != "0"
+	dumpConfig.filterLock.Unlock()
+}
+
+// 库名、表名匹配是否不区分大小写
+func (dumpConfig *DumpConfig) IgnoreCase() bool {
+	dumpConfig.filterLock.RLock()
+	defer dumpConfig.filterLock.RUnlock()
+	return dumpConfig.ignoreCase
+}
+
+// databases 配置转为 BinlogDump.ReplicateDoDb，未配置时同步所有库
+func (dumpConfig *DumpConfig) replicateDoDb() map[string]uint8 {
+	doDb := make(map[string]uint8, 0)
+	for _, db := range dumpConfig.sourceConf().GetStringSlice("databases", nil) {
+		doDb[db] = 1
+	}
+	return doDb
+}
+
+// init_sql 配置的语句，以分号分隔
+func (dumpConfig *DumpConfig) initSQL() []string {
+	statements := make([]string, 0)
+	for _, sql := range strings.Split(dumpConfig.sourceConf().GetString("init_sql", ""), ";") {
+		if sql = strings.TrimSpace(sql); sql != "" {
+			statements = append(statements, sql)
+		}
+	}
+	return statements
+}
+
+// events 配置转为 BinlogDump.OnlyEvent，未配置时为 rows,ddl
+func (dumpConfig *DumpConfig) onlyEvent() []mysql.EventType {
+	// 已在 checkConf 中检查
+	events, _ := mysql.ParseEventTypes(dumpConfig.sourceConf().GetStringSlice("events", []string{"rows", "ddl"}))
+	return events
+}
+
+// 检查 tables/filter_tables 中的通配符
+func validateTableNames(tables string) error {
+	for name := range newTableMap(tables) {
+		if err := mysql.ValidateNamePattern(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tables 配置 db.table,table 转为 TableMap，库名、表名可以使用通配符，如 db.log_*、*.tmp
+func newTableMap(tables string) map[string]*Table {
+	tableMap := make(map[string]*Table, 0)
+	for _, name := range strings.Split(tables, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		tableMap[name] = &Table{Name: name, SyncStatus: true}
+	}
+	return tableMap
+}
+
+// 含 . 的配置按 db.table 匹配，否则只匹配表名
+func matchTable(tableMap map[string]*Table, schemaName string, tableName string, ignoreCase bool) bool {
+	if _, ok := tableMap[schemaName+"."+tableName]; ok {
+		return true
+	}
+	if _, ok := tableMap[tableName]; ok {
+		return true
+	}
+	for name := range tableMap {
+		if strings.IndexByte(name, '.') >= 0 {
+			if mysql.MatchName(name, schemaName+"."+tableName, ignoreCase) {
+				return true
+			}
+		} else if mysql.MatchName(name, tableName, ignoreCase) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否需要同步该表
+// 配置了 tables 时只同步其中的表，filter_tables 中的表不同步
+func (dumpConfig *DumpConfig) IsSyncTable(schemaName string, tableName string) bool {
+	if tableName == "" {
+		return true
+	}
+	dumpConfig.filterLock.RLock()
+	defer dumpConfig.filterLock.RUnlock()
+	if len(dumpConfig.TableMap) > 0 && !matchTable(dumpConfig.TableMap, schemaName, tableName, dumpConfig.ignoreCase) {
+		return false
+	}
+	return !matchTable(dumpConfig.FilterTableMap, schemaName, tableName, dumpConfig.ignoreCase)
+}
+
+// 修改表过滤，格式同 tables/filter_tables 配置
+func (dumpConfig *DumpConfig) SetFilter(tables string, filterTables string) error {
+	for _, names := range []string{tables, filterTables} {
+		if err := validateTableNames(names); err != nil {
+			return err
+		}
+	}
+	tableMap := newTableMap(tables)
+	filterTableMap := newTableMap(filterTables)
+	dumpConfig.filterLock.Lock()
+	dumpConfig.TableMap = tableMap
+	dumpConfig.FilterTableMap = filterTableMap
+	dumpConfig.filterLock.Unlock()
+	return nil
+}
+
+// 当前表过滤
+func (dumpConfig *DumpConfig) GetFilter() ([]string, []string) {
+	dumpConfig.filterLock.RLock()
+	defer dumpConfig.filterLock.RUnlock()
+	return tableNames(dumpConfig.TableMap), tableNames(dumpConfig.FilterTableMap)
+}
+
+func tableNames(tableMap map[string]*Table) []string {
+	names := make([]string, 0, len(tableMap))
+	for name := range tableMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 输出所有数据源的状态
+func logSources() {
+	for _, status := range Instances.List() {
+		logger.With(logger.Fields{
+			"instance":    status.Name,
+			"host":        status.Host,
+			"server_id":   status.ServerId,
+			"state":       status.State,
+			"binlog_file": status.BinlogDumpFileName,
+			"binlog_pos":  status.BinlogDumpPosition,
+			"conn_err":    status.ConnErr,
+		}).Info("source status")
+	}
+}
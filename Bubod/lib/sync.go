@@ -3,20 +3,116 @@ package lib
 import(
 	"os"
 	"io"
-	"log"
+	"io/ioutil"
+	"bubod/Bubod/logger"
 	"fmt"
 	"time"
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
 )
 
-// 每秒同步一次 file.pos
-func (dumpConfig *DumpConfig) InstantSync() {
+// 每秒同步一次 file.pos，quit 关闭时保存最后的位点并退出
+func (dumpConfig *DumpConfig) InstantSync(quit <-chan struct{}) {
 	for {
-		newPos := fmt.Sprintf("%s:%d", dumpConfig.BinlogDumpFileName, dumpConfig.BinlogDumpPosition)
-		if newPos != dumpConfig.SyncPos {
-			dumpConfig.SyncBinlogFilenamePos(newPos)
+		newPos := dumpConfig.syncLastPos()
+		dumpConfig.logEntry().Debug("sync position", newPos)
+		select {
+		case <-quit:
+			dumpConfig.syncLastPos()
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+func (dumpConfig *DumpConfig) syncLastPos() string {
+	dumpConfig.syncLock.Lock()
+	defer dumpConfig.syncLock.Unlock()
+	// 所有输出已投递的位点，见 sink_progress.go
+	file, position, timestamp, delivered := dumpConfig.sinkProgress.checkpoint(dumpConfig.BinlogDumpFileName, dumpConfig.BinlogDumpPosition, dumpConfig.BinlogDumpTimestamp)
+	dumpConfig.updateSinkMetrics()
+	newPos := fmt.Sprintf("%s:%d", file, position)
+	if dumpConfig.BinlogDumpTimestamp > dumpConfig.SyncTimestamp && dumpConfig.SyncTimestamp > 0 {
+		metrics.CheckpointLag.Set(float64(dumpConfig.BinlogDumpTimestamp-dumpConfig.SyncTimestamp), dumpConfig.Name)
+	} else {
+		metrics.CheckpointLag.Set(0, dumpConfig.Name)
+	}
+	if newPos != dumpConfig.SyncPos && dumpConfig.positionAdvances(file, position) {
+		if dumpConfig.SyncBinlogFilenamePos(newPos) == nil {
+			dumpConfig.SyncPos = newPos
+			if timestamp > 0 {
+				dumpConfig.SyncTimestamp = timestamp
+			}
+			dumpConfig.recordCheckpoint(file, position, timestamp)
+		}
+	}
+	if delivered {
+		dumpConfig.syncGTID()
+	}
+	dumpConfig.flushObjectCheckpoint(false)
+	return newPos
+}
+
+// 新位点是否不早于已保存的位点，早于时不保存，见 mysql/checkpoint.go
+// 已保存的位点为空(首次保存、master 切换后)时不检查
+func (dumpConfig *DumpConfig) positionAdvances(file string, position uint32) bool {
+	saved, err := mysql.ParseBinlogPosition(dumpConfig.SyncPos)
+	if err != nil || mysql.PositionAdvances(saved.File, saved.Pos, file, position) {
+		return true
+	}
+	metrics.CheckpointRewinds.Inc(dumpConfig.Name, "position")
+	dumpConfig.logEntry().With(logger.Fields{"saved": dumpConfig.SyncPos}).Warn("position is behind the saved checkpoint, skip saving")
+	return false
+}
+
+// 保存已执行的 GTID 集合，集合不完整时不保存
+// 切换到从库或其他 master 后文件位点不再适用，按 GTID 续传不会重复投递
+func (dumpConfig *DumpConfig) syncGTID() {
+	binlogDump := dumpConfig.binlogDump
+	if binlogDump == nil || !dumpConfig.gtidCheckpoint() {
+		return
+	}
+	gtidSet, ok := binlogDump.ExecutedGTIDSet()
+	if !ok || gtidSet == "" || gtidSet == dumpConfig.syncGTIDSet {
+		return
+	}
+	// 已执行的集合不包含已保存的集合时不保存
+	if advances, err := mysql.GTIDSetAdvances(dumpConfig.syncGTIDSet, gtidSet); err != nil || !advances {
+		metrics.CheckpointRewinds.Inc(dumpConfig.Name, "gtid")
+		dumpConfig.logEntry().With(logger.Fields{"saved": dumpConfig.syncGTIDSet, "executed": gtidSet}).WithError(err).Warn("gtid set does not contain the saved checkpoint, skip saving")
+		return
+	}
+	if err := dumpConfig.writeGTIDCheckpoint(gtidSet); err != nil {
+		dumpConfig.logEntry().With(logger.Fields{"file": dumpConfig.GTIDFile}).WithError(err).Error("write gtid file")
+	}
+}
+
+// 写入 GTID 集合文件，先写临时文件再改名，避免写入一半时退出
+func (dumpConfig *DumpConfig) writeGTIDCheckpoint(gtidSet string) error {
+	tmp := dumpConfig.GTIDFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(gtidSet), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dumpConfig.GTIDFile); err != nil {
+		return err
+	}
+	dumpConfig.syncGTIDSet = gtidSet
+	if dumpConfig.objectCheckpoint != nil {
+		dumpConfig.objectCheckpoint.save(OBJECT_CHECKPOINT_GTID, gtidSet)
+	}
+	return nil
+}
+
+// 删除已保存的 GTID 集合
+func (dumpConfig *DumpConfig) removeGTIDCheckpoint() {
+	dumpConfig.syncGTIDSet = ""
+	if err := os.Remove(dumpConfig.GTIDFile); err != nil && !os.IsNotExist(err) {
+		dumpConfig.logEntry().With(logger.Fields{"file": dumpConfig.GTIDFile}).WithError(err).Error("remove gtid file")
+	}
+	if checkpoint := dumpConfig.objectCheckpoint; checkpoint != nil {
+		if err := checkpoint.remove(OBJECT_CHECKPOINT_GTID); err != nil {
+			dumpConfig.logEntry().WithError(err).Error("remove gtid checkpoint from object storage")
 		}
-		log.Println("=============:",newPos)
-		time.Sleep(1 * time.Second)
 	}
 }
 
@@ -27,22 +123,29 @@ func (dumpConfig *DumpConfig) SyncBinlogFilenamePos(fileNamePos string) error {
 		return fmt.Errorf("[error] SyncBinlogFilenamePos Invalid fileNamePos error %s", fileNamePos)
 	}
 	//打开本地文件并写入
-	bubod_dump_pos := dumpConfig.Conf["Bubod"]["bubod_dump_pos"]
+	bubod_dump_pos := dumpConfig.PosFile
 	f, err := os.OpenFile(bubod_dump_pos, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0777) //打开文件
 	if err !=nil {
-		log.Println("[error] Write bubod_dump_pos OpenFile error:", bubod_dump_pos, "; Error:",err)
+		dumpConfig.logEntry().With(logger.Fields{"file": bubod_dump_pos}).WithError(err).Error("open position file")
 		return err
 	}else{
 		_, err := io.WriteString(f, fileNamePos)
 		if err !=nil {
-			log.Println("[error] Write bubod_dump_pos WriteString err:", bubod_dump_pos, "; Error:",err)
+			dumpConfig.logEntry().With(logger.Fields{"file": bubod_dump_pos}).WithError(err).Error("write position file")
 			return err
 		}
 	}	
 	defer f.Close()
-	//同步到zk
-	if (dumpConfig.Conf["Zookeeper"]["server"] != ""){
-		dumpConfig.ElectionManager.SetData(fileNamePos)
+	//同步到选举后端
+	// 写入失败时本地文件已保存，启动时按 checkpoint_quorum 处理不一致
+	if dumpConfig.ElectionManager != nil {
+		if err := dumpConfig.ElectionManager.SetData(dumpConfig.Name, fileNamePos); err != nil {
+			dumpConfig.logEntry().WithError(err).Warn("save position to election backend")
+		}
+	}
+	//同步到对象存储，按 checkpoint_interval 上传
+	if dumpConfig.objectCheckpoint != nil {
+		dumpConfig.objectCheckpoint.save(OBJECT_CHECKPOINT_POSITION, fileNamePos)
 	}
 	return nil
 }
\ No newline at end of file
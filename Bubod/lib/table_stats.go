@@ -0,0 +1,158 @@
+// 按表统计
+// 统计实例创建以来每张表写入输出的事件数、行数和 binlog 字节数，按 insert/update/delete/ddl 分别计数，
+// 以及最近 1m/5m/15m 的滑动窗口，用于找出占同步流量主要部分的表。
+// 通过管理接口 /instances/{name}/tables 和 bubod_table_rows_total/bubod_table_bytes_total 指标查看。
+// 滑动窗口按 10 秒分桶，精度为 10 秒。
+package lib
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/mysql"
+)
+
+const (
+	TABLE_STATS_BUCKET  = 10 * time.Second
+	TABLE_STATS_BUCKETS = 90 // 15 分钟
+)
+
+// 滑动窗口
+var tableStatsWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+// 计数
+type OpStats struct {
+	Events int64 `json:"events"`
+	Rows   int64 `json:"rows"`  // 行变更数，update 的变更前、变更后为一行
+	Bytes  int64 `json:"bytes"` // binlog 事件字节数
+}
+
+func (stats *OpStats) add(other OpStats) {
+	stats.Events += other.Events
+	stats.Rows += other.Rows
+	stats.Bytes += other.Bytes
+}
+
+// 一张表的统计
+type TableStats struct {
+	Table   string              `json:"table"` // db.table
+	Total   OpStats             `json:"total"`
+	Ops     map[string]*OpStats `json:"ops"`     // insert/update/delete/ddl
+	Windows map[string]OpStats  `json:"windows"` // 1m/5m/15m
+}
+
+type tableCounter struct {
+	total   OpStats
+	ops     map[string]*OpStats
+	buckets [TABLE_STATS_BUCKETS]OpStats
+	slots   [TABLE_STATS_BUCKETS]int64 // 桶对应的时间序号，不是当前序号时为过期的桶
+}
+
+// 实例的按表统计
+type TableStatsReport struct {
+	Since  time.Time     `json:"since"` // 开始统计的时间
+	Tables []*TableStats `json:"tables"`
+}
+
+// 实例的按表统计，并发安全
+type tableStats struct {
+	sync.Mutex
+	source string
+	since  time.Time
+	tables map[string]*tableCounter
+}
+
+func newTableStats(source string) *tableStats {
+	return &tableStats{source: source, since: time.Now(), tables: make(map[string]*tableCounter)}
+}
+
+// 事件的操作类型
+func eventOp(data *mysql.EventReslut) string {
+	if data.DDL != nil {
+		return "ddl"
+	}
+	return mysql.EvenTypeName(data.Header.EventType)
+}
+
+// 记录一个写入输出的事件
+func (stats *tableStats) add(schemaName string, tableName string, data *mysql.EventReslut, now time.Time) {
+	op := eventOp(data)
+	delta := OpStats{Events: 1, Bytes: int64(data.Header.EventSize)}
+	if data.DDL == nil {
+		delta.Rows = int64(data.ChangeCount())
+	}
+	metrics.TableRows.Add(float64(delta.Rows), stats.source, schemaName, tableName, op)
+	metrics.TableBytes.Add(float64(delta.Bytes), stats.source, schemaName, tableName, op)
+
+	name := schemaName + "." + tableName
+	slot := now.UnixNano() / int64(TABLE_STATS_BUCKET)
+	stats.Lock()
+	defer stats.Unlock()
+	counter, ok := stats.tables[name]
+	if !ok {
+		counter = &tableCounter{ops: make(map[string]*OpStats)}
+		stats.tables[name] = counter
+	}
+	counter.total.add(delta)
+	if counter.ops[op] == nil {
+		counter.ops[op] = &OpStats{}
+	}
+	counter.ops[op].add(delta)
+	i := slot % TABLE_STATS_BUCKETS
+	if counter.slots[i] != slot {
+		counter.slots[i], counter.buckets[i] = slot, OpStats{}
+	}
+	counter.buckets[i].add(delta)
+}
+
+// 所有表的统计，按字节数从大到小排序，limit 大于 0 时只返回前 limit 张表
+func (stats *tableStats) report(now time.Time, limit int) *TableStatsReport {
+	slot := now.UnixNano() / int64(TABLE_STATS_BUCKET)
+	stats.Lock()
+	list := make([]*TableStats, 0, len(stats.tables))
+	for name, counter := range stats.tables {
+		table := &TableStats{
+			Table:   name,
+			Total:   counter.total,
+			Ops:     make(map[string]*OpStats, len(counter.ops)),
+			Windows: make(map[string]OpStats, len(tableStatsWindows)),
+		}
+		for op, opStats := range counter.ops {
+			copied := *opStats
+			table.Ops[op] = &copied
+		}
+		for _, window := range tableStatsWindows {
+			n := int64(window.duration / TABLE_STATS_BUCKET)
+			windowStats := OpStats{}
+			for i := range counter.slots {
+				if counter.slots[i] > slot-n && counter.slots[i] <= slot {
+					windowStats.add(counter.buckets[i])
+				}
+			}
+			table.Windows[window.name] = windowStats
+		}
+		list = append(list, table)
+	}
+	since := stats.since
+	stats.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Total.Bytes != list[j].Total.Bytes {
+			return list[i].Total.Bytes > list[j].Total.Bytes
+		}
+		return list[i].Table < list[j].Table
+	})
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return &TableStatsReport{Since: since, Tables: list}
+}
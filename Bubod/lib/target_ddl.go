@@ -0,0 +1,460 @@
+// 目标库 DDL 生成
+// applier 输出按表结构缓存生成目标库的 CREATE TABLE/ALTER TABLE，目标库为 mysql/postgres/clickhouse/sqlite:
+//
+//   - 首次写入某张表时，目标库没有该表则按源表结构建表，已有时补齐缺少的字段
+//   - 表结构版本变化(源库执行了 DDL)后，按新旧字段的差异生成 ALTER TABLE: 新增字段、修改类型和是否允许 NULL，
+//     drop_columns=true 时删除源表已删除的字段；字段重命名表现为删除旧字段、新增新字段
+//   - RENAME TABLE 同步重命名目标表，DROP TABLE 只在 drop_tables=true 时执行
+//
+// 字段类型按源表的 COLUMN_TYPE 转换，postgres/clickhouse 没有对应类型时使用文本类型。
+// clickhouse 使用 ReplacingMergeTree(_version)，按主键排序，删除写入 _is_deleted=1 的行。
+// sqlite 每个库为一个附加的数据库文件(见 sink_sqlite.go)，字段类型按类型亲和性转换，不修改已有字段的类型。
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"bubod/Bubod/mysql"
+)
+
+// 目标库类型
+const (
+	TARGET_MYSQL      = "mysql"
+	TARGET_POSTGRES   = "postgres"
+	TARGET_CLICKHOUSE = "clickhouse"
+	TARGET_SQLITE     = "sqlite"
+)
+
+// clickhouse 表中记录版本和删除标记的字段
+const (
+	CLICKHOUSE_VERSION_COLUMN = "_version"
+	CLICKHOUSE_DELETED_COLUMN = "_is_deleted"
+)
+
+func checkTargetDialect(dialect string) error {
+	switch dialect {
+	case TARGET_MYSQL, TARGET_POSTGRES, TARGET_CLICKHOUSE, TARGET_SQLITE:
+		return nil
+	}
+	return fmt.Errorf("invalid dialect %q, must be mysql, postgres, clickhouse or sqlite", dialect)
+}
+
+// 转义库表名、字段名
+func quoteTargetName(dialect string, name string) string {
+	if dialect == TARGET_POSTGRES || dialect == TARGET_SQLITE {
+		return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+	}
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func quoteTargetTable(dialect string, schemaName string, tableName string) string {
+	return quoteTargetName(dialect, schemaName) + "." + quoteTargetName(dialect, tableName)
+}
+
+// 字符串字面量，mysql/clickhouse 使用反斜杠转义，postgres/sqlite 只转义单引号
+func quoteTargetString(dialect string, s string) string {
+	if dialect == TARGET_POSTGRES || dialect == TARGET_SQLITE {
+		return "'" + strings.Replace(s, "'", "''", -1) + "'"
+	}
+	return "'" + targetStringEscaper.Replace(s) + "'"
+}
+
+var targetStringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`)
+
+// 拆分 COLUMN_TYPE，如 decimal(10,2) unsigned => decimal, 10,2, true
+func splitColumnType(columnType string) (base string, args string, unsigned bool) {
+	columnType = strings.ToLower(strings.TrimSpace(columnType))
+	unsigned = strings.Contains(columnType, " unsigned")
+	base = columnType
+	if i := strings.IndexAny(columnType, "( "); i >= 0 {
+		base = columnType[:i]
+	}
+	if i := strings.IndexByte(columnType, '('); i >= 0 {
+		if j := strings.LastIndexByte(columnType, ')'); j > i {
+			args = columnType[i+1 : j]
+		}
+	}
+	return base, args, unsigned
+}
+
+// 目标库的字段类型，不含 NULL/NOT NULL
+func targetColumnType(dialect string, column *mysql.ColumnInfo) string {
+	base, args, unsigned := splitColumnType(column.Type)
+	switch dialect {
+	case TARGET_MYSQL:
+		return column.Type
+	case TARGET_POSTGRES:
+		return postgresColumnType(base, args, unsigned, column.DatetimePrecision)
+	case TARGET_CLICKHOUSE:
+		t := clickhouseColumnType(base, args, unsigned, column.DatetimePrecision)
+		if column.Nullable && column.Key != "PRI" {
+			t = "Nullable(" + t + ")"
+		}
+		return t
+	case TARGET_SQLITE:
+		return sqliteColumnType(base)
+	}
+	return column.Type
+}
+
+// sqlite 的类型亲和性
+func sqliteColumnType(base string) string {
+	switch base {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "bit", "year":
+		return "INTEGER"
+	case "float", "double", "real":
+		return "REAL"
+	case "decimal", "numeric":
+		return "NUMERIC"
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		return "BLOB"
+	}
+	return "TEXT"
+}
+
+func postgresColumnType(base string, args string, unsigned bool, precision int) string {
+	switch base {
+	case "tinyint", "smallint", "year":
+		if unsigned {
+			return "integer"
+		}
+		return "smallint"
+	case "mediumint":
+		return "integer"
+	case "int", "integer":
+		if unsigned {
+			return "bigint"
+		}
+		return "integer"
+	case "bigint":
+		if unsigned {
+			return "numeric(20)"
+		}
+		return "bigint"
+	case "bit":
+		return "bigint"
+	case "float":
+		return "real"
+	case "double", "real":
+		return "double precision"
+	case "decimal", "numeric":
+		if args != "" {
+			return "numeric(" + args + ")"
+		}
+		return "numeric"
+	case "char":
+		if args != "" {
+			return "char(" + args + ")"
+		}
+		return "char(1)"
+	case "varchar":
+		return "varchar(" + args + ")"
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		return "bytea"
+	case "date":
+		return "date"
+	case "datetime":
+		return fmt.Sprintf("timestamp(%d)", precision)
+	case "timestamp":
+		return fmt.Sprintf("timestamptz(%d)", precision)
+	case "time":
+		return fmt.Sprintf("time(%d)", precision)
+	case "json":
+		return "jsonb"
+	}
+	// text、enum、set 及空间类型等
+	return "text"
+}
+
+func clickhouseColumnType(base string, args string, unsigned bool, precision int) string {
+	integer := func(bits int) string {
+		if unsigned {
+			return fmt.Sprintf("UInt%d", bits)
+		}
+		return fmt.Sprintf("Int%d", bits)
+	}
+	switch base {
+	case "tinyint":
+		return integer(8)
+	case "smallint":
+		return integer(16)
+	case "mediumint", "int", "integer":
+		return integer(32)
+	case "bigint":
+		return integer(64)
+	case "bit":
+		return "UInt64"
+	case "year":
+		return "UInt16"
+	case "float":
+		return "Float32"
+	case "double", "real":
+		return "Float64"
+	case "decimal", "numeric":
+		if args == "" {
+			args = "10,0"
+		}
+		return "Decimal(" + args + ")"
+	case "date":
+		return "Date32"
+	case "datetime", "timestamp":
+		return fmt.Sprintf("DateTime64(%d)", precision)
+	}
+	// 字符串、二进制、time、json、enum、set 等
+	return "String"
+}
+
+// 字段默认值子句，没有默认值时为空
+func targetColumnDefault(dialect string, column *mysql.ColumnInfo) string {
+	if column.Default == nil || dialect == TARGET_CLICKHOUSE {
+		return ""
+	}
+	value := *column.Default
+	base, _, _ := splitColumnType(column.Type)
+	switch {
+	case strings.HasPrefix(strings.ToUpper(value), "CURRENT_TIMESTAMP"):
+		if dialect == TARGET_POSTGRES || dialect == TARGET_SQLITE {
+			return " DEFAULT CURRENT_TIMESTAMP"
+		}
+		return " DEFAULT " + value
+	case isNumericType(base):
+		if dialect == TARGET_POSTGRES && base == "bit" {
+			return ""
+		}
+		return " DEFAULT " + value
+	}
+	return " DEFAULT " + quoteTargetString(dialect, value)
+}
+
+func isNumericType(base string) bool {
+	switch base {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "float", "double", "real", "decimal", "numeric", "bit", "year":
+		return true
+	}
+	return false
+}
+
+// 字段定义，如 `name` varchar(32) NOT NULL DEFAULT 'a'
+func targetColumnDefinition(dialect string, column *mysql.ColumnInfo) string {
+	definition := quoteTargetName(dialect, column.Name) + " " + targetColumnType(dialect, column)
+	if dialect != TARGET_CLICKHOUSE && !column.Nullable {
+		definition += " NOT NULL"
+	}
+	return definition + targetColumnDefault(dialect, column)
+}
+
+// 主键字段，按字段顺序
+func primaryColumns(columns []*mysql.ColumnInfo) []string {
+	keys := make([]string, 0, 1)
+	for _, column := range columns {
+		if column.Key == "PRI" {
+			keys = append(keys, column.Name)
+		}
+	}
+	return keys
+}
+
+func quoteTargetNames(dialect string, names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, quoteTargetName(dialect, name))
+	}
+	return strings.Join(quoted, ",")
+}
+
+// 建库建表语句
+func createTableSQL(dialect string, schemaName string, tableName string, columns []*mysql.ColumnInfo) []string {
+	definitions := make([]string, 0, len(columns)+3)
+	for _, column := range columns {
+		definitions = append(definitions, targetColumnDefinition(dialect, column))
+	}
+	keys := primaryColumns(columns)
+	table := quoteTargetTable(dialect, schemaName, tableName)
+	switch dialect {
+	case TARGET_CLICKHOUSE:
+		definitions = append(definitions,
+			quoteTargetName(dialect, CLICKHOUSE_VERSION_COLUMN)+" UInt64",
+			quoteTargetName(dialect, CLICKHOUSE_DELETED_COLUMN)+" UInt8")
+		orderBy := "tuple()"
+		if len(keys) > 0 {
+			orderBy = "(" + quoteTargetNames(dialect, keys) + ")"
+		}
+		return []string{
+			"CREATE DATABASE IF NOT EXISTS " + quoteTargetName(dialect, schemaName),
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) ENGINE = ReplacingMergeTree(%s) ORDER BY %s", table,
+				strings.Join(definitions, ", "), quoteTargetName(dialect, CLICKHOUSE_VERSION_COLUMN), orderBy),
+		}
+	case TARGET_POSTGRES:
+		if len(keys) > 0 {
+			definitions = append(definitions, "PRIMARY KEY ("+quoteTargetNames(dialect, keys)+")")
+		}
+		return []string{
+			"CREATE SCHEMA IF NOT EXISTS " + quoteTargetName(dialect, schemaName),
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, strings.Join(definitions, ", ")),
+		}
+	case TARGET_SQLITE:
+		// 库为附加的数据库文件，由 applier 在写入前附加
+		if len(keys) > 0 {
+			definitions = append(definitions, "PRIMARY KEY ("+quoteTargetNames(dialect, keys)+")")
+		}
+		return []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, strings.Join(definitions, ", "))}
+	}
+	if len(keys) > 0 {
+		definitions = append(definitions, "PRIMARY KEY ("+quoteTargetNames(dialect, keys)+")")
+	}
+	return []string{
+		"CREATE DATABASE IF NOT EXISTS " + quoteTargetName(dialect, schemaName),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, strings.Join(definitions, ", ")),
+	}
+}
+
+// 补齐目标表缺少的字段，existing 为目标表已有的字段名
+func addMissingColumnsSQL(dialect string, schemaName string, tableName string, columns []*mysql.ColumnInfo, existing []string) []string {
+	names := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		names[strings.ToLower(name)] = true
+	}
+	statements := make([]string, 0)
+	for _, column := range columns {
+		if !names[strings.ToLower(column.Name)] {
+			statements = append(statements, addColumnSQL(dialect, schemaName, tableName, column))
+		}
+	}
+	return statements
+}
+
+func addColumnSQL(dialect string, schemaName string, tableName string, column *mysql.ColumnInfo) string {
+	definition := targetColumnDefinition(dialect, column)
+	// 已有数据的表新增 NOT NULL 且没有默认值的字段会失败，目标表中允许 NULL
+	if dialect != TARGET_CLICKHOUSE && !column.Nullable && column.Default == nil {
+		nullable := *column
+		nullable.Nullable = true
+		definition = targetColumnDefinition(dialect, &nullable)
+	}
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", quoteTargetTable(dialect, schemaName, tableName), definition)
+}
+
+// 新旧表结构的差异，dropColumns 为 false 时不删除字段
+func alterTableSQL(dialect string, schemaName string, tableName string, old []*mysql.ColumnInfo, columns []*mysql.ColumnInfo, dropColumns bool) []string {
+	table := quoteTargetTable(dialect, schemaName, tableName)
+	before := make(map[string]*mysql.ColumnInfo, len(old))
+	for _, column := range old {
+		before[strings.ToLower(column.Name)] = column
+	}
+	after := make(map[string]bool, len(columns))
+	statements := make([]string, 0)
+	for _, column := range columns {
+		name := strings.ToLower(column.Name)
+		after[name] = true
+		previous, ok := before[name]
+		if !ok {
+			statements = append(statements, addColumnSQL(dialect, schemaName, tableName, column))
+			continue
+		}
+		if targetColumnType(dialect, previous) == targetColumnType(dialect, column) && previous.Nullable == column.Nullable {
+			continue
+		}
+		if dialect == TARGET_SQLITE {
+			// sqlite 不能修改字段定义，按类型亲和性存储任意类型的值
+			continue
+		}
+		quoted := quoteTargetName(dialect, column.Name)
+		switch dialect {
+		case TARGET_POSTGRES:
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s::%s", table, quoted,
+				targetColumnType(dialect, column), quoted, targetColumnType(dialect, column)))
+			if column.Nullable {
+				statements = append(statements, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL", table, quoted))
+			} else {
+				statements = append(statements, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET NOT NULL", table, quoted))
+			}
+		default:
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s", table, targetColumnDefinition(dialect, column)))
+		}
+	}
+	if dropColumns {
+		for _, column := range old {
+			if !after[strings.ToLower(column.Name)] {
+				statements = append(statements, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, quoteTargetName(dialect, column.Name)))
+			}
+		}
+	}
+	return statements
+}
+
+// 重命名表
+func renameTableSQL(dialect string, rename *mysql.TableRename) []string {
+	if dialect == TARGET_SQLITE {
+		// 不能跨数据库文件重命名
+		if rename.SchemaName != rename.NewSchemaName {
+			return nil
+		}
+		return []string{fmt.Sprintf("ALTER TABLE %s RENAME TO %s", quoteTargetTable(dialect, rename.SchemaName, rename.TableName),
+			quoteTargetName(dialect, rename.NewTableName))}
+	}
+	if dialect != TARGET_POSTGRES {
+		return []string{fmt.Sprintf("RENAME TABLE %s TO %s", quoteTargetTable(dialect, rename.SchemaName, rename.TableName),
+			quoteTargetTable(dialect, rename.NewSchemaName, rename.NewTableName))}
+	}
+	// postgres 分别修改 schema 和表名
+	statements := make([]string, 0, 2)
+	schemaName := rename.SchemaName
+	if rename.SchemaName != rename.NewSchemaName {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s SET SCHEMA %s", quoteTargetTable(dialect, rename.SchemaName, rename.TableName),
+			quoteTargetName(dialect, rename.NewSchemaName)))
+		schemaName = rename.NewSchemaName
+	}
+	if rename.TableName != rename.NewTableName {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s RENAME TO %s", quoteTargetTable(dialect, schemaName, rename.TableName),
+			quoteTargetName(dialect, rename.NewTableName)))
+	}
+	return statements
+}
+
+func dropTableSQL(dialect string, schemaName string, tableName string) string {
+	return "DROP TABLE IF EXISTS " + quoteTargetTable(dialect, schemaName, tableName)
+}
+
+func truncateTableSQL(dialect string, schemaName string, tableName string) string {
+	if dialect == TARGET_SQLITE {
+		return "DELETE FROM " + quoteTargetTable(dialect, schemaName, tableName)
+	}
+	return "TRUNCATE TABLE " + quoteTargetTable(dialect, schemaName, tableName)
+}
+
+// 按表结构快照生成目标库的建表语句，用于手动建表或不支持执行的目标库(如 postgres)
+func TargetCreateTables(dialect string, snapshot *mysql.SchemaSnapshot) ([]string, error) {
+	if err := checkTargetDialect(dialect); err != nil {
+		return nil, err
+	}
+	statements := make([]string, 0, len(snapshot.Tables)*2)
+	schemas := make(map[string]bool)
+	for _, table := range snapshot.Tables {
+		columns := make([]*mysql.ColumnInfo, 0, len(table.Columns))
+		for _, column := range table.Columns {
+			columns = append(columns, &mysql.ColumnInfo{
+				Name:              column.Name,
+				Type:              column.Type,
+				Key:               column.Key,
+				Unsigned:          column.Unsigned,
+				IsPrimary:         column.Key != "",
+				Nullable:          column.Nullable,
+				Default:           column.Default,
+				DatetimePrecision: column.DatetimePrecision,
+			})
+		}
+		// 建库语句每个库只保留一条
+		created := createTableSQL(dialect, table.SchemaName, table.TableName, columns)
+		for i, statement := range created {
+			if i == 0 && len(created) > 1 {
+				if schemas[table.SchemaName] {
+					continue
+				}
+				schemas[table.SchemaName] = true
+			}
+			statements = append(statements, statement)
+		}
+	}
+	return statements, nil
+}
@@ -0,0 +1,34 @@
+package lib
+
+import (
+	"bubod/Bubod/config"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/trace"
+)
+
+// 根据 [Bubod] trace_exporter/trace_endpoint/trace_sample_ratio 配置初始化链路追踪
+func initTrace(conf map[string]string) {
+	var exporter trace.Exporter
+	switch conf["trace_exporter"] {
+	case "":
+		return
+	case "log":
+		exporter = &trace.LogExporter{}
+	case "otlp":
+		endpoint := conf["trace_endpoint"]
+		if endpoint == "" {
+			endpoint = "http://127.0.0.1:4318"
+		}
+		exporter = trace.NewOTLPExporter(endpoint)
+	default:
+		logger.Error("unknown trace_exporter", conf["trace_exporter"])
+		return
+	}
+	ratio, err := config.Section(conf).GetFloat("trace_sample_ratio", 1)
+	if err != nil {
+		logger.WithError(err).Error("trace disabled")
+		return
+	}
+	trace.Init(exporter, ratio, conf["cluster_name"])
+	logger.Info("trace exporter", conf["trace_exporter"])
+}
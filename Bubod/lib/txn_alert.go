@@ -0,0 +1,52 @@
+// 大事务、长事务告警
+// 事务的行数、rows 事件字节数和时长(BEGIN 到 XID/COMMIT 的事件时间之差)记录在直方图指标
+// bubod_transaction_rows/bubod_transaction_bytes/bubod_transaction_duration_seconds 中，
+// 超过 txn_alert_rows/txn_alert_bytes/txn_alert_duration 任一阈值时每个事务告警一次，大事务和长事务常常是复制延迟的前兆。
+// 与 max_txn_rows/max_txn_bytes 的大事务保护相互独立，只告警，不影响投递。
+package lib
+
+import (
+	"time"
+
+	"bubod/Bubod/logger"
+	"bubod/Bubod/mysql"
+)
+
+// 事务告警
+type TransactionAlert struct {
+	Source string `json:"source"`
+	*mysql.TransactionStats
+	Time int64 `json:"time"`
+}
+
+// 事务告警回调，供内嵌使用；配置了 txn_alert_webhook 时同时 POST 到该地址
+var TransactionAlertCallback func(alert *TransactionAlert)
+
+// 事务告警阈值，已在 checkConf 中检查
+func (dumpConfig *DumpConfig) transactionThreshold() mysql.TransactionThreshold {
+	section := dumpConfig.sourceConf()
+	rows, _ := section.GetInt("txn_alert_rows", 0)
+	bytes, _ := section.GetInt("txn_alert_bytes", 0)
+	duration, _ := section.GetDuration("txn_alert_duration", 0)
+	return mysql.TransactionThreshold{Rows: rows, Bytes: bytes, Duration: duration}
+}
+
+// 事务超过告警阈值，在解析协程中调用
+func (dumpConfig *DumpConfig) transactionAlert(stats *mysql.TransactionStats) {
+	alert := &TransactionAlert{Source: dumpConfig.Name, TransactionStats: stats, Time: time.Now().Unix()}
+	dumpConfig.logEntry().With(logger.Fields{
+		"binlog_file": stats.File,
+		"binlog_pos":  stats.Position,
+		"gtid":        stats.GTID,
+		"rows":        stats.Rows,
+		"bytes":       stats.Bytes,
+		"duration":    stats.Duration,
+		"tables":      stats.Tables,
+	}).Warn("transaction exceeds alert threshold")
+	if TransactionAlertCallback != nil {
+		TransactionAlertCallback(alert)
+	}
+	if webhook := dumpConfig.GetSourceVal("txn_alert_webhook"); webhook != "" {
+		go postAlert(webhook, dumpConfig.Name, alert)
+	}
+}
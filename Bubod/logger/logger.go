@@ -0,0 +1,191 @@
+// 结构化日志
+// 每条日志输出为一行，json 格式或 key=value 格式，附带实例名、binlog 位点、GTID、库表、事件类型等上下文字段。
+//
+//	{"time":"2018-09-14 12:00:00.000","level":"error","msg":"parse event","instance":"source.1","binlog_file":"mysql-bin.000003","binlog_pos":120}
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int32
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+func (level Level) String() string {
+	switch level {
+	case DEBUG:
+		return "debug"
+	case INFO:
+		return "info"
+	case WARN:
+		return "warn"
+	case ERROR:
+		return "error"
+	}
+	return "unknown"
+}
+
+// 解析日志级别，无法识别时返回 INFO
+func ParseLevel(level string) Level {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return DEBUG
+	case "warn", "warning":
+		return WARN
+	case "error":
+		return ERROR
+	}
+	return INFO
+}
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_TEXT = "text"
+)
+
+// 上下文字段
+type Fields map[string]interface{}
+
+var (
+	lock     sync.Mutex
+	output   io.Writer = os.Stderr
+	minLevel           = INFO
+	format             = FORMAT_JSON
+)
+
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	output = w
+	lock.Unlock()
+}
+
+func SetLevel(level string) {
+	lock.Lock()
+	minLevel = ParseLevel(level)
+	lock.Unlock()
+}
+
+// json(默认)/text
+func SetFormat(f string) {
+	lock.Lock()
+	if f == FORMAT_TEXT {
+		format = FORMAT_TEXT
+	} else {
+		format = FORMAT_JSON
+	}
+	lock.Unlock()
+}
+
+func Enabled(level Level) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return level >= minLevel
+}
+
+// 带上下文字段的日志
+type Entry struct {
+	fields Fields
+}
+
+func With(fields Fields) *Entry {
+	return (&Entry{}).With(fields)
+}
+
+// 返回附加了 fields 的新 Entry，空值字段不输出
+func (entry *Entry) With(fields Fields) *Entry {
+	merged := make(Fields, len(entry.fields)+len(fields))
+	for k, v := range entry.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		if v == nil || v == "" {
+			continue
+		}
+		merged[k] = v
+	}
+	return &Entry{fields: merged}
+}
+
+func WithError(err error) *Entry {
+	return (&Entry{}).WithError(err)
+}
+
+func (entry *Entry) WithError(err error) *Entry {
+	if err == nil {
+		return entry
+	}
+	return entry.With(Fields{"error": err.Error()})
+}
+
+// msg 后的参数与 log.Println 一样以空格拼接
+func (entry *Entry) Debug(msg string, args ...interface{}) { entry.log(DEBUG, msg, args) }
+func (entry *Entry) Info(msg string, args ...interface{})  { entry.log(INFO, msg, args) }
+func (entry *Entry) Warn(msg string, args ...interface{})  { entry.log(WARN, msg, args) }
+func (entry *Entry) Error(msg string, args ...interface{}) { entry.log(ERROR, msg, args) }
+
+func Debug(msg string, args ...interface{}) { (&Entry{}).log(DEBUG, msg, args) }
+func Info(msg string, args ...interface{})  { (&Entry{}).log(INFO, msg, args) }
+func Warn(msg string, args ...interface{})  { (&Entry{}).log(WARN, msg, args) }
+func Error(msg string, args ...interface{}) { (&Entry{}).log(ERROR, msg, args) }
+
+func (entry *Entry) log(level Level, msg string, args []interface{}) {
+	if !Enabled(level) {
+		return
+	}
+	if len(args) > 0 {
+		msg = strings.TrimSuffix(fmt.Sprintln(append([]interface{}{msg}, args...)...), "\n")
+	}
+	now := time.Now().Format("2006-01-02 15:04:05.000")
+
+	lock.Lock()
+	defer lock.Unlock()
+	var buf bytes.Buffer
+	if format == FORMAT_TEXT {
+		fmt.Fprintf(&buf, "%s [%s] %s", now, level, msg)
+		for _, k := range entry.keys() {
+			fmt.Fprintf(&buf, " %s=%v", k, entry.fields[k])
+		}
+		buf.WriteByte('\n')
+	} else {
+		line := make(map[string]interface{}, len(entry.fields)+3)
+		for k, v := range entry.fields {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			line[k] = v
+		}
+		line["time"] = now
+		line["level"] = level.String()
+		line["msg"] = msg
+		b, err := json.Marshal(line)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{"time": now, "level": level.String(), "msg": msg})
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	output.Write(buf.Bytes())
+}
+
+func (entry *Entry) keys() []string {
+	keys := make([]string, 0, len(entry.fields))
+	for k := range entry.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
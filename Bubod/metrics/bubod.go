@@ -0,0 +1,56 @@
+package metrics
+
+// bubod 指标，第一个标签均为数据源名称 source
+var (
+	EventsReceived     = NewCounter("bubod_events_received_total", "Binlog events received from master.", "source", "type")
+	EventsParsed       = NewCounter("bubod_events_parsed_total", "Binlog events parsed successfully.", "source", "type")
+	EventsDelivered    = NewCounter("bubod_events_delivered_total", "Binlog events delivered to callback.", "source", "type", "schema", "table")
+	BytesRead          = NewCounter("bubod_bytes_read_total", "Bytes of binlog packets read from master.", "source")
+	ParseErrors        = NewCounter("bubod_parse_errors_total", "Binlog events failed to parse.", "source", "type")
+	RowsSkipped        = NewCounter("bubod_rows_events_skipped_total", "Rows events of filtered tables skipped without decoding.", "source")
+	EventsDeduplicated = NewCounter("bubod_events_deduplicated_total", "Already delivered events dropped after reconnect.", "source")
+	LoopEventsSkipped  = NewCounter("bubod_loop_events_skipped_total", "Rows events and DDL written by a bubod applier and not delivered to prevent replication loops.", "source")
+	TableRows          = NewCounter("bubod_table_rows_total", "Row changes delivered to sinks per table.", "source", "schema", "table", "op")
+	TableBytes         = NewCounter("bubod_table_bytes_total", "Binlog event bytes delivered to sinks per table.", "source", "schema", "table", "op")
+	LargeTransactions  = NewCounter("bubod_large_transactions_total", "Transactions exceeding max_txn_rows or max_txn_bytes.", "source", "policy")
+	Reconnects         = NewCounter("bubod_reconnects_total", "Binlog dump reconnects.", "source")
+	CheckpointRewinds  = NewCounter("bubod_checkpoint_rewinds_total", "Checkpoints not saved because they were behind the saved one.", "source", "kind")
+
+	ReplicationDelay       = NewGauge("bubod_replication_delay_seconds", "Now minus timestamp of the last delivered event.", "source")
+	CheckpointLag          = NewGauge("bubod_checkpoint_lag_seconds", "Timestamp of the last delivered event minus timestamp of the last saved checkpoint.", "source")
+	ReplicationLagBytes    = NewGauge("bubod_replication_lag_bytes", "Binlog bytes on master not yet consumed.", "source")
+	QueueDepth             = NewGauge("bubod_queue_depth", "Events buffered between binlog pipeline stages when pipeline_depth > 0.", "source", "queue")
+	CheckpointPurgeSeconds = NewGauge("bubod_checkpoint_purge_seconds", "Seconds until the binlog file of the synced position may be purged, -1 if never.", "source")
+	CheckpointDivergence   = NewGauge("bubod_checkpoint_divergence", "1 if positions saved in file, election backend and object storage disagreed at the last start.", "source")
+	SinkPendingEvents      = NewGauge("bubod_sink_pending_events", "Events of a source written to a queued sink and not yet acknowledged.", "source", "sink")
+	DDLPaused              = NewGauge("bubod_ddl_paused", "1 while delivery of a source is paused before a DDL waiting for acknowledgement.", "source")
+	SinkDeliveryLag        = NewGauge("bubod_sink_delivery_lag_seconds", "Timestamp of the last read event minus timestamp of the position delivered by a sink.", "source", "sink")
+
+	SinkLatency = NewSummary("bubod_sink_latency_seconds", "Time spent in event callback.", "source")
+
+	E2ELatency      = NewHistogram("bubod_e2e_latency_seconds", "Time a sink wrote an event minus binlog event timestamp (second precision).", latencyBuckets, "source", "sink", "schema", "table")
+	PipelineLatency = NewHistogram("bubod_pipeline_latency_seconds", "Time a sink wrote an event minus time the event was parsed.", latencyBuckets, "source", "sink", "schema", "table")
+
+	TransactionRows     = NewHistogram("bubod_transaction_rows", "Row changes per transaction.", []float64{1, 10, 100, 1000, 10000, 100000, 1000000}, "source")
+	TransactionBytes    = NewHistogram("bubod_transaction_bytes", "Bytes of rows events per transaction.", []float64{1 << 10, 16 << 10, 256 << 10, 1 << 20, 16 << 20, 256 << 20, 1 << 30}, "source")
+	TransactionDuration = NewHistogram("bubod_transaction_duration_seconds", "Seconds from BEGIN to XID/COMMIT of a transaction by event timestamps.", []float64{0, 1, 5, 10, 30, 60, 300, 1800}, "source")
+)
+
+// 端到端延迟的桶上限(秒)
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// 输出指标，输出在数据源间共享，第一个标签为输出名称 sink
+var (
+	SinkQueueDepth   = NewGauge("bubod_sink_queue_depth", "Events waiting in the in-memory queue of a sink.", "sink")
+	SinkSpillBytes   = NewGauge("bubod_sink_spill_bytes", "Bytes of spilled events on disk not yet written to a sink.", "sink")
+	SinkInFlight     = NewGauge("bubod_sink_in_flight", "Events dispatched to the workers of a sink and not yet written.", "sink")
+	SinkBreakerState = NewGauge("bubod_sink_breaker_state", "Circuit breaker state of a sink: 0 closed, 1 open, 2 half open.", "sink")
+
+	SinkWriteRetries       = NewCounter("bubod_sink_write_retries_total", "Failed writes of a queued sink that were retried.", "sink")
+	SinkEventsDropped      = NewCounter("bubod_sink_events_dropped_total", "Events dropped by a queued sink after max_retries failed writes.", "sink")
+	SinkEventsDeadLettered = NewCounter("bubod_sink_events_dead_lettered_total", "Events written to the dlq_file of a sink while its circuit was open.", "sink")
+
+	SinkRowsAggregated = NewCounter("bubod_sink_rows_aggregated_total", "Row changes merged into an earlier change of the same row within aggregate_window.", "sink")
+	SinkRowsSampledOut = NewCounter("bubod_sink_rows_sampled_out_total", "Row changes dropped by the sample rules of a sink.", "sink")
+	SinkApplyConflicts = NewCounter("bubod_sink_apply_conflicts_total", "Row changes of an applier sink that hit a duplicate key or a missing row.", "sink", "conflict")
+)
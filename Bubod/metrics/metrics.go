@@ -0,0 +1,230 @@
+// Prometheus 指标
+// 只实现了 counter/gauge/summary(仅 _sum、_count)/histogram 四种类型和文本格式输出，不依赖 prometheus client。
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	TYPE_COUNTER   = "counter"
+	TYPE_GAUGE     = "gauge"
+	TYPE_SUMMARY   = "summary"
+	TYPE_HISTOGRAM = "histogram"
+)
+
+// 一组同名、不同标签值的指标
+type Metric struct {
+	sync.Mutex
+	Name    string
+	Help    string
+	Type    string
+	Labels  []string
+	Buckets []float64         // histogram 的桶上限，升序，不含 +Inf
+	values  map[string]*value // 标签值 => 指标值
+}
+
+type value struct {
+	labelValues []string
+	value       float64  // counter/gauge 的值，summary/histogram 的 sum
+	count       uint64   // summary/histogram 的 count
+	buckets     []uint64 // histogram 各桶的观测数，不累计
+}
+
+type Registry struct {
+	sync.RWMutex
+	metrics []*Metric
+}
+
+var DefaultRegistry = &Registry{}
+
+func (registry *Registry) Register(metric *Metric) *Metric {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.metrics = append(registry.metrics, metric)
+	return metric
+}
+
+func newMetric(metricType string, name string, help string, labels []string) *Metric {
+	return DefaultRegistry.Register(&Metric{
+		Name:   name,
+		Help:   help,
+		Type:   metricType,
+		Labels: labels,
+		values: make(map[string]*value, 0),
+	})
+}
+
+func NewCounter(name string, help string, labels ...string) *Metric {
+	return newMetric(TYPE_COUNTER, name, help, labels)
+}
+
+func NewGauge(name string, help string, labels ...string) *Metric {
+	return newMetric(TYPE_GAUGE, name, help, labels)
+}
+
+func NewSummary(name string, help string, labels ...string) *Metric {
+	return newMetric(TYPE_SUMMARY, name, help, labels)
+}
+
+// buckets 为升序的桶上限
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Metric {
+	metric := newMetric(TYPE_HISTOGRAM, name, help, labels)
+	metric.Buckets = buckets
+	return metric
+}
+
+func (metric *Metric) get(labelValues []string) *value {
+	key := strings.Join(labelValues, "\xff")
+	v, ok := metric.values[key]
+	if !ok {
+		v = &value{labelValues: append([]string(nil), labelValues...)}
+		if metric.Type == TYPE_HISTOGRAM {
+			v.buckets = make([]uint64, len(metric.Buckets))
+		}
+		metric.values[key] = v
+	}
+	return v
+}
+
+// counter/gauge 增加 delta
+func (metric *Metric) Add(delta float64, labelValues ...string) {
+	metric.Lock()
+	metric.get(labelValues).value += delta
+	metric.Unlock()
+}
+
+func (metric *Metric) Inc(labelValues ...string) {
+	metric.Add(1, labelValues...)
+}
+
+// gauge 设置值
+func (metric *Metric) Set(v float64, labelValues ...string) {
+	metric.Lock()
+	metric.get(labelValues).value = v
+	metric.Unlock()
+}
+
+// summary/histogram 记录一次观测值
+func (metric *Metric) Observe(v float64, labelValues ...string) {
+	metric.Lock()
+	val := metric.get(labelValues)
+	val.value += v
+	val.count++
+	for i, bound := range metric.Buckets {
+		if v <= bound {
+			val.buckets[i]++
+			break
+		}
+	}
+	metric.Unlock()
+}
+
+// 删除某组标签值的指标，如实例被删除后
+func (metric *Metric) Delete(labelValues ...string) {
+	metric.Lock()
+	delete(metric.values, strings.Join(labelValues, "\xff"))
+	metric.Unlock()
+}
+
+// 删除第一个标签值为 value 的所有指标
+func (registry *Registry) DeleteByFirstLabel(labelValue string) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, metric := range registry.metrics {
+		metric.Lock()
+		for key, v := range metric.values {
+			if len(v.labelValues) > 0 && v.labelValues[0] == labelValue {
+				delete(metric.values, key)
+			}
+		}
+		metric.Unlock()
+	}
+}
+
+// 以文本格式输出所有指标
+func (registry *Registry) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	registry.RLock()
+	for _, metric := range registry.metrics {
+		metric.write(&buf)
+	}
+	registry.RUnlock()
+	return buf.WriteTo(w)
+}
+
+func (metric *Metric) write(buf *bytes.Buffer) {
+	metric.Lock()
+	defer metric.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n", metric.Name, metric.Help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", metric.Name, metric.Type)
+
+	keys := make([]string, 0, len(metric.values))
+	for key := range metric.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := metric.values[key]
+		labels := metric.formatLabels(v.labelValues)
+		if metric.Type == TYPE_HISTOGRAM {
+			var cumulative uint64
+			for i, bound := range metric.Buckets {
+				cumulative += v.buckets[i]
+				fmt.Fprintf(buf, "%s_bucket%s %d\n", metric.Name, metric.formatLabels(v.labelValues, "le", formatFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", metric.Name, metric.formatLabels(v.labelValues, "le", "+Inf"), v.count)
+		}
+		if metric.Type == TYPE_SUMMARY || metric.Type == TYPE_HISTOGRAM {
+			fmt.Fprintf(buf, "%s_sum%s %s\n", metric.Name, labels, formatFloat(v.value))
+			fmt.Fprintf(buf, "%s_count%s %d\n", metric.Name, labels, v.count)
+			continue
+		}
+		fmt.Fprintf(buf, "%s%s %s\n", metric.Name, labels, formatFloat(v.value))
+	}
+}
+
+// extra 为追加的标签名、标签值，如 histogram 的 le
+func (metric *Metric) formatLabels(labelValues []string, extra ...string) string {
+	if len(metric.Labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(metric.Labels)+len(extra)/2)
+	for i, label := range metric.Labels {
+		labelValue := ""
+		if i < len(labelValues) {
+			labelValue = labelValues[i]
+		}
+		pairs = append(pairs, label+"=\""+escapeLabelValue(labelValue)+"\"")
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+escapeLabelValue(extra[i+1])+"\"")
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escapeLabelValue(labelValue string) string {
+	return labelValueReplacer.Replace(labelValue)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// /metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		DefaultRegistry.WriteTo(w)
+	})
+}
@@ -5,63 +5,127 @@
 package mysql
 
 import (
-	"bytes"
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/trace"
+	"context"
 	"database/sql/driver"
-	"log"
+	"bubod/Bubod/logger"
 	"strings"
 	"encoding/hex"
 	"fmt"
 	"time"
 	"sync"
+	"sync/atomic"
 	"strconv"
 )
 
 type eventParser struct {
 	format           	*FormatDescriptionEvent				// 格式描述事件
+	binlogFormat     	atomic.Value 		// 当前 binlog 的 *BinlogFormat，供状态接口读取
+	restart          	restartTracker 		// master 重启检测，见 restart.go
 	tableMap         	map[uint64]*TableMapEvent			// tableId => *TableMapEvent
-	tableNameMap     	map[string]uint64					// database.table => tableId
-	tableSchemaMap   	map[uint64][]*column_schema_type	// tableId => []*column_schema_type
+	schemas          	*schemaCache 		// 表结构缓存，tableId => 各版本的表结构
+	rowFormat        	string 				// 行数据格式 ROW_FORMAT_*
+	rowBuffer        	[]driver.Value 		// map 格式解析时复用的行缓冲区
+	name             	string 				// 实例名称，用于 metrics 标签
 	dataSource       	*string
-	connStatus       	int8 				// 连接状态 0 stop  1 running
+	connStatus       	int32 				// 连接状态 0 stop  1 running，原子读写
 	conn             	MysqlConnection     // 
-	dumpBinLogStatus 	uint8 				// 同步状态 0 stop, 1 running, 2 mysqlConn.Close, 3 KillConnect mysqlConn.Close
+	state            	*dumpState 			// 同步状态，与 BinlogDump 共享
 
 	binlogFileName   	string
 	binlogPosition   	uint32
-	maxBinlogFileName   string
-	maxBinlogPosition   uint32
+	stopAt           	*stopCondition 		// 结束条件，为 nil 时持续同步
+	completed        	bool 				// 已到达结束条件
 	binlogIgnoreDb   	*string
-	replicateDoDb    	map[string]uint8    // 
+	replicateDoDb    	map[string]uint8    // 同步的库，可以使用通配符，见 name_filter.go
+	ignoreCase       	bool 				// 库名匹配不区分大小写
+	tableFilter      	func(schemaName string, tableName string) bool // 表过滤，返回 false 的表不解码 rows 事件
 	eventDo          	[]bool				// 订阅的事件
 	ServerId        	uint32
+	offline          	bool 				// 离线读取 binlog，见 binlog_reader.go
 	connectionId	 	string
 	connLock 		 	sync.Mutex
 	binlog_checksum  	bool
+	binlogPurged     	bool				// 请求的 binlog 文件已被 master 清除
+	gtidSet          	string 				// 非空时使用 COM_BINLOG_DUMP_GTID 从该 GTID 集合之后开始同步
+	gtid             	*gtidTracker 		// 已执行的 GTID 集合
+	txnGTID          	string 				// 当前事务的 GTID uuid:gno，匿名事务时为空
+	gtidOps          	[]func() 			// 流水线模式下等待投递后执行的 GTID 集合更新
+	pipelineDepth    	int 				// 流水线各阶段间的缓冲事件数，0 为串行
+	txn              	txnTracker 			// 当前事务的大小，见 large_txn.go
+	maxTxnRows       	int64 				// 事务行数上限，0 为不限制
+	maxTxnBytes      	int64 				// 事务 rows 事件字节数上限，0 为不限制
+	largeTxnPolicy   	string 				// 超过上限时的处理策略 TXN_POLICY_*
+	txnAlert         	TransactionThreshold // 事务告警阈值
+	loopMarkerTable  	string 				// 防回环标记表 db.table，见 loop.go
+	txnAlertCallback 	transactionCallback // 事务超过告警阈值时回调
+	errorPolicy      	string 				// 事件解析失败时的处理策略 ERROR_POLICY_*
+	errorCallback    	errorCallback 		// 事件解析失败回调
+	pauseBefore      	func(event *EventReslut) bool // 投递前调用，返回 true 时暂停，恢复后再投递该事件
+	seekLock         	sync.Mutex
+	seek             	*seekPosition 		// 等待生效的重新定位请求
+	dedupWindow      	time.Duration 		// 重连去重窗口，0 为不去重，见 dedup.go
+	delivered        	*DeliveredPosition 	// 最后投递的事件，与 BinlogDump 共享
+	faults           	*faultInjector 		// 故障注入，与 BinlogDump 共享，离线解析时为 nil
+}
+
+// 运行时重新定位
+type seekPosition struct {
+	binlogFileName string
+	binlogPosition uint32
+	gtidSet        string
+}
+
+// 是否有等待生效的重新定位请求
+func (parser *eventParser) seekPending() bool {
+	parser.seekLock.Lock()
+	defer parser.seekLock.Unlock()
+	return parser.seek != nil
+}
+
+// 应用重新定位请求，在建立 dump 连接前调用
+func (parser *eventParser) applySeek() {
+	parser.seekLock.Lock()
+	defer parser.seekLock.Unlock()
+	if parser.seek == nil {
+		return
+	}
+	parser.binlogFileName = parser.seek.binlogFileName
+	parser.binlogPosition = parser.seek.binlogPosition
+	parser.txn.reset()
+	parser.gtidSet = parser.seek.gtidSet
+	parser.gtid.reset(parser.seek.gtidSet)
+	if parser.delivered != nil {
+		parser.delivered.Reset()
+	}
+	parser.seek = nil
 }
 
 func newEventParser() (parser *eventParser) {
 	parser = new(eventParser)
 	parser.tableMap = make(map[uint64]*TableMapEvent)
-	parser.tableNameMap = make(map[string]uint64)
-	parser.tableSchemaMap = make(map[uint64][]*column_schema_type)
+	parser.schemas = newSchemaCache()
 	parser.eventDo = make([]bool, 36, 36)
 	parser.ServerId = 1
 	parser.connectionId = ""
-	parser.maxBinlogFileName = ""
-	parser.maxBinlogPosition = 0
 	parser.binlog_checksum = false
+	parser.gtid = newGTIDTracker()
 	return
 }
 
 // binlog事件内容解析
 func (parser *eventParser) parseEvent(data []byte) (event *EventReslut, filename string, err error) {
-	var buf *bytes.Buffer
+	var buf *eventReader
 
-	//根据是否含有4字节校验和确定数据区域范围
+	//根据是否含有4字节校验和确定数据区域范围，解码器直接在 data 上读取
 	if parser.binlog_checksum {
-		buf = bytes.NewBuffer(data[0:len(data)-4])
+		if err = verifyEventChecksum(data); err != nil {
+			return
+		}
+		buf = newEventReader(data[0:len(data)-4])
 	}else{
-		buf = bytes.NewBuffer(data)
+		buf = newEventReader(data)
 	}
 
 	filename = parser.binlogFileName
@@ -78,34 +142,45 @@ func (parser *eventParser) parseEvent(data []byte) (event *EventReslut, filename
 
 	//第4字节为 eventType，标识事件类型，不同事件类型对应不同的协议解析方式。
 	switch EventType(data[4]) {
-	case HEARTBEAT_EVENT, IGNORABLE_EVENT, GTID_EVENT, ANONYMOUS_GTID_EVENT, PREVIOUS_GTIDS_EVENT:
+	case HEARTBEAT_EVENT, IGNORABLE_EVENT:
 		// 其余主 主动更新事件
 		return
+	case ANONYMOUS_GTID_EVENT:
+		parser.txnGTID = ""
+		return
+	case GTID_EVENT:
+		// flags(1) sid(16) gno(8)，事务提交后加入已执行集合
+		if body := buf.Bytes()[19:]; len(body) >= 25 {
+			sid, gno := append([]byte(nil), body[1:17]...), int64(bytesToUint64(body[17:25]))
+			parser.txnGTID = formatUUID(sid) + ":" + strconv.FormatInt(gno, 10)
+			parser.updateGTID(func() { parser.gtid.begin(sid, gno) })
+		}
+		return
+	case PREVIOUS_GTIDS_EVENT:
+		// binlog 文件开头，该文件之前已执行的 GTID 集合
+		var sids []*gtidSid
+		if sids, err = decodeGTIDSet(buf.Bytes()[19:]); err == nil {
+			parser.updateGTID(func() { parser.gtid.merge(sids) })
+		}
+		return
 	case FORMAT_DESCRIPTION_EVENT:
 		// 格式描述事件
 		parser.format, err = parser.parseFormatDescriptionEvent(buf)
-		/*
-		i := strings.IndexAny(parser.format.mysqlServerVersion, "-")
-		var version string
-		if i> 0{
-			version = parser.format.mysqlServerVersion[0:i]
-		}else{
-			version = parser.format.mysqlServerVersion
-		}
-		if len(version)==5{
-			version = strings.Replace(version, ".", "", 1)
-			version = strings.Replace(version, ".", "0", 1)
-		}else{
-			version = strings.Replace(version, ".", "", -1)
-		}
-		parser.mysqlVersionInt,err = strconv.Atoi(version)
-		if err != nil{
-			log.Println("mysql version:",version,"err",err)
+		parser.setBinlogFormat(parser.format.info())
+		event = &EventReslut{
+			Header:         parser.format.header,
+			BinlogFileName: parser.binlogFileName,
+			BinlogPosition: parser.binlogPosition,
+			Restart:        parser.checkRestart(parser.format),
 		}
-		*/
-		//log.Println("binlogVersion:",parser.format.binlogVersion,"server version:",parser.format.mysqlServerVersion)
+		return
+	case STOP_EVENT:
+		// master 正常关闭，之后的文件为重启后创建
+		parser.restart.stopped = true
+		var genericEvent *GenericEvent
+		genericEvent, err = parseGenericEvent(buf)
 		event = &EventReslut{
-			Header: parser.format.header,
+			Header: genericEvent.header,
 		}
 		return
 	case QUERY_EVENT:
@@ -116,8 +191,15 @@ func (parser *eventParser) parseEvent(data []byte) (event *EventReslut, filename
 			Header:         queryEvent.header,
 			SchemaName:     queryEvent.schema,
 			BinlogFileName: parser.binlogFileName,
+			BinlogPosition: parser.binlogPosition,
 			TableName:      "",
 			Query:          queryEvent.query,
+			DDL:            ParseDDL(queryEvent.query, queryEvent.schema),
+			GTID:           parser.txnGTID,
+		}
+		// DDL 等非事务语句单独提交
+		if queryEvent.query != "BEGIN" {
+			parser.updateGTID(parser.gtid.commit)
 		}
 		return
 
@@ -128,13 +210,16 @@ func (parser *eventParser) parseEvent(data []byte) (event *EventReslut, filename
 
 
 		// 更新 binlogFileName 和 binlogPosition
-		parser.binlogFileName = rotateEvent.filename
-		parser.binlogPosition = uint32(rotateEvent.position)
+		// dump 开始时 master 发送的伪 ROTATE_EVENT 只告知当前文件，其位点可能为 4，同一文件内不回退位点
+		if !rotateEvent.artificial() || rotateEvent.filename != parser.binlogFileName || uint32(rotateEvent.position) > parser.binlogPosition {
+			parser.binlogFileName = rotateEvent.filename
+			parser.binlogPosition = uint32(rotateEvent.position)
+		}
 		filename = parser.binlogFileName
 
 
 		// 清空表字段 map，避免字段串表（不同binlog文件可能 Tableid 对应关系不同）
-		parser.tableSchemaMap = make(map[uint64][]*column_schema_type, 0)
+		parser.schemas.reset()
 
 		event = &EventReslut{
 			Header:         rotateEvent.header,
@@ -154,9 +239,18 @@ func (parser *eventParser) parseEvent(data []byte) (event *EventReslut, filename
 		parser.tableMap[table_map_event.tableId] = table_map_event
 
 		// 若 TableId 是新生成的，那么要去查一次 mysql svr 获取表的最新 Meta 信息，然后更新 tableId、database.tablename、Meta 间的映射关系。
-		// 若 TableId 不是新生成的，那么表 Meta 信息没有变更，就不需要去获取和更新。
-		if _, ok := parser.tableSchemaMap[table_map_event.tableId]; !ok {
-			parser.GetTableSchema(table_map_event.tableId, table_map_event.schemaName, table_map_event.tableName)
+		// 若 TableId 不是新生成的，那么表 Meta 信息没有变更，就不需要去获取和更新；库表名或字段数不一致时重新获取，见 compat.go。
+		// 开启预加载时优先使用预加载的表结构，避免逐表查询阻塞同步
+		// 过滤掉的表不查询表结构，其后的 rows 事件也不解码
+		table_map_event.skip = !parser.isSyncTable(table_map_event.schemaName, table_map_event.tableName)
+		if !table_map_event.skip && parser.staleTableSchema(table_map_event) {
+			if !parser.usePreloadedSchema(table_map_event.tableId, table_map_event.schemaName, table_map_event.tableName) {
+				if err = parser.GetTableSchema(table_map_event.tableId, table_map_event.schemaName, table_map_event.tableName); err != nil {
+					// 没有表结构时其后的 rows 事件同样解析失败，按 errorPolicy 处理，不会按旧的表结构解码
+					delete(parser.tableMap, table_map_event.tableId)
+					return
+				}
+			}
 		}
 
 		event = &EventReslut{
@@ -182,7 +276,7 @@ func (parser *eventParser) parseEvent(data []byte) (event *EventReslut, filename
 		var rowsEvent *RowsEvent
 		rowsEvent, err = parser.parseRowsEvent(buf)
 		if err != nil{
-			log.Println("row event err:",err)
+			parser.logEntry().WithError(err).Error("parse rows event")
 		}
 
 		// log.Println("############:",parser.tableMap[rowsEvent.tableId].tableName)
@@ -196,10 +290,19 @@ func (parser *eventParser) parseEvent(data []byte) (event *EventReslut, filename
 			SchemaName:     parser.tableMap[rowsEvent.tableId].schemaName,
 			TableName:      parser.tableMap[rowsEvent.tableId].tableName,
 			Rows:           rowsEvent.rows,
+			Values:         rowsEvent.values,
+			Columns:        rowsEvent.columns,
 			Primary:        rowsEvent.primary,
+			PrimaryKeys:    rowsEvent.primaryKeys,
+			SchemaVersion:  rowsEvent.schemaVersion,
+			GTID:           parser.txnGTID,
+			skipped:        rowsEvent.skipped,
 		}
 
 	default:
+		if EventType(data[4]) == XID_EVENT {
+			parser.updateGTID(parser.gtid.commit)
+		}
 		var genericEvent *GenericEvent
 		genericEvent, err = parseGenericEvent(buf)
 		event = &EventReslut{
@@ -218,179 +321,209 @@ func (parser *eventParser) initConn() {
 	if err != nil {
 		panic(err)
 	} else {
-		parser.connStatus = 1  // 连接状态
+		atomic.StoreInt32(&parser.connStatus, 1)  // 连接状态
 	}
 	parser.conn = conn.(MysqlConnection)
 }
 
+// 表结构查询失败时的重试次数和首次重试间隔，间隔逐次加倍
+const (
+	SCHEMA_LOOKUP_RETRIES = 5
+	SCHEMA_LOOKUP_BACKOFF = 200 * time.Millisecond
+)
+
 //这个函数主要做了两件事：
 // 1. 保存 database.tablename 到 tableId 的映射关系。
 // 2. 保存 tableId 到 database.tablename 的 Meta 信息的映射关系。
-func (parser *eventParser) GetTableSchema(tableId uint64, database string, tablename string) {
-	for {
+// 失败时重新连接并按 SCHEMA_LOOKUP_BACKOFF 加倍等待后重试，SCHEMA_LOOKUP_RETRIES 次后返回错误，由调用方按 errorPolicy 处理；
+// 同步关闭时不再重试
+func (parser *eventParser) GetTableSchema(tableId uint64, database string, tablename string) (err error) {
+	if parser.offline {
+		parser.offlineTableSchema(tableId, database, tablename)
+		return nil
+	}
+	backoff := SCHEMA_LOOKUP_BACKOFF
+	for i := 0; ; i++ {
 		parser.connLock.Lock()
-		err := parser.GetTableSchemaByName(tableId, database, tablename)
+		err = parser.GetTableSchemaByName(tableId, database, tablename)
 		parser.connLock.Unlock()
-		if err == nil{
+		if err == nil {
+			return nil
+		}
+		if i+1 >= SCHEMA_LOOKUP_RETRIES {
 			break
 		}
+		if parser.state != nil {
+			if state := parser.state.Load(); state == STATE_CLOSING || state == STATE_CLOSED {
+				break
+			}
+		}
+		parser.logEntry().With(logger.Fields{"db": database, "table": tablename, "retry_in": backoff.String()}).WithError(err).Warn("get table schema")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return fmt.Errorf("get table schema %s.%s: %s", database, tablename, err)
+}
+
+// 关闭元数据连接，下次使用时重新连接，调用方需持有 connLock
+func (parser *eventParser) closeConn() {
+	if atomic.CompareAndSwapInt32(&parser.connStatus, 1, 0) {
+		parser.conn.Close()
 	}
 }
 
-// 查询 mysql sever 获取 tablename 表的 Meta 信息，然后更新 parser.tableNameMap[] 和 parser.tableSchemaMap[] 的映射关系。
+// 查询 mysql sever 获取 tablename 表的 Meta 信息，然后更新 parser.schemas 中的映射关系。
 //（这个函数名称起的太奇葩了）
 func (parser *eventParser) GetTableSchemaByName(tableId uint64, database string, tablename string) (errs error) {
 	errs = fmt.Errorf("unknow error")
 	defer func() {
 		if err := recover(); err != nil {
-			if parser.connStatus == 1{
-				parser.connStatus = 0
+			if atomic.CompareAndSwapInt32(&parser.connStatus, 1, 0) {
 				parser.conn.Close()
 			}
-			errs = fmt.Errorf(fmt.Sprint(err))
+			errs = fmt.Errorf("%v", err)
+		}
+	}()
+
+	if errs = parser.faults.schemaLookup(database, tablename); errs != nil {
+		return
+	}
+
+	// 查询失败时在关闭 stmt 之后关闭连接，下次重试时重新连接，连接可能已断开或处于错误的协议状态
+	defer func() {
+		if errs != nil {
+			parser.closeConn()
 		}
 	}()
 
 	// 如果 connStatus 为 0（未连接）则重新建立 mysql 连接。
-	if parser.connStatus == 0 {
+	if atomic.LoadInt32(&parser.connStatus) == 0 {
 		parser.initConn()
 	}
 
-	// 注意，tableNameMap 保存了 database.tablename 和 tableId 的映射关系， 
-	// 而 tableSchemaMap 保存了 tableId 和 database.tablename 对应的 column_schema_type[] 的映射关系：
-	// 		parser.tableNameMap[database+"."+tablename] = tableId
-	// 		parser.tableSchemaMap[tableId] = append(parser.tableSchemaMap[tableId], &column_schema_type{...})
+	// 注意，schemas.names 保存了 database.tablename 和 tableId 的映射关系， 
+	// 而 schemas.tables 保存了 tableId 和 database.tablename 对应的各版本 column_schema_type[] 的映射关系：
+	// 		schemas.names[database+"."+tablename] = tableId
+	// 		schemas.tables[tableId] = &tableSchema{version: n, columns: []*column_schema_type{...}}
 
 	// 这里通过执行sql语句获取 database.tablename 的表元信息，然后转化成 column_schema_type 结构存储起来。
-	parser.tableNameMap[database+"."+tablename] = tableId
-	sql := "SELECT COLUMN_NAME,COLUMN_KEY,COLUMN_TYPE,CHARACTER_SET_NAME,COLLATION_NAME,NUMERIC_SCALE,EXTRA FROM information_schema.columns WHERE table_schema='" + database + "' AND table_name='" + tablename + "' ORDER BY `ORDINAL_POSITION` ASC"
+	// 库名、表名使用占位符传参，避免表名中含有引号等字符时拼接出错误的 sql
+	sql := "SELECT " + parser.columnSchemaFields() + " FROM information_schema.columns WHERE table_schema=? AND table_name=? ORDER BY `ORDINAL_POSITION` ASC"
 	stmt, err := parser.conn.Prepare(sql)
-	p := make([]driver.Value, 0)
+	if err != nil {
+		errs = err
+		return
+	}
+	defer stmt.Close()
+	p := []driver.Value{database, tablename}
 	rows, err := stmt.Query(p)
 	if err != nil {
 		errs = err
 		return
 	}
+	// 重新获取时整体替换，避免字段重复追加
+	columns := make([]*column_schema_type, 0)
 	for {
-		dest := make([]driver.Value, 7, 7)
+		dest := make([]driver.Value, 10, 10)
 		err := rows.Next(dest)
 		if err != nil {
 			break
 		}
 
-		COLUMN_NAME 		:= string(dest[0].([]byte))
-		COLUMN_KEY 			:= string(dest[1].([]byte))
-		COLUMN_TYPE 		:= string(dest[2].([]byte))
-		CHARACTER_SET_NAME 	:= string(dest[3].([]byte))
-		COLLATION_NAME 		:= string(dest[4].([]byte))
-		NUMERIC_SCALE 		:= string(dest[5].([]byte))
-		EXTRA 				:= string(dest[6].([]byte))
-		
-		var isBool bool = false
-		var unsigned bool = false
-		var is_primary bool = false
-		var auto_increment bool = false
-		var enum_values, set_values []string
-
-		if COLUMN_TYPE == "tinyint(1)"{
-			isBool = true
-		}
-		if EXTRA == "auto_increment"{
-			auto_increment = true
-		}
-		if strings.Contains(COLUMN_TYPE,"unsigned"){
-			unsigned = true
-		}
-		if COLUMN_KEY != ""{
-			is_primary = true
-		}
-
-		//枚举类型
-		if COLUMN_TYPE[0:4] == "enum" {
-			d := strings.Replace(COLUMN_TYPE, "enum(", "", -1)
-			d  = strings.Replace(d, ")", "", -1)
-			d  = strings.Replace(d, "'", "", -1)
-			enum_values = strings.Split(d, ",")
-		} else {
-			enum_values = make([]string, 0)
-		}
-
-		//集合类型：属性名 SET('值1','值2','值3'...,'值n')
-		if COLUMN_TYPE[0:3] == "set" {
-			d := strings.Replace(COLUMN_TYPE, "set(", "", -1)
-			d  = strings.Replace(d, ")", "", -1)
-			d  = strings.Replace(d, "'", "", -1)
-			set_values = strings.Split(d, ",")
-		} else {
-			set_values = make([]string, 0)
-		}
-
 		// 字段 Meta 信息表：tableId => column_schema_types[]
-		parser.tableSchemaMap[tableId] = append(parser.tableSchemaMap[tableId], 
-			&column_schema_type {
-				COLUMN_NAME: COLUMN_NAME,
-				COLUMN_KEY:  COLUMN_KEY,
-				COLUMN_TYPE: COLUMN_TYPE,
-				enum_values: enum_values,
-				set_values:  set_values,
-				is_bool:	 isBool,
-				unsigned:    unsigned,
-				is_primary:  is_primary,
-				auto_increment: auto_increment,
-				CHARACTER_SET_NAME:CHARACTER_SET_NAME,
-				COLLATION_NAME:COLLATION_NAME,
-				NUMERIC_SCALE:NUMERIC_SCALE,
-		})
+		columns = append(columns, newColumnSchema(dest))
 	}
 	rows.Close()
+	parser.setTableSchema(tableId, database+"."+tablename, columns)
 	errs = nil
 	return
 }
 
-func (parser *eventParser) GetConnectionInfo(connectionId string) (m map[string]string){
-	parser.connLock.Lock()
-	defer func() {
-		if err := recover(); err != nil {
-			if parser.connStatus == 1{
-				parser.connStatus = 0
-				parser.conn.Close()
-			}
-			parser.connLock.Unlock()
-			log.Println("binlog.go GetConnectionInfo err:",err)
-			m = nil
-		}else{
-			parser.connLock.Unlock()
+// 将 information_schema.columns 的一行
+// information_schema.columns 中查询的字段，顺序同 newColumnSchema；DATETIME_PRECISION 5.6.4 起才有，之前的版本查询 NULL
+func (parser *eventParser) columnSchemaFields() string {
+	fields := "COLUMN_NAME,COLUMN_KEY,COLUMN_TYPE,CHARACTER_SET_NAME,COLLATION_NAME,NUMERIC_SCALE,EXTRA,IS_NULLABLE,COLUMN_DEFAULT,"
+	if mc, ok := parser.conn.(*mysqlConn); ok && mc.server != nil {
+		if version, err := ParseServerVersion(mc.server.version); err == nil && !version.AtLeast(5, 6, 4) {
+			return fields + "NULL"
 		}
-	}()
-
-	// 如果 connStatus 为 0（未连接）则重新建立 mysql 连接。
-	if parser.connStatus == 0 {
-		parser.initConn()
 	}
+	return fields + "DATETIME_PRECISION"
+}
 
-	// 执行 sql。
-	sql := "select TIME, STATE from `information_schema`.`PROCESSLIST` WHERE ID='"+connectionId+"'"
-	stmt, err := parser.conn.Prepare(sql)
-	p := make([]driver.Value, 0)
-	rows, err := stmt.Query(p)
-	if err != nil {
-		return nil
+// COLUMN_NAME,COLUMN_KEY,COLUMN_TYPE,CHARACTER_SET_NAME,COLLATION_NAME,NUMERIC_SCALE,EXTRA,IS_NULLABLE,COLUMN_DEFAULT,DATETIME_PRECISION 转为字段 Meta 信息
+func newColumnSchema(dest []driver.Value) *column_schema_type {
+	COLUMN_NAME 		:= string(dest[0].([]byte))
+	COLUMN_KEY 			:= string(dest[1].([]byte))
+	COLUMN_TYPE 		:= string(dest[2].([]byte))
+	CHARACTER_SET_NAME 	:= string(dest[3].([]byte))
+	COLLATION_NAME 		:= string(dest[4].([]byte))
+	NUMERIC_SCALE 		:= string(dest[5].([]byte))
+	EXTRA 				:= string(dest[6].([]byte))
+	IS_NULLABLE 		:= string(dest[7].([]byte))
+	COLUMN_DEFAULT 		:= string(dest[8].([]byte))
+	DATETIME_PRECISION 	:= string(dest[9].([]byte))
+	has_default 		:= dest[8].([]byte) != nil	// NULL 时为 nil
+	
+	var isBool bool = false
+	var unsigned bool = false
+	var is_primary bool = false
+	var auto_increment bool = false
+	var enum_values, set_values []string
+
+	if COLUMN_TYPE == "tinyint(1)"{
+		isBool = true
 	}
-	m = make(map[string]string,2)
-	for {
-		dest := make([]driver.Value, 2, 2)
-		err := rows.Next(dest)
-		if err != nil {
-			break
-		}
-		m["TIME"] = string(dest[0].([]byte))  //时间
-		m["STATE"] = string(dest[1].([]byte)) //状态
-		break
+	if EXTRA == "auto_increment"{
+		auto_increment = true
+	}
+	if strings.Contains(COLUMN_TYPE,"unsigned"){
+		unsigned = true
+	}
+	if COLUMN_KEY != ""{
+		is_primary = true
 	}
-	return
-}
 
+	//枚举类型
+	if strings.HasPrefix(COLUMN_TYPE, "enum(") {
+		d := strings.Replace(COLUMN_TYPE, "enum(", "", -1)
+		d  = strings.Replace(d, ")", "", -1)
+		d  = strings.Replace(d, "'", "", -1)
+		enum_values = strings.Split(d, ",")
+	} else {
+		enum_values = make([]string, 0)
+	}
 
+	//集合类型：属性名 SET('值1','值2','值3'...,'值n')
+	if strings.HasPrefix(COLUMN_TYPE, "set(") {
+		d := strings.Replace(COLUMN_TYPE, "set(", "", -1)
+		d  = strings.Replace(d, ")", "", -1)
+		d  = strings.Replace(d, "'", "", -1)
+		set_values = strings.Split(d, ",")
+	} else {
+		set_values = make([]string, 0)
+	}
+
+	return &column_schema_type {
+		COLUMN_NAME: COLUMN_NAME,
+		COLUMN_KEY:  COLUMN_KEY,
+		COLUMN_TYPE: COLUMN_TYPE,
+		enum_values: enum_values,
+		set_values:  set_values,
+		is_bool:	 isBool,
+		unsigned:    unsigned,
+		is_primary:  is_primary,
+		auto_increment: auto_increment,
+		CHARACTER_SET_NAME:CHARACTER_SET_NAME,
+		COLLATION_NAME:COLLATION_NAME,
+		NUMERIC_SCALE:NUMERIC_SCALE,
+		IS_NULLABLE:IS_NULLABLE,
+		COLUMN_DEFAULT:COLUMN_DEFAULT,
+		DATETIME_PRECISION:DATETIME_PRECISION,
+		nullable:    IS_NULLABLE == "YES",
+		has_default: has_default,
+	}
+}
 
 func (parser *eventParser) KillConnect(connectionId string) (b bool){
 	b = false
@@ -398,8 +531,7 @@ func (parser *eventParser) KillConnect(connectionId string) (b bool){
 	defer func() {
 		if err := recover(); err != nil {
 			// 连接状态: 0-stop, 1-running
-			if parser.connStatus == 1 {
-				parser.connStatus = 0
+			if atomic.CompareAndSwapInt32(&parser.connStatus, 1, 0) {
 				parser.conn.Close()
 			}
 			parser.connLock.Unlock()
@@ -409,10 +541,24 @@ func (parser *eventParser) KillConnect(connectionId string) (b bool){
 		}
 	}()
 
-	if parser.connStatus == 0 {
+	// kill 不支持预处理语句，connectionId 只允许为数字
+	if _, err := strconv.ParseUint(connectionId, 10, 64); err != nil {
+		return false
+	}
+	if atomic.LoadInt32(&parser.connStatus) == 0 {
 		parser.initConn()
 	}
 	sql := "kill "+connectionId
+	if mc, ok := parser.conn.(*mysqlConn); ok {
+		// 经过代理时线程 id 属于代理后端，不 kill，见 proxy.go
+		if mc.cfg.proxy {
+			return false
+		}
+		// RDS/Aurora 没有 SUPER 权限，见 rds.go
+		if mc.cfg.rds {
+			sql = "CALL mysql.rds_kill("+connectionId+")"
+		}
+	}
 	p := make([]driver.Value, 0)
 	_, err := parser.conn.Exec(sql,p)
 	if err != nil {
@@ -423,32 +569,53 @@ func (parser *eventParser) KillConnect(connectionId string) (b bool){
 
 // 根据 database.tablename 获取对应的 tableId
 func (parser *eventParser) GetTableId(database string, tablename string) uint64 {
-	key := database + "." + tablename
-	if _, ok := parser.tableNameMap[key]; !ok {
-		return uint64(0)
+	return parser.schemas.tableId(database + "." + tablename)
+}
+
+// 删除 database.tablename 的表结构缓存，返回其原 tableId
+func (parser *eventParser) removeTableSchema(database string, tablename string) uint64 {
+	return parser.schemas.remove(database + "." + tablename)
+}
+
+// DDL 后重新获取表结构，失败时删除缓存，下一个 TABLE_MAP_EVENT 重新获取，不沿用变更前的表结构
+func (parser *eventParser) refreshTableSchema(tableId uint64, database string, tablename string) {
+	if err := parser.GetTableSchema(tableId, database, tablename); err != nil {
+		parser.logEntry().WithError(err).Error("refresh table schema after ddl")
+		parser.removeTableSchema(database, tablename)
+	}
+}
+
+// 根据 DDL 更新表结构缓存
+//   ALTER TABLE:            重新获取表结构
+//   TRUNCATE / DROP TABLE:  删除缓存(DROP TABLE t1, t2 删除所有表的缓存)，TRUNCATE 后的 TABLE_MAP_EVENT 会使用新的 tableId 重新获取
+//   RENAME TABLE:           删除旧表名的缓存，原 tableId 映射到新表名
+func (parser *eventParser) updateTableSchemaByDDL(ddl *DDLEvent) {
+	switch ddl.Operation {
+	case DDL_ALTER_TABLE, DDL_RENAME_TABLE:
+		if len(ddl.Renames) == 0 {
+			if tableId := parser.GetTableId(ddl.SchemaName, ddl.TableName); tableId > 0 {
+				parser.refreshTableSchema(tableId, ddl.SchemaName, ddl.TableName)
+			}
+			return
+		}
+		for _, rename := range ddl.Renames {
+			if tableId := parser.removeTableSchema(rename.SchemaName, rename.TableName); tableId > 0 {
+				parser.refreshTableSchema(tableId, rename.NewSchemaName, rename.NewTableName)
+			}
+		}
+	case DDL_TRUNCATE_TABLE:
+		parser.removeTableSchema(ddl.SchemaName, ddl.TableName)
+	case DDL_DROP_TABLE:
+		for _, table := range ddl.DropTables() {
+			parser.removeTableSchema(table.SchemaName, table.TableName)
+		}
 	}
-	return parser.tableNameMap[key]
 }
 
 // 检查sql语句是否是alter table语句，是的话就获取变更的 database 和 tablename 并返回。
 func (parser *eventParser) GetQueryTableName(sql string) (string, string) {
-	sql = strings.Trim(sql, " ")
-	if len(sql) < 11 {
-		return "", ""
-	}
-	if strings.ToUpper(sql[0:11]) == "ALTER TABLE" {
-		sqlArr := strings.Split(sql, " ")
-		dbAndTable := strings.Replace(sqlArr[2], "`", "", -1)
-		i := strings.IndexAny(dbAndTable, ".")
-		var databaseName, tablename string
-		if i > 0 {
-			databaseName = dbAndTable[0:i]
-			tablename = dbAndTable[i+1:]
-		} else {
-			databaseName = ""
-			tablename = dbAndTable
-		}
-		return databaseName, tablename
+	if ddl := ParseDDL(sql, ""); ddl != nil && ddl.Operation == DDL_ALTER_TABLE {
+		return ddl.SchemaName, ddl.TableName
 	}
 	return "", ""
 }
@@ -469,30 +636,75 @@ func (mc *mysqlConn) DumpBinlog(filename string, position uint32, parser *eventP
 	// 向 mysql server 发送 binlog 订阅指令
 	ServerId := uint32(parser.ServerId) // Must be non-zero to avoid getting EOF packet
 	flags := uint16(0)
-	e := mc.writeCommandPacket(COM_BINLOG_DUMP, position, flags, ServerId, filename)
+	var e error
+	if parser.gtidSet != "" {
+		var sids []*gtidSid
+		sids, e = parseGTIDSet(parser.gtidSet)
+		if e == nil {
+			// BINLOG_THROUGH_GTID
+			e = mc.writeCommandPacket(COM_BINLOG_DUMP_GTID, uint16(0x04), ServerId, filename, uint64(position), encodeGTIDSet(sids))
+		}
+	} else {
+		e = mc.writeCommandPacket(COM_BINLOG_DUMP, position, flags, ServerId, filename)
+	}
 	if e != nil {
 		result <- e
 		return nil, e
 	}
 
+	// 起始 GTID 集合已包含结束集合
+	if parser.reachedStopGTID() {
+		parser.complete(result)
+		return nil, nil
+	}
+
+	// 读取、解析、投递流水线执行
+	if parser.pipelineDepth > 0 {
+		return nil, mc.dumpPipeline(filename, position, parser, callbackFun, result)
+	}
+
+	// 每个事件一个 trace，未投递的事件(过滤、退出等)在下一轮循环或退出时丢弃
+	// 事件的行数据同样在下一轮循环或退出时回收，packet 缓冲区在整个 dump 连接中复用
+	var span *trace.Span
+	var event *EventReslut
+	pktBuf := getPacketBuffer()
+	defer func() {
+		span.Drop()
+		event.release()
+		putPacketBuffer(pktBuf)
+	}()
+
 	// 不断地接收 mysql server 写回的 binlog event
 	for {
+		span.Drop()
+		event.release()
+		event = nil
 
-		if parser.dumpBinLogStatus != 1 {
-			if parser.dumpBinLogStatus == 0 {  // BinlogDump.Stop() 会将 dumpBinLogStatus 置为0，此时continue会导致for循环空转，相当于暂停同步。
-				time.Sleep(1 * time.Second)
-				result <- fmt.Errorf("stop")
-				continue
-			}
-			if parser.dumpBinLogStatus == 2 {  // BinlogDump.Close() 会将 dumpBinLogStatus 置为2，此时会退出同步。
-				result <- fmt.Errorf("close")
-				break
-			}
+		// BinlogDump.Close() 会将状态置为 STATE_CLOSING，此时会退出同步。
+		if state := parser.state.Load(); state == STATE_CLOSING || state == STATE_CLOSED {
+			result <- fmt.Errorf("close")
+			break
+		}
+		// BinlogDump.SeekTo() 需要重新建立 dump 连接
+		if parser.seekPending() {
+			break
+		}
+		// 上一个事务提交后已执行的 GTID 集合包含结束集合
+		if parser.reachedStopGTID() {
+			parser.complete(result)
+			break
 		}
 		
 		// 每次收取一个完整的 packet
-		pkt, e := mc.readPacket()
+		span = trace.StartTrace("binlog.event")
+		readSpan := span.StartChild("binlog.read")
+		pkt, e := mc.readPacketTo(pktBuf)
+		readSpan.Finish()
+		if e == nil {
+			e = parser.faults.afterRead(pkt, parser.binlog_checksum)
+		}
 		if e != nil {
+			e = mc.dumpReadError(e)
 			result <- e
 			return nil, e
 		} 
@@ -503,76 +715,81 @@ func (mc *mysqlConn) DumpBinlog(filename string, position uint32, parser *eventP
 			break
 		}
 
+		metrics.BytesRead.Add(float64(len(pkt)), parser.name)
+
 		// 合法包
 		if pkt[0] == 0 {
 
-			event, _, e := parser.parseEvent(pkt[1:])
+			eventName := "UNKNOWN_EVENT"
+			if len(pkt) > 5 {
+				eventName = (&EventHeader{EventType: EventType(pkt[5])}).EventName()
+			}
+			metrics.EventsReceived.Inc(parser.name, eventName)
+			span.SetAttribute("bubod.source", parser.name)
+			span.SetAttribute("binlog.event_type", eventName)
+			span.SetAttribute("binlog.bytes", len(pkt))
+
+			parseSpan := span.StartChild("binlog.parse")
+			event, _, e = parser.safeParseEvent(pkt[1:])
+			parseSpan.Finish()
 			if e != nil {
-				fmt.Println("parseEvent err:",e)
-				result <- e
-				return nil, e
+				metrics.ParseErrors.Inc(parser.name, eventName)
+				span.SetAttribute("error", e)
+				span.Finish()
+				// 按 errorPolicy 处理，跳过时位点前移到下一个事件
+				errorEvent := parser.newErrorEvent(pkt[1:], e)
+				if !parser.handleErrorEvent(errorEvent) {
+					result <- e
+					return nil, e
+				}
+				if errorEvent.Header.LogPos > 0 {
+					parser.binlogPosition = errorEvent.Header.LogPos
+				}
+				continue
 			}
 
 			if event == nil{ //看代码 event==nil 不会发生
 				continue
 			}
+			metrics.EventsParsed.Inc(parser.name, eventName)
+			event.Source, event.ParsedAt = parser.name, time.Now()
 
-			// QUERY_EVENT, must be read Schema again
-
-
-			// 执行更新语句时会生成 QUERY_EVENT，包括 create, insert, update, delete. 
-			if event.Header.EventType == QUERY_EVENT {
-
-				//？？？？
-
-
-				// 检查 sql 语句来确认是否是表结构变更事件，如果表结构变更，则tableId会发生变更，
-				// 如果是的话，获取变更的 database 和 tablename 并返回。
-				if SchemaName, tableName := parser.GetQueryTableName(event.Query); tableName != "" {
-					if SchemaName != "" {
-						event.SchemaName = SchemaName
-					}
-					event.TableName = tableName
-					
-
-					// 获取
-					if tableId := parser.GetTableId(event.SchemaName, tableName); tableId > 0 {
-
-						//
-						parser.GetTableSchema(tableId, event.SchemaName, tableName)
-					}
-				}
+			// 到达结束位点或时间，过滤掉的事件同样检查
+			if parser.reachedStopPosition(event) {
+				parser.complete(result)
+				break
 			}
 
-			//only return replicateDoDb, any sql may be use db.table query
-			if len(parser.replicateDoDb) > 0 {
-				if _, ok := parser.replicateDoDb[event.SchemaName]; !ok {
-					continue
-				}
+			filterSpan := span.StartChild("binlog.filter")
+			looped := parser.looped(event)
+			deliver, e := parser.checkTransaction(event)
+			if e != nil {
+				result <- e
+				break
 			}
-
-			// 忽略掉不关注的 EventType
-			if parser.eventDo[int(event.Header.EventType)] == false {
+			if !deliver || !parser.filterEvent(event) || looped {
 				continue
 			}
 
-			// 超过单个文件的最大同步位点限制，被当作错误处理，会导致同步被停止
-			if event.BinlogFileName == parser.maxBinlogFileName && event.Header.LogPos >= parser.maxBinlogPosition {
-				parser.dumpBinLogStatus = 2
+			if parser.seekPending() {
 				break
 			}
+			filterSpan.Finish()
 
-			// 调用业务回调函数，主要是用json格式化后打印出来，更进一步可以写入kafka。
-			callbackFun(event)
+			if !parser.deliverEvent(event, eventName, span, callbackFun, result) {
+				break
+			}
 
 			// 设置同步信息
-			parser.binlogFileName = event.BinlogFileName
-			parser.binlogPosition = event.Header.LogPos
+			if file, pos, ok := event.nextPosition(parser.binlogFileName); ok {
+				parser.binlogFileName, parser.binlogPosition = file, pos
+			}
 
 		} else {
 			result <- fmt.Errorf("Unknown packet:\n%s\n\n", hex.Dump(pkt))
 			if strings.Contains(string(pkt),"Could not find first log file name in binary log index file"){
-				result <- fmt.Errorf("close")
+				// 交由 BinlogDump 按 PurgedPolicy 处理
+				parser.binlogPurged = true
 				break
 			}
 			//result <- fmt.Errorf("Unknown packet:\n%s\n\n", hex.Dump(pkt))
@@ -581,6 +798,122 @@ func (mc *mysqlConn) DumpBinlog(filename string, position uint32, parser *eventP
 	return nil, nil
 }
 
+// 投递前的处理: DDL 更新表结构缓存，按库、事件类型过滤，返回是否投递
+func (parser *eventParser) filterEvent(event *EventReslut) bool {
+
+	// 执行更新语句时会生成 QUERY_EVENT，包括 create, insert, update, delete. 
+	if event.Header.EventType == QUERY_EVENT {
+
+		// 检查 sql 语句来确认是否是表结构变更事件，如果表结构变更，则tableId会发生变更，
+		// 如果是的话，获取变更的 database 和 tablename 并返回。
+		if event.DDL != nil && event.DDL.TableName != "" {
+			event.SchemaName = event.DDL.SchemaName
+			event.TableName = event.DDL.TableName
+
+			// ALTER / RENAME / TRUNCATE 等需要更新表结构缓存
+			parser.updateTableSchemaByDDL(event.DDL)
+		}
+	}
+
+	// master 重启通知所有输出
+	if event.Restart != nil {
+		return true
+	}
+
+	// 过滤掉的表的 rows 事件没有解码
+	if event.skipped {
+		metrics.RowsSkipped.Inc(parser.name)
+		return false
+	}
+
+	//only return replicateDoDb, any sql may be use db.table query
+	if !parser.isSyncDb(event.SchemaName) {
+		return false
+	}
+
+	// 忽略掉不关注的 EventType
+	if parser.eventDo[int(event.Header.EventType)] == false {
+		return false
+	}
+	return true
+}
+
+// 是否需要解码该表的 rows 事件，不在 replicateDoDb 中或被 tableFilter 过滤的表不解码
+func (parser *eventParser) isSyncTable(schemaName string, tableName string) bool {
+	if !parser.isSyncDb(schemaName) {
+		return false
+	}
+	return parser.tableFilter == nil || parser.tableFilter(schemaName, tableName)
+}
+
+// 暂停时阻塞等待恢复，返回 false 时结束同步(关闭或有重新定位请求)
+func (parser *eventParser) waitPaused(result chan error) bool {
+	if parser.state.Load() != STATE_PAUSED {
+		return true
+	}
+	result <- fmt.Errorf("stop")
+	state := parser.state.WaitWhile(STATE_PAUSED)
+	if state == STATE_CLOSING || state == STATE_CLOSED {
+		result <- fmt.Errorf("close")
+		return false
+	}
+	if parser.seekPending() {
+		return false
+	}
+	result <- fmt.Errorf("running")
+	return true
+}
+
+// 投递事件，暂停时阻塞等待恢复，返回 false 时结束同步
+func (parser *eventParser) deliverEvent(event *EventReslut, eventName string, span *trace.Span, callbackFun callback, result chan error) bool {
+
+	// BinlogDump.Stop() 会将状态置为 STATE_PAUSED，此时停止投递并阻塞等待恢复。
+	// 暂停期间不再读取数据，由 tcp 流控阻止 master 继续发送；若暂停过久 master 断开连接，
+	// 恢复后会从最后投递的位点重新连接，不会丢失事件。
+	if !parser.waitPaused(result) {
+		return false
+	}
+
+	// 重连后再次读取的已投递事件
+	if parser.duplicate(event) {
+		span.Drop()
+		return true
+	}
+
+	// 投递前暂停，如 DDL 等待确认；恢复后投递该事件，暂停期间关闭或重新定位时不投递
+	if parser.pauseBefore != nil && parser.pauseBefore(event) {
+		parser.state.CompareAndTransition(STATE_RUNNING, STATE_PAUSED)
+		if state := parser.state.Load(); state == STATE_CLOSING || state == STATE_CLOSED {
+			result <- fmt.Errorf("close")
+			return false
+		}
+		if !parser.waitPaused(result) {
+			return false
+		}
+	}
+
+	// 调用业务回调函数，主要是用json格式化后打印出来，更进一步可以写入kafka。
+	span.SetAttribute("binlog.file", event.BinlogFileName)
+	span.SetAttribute("binlog.position", event.Header.LogPos)
+	span.SetAttribute("binlog.event_time", event.Header.Timestamp)
+	span.SetAttribute("db.name", event.SchemaName)
+	span.SetAttribute("db.table", event.TableName)
+	event.Trace = span
+	if logger.Enabled(logger.DEBUG) {
+		parser.logEntry().With(event.LogFields()).Debug("deliver event")
+	}
+	start := time.Now()
+	callbackFun(event)
+	parser.markDelivered(event)
+	span.Finish()
+	metrics.SinkLatency.Observe(time.Since(start).Seconds(), parser.name)
+	metrics.EventsDelivered.Inc(parser.name, eventName, event.SchemaName, event.TableName)
+	if event.Header.Timestamp > 0 {
+		metrics.ReplicationDelay.Set(float64(time.Now().Unix()-int64(event.Header.Timestamp)), parser.name)
+	}
+	return true
+}
+
 
 
 
@@ -590,54 +923,158 @@ func (mc *mysqlConn) DumpBinlog(filename string, position uint32, parser *eventP
 // 可见，二者区别使用是因为 binlog dump 是单向接收数据的连接，而交互式的命令需要另建新连接避免互相干扰。
 
 
+// 请求的 binlog 文件已被 master 清除时的处理策略
+const (
+	BINLOG_PURGED_FAIL     = "fail"     // 停止同步(默认)
+	BINLOG_PURGED_EARLIEST = "earliest" // 从 master 上最早的 binlog 文件开始
+	BINLOG_PURGED_CURRENT  = "current"  // 从 master 当前位点开始
+)
+
+// dump 连接的会话超时(秒)
+// 进程异常退出或网络中断未能 kill dump 线程时，master 写入阻塞超过该时间后关闭 Binlog Dump 线程
+const DUMP_SESSION_TIMEOUT = 600
+
 type BinlogDump struct {
+	Name 			string 			 // 实例名称，用于 metrics 标签
 	DataSource 		string
-	Status     		string 			 // stop, running, close, error, starting
+	Candidates 		[]string 		 // 候选 master DSN，为空时只连接 DataSource；重连时选择其中可写的实例
+	AllowReplica 	bool 			 // 允许从只读的从库 dump，此时选择候选中第一个可连接的实例
+	master 			string 			 // 当前连接的 master DSN，解析器元数据连接同样使用
+	serverUUID 		string 			 // 当前 master 的 server_uuid，变化时视为 master 切换
+	SessionTimeout 	int 			 // dump 连接 wait_timeout/net_write_timeout(秒)，0 为 DUMP_SESSION_TIMEOUT，小于 0 不设置
+	HeartbeatPeriod time.Duration 	 // master 心跳周期，0 为 DUMP_HEARTBEAT_PERIOD，小于 0 不设置
+	InitSQL 		[]string 		 // 建立 dump 连接后依次执行的语句，如 SET NAMES utf8mb4，在会话超时、心跳之后执行，失败时重连
+	SlaveUUID 		string 			 // 非空时设置 @slave_uuid，master 开始 dump 时终止使用相同 uuid 的旧 dump 线程
+	PurgedPolicy 	string 			 // binlog 被清除时的处理策略 BINLOG_PURGED_*
+	InvalidPositionPolicy string 	 // 起始位点不在事件边界上时的处理策略 POSITION_INVALID_*，见 position_check.go
+	positionChecked bool 			 // 已检查起始位点，重新定位后再次检查
+	state      		dumpState 		 // 同步状态
 	parser     		*eventParser     // binlog事件解析器
 	//BinlogIgnoreDb string
-	ReplicateDoDb 	map[string]uint8 // 
+	ReplicateDoDb 	map[string]uint8 // 同步的库，为空时同步所有库；库名可以使用通配符 * 和 ?
+	IgnoreCase 		bool 			 // ReplicateDoDb 匹配不区分大小写，master 的 lower_case_table_names 不为 0 时设置
+	TableFilter 	func(schemaName string, tableName string) bool // 表过滤，返回 false 的表不查询表结构、不解码 rows 事件，为 nil 时不过滤
 	OnlyEvent     	[]EventType		 // 订阅事件类型
+	GTIDSet       	string 			 // 非空时从该 GTID 集合之后开始同步，忽略 filename/position
 	CallbackFun   	callback		 // 回调函数
+	ErrorPolicy   	string 			 // 事件解析失败时的处理策略 ERROR_POLICY_*
+	ErrorCallbackFun errorCallback 	 // 事件解析失败回调，dlq 策略下由其写入死信队列
+	PauseBefore   	func(event *EventReslut) bool // 投递每个事件前调用，返回 true 时暂停同步，Start() 恢复后再投递该事件
+	RowFormat     	string 			 // 行数据格式 ROW_FORMAT_*，默认 map
+	PipelineDepth 	int 			 // 大于 0 时读取、解析、投递分别在独立协程中执行，阶段间最多缓冲的事件数
+	MaxTransactionRows  int64 		 // 事务行数上限，0 为不限制，见 large_txn.go
+	MaxTransactionBytes int64 		 // 事务 rows 事件字节数上限，0 为不限制
+	LargeTransactionPolicy string 	 // 超过上限时的处理策略 TXN_POLICY_*
+	TransactionAlert TransactionThreshold // 事务告警阈值，见 large_txn.go
+	TransactionAlertFun transactionCallback // 事务超过告警阈值时回调
+	LoopMarkerTable 	string 			 // 防回环标记表 db.table，applier 写入的事务和 DDL 不投递，见 loop.go
+	PreloadSchema 	bool 			 // 每次建立 dump 连接时一次性加载 ReplicateDoDb(为空时为所有业务库)中所有表的结构
+	ImportSchema  	*SchemaSnapshot  // 导入的表结构快照，作为预加载的表结构使用，见 schema_snapshot.go
+	StopAt        	*StopCondition 	 // 结束条件，到达后状态变为 STATE_COMPLETED，为 nil 时持续同步
+	StartTime     	time.Time 		 // 没有起始位点和 GTID 集合时，从该时间之后的第一个事务开始同步
+	DedupWindow   	time.Duration 	 // 大于 0 时丢弃重连后再次读取的已投递事件，见 dedup.go
+	Delivered     	*DeliveredPosition // 最后投递的事件，为 nil 时在 StartDumpBinlog 中创建；重启实例时传入上次的值以便去重
+	faults     		faultInjector 	 // 故障注入，见 fault.go
 	mysqlConn  		MysqlConnection  // 用于 binlog dump 的连接对象
 	mysqlConnStatus int 			 // 连接状态
 	connLock 		sync.Mutex 		 // 互斥锁
 }
 
+// 重置同步状态为 STATE_STARTING，再次启动同一个 BinlogDump 时在启动 StartDumpBinlog 协程之前调用，
+// 协程启动前调用的 Close/Shutdown 设置的 STATE_CLOSING 不会被覆盖；新建的 BinlogDump 初始即为 STATE_STARTING
+func (This *BinlogDump) ResetState() {
+	This.state.reset(STATE_STARTING)
+}
+
+// 当前的解析器，未启动时为 nil；StartDumpBinlog 协程之外读取 This.parser 时使用
+func (This *BinlogDump) currentParser() *eventParser {
+	This.connLock.Lock()
+	defer This.connLock.Unlock()
+	return This.parser
+}
+
+// maxFileName 不为空且未设置 StopAt 时，同步到 maxFileName:maxPosition 为止
+// 不重置同步状态，启动前已关闭时直接退出，见 ResetState
 func (This *BinlogDump) StartDumpBinlog(filename string, position uint32, ServerId uint32, result chan error, maxFileName string, maxPosition uint32) {
 	
-	This.parser = newEventParser()
-	This.parser.dataSource = &This.DataSource        // 数据源
-	This.parser.connStatus = 0                       // 连接状态 0 stop  1 running
-	This.parser.dumpBinLogStatus = 1                 // 同步状态 0 stop, 1 running, 2 mysqlConn.Close, 3 KillConnect mysqlConn.Close
-	This.parser.replicateDoDb = This.ReplicateDoDb   //
-	This.parser.ServerId = ServerId 				 //
-	This.parser.maxBinlogPosition = maxPosition
-	This.parser.maxBinlogFileName = maxFileName
+	parser := newEventParser()
+	parser.name = This.Name                     // 实例名称
+	This.master = This.DataSource
+	This.serverUUID = ""
+	This.positionChecked = false
+	parser.dataSource = &This.master            // 数据源，master 切换后随之变化
+	parser.connStatus = 0                       // 连接状态 0 stop  1 running
+	parser.state = &This.state                  // 同步状态
+	parser.faults = &This.faults                // 故障注入
+	parser.replicateDoDb = This.ReplicateDoDb   //
+	parser.ignoreCase = This.IgnoreCase         // 库名匹配不区分大小写
+	parser.tableFilter = This.TableFilter       // 表过滤
+	parser.maxTxnRows = This.MaxTransactionRows // 大事务保护
+	parser.maxTxnBytes = This.MaxTransactionBytes
+	parser.largeTxnPolicy = This.LargeTransactionPolicy
+	parser.txnAlert = This.TransactionAlert       // 事务告警
+	parser.txnAlertCallback = This.TransactionAlertFun
+	parser.loopMarkerTable = This.LoopMarkerTable // 防回环
+	parser.pauseBefore = This.PauseBefore         // 投递前暂停
+	parser.ServerId = ServerId 				 //
+	parser.importSchemaSnapshot(This.ImportSchema) // 表结构快照
 
 	//初始化不关注的 EventType 事件
 	for _, val := range This.OnlyEvent {
-		This.parser.eventDo[int(val)] = true
+		parser.eventDo[int(val)] = true
 	}
+	// 其他协程在 connLock 下读取 This.parser，见 currentParser
+	This.connLock.Lock()
+	This.parser = parser
+	This.connLock.Unlock()
 
 	defer func() {
 		This.parser.connLock.Lock()
-		if This.parser.connStatus == 1 {
-			This.parser.connStatus = 0
+		if atomic.CompareAndSwapInt32(&This.parser.connStatus, 1, 0) {
 			This.parser.conn.Close()
 		}
 		This.parser.connLock.Unlock()
+		if This.parser.completed {
+			This.state.Transition(STATE_COMPLETED)
+		} else {
+			This.state.Transition(STATE_CLOSED)
+		}
 	}()
 
+	stopAt := This.StopAt
+	if stopAt == nil && maxFileName != "" {
+		stopAt = &StopCondition{BinlogFileName: maxFileName, BinlogPosition: maxPosition}
+	}
+	stopCondition, err := newStopCondition(stopAt)
+	if err != nil {
+		result <- err
+		return
+	}
+	This.parser.stopAt = stopCondition
+
 	This.parser.binlogFileName = filename
 	This.parser.binlogPosition = position
+	This.parser.gtidSet = This.GTIDSet
+	This.parser.gtid.reset(This.GTIDSet)
+	This.parser.errorPolicy = This.ErrorPolicy
+	This.parser.rowFormat = This.RowFormat
+	This.parser.pipelineDepth = This.PipelineDepth
+	This.parser.errorCallback = This.ErrorCallbackFun
+	if This.Delivered == nil {
+		This.Delivered = &DeliveredPosition{}
+	}
+	This.parser.delivered = This.Delivered
+	This.parser.dedupWindow = This.DedupWindow
 
-	for {
-		if This.parser.dumpBinLogStatus == 3 {
+	for i := 0; ; i++ {
+		if state := This.state.Load(); state == STATE_CLOSING || state == STATE_CLOSED {
+			if !This.parser.completed {
+				result <- fmt.Errorf("close")
+			}
 			break
 		}
-		if This.parser.dumpBinLogStatus == 2 {
-			result <- fmt.Errorf("close")
-			break
+		if i > 0 {
+			metrics.Reconnects.Inc(This.Name)
 		}
 
 		result <- fmt.Errorf("starting")
@@ -661,19 +1098,20 @@ func (This *BinlogDump) checksum_enabled() {
 	rows, err := stmt.Query(p)
 	defer rows.Close()
 	if err != nil {
-		log.Println("checksum_enabled sql query err:",err)
+		This.logEntry().WithError(err).Error("checksum_enabled sql query")
 		return
 	}
 	dest := make([]driver.Value, 2, 2)
 	err = rows.Next(dest)
 	if err != nil {
 		if err.Error() != "EOF"{
-			log.Println("checksum_enabled err:",err)
+			This.logEntry().WithError(err).Error("checksum_enabled")
 		}
 		return
 	}
 	
-	if string(dest[1].([]byte)) != ""{
+	// 关闭校验和时为 NONE
+	if val := string(dest[1].([]byte)); val != "" && !strings.EqualFold(val, "NONE") {
 		This.mysqlConn.Exec("set @master_binlog_checksum= @@global.binlog_checksum",p)
 		This.parser.binlog_checksum = true
 	}
@@ -690,14 +1128,14 @@ func (This *BinlogDump) getMasterFilePosition() []string {
 	rows, err := stmt.Query(p)
 	defer rows.Close()
 	if err != nil {
-		log.Println("[error] show master status, sql query error:",err)
+		This.logEntry().WithError(err).Error("show master status, sql query")
 		return nil
 	}
 	dest := make([]driver.Value, 4, 4)
 	err = rows.Next(dest)
 	if err != nil {
 		if err.Error() != "EOF"{
-			log.Println("getMasterFilePosition err:", err)
+			This.logEntry().WithError(err).Error("getMasterFilePosition")
 		}
 		return nil
 	}
@@ -709,18 +1147,204 @@ func (This *BinlogDump) getMasterFilePosition() []string {
 	return nil
 }
 
+// 获取 mysql master 上最早的 binlog 文件
+func (This *BinlogDump) getFirstBinlogFile() string {
+	sql := "SHOW BINARY LOGS"
+	stmt, err := This.mysqlConn.Prepare(sql)
+	if err != nil {
+		This.logEntry().WithError(err).Error("show binary logs, sql prepare")
+		return ""
+	}
+	defer stmt.Close()
+	p := make([]driver.Value, 0)
+	rows, err := stmt.Query(p)
+	if err != nil {
+		This.logEntry().WithError(err).Error("show binary logs, sql query")
+		return ""
+	}
+	defer rows.Close()
+	// Log_name, File_size (8.0 以后还有 Encrypted)
+	dest := make([]driver.Value, 2, 2)
+	err = rows.Next(dest)
+	if err != nil {
+		return ""
+	}
+	return string(dest[0].([]byte))
+}
+
+// binlog 文件
+type BinaryLog struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+}
+
+// SHOW BINARY LOGS，使用解析器的元数据连接，可在同步过程中调用
+func (parser *eventParser) showBinaryLogs() (logs []*BinaryLog, errs error) {
+	parser.connLock.Lock()
+	defer func() {
+		if err := recover(); err != nil {
+			if atomic.CompareAndSwapInt32(&parser.connStatus, 1, 0) {
+				parser.conn.Close()
+			}
+			errs = fmt.Errorf("%v", err)
+		}
+		parser.connLock.Unlock()
+	}()
+
+	if atomic.LoadInt32(&parser.connStatus) == 0 {
+		parser.initConn()
+	}
+	return queryBinaryLogs(parser.conn)
+}
+
+func queryBinaryLogs(conn MysqlConnection) ([]*BinaryLog, error) {
+	stmt, err := conn.Prepare("SHOW BINARY LOGS")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(make([]driver.Value, 0))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	logs := make([]*BinaryLog, 0)
+	for {
+		// Log_name, File_size (8.0 以后还有 Encrypted)
+		dest := make([]driver.Value, 2, 2)
+		if err := rows.Next(dest); err != nil {
+			break
+		}
+		size, _ := strconv.ParseUint(string(dest[1].([]byte)), 10, 64)
+		logs = append(logs, &BinaryLog{Name: string(dest[0].([]byte)), Size: size})
+	}
+	return logs, nil
+}
+
+// master 当前位点，以及 filename:position 之后未消费的 binlog 字节数
+// 最后一个 binlog 文件的大小即为 master 当前位点
+func (This *BinlogDump) MasterLag(filename string, position uint32) (masterFile string, masterPosition uint64, lag uint64, err error) {
+	parser := This.currentParser()
+	if parser == nil {
+		return "", 0, 0, fmt.Errorf("binlog dump not started")
+	}
+	logs, err := parser.showBinaryLogs()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if len(logs) == 0 {
+		return "", 0, 0, fmt.Errorf("binary log is not enabled")
+	}
+	masterFile, masterPosition = logs[len(logs)-1].Name, logs[len(logs)-1].Size
+	found := false
+	for _, binaryLog := range logs {
+		if binaryLog.Name == filename {
+			found = true
+			if binaryLog.Size > uint64(position) {
+				lag += binaryLog.Size - uint64(position)
+			}
+			continue
+		}
+		if found {
+			lag += binaryLog.Size
+		}
+	}
+	if !found {
+		return masterFile, masterPosition, 0, fmt.Errorf("binlog %s not found on master", filename)
+	}
+	return masterFile, masterPosition, lag, nil
+}
+
+// 请求的 binlog 文件已被清除，按 PurgedPolicy 重新定位，并报告跳过的区间
+func (This *BinlogDump) recoverPurgedBinlog(result chan error) {
+	This.parser.binlogPurged = false
+	fromFile, fromPos := This.parser.binlogFileName, This.parser.binlogPosition
+
+	var toFile string
+	var toPos uint32
+	switch This.PurgedPolicy {
+	case BINLOG_PURGED_EARLIEST:
+		toFile = This.getFirstBinlogFile()
+		toPos = 4
+	case BINLOG_PURGED_CURRENT:
+		filepos := This.getMasterFilePosition()
+		if len(filepos) >= 2 {
+			pos, err := strconv.ParseUint(filepos[1], 10, 64)
+			if err == nil {
+				toFile = filepos[0]
+				toPos = uint32(pos)
+			}
+		}
+	}
+
+	if toFile == "" {
+		err := fmt.Errorf("binlog %s:%d has been purged on master, policy: %s", fromFile, fromPos, This.PurgedPolicy)
+		This.logEntry().Error(err.Error())
+		result <- err
+		This.state.Transition(STATE_CLOSING)
+		return
+	}
+
+	err := fmt.Errorf("binlog %s:%d has been purged on master, events before %s:%d are lost, policy: %s", fromFile, fromPos, toFile, toPos, This.PurgedPolicy)
+	This.logEntry().Warn(err.Error())
+	result <- err
+	This.parser.binlogFileName = toFile
+	This.parser.binlogPosition = toPos
+}
+
 func (This *BinlogDump) startConnAndDumpBinlog(result chan error) {
 	
-	// 1. 初始化 mysql 连接，用于 dump binlog
-	dbopen := &mysqlDriver{}
-	conn, err := dbopen.Open(This.DataSource)
+	// 1. 初始化 mysql 连接，用于 dump binlog，配置了候选 master 时选择可写的实例
+	conn, dataSource, err := This.connectMaster()
 	if err != nil {
 		result <- err
 		time.Sleep(5 * time.Second)
-		log.Println("mysqlConn err:", err)
+		This.logEntry().WithError(err).Error("open dump connection")
+		return
+	}
+	// 建立连接期间被关闭
+	This.connLock.Lock()
+	if state := This.state.Load(); state == STATE_CLOSING || state == STATE_CLOSED {
+		This.connLock.Unlock()
+		conn.Close()
 		return
 	}
 	This.mysqlConn = conn.(MysqlConnection)
+	This.connLock.Unlock()
+
+	// 任何路径退出(包括 panic)都关闭 dump 连接并 kill master 上的 dump 线程
+	var connectionId string
+	defer func() {
+		This.releaseDumpConn(connectionId)
+	}()
+
+	// master 切换后按 GTID 续传
+	failover, err := This.checkFailover(conn.(*mysqlConn), dataSource)
+	if err != nil {
+		This.logEntry().WithError(err).Error("master failover")
+		result <- err
+		This.state.Transition(STATE_CLOSING)
+		return
+	}
+
+	This.checkDeliveredMaster()
+
+	// 设置会话超时，进程崩溃时由 master 清理 dump 线程
+	if err := This.setSessionTimeout(); err != nil {
+		This.logEntry().WithError(err).Warn("set dump session timeout")
+	}
+
+	// 设置心跳，master 失联时由读超时断开重连
+	if err := This.setHeartbeat(conn.(*mysqlConn)); err != nil {
+		This.logEntry().WithError(err).Warn("set dump heartbeat period")
+	}
+
+	// 配置的会话变量和初始化语句，可以覆盖以上设置
+	if err := This.initSession(); err != nil {
+		This.logEntry().WithError(err).Error("init dump session")
+		result <- err
+		return
+	}
 
 	// 2. 获取 mysql 连接ID
 	//*** get connection id start
@@ -728,40 +1352,67 @@ func (This *BinlogDump) startConnAndDumpBinlog(result chan error) {
 	stmt, err := This.mysqlConn.Prepare(sql)
 	if err != nil{
 		result <- err
-		log.Println("[error] SELECT connection_id() err:", err)
+		This.logEntry().WithError(err).Error("SELECT connection_id()")
 		return
 	}
 	p := make([]driver.Value, 0)
 	rows, err := stmt.Query(p)
-	var connectionId string
+	if err != nil{
+		result <- err
+		This.logEntry().WithError(err).Error("SELECT connection_id()")
+		return
+	}
 	for {
 		dest := make([]driver.Value, 1, 1)
 		err := rows.Next(dest)
 		if err != nil {
-			log.Println("[error] row Next err:", err)
+			This.logEntry().WithError(err).Error("SELECT connection_id() row Next")
 			break
 		}
 		connectionId = string(dest[0].([]byte))
 		break
 	}
-	log.Println("connectionId:", connectionId)
+	This.logEntry().Info("connectionId:", connectionId)
 	if connectionId == ""{
-		log.Println("[error] connectionId:null")
+		This.logEntry().Error("connectionId:null")
 		return
 	}
 
 	result <- fmt.Errorf("running") // 消息需要及时消费，否则是阻塞
+	This.state.CompareAndTransition(STATE_STARTING, STATE_RUNNING)
+	This.connLock.Lock()
 	This.parser.connectionId = connectionId
-	//go This.checkDumpConnection(connectionId)
+	This.connLock.Unlock()
 	//*** get connection id end
 
 	// 3. 获取 binlog file 和 pos，如果 filename 为空，则请求 mysql server 获取当前最新 file 和 pos.
-	if This.parser.binlogFileName==""{
+	if This.parser.seekPending() {
+		This.positionChecked = false
+	}
+	This.parser.applySeek()
+	// 按 GTID 同步时从已执行的集合续传，避免重连后重复投递
+	if This.parser.gtidSet != "" {
+		if gtidSet, ok := This.parser.gtid.String(); ok {
+			This.parser.gtidSet = gtidSet
+		}
+	}
+	if This.parser.binlogFileName=="" && This.parser.gtidSet == "" && !This.StartTime.IsZero() {
+		filename, position, err := This.locateTime(This.StartTime)
+		if err != nil {
+			This.logEntry().WithError(err).Error("locate start time")
+			result <- err
+			return
+		}
+		This.logEntry().With(logger.Fields{"start_time": This.StartTime, "binlog_file": filename, "binlog_pos": position}).Info("locate start time")
+		This.parser.binlogFileName = filename
+		This.parser.binlogPosition = position
+	}
+	if This.parser.binlogFileName=="" && This.parser.gtidSet == ""{
 		filepos := This.getMasterFilePosition()
 		if len(filepos) >=2 {
 			pos, err := strconv.ParseUint(filepos[1], 10, 64)
 			if err != nil {
-				log.Println("[error] getMasterFilePosition ParseUint pos error:", err)
+				This.logEntry().WithError(err).Error("getMasterFilePosition ParseUint pos")
 			}else{
 				This.parser.binlogFileName = filepos[0]
 				This.parser.binlogPosition = uint32(pos)
@@ -772,92 +1423,182 @@ func (This *BinlogDump) startConnAndDumpBinlog(result chan error) {
 	// 4. skip
 	This.checksum_enabled()
 
+	// 首次连接和重新定位后检查起始位点是否在事件边界上
+	if !This.positionChecked && This.parser.gtidSet == "" {
+		if !This.recoverInvalidPosition(result) {
+			return
+		}
+		This.positionChecked = true
+	}
+
+	// 预加载表结构，重连后整体刷新
+	if This.PreloadSchema {
+		if err := This.parser.preloadSchemas(); err != nil {
+			This.logEntry().WithError(err).Warn("preload table schema")
+		}
+	}
+
+	if failover != nil {
+		This.deliverFailover(failover)
+	}
+
 	// 5. 开始启动 binlog 同步，阻塞式运行，每个 binlog 事件会被 This.parser 解析并自动调用回调函数 This.CallbackFun 来处理。
 	This.mysqlConn.DumpBinlog(This.parser.binlogFileName, This.parser.binlogPosition, This.parser, This.CallbackFun, result)
 
-	// 6. 退出处理：关闭 dump binlog 的 mysql 连接。
-	This.connLock.Lock()
-	if This.mysqlConn != nil {
-		This.mysqlConn.Close()
-		This.mysqlConn = nil
+	// binlog 文件已被清除，在关闭连接前重新定位
+	if This.parser.binlogPurged {
+		This.recoverPurgedBinlog(result)
 	}
-	This.connLock.Unlock()
 
-
-	// 7. 退出处理：设置退出状态
-	switch This.parser.dumpBinLogStatus {
-	case 3:
-		break
-	case 2:
-		result <- fmt.Errorf("close")
-		This.Status = "close"
-		break
+	// 6. 退出处理：设置退出状态，非主动关闭时重新连接；dump 连接由 releaseDumpConn 关闭
+	switch This.state.Load() {
+	case STATE_CLOSING, STATE_CLOSED:
+		if !This.parser.completed {
+			result <- fmt.Errorf("close")
+		}
 	default:
 		result <- fmt.Errorf("starting")
-		This.Status = "stop"
+		This.state.CompareAndTransition(STATE_RUNNING, STATE_STARTING)
 	}
+}
 
-	// 7. ？？？
-	This.parser.KillConnect(This.parser.connectionId)
+// dump 连接会话超时，wait_timeout 作用于发送 COM_BINLOG_DUMP 之前的空闲，
+// net_write_timeout 作用于 master 向已失联的客户端发送事件
+func (This *BinlogDump) setSessionTimeout() error {
+	timeout := This.SessionTimeout
+	if timeout == 0 {
+		timeout = DUMP_SESSION_TIMEOUT
+	}
+	if timeout < 0 {
+		return nil
+	}
+	// DSN 中配置的会话变量优先
+	var params map[string]string
+	if mc, ok := This.mysqlConn.(*mysqlConn); ok {
+		params = mc.cfg.params
+	}
+	vars := make([]string, 0, 2)
+	for _, name := range []string{"wait_timeout", "net_write_timeout"} {
+		if _, ok := params[name]; !ok {
+			vars = append(vars, fmt.Sprintf("@@session.%s=%d", name, timeout))
+		}
+	}
+	if len(vars) == 0 {
+		return nil
+	}
+	_, err := This.mysqlConn.Exec("SET "+strings.Join(vars, ", "), make([]driver.Value, 0))
+	return err
 }
 
-func (This *BinlogDump) checkDumpConnection(connectionId string) {
-	defer func() {
-		if err := recover();err !=nil{
-			log.Println("binlog.go checkDumpConnection err:",err)
+// 执行 SlaveUUID 和 InitSQL
+func (This *BinlogDump) initSession() error {
+	statements := make([]string, 0, len(This.InitSQL)+1)
+	if This.SlaveUUID != "" {
+		statements = append(statements, "SET @slave_uuid='"+strings.Replace(This.SlaveUUID, "'", "''", -1)+"'")
+	}
+	statements = append(statements, This.InitSQL...)
+	for _, sql := range statements {
+		if _, err := This.mysqlConn.Exec(sql, make([]driver.Value, 0)); err != nil {
+			return fmt.Errorf("%s: %s", sql, err)
 		}
-	}()
+	}
+	return nil
+}
 
-	for{
-		time.Sleep(9 * time.Second)
+// 关闭 dump 连接并 kill master 上对应的 Binlog Dump 线程
+// 只关闭客户端连接时，master 上的线程要到下次写入失败才会退出
+func (This *BinlogDump) releaseDumpConn(connectionId string) {
+	This.connLock.Lock()
+	if This.mysqlConn != nil {
+		This.mysqlConn.Close()
+		This.mysqlConn = nil
+	}
+	if This.parser.connectionId == connectionId {
+		This.parser.connectionId = ""
+	}
+	This.connLock.Unlock()
 
-		// 同步状态: 0-stop, 1-running, 2-mysqlConn.Close, 3-KillConnect mysqlConn.Close.
-		if This.parser.dumpBinLogStatus >= 2 {
-			break
-		}
+	if connectionId == "" {
+		return
+	}
+	// KillDump 可能已经 kill 过，失败只记录
+	if !This.parser.KillConnect(connectionId) {
+		This.logEntry().With(logger.Fields{"connection_id": connectionId}).Debug("kill dump connection failed")
+	}
+}
 
-		// 获取 connectionId 对应的连接信息: TIME、STATE。
-		var m map[string]string
-		for i:=0;i<3;i++{
-			m = This.parser.GetConnectionInfo(connectionId)
-			if m == nil{
-				time.Sleep(2 * time.Second)
-				continue
-			}
-			break
-		}
+// 运行时重新定位到 filename:position，会重新建立 dump 连接
+func (This *BinlogDump) SeekTo(filename string, position uint32) error {
+	if filename == "" || position < 4 {
+		return fmt.Errorf("Invalid binlog position %s:%d", filename, position)
+	}
+	return This.seek(&seekPosition{binlogFileName: filename, binlogPosition: position})
+}
 
-		// log.Println("GetConnectionInfo:", m)
+// 运行时重新定位到 GTID 集合之后，会重新建立 dump 连接
+func (This *BinlogDump) SeekToGTID(gtidSet string) error {
+	if _, err := parseGTIDSet(gtidSet); err != nil {
+		return err
+	}
+	if gtidSet == "" {
+		return fmt.Errorf("Invalid GTID set")
+	}
+	return This.seek(&seekPosition{gtidSet: gtidSet, binlogPosition: 4})
+}
 
-		// ???
-		This.parser.connLock.Lock()
-		if connectionId != This.parser.connectionId {
-			This.parser.connLock.Unlock()
-			break
-		}
+func (This *BinlogDump) seek(pos *seekPosition) error {
+	parser := This.currentParser()
+	if parser == nil {
+		return fmt.Errorf("binlog dump not started")
+	}
+	if state := This.state.Load(); state == STATE_CLOSING || state == STATE_CLOSED {
+		return fmt.Errorf("binlog dump is %s", state)
+	}
+	parser.seekLock.Lock()
+	parser.seek = pos
+	parser.seekLock.Unlock()
 
-		// ???
-		if m == nil || m["TIME"] == "" {
-			log.Println("This.mysqlConn close, connectionId: ", connectionId)
-			This.connLock.Lock()
-			if This.mysqlConn != nil {
-				This.mysqlConn.Close()
-				This.mysqlConn = nil
-			}
-			This.connLock.Unlock()
-			break
-		}
-		This.parser.connLock.Unlock()
+	// 中断 dump 连接，使读取循环退出并按新位点重连，连接由读取循环自行关闭
+	This.connLock.Lock()
+	defer This.connLock.Unlock()
+	This.interruptConn()
+	return nil
+}
+
+// 当前同步状态
+func (This *BinlogDump) State() DumpState {
+	return This.state.Load()
+}
+
+// 当前 binlog 的格式，收到 FORMAT_DESCRIPTION_EVENT 之前为 nil
+func (This *BinlogDump) BinlogFormat() *BinlogFormat {
+	parser := This.currentParser()
+	if parser == nil {
+		return nil
 	}
+	info, _ := parser.binlogFormat.Load().(*BinlogFormat)
+	return info
 }
 
+// 订阅同步状态变更
+func (This *BinlogDump) Subscribe() <-chan DumpState {
+	return This.state.Subscribe()
+}
+
+func (This *BinlogDump) Unsubscribe(ch <-chan DumpState) {
+	This.state.Unsubscribe(ch)
+}
 
+// 暂停同步
 func (This *BinlogDump) Stop() {
-	This.parser.dumpBinLogStatus = 0
+	if !This.state.CompareAndTransition(STATE_RUNNING, STATE_PAUSED) {
+		This.state.CompareAndTransition(STATE_STARTING, STATE_PAUSED)
+	}
 }
 
+// 恢复同步
 func (This *BinlogDump) Start() {
-	This.parser.dumpBinLogStatus = 1
+	This.state.CompareAndTransition(STATE_PAUSED, STATE_RUNNING)
 }
 
 func (This *BinlogDump) Close() {
@@ -868,9 +1609,16 @@ func (This *BinlogDump) Close() {
 	}()
 	This.connLock.Lock()
 	defer This.connLock.Unlock()
-	This.parser.dumpBinLogStatus = 2
-	This.mysqlConn.Close()
-	This.mysqlConn = nil
+	This.state.Transition(STATE_CLOSING)
+	This.interruptConn()
+}
+
+// 中断 dump 连接上阻塞的读取，连接由 dump 协程退出时关闭
+// 直接 Close 会与读取中的 dump 协程竞争 bufReader
+func (This *BinlogDump) interruptConn() {
+	if mc, ok := This.mysqlConn.(*mysqlConn); ok {
+		mc.interrupt()
+	}
 }
 
 func (This *BinlogDump) KillDump() {
@@ -881,8 +1629,26 @@ func (This *BinlogDump) KillDump() {
 	}()
 	This.connLock.Lock()
 	defer This.connLock.Unlock()
-	This.parser.dumpBinLogStatus = 3
-	This.parser.KillConnect(This.parser.connectionId)
-	This.mysqlConn.Close()
-	This.mysqlConn = nil
+	This.state.Transition(STATE_CLOSING)
+	if This.parser != nil {
+		This.parser.KillConnect(This.parser.connectionId)
+	}
+	This.interruptConn()
+}
+
+// 优雅关闭
+// 停止读取新的事件，正在处理的事件回调执行完成后 dump 协程退出；同时 kill master 上的 dump 线程。
+// dump 协程已退出(STATE_CLOSED/STATE_COMPLETED)时返回 nil，ctx 先结束时返回 ctx.Err()，此时 dump 协程仍会在回调完成后退出。
+func (This *BinlogDump) Shutdown(ctx context.Context) error {
+	ch := This.Subscribe()
+	defer This.Unsubscribe(ch)
+	This.KillDump()
+	for state := This.State(); state != STATE_CLOSED && state != STATE_COMPLETED; state = This.State() {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
\ No newline at end of file
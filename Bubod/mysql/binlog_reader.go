@@ -0,0 +1,195 @@
+// 离线读取 binlog
+// 读取本地 binlog 文件，或通过非阻塞 dump 读取 master 上已有的一段 binlog，使用与同步相同的解码器解析事件，
+// 不保存位点、不投递输出，用于查看、导出和生成回滚语句等工具。
+//
+// 表结构按 TABLE_MAP_EVENT 从 DataSource 查询；没有 DataSource、表已删除或字段数与 binlog 不一致时，
+// 按 TABLE_MAP_EVENT 的字段类型生成表结构，字段名为 @1、@2...(同 mysqlbinlog -v)，无符号、枚举、集合按有符号整数、序号解码。
+// 查询到的是 master 当前的表结构，读取表结构变更之前的事件时字段可能对不上。
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// binlog 文件开头的魔数
+var binlogFileMagic = []byte{0xfe, 'b', 'i', 'n'}
+
+type BinlogReader struct {
+	DataSource   string          // master DSN，读取 master 上的 binlog 时必填，读取本地文件时用于查询表结构
+	ServerId     uint32          // 读取 master binlog 使用的 server_id，默认 0，非阻塞读取不影响其他复制连接
+	StopPosition uint32          // 非 0 时从该位点开始的事件不再读取(同 mysqlbinlog --stop-position)
+	RowFormat    string          // 行数据格式 ROW_FORMAT_*，默认 map
+	ImportSchema *SchemaSnapshot // 表结构快照，快照中的表不查询 information_schema，见 schema_snapshot.go
+}
+
+func (reader *BinlogReader) newParser() *eventParser {
+	parser := newEventParser()
+	parser.offline = true
+	parser.dataSource = &reader.DataSource
+	parser.rowFormat = reader.RowFormat
+	parser.importSchemaSnapshot(reader.ImportSchema)
+	return parser
+}
+
+// 读取本地 binlog 文件，从 start 开始的事件回调 fn，fn 返回错误时停止，每次只读取一个文件
+// 回调返回后事件的行数据会被回收，需要保留时调用 event.Retain()
+func (reader *BinlogReader) ReadFile(path string, start uint32, fn func(event *EventReslut) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 1<<20)
+
+	magic := make([]byte, len(binlogFileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, binlogFileMagic) {
+		return fmt.Errorf("%s is not a binlog file", path)
+	}
+	parser := reader.newParser()
+	parser.binlogFileName = path[strings.LastIndexAny(path, `/\`)+1:]
+	parser.binlogPosition = 4
+	checksum := false
+	header := make([]byte, 19)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("read %s at %d: %s", path, parser.binlogPosition, err)
+		}
+		eventSize := bytesToUint32(header[9:13])
+		if eventSize < 19 {
+			return fmt.Errorf("invalid event size %d at %d", eventSize, parser.binlogPosition)
+		}
+		data := make([]byte, eventSize)
+		copy(data, header)
+		if _, err := io.ReadFull(r, data[19:]); err != nil {
+			return fmt.Errorf("read %s at %d: %s", path, parser.binlogPosition, err)
+		}
+		if EventType(data[4]) == FORMAT_DESCRIPTION_EVENT {
+			checksum = formatDescriptionChecksum(data)
+		}
+		if checksum {
+			data = data[:len(data)-4]
+		}
+		done, err := reader.readEvent(parser, data, start, fn)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// 非阻塞地读取 master 上 filename 从 start 开始已有的事件，读到 master 当前位点后返回
+func (reader *BinlogReader) ReadMaster(filename string, start uint32, fn func(event *EventReslut) error) error {
+	if reader.DataSource == "" {
+		return fmt.Errorf("data source is required")
+	}
+	if start < 4 {
+		start = 4
+	}
+	parser := reader.newParser()
+	parser.binlogFileName = filename
+	parser.binlogPosition = start
+	var errs error
+	err := scanMasterBinlog(reader.DataSource, reader.ServerId, filename, start, func(header *EventHeader, data []byte) bool {
+		done, err := reader.readEvent(parser, data, start, fn)
+		errs = err
+		return err == nil && !done
+	})
+	if errs != nil {
+		return errs
+	}
+	return err
+}
+
+// 解析一个不含校验和的事件，返回是否已到达结束位点
+func (reader *BinlogReader) readEvent(parser *eventParser, data []byte, start uint32, fn func(event *EventReslut) error) (bool, error) {
+	header := new(EventHeader)
+	if err := header.Read(data); err != nil {
+		return false, err
+	}
+	filename := parser.binlogFileName
+	// master 生成的 ROTATE_EVENT 等位点为 0
+	if reader.StopPosition > 0 && header.LogPos > 0 && header.LogPos-header.EventSize >= reader.StopPosition {
+		return true, nil
+	}
+	event, _, err := parser.safeParseEvent(data)
+	if err != nil {
+		return false, fmt.Errorf("%s:%d %s: %s", filename, parser.binlogPosition, header.EventName(), err)
+	}
+	defer event.release()
+	if header.LogPos == 0 {
+		return false, nil
+	}
+	if event != nil && header.LogPos-header.EventSize >= start {
+		if event.Header.EventType == QUERY_EVENT && event.DDL != nil && event.DDL.TableName != "" {
+			event.SchemaName, event.TableName = event.DDL.SchemaName, event.DDL.TableName
+			parser.updateTableSchemaByDDL(event.DDL)
+		}
+		if event.BinlogFileName == "" {
+			event.BinlogFileName, event.BinlogPosition = filename, parser.binlogPosition
+		}
+		if err := fn(event); err != nil {
+			return false, err
+		}
+	}
+	if header.EventType == ROTATE_EVENT {
+		// 本地文件和 master 上的文件均以 ROTATE_EVENT 结束
+		return true, nil
+	}
+	parser.binlogPosition = header.LogPos
+	return false, nil
+}
+
+// 离线读取时的表结构，查询失败或字段数不一致时按 TABLE_MAP_EVENT 生成
+func (parser *eventParser) offlineTableSchema(tableId uint64, database string, tablename string) {
+	tableMap, ok := parser.tableMap[tableId]
+	if *parser.dataSource != "" {
+		parser.connLock.Lock()
+		err := parser.GetTableSchemaByName(tableId, database, tablename)
+		parser.connLock.Unlock()
+		if err == nil {
+			if schema := parser.schemas.get(tableId); schema != nil && (!ok || len(schema.columns) == len(tableMap.columnMetaData)) {
+				return
+			}
+		}
+	}
+	if !ok {
+		return
+	}
+	columns := make([]*column_schema_type, 0, len(tableMap.columnMetaData))
+	for i, meta := range tableMap.columnMetaData {
+		columns = append(columns, &column_schema_type{
+			COLUMN_NAME: "@" + strconv.Itoa(i+1),
+			COLUMN_TYPE: fieldTypeName(meta.column_type),
+			nullable:    tableMap.nullBitmap.isSet(uint(i)),
+			enum_values: make([]string, 0),
+			set_values:  make([]string, 0),
+		})
+	}
+	parser.setTableSchema(tableId, database+"."+tablename, columns)
+}
+
+// FORMAT_DESCRIPTION_EVENT 中的校验和算法，5.6.1 之前的版本没有校验和
+func formatDescriptionChecksum(data []byte) bool {
+	if len(data) < 71+5 {
+		return false
+	}
+	version := string(bytes.TrimRight(data[21:71], "\x00"))
+	parts := strings.SplitN(strings.SplitN(version, "-", 2)[0], ".", 3)
+	nums := make([]int, 3)
+	for i := 0; i < len(parts) && i < 3; i++ {
+		nums[i], _ = strconv.Atoi(parts[i])
+	}
+	if nums[0]*10000+nums[1]*100+nums[2] < 50601 {
+		return false
+	}
+	// 校验和算法 1 字节 + 校验和 4 字节，0 为 NONE，1 为 CRC32
+	return data[len(data)-5] == 1
+}
@@ -0,0 +1,91 @@
+// binlog 保留
+// SHOW BINARY LOGS 获取 master 上现有的 binlog 文件，最早文件的开头即为最早可以同步的位点；
+// 自动清除的保留时间为 MySQL 8.0 的 binlog_expire_logs_seconds，为 0 时为 expire_logs_days。
+// RDS/Aurora 模式下为 mysql.rds_show_configuration 的 binlog retention hours，见 rds.go。
+// binlog 文件在最后一次写入的保留时间之后才会被清除，因此已同步事件的时间加上保留时间是该文件最早被清除的时间。
+package mysql
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// master 上的 binlog 文件和保留时间
+type BinlogRetention struct {
+	Logs             []*BinaryLog `json:"logs"`
+	EarliestFile     string       `json:"earliest_file"` // 最早可以同步的位点
+	EarliestPosition uint32       `json:"earliest_position"`
+	ExpireSeconds    int64        `json:"expire_seconds"` // 自动清除的保留时间，0 为不自动清除
+}
+
+// 查询 master 的 binlog 文件和保留时间，使用独立连接
+func ShowBinlogRetention(dataSource string) (*BinlogRetention, error) {
+	conn, err := (&mysqlDriver{}).Open(dataSource)
+	if err != nil {
+		return nil, err
+	}
+	mc := conn.(*mysqlConn)
+	defer mc.Close()
+
+	logs, err := queryBinaryLogs(mc)
+	if err != nil {
+		return nil, err
+	}
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("binary log is not enabled")
+	}
+	retention := &BinlogRetention{Logs: logs, EarliestFile: logs[0].Name, EarliestPosition: 4}
+
+	if mc.cfg.rds {
+		hours, set, err := mc.rdsRetentionHours()
+		if err != nil {
+			return nil, err
+		}
+		retention.ExpireSeconds = hours * 3600
+		if !set {
+			retention.ExpireSeconds = int64(RDS_NULL_RETENTION / time.Second)
+		}
+		return retention, nil
+	}
+
+	// 5.7 没有 binlog_expire_logs_seconds
+	if val, err := mc.getSystemVar("binlog_expire_logs_seconds"); err == nil {
+		retention.ExpireSeconds, _ = strconv.ParseInt(val, 10, 64)
+	}
+	if retention.ExpireSeconds == 0 {
+		if val, err := mc.getSystemVar("expire_logs_days"); err == nil {
+			days, _ := strconv.ParseInt(val, 10, 64)
+			retention.ExpireSeconds = days * 86400
+		}
+	}
+	return retention, nil
+}
+
+// 当前 master 的 binlog 文件和保留时间
+func (This *BinlogDump) BinlogRetention() (*BinlogRetention, error) {
+	dataSource := This.master
+	if dataSource == "" {
+		dataSource = This.DataSource
+	}
+	return ShowBinlogRetention(dataSource)
+}
+
+// filename 是否还在 master 上
+func (retention *BinlogRetention) Contains(filename string) bool {
+	for _, binaryLog := range retention.Logs {
+		if binaryLog.Name == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// filename 最早被清除的时间，timestamp 为 filename 中已同步事件的时间
+// 当前写入的文件和不自动清除时返回零值
+func (retention *BinlogRetention) PurgeTime(filename string, timestamp uint32) time.Time {
+	if retention.ExpireSeconds <= 0 || timestamp == 0 || len(retention.Logs) == 0 || retention.Logs[len(retention.Logs)-1].Name == filename {
+		return time.Time{}
+	}
+	return time.Unix(int64(timestamp)+retention.ExpireSeconds, 0)
+}
@@ -0,0 +1,27 @@
+// 位点单调性
+// 已保存的位点只前进不回退: 伪 ROTATE_EVENT、心跳、重连后重复读取等边界情况下，新位点可能早于已保存的位点，
+// 此时保存会使重启后重复投递。文件位点按文件序号和偏移比较，GTID 集合按包含关系比较。
+// SeekTo、master 切换等有意的回退由调用方清空已保存的位点后再保存。
+package mysql
+
+// 文件位点 file:pos 是否不早于已保存的位点 savedFile:savedPos，已保存的位点为空时返回 true
+func PositionAdvances(savedFile string, savedPos uint32, file string, pos uint32) bool {
+	if savedFile == "" {
+		return true
+	}
+	return compareBinlogPosition(file, pos, savedFile, savedPos) >= 0
+}
+
+// GTID 集合 gtidSet 是否包含已保存的集合 saved 中的全部 GTID，saved 为空时返回 true
+func GTIDSetAdvances(saved string, gtidSet string) (bool, error) {
+	savedSids, err := parseGTIDSet(saved)
+	if err != nil || len(savedSids) == 0 {
+		return true, err
+	}
+	if _, err := parseGTIDSet(gtidSet); err != nil {
+		return false, err
+	}
+	tracker := newGTIDTracker()
+	tracker.reset(gtidSet)
+	return tracker.contains(savedSids), nil
+}
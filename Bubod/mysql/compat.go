@@ -0,0 +1,75 @@
+// 上游兼容性
+// 兼容 MySQL 协议但 binlog 语义不同的上游，启动前由 Preflight 识别，避免静默解码出错误的数据:
+//
+//  1. TiDB: 不支持 COM_BINLOG_DUMP，SHOW MASTER STATUS 的位点也不是 binlog 文件位点，前置检查不通过，
+//     需要先用 TiCDC 同步到 MySQL 再从该 MySQL dump
+//  2. Vitess vtgate: 不支持 binlog dump，GTID 为 vtgate 聚合各分片后的位点，前置检查不通过，需要连接 primary tablet 的 mysqld
+//  3. Vitess 管理的 mysqld(存在 _vt 库): binlog 与 MySQL 相同，但 reparent 会切换 primary，
+//     按文件位点无法在新 primary 上续传，前置检查要求配置 gtid_set；_vt.heartbeat 等内部表建议在表过滤中排除
+//
+// tableId 的稳定性: MySQL 的 tableId 在表定义缓存淘汰后可能分配给其他表，经过 binlog 中转的上游也不保证稳定，
+// TABLE_MAP_EVENT 的库表名或字段数与缓存的表结构不一致时重新获取表结构，不按旧的表结构解码。
+package mysql
+
+import (
+	"bubod/Bubod/logger"
+)
+
+// 上游类型
+const (
+	FLAVOR_MYSQL   = "mysql"
+	FLAVOR_MARIADB = "mariadb"
+	FLAVOR_TIDB    = "tidb"
+	FLAVOR_VITESS  = "vitess" // vtgate
+)
+
+// 服务端类型
+func (v *ServerVersion) Flavor() string {
+	switch {
+	case v.TiDB:
+		return FLAVOR_TIDB
+	case v.Vitess:
+		return FLAVOR_VITESS
+	case v.MariaDB:
+		return FLAVOR_MARIADB
+	default:
+		return FLAVOR_MYSQL
+	}
+}
+
+// 不支持 binlog dump 的上游，返回处理方法
+func (v *ServerVersion) unsupportedProblem() string {
+	switch {
+	case v.TiDB:
+		return "TiDB does not support binlog dump, replicate it to MySQL with TiCDC and dump from that MySQL"
+	case v.Vitess:
+		return "vtgate does not support binlog dump, connect to the mysqld of the primary tablet instead"
+	}
+	return ""
+}
+
+// mysqld 是否由 Vitess 管理
+func (mc *mysqlConn) managedByVitess() (bool, error) {
+	databases, err := mc.queryFirstColumn("SHOW DATABASES LIKE '\\_vt'")
+	return len(databases) > 0, err
+}
+
+// TABLE_MAP_EVENT 对应的表结构是否需要重新获取: 未缓存，或缓存的库表名、字段数与事件不一致
+func (parser *eventParser) staleTableSchema(event *TableMapEvent) bool {
+	schema := parser.schemas.get(event.tableId)
+	if schema == nil {
+		return true
+	}
+	name := event.schemaName + "." + event.tableName
+	if schema.name == name && len(schema.columns) == len(event.columnTypes) {
+		return false
+	}
+	parser.logEntry().With(logger.Fields{
+		"table_id":      event.tableId,
+		"cached":        schema.name,
+		"columns":       len(schema.columns),
+		"table":         name,
+		"event_columns": len(event.columnTypes),
+	}).Warn("table map does not match cached schema, reload table schema")
+	return true
+}
@@ -2,6 +2,7 @@ package mysql
 
 import (
 	"bufio"
+	"crypto/tls"
 	"database/sql/driver"
 	"errors"
 	"net"
@@ -19,17 +20,28 @@ type mysqlConn struct {
 	affectedRows   uint64
 	insertId       uint64
 	lastCmdTime    time.Time        //上个命令的执行时间戳
+	readStart      time.Time        //最近一次设置读超时的时间戳
 	keepaliveTimer *time.Timer 		//
 }
 
 // Mysql连接参数
 type config struct {
-	user   string
-	passwd string
-	net    string
-	addr   string
-	dbname string
-	params map[string]string
+	user         string
+	passwd       string
+	net          string
+	addr         string
+	dbname       string
+	params       map[string]string
+	timeout      time.Duration // 建立连接超时
+	readTimeout  time.Duration // 每个包的读超时
+	writeTimeout time.Duration // 每个包的写超时
+	tcpKeepalive time.Duration // TCP keepalive 探测间隔，0 为系统默认，小于 0 关闭
+	proxy        bool              // 代理兼容模式，见 proxy.go
+	connAttrs    map[string]string // 自定义连接属性
+	rds          bool              // RDS/Aurora 兼容模式，见 rds.go
+	tls          *tls.Config       // 为 nil 时不使用 TLS
+	credential   string            // 凭据提供者，见 credential.go
+	foundRows    bool              // CLIENT_FOUND_ROWS
 }
 
 //
@@ -57,13 +69,9 @@ func (mc *mysqlConn) handleParams() (e error) {
 				return
 			}
 
-		// TLS-Encryption
-		case "tls":
-			dbgLog.Print("TLS-Encryption not implemented yet")
-
 		// Compression
 		case "compress":
-			dbgLog.Print("Compression not implemented yet")
+			dbgLog.Debug("Compression not implemented yet")
 
 		// We don't want to set keepalive as system var
 		case "keepalive":
@@ -150,6 +158,13 @@ func (mc *mysqlConn) Close() (e error) {
 	return
 }
 
+// 关闭底层网络连接以中断阻塞中的读取，不修改连接状态，可在其他 goroutine 中调用
+func (mc *mysqlConn) interrupt() {
+	if netConn := mc.netConn; netConn != nil {
+		netConn.Close()
+	}
+}
+
 func (mc *mysqlConn) Prepare(query string) (driver.Stmt, error) {
 	// Send command
 	e := mc.writeCommandPacket(COM_STMT_PREPARE, query)
@@ -299,4 +314,13 @@ func NewConnect(uri string) MysqlConnection{
 		panic(err)
 	}
 	return conn.(MysqlConnection)
-}
\ No newline at end of file
+}
+// 建立普通连接，用于 applier 等写入目标库，失败时返回错误
+func Connect(uri string) (MysqlConnection, error) {
+	dbopen := &mysqlDriver{}
+	conn, err := dbopen.Open(uri)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(MysqlConnection), nil
+}
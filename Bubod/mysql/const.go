@@ -34,6 +34,9 @@ const (
 	CLIENT_SECURE_CONN
 	CLIENT_MULTI_STATEMENTS
 	CLIENT_MULTI_RESULTS
+	CLIENT_PS_MULTI_RESULTS
+	CLIENT_PLUGIN_AUTH
+	CLIENT_CONNECT_ATTRS
 )
 
 // sql类型
@@ -69,6 +72,8 @@ const (
 	COM_STMT_RESET
 	COM_SET_OPTION
 	COM_STMT_FETCH
+	COM_DAEMON
+	COM_BINLOG_DUMP_GTID
 )
 
 // mysql表字段值类型定义
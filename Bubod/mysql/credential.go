@@ -0,0 +1,289 @@
+// 外部凭据
+// 云环境通常禁止静态密码。DSN 配置 credentialProvider=name 时，每次建立连接(包括断线重连)前由注册的
+// CredentialProvider 生成密码，忽略 DSN 中的密码:
+//
+//   - RDSIAMProvider: AWS RDS/Aurora IAM 数据库认证令牌，有效期 15 分钟，
+//     AWS 凭据依次从环境变量、ECS 任务角色、EC2 实例角色(IMDSv2)获取
+//   - CloudSQLIAMProvider: GCP Cloud SQL IAM 数据库认证，使用 GCE/GKE 元数据服务的 OAuth2 访问令牌
+//   - CommandProvider: 执行命令，标准输出为密码，如 vault、gcloud auth print-access-token
+//   - CredentialFunc: 调用方注册的回调
+//
+// 令牌由服务端通过认证方式切换请求以 mysql_clear_password 明文获取，需要配置 tls=true(RDS、Cloud SQL 均要求 TLS)。
+// 令牌在有效期内缓存，元数据查询等短连接不会每次重新生成。
+package mysql
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RDS_IAM_TOKEN_TTL      = 15 * time.Minute // RDS IAM 令牌有效期
+	RDS_IAM_TOKEN_REFRESH  = 10 * time.Minute // 令牌缓存时间，留出建立连接的余量
+	CREDENTIAL_HTTP_TIMEOUT = 5 * time.Second
+)
+
+// 凭据提供者，返回建立连接使用的密码
+type CredentialProvider interface {
+	Password() (string, error)
+}
+
+// 回调形式的凭据提供者
+type CredentialFunc func() (string, error)
+
+func (f CredentialFunc) Password() (string, error) {
+	return f()
+}
+
+var credentialProviders = struct {
+	sync.RWMutex
+	m map[string]CredentialProvider
+}{m: make(map[string]CredentialProvider)}
+
+// 注册凭据提供者，DSN 中以 credentialProvider=name 引用，同名时覆盖
+func RegisterCredentialProvider(name string, provider CredentialProvider) {
+	credentialProviders.Lock()
+	defer credentialProviders.Unlock()
+	credentialProviders.m[name] = provider
+}
+
+// 生成 name 对应的密码
+func credentialPassword(name string) (string, error) {
+	credentialProviders.RLock()
+	provider, ok := credentialProviders.m[name]
+	credentialProviders.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("credential provider %q is not registered", name)
+	}
+	password, err := provider.Password()
+	if err != nil {
+		return "", fmt.Errorf("credential provider %q: %s", name, err)
+	}
+	return password, nil
+}
+
+// 有效期内缓存的密码
+type cachedCredential struct {
+	sync.Mutex
+	password string
+	expires  time.Time
+}
+
+// 缓存过期时调用 fetch 重新生成，fetch 返回密码和过期时间
+func (cache *cachedCredential) get(fetch func() (string, time.Time, error)) (string, error) {
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.password != "" && time.Now().Before(cache.expires) {
+		return cache.password, nil
+	}
+	password, expires, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	cache.password, cache.expires = password, expires
+	return password, nil
+}
+
+// AWS RDS/Aurora IAM 数据库认证令牌
+// 账号需要 CREATE USER ... IDENTIFIED WITH AWSAuthenticationPlugin AS 'RDS'，IAM 策略授予 rds-db:connect
+type RDSIAMProvider struct {
+	Region string // 为空时取环境变量 AWS_REGION
+	Addr   string // 实例地址 host:port，与 DSN 中的地址相同
+	User   string
+	cache  cachedCredential
+}
+
+func (provider *RDSIAMProvider) Password() (string, error) {
+	return provider.cache.get(func() (string, time.Time, error) {
+		region := provider.Region
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if region == "" {
+			return "", time.Time{}, fmt.Errorf("aws region is required")
+		}
+		creds, err := loadAWSCredentials()
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		now := time.Now()
+		return rdsAuthToken(provider.Addr, region, provider.User, creds, now.UTC()), now.Add(RDS_IAM_TOKEN_REFRESH), nil
+	})
+}
+
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+}
+
+// 生成 RDS IAM 认证令牌，为 SigV4 预签名的 connect 请求去掉 scheme 后的 URL
+func rdsAuthToken(addr string, region string, user string, creds *awsCredentials, now time.Time) string {
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	scope := date + "/" + region + "/rds-db/aws4_request"
+	query := map[string]string{
+		"Action":              "connect",
+		"DBUser":              user,
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    creds.AccessKeyId + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       fmt.Sprint(int(RDS_IAM_TOKEN_TTL / time.Second)),
+		"X-Amz-SignedHeaders": "host",
+	}
+	if creds.Token != "" {
+		query["X-Amz-Security-Token"] = creds.Token
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, awsEscape(k)+"="+awsEscape(query[k]))
+	}
+	canonicalQuery := strings.Join(pairs, "&")
+
+	emptyHash := sha256.Sum256(nil)
+	canonicalRequest := "GET\n/\n" + canonicalQuery + "\nhost:" + addr + "\n\nhost\n" + hex.EncodeToString(emptyHash[:])
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, "rds-db", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	return addr + "/?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// SigV4 的 URI 编码，只保留 A-Za-z0-9-_.~
+func awsEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// AWS 凭据: 环境变量 AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY/AWS_SESSION_TOKEN，ECS 任务角色，EC2 实例角色
+func loadAWSCredentials() (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{AccessKeyId: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		creds := &awsCredentials{}
+		return creds, credentialHTTPJson("GET", "http://169.254.170.2"+uri, nil, creds)
+	}
+	// IMDSv2
+	token, err := credentialHTTP("PUT", "http://169.254.169.254/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "300"})
+	if err != nil {
+		return nil, fmt.Errorf("aws credentials not found: %s", err)
+	}
+	header := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+	role, err := credentialHTTP("GET", "http://169.254.169.254/latest/meta-data/iam/security-credentials/", header)
+	if err != nil {
+		return nil, err
+	}
+	creds := &awsCredentials{}
+	name := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+	return creds, credentialHTTPJson("GET", "http://169.254.169.254/latest/meta-data/iam/security-credentials/"+name, header, creds)
+}
+
+// GCP Cloud SQL IAM 数据库认证，密码为服务账号的 OAuth2 访问令牌
+// 不在 GCE/GKE 上运行时可以使用 CommandProvider 执行 gcloud auth print-access-token
+type CloudSQLIAMProvider struct {
+	ServiceAccount string // 元数据服务中的服务账号，为空时为 default
+	cache          cachedCredential
+}
+
+func (provider *CloudSQLIAMProvider) Password() (string, error) {
+	return provider.cache.get(func() (string, time.Time, error) {
+		account := provider.ServiceAccount
+		if account == "" {
+			account = "default"
+		}
+		var token struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int64  `json:"expires_in"`
+		}
+		err := credentialHTTPJson("GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/"+account+"/token",
+			map[string]string{"Metadata-Flavor": "Google"}, &token)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		// 提前 1 分钟过期
+		return token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn-60) * time.Second), nil
+	})
+}
+
+// 执行命令生成密码，标准输出去掉首尾空白为密码，TTL 大于 0 时缓存
+type CommandProvider struct {
+	Command string        // 由 sh -c 执行
+	Timeout time.Duration // 为 0 时为 CREDENTIAL_HTTP_TIMEOUT
+	TTL     time.Duration
+	cache   cachedCredential
+}
+
+func (provider *CommandProvider) Password() (string, error) {
+	return provider.cache.get(func() (string, time.Time, error) {
+		timeout := provider.Timeout
+		if timeout <= 0 {
+			timeout = CREDENTIAL_HTTP_TIMEOUT
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "sh", "-c", provider.Command).Output()
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("run %q: %s", provider.Command, err)
+		}
+		return strings.TrimSpace(string(out)), time.Now().Add(provider.TTL), nil
+	})
+}
+
+func credentialHTTP(method string, url string, header map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := (&http.Client{Timeout: CREDENTIAL_HTTP_TIMEOUT}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return body, nil
+}
+
+func credentialHTTPJson(method string, url string, header map[string]string, v interface{}) error {
+	body, err := credentialHTTP(method, url, header)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
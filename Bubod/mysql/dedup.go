@@ -0,0 +1,65 @@
+// 重连去重
+// 按文件位点重连或重启实例时，从已保存的位点开始读取，最后几个已投递的事件(如事务中间断开时已投递的 rows 事件、
+// 保存位点之后已投递的事件)会被再次读取。配置 DedupWindow 后，与最后投递的位点比较:
+// 事件的结束位点不晚于最后投递的位点，且事件时间不早于最后投递事件的时间减去 DedupWindow 时视为重复，不再投递。
+//
+// 事件时间早于窗口的事件(如运维有意回退到很早的位点)照常投递；重新定位(SeekTo/SeekToGTID)后清空最后投递的位点；
+// master 切换(server_uuid 变化)后文件位点不可比较，同样清空，由 GTID 续传避免重复投递完整的事务。
+package mysql
+
+import (
+	"time"
+
+	"bubod/Bubod/metrics"
+)
+
+// 最后投递的事件
+type DeliveredPosition struct {
+	File       string
+	Position   uint32 // 事件结束位置
+	Timestamp  uint32
+	ServerUUID string // 投递时连接的 master
+}
+
+// 清空，之后的事件均不视为重复
+func (delivered *DeliveredPosition) Reset() {
+	*delivered = DeliveredPosition{}
+}
+
+// 事件是否已投递过
+func (parser *eventParser) duplicate(event *EventReslut) bool {
+	delivered := parser.delivered
+	if parser.dedupWindow <= 0 || delivered == nil || delivered.File == "" || event.Header.LogPos == 0 {
+		return false
+	}
+	if int64(event.Header.Timestamp)+int64(parser.dedupWindow/time.Second) < int64(delivered.Timestamp) {
+		return false
+	}
+	if compareBinlogPosition(event.BinlogFileName, event.Header.LogPos, delivered.File, delivered.Position) > 0 {
+		return false
+	}
+	metrics.EventsDeduplicated.Inc(parser.name)
+	return true
+}
+
+// 记录最后投递的事件
+func (parser *eventParser) markDelivered(event *EventReslut) {
+	if parser.delivered == nil || event.Header.LogPos == 0 {
+		return
+	}
+	parser.delivered.File = event.BinlogFileName
+	parser.delivered.Position = event.Header.LogPos
+	parser.delivered.Timestamp = event.Header.Timestamp
+}
+
+// 连接 master 后调用，master 变化时清空最后投递的位点
+func (This *BinlogDump) checkDeliveredMaster() {
+	delivered := This.parser.delivered
+	if delivered == nil || This.serverUUID == "" {
+		return
+	}
+	if delivered.ServerUUID != "" && delivered.ServerUUID != This.serverUUID {
+		delivered.Reset()
+	}
+	delivered.ServerUUID = This.serverUUID
+}
@@ -12,7 +12,10 @@ func (d *mysqlDriver) Open(dsn string) (driver.Conn, error) {
 	var e error
 	// New mysqlConn
 	mc := new(mysqlConn)
-	mc.cfg = parseDSN(dsn)
+	mc.cfg, e = parseDSN(dsn)
+	if e != nil {
+		return nil, e
+	}
 
 	if mc.cfg.dbname == "" {
 		e = errors.New("Incomplete or invalid DSN")
@@ -20,7 +23,9 @@ func (d *mysqlDriver) Open(dsn string) (driver.Conn, error) {
 	}
 
 	// Connect to Server
-	mc.netConn, e = net.Dial(mc.cfg.net, mc.cfg.addr)
+	// TCP keepalive 避免空闲连接被 NAT 网关、防火墙静默回收
+	dialer := &net.Dialer{Timeout: mc.cfg.timeout, KeepAlive: mc.cfg.tcpKeepalive}
+	mc.netConn, e = dialer.Dial(mc.cfg.net, mc.cfg.addr)
 	if e != nil {
 		return nil, e
 	}
@@ -34,6 +39,22 @@ func (d *mysqlDriver) Open(dsn string) (driver.Conn, error) {
 		return nil, e
 	}
 
+	// TLS
+	if mc.cfg.tls != nil {
+		if e = mc.startTLS(); e != nil {
+			mc.netConn.Close()
+			return nil, e
+		}
+	}
+
+	// 外部凭据，每次建立连接前获取
+	if mc.cfg.credential != "" {
+		if mc.cfg.passwd, e = credentialPassword(mc.cfg.credential); e != nil {
+			mc.netConn.Close()
+			return nil, e
+		}
+	}
+
 	// Send Client Authentication Packet
 	e = mc.writeAuthPacket()
 	if e != nil {
@@ -41,7 +62,7 @@ func (d *mysqlDriver) Open(dsn string) (driver.Conn, error) {
 	}
 
 	// Read Result Packet
-	e = mc.readResultOK()
+	e = mc.readAuthResult()
 	if e != nil {
 		return nil, e
 	}
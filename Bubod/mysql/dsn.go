@@ -0,0 +1,264 @@
+package mysql
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_HOST = "127.0.0.1"
+	DEFAULT_PORT = 3306
+)
+
+// 数据源连接参数
+// 格式 [user[:password]@][tcp(host:port)|unix(/path/to/socket)]/dbname[?param1=value1&paramN=valueN]
+type DSN struct {
+	User         string
+	Password     string
+	Host         string
+	Port         int
+	Socket       string // unix socket，非空时忽略 Host/Port
+	DBName       string
+	Charset      string
+	TLS          string        // true/false/skip-verify，true 时校验服务端证书
+	Timeout      time.Duration // 建立连接超时
+	ReadTimeout  time.Duration // 读超时，binlog 流空闲时同样生效，需大于 master 心跳间隔
+	WriteTimeout time.Duration // 写超时
+	Keepalive    int64         // 保活间隔(秒)，1 为取 wait_timeout - 60
+	TCPKeepalive time.Duration // TCP keepalive 探测间隔，0 为系统默认(15s)，小于 0 关闭
+	Proxy        bool          // 通过 ProxySQL/MySQL Router 等代理连接，见 proxy.go
+	ConnAttrs    map[string]string // 代理模式下追加的连接属性，connectionAttributes=k1:v1,k2:v2
+	RDS          bool              // 连接 AWS RDS/Aurora，见 rds.go
+	Credential   string            // 凭据提供者名称，每次连接前生成密码，见 credential.go
+	FoundRows    bool              // clientFoundRows=true 时 UPDATE 返回匹配的行数，而不是修改的行数
+	Params       map[string]string // 其他参数，连接后作为会话变量 SET
+}
+
+// 解析 DSN
+func ParseDSN(dsn string) (*DSN, error) {
+	matches := dsnPattern.FindStringSubmatch(dsn)
+	if matches == nil {
+		return nil, fmt.Errorf("invalid dsn %q", dsn)
+	}
+	d := &DSN{Params: make(map[string]string)}
+	var network, addr string
+	for i, name := range dsnPattern.SubexpNames() {
+		match := matches[i]
+		switch name {
+		case "user":
+			d.User = match
+		case "passwd":
+			d.Password = match
+		case "net":
+			network = match
+		case "addr":
+			addr = match
+		case "dbname":
+			d.DBName = match
+		case "params":
+			for _, v := range strings.Split(match, "&") {
+				param := strings.SplitN(v, "=", 2)
+				if len(param) != 2 {
+					continue
+				}
+				if err := d.setParam(param[0], param[1]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	switch network {
+	case "unix":
+		d.Socket = addr
+	case "", "tcp", "tcp4", "tcp6":
+		if addr == "" {
+			break
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			// 未指定端口
+			host, port = addr, ""
+		}
+		d.Host = host
+		if port != "" {
+			if d.Port, err = strconv.Atoi(port); err != nil || d.Port <= 0 || d.Port > 65535 {
+				return nil, fmt.Errorf("invalid port %q in dsn", port)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported network %q in dsn", network)
+	}
+	return d, nil
+}
+
+func (d *DSN) setParam(key string, val string) (err error) {
+	switch key {
+	case "charset":
+		d.Charset = val
+	case "tls":
+		switch val {
+		case "true", "false", "skip-verify":
+		default:
+			return fmt.Errorf("invalid tls %q in dsn", val)
+		}
+		d.TLS = val
+	case "timeout":
+		d.Timeout, err = parseDSNDuration(key, val)
+	case "readTimeout":
+		d.ReadTimeout, err = parseDSNDuration(key, val)
+	case "writeTimeout":
+		d.WriteTimeout, err = parseDSNDuration(key, val)
+	case "keepalive":
+		if d.Keepalive, err = strconv.ParseInt(val, 10, 64); err != nil {
+			err = fmt.Errorf("invalid keepalive %q in dsn", val)
+		}
+	case "proxy":
+		if d.Proxy, err = strconv.ParseBool(val); err != nil {
+			err = fmt.Errorf("invalid proxy %q in dsn", val)
+		}
+	case "rds":
+		if d.RDS, err = strconv.ParseBool(val); err != nil {
+			err = fmt.Errorf("invalid rds %q in dsn", val)
+		}
+	case "credentialProvider":
+		d.Credential = val
+	case "clientFoundRows":
+		if d.FoundRows, err = strconv.ParseBool(val); err != nil {
+			err = fmt.Errorf("invalid clientFoundRows %q in dsn", val)
+		}
+	case "connectionAttributes":
+		d.ConnAttrs, err = ParseConnAttrs(val)
+	case "tcpKeepalive":
+		if d.TCPKeepalive, err = time.ParseDuration(val); err != nil {
+			err = fmt.Errorf("invalid tcpKeepalive %q in dsn", val)
+		}
+	default:
+		d.Params[key] = val
+	}
+	return
+}
+
+func parseDSNDuration(key string, val string) (time.Duration, error) {
+	v, err := time.ParseDuration(val)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid %s %q in dsn", key, val)
+	}
+	return v, nil
+}
+
+// 连接地址，未指定时为 127.0.0.1:3306
+func (d *DSN) Addr() (string, string) {
+	if d.Socket != "" {
+		return "unix", d.Socket
+	}
+	host, port := d.Host, d.Port
+	if host == "" {
+		host = DEFAULT_HOST
+	}
+	if port == 0 {
+		port = DEFAULT_PORT
+	}
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// 检查必填项
+func (d *DSN) Validate() error {
+	if d.User == "" {
+		return fmt.Errorf("dsn user is required")
+	}
+	if d.DBName == "" {
+		return fmt.Errorf("dsn dbname is required")
+	}
+	if d.Port < 0 || d.Port > 65535 {
+		return fmt.Errorf("invalid dsn port %d", d.Port)
+	}
+	return nil
+}
+
+// 生成 DSN，参数按名称排序
+func (d *DSN) String() string {
+	var b strings.Builder
+	if d.User != "" || d.Password != "" {
+		b.WriteString(d.User)
+		if d.Password != "" {
+			b.WriteString(":" + d.Password)
+		}
+		b.WriteString("@")
+	}
+	network, addr := d.Addr()
+	b.WriteString(network + "(" + addr + ")/" + d.DBName)
+
+	params := make(map[string]string, len(d.Params)+6)
+	for k, v := range d.Params {
+		params[k] = v
+	}
+	if d.Charset != "" {
+		params["charset"] = d.Charset
+	}
+	if d.TLS != "" {
+		params["tls"] = d.TLS
+	}
+	if d.Timeout > 0 {
+		params["timeout"] = d.Timeout.String()
+	}
+	if d.ReadTimeout > 0 {
+		params["readTimeout"] = d.ReadTimeout.String()
+	}
+	if d.WriteTimeout > 0 {
+		params["writeTimeout"] = d.WriteTimeout.String()
+	}
+	if d.Keepalive != 0 {
+		params["keepalive"] = strconv.FormatInt(d.Keepalive, 10)
+	}
+	if d.TCPKeepalive != 0 {
+		params["tcpKeepalive"] = d.TCPKeepalive.String()
+	}
+	if d.Proxy {
+		params["proxy"] = "true"
+	}
+	if d.RDS {
+		params["rds"] = "true"
+	}
+	if d.Credential != "" {
+		params["credentialProvider"] = d.Credential
+	}
+	if d.FoundRows {
+		params["clientFoundRows"] = "true"
+	}
+	if len(d.ConnAttrs) > 0 {
+		attrs := make([]string, 0, len(d.ConnAttrs))
+		for k, v := range d.ConnAttrs {
+			attrs = append(attrs, k+":"+v)
+		}
+		sort.Strings(attrs)
+		params["connectionAttributes"] = strings.Join(attrs, ",")
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteString("?")
+		} else {
+			b.WriteString("&")
+		}
+		b.WriteString(k + "=" + params[k])
+	}
+	return b.String()
+}
+
+// 隐藏密码，用于日志和状态输出
+func (d *DSN) Redacted() string {
+	c := *d
+	if c.Password != "" {
+		c.Password = "***"
+	}
+	return c.String()
+}
@@ -0,0 +1,150 @@
+// binlog dump 同步状态机
+package mysql
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// 同步状态
+type DumpState int32
+
+const (
+	STATE_STARTING DumpState = iota // 正在建立 dump 连接
+	STATE_RUNNING                   // 正在同步
+	STATE_PAUSED                    // 暂停
+	STATE_CLOSING                   // 正在关闭
+	STATE_CLOSED                    // 已关闭
+	STATE_COMPLETED                 // 已到达结束条件 StopAt，不再重连
+)
+
+func (s DumpState) String() string {
+	switch s {
+	case STATE_STARTING:
+		return "starting"
+	case STATE_RUNNING:
+		return "running"
+	case STATE_PAUSED:
+		return "paused"
+	case STATE_CLOSING:
+		return "closing"
+	case STATE_CLOSED:
+		return "closed"
+	case STATE_COMPLETED:
+		return "completed"
+	}
+	return "unknown"
+}
+
+// 状态机，零值可用，初始状态为 STATE_STARTING
+// 状态读写均为原子操作，状态变更会通知所有订阅者
+type dumpState struct {
+	state       int32
+	lock        sync.Mutex
+	changed     chan struct{}     // 每次状态变更时 close 并替换，用于阻塞等待状态变更
+	subscribers []chan DumpState
+}
+
+// 允许的状态转换
+func canTransition(from DumpState, to DumpState) bool {
+	switch from {
+	case STATE_CLOSING:
+		return to == STATE_CLOSED || to == STATE_COMPLETED
+	case STATE_CLOSED, STATE_COMPLETED:
+		return false
+	}
+	return from != to
+}
+
+func (s *dumpState) Load() DumpState {
+	return DumpState(atomic.LoadInt32(&s.state))
+}
+
+// 转换到 to 状态，不允许的转换返回 false
+func (s *dumpState) Transition(to DumpState) bool {
+	for {
+		from := s.Load()
+		if !canTransition(from, to) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.state, int32(from), int32(to)) {
+			s.notify(to)
+			return true
+		}
+	}
+}
+
+// 仅当前状态为 from 时转换到 to
+func (s *dumpState) CompareAndTransition(from DumpState, to DumpState) bool {
+	if !canTransition(from, to) {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&s.state, int32(from), int32(to)) {
+		s.notify(to)
+		return true
+	}
+	return false
+}
+
+// 重置状态，用于重新开始同步
+func (s *dumpState) reset(to DumpState) {
+	atomic.StoreInt32(&s.state, int32(to))
+	s.notify(to)
+}
+
+// 返回一个在下次状态变更时被 close 的 channel
+func (s *dumpState) Changed() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return s.changed
+}
+
+// 阻塞直到状态不为 state
+func (s *dumpState) WaitWhile(state DumpState) DumpState {
+	for {
+		changed := s.Changed()
+		if current := s.Load(); current != state {
+			return current
+		}
+		<-changed
+	}
+}
+
+// 订阅状态变更，订阅者需要及时消费，channel 满时新的状态会被丢弃，不会阻塞同步
+func (s *dumpState) Subscribe() <-chan DumpState {
+	ch := make(chan DumpState, 16)
+	s.lock.Lock()
+	s.subscribers = append(s.subscribers, ch)
+	s.lock.Unlock()
+	return ch
+}
+
+func (s *dumpState) Unsubscribe(ch <-chan DumpState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, sub := range s.subscribers {
+		if sub == ch {
+			s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
+			close(sub)
+			return
+		}
+	}
+}
+
+func (s *dumpState) notify(state DumpState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+	for _, sub := range s.subscribers {
+		select {
+		case sub <- state:
+		default:
+		}
+	}
+}
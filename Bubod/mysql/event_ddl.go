@@ -0,0 +1,375 @@
+// DDL 语句解析
+// QUERY_EVENT 中的 DDL 语句只以文本形式出现，这里将其解析成结构化的 DDLEvent，
+// 便于下游(如 applier、schema registry)根据表结构变更做出处理。
+package mysql
+
+import (
+	"strings"
+)
+
+// DDL 操作类型
+const (
+	DDL_CREATE_DATABASE = "CREATE_DATABASE"
+	DDL_ALTER_DATABASE  = "ALTER_DATABASE"
+	DDL_DROP_DATABASE   = "DROP_DATABASE"
+	DDL_CREATE_TABLE    = "CREATE_TABLE"
+	DDL_ALTER_TABLE     = "ALTER_TABLE"
+	DDL_DROP_TABLE      = "DROP_TABLE"
+	DDL_RENAME_TABLE    = "RENAME_TABLE"
+	DDL_TRUNCATE_TABLE  = "TRUNCATE_TABLE"
+	DDL_CREATE_INDEX    = "CREATE_INDEX"
+	DDL_DROP_INDEX      = "DROP_INDEX"
+)
+
+// 结构化的 DDL 事件
+type DDLEvent struct {
+	Operation  string         `json:"operation"`         // 操作类型 DDL_*
+	SchemaName string         `json:"schema"`            // 库，语句中未指定时为 QUERY_EVENT 的默认库
+	TableName  string         `json:"table"`             // 表，库级操作时为空
+	Statement  string         `json:"statement"`         // 去掉注释、合并空白后的语句
+	Renames    []*TableRename `json:"renames,omitempty"` // RENAME TABLE / ALTER TABLE ... RENAME 的新旧表名
+	Tables     []*DDLTable    `json:"tables,omitempty"`  // DROP TABLE t1, t2 删除的所有表，第一个表同 SchemaName/TableName
+}
+
+// DDL 涉及的表
+type DDLTable struct {
+	SchemaName string `json:"schema"`
+	TableName  string `json:"table"`
+}
+
+// 表重命名 old => new
+type TableRename struct {
+	SchemaName    string `json:"schema"`
+	TableName     string `json:"table"`
+	NewSchemaName string `json:"new_schema"`
+	NewTableName  string `json:"new_table"`
+}
+
+// 解析 sql，非 DDL 语句返回 nil
+// defaultSchema 为 QUERY_EVENT 中记录的默认库(use db)
+func ParseDDL(sql string, defaultSchema string) *DDLEvent {
+	statement := NormalizeStatement(sql)
+	tokens := splitStatement(statement)
+	if len(tokens) < 2 {
+		return nil
+	}
+
+	ddl := &DDLEvent{
+		SchemaName: defaultSchema,
+		Statement:  statement,
+	}
+
+	var name string
+	switch strings.ToUpper(tokens[0]) {
+	case "CREATE":
+		tokens = skipKeywords(tokens[1:], "OR", "REPLACE", "TEMPORARY", "UNIQUE", "FULLTEXT", "SPATIAL")
+		if len(tokens) < 2 {
+			return nil
+		}
+		switch strings.ToUpper(tokens[0]) {
+		case "DATABASE", "SCHEMA":
+			ddl.Operation = DDL_CREATE_DATABASE
+			ddl.SchemaName = unquoteIdentifier(firstToken(skipKeywords(tokens[1:], "IF", "NOT", "EXISTS")))
+			return ddl
+		case "TABLE":
+			ddl.Operation = DDL_CREATE_TABLE
+			name = firstToken(skipKeywords(tokens[1:], "IF", "NOT", "EXISTS"))
+		case "INDEX":
+			// CREATE INDEX idx ON tbl (...)
+			ddl.Operation = DDL_CREATE_INDEX
+			name = tokenAfter(tokens, "ON")
+		default:
+			return nil
+		}
+	case "ALTER":
+		tokens = skipKeywords(tokens[1:], "ONLINE", "OFFLINE", "IGNORE")
+		if len(tokens) < 2 {
+			return nil
+		}
+		switch strings.ToUpper(tokens[0]) {
+		case "DATABASE", "SCHEMA":
+			ddl.Operation = DDL_ALTER_DATABASE
+			if len(tokens) > 2 {
+				ddl.SchemaName = unquoteIdentifier(tokens[1])
+			}
+			return ddl
+		case "TABLE":
+			ddl.Operation = DDL_ALTER_TABLE
+			name = tokens[1]
+			// ALTER TABLE a RENAME [TO|AS] b
+			for i := 2; i < len(tokens)-1; i++ {
+				if strings.ToUpper(tokens[i]) != "RENAME" {
+					continue
+				}
+				next := skipKeywords(tokens[i+1:], "TO", "AS")
+				if len(next) == 0 {
+					break
+				}
+				switch strings.ToUpper(next[0]) {
+				case "COLUMN", "INDEX", "KEY":
+				default:
+					ddl.Renames = append(ddl.Renames, newTableRename(name, next[0], defaultSchema))
+				}
+				break
+			}
+		default:
+			return nil
+		}
+	case "DROP":
+		tokens = skipKeywords(tokens[1:], "TEMPORARY")
+		if len(tokens) < 2 {
+			return nil
+		}
+		switch strings.ToUpper(tokens[0]) {
+		case "DATABASE", "SCHEMA":
+			ddl.Operation = DDL_DROP_DATABASE
+			ddl.SchemaName = unquoteIdentifier(firstToken(skipKeywords(tokens[1:], "IF", "EXISTS")))
+			return ddl
+		case "TABLE":
+			// DROP TABLE t1, t2 [RESTRICT|CASCADE]
+			ddl.Operation = DDL_DROP_TABLE
+			for _, table := range splitTableList(skipKeywords(tokens[1:], "IF", "EXISTS")) {
+				schemaName, tableName := splitTableName(table)
+				if schemaName == "" {
+					schemaName = defaultSchema
+				}
+				ddl.Tables = append(ddl.Tables, &DDLTable{SchemaName: schemaName, TableName: tableName})
+			}
+			if len(ddl.Tables) == 0 {
+				return nil
+			}
+			ddl.SchemaName, ddl.TableName = ddl.Tables[0].SchemaName, ddl.Tables[0].TableName
+			return ddl
+		case "INDEX":
+			ddl.Operation = DDL_DROP_INDEX
+			name = tokenAfter(tokens, "ON")
+		default:
+			return nil
+		}
+	case "RENAME":
+		// RENAME TABLE a TO b [, c TO d]
+		if strings.ToUpper(tokens[1]) != "TABLE" || len(tokens) < 3 {
+			return nil
+		}
+		ddl.Operation = DDL_RENAME_TABLE
+		name = tokens[2]
+		for i := 2; i+2 < len(tokens); i += 3 {
+			if strings.ToUpper(tokens[i+1]) != "TO" {
+				break
+			}
+			ddl.Renames = append(ddl.Renames, newTableRename(tokens[i], tokens[i+2], defaultSchema))
+		}
+	case "TRUNCATE":
+		ddl.Operation = DDL_TRUNCATE_TABLE
+		name = firstToken(skipKeywords(tokens[1:], "TABLE"))
+	default:
+		return nil
+	}
+
+	if name == "" {
+		return nil
+	}
+	schemaName, tableName := splitTableName(name)
+	if schemaName != "" {
+		ddl.SchemaName = schemaName
+	}
+	ddl.TableName = tableName
+	return ddl
+}
+
+// DROP TABLE 删除的所有表，Tables 为空时(如旧版本写入的事件)为 SchemaName.TableName
+func (ddl *DDLEvent) DropTables() []*DDLTable {
+	if len(ddl.Tables) > 0 {
+		return ddl.Tables
+	}
+	return []*DDLTable{{SchemaName: ddl.SchemaName, TableName: ddl.TableName}}
+}
+
+func newTableRename(oldName string, newName string, defaultSchema string) *TableRename {
+	rename := &TableRename{}
+	rename.SchemaName, rename.TableName = splitTableName(oldName)
+	rename.NewSchemaName, rename.NewTableName = splitTableName(newName)
+	if rename.SchemaName == "" {
+		rename.SchemaName = defaultSchema
+	}
+	if rename.NewSchemaName == "" {
+		rename.NewSchemaName = defaultSchema
+	}
+	return rename
+}
+
+// 去掉注释，合并连续空白，去掉结尾分号
+// 引号内的内容保持原样
+func NormalizeStatement(sql string) string {
+	var b strings.Builder
+	var quote byte
+	space := false
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		if quote != 0 {
+			b.WriteByte(c)
+			if c == '\\' && quote != '`' && i+1 < len(sql) {
+				i++
+				b.WriteByte(sql[i])
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			// /*!40101 ... */ 这类版本注释中的内容会被 mysql 执行，保留其内容
+			end := strings.Index(sql[i+2:], "*/")
+			rest := ""
+			if end < 0 {
+				end = len(sql) - i - 2
+			} else {
+				rest = sql[i+4+end:]
+			}
+			if i+2 < len(sql) && sql[i+2] == '!' {
+				body := strings.TrimLeft(sql[i+3:i+2+end], "0123456789")
+				sql = sql[:i] + " " + body + " " + rest
+				i--
+			} else {
+				i += end + 3
+				space = true
+			}
+			continue
+		case c == '#' || (c == '-' && i+2 < len(sql) && sql[i+1] == '-' && (sql[i+2] == ' ' || sql[i+2] == '\t')):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end
+			}
+			space = true
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteByte(c)
+	}
+	return strings.TrimRight(strings.TrimSpace(b.String()), "; ")
+}
+
+// 按逗号拆分表名列表，反引号内的逗号不拆分，去掉结尾的 RESTRICT/CASCADE
+func splitTableList(tokens []string) []string {
+	tables := make([]string, 0)
+	inQuote := false
+	start := 0
+	list := strings.Join(tokens, " ")
+	for i := 0; i <= len(list); i++ {
+		if i < len(list) && list[i] == '`' {
+			inQuote = !inQuote
+		}
+		if i < len(list) && (list[i] != ',' || inQuote) {
+			continue
+		}
+		if table := firstToken(splitStatement(strings.TrimSpace(list[start:i]))); table != "" {
+			tables = append(tables, table)
+		}
+		start = i + 1
+	}
+	return tables
+}
+
+// 按空白拆分语句，反引号内的空白不拆分
+func splitStatement(statement string) []string {
+	tokens := make([]string, 0)
+	start := -1
+	inQuote := false
+	for i := 0; i < len(statement); i++ {
+		c := statement[i]
+		if c == '`' {
+			inQuote = !inQuote
+		}
+		if c == ' ' && !inQuote {
+			if start >= 0 {
+				tokens = append(tokens, statement[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, statement[start:])
+	}
+	return tokens
+}
+
+// 跳过开头的关键字
+func skipKeywords(tokens []string, keywords ...string) []string {
+	for len(tokens) > 0 {
+		found := false
+		for _, k := range keywords {
+			if strings.ToUpper(tokens[0]) == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	return tokens
+}
+
+func firstToken(tokens []string) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	// create table t(id int) 表名与括号相连
+	if i := strings.IndexByte(tokens[0], '('); i > 0 && !strings.HasPrefix(tokens[0], "`") {
+		return tokens[0][0:i]
+	}
+	return tokens[0]
+}
+
+// 获取关键字之后的 token
+func tokenAfter(tokens []string, keyword string) string {
+	for i := 0; i < len(tokens)-1; i++ {
+		if strings.ToUpper(tokens[i]) == keyword {
+			return firstToken(tokens[i+1:])
+		}
+	}
+	return ""
+}
+
+// `db`.`table` / db.table / table => db, table
+func splitTableName(name string) (string, string) {
+	name = strings.TrimRight(name, ",;")
+	if i := strings.IndexByte(name, '('); i > 0 && !strings.HasSuffix(name, "`") {
+		name = name[0:i]
+	}
+	inQuote := false
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '`':
+			inQuote = !inQuote
+		case '.':
+			if !inQuote {
+				return unquoteIdentifier(name[0:i]), unquoteIdentifier(name[i+1:])
+			}
+		}
+	}
+	return "", unquoteIdentifier(name)
+}
+
+func unquoteIdentifier(name string) string {
+	name = strings.TrimRight(name, ",;")
+	if len(name) >= 2 && name[0] == '`' && name[len(name)-1] == '`' {
+		return strings.Replace(name[1:len(name)-1], "``", "`", -1)
+	}
+	return name
+}
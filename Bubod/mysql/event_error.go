@@ -0,0 +1,94 @@
+// 事件解析失败处理
+package mysql
+
+import (
+	"fmt"
+)
+
+// 事件解析失败时的处理策略
+const (
+	ERROR_POLICY_STOP = "stop" // 停止同步(默认)
+	ERROR_POLICY_SKIP = "skip" // 跳过该事件并报告
+	ERROR_POLICY_DLQ  = "dlq"  // 跳过该事件并投递到死信队列
+)
+
+// 解析失败的事件
+type ErrorEvent struct {
+	Header         EventHeader `json:"header"`
+	SchemaName     string      `json:"db"`
+	TableName      string      `json:"table"`
+	BinlogFileName string      `json:"binlog_file"`
+	BinlogPosition uint32      `json:"binlog_position"` // 事件起始位点
+	Error          string      `json:"error"`
+	Raw            []byte      `json:"raw"`             // 原始事件数据(含事件头)
+}
+
+// 解析失败回调
+type errorCallback func(data *ErrorEvent)
+
+func (event *ErrorEvent) String() string {
+	return fmt.Sprintf("%s %s.%s %s:%d: %s", event.Header.EventName(), event.SchemaName, event.TableName, event.BinlogFileName, event.BinlogPosition, event.Error)
+}
+
+// 解析事件，解析过程中的 panic 会被转换为 error
+func (parser *eventParser) safeParseEvent(data []byte) (event *EventReslut, filename string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("parse event panic: %v", r)
+		}
+	}()
+	return parser.parseEvent(data)
+}
+
+// 构造解析失败事件
+func (parser *eventParser) newErrorEvent(data []byte, err error) *ErrorEvent {
+	errorEvent := &ErrorEvent{
+		BinlogFileName: parser.binlogFileName,
+		Error:          err.Error(),
+		Raw:            append([]byte(nil), data...),
+	}
+	if len(data) >= 19 {
+		errorEvent.Header.Read(data[0:19])
+		errorEvent.BinlogPosition = errorEvent.Header.LogPos - errorEvent.Header.EventSize
+	}
+
+	// rows 事件前一定有 TABLE_MAP_EVENT，尽量给出库表
+	// 事件类型来自无法解析的数据，不在 FORMAT_DESCRIPTION_EVENT 的 post-header 长度数组范围内时不查找
+	if len(data) > 19 && parser.format.postHeaderLength(errorEvent.Header.EventType) >= 0 {
+		switch errorEvent.Header.EventType {
+		case WRITE_ROWS_EVENTv0, WRITE_ROWS_EVENTv1, WRITE_ROWS_EVENTv2,
+			UPDATE_ROWS_EVENTv0, UPDATE_ROWS_EVENTv1, UPDATE_ROWS_EVENTv2,
+			DELETE_ROWS_EVENTv0, DELETE_ROWS_EVENTv1, DELETE_ROWS_EVENTv2:
+			tableIdSize := parser.format.tableIdSize(errorEvent.Header.EventType)
+			if len(data) >= 19+tableIdSize {
+				var tableId uint64
+				for i := 0; i < tableIdSize; i++ {
+					tableId |= uint64(data[19+i]) << (uint(i) * 8)
+				}
+				if tableMap, ok := parser.tableMap[tableId]; ok {
+					errorEvent.SchemaName = tableMap.schemaName
+					errorEvent.TableName = tableMap.tableName
+				}
+			}
+		}
+	}
+	return errorEvent
+}
+
+// 按 errorPolicy 处理解析失败的事件，返回是否继续同步
+func (parser *eventParser) handleErrorEvent(errorEvent *ErrorEvent) bool {
+	switch parser.errorPolicy {
+	case ERROR_POLICY_SKIP, ERROR_POLICY_DLQ:
+		parser.logEntry().With(errorEvent.fields()).Warn("skip event:", errorEvent.Error)
+		if parser.errorCallback != nil {
+			parser.errorCallback(errorEvent)
+		}
+		return true
+	default:
+		parser.logEntry().With(errorEvent.fields()).Error("parse event:", errorEvent.Error)
+		if parser.errorCallback != nil {
+			parser.errorCallback(errorEvent)
+		}
+		return false
+	}
+}
@@ -6,8 +6,9 @@
 package mysql
 
 import (
-	"bytes"
-	"encoding/binary"
+	"strings"
+
+	"bubod/Bubod/logger"
 )
 
 // 简介:
@@ -62,15 +63,97 @@ type FormatDescriptionEvent struct {
 	createTimestamp        uint32
 	eventHeaderLength      uint8
 	eventTypeHeaderLengths []byte
+	serverVersion          *ServerVersion // 版本无法解析时为 nil
+	checksumAlg            byte           // BINLOG_CHECKSUM_ALG_*
 }
 
-func (parser *eventParser) parseFormatDescriptionEvent(buf *bytes.Buffer) (event *FormatDescriptionEvent, err error) {
+// 校验算法
+const (
+	BINLOG_CHECKSUM_ALG_OFF   byte = 0
+	BINLOG_CHECKSUM_ALG_CRC32 byte = 1
+	BINLOG_CHECKSUM_ALG_UNDEF byte = 255
+)
+
+func (parser *eventParser) parseFormatDescriptionEvent(buf *eventReader) (event *FormatDescriptionEvent, err error) {
 	event = new(FormatDescriptionEvent)
-	err = binary.Read(buf, binary.LittleEndian, &event.header)
-	err = binary.Read(buf, binary.LittleEndian, &event.binlogVersion)
+	err = buf.readHeader(&event.header)
+	event.binlogVersion, err = buf.Uint16()
 	event.mysqlServerVersion = string(buf.Next(50))
-	err = binary.Read(buf, binary.LittleEndian, &event.createTimestamp)
+	event.createTimestamp, err = buf.Uint32()
 	event.eventHeaderLength, err = buf.ReadByte()
-	event.eventTypeHeaderLengths = buf.Bytes()
+	// packet 缓冲区会被复用，需要复制
+	event.eventTypeHeaderLengths = append([]byte(nil), buf.Bytes()...)
+	event.mysqlServerVersion = strings.TrimRight(event.mysqlServerVersion, "\x00")
+	event.serverVersion, _ = ParseServerVersion(event.mysqlServerVersion)
+	// 5.6.1 以后(MariaDB 5.3 以后)数组后为 1 字节的校验算法，不属于 post-header 长度
+	event.checksumAlg = BINLOG_CHECKSUM_ALG_UNDEF
+	if v := event.serverVersion; v != nil && (v.MariaDB || v.AtLeast(5, 6, 1)) && len(event.eventTypeHeaderLengths) > 0 {
+		n := len(event.eventTypeHeaderLengths) - 1
+		event.checksumAlg = event.eventTypeHeaderLengths[n]
+		event.eventTypeHeaderLengths = event.eventTypeHeaderLengths[:n]
+	}
 	return
-}
\ No newline at end of file
+}
+
+// 事件的 post-header 长度，数组中没有该事件时返回 -1
+func (event *FormatDescriptionEvent) postHeaderLength(eventType EventType) int {
+	if event == nil || eventType < 1 || int(eventType) > len(event.eventTypeHeaderLengths) {
+		return -1
+	}
+	return int(event.eventTypeHeaderLengths[eventType-1])
+}
+
+// TABLE_MAP 和 rows 事件中 tableId 的字节数，post-header 为 6 字节时(5.1.4 之前)为 4，否则为 6
+func (event *FormatDescriptionEvent) tableIdSize(eventType EventType) int {
+	if event.postHeaderLength(eventType) == 6 {
+		return 4
+	}
+	return 6
+}
+
+// binlog 的格式，由 FORMAT_DESCRIPTION_EVENT 确定，见 BinlogDump.BinlogFormat
+type BinlogFormat struct {
+	BinlogVersion   uint16 `json:"binlog_version"`
+	ServerVersion   string `json:"server_version"`    // FDE 中的版本，如 5.7.30-log
+	Flavor          string `json:"flavor,omitempty"`  // FLAVOR_*，版本无法解析时为空
+	HeaderLength    uint8  `json:"header_length"`     // 通用事件头长度，v4 为 19
+	Checksum        string `json:"checksum"`          // NONE/CRC32，5.6.1 之前没有校验算法时为空
+	TableIdSize     int    `json:"table_id_size"`     // TABLE_MAP 和 rows 事件中 tableId 的字节数
+	QueryStatusVars bool   `json:"query_status_vars"` // QUERY_EVENT 带状态变量(binlog v4)
+	RowsEventV2     bool   `json:"rows_event_v2"`     // 5.6 以后的 rows 事件 v2
+	TemporalV2      bool   `json:"temporal_v2"`       // 5.6.4 以后的 TIME2/DATETIME2/TIMESTAMP2，旧类型仍按原格式解码
+}
+
+func (event *FormatDescriptionEvent) info() *BinlogFormat {
+	info := &BinlogFormat{
+		BinlogVersion:   event.binlogVersion,
+		ServerVersion:   event.mysqlServerVersion,
+		HeaderLength:    event.eventHeaderLength,
+		TableIdSize:     event.tableIdSize(TABLE_MAP_EVENT),
+		QueryStatusVars: event.postHeaderLength(QUERY_EVENT) >= 13,
+	}
+	if v := event.serverVersion; v != nil {
+		info.Flavor = v.Flavor()
+		info.RowsEventV2 = !v.MariaDB && v.AtLeast(5, 6, 0)
+		info.TemporalV2 = v.AtLeast(5, 6, 4) || v.MariaDB && v.AtLeast(10, 1, 2)
+	}
+	switch event.checksumAlg {
+	case BINLOG_CHECKSUM_ALG_OFF:
+		info.Checksum = "NONE"
+	case BINLOG_CHECKSUM_ALG_CRC32:
+		info.Checksum = "CRC32"
+	}
+	return info
+}
+// 记录当前 binlog 的格式，版本、校验算法等变化时(如切换到新的 master)输出日志
+func (parser *eventParser) setBinlogFormat(info *BinlogFormat) {
+	if old, _ := parser.binlogFormat.Load().(*BinlogFormat); old == nil || *old != *info {
+		parser.logEntry().With(logger.Fields{
+			"server_version": info.ServerVersion,
+			"binlog_version": info.BinlogVersion,
+			"checksum":       info.Checksum,
+			"table_id_size":  info.TableIdSize,
+		}).Info("binlog format")
+	}
+	parser.binlogFormat.Store(info)
+}
@@ -1,19 +1,14 @@
 // 其余事件通用处理
 package mysql
 
-import (
-	"bytes"
-	"encoding/binary"
-)
-
 type GenericEvent struct {
 	header EventHeader
 	data   []byte
 }
 
-func parseGenericEvent(buf *bytes.Buffer) (event *GenericEvent, err error) {
+func parseGenericEvent(buf *eventReader) (event *GenericEvent, err error) {
 	event = new(GenericEvent)
-	err = binary.Read(buf, binary.LittleEndian, &event.header)
+	err = buf.readHeader(&event.header)
 	event.data = buf.Bytes()
 	return
 }
\ No newline at end of file
@@ -3,8 +3,6 @@
 package mysql
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 )
 
@@ -69,12 +67,16 @@ type EventHeader struct {
 }
 
 func (header *EventHeader) Read(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	return binary.Read(buf, binary.LittleEndian, header)
+	return newEventReader(data).readHeader(header)
 }
 
 func (header *EventHeader) EventName() string {
-	switch header.EventType {
+	return header.EventType.String()
+}
+
+// 事件名称，未知类型为编号
+func (e EventType) String() string {
+	switch e {
 	case UNKNOWN_EVENT:
 		return "UNKNOWN_EVENT"
 	case START_EVENT_V3:
@@ -148,7 +150,7 @@ func (header *EventHeader) EventName() string {
 	case PREVIOUS_GTIDS_EVENT:
 		return "PREVIOUS_GTIDS_EVENT"
 	}
-	return fmt.Sprintf("%d", header.EventType)
+	return fmt.Sprintf("%d", e)
 }
 
 func (header *EventHeader) FlagNames() (names []string) {
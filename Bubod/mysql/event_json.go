@@ -0,0 +1,199 @@
+// EventReslut 的 JSON 格式
+// 直接序列化 driver.Value 时各类型的表示取决于解码结果: 二进制字段解码为 string，非 UTF-8 字节被替换；
+// 整数、小数、字符串无法区分字段类型。MarshalJSON 输出字段固定的结构:
+//
+//	{
+//		"action": "update",                // insert/update/delete/ddl/failover/restart，其他事件为事件名
+//		"schema": "shop",
+//		"table": "orders",
+//		"ts": 1536891000,                  // 事件时间戳(秒)
+//		"position": {"file": "mysql-bin.000004", "pos": 786},
+//		"gtid": "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+//		"primary_key": ["id"],
+//		"columns": [{"name": "id", "type": "int(11)", ...}],
+//		"rows": [{"before": {...}, "after": {...}}]
+//	}
+//
+// 行数据按类型编码: 整数、浮点数为数字(整数不经过 float64，不丢精度)，DECIMAL 为字符串，
+// BLOB/BINARY/VARBINARY 为 base64 字符串，SET 为字符串数组，日期时间为字符串，NULL 为 null。
+// 二进制字段通过 columns 中的类型识别，没有字段信息的事件(如 ParseEventDataJson 生成的)按字符串输出。
+// insert 的行只有 after，delete 只有 before。
+package mysql
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type eventJson struct {
+	Action     string              `json:"action"`
+	Schema     string              `json:"schema"`
+	Table      string              `json:"table"`
+	Ts         uint32              `json:"ts"`
+	Position   eventPositionJson   `json:"position"`
+	GTID       string              `json:"gtid"`
+	PrimaryKey []string            `json:"primary_key"`
+	Columns    []*ColumnInfo       `json:"columns,omitempty"`
+	Rows       []eventRowJson      `json:"rows"`
+	Query      string              `json:"query,omitempty"`
+	DDL        *DDLEvent           `json:"ddl,omitempty"`
+	Failover   *FailoverEvent      `json:"failover,omitempty"`
+	Restart    *MasterRestartEvent `json:"restart,omitempty"`
+}
+
+type eventPositionJson struct {
+	File string `json:"file"`
+	Pos  uint32 `json:"pos"`
+}
+
+type eventRowJson struct {
+	Before map[string]json.RawMessage `json:"before,omitempty"`
+	After  map[string]json.RawMessage `json:"after,omitempty"`
+}
+
+func (event *EventReslut) MarshalJSON() ([]byte, error) {
+	data := &eventJson{
+		Action:     event.action(),
+		Schema:     event.SchemaName,
+		Table:      event.TableName,
+		Ts:         event.Header.Timestamp,
+		Position:   eventPositionJson{File: event.BinlogFileName, Pos: event.BinlogPosition},
+		GTID:       event.GTID,
+		PrimaryKey: event.PrimaryKeys,
+		Columns:    event.Columns,
+		Rows:       make([]eventRowJson, 0),
+		Query:      event.Query,
+		DDL:        event.DDL,
+		Failover:   event.Failover,
+		Restart:    event.Restart,
+	}
+	if data.PrimaryKey == nil {
+		data.PrimaryKey = make([]string, 0)
+	}
+	if event.DDL != nil && data.Schema == "" {
+		data.Schema, data.Table = event.DDL.SchemaName, event.DDL.TableName
+	}
+	columns := make(map[string]*ColumnInfo, len(event.Columns))
+	for _, column := range event.Columns {
+		columns[column.Name] = column
+	}
+	rows := event.RowMaps()
+	switch data.Action {
+	case "insert", "delete":
+		for _, row := range rows {
+			values, err := jsonRow(columns, row)
+			if err != nil {
+				return nil, err
+			}
+			if data.Action == "insert" {
+				data.Rows = append(data.Rows, eventRowJson{After: values})
+			} else {
+				data.Rows = append(data.Rows, eventRowJson{Before: values})
+			}
+		}
+	case "update":
+		// 每次变更为 before、after 两行
+		for k := 1; k < len(rows); k += 2 {
+			before, err := jsonRow(columns, rows[k-1])
+			if err != nil {
+				return nil, err
+			}
+			after, err := jsonRow(columns, rows[k])
+			if err != nil {
+				return nil, err
+			}
+			data.Rows = append(data.Rows, eventRowJson{Before: before, After: after})
+		}
+	}
+	return json.Marshal(data)
+}
+
+// 事件的操作类型
+func (event *EventReslut) action() string {
+	switch {
+	case event.Failover != nil:
+		return "failover"
+	case event.Restart != nil:
+		return "restart"
+	case event.DDL != nil:
+		return "ddl"
+	}
+	switch event.Header.EventType {
+	case WRITE_ROWS_EVENTv0, WRITE_ROWS_EVENTv1, WRITE_ROWS_EVENTv2,
+		UPDATE_ROWS_EVENTv0, UPDATE_ROWS_EVENTv1, UPDATE_ROWS_EVENTv2,
+		DELETE_ROWS_EVENTv0, DELETE_ROWS_EVENTv1, DELETE_ROWS_EVENTv2:
+		return EvenTypeName(event.Header.EventType)
+	}
+	return event.Header.EventName()
+}
+
+func jsonRow(columns map[string]*ColumnInfo, row map[string]driver.Value) (map[string]json.RawMessage, error) {
+	values := make(map[string]json.RawMessage, len(row))
+	for name, value := range row {
+		b, err := jsonValue(value, columns[name])
+		if err != nil {
+			return nil, err
+		}
+		values[name] = b
+	}
+	return values, nil
+}
+
+// 按类型编码字段值，column 为 nil 时只按值的类型编码
+func jsonValue(value driver.Value, column *ColumnInfo) (json.RawMessage, error) {
+	switch v := value.(type) {
+	case nil:
+		return json.RawMessage("null"), nil
+	case int8:
+		return json.RawMessage(strconv.FormatInt(int64(v), 10)), nil
+	case int16:
+		return json.RawMessage(strconv.FormatInt(int64(v), 10)), nil
+	case int32:
+		return json.RawMessage(strconv.FormatInt(int64(v), 10)), nil
+	case int64:
+		return json.RawMessage(strconv.FormatInt(v, 10)), nil
+	case int:
+		return json.RawMessage(strconv.FormatInt(int64(v), 10)), nil
+	case uint8:
+		return json.RawMessage(strconv.FormatUint(uint64(v), 10)), nil
+	case uint16:
+		return json.RawMessage(strconv.FormatUint(uint64(v), 10)), nil
+	case uint32:
+		return json.RawMessage(strconv.FormatUint(uint64(v), 10)), nil
+	case uint64:
+		return json.RawMessage(strconv.FormatUint(v, 10)), nil
+	case float32:
+		return jsonFloat(float64(v), 32), nil
+	case float64:
+		return jsonFloat(v, 64), nil
+	case string:
+		if isBinaryColumn(column) {
+			return json.Marshal(base64.StdEncoding.EncodeToString([]byte(v)))
+		}
+		return json.Marshal(v)
+	}
+	// []byte 由 encoding/json 编码为 base64，[]string、bool、json.Number 等按默认方式
+	return json.Marshal(value)
+}
+
+// NaN、Inf 不是合法的 JSON 数字，输出为字符串
+func jsonFloat(f float64, bitSize int) json.RawMessage {
+	s := strconv.FormatFloat(f, 'g', -1, bitSize)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return json.RawMessage(strconv.Quote(s))
+	}
+	return json.RawMessage(s)
+}
+
+// BLOB、BINARY、VARBINARY 字段
+func isBinaryColumn(column *ColumnInfo) bool {
+	if column == nil {
+		return false
+	}
+	t := strings.ToLower(column.Type)
+	return strings.Contains(t, "blob") || strings.Contains(t, "binary")
+}
@@ -0,0 +1,522 @@
+// EventReslut 的 protobuf 编码，消息定义见 event.proto
+// 按 protobuf 编码规则直接读写，不依赖生成代码；其他语言由 event.proto 生成代码解析。
+// 行数据按 map 格式编码(slice 格式的事件由 Values、Columns 转换)，解码后为 map 格式:
+// 有符号整数解码为 int64，无符号整数为 uint64，二进制字段与 parseEventRow 的结果一致为 string。
+package mysql
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+// wire type
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (w *protoWriter) tag(field int, wireType int) {
+	w.uvarint(uint64(field<<3 | wireType))
+}
+
+func (w *protoWriter) varintField(field int, v uint64) {
+	w.tag(field, protoVarint)
+	w.uvarint(v)
+}
+
+func (w *protoWriter) bytesField(field int, b []byte) {
+	w.tag(field, protoBytes)
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *protoWriter) stringField(field int, s string) {
+	w.tag(field, protoBytes)
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// proto3 中值为 0、空字符串的字段不编码
+func (w *protoWriter) optVarint(field int, v uint64) {
+	if v != 0 {
+		w.varintField(field, v)
+	}
+}
+
+func (w *protoWriter) optString(field int, s string) {
+	if s != "" {
+		w.stringField(field, s)
+	}
+}
+
+func (w *protoWriter) optBool(field int, b bool) {
+	if b {
+		w.varintField(field, 1)
+	}
+}
+
+// Value 消息，oneof 字段即使为 0 也需要编码
+func (w *protoWriter) value(value driver.Value, column *ColumnInfo) error {
+	switch v := value.(type) {
+	case nil:
+		w.varintField(1, 1)
+	case int8:
+		w.varintField(2, zigzag(int64(v)))
+	case int16:
+		w.varintField(2, zigzag(int64(v)))
+	case int32:
+		w.varintField(2, zigzag(int64(v)))
+	case int64:
+		w.varintField(2, zigzag(v))
+	case int:
+		w.varintField(2, zigzag(int64(v)))
+	case uint8:
+		w.varintField(3, uint64(v))
+	case uint16:
+		w.varintField(3, uint64(v))
+	case uint32:
+		w.varintField(3, uint64(v))
+	case uint64:
+		w.varintField(3, v)
+	case float64:
+		w.tag(4, protoFixed64)
+		w.buf = append(w.buf, uint64ToBytes(math.Float64bits(v))...)
+	case float32:
+		w.tag(5, protoFixed32)
+		w.buf = append(w.buf, uint32ToBytes(math.Float32bits(v))...)
+	case string:
+		// proto 的 string 必须是 UTF-8
+		if isBinaryColumn(column) || !utf8.ValidString(v) {
+			w.stringField(7, v)
+		} else {
+			w.stringField(6, v)
+		}
+	case []byte:
+		w.bytesField(7, v)
+	case []string:
+		set := &protoWriter{}
+		for _, s := range v {
+			set.stringField(1, s)
+		}
+		w.bytesField(8, set.buf)
+	case bool:
+		if v {
+			w.varintField(9, 1)
+		} else {
+			w.varintField(9, 0)
+		}
+	case json.Number:
+		// ParseEventDataJson 解析的数字
+		if i, err := v.Int64(); err == nil {
+			w.varintField(2, zigzag(i))
+		} else if f, err := v.Float64(); err == nil {
+			return w.value(f, column)
+		} else {
+			w.stringField(6, string(v))
+		}
+	default:
+		return fmt.Errorf("unsupported value type %T", value)
+	}
+	return nil
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// 编码为 event.proto 中的 Event 消息
+func (event *EventReslut) ToProto() ([]byte, error) {
+	w := &protoWriter{}
+	w.optVarint(1, uint64(event.Header.EventType))
+	w.optVarint(2, uint64(event.Header.Timestamp))
+	w.optVarint(3, uint64(event.Header.ServerId))
+	w.optVarint(4, uint64(event.Header.LogPos))
+	w.optVarint(5, uint64(event.Header.EventSize))
+	w.optVarint(6, uint64(event.Header.Flags))
+	w.optString(7, event.action())
+	w.optString(8, event.SchemaName)
+	w.optString(9, event.TableName)
+	w.optString(10, event.BinlogFileName)
+	w.optVarint(11, uint64(event.BinlogPosition))
+	w.optString(12, event.GTID)
+	w.optString(13, event.Primary)
+	for _, key := range event.PrimaryKeys {
+		w.stringField(14, key)
+	}
+	w.optVarint(15, event.SchemaVersion)
+	w.optString(16, event.Query)
+
+	columns := make(map[string]*ColumnInfo, len(event.Columns))
+	for _, column := range event.Columns {
+		columns[column.Name] = column
+		c := &protoWriter{}
+		c.optString(1, column.Name)
+		c.optString(2, column.Type)
+		c.optString(3, column.Key)
+		c.optBool(4, column.Unsigned)
+		c.optBool(5, column.IsPrimary)
+		c.optBool(6, column.Nullable)
+		if column.Default != nil {
+			c.stringField(7, *column.Default)
+		}
+		c.optVarint(8, uint64(column.DatetimePrecision))
+		w.bytesField(17, c.buf)
+	}
+	for _, row := range event.RowMaps() {
+		names := make([]string, 0, len(row))
+		for name := range row {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		r := &protoWriter{}
+		for _, name := range names {
+			value := &protoWriter{}
+			if err := value.value(row[name], columns[name]); err != nil {
+				return nil, fmt.Errorf("column %s: %s", name, err)
+			}
+			// map 的每一项为 key=1、value=2 的消息
+			entry := &protoWriter{}
+			entry.stringField(1, name)
+			entry.bytesField(2, value.buf)
+			r.bytesField(1, entry.buf)
+		}
+		w.bytesField(18, r.buf)
+	}
+
+	if ddl := event.DDL; ddl != nil {
+		d := &protoWriter{}
+		d.optString(1, ddl.Operation)
+		d.optString(2, ddl.SchemaName)
+		d.optString(3, ddl.TableName)
+		d.optString(4, ddl.Statement)
+		for _, rename := range ddl.Renames {
+			t := &protoWriter{}
+			t.optString(1, rename.SchemaName)
+			t.optString(2, rename.TableName)
+			t.optString(3, rename.NewSchemaName)
+			t.optString(4, rename.NewTableName)
+			d.bytesField(5, t.buf)
+		}
+		for _, table := range ddl.Tables {
+			t := &protoWriter{}
+			t.optString(1, table.SchemaName)
+			t.optString(2, table.TableName)
+			d.bytesField(6, t.buf)
+		}
+		w.bytesField(19, d.buf)
+	}
+	if failover := event.Failover; failover != nil {
+		f := &protoWriter{}
+		f.optString(1, failover.OldMaster)
+		f.optString(2, failover.NewMaster)
+		f.optString(3, failover.OldServerUUID)
+		f.optString(4, failover.NewServerUUID)
+		f.optString(5, failover.GTIDSet)
+		w.bytesField(20, f.buf)
+	}
+	if restart := event.Restart; restart != nil {
+		r := &protoWriter{}
+		r.optVarint(1, uint64(restart.ServerId))
+		r.optString(2, restart.BinlogFile)
+		r.optVarint(3, uint64(restart.StartTime))
+		r.optString(4, restart.PrevFile)
+		r.optBool(5, restart.Clean)
+		w.bytesField(21, r.buf)
+	}
+	return w.buf, nil
+}
+
+type protoReader struct {
+	data []byte
+}
+
+// 读取下一个字段，varint/fixed 字段的值在 v 中，length-delimited 字段在 b 中
+func (r *protoReader) next() (field int, wireType int, v uint64, b []byte, err error) {
+	key, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		return 0, 0, 0, nil, fmt.Errorf("proto: invalid field key")
+	}
+	r.data = r.data[n:]
+	field, wireType = int(key>>3), int(key&7)
+	switch wireType {
+	case protoVarint:
+		if v, n = binary.Uvarint(r.data); n <= 0 {
+			return 0, 0, 0, nil, fmt.Errorf("proto: invalid varint in field %d", field)
+		}
+		r.data = r.data[n:]
+	case protoFixed64:
+		if len(r.data) < 8 {
+			return 0, 0, 0, nil, fmt.Errorf("proto: truncated field %d", field)
+		}
+		v, r.data = binary.LittleEndian.Uint64(r.data), r.data[8:]
+	case protoFixed32:
+		if len(r.data) < 4 {
+			return 0, 0, 0, nil, fmt.Errorf("proto: truncated field %d", field)
+		}
+		v, r.data = uint64(binary.LittleEndian.Uint32(r.data)), r.data[4:]
+	case protoBytes:
+		var size uint64
+		if size, n = binary.Uvarint(r.data); n <= 0 || uint64(len(r.data)-n) < size {
+			return 0, 0, 0, nil, fmt.Errorf("proto: truncated field %d", field)
+		}
+		b, r.data = r.data[n:n+int(size)], r.data[n+int(size):]
+	default:
+		return 0, 0, 0, nil, fmt.Errorf("proto: unsupported wire type %d in field %d", wireType, field)
+	}
+	return
+}
+
+// 读取消息的所有字段，未知字段忽略
+func readProto(data []byte, fn func(field int, v uint64, b []byte) error) error {
+	r := &protoReader{data: data}
+	for len(r.data) > 0 {
+		field, _, v, b, err := r.next()
+		if err != nil {
+			return err
+		}
+		if err = fn(field, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 解码 ToProto 生成的 Event 消息
+func (event *EventReslut) FromProto(data []byte) error {
+	*event = EventReslut{}
+	return readProto(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			event.Header.EventType = EventType(v)
+		case 2:
+			event.Header.Timestamp = uint32(v)
+		case 3:
+			event.Header.ServerId = uint32(v)
+		case 4:
+			event.Header.LogPos = uint32(v)
+		case 5:
+			event.Header.EventSize = uint32(v)
+		case 6:
+			event.Header.Flags = eventFlag(v)
+		case 8:
+			event.SchemaName = string(b)
+		case 9:
+			event.TableName = string(b)
+		case 10:
+			event.BinlogFileName = string(b)
+		case 11:
+			event.BinlogPosition = uint32(v)
+		case 12:
+			event.GTID = string(b)
+		case 13:
+			event.Primary = string(b)
+		case 14:
+			event.PrimaryKeys = append(event.PrimaryKeys, string(b))
+		case 15:
+			event.SchemaVersion = v
+		case 16:
+			event.Query = string(b)
+		case 17:
+			column := &ColumnInfo{}
+			if err := readProto(b, func(field int, v uint64, b []byte) error {
+				switch field {
+				case 1:
+					column.Name = string(b)
+				case 2:
+					column.Type = string(b)
+				case 3:
+					column.Key = string(b)
+				case 4:
+					column.Unsigned = v != 0
+				case 5:
+					column.IsPrimary = v != 0
+				case 6:
+					column.Nullable = v != 0
+				case 7:
+					value := string(b)
+					column.Default = &value
+				case 8:
+					column.DatetimePrecision = int(v)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			event.Columns = append(event.Columns, column)
+		case 18:
+			row, err := protoRow(b)
+			if err != nil {
+				return err
+			}
+			event.Rows = append(event.Rows, row)
+		case 19:
+			ddl := &DDLEvent{}
+			if err := readProto(b, func(field int, v uint64, b []byte) error {
+				switch field {
+				case 1:
+					ddl.Operation = string(b)
+				case 2:
+					ddl.SchemaName = string(b)
+				case 3:
+					ddl.TableName = string(b)
+				case 4:
+					ddl.Statement = string(b)
+				case 5:
+					rename := &TableRename{}
+					if err := readProto(b, func(field int, v uint64, b []byte) error {
+						switch field {
+						case 1:
+							rename.SchemaName = string(b)
+						case 2:
+							rename.TableName = string(b)
+						case 3:
+							rename.NewSchemaName = string(b)
+						case 4:
+							rename.NewTableName = string(b)
+						}
+						return nil
+					}); err != nil {
+						return err
+					}
+					ddl.Renames = append(ddl.Renames, rename)
+				case 6:
+					table := &DDLTable{}
+					if err := readProto(b, func(field int, v uint64, b []byte) error {
+						switch field {
+						case 1:
+							table.SchemaName = string(b)
+						case 2:
+							table.TableName = string(b)
+						}
+						return nil
+					}); err != nil {
+						return err
+					}
+					ddl.Tables = append(ddl.Tables, table)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			event.DDL = ddl
+		case 20:
+			failover := &FailoverEvent{}
+			if err := readProto(b, func(field int, v uint64, b []byte) error {
+				switch field {
+				case 1:
+					failover.OldMaster = string(b)
+				case 2:
+					failover.NewMaster = string(b)
+				case 3:
+					failover.OldServerUUID = string(b)
+				case 4:
+					failover.NewServerUUID = string(b)
+				case 5:
+					failover.GTIDSet = string(b)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			event.Failover = failover
+		case 21:
+			restart := &MasterRestartEvent{}
+			if err := readProto(b, func(field int, v uint64, b []byte) error {
+				switch field {
+				case 1:
+					restart.ServerId = uint32(v)
+				case 2:
+					restart.BinlogFile = string(b)
+				case 3:
+					restart.StartTime = uint32(v)
+				case 4:
+					restart.PrevFile = string(b)
+				case 5:
+					restart.Clean = v != 0
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			event.Restart = restart
+		}
+		return nil
+	})
+}
+
+func protoRow(data []byte) (map[string]driver.Value, error) {
+	row := make(map[string]driver.Value)
+	err := readProto(data, func(field int, v uint64, b []byte) error {
+		if field != 1 {
+			return nil
+		}
+		var name string
+		var value driver.Value
+		err := readProto(b, func(field int, v uint64, b []byte) (err error) {
+			switch field {
+			case 1:
+				name = string(b)
+			case 2:
+				value, err = protoValue(b)
+			}
+			return
+		})
+		row[name] = value
+		return err
+	})
+	return row, err
+}
+
+func protoValue(data []byte) (value driver.Value, err error) {
+	err = readProto(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			value = nil
+		case 2:
+			value = unzigzag(v)
+		case 3:
+			value = v
+		case 4:
+			value = math.Float64frombits(v)
+		case 5:
+			value = math.Float32frombits(uint32(v))
+		case 6, 7:
+			value = string(b)
+		case 8:
+			set := make([]string, 0)
+			if err := readProto(b, func(field int, v uint64, b []byte) error {
+				if field == 1 {
+					set = append(set, string(b))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			value = set
+		case 9:
+			value = v != 0
+		}
+		return nil
+	})
+	return
+}
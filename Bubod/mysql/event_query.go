@@ -4,11 +4,6 @@
 // 其余查询时间，向binlog发送文本查询
 package mysql
 
-import (
-	"bytes"
-	"encoding/binary"
-)
-
 // 执行更新语句时会生成 QUERY_EVENT，包括 create, insert, update, delete. 
 
 
@@ -23,17 +18,23 @@ type QueryEvent struct {
 	query         string    // sql语句
 }
 
-func (parser *eventParser) parseQueryEvent(buf *bytes.Buffer) (event *QueryEvent, err error) {
+func (parser *eventParser) parseQueryEvent(buf *eventReader) (event *QueryEvent, err error) {
 	var schemaLength byte
 	var statusVarsLength uint16
 
 	event = new(QueryEvent)
-	err = binary.Read(buf, binary.LittleEndian, &event.header)
-	err = binary.Read(buf, binary.LittleEndian, &event.slaveProxyId)
-	err = binary.Read(buf, binary.LittleEndian, &event.executionTime)
-	err = binary.Read(buf, binary.LittleEndian, &schemaLength)     		//1B
-	err = binary.Read(buf, binary.LittleEndian, &event.errorCode)
-	err = binary.Read(buf, binary.LittleEndian, &statusVarsLength)      //2B
+	err = buf.readHeader(&event.header)
+	event.slaveProxyId, err = buf.Uint32()
+	event.executionTime, err = buf.Uint32()
+	schemaLength, err = buf.ReadByte()     		//1B
+	event.errorCode, err = buf.Uint16()
+	// binlog v1、v3 的 post-header 为 11 字节，没有状态变量；更长的 post-header 跳过未知部分
+	if postHeaderLength := parser.format.postHeaderLength(QUERY_EVENT); postHeaderLength < 0 || postHeaderLength >= 13 {
+		statusVarsLength, err = buf.Uint16()      //2B
+		if postHeaderLength > 13 {
+			buf.Next(postHeaderLength - 13)
+		}
+	}
 	event.statusVars = string(buf.Next(int(statusVarsLength)))
 	event.schema = string(buf.Next(int(schemaLength)))
 	_, err = buf.ReadByte()
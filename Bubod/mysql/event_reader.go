@@ -0,0 +1,129 @@
+// 事件数据读取
+// 解码器直接在 packet 切片上按偏移读取，不再经过 bytes.Buffer 和 binary.Read 的反射与中间缓冲区。
+// Next/Bytes 返回的切片引用 packet 缓冲区，解析结果中需要保留的数据要复制(string 转换即为复制)。
+package mysql
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+type eventReader struct {
+	data []byte
+	off  int
+}
+
+func newEventReader(data []byte) *eventReader {
+	return &eventReader{data: data}
+}
+
+// 剩余字节数
+func (r *eventReader) Len() int {
+	return len(r.data) - r.off
+}
+
+// 剩余数据，不移动游标
+func (r *eventReader) Bytes() []byte {
+	return r.data[r.off:]
+}
+
+// 剩余数据转为字符串，不移动游标
+func (r *eventReader) String() string {
+	return string(r.data[r.off:])
+}
+
+// 读取 n 个字节，不足时返回剩余的全部数据，同 bytes.Buffer.Next
+func (r *eventReader) Next(n int) []byte {
+	if n < 0 {
+		n = 0
+	}
+	if n > r.Len() {
+		n = r.Len()
+	}
+	b := r.data[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *eventReader) ReadByte() (byte, error) {
+	if r.off >= len(r.data) {
+		return 0, io.EOF
+	}
+	b := r.data[r.off]
+	r.off++
+	return b, nil
+}
+
+// 读取定长数据，不足时丢弃剩余数据并返回错误，同 binary.Read
+func (r *eventReader) fixed(n int) ([]byte, error) {
+	if r.Len() < n {
+		empty := r.Len() == 0
+		r.off = len(r.data)
+		if empty {
+			return nil, io.EOF
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := r.data[r.off : r.off+n]
+	r.off += n
+	return b, nil
+}
+
+func (r *eventReader) Uint16() (uint16, error) {
+	b, err := r.fixed(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (r *eventReader) Uint32() (uint32, error) {
+	b, err := r.fixed(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (r *eventReader) Uint64() (uint64, error) {
+	b, err := r.fixed(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+func (r *eventReader) Float32() (float32, error) {
+	n, err := r.Uint32()
+	return math.Float32frombits(n), err
+}
+
+func (r *eventReader) Float64() (float64, error) {
+	n, err := r.Uint64()
+	return math.Float64frombits(n), err
+}
+
+// 大端序，用于 TIMESTAMP2/DATETIME2 等新时间类型
+func (r *eventReader) Uint32BE() (uint32, error) {
+	b, err := r.fixed(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// 通用事件头，固定 19 字节
+func (r *eventReader) readHeader(header *EventHeader) error {
+	b, err := r.fixed(19)
+	if err != nil {
+		return err
+	}
+	header.Timestamp = binary.LittleEndian.Uint32(b[0:4])
+	header.EventType = EventType(b[4])
+	header.ServerId = binary.LittleEndian.Uint32(b[5:9])
+	header.EventSize = binary.LittleEndian.Uint32(b[9:13])
+	header.LogPos = binary.LittleEndian.Uint32(b[13:17])
+	header.Flags = eventFlag(binary.LittleEndian.Uint16(b[17:19]))
+	return nil
+}
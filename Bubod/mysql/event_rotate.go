@@ -2,12 +2,6 @@
 // binlog文件切换事件
 package mysql
 
-import (
-	"bytes"
-	"encoding/binary"
-)
-
-
 // 当binlog的文件大小超过阈值时，这个事件会写到binlog的结尾处，指向下一个binlog文件序列。
 // 这个事件可以让slave知道下一个binlog文件的名字，以便它去接收。
 
@@ -21,10 +15,31 @@ type RotateEvent struct {
 	filename string 	//下个binlog文件的名字。文件名不是以null结尾的。
 }
 
-func  (parser *eventParser) parseRotateEvent(buf *bytes.Buffer) (event *RotateEvent, err error) {
+// master 生成的伪 ROTATE_EVENT，不在 binlog 文件中: dump 开始时告知当前文件，或 binlog 文件结束时(如 master 重启)告知下一个文件。
+// 带 LOG_EVENT_ARTIFICIAL_F 标志，位点为 0
+func (event *RotateEvent) artificial() bool {
+	return event.header.Flags&LOG_EVENT_ARTIFICIAL_F != 0 || event.header.LogPos == 0
+}
+
+// 事件之后的同步位点，ok 为 false 时不更新位点:
+// ROTATE_EVENT 为新文件的位点(伪 ROTATE_EVENT 不回退)，master 生成的其他事件位点为 0。
+// XID 等事件没有文件名，沿用当前文件 current
+func (event *EventReslut) nextPosition(current string) (file string, pos uint32, ok bool) {
+	switch {
+	case event.Header.EventType == ROTATE_EVENT:
+		return event.BinlogFileName, event.BinlogPosition, event.BinlogFileName != ""
+	case event.Header.LogPos == 0:
+		return "", 0, false
+	case event.BinlogFileName == "":
+		return current, event.Header.LogPos, true
+	}
+	return event.BinlogFileName, event.Header.LogPos, true
+}
+
+func  (parser *eventParser) parseRotateEvent(buf *eventReader) (event *RotateEvent, err error) {
 	event = new(RotateEvent)
-	err = binary.Read(buf, binary.LittleEndian, &event.header)
-	err = binary.Read(buf, binary.LittleEndian, &event.position)
+	err = buf.readHeader(&event.header)
+	event.position, err = buf.Uint64()
 	event.filename = buf.String()
 	return
 }
\ No newline at end of file
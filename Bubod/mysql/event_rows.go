@@ -5,14 +5,13 @@
 package mysql
 
 import (
-	"bytes"
 	"database/sql/driver"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"strconv"
 	"time"
-	"log"
+	"bubod/Bubod/logger"
 	// "encoding/json"
 )
 
@@ -35,8 +34,13 @@ type RowsEvent struct {
 	flags                 uint16
 	columnsPresentBitmap1 Bitfield
 	columnsPresentBitmap2 Bitfield
-	rows                  []map[string]driver.Value // 记录了所有的变更行
+	rows                  []map[string]driver.Value // 记录了所有的变更行，map 格式
+	values                [][]driver.Value          // 记录了所有的变更行，slice 格式
+	columns               []*ColumnInfo             // slice 格式的字段信息
 	primary			  	  string					// 记录主键字段
+	primaryKeys           []string                  // 主键字段，联合主键时按字段顺序
+	schemaVersion         uint64                    // 解码使用的表结构版本
+	skipped               bool                      // 被过滤的表，只读取了 tableId，没有解码行数据
 	// ColumnSchemaType	  *column_schema_type 		// 表字段属性
 }
 
@@ -72,32 +76,26 @@ type RowsEvent struct {
 //   }
 //   ... repeat rows until event-end
 
-func (parser *eventParser) parseRowsEvent(buf *bytes.Buffer) (event *RowsEvent, err error) {
+func (parser *eventParser) parseRowsEvent(buf *eventReader) (event *RowsEvent, err error) {
 	var columnCount uint64
 
 	//通用事件头 EventHeader
 	event = new(RowsEvent)
-	err = binary.Read(buf, binary.LittleEndian, &event.header)
-
-	//获取 event.header.EventType 事件对应的私有事件头的长度
-	headerSize := parser.format.eventTypeHeaderLengths[event.header.EventType-1]
-	var tableIdSize int
-	if headerSize == 6 {
-		tableIdSize = 4
-	} else {
-		tableIdSize = 6
-	}
+	err = buf.readHeader(&event.header)
 
-	// event = &RowsEvent{}
-	// if parser.format.EventTypeHeaderLengths[h.EventType-1] == 6 {
-	// 		event.tableIDSize = 4
-	// } else {
-	// 		event.tableIDSize = 6
-	// }
+	//根据私有事件头的长度确定 tableIdSize 字节数
+	tableIdSize := parser.format.tableIdSize(event.header.EventType)
 
 	//TableId: 4B or 6B, 如果 TableId 是 0x00ffffff，则它是一个伪事件，它应该设置语句结束标志，声明可以释放所有表映射。
 	event.tableId, err = readFixedLengthInteger(buf, tableIdSize)
 
+	// 过滤掉的表只需要 tableId 确定库表名，跳过行数据的解码
+	if tableMap := parser.tableMap[event.tableId]; tableMap != nil && tableMap.skip {
+		event.tableMap = tableMap
+		event.skipped = true
+		return
+	}
+
 	// log.Println("======parser.tableMap:", parser.tableMap)
 	// log.Println("======parser.tableSchemaMap:", parser.tableSchemaMap)
 	// log.Println("======event.tableId:", event.tableId)
@@ -116,11 +114,11 @@ func (parser *eventParser) parseRowsEvent(buf *bytes.Buffer) (event *RowsEvent,
 	// 0x0002 - no foreign key checks, 
 	// 0x0004 - no unique key checks,
 	// 0x0008 - row has a columns
-	err = binary.Read(buf, binary.LittleEndian, &event.flags)
+	event.flags, err = buf.Uint16()
 
 	switch event.header.EventType {
 	case UPDATE_ROWS_EVENTv2, WRITE_ROWS_EVENTv2, DELETE_ROWS_EVENTv2: // written from MySQL 5.6.x, added the extra-data fields
-		//err = binary.Read(buf, binary.LittleEndian, &event.flags)
+		//event.flags, err = buf.Uint16()
 		//extra_data_len: 2B, length of extra_data (has to be ≥ 2)
 		extraDataLength,_:=readFixedLengthInteger(buf, 2)
 		//extra_data: ignore
@@ -140,89 +138,88 @@ func (parser *eventParser) parseRowsEvent(buf *bytes.Buffer) (event *RowsEvent,
 	
 
 	event.tableMap = parser.tableMap[event.tableId]
+	// 整个事件使用同一版本的表结构，字段数少于事件中的字段数时说明表结构已过期(如 DDL 后未重新获取)，不能解码
+	schema := parser.schemas.get(event.tableId)
+	if schema == nil || len(schema.columns) < len(event.tableMap.columnTypes) {
+		err = fmt.Errorf("table %s.%s schema mismatch: rows event has %d columns", event.tableMap.schemaName, event.tableMap.tableName, len(event.tableMap.columnTypes))
+		return
+	}
+	event.schemaVersion = schema.version
+	event.primary = schema.primary
+	event.primaryKeys = schema.keys
+	event.columns = schema.infos
 	for buf.Len() > 0 {
 
-		// 从 buf 中解析出一个 RowEvent，转成 map[field_name][field_value] 格式
-		var row map[string]driver.Value
-		row, err = parser.parseEventRow(buf, event.tableMap, parser.tableSchemaMap[event.tableId])
+		// 从 buf 中解析出一个 RowEvent，slice 格式直接保存，map 格式转成 map[field_name][field_value]
+		var values []driver.Value
+		if parser.rowFormat == ROW_FORMAT_SLICE {
+			values = make([]driver.Value, len(event.tableMap.columnTypes))
+		} else {
+			values = parser.rowValues(len(event.tableMap.columnTypes))
+		}
+		err = parser.parseEventRow(buf, event.tableMap, schema.columns, values)
 		if err != nil {
-			log.Println("event row parser err:",err)
+			parser.logEntry().With(logger.Fields{"schema": event.tableMap.schemaName, "table": event.tableMap.tableName}).WithError(err).Error("parse event row")
 			return
 		}
 
 		// 保存
-		event.rows = append(event.rows, row)
-
-		// 判断设置的 COLUMN_KEY 约束类型，来获取主键字段
-		for _, w := range parser.tableSchemaMap[event.tableId]{
-			// b, err := json.Marshal(w)
-			// if err != nil {
-			// 	fmt.Println("encoding faild")
-			// } else {
-			// 	log.Println("================:", string(b), w.auto_increment, "##")
-			// }
-			if w.is_primary == true && w.COLUMN_KEY == "PRI" {
-				event.primary = w.COLUMN_NAME
-			}
+		if parser.rowFormat == ROW_FORMAT_SLICE {
+			event.values = append(event.values, values)
+		} else {
+			event.rows = append(event.rows, newRowMap(schema.columns, values))
 		}
 	}
 	return
 }
 
-// 字段=值，值类型转换
-func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEvent, tableSchemaMap []*column_schema_type) (row map[string]driver.Value, e error) {
+// 解析一行，按字段顺序写入 values，len(values) 为字段数，值类型转换
+func (parser *eventParser) parseEventRow(buf *eventReader, tableMap *TableMapEvent, tableSchemaMap []*column_schema_type, values []driver.Value) (e error) {
 	columnsCount := len(tableMap.columnTypes)
 	bitfieldSize := (columnsCount + 7) / 8
 
 	nullBitMap := Bitfield(buf.Next(bitfieldSize))  		// 空字段位图，若第i字段值为null，就设置nullBitMap的第i位为1，以节省存储
 	
 
-	row = make(map[string]driver.Value)
-
-
-
 	for i := 0; i < columnsCount; i++ { 					// 逐列遍历字段 Meta 信息表，它是按照表字段名升序排序的。
-		column_name := tableSchemaMap[i].COLUMN_NAME      	// 字段名
 		if nullBitMap.isSet(uint(i)) {                      // 将空字段置为nil
-			row[column_name] = nil
+			values[i] = nil
 			continue
 		}
 
 		switch tableMap.columnMetaData[i].column_type {     // 为啥是 tableMap.columnMetaData[i].column_type 而不是 tableSchemaMap[i].COLUMN_TYPE ? 
 		case FIELD_TYPE_NULL: //null
-			row[column_name] = nil
+			values[i] = nil
 
 		case FIELD_TYPE_TINY: //bool or uint8 or int8
 			var b byte
 			b, e = buf.ReadByte()
 			if tableSchemaMap[i].is_bool == true{
 				switch int(b) {
-				case 1:row[column_name] = true
-				case 0:row[column_name] = false
+				case 1:values[i] = true
+				case 0:values[i] = false
 				default:
 					if tableSchemaMap[i].unsigned == true{
-						row[column_name] = uint8(b)
+						values[i] = uint8(b)
 					}else{
-						row[column_name] = int8(b)
+						values[i] = int8(b)
 					}
 				}
 			}else{
 				if tableSchemaMap[i].unsigned == true{
-					row[column_name] = uint8(b)
+					values[i] = uint8(b)
 				}else{
-					row[column_name] = int8(b)
+					values[i] = int8(b)
 				}
 			}
 
 		case FIELD_TYPE_SHORT: //uint16 or int16
+			var short uint16
+			short, e = buf.Uint16()
 			if tableSchemaMap[i].unsigned{
-				var short uint16
-				e = binary.Read(buf, binary.LittleEndian, &short)
-				row[column_name] = short
+				values[i] = short
 			}else{
-				var short int16
-				e = binary.Read(buf, binary.LittleEndian, &short)
-				row[column_name] = short
+				values[i] = int16(short)
 			}
 
 		case FIELD_TYPE_YEAR: //1900+x
@@ -230,56 +227,52 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 			b, e = buf.ReadByte()
 			if e == nil && b != 0 {
 				//time.Date(int(b)+1900, time.January, 0, 0, 0, 0, 0, time.UTC)
-				row[column_name] = strconv.Itoa(int(b) + 1900)
+				values[i] = strconv.Itoa(int(b) + 1900)
 			}
 
 		case FIELD_TYPE_INT24: //uint32 or int32
 			if tableSchemaMap[i].unsigned {
 				var bint uint64
 				bint, e = readFixedLengthInteger(buf, 3)
-				row[column_name] = uint32(bint)
+				values[i] = uint32(bint)
 			}else{
 				var a,b,c int8
-				binary.Read(buf,binary.LittleEndian,&a)
-				binary.Read(buf,binary.LittleEndian,&b)
-				binary.Read(buf,binary.LittleEndian,&c)
-				row[column_name] = int32(a + (b << 8) + (c << 16))
+				if data := buf.Next(3); len(data) == 3 {
+					a, b, c = int8(data[0]), int8(data[1]), int8(data[2])
+				}
+				values[i] = int32(a + (b << 8) + (c << 16))
 			}
 
 		case FIELD_TYPE_LONG: //uint32 or int32
+			var long uint32
+			long, e = buf.Uint32()
 			if tableSchemaMap[i].unsigned {
-				var long uint32
-				e = binary.Read(buf, binary.LittleEndian, &long)
-				row[column_name] = long
+				values[i] = long
 			}else{
-				var long int32
-				e = binary.Read(buf, binary.LittleEndian, &long)
-				row[column_name] = long
+				values[i] = int32(long)
 			}
 
 		case FIELD_TYPE_LONGLONG: //uint64 or int64
+			var longlong uint64
+			longlong, e = buf.Uint64()
 			if tableSchemaMap[i].unsigned{
-				var longlong uint64
-				e = binary.Read(buf, binary.LittleEndian, &longlong)
-				row[column_name] = longlong
+				values[i] = longlong
 			}else {
-				var longlong int64
-				e = binary.Read(buf, binary.LittleEndian, &longlong)
-				row[column_name] = longlong
+				values[i] = int64(longlong)
 			}
 
 		case FIELD_TYPE_FLOAT: //float32
 			var float float32
-			e = binary.Read(buf, binary.LittleEndian, &float)
-			row[column_name] = float
+			float, e = buf.Float32()
+			values[i] = float
 
 		case FIELD_TYPE_DOUBLE: //float64
 			var double float64
-			e = binary.Read(buf, binary.LittleEndian, &double)
-			row[column_name] = double
+			double, e = buf.Float64()
+			values[i] = double
 
 		case FIELD_TYPE_DECIMAL: //...
-			return nil, fmt.Errorf("parseEventRow unimplemented for field type %s", fieldTypeName(tableMap.columnTypes[i]))
+			return fmt.Errorf("parseEventRow unimplemented for field type %s", fieldTypeName(tableMap.columnTypes[i]))
 
 		case FIELD_TYPE_NEWDECIMAL: //...
 			digits_per_integer := 9
@@ -310,16 +303,15 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 				res = "-"
 			}
 
-			var tmp *bytes.Buffer = new(bytes.Buffer)
-			binary.Write(tmp, binary.LittleEndian, uint8(b)^128)
-			bufPaket.unread(tmp.Next(1))
+			bufPaket.unread([]byte{b ^ 128})
 
 			if size > 0 {
 				d := bufPaket.read(size)
-				data := bytes.NewBuffer(d)
 
 				var v1 int32
-				binary.Read(data, binary.BigEndian, &v1)
+				if len(d) >= 4 {
+					v1 = int32(binary.BigEndian.Uint32(d))
+				}
 				value = int(v1) ^ mask
 				res += strconv.Itoa(value)
 			}
@@ -340,7 +332,7 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 				value = int(read_uint64_be_by_bytes(bufPaket.read(size))) ^ mask
 				res += fmt.Sprintf("%0*d", comp_fractional, value)
 			}
-			row[column_name] = res
+			values[i] = res
 
 		case FIELD_TYPE_VARCHAR: //string
 			max_length := tableMap.columnMetaData[i].max_length
@@ -348,7 +340,7 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 			//对于varchar类型，如果最大长度超过255，会用两个字节保存长度
 			if max_length > 255 {
 				var short uint16
-				e = binary.Read(buf, binary.LittleEndian, &short)
+				short, e = buf.Uint16()
 				length = int(short)
 			} else {
 				var b byte
@@ -359,14 +351,14 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 			if buf.Len() < length {
 				e = io.EOF
 			}
-			row[column_name] = string(buf.Next(length))
+			values[i] = string(buf.Next(length))
 
 		case FIELD_TYPE_STRING:
 			var length int
 			var b byte
 			b, e = buf.ReadByte()
 			length = int(b)
-			row[column_name] = string(buf.Next(length))
+			values[i] = string(buf.Next(length))
 
 		case FIELD_TYPE_ENUM:
 			//对于enum和set类型，size保存了当前列的数值用几个字节来存储
@@ -379,8 +371,15 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 			} else {
 				index = int(bytesToUint16(buf.Next(int(size))))
 			}
-			//反查enum_values[]表获取枚举对应的真实值
-			row[column_name] = tableSchemaMap[i].enum_values[index-1] 
+			//反查enum_values[]表获取枚举对应的真实值，0 为写入非法值时的空字符串，没有枚举值(离线读取)时返回序号
+			switch {
+			case index > 0 && index <= len(tableSchemaMap[i].enum_values):
+				values[i] = tableSchemaMap[i].enum_values[index-1]
+			case len(tableSchemaMap[i].enum_values) > 0:
+				values[i] = ""
+			default:
+				values[i] = index
+			}
 
 		case FIELD_TYPE_SET:
 			//对于enum和set类型，size保存了当前列的值用几个字节来存储
@@ -388,7 +387,7 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 			var index int
 			switch size {
 			case 0:
-				row[column_name] = nil
+				values[i] = nil
 				break
 			case 1:
 				var b byte
@@ -425,7 +424,7 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 			for key, _ := range result {
 				f = append(f, key)
 			}
-			row[column_name] = f
+			values[i] = f
 
 		case FIELD_TYPE_BLOB,
 			 FIELD_TYPE_TINY_BLOB, 
@@ -434,7 +433,7 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 			 FIELD_TYPE_VAR_STRING:
 			var length uint64
 			length, e = readFixedLengthInteger(buf, int(tableMap.columnMetaData[i].length_size))
-			row[column_name] = string(buf.Next(int(length)))
+			values[i] = string(buf.Next(int(length)))
 			break
 
 		case FIELD_TYPE_BIT:
@@ -494,18 +493,18 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 			}
 
 			bitInt, _ := strconv.ParseInt(resp, 2, 10)  // 以二进制方式将字符串resp解码成10位的整数
-			row[column_name] = bitInt
+			values[i] = bitInt
 			break
 
 		case FIELD_TYPE_GEOMETRY:
-			return nil, fmt.Errorf("parseEventRow unimplemented for field type %s", fieldTypeName(tableMap.columnTypes[i]))
+			return fmt.Errorf("parseEventRow unimplemented for field type %s", fieldTypeName(tableMap.columnTypes[i]))
 
 		case FIELD_TYPE_DATE, FIELD_TYPE_NEWDATE:
 			var data []byte
 			data = buf.Next(3)
 			timeInt := int(int(data[0]) + (int(data[1]) << 8) + (int(data[2]) << 16))
 			if timeInt == 0 {
-				row[column_name] = nil
+				values[i] = nil
 			} else {
 				year  := (timeInt & (((1 << 15) - 1) << 9)) >> 9
 				month := (timeInt & (((1 << 4) - 1) << 5)) >> 5
@@ -523,7 +522,7 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 				}
 				t := strconv.Itoa(year) + "-" + monthStr + "-" + dayStr
 				///tm, _ := time.Parse("2006-01-02", t)
-				row[column_name] = t
+				values[i] = t
 			}
 
 		case FIELD_TYPE_TIME:
@@ -531,7 +530,7 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 			data = buf.Next(3)
 			timeInt := int(int(data[0]) + (int(data[1]) << 8) + (int(data[2]) << 16))
 			if timeInt == 0 {
-				row[column_name] = nil
+				values[i] = nil
 			} else {
 				hour := int(timeInt / 10000)
 				minute := int((timeInt % 10000) / 100)
@@ -549,17 +548,17 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 				}
 				t := strconv.Itoa(hour) + ":" + minuteStr + ":" + secondStr
 				//tm, _ := time.Parse("15:04:05", t)
-				//row[column_name] = tm.Format("15:04:05")
-				row[column_name] = t
+				//values[i] = tm.Format("15:04:05")
+				values[i] = t
 			}
 
 		case FIELD_TYPE_TIME2:
 			var a byte
 			var b byte
 			var c byte
-			binary.Read(buf,binary.BigEndian,&a)
-			binary.Read(buf,binary.BigEndian,&b)
-			binary.Read(buf,binary.BigEndian,&c)
+			a, _ = buf.ReadByte()
+			b, _ = buf.ReadByte()
+			c, _ = buf.ReadByte()
 			timeInt := uint64((int(a) << 16) | (int(b) << 8) | int(c))
 			if timeInt >= 0x800000{
 				timeInt -= 0x1000000
@@ -580,25 +579,25 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 				secondStr = "0" + strconv.Itoa(int(second))
 			}
 			t := strconv.Itoa(int(hour)) + ":" + minuteStr + ":" + secondStr
-			row[column_name] = t
+			values[i] = t
 			break
 
 		case FIELD_TYPE_TIMESTAMP:
 			timestamp := int64(bytesToUint32(buf.Next(4)))
 			tm := time.Unix(timestamp, 0)
-			row[column_name] = tm.Format(TIME_FORMAT)
+			values[i] = tm.Format(TIME_FORMAT)
 			break
 
 		case FIELD_TYPE_TIMESTAMP2:
-			var timestamp int32
-			binary.Read(buf,binary.BigEndian,&timestamp)
-			tm := time.Unix(int64(timestamp), 0)
-			row[column_name] = tm.Format(TIME_FORMAT)
+			timestamp, _ := buf.Uint32BE()
+			tm := time.Unix(int64(int32(timestamp)), 0)
+			values[i] = tm.Format(TIME_FORMAT)
 			break
 
 		case FIELD_TYPE_DATETIME:
-			var t int64
-			e = binary.Read(buf, binary.LittleEndian, &t)
+			var u uint64
+			u, e = buf.Uint64()
+			t := int64(u)
 
 			second := int(t % 100)
 			minute := int((t % 10000) / 100)
@@ -608,20 +607,20 @@ func (parser *eventParser) parseEventRow(buf *bytes.Buffer, tableMap *TableMapEv
 			month  := time.Month((d % 10000) / 100)
 			year   := d / 10000
 
-			row[column_name] = time.Date(year, month, day, hour, minute, second, 0, time.UTC).Format(TIME_FORMAT)
+			values[i] = time.Date(year, month, day, hour, minute, second, 0, time.UTC).Format(TIME_FORMAT)
 			break
 
 		case FIELD_TYPE_DATETIME2:
-			row[column_name],e = read_datetime2(buf)
+			values[i],e = read_datetime2(buf)
 			break
 
 		default:
-			return nil, fmt.Errorf("Unknown FieldType %d", tableMap.columnTypes[i])
+			return fmt.Errorf("Unknown FieldType %d", tableMap.columnTypes[i])
 		}
 		
 		if e != nil {
-			log.Println("lastFiled err:",tableMap.columnMetaData[i].column_type,e)
-			return nil, e
+			parser.logEntry().With(logger.Fields{"schema": tableMap.schemaName, "table": tableMap.tableName}).WithError(e).Error("parse field, column type:", tableMap.columnMetaData[i].column_type)
+			return e
 		}
 	}
 	return
@@ -655,7 +654,7 @@ DATETIME
 ---------------------------
 40 bits = 5 bytes
 */
-func read_datetime2(buf *bytes.Buffer)(data string,err error) {
+func read_datetime2(buf *eventReader)(data string,err error) {
 	defer func(){
 		if errs:=recover();errs!=nil{
 			err = fmt.Errorf(fmt.Sprint(errs))
@@ -664,8 +663,8 @@ func read_datetime2(buf *bytes.Buffer)(data string,err error) {
 	}()
 	var b byte
 	var a uint32
-	binary.Read(buf, binary.BigEndian, &a)
-	binary.Read(buf, binary.BigEndian, &b)
+	a, _ = buf.Uint32BE()
+	b, _ = buf.ReadByte()
 	/*
 	log.Println("read_datetime2 a:",a)
 	log.Println("read_datetime2 b:",b)
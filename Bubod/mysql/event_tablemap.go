@@ -5,8 +5,6 @@
 package mysql
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
 )
@@ -42,6 +40,7 @@ type TableMapEvent struct {
 	columnMeta     []uint16 		//
 	columnMetaData []*ColumnType    //
 	nullBitmap     Bitfield         //
+	skip           bool             // 被过滤的表，不解码 rows 事件
 }
 
 
@@ -153,29 +152,21 @@ func (event *TableMapEvent) parseColumnMetadata(data []byte) error {
 //   		lenenc-str     column-meta-def
 //   		n              NULL-bitmask, length: (column-count + 8) / 7
 //
-func (parser *eventParser) parseTableMapEvent(buf *bytes.Buffer) (event *TableMapEvent, err error) {
+func (parser *eventParser) parseTableMapEvent(buf *eventReader) (event *TableMapEvent, err error) {
 	var byteLength byte
 	var columnCount, variableLength uint64
 
 	//通用事件头 EventHeader
 	event = new(TableMapEvent)
-	err = binary.Read(buf, binary.LittleEndian, &event.header)
+	err = buf.readHeader(&event.header)
 
-	//获取 event.header.EventType 事件对应的私有事件头的长度
-	headerSize := parser.format.eventTypeHeaderLengths[event.header.EventType-1]
-
-	//根据 headerSize 字节数确定 tableIdSize 字节数
-	var tableIdSize int
-	if headerSize == 6 {
-		tableIdSize = 4
-	} else {
-		tableIdSize = 6
-	}
+	//根据私有事件头的长度确定 tableIdSize 字节数
+	tableIdSize := parser.format.tableIdSize(event.header.EventType)
 
 	//TableId: 4B or 6B
 	event.tableId, err = readFixedLengthInteger(buf, tableIdSize)
 	//Flags: 2B
-	err = binary.Read(buf, binary.LittleEndian, &event.flags)
+	event.flags, err = buf.Uint16()
 
 	//schema name length: 1B
 	byteLength, err = buf.ReadByte()
@@ -217,7 +208,8 @@ func (parser *eventParser) parseTableMapEvent(buf *bytes.Buffer) (event *TableMa
 	}
 
 	//null_bitmap (string.var_len) -- [len=(column_count + 8) / 7]
-	event.nullBitmap = Bitfield(buf.Next(int((columnCount + 7) / 8)))
+	// TableMapEvent 会被缓存，packet 缓冲区会被复用，需要复制
+	event.nullBitmap = Bitfield(append([]byte(nil), buf.Next(int((columnCount + 7) / 8))...))
 
 	//Checksum: 4B
 	if parser.binlog_checksum {
@@ -0,0 +1,95 @@
+// 事件类型分组和名称解析
+// OnlyEvent 可以使用分组代替逐个列出 v0/v1/v2 各版本的 rows 事件，如 append(RowEvents(), DDLEvents()...)。
+// 配置文件中以名称列出事件，不区分大小写:
+//
+//   - 分组: rows、insert、update、delete、ddl
+//   - 事件: EventName 返回的名称，如 WRITE_ROWS_EVENTv2、QUERY_EVENT，或事件类型编号
+package mysql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 插入行事件 WRITE_ROWS_EVENT v0/v1/v2
+func InsertEvents() []EventType {
+	return []EventType{WRITE_ROWS_EVENTv0, WRITE_ROWS_EVENTv1, WRITE_ROWS_EVENTv2}
+}
+
+// 更新行事件 UPDATE_ROWS_EVENT v0/v1/v2
+func UpdateEvents() []EventType {
+	return []EventType{UPDATE_ROWS_EVENTv0, UPDATE_ROWS_EVENTv1, UPDATE_ROWS_EVENTv2}
+}
+
+// 删除行事件 DELETE_ROWS_EVENT v0/v1/v2
+func DeleteEvents() []EventType {
+	return []EventType{DELETE_ROWS_EVENTv0, DELETE_ROWS_EVENTv1, DELETE_ROWS_EVENTv2}
+}
+
+// 所有 rows 事件
+func RowEvents() []EventType {
+	events := InsertEvents()
+	events = append(events, UpdateEvents()...)
+	return append(events, DeleteEvents()...)
+}
+
+// DDL 所在的 QUERY_EVENT
+func DDLEvents() []EventType {
+	return []EventType{QUERY_EVENT}
+}
+
+// 事件名称或编号转为事件类型，不区分大小写
+func EventTypeFromString(name string) (EventType, error) {
+	name = strings.TrimSpace(name)
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < int(UNKNOWN_EVENT) || n > int(PREVIOUS_GTIDS_EVENT) {
+			return UNKNOWN_EVENT, fmt.Errorf("unknown event type %d", n)
+		}
+		return EventType(n), nil
+	}
+	for e := UNKNOWN_EVENT; e <= PREVIOUS_GTIDS_EVENT; e++ {
+		if strings.EqualFold(e.String(), name) {
+			return e, nil
+		}
+	}
+	return UNKNOWN_EVENT, fmt.Errorf("unknown event type %q", name)
+}
+
+// 解析事件列表，元素可以是分组名或事件名，重复的事件只保留一个
+func ParseEventTypes(names []string) ([]EventType, error) {
+	var events []EventType
+	seen := make(map[EventType]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		var group []EventType
+		switch strings.ToLower(name) {
+		case "rows":
+			group = RowEvents()
+		case "insert":
+			group = InsertEvents()
+		case "update":
+			group = UpdateEvents()
+		case "delete":
+			group = DeleteEvents()
+		case "ddl":
+			group = DDLEvents()
+		default:
+			e, err := EventTypeFromString(name)
+			if err != nil {
+				return nil, err
+			}
+			group = []EventType{e}
+		}
+		for _, e := range group {
+			if !seen[e] {
+				seen[e] = true
+				events = append(events, e)
+			}
+		}
+	}
+	return events, nil
+}
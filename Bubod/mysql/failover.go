@@ -0,0 +1,130 @@
+// master 切换
+// 配置多个候选 master 时，每次建立 dump 连接都选择其中可写(read_only=0)的实例，AllowReplica 时选择第一个可连接的实例；
+// 只配置一个 DNS/代理地址时，由 DNS/代理指向新的 master。
+// 两种方式都通过 server_uuid 变化识别切换，切换后按已执行的 GTID 集合在新 master 上续传，并投递 FailoverEvent。
+package mysql
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"bubod/Bubod/logger"
+)
+
+// master 切换事件
+type FailoverEvent struct {
+	OldMaster     string `json:"old_master"` // host:port
+	NewMaster     string `json:"new_master"`
+	OldServerUUID string `json:"old_server_uuid"`
+	NewServerUUID string `json:"new_server_uuid"`
+	GTIDSet       string `json:"gtid_set"` // 在新 master 上续传的 GTID 集合
+}
+
+// 连接 master，配置了 Candidates 时依次尝试，返回第一个可写的实例
+func (This *BinlogDump) connectMaster() (driver.Conn, string, error) {
+	candidates := This.Candidates
+	if len(candidates) == 0 {
+		candidates = []string{This.DataSource}
+	}
+	dbopen := &mysqlDriver{}
+	var lastErr error
+	for _, dataSource := range candidates {
+		conn, err := dbopen.Open(dataSource)
+		if err != nil {
+			lastErr = err
+			This.logEntry().With(logger.Fields{"master": dsnAddr(dataSource)}).WithError(err).Warn("connect master")
+			continue
+		}
+		if len(This.Candidates) == 0 || This.AllowReplica {
+			return conn, dataSource, nil
+		}
+		readOnly, err := conn.(*mysqlConn).getSystemVar("read_only")
+		if err == nil && readOnly == "0" {
+			return conn, dataSource, nil
+		}
+		conn.Close()
+		if err != nil {
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no writable master among %d candidates", len(candidates))
+	}
+	return nil, "", lastErr
+}
+
+// 记录当前 master，server_uuid 与上次连接不同时返回切换事件
+// 集合不完整时无法在新 master 上定位，返回错误
+func (This *BinlogDump) checkFailover(conn *mysqlConn, dataSource string) (*FailoverEvent, error) {
+	// 5.6 以前没有 server_uuid，无法识别切换
+	uuid, err := conn.getSystemVar("server_uuid")
+	if err != nil {
+		uuid = ""
+	}
+	oldMaster, oldUUID := This.master, This.serverUUID
+
+	This.parser.connLock.Lock()
+	This.master = dataSource
+	// 元数据连接同样切换到新 master
+	if oldMaster != dataSource && atomic.CompareAndSwapInt32(&This.parser.connStatus, 1, 0) {
+		This.parser.conn.Close()
+	}
+	This.parser.connLock.Unlock()
+	This.serverUUID = uuid
+
+	if oldUUID == "" || uuid == "" || oldUUID == uuid {
+		return nil, nil
+	}
+	gtidSet, ok := This.parser.gtid.String()
+	if !ok {
+		return nil, fmt.Errorf("master changed from %s to %s, but executed GTID set is incomplete, set gtid_set to resume", dsnAddr(oldMaster), dsnAddr(dataSource))
+	}
+	// 新 master 的 binlog 文件位点与原 master 无关，按 GTID 续传
+	This.parser.gtidSet = gtidSet
+	This.parser.binlogFileName = ""
+	This.parser.binlogPosition = 4
+	return &FailoverEvent{
+		OldMaster:     dsnAddr(oldMaster),
+		NewMaster:     dsnAddr(dataSource),
+		OldServerUUID: oldUUID,
+		NewServerUUID: uuid,
+		GTIDSet:       gtidSet,
+	}, nil
+}
+
+// 投递切换事件
+func (This *BinlogDump) deliverFailover(failover *FailoverEvent) {
+	This.logEntry().With(logger.Fields{
+		"old_master": failover.OldMaster,
+		"new_master": failover.NewMaster,
+		"gtid":       failover.GTIDSet,
+	}).Warn("master failover")
+	if This.CallbackFun == nil {
+		return
+	}
+	This.CallbackFun(&EventReslut{
+		Header:   EventHeader{Timestamp: uint32(time.Now().Unix())},
+		Failover: failover,
+	})
+}
+
+// 已执行的 GTID 集合，未按 GTID 启动且尚未读到 PREVIOUS_GTIDS_EVENT 时 ok 为 false
+func (This *BinlogDump) ExecutedGTIDSet() (gtidSet string, ok bool) {
+	parser := This.currentParser()
+	if parser == nil {
+		return "", false
+	}
+	return parser.gtid.String()
+}
+
+// DSN 中的地址，用于日志
+func dsnAddr(dataSource string) string {
+	d, err := ParseDSN(dataSource)
+	if err != nil {
+		return ""
+	}
+	_, addr := d.Addr()
+	return addr
+}
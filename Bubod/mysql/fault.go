@@ -0,0 +1,128 @@
+// 故障注入
+// 在测试环境中模拟 dump 连接断开、网络延迟、事件校验和损坏和表结构查询失败，
+// 用于验证高可用切换、断线重连和死信队列，通过 BinlogDump.SetFaults 设置，立即生效。
+package mysql
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"time"
+
+	"bubod/Bubod/logger"
+)
+
+// 注入的故障，计数类故障每触发一次减 1，减到 0 后不再触发
+type Faults struct {
+	DropAfterEvents   int `json:"drop_after_events"`   // 再收到 N 个事件后断开 dump 连接，由重连从已投递位点继续
+	PacketDelayMs     int `json:"packet_delay_ms"`     // 每个 packet 读取后延迟的毫秒数，0 为不延迟
+	CorruptChecksums  int `json:"corrupt_checksums"`   // 之后 N 个事件的校验和损坏，按 ErrorPolicy 处理；需要 master 开启 binlog_checksum
+	FailSchemaLookups int `json:"fail_schema_lookups"` // 之后 N 次表结构查询失败
+}
+
+func (faults *Faults) Validate() error {
+	if faults.DropAfterEvents < 0 || faults.PacketDelayMs < 0 || faults.CorruptChecksums < 0 || faults.FailSchemaLookups < 0 {
+		return fmt.Errorf("faults must not be negative")
+	}
+	return nil
+}
+
+type faultInjector struct {
+	sync.Mutex
+	faults Faults
+}
+
+func (injector *faultInjector) set(faults Faults) {
+	injector.Lock()
+	injector.faults = faults
+	injector.Unlock()
+}
+
+func (injector *faultInjector) get() Faults {
+	injector.Lock()
+	defer injector.Unlock()
+	return injector.faults
+}
+
+// 读取 packet 后调用，返回非 nil 时按读取失败处理(断开重连)，离线解析时 injector 为 nil
+// 校验和只在行变更、语句等普通事件上损坏，格式描述、rotate 和心跳事件不受影响
+func (injector *faultInjector) afterRead(pkt []byte, checksum bool) error {
+	if injector == nil {
+		return nil
+	}
+	injector.Lock()
+	faults := &injector.faults
+	delay := time.Duration(faults.PacketDelayMs) * time.Millisecond
+	var err error
+	if len(pkt) > 1+19 && pkt[0] == 0 {
+		if faults.DropAfterEvents > 0 {
+			faults.DropAfterEvents--
+			if faults.DropAfterEvents == 0 {
+				err = fmt.Errorf("fault injection: drop dump connection")
+			}
+		}
+		switch EventType(pkt[5]) {
+		case FORMAT_DESCRIPTION_EVENT, ROTATE_EVENT, HEARTBEAT_EVENT:
+		default:
+			if err == nil && checksum && faults.CorruptChecksums > 0 {
+				faults.CorruptChecksums--
+				pkt[len(pkt)-1] ^= 0xff
+			}
+		}
+	}
+	injector.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return err
+}
+
+// 查询表结构前调用，返回非 nil 时查询失败
+func (injector *faultInjector) schemaLookup(database string, tablename string) error {
+	if injector == nil {
+		return nil
+	}
+	injector.Lock()
+	defer injector.Unlock()
+	if injector.faults.FailSchemaLookups <= 0 {
+		return nil
+	}
+	injector.faults.FailSchemaLookups--
+	return fmt.Errorf("fault injection: schema lookup %s.%s failed", database, tablename)
+}
+
+// 校验事件的 CRC32 校验和，data 为含 4 字节校验和的完整事件
+// 心跳事件和校验和算法为 NONE 的格式描述事件不校验
+func verifyEventChecksum(data []byte) error {
+	if len(data) < 19+4 {
+		return fmt.Errorf("event too short for checksum: %d bytes", len(data))
+	}
+	switch EventType(data[4]) {
+	case HEARTBEAT_EVENT:
+		return nil
+	case FORMAT_DESCRIPTION_EVENT:
+		if data[len(data)-5] != 1 {
+			return nil
+		}
+	}
+	n := len(data) - 4
+	if expected, actual := bytesToUint32(data[n:]), crc32.ChecksumIEEE(data[:n]); expected != actual {
+		return fmt.Errorf("event checksum mismatch: expected %08x, actual %08x", expected, actual)
+	}
+	return nil
+}
+
+// 设置故障注入，全部为 0 时关闭
+func (This *BinlogDump) SetFaults(faults Faults) error {
+	if err := faults.Validate(); err != nil {
+		return err
+	}
+	This.faults.set(faults)
+	This.logEntry().With(logger.Fields{"faults": faults}).Warn("fault injection")
+	return nil
+}
+
+// 当前剩余的故障
+func (This *BinlogDump) Faults() Faults {
+	return This.faults.get()
+}
@@ -0,0 +1,287 @@
+// 解析 CDC 工具写入消息队列的 json 消息
+// 将每行一条的变更消息(bubod、Maxwell、Canal flat message、Debezium 格式)转为事件，由 replay 命令从文件或标准输入读取后写入输出(如 applier)。
+// bubod 不是 Kafka 消费者: 不连接 broker，没有消费组和 offset，消费和 offset 提交由管道前的工具(如 kafka-console-consumer --group)完成，
+// 与写入输出无关，中断后可能重复或丢失消息；applier 默认的 overwrite 模式重复写入是幂等的。
+//
+// 字段信息优先取表结构快照(见 schema_snapshot.go)，快照中没有的表按消息中的字段名排序生成，
+// 类型只有 Canal 的 mysqlType，此时 auto_ddl 无法建表；主键取消息中的主键字段(Maxwell 需开启 output_primary_key_columns)，
+// Debezium 消息中没有主键，需要快照，否则 update/delete 按变更前的所有字段定位。
+// 字段值按消息中的原样写入，数字为 json.Number；Debezium 按其类型编码的时间、decimal 等字段不做转换。
+package mysql
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 消息格式
+const (
+	CDC_FORMAT_BUBOD    = "bubod"
+	CDC_FORMAT_MAXWELL  = "maxwell"
+	CDC_FORMAT_CANAL    = "canal"
+	CDC_FORMAT_DEBEZIUM = "debezium"
+)
+
+// 按格式解析消息
+type CDCDecoder struct {
+	format string
+	tables map[string]*tableSchema // 快照中的表结构 db.table
+}
+
+// snapshot 为 nil 时按消息中的字段生成字段信息
+func NewCDCDecoder(format string, snapshot *SchemaSnapshot) (*CDCDecoder, error) {
+	switch format {
+	case CDC_FORMAT_BUBOD, CDC_FORMAT_MAXWELL, CDC_FORMAT_CANAL, CDC_FORMAT_DEBEZIUM:
+	default:
+		return nil, fmt.Errorf("unknown format %q, must be bubod, maxwell, canal or debezium", format)
+	}
+	decoder := &CDCDecoder{format: format, tables: make(map[string]*tableSchema)}
+	if snapshot != nil {
+		for name, columns := range snapshot.columns() {
+			decoder.tables[name] = newTableSchema(0, name, 0, columns)
+		}
+	}
+	return decoder, nil
+}
+
+// 解析一条消息，返回 nil 时忽略该消息(如控制消息、tombstone)
+func (decoder *CDCDecoder) Decode(message []byte) (*EventReslut, error) {
+	switch decoder.format {
+	case CDC_FORMAT_MAXWELL:
+		return decoder.decodeMaxwell(message)
+	case CDC_FORMAT_CANAL:
+		return decoder.decodeCanal(message)
+	case CDC_FORMAT_DEBEZIUM:
+		return decoder.decodeDebezium(message)
+	}
+	event, err := ParseEventDataJson(message)
+	if err != nil || event.RowCount() == 0 {
+		return event, err
+	}
+	decoder.setColumns(event, event.PrimaryKeys, nil)
+	return event, nil
+}
+
+func decodeJson(message []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// 行变更事件，update 的 rows 为变更前、变更后交替
+func (decoder *CDCDecoder) rowsEvent(eventType EventType, schemaName string, tableName string, rows []map[string]driver.Value, keys []string, types map[string]string) *EventReslut {
+	event := &EventReslut{
+		Header:     EventHeader{EventType: eventType},
+		SchemaName: schemaName,
+		TableName:  tableName,
+		Rows:       rows,
+	}
+	decoder.setColumns(event, keys, types)
+	return event
+}
+
+// 字段信息和主键，优先使用快照
+func (decoder *CDCDecoder) setColumns(event *EventReslut, keys []string, types map[string]string) {
+	if schema, ok := decoder.tables[event.SchemaName+"."+event.TableName]; ok {
+		event.Columns, event.Primary, event.PrimaryKeys = schema.infos, schema.primary, schema.keys
+		return
+	}
+	names := make(map[string]bool)
+	for _, row := range event.Rows {
+		for name := range row {
+			names[name] = true
+		}
+	}
+	primary := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		primary[key] = true
+	}
+	event.Columns = make([]*ColumnInfo, 0, len(names))
+	for name := range names {
+		column := &ColumnInfo{Name: name, Type: strings.ToLower(types[name]), Nullable: !primary[name], IsPrimary: primary[name]}
+		if column.IsPrimary {
+			column.Key = "PRI"
+		}
+		column.Unsigned = strings.Contains(column.Type, "unsigned")
+		event.Columns = append(event.Columns, column)
+	}
+	sort.Slice(event.Columns, func(i, j int) bool {
+		return event.Columns[i].Name < event.Columns[j].Name
+	})
+	event.PrimaryKeys = keys
+	if len(keys) > 0 {
+		event.Primary = keys[len(keys)-1]
+	}
+}
+
+// DDL 事件
+func ddlEvent(schemaName string, query string) *EventReslut {
+	return &EventReslut{
+		Header:     EventHeader{EventType: QUERY_EVENT},
+		SchemaName: schemaName,
+		Query:      query,
+		DDL:        ParseDDL(query, schemaName),
+	}
+}
+
+// 变更后的行覆盖 old 中变更前的值
+func beforeRow(after map[string]driver.Value, old map[string]driver.Value) map[string]driver.Value {
+	before := make(map[string]driver.Value, len(after))
+	for name, value := range after {
+		before[name] = value
+	}
+	for name, value := range old {
+		before[name] = value
+	}
+	return before
+}
+
+// Maxwell
+type maxwellMessage struct {
+	Database          string                  `json:"database"`
+	Table             string                  `json:"table"`
+	Type              string                  `json:"type"` // insert/update/delete/bootstrap-insert，DDL 为 table-create 等
+	Ts                uint32                  `json:"ts"`
+	Data              map[string]driver.Value `json:"data"`
+	Old               map[string]driver.Value `json:"old"` // update 变更的字段变更前的值
+	PrimaryKeyColumns []string                `json:"primary_key_columns"`
+	SQL               string                  `json:"sql"`
+}
+
+func (decoder *CDCDecoder) decodeMaxwell(message []byte) (*EventReslut, error) {
+	data := &maxwellMessage{}
+	if err := decodeJson(message, data); err != nil {
+		return nil, err
+	}
+	var event *EventReslut
+	switch data.Type {
+	case "insert", "bootstrap-insert":
+		event = decoder.rowsEvent(WRITE_ROWS_EVENTv2, data.Database, data.Table, []map[string]driver.Value{data.Data}, data.PrimaryKeyColumns, nil)
+	case "update":
+		event = decoder.rowsEvent(UPDATE_ROWS_EVENTv2, data.Database, data.Table,
+			[]map[string]driver.Value{beforeRow(data.Data, data.Old), data.Data}, data.PrimaryKeyColumns, nil)
+	case "delete":
+		event = decoder.rowsEvent(DELETE_ROWS_EVENTv2, data.Database, data.Table, []map[string]driver.Value{data.Data}, data.PrimaryKeyColumns, nil)
+	default:
+		if data.SQL == "" {
+			// bootstrap-start/bootstrap-complete 等控制消息
+			return nil, nil
+		}
+		event = ddlEvent(data.Database, data.SQL)
+	}
+	event.Header.Timestamp = data.Ts
+	return event, nil
+}
+
+// Canal flat message
+type canalMessage struct {
+	Database  string                    `json:"database"`
+	Table     string                    `json:"table"`
+	Type      string                    `json:"type"` // INSERT/UPDATE/DELETE，DDL 为 CREATE/ALTER 等
+	IsDdl     bool                      `json:"isDdl"`
+	SQL       string                    `json:"sql"`
+	PkNames   []string                  `json:"pkNames"`
+	Data      []map[string]driver.Value `json:"data"`
+	Old       []map[string]driver.Value `json:"old"` // update 变更的字段变更前的值，与 data 一一对应
+	MysqlType map[string]string         `json:"mysqlType"`
+	Es        int64                     `json:"es"` // binlog 事件时间(毫秒)
+}
+
+func (decoder *CDCDecoder) decodeCanal(message []byte) (*EventReslut, error) {
+	data := &canalMessage{}
+	if err := decodeJson(message, data); err != nil {
+		return nil, err
+	}
+	var event *EventReslut
+	switch {
+	case data.IsDdl:
+		if data.SQL == "" {
+			return nil, nil
+		}
+		event = ddlEvent(data.Database, data.SQL)
+	case data.Type == "INSERT":
+		event = decoder.rowsEvent(WRITE_ROWS_EVENTv2, data.Database, data.Table, data.Data, data.PkNames, data.MysqlType)
+	case data.Type == "DELETE":
+		event = decoder.rowsEvent(DELETE_ROWS_EVENTv2, data.Database, data.Table, data.Data, data.PkNames, data.MysqlType)
+	case data.Type == "UPDATE":
+		rows := make([]map[string]driver.Value, 0, len(data.Data)*2)
+		for i, after := range data.Data {
+			var old map[string]driver.Value
+			if i < len(data.Old) {
+				old = data.Old[i]
+			}
+			rows = append(rows, beforeRow(after, old), after)
+		}
+		event = decoder.rowsEvent(UPDATE_ROWS_EVENTv2, data.Database, data.Table, rows, data.PkNames, data.MysqlType)
+	default:
+		return nil, fmt.Errorf("unknown canal type %q", data.Type)
+	}
+	event.Header.Timestamp = uint32(data.Es / 1000)
+	return event, nil
+}
+
+// Debezium，带 schema 时为 {"schema":...,"payload":...}
+type debeziumPayload struct {
+	Before map[string]driver.Value `json:"before"`
+	After  map[string]driver.Value `json:"after"`
+	Op     string                  `json:"op"` // c/r/u/d，t 为 truncate
+	TsMs   int64                   `json:"ts_ms"`
+	Source struct {
+		Db    string `json:"db"`
+		Table string `json:"table"`
+		File  string `json:"file"`
+		Pos   uint32 `json:"pos"`
+		Gtid  string `json:"gtid"`
+		TsMs  int64  `json:"ts_ms"`
+	} `json:"source"`
+	DDL          string `json:"ddl"` // schema change topic
+	DatabaseName string `json:"databaseName"`
+}
+
+type debeziumMessage struct {
+	Payload *debeziumPayload `json:"payload"`
+}
+
+func (decoder *CDCDecoder) decodeDebezium(message []byte) (*EventReslut, error) {
+	if len(bytes.TrimSpace(message)) == 0 || string(bytes.TrimSpace(message)) == "null" {
+		// tombstone
+		return nil, nil
+	}
+	envelope := &debeziumMessage{}
+	if err := decodeJson(message, envelope); err != nil {
+		return nil, err
+	}
+	data := envelope.Payload
+	if data == nil {
+		data = &debeziumPayload{}
+		if err := decodeJson(message, data); err != nil {
+			return nil, err
+		}
+	}
+	var event *EventReslut
+	switch {
+	case data.DDL != "":
+		event = ddlEvent(data.DatabaseName, data.DDL)
+	case data.Op == "c" || data.Op == "r":
+		event = decoder.rowsEvent(WRITE_ROWS_EVENTv2, data.Source.Db, data.Source.Table, []map[string]driver.Value{data.After}, nil, nil)
+	case data.Op == "u":
+		event = decoder.rowsEvent(UPDATE_ROWS_EVENTv2, data.Source.Db, data.Source.Table, []map[string]driver.Value{data.Before, data.After}, nil, nil)
+	case data.Op == "d":
+		event = decoder.rowsEvent(DELETE_ROWS_EVENTv2, data.Source.Db, data.Source.Table, []map[string]driver.Value{data.Before}, nil, nil)
+	case data.Op == "t":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown debezium op %q", data.Op)
+	}
+	ts := data.Source.TsMs
+	if ts == 0 {
+		ts = data.TsMs
+	}
+	event.Header.Timestamp = uint32(ts / 1000)
+	event.BinlogFileName, event.BinlogPosition, event.GTID = data.Source.File, data.Source.Pos, data.Source.Gtid
+	return event, nil
+}
@@ -1,6 +1,9 @@
 package mysql
 import (
+	"bytes"
 	"fmt"
+	"strconv"
+	"strings"
 	// "log"
 	"database/sql/driver"
 	"encoding/json"
@@ -10,10 +13,17 @@ import (
 最终输出格式:
 {
 	"binlog": "mysql-bin.000004:786",
+	"gtid": "3E11FA47-71CA-11E1-9E33-C80AA9429562:23",
 	"db": "test",
 	"table": "test1",
 	"query": "",
 	"event_type": "update",
+	"primary": "id",
+	"primary_keys": ["id"],
+	"key": "[2]",
+	"fields": {
+		"ingest_time": 1536883200123
+	},
 	"before": {
 		"id": 2,
 		"num": 1,
@@ -31,14 +41,23 @@ import (
 */
 type FormatDataJsonStruct struct {
 	Binlog		string 	`json:"binlog"`
+	GTID		string	`json:"gtid,omitempty"`	// 所在事务的 GTID uuid:gno；master 开启 GTID 时有值
 	Db  		string 	`json:"db"`
 	Table  	 	string  `json:"table"`		// table
 	Query		string	`json:"query"`		// 如果非 insert、update、delete.则返回操作sql
 	EventType  	string 	`json:"event_type"`	// 操作类型 insert、update、delete、空
 	Primary		string	`json:"primary"`	// 主键字段；EventType非空时有值
+	PrimaryKeys	[]string `json:"primary_keys,omitempty"`	// 主键字段，联合主键时按字段顺序；有主键时有值
+	Key			string	`json:"key,omitempty"`	// 主键值的规范字符串，见 RowKey；有主键时有值，可用于分区和幂等写入
+	OldKey		string	`json:"old_key,omitempty"`	// update 修改了主键时变更前的主键，下游需要删除旧主键的数据
 	Before 		map[string]driver.Value `json:"before"`	// 变更前数据
 	After		map[string]driver.Value `json:"after"`	// 变更后数据
 	Timestamp	uint32	`json:"timestamp"`	// 事件事件
+	DDL			*DDLEvent `json:"ddl,omitempty"`	// DDL 解析结果；EventType 为 ddl 时有值
+	Failover	*FailoverEvent `json:"failover,omitempty"`	// master 切换；EventType 为 failover 时有值
+	Restart		*MasterRestartEvent `json:"restart,omitempty"`	// master 重启；EventType 为 restart 时有值
+	Traceparent	string	`json:"traceparent,omitempty"`	// 链路追踪上下文(W3C traceparent)；开启追踪时有值
+	Fields		map[string]driver.Value `json:"fields,omitempty"`	// 计算字段；配置 computed_fields 时有值
 }
 
 // 自定义类型name
@@ -65,45 +84,143 @@ func FormatEventDataJson(data *FormatDataJsonStruct) string {
 	return ""
 }
 
+// 解析 FormatEventDataJson 生成的消息，用于回放归档的消息
+// 行数据的数字为 json.Number，insert/delete 的行在 before 中，update 为 before、after 两行
+func ParseEventDataJson(message []byte) (*EventReslut, error) {
+	data := new(FormatDataJsonStruct)
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	if err := decoder.Decode(data); err != nil {
+		return nil, err
+	}
+	event := &EventReslut{
+		Header:     EventHeader{Timestamp: data.Timestamp},
+		SchemaName: data.Db,
+		TableName:  data.Table,
+		Query:      data.Query,
+		GTID:       data.GTID,
+		Primary:    data.Primary,
+		PrimaryKeys: data.PrimaryKeys,
+		DDL:        data.DDL,
+		Failover:   data.Failover,
+		Restart:    data.Restart,
+	}
+	if i := strings.LastIndexByte(data.Binlog, ':'); i > 0 {
+		pos, _ := strconv.ParseUint(data.Binlog[i+1:], 10, 32)
+		event.BinlogFileName, event.BinlogPosition = data.Binlog[:i], uint32(pos)
+	}
+	switch data.EventType {
+	case "insert":
+		event.Header.EventType = WRITE_ROWS_EVENTv2
+		event.Rows = []map[string]driver.Value{data.Before}
+	case "delete":
+		event.Header.EventType = DELETE_ROWS_EVENTv2
+		event.Rows = []map[string]driver.Value{data.Before}
+	case "update":
+		event.Header.EventType = UPDATE_ROWS_EVENTv2
+		event.Rows = []map[string]driver.Value{data.Before, data.After}
+	case "ddl":
+		event.Header.EventType = QUERY_EVENT
+	case "failover":
+	case "restart":
+		event.Header.EventType = FORMAT_DESCRIPTION_EVENT
+	default:
+		return nil, fmt.Errorf("unknown event_type %q", data.EventType)
+	}
+	return event, nil
+}
+
 // 拆分组装数据
 func FormatEventData(data *EventReslut) []string {
-	if len(data.Rows)<1 {
+	return FormatEventDataWith(data, nil)
+}
+
+// 按渲染方案转换字段值后拆分组装数据，profile 为 nil 时同 FormatEventData，见 render.go
+func FormatEventDataWith(data *EventReslut, profile *RenderProfile) []string {
+	if data.Failover != nil {
+		return []string{FormatEventDataJson(&FormatDataJsonStruct{
+			EventType: 	"failover",
+			Timestamp:	data.Header.Timestamp,
+			Failover:	data.Failover,
+		})}
+	}
+	if data.Restart != nil {
+		return []string{FormatEventDataJson(&FormatDataJsonStruct{
+			Binlog:		fmt.Sprintf("%s:%d", data.BinlogFileName, data.BinlogPosition),
+			EventType: 	"restart",
+			Timestamp:	data.Header.Timestamp,
+			Restart:	data.Restart,
+		})}
+	}
+	if data.DDL != nil {
+		return []string{FormatEventDataJson(&FormatDataJsonStruct{
+			Binlog:		fmt.Sprintf("%s:%d", data.BinlogFileName, data.BinlogPosition),
+			GTID:		data.GTID,
+			Db:  		data.DDL.SchemaName,
+			Table:  	data.DDL.TableName,
+			EventType: 	"ddl",
+			Query:		data.Query,
+			Timestamp:	data.Header.Timestamp,
+			DDL:		data.DDL,
+			Traceparent: data.Trace.Traceparent(),
+		})}
+	}
+	rows := data.RowMaps()
+	if len(rows)<1 {
 		return nil
 	}
+	overrides := profile.tableColumnRenders(data.SchemaName, data.TableName)
+	if !profile.identity() && (len(data.Columns) > 0 || len(overrides) > 0) {
+		columns := make(map[string]*ColumnInfo, len(data.Columns))
+		for _, column := range data.Columns {
+			columns[column.Name] = column
+		}
+		rendered := make([]map[string]driver.Value, 0, len(rows))
+		for _, row := range rows {
+			rendered = append(rendered, profile.renderRow(row, columns, overrides))
+		}
+		rows = rendered
+	}
 
 	binlog := fmt.Sprintf("%s:%d", data.BinlogFileName, data.BinlogPosition)
 	eventType := EvenTypeName(data.Header.EventType)
 	
 	formatDataJsonStruct := &FormatDataJsonStruct{
 		Binlog:		binlog,
+		GTID:		data.GTID,
 		Db:  		data.SchemaName,
 		Table:  	data.TableName,
 		EventType: 	eventType,
 		Query:		"",
 		Primary:	data.Primary,
+		PrimaryKeys: data.PrimaryKeys,
 		Before:		make(map[string]driver.Value),
 		After:		make(map[string]driver.Value),
 		Timestamp:	data.Header.Timestamp,
+		Traceparent: data.Trace.Traceparent(),
 	}
 	var formatEventDatas = make([]string, 0)
 	switch eventType {
 	case "insert", "delete":
 
 		// var formatEventDatas = make([]string, len(data.Rows))
-		for _, row := range data.Rows {
+		for k, row := range rows {
 			_data := formatDataJsonStruct
 			_data.Before = row
+			_data.Key = rowKeyString(data.Key(k))
 			formatEventDatas = append(formatEventDatas, FormatEventDataJson(_data))
 		}
 
 	case "update":
 		
 		// var formatEventDatas = make([]string, len(data.Rows)/2)
-		for k, row := range data.Rows {
+		for k, row := range rows {
 			if k%2 == 1 { // 奇数
 				_data := formatDataJsonStruct
-				_data.Before = row			// data.Rows[k-1]
-				_data.After = data.Rows[k]
+				_data.Before = rows[k-1]
+				_data.After = row
+				_data.Key = rowKeyString(data.Key(k / 2))
+				_data.OldKey = rowKeyString(data.OldKey(k / 2))
 				formatEventDatas = append(formatEventDatas, FormatEventDataJson(_data))
 			}
 		}
@@ -117,6 +234,13 @@ func FormatEventData(data *EventReslut) []string {
 	return formatEventDatas
 }
 
+func rowKeyString(key *RowKey) string {
+	if key == nil {
+		return ""
+	}
+	return key.String()
+}
+
 /*
 {
 	"binlog": "mysql-bin.000005:4",
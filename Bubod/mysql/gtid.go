@@ -0,0 +1,250 @@
+// GTID 集合解析与编码
+// https://dev.mysql.com/doc/internals/en/com-binlog-dump-gtid.html
+package mysql
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GTID 区间 [Start, Stop)
+type gtidInterval struct {
+	Start int64
+	Stop  int64
+}
+
+type gtidSid struct {
+	Sid       []byte // 16 字节 server uuid
+	Intervals []gtidInterval
+}
+
+// 解析 GTID 集合
+// 格式: 3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5:7,4E11FA47-71CA-11E1-9E33-C80AA9429562:1-3
+func parseGTIDSet(gtidSet string) ([]*gtidSid, error) {
+	sids := make([]*gtidSid, 0)
+	gtidSet = strings.TrimSpace(gtidSet)
+	if gtidSet == "" {
+		return sids, nil
+	}
+	for _, item := range strings.Split(gtidSet, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("Invalid GTID set %s", item)
+		}
+		sid, err := hex.DecodeString(strings.Replace(parts[0], "-", "", -1))
+		if err != nil || len(sid) != 16 {
+			return nil, fmt.Errorf("Invalid GTID server uuid %s", parts[0])
+		}
+		s := &gtidSid{Sid: sid}
+		for _, interval := range parts[1:] {
+			bounds := strings.SplitN(interval, "-", 2)
+			start, err := strconv.ParseInt(bounds[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid GTID interval %s", interval)
+			}
+			stop := start
+			if len(bounds) == 2 {
+				stop, err = strconv.ParseInt(bounds[1], 10, 64)
+				if err != nil || stop < start {
+					return nil, fmt.Errorf("Invalid GTID interval %s", interval)
+				}
+			}
+			s.Intervals = append(s.Intervals, gtidInterval{Start: start, Stop: stop + 1})
+		}
+		sids = append(sids, s)
+	}
+	return sids, nil
+}
+
+// 检查 GTID 集合格式
+func ValidateGTIDSet(gtidSet string) error {
+	if strings.TrimSpace(gtidSet) == "" {
+		return fmt.Errorf("empty gtid set")
+	}
+	_, err := parseGTIDSet(gtidSet)
+	return err
+}
+
+// 编码 GTID 集合，用于 COM_BINLOG_DUMP_GTID
+//   8              n_sids
+//   n_sids * {
+//     16           sid
+//     8            n_intervals
+//     n_intervals * {
+//       8          start
+//       8          end
+//     }
+//   }
+func encodeGTIDSet(sids []*gtidSid) []byte {
+	data := make([]byte, 0)
+	data = append(data, uint64ToBytes(uint64(len(sids)))...)
+	for _, s := range sids {
+		data = append(data, s.Sid...)
+		data = append(data, uint64ToBytes(uint64(len(s.Intervals)))...)
+		for _, interval := range s.Intervals {
+			data = append(data, uint64ToBytes(uint64(interval.Start))...)
+			data = append(data, uint64ToBytes(uint64(interval.Stop))...)
+		}
+	}
+	return data
+}
+
+// 解码 PREVIOUS_GTIDS_EVENT 中的 GTID 集合，格式同 encodeGTIDSet
+func decodeGTIDSet(data []byte) ([]*gtidSid, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("Invalid GTID set data")
+	}
+	n := bytesToUint64(data[0:8])
+	pos := 8
+	sids := make([]*gtidSid, 0, n)
+	for i := uint64(0); i < n; i++ {
+		if len(data) < pos+24 {
+			return nil, fmt.Errorf("Invalid GTID set data")
+		}
+		s := &gtidSid{Sid: append([]byte(nil), data[pos:pos+16]...)}
+		m := bytesToUint64(data[pos+16 : pos+24])
+		pos += 24
+		if uint64(len(data)-pos) < m*16 {
+			return nil, fmt.Errorf("Invalid GTID set data")
+		}
+		for j := uint64(0); j < m; j++ {
+			s.Intervals = append(s.Intervals, gtidInterval{
+				Start: int64(bytesToUint64(data[pos : pos+8])),
+				Stop:  int64(bytesToUint64(data[pos+8 : pos+16])),
+			})
+			pos += 16
+		}
+		sids = append(sids, s)
+	}
+	return sids, nil
+}
+
+// 16 字节 server uuid 转为 3e11fa47-71ca-11e1-9e33-c80aa9429562
+func formatUUID(sid []byte) string {
+	s := hex.EncodeToString(sid)
+	if len(s) != 32 {
+		return s
+	}
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+// 已执行的 GTID 集合，重连或 master 切换后按 GTID 续传
+// 事务提交(XID_EVENT/非 BEGIN 的 QUERY_EVENT)后才加入集合，切换时未完成的事务会在新 master 上重新投递
+type gtidTracker struct {
+	sync.Mutex
+	executed map[string][]gtidInterval // server uuid => 区间
+	pending  *gtidSid                  // 当前事务的 GTID
+	complete bool                      // 是否包含起始位点之前的全部 GTID
+}
+
+func newGTIDTracker() *gtidTracker {
+	return &gtidTracker{executed: make(map[string][]gtidInterval)}
+}
+
+// base 为起始 GTID 集合；为空时(按文件位点启动)需要等到下一个 binlog 文件的 PREVIOUS_GTIDS_EVENT 才完整
+func (tracker *gtidTracker) reset(base string) {
+	tracker.Lock()
+	tracker.executed = make(map[string][]gtidInterval)
+	tracker.pending = nil
+	tracker.complete = false
+	tracker.Unlock()
+	if sids, err := parseGTIDSet(base); err == nil && len(sids) > 0 {
+		tracker.merge(sids)
+	}
+}
+
+func (tracker *gtidTracker) begin(sid []byte, gno int64) {
+	tracker.Lock()
+	defer tracker.Unlock()
+	// sid 指向事件缓冲区，需要复制
+	tracker.pending = &gtidSid{Sid: append([]byte(nil), sid...), Intervals: []gtidInterval{{Start: gno, Stop: gno + 1}}}
+}
+
+func (tracker *gtidTracker) commit() {
+	tracker.Lock()
+	defer tracker.Unlock()
+	if tracker.pending == nil {
+		return
+	}
+	tracker.add(tracker.pending)
+	tracker.pending = nil
+}
+
+// 合并 GTID 集合，之后集合视为完整
+func (tracker *gtidTracker) merge(sids []*gtidSid) {
+	tracker.Lock()
+	defer tracker.Unlock()
+	for _, s := range sids {
+		tracker.add(s)
+	}
+	tracker.complete = true
+}
+
+func (tracker *gtidTracker) add(s *gtidSid) {
+	uuid := formatUUID(s.Sid)
+	intervals := append(tracker.executed[uuid], s.Intervals...)
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].Start < intervals[j].Start
+	})
+	merged := intervals[:0]
+	for _, interval := range intervals {
+		if n := len(merged); n > 0 && interval.Start <= merged[n-1].Stop {
+			if interval.Stop > merged[n-1].Stop {
+				merged[n-1].Stop = interval.Stop
+			}
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	tracker.executed[uuid] = merged
+}
+
+// 集合不完整时 ok 为 false
+func (tracker *gtidTracker) String() (gtidSet string, ok bool) {
+	tracker.Lock()
+	defer tracker.Unlock()
+	uuids := make([]string, 0, len(tracker.executed))
+	for uuid := range tracker.executed {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	items := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		item := uuid
+		for _, interval := range tracker.executed[uuid] {
+			if interval.Stop-1 == interval.Start {
+				item += fmt.Sprintf(":%d", interval.Start)
+			} else {
+				item += fmt.Sprintf(":%d-%d", interval.Start, interval.Stop-1)
+			}
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, ","), tracker.complete
+}
+
+// 是否包含 sids 中的全部 GTID
+func (tracker *gtidTracker) contains(sids []*gtidSid) bool {
+	tracker.Lock()
+	defer tracker.Unlock()
+	for _, s := range sids {
+		executed := tracker.executed[formatUUID(s.Sid)]
+		for _, interval := range s.Intervals {
+			covered := false
+			for _, e := range executed {
+				if e.Start <= interval.Start && interval.Stop <= e.Stop {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+// 心跳与空闲检测
+// dump 连接设置 @master_heartbeat_period，master 没有新事件时按周期发送 HEARTBEAT_EVENT；
+// dump 连接的读超时默认为 DUMP_IDLE_HEARTBEATS 个心跳周期，超时未收到任何事件或心跳时视为连接失效，断开后重连。
+// 只使用 dump 连接本身，不需要额外连接轮询 information_schema.PROCESSLIST，也不需要 PROCESS 权限。
+package mysql
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// 默认心跳周期
+const DUMP_HEARTBEAT_PERIOD = 10 * time.Second
+
+// 连续多少个心跳周期未收到数据时断开
+const DUMP_IDLE_HEARTBEATS = 3
+
+// 设置 master 心跳周期，DSN 未配置 readTimeout 时 dump 连接的读超时设置为 DUMP_IDLE_HEARTBEATS 个周期
+func (This *BinlogDump) setHeartbeat(mc *mysqlConn) error {
+	period := This.HeartbeatPeriod
+	if period == 0 {
+		period = DUMP_HEARTBEAT_PERIOD
+	}
+	if period < 0 {
+		return nil
+	}
+	// 单位为纳秒
+	sql := fmt.Sprintf("SET @master_heartbeat_period=%d", period.Nanoseconds())
+	if _, err := mc.Exec(sql, make([]driver.Value, 0)); err != nil {
+		return err
+	}
+	// Aurora 空闲时不保证发送心跳，见 rds.go
+	if mc.cfg.readTimeout == 0 && !mc.cfg.rds {
+		mc.cfg.readTimeout = period * DUMP_IDLE_HEARTBEATS
+	}
+	return nil
+}
+
+// dump 连接读取失败时，超过读超时未收到数据说明 master 已失联(心跳也未收到)
+func (mc *mysqlConn) dumpReadError(e error) error {
+	if mc.cfg.readTimeout > 0 && time.Since(mc.readStart) >= mc.cfg.readTimeout {
+		return fmt.Errorf("no event or heartbeat from master in %s, dump connection idle", mc.cfg.readTimeout)
+	}
+	return e
+}
@@ -0,0 +1,186 @@
+// 大事务保护
+// 事件按 rows 事件逐个投递，不在内存中缓冲整个事务，大事务占用的内存由流水线深度和单个事件的大小限制。
+// 解析阶段统计当前事务(BEGIN 到 XID/COMMIT)的 rows 事件行数和字节数，
+// 超过 MaxTransactionRows/MaxTransactionBytes 时按 LargeTransactionPolicy 处理，每个事务只处理一次。
+// 被过滤的表的 rows 事件没有解码，只计入字节数。
+// 重连后从事务中间的已投递位点继续读取时，统计延续重连前的值，已读取未投递的事件会重复计入。
+//
+// 事务结束时记录行数、字节数和时长(BEGIN 到 XID/COMMIT 的事件时间之差，秒级精度)的直方图指标，
+// 超过 TransactionAlert 任一阈值时回调 TransactionAlertFun，用于在复制延迟之前发现大事务和长事务。
+// 重连后从事务中间开始读取的事务没有 BEGIN，不统计。
+package mysql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"bubod/Bubod/logger"
+	"bubod/Bubod/metrics"
+)
+
+// 大事务的处理策略
+const (
+	TXN_POLICY_STREAM = "stream" // 继续逐个投递，告警(默认)
+	TXN_POLICY_SKIP   = "skip"   // 丢弃该事务剩余的 rows 事件，告警；已投递的部分不撤回
+	TXN_POLICY_FAIL   = "fail"   // 停止同步
+)
+
+// 事务超过大小限制
+type LargeTransactionError struct {
+	File     string
+	Position uint32 // 事务起始位点
+	Rows     int64
+	Bytes    int64
+}
+
+func (e *LargeTransactionError) Error() string {
+	return fmt.Sprintf("large transaction at %s:%d exceeds limit, rows: %d, bytes: %d", e.File, e.Position, e.Rows, e.Bytes)
+}
+
+// 事务告警阈值，均为 0 时不告警
+type TransactionThreshold struct {
+	Rows     int64         // 行数
+	Bytes    int64         // rows 事件字节数
+	Duration time.Duration // BEGIN 到 XID/COMMIT 的时长
+}
+
+func (threshold *TransactionThreshold) exceeded(stats *TransactionStats) bool {
+	return (threshold.Rows > 0 && stats.Rows > threshold.Rows) ||
+		(threshold.Bytes > 0 && stats.Bytes > threshold.Bytes) ||
+		(threshold.Duration > 0 && time.Duration(stats.Duration)*time.Second > threshold.Duration)
+}
+
+// 已结束的事务
+type TransactionStats struct {
+	File       string   `json:"file"`
+	Position   uint32   `json:"position"` // BEGIN 的位点
+	GTID       string   `json:"gtid,omitempty"`
+	Rows       int64    `json:"rows"`
+	Bytes      int64    `json:"bytes"`
+	Begin      uint32   `json:"begin"`    // BEGIN 的事件时间
+	Commit     uint32   `json:"commit"`   // XID/COMMIT 的事件时间
+	Duration   uint32   `json:"duration"` // 秒
+	Tables     []string `json:"tables"`   // db.table
+	RolledBack bool     `json:"rolled_back,omitempty"`
+}
+
+// 事务超过告警阈值时回调
+type transactionCallback func(stats *TransactionStats)
+
+// 当前事务的大小
+type txnTracker struct {
+	active   bool
+	file     string
+	position uint32
+	gtid     string
+	begin    uint32 // BEGIN 的事件时间
+	rows     int64
+	bytes    int64
+	tables   map[string]bool
+	exceeded bool // 已超过限制
+	looped   bool // applier 写入的事务，见 loop.go
+}
+
+func (tracker *txnTracker) reset() {
+	*tracker = txnTracker{}
+}
+
+// 统计事务大小，返回 false 时丢弃该事件，error 不为 nil 时停止同步
+func (parser *eventParser) checkTransaction(event *EventReslut) (bool, error) {
+	tracker := &parser.txn
+	switch event.Header.EventType {
+	case QUERY_EVENT:
+		query := strings.ToUpper(strings.TrimSpace(event.Query))
+		if query == "BEGIN" {
+			tracker.reset()
+			tracker.active = true
+			tracker.file = event.BinlogFileName
+			tracker.position = event.Header.LogPos - event.Header.EventSize
+			tracker.gtid = event.GTID
+			tracker.begin = event.Header.Timestamp
+		} else if query == "COMMIT" || query == "ROLLBACK" {
+			parser.endTransaction(event, query == "ROLLBACK")
+			tracker.reset()
+		}
+		return true, nil
+	case XID_EVENT:
+		parser.endTransaction(event, false)
+		tracker.reset()
+		return true, nil
+	case WRITE_ROWS_EVENTv0, WRITE_ROWS_EVENTv1, WRITE_ROWS_EVENTv2,
+		UPDATE_ROWS_EVENTv0, UPDATE_ROWS_EVENTv1, UPDATE_ROWS_EVENTv2,
+		DELETE_ROWS_EVENTv0, DELETE_ROWS_EVENTv1, DELETE_ROWS_EVENTv2:
+	default:
+		return true, nil
+	}
+	if !tracker.active {
+		return true, nil
+	}
+	tracker.rows += int64(event.RowCount())
+	tracker.bytes += int64(event.Header.EventSize)
+	if tracker.tables == nil {
+		tracker.tables = make(map[string]bool)
+	}
+	tracker.tables[event.SchemaName+"."+event.TableName] = true
+	if tracker.exceeded {
+		return parser.largeTxnPolicy != TXN_POLICY_SKIP, nil
+	}
+	if (parser.maxTxnRows <= 0 || tracker.rows <= parser.maxTxnRows) && (parser.maxTxnBytes <= 0 || tracker.bytes <= parser.maxTxnBytes) {
+		return true, nil
+	}
+
+	tracker.exceeded = true
+	policy := parser.largeTxnPolicy
+	if policy == "" {
+		policy = TXN_POLICY_STREAM
+	}
+	metrics.LargeTransactions.Inc(parser.name, policy)
+	err := &LargeTransactionError{File: tracker.file, Position: tracker.position, Rows: tracker.rows, Bytes: tracker.bytes}
+	entry := parser.logEntry().With(logger.Fields{"binlog_file": tracker.file, "binlog_pos": tracker.position, "db": event.SchemaName, "table": event.TableName, "policy": policy})
+	switch policy {
+	case TXN_POLICY_SKIP:
+		entry.Error(err.Error() + ", skip the rest of the transaction")
+		return false, nil
+	case TXN_POLICY_FAIL:
+		entry.Error(err.Error())
+		parser.state.Transition(STATE_CLOSING)
+		return false, err
+	default:
+		entry.Warn(err.Error())
+		return true, nil
+	}
+}
+
+// 事务结束，记录指标，超过告警阈值时回调
+func (parser *eventParser) endTransaction(event *EventReslut, rolledBack bool) {
+	tracker := &parser.txn
+	if !tracker.active || parser.offline {
+		return
+	}
+	stats := &TransactionStats{
+		File:       tracker.file,
+		Position:   tracker.position,
+		GTID:       tracker.gtid,
+		Rows:       tracker.rows,
+		Bytes:      tracker.bytes,
+		Begin:      tracker.begin,
+		Commit:     event.Header.Timestamp,
+		RolledBack: rolledBack,
+	}
+	if stats.Commit > stats.Begin {
+		stats.Duration = stats.Commit - stats.Begin
+	}
+	metrics.TransactionRows.Observe(float64(stats.Rows), parser.name)
+	metrics.TransactionBytes.Observe(float64(stats.Bytes), parser.name)
+	metrics.TransactionDuration.Observe(float64(stats.Duration), parser.name)
+	if parser.txnAlertCallback == nil || !parser.txnAlert.exceeded(stats) {
+		return
+	}
+	for table := range tracker.tables {
+		stats.Tables = append(stats.Tables, table)
+	}
+	sort.Strings(stats.Tables)
+	parser.txnAlertCallback(stats)
+}
@@ -1,8 +1,10 @@
 package mysql
 
 import (
+	"bubod/Bubod/trace"
 	"database/sql/driver"
 	"fmt"
+	"time"
 )
 // 表字段描述
 type column_schema_type struct {
@@ -13,12 +15,17 @@ type column_schema_type struct {
 	COLUMN_KEY         string	// 约束类型，PRI主键约束、UNI唯一约束、MUL可以重复、没有主键则为空 "“（没有用户手动设置的主键，mysql自身优化创建的主键无法获取）
 	COLUMN_TYPE        string	// 字段类型 如：int(10)、varchar(16)、int(11) unsigned、float(9,2)
 	NUMERIC_SCALE      string   // 浮点数精确多少数
+	IS_NULLABLE        string	// 是否允许 NULL，YES/NO
+	COLUMN_DEFAULT     string	// 默认值，has_default 为 false 时没有默认值或默认值为 NULL
+	DATETIME_PRECISION string	// datetime/timestamp/time 的小数秒位数，其他类型为空
 	enum_values        []string // 枚举值，0 - enum_values[0]、1 - enum_values[1]
 	set_values         []string // 集合值，
 	is_bool            bool     // 是否布尔类型
 	is_primary         bool		// 是否索引，COLUMN_KEY非空时候此值为true
 	unsigned 		   bool     // 是否无符号整数
 	auto_increment     bool		// 是否自增列
+	nullable           bool		// IS_NULLABLE 为 YES
+	has_default        bool		// COLUMN_DEFAULT 不为 NULL
 }
 
 type MysqlConnection interface {
@@ -32,13 +39,26 @@ type MysqlConnection interface {
 // 事件内容
 type EventReslut struct {
 	Header         EventHeader                  // 通用事件头
-	Rows           []map[string]driver.Value 	// 变更数据
+	Rows           []map[string]driver.Value 	// 变更数据，map 格式
+	Values         [][]driver.Value 			// 变更数据，slice 格式，按 Columns 顺序
+	Columns        []*ColumnInfo 				// 字段信息，只读，slice 格式的 Values 按其顺序
 	Query          string						// sql
 	SchemaName     string						// 库
 	TableName      string						// 表
 	BinlogFileName string   					// binlog文件名
 	BinlogPosition uint32   					// binlog文件偏移
 	Primary		   string						// 主键字段
+	PrimaryKeys    []string                     // 主键字段，联合主键时按字段顺序，无主键时为空，见 Key
+	SchemaVersion  uint64                       // 解码 rows 事件使用的表结构版本，表结构更新后递增
+	GTID           string                       // 所在事务的 GTID uuid:gno，rows 和 QUERY 事件有值，未开启 GTID 时为空
+	DDL            *DDLEvent                    // DDL 语句解析结果，非 DDL 时为 nil
+	Failover       *FailoverEvent               // master 切换，非切换事件时为 nil
+	Restart        *MasterRestartEvent          // master 重启，在重启后第一个文件的 FORMAT_DESCRIPTION_EVENT 上，其他事件为 nil
+	Trace          *trace.Span                  // 链路追踪，未开启或未采样时为 nil
+	Source         string                       // 数据源名称，解析时设置
+	ParsedAt       time.Time                    // 解析完成的时间，用于端到端延迟；不是从 binlog 解析的事件为零值
+	retained       bool                         // 已调用 Retain，Rows 不回收
+	skipped        bool                         // 被过滤的表的 rows 事件，没有解码行数据
 	// ColumnSchemaType	  *column_schema_type 	// 表字段属性
 }
 
@@ -0,0 +1,40 @@
+package mysql
+
+import (
+	"bubod/Bubod/logger"
+)
+
+// 日志上下文: 实例名、当前位点、GTID
+func (parser *eventParser) logEntry() *logger.Entry {
+	return logger.With(logger.Fields{
+		"instance":    parser.name,
+		"binlog_file": parser.binlogFileName,
+		"binlog_pos":  parser.binlogPosition,
+		"gtid":        parser.gtidSet,
+	})
+}
+
+func (This *BinlogDump) logEntry() *logger.Entry {
+	if This.parser == nil {
+		return logger.With(logger.Fields{"instance": This.Name})
+	}
+	return This.parser.logEntry()
+}
+
+// 事件的库表、事件类型
+func (event *EventReslut) LogFields() logger.Fields {
+	return logger.Fields{
+		"schema":     event.SchemaName,
+		"table":      event.TableName,
+		"event_type": event.Header.EventName(),
+	}
+}
+
+func (event *ErrorEvent) fields() logger.Fields {
+	return logger.Fields{
+		"schema":     event.SchemaName,
+		"table":      event.TableName,
+		"event_type": event.Header.EventName(),
+		"binlog_pos": event.BinlogPosition,
+	}
+}
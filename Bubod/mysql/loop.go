@@ -0,0 +1,46 @@
+// 双向同步防回环
+// 两个集群通过 applier 互相同步时，applier 写入的变更会被对端的数据源再次读取并同步回来。
+// applier 配置 loop_marker 后(见 lib/sink_mysql.go)，写入的每个事务先更新标记表，执行的 DDL 以 LOOP_QUERY_COMMENT 开头；
+// 数据源配置 LoopMarkerTable 为同一张表后:
+//
+//	rows 事件   包含标记表变更的事务中的 rows 事件(包括标记表本身)不投递，标记表的变更是事务中的第一个 rows 事件
+//	DDL        以 LOOP_QUERY_COMMENT 开头的语句不投递，仍更新表结构缓存
+//
+// 标记表不需要在同步的库中。需要 binlog_format=ROW。
+package mysql
+
+import (
+	"strings"
+
+	"bubod/Bubod/metrics"
+)
+
+// applier 执行的语句的前缀
+const LOOP_QUERY_COMMENT = "/* bubod:apply */"
+
+// 是否为 applier 写入的事件，在 checkTransaction 之前调用
+func (parser *eventParser) looped(event *EventReslut) bool {
+	if parser.loopMarkerTable == "" {
+		return false
+	}
+	switch event.Header.EventType {
+	case QUERY_EVENT:
+		if strings.HasPrefix(strings.TrimSpace(event.Query), LOOP_QUERY_COMMENT) {
+			metrics.LoopEventsSkipped.Inc(parser.name)
+			return true
+		}
+		return false
+	case WRITE_ROWS_EVENTv0, WRITE_ROWS_EVENTv1, WRITE_ROWS_EVENTv2,
+		UPDATE_ROWS_EVENTv0, UPDATE_ROWS_EVENTv1, UPDATE_ROWS_EVENTv2,
+		DELETE_ROWS_EVENTv0, DELETE_ROWS_EVENTv1, DELETE_ROWS_EVENTv2:
+	default:
+		return false
+	}
+	if event.SchemaName+"."+event.TableName == parser.loopMarkerTable {
+		parser.txn.looped = true
+	}
+	if parser.txn.looped {
+		metrics.LoopEventsSkipped.Inc(parser.name)
+	}
+	return parser.txn.looped
+}
@@ -0,0 +1,68 @@
+// 库名、表名匹配
+// 名称中可以使用通配符 * 和 ?(语法同 path.Match)，如 order_*、log_20??。
+// 大小写敏感性与 master 的 lower_case_table_names 一致: 0 时区分大小写，
+// 1、2 时不区分(1 时库表名以小写保存，2 时保留建表时的大小写但比较时不区分)。
+package mysql
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// 名称是否含有通配符
+func IsNamePattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// name 是否与 pattern 匹配，pattern 不含通配符时为名称相等
+func MatchName(pattern string, name string, ignoreCase bool) bool {
+	if ignoreCase {
+		pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	}
+	if !IsNamePattern(pattern) {
+		return pattern == name
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// 检查通配符语法
+func ValidateNamePattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %q", pattern)
+	}
+	return nil
+}
+
+// 查询 master 的 lower_case_table_names
+func LowerCaseTableNames(dataSource string) (int, error) {
+	dbopen := &mysqlDriver{}
+	conn, err := dbopen.Open(dataSource)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	val, err := conn.(*mysqlConn).getSystemVar("lower_case_table_names")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(val)
+}
+
+// schemaName 是否在 ReplicateDoDb 中，ReplicateDoDb 为空时同步所有库
+func (parser *eventParser) isSyncDb(schemaName string) bool {
+	if len(parser.replicateDoDb) == 0 {
+		return true
+	}
+	if _, ok := parser.replicateDoDb[schemaName]; ok {
+		return true
+	}
+	for db := range parser.replicateDoDb {
+		if MatchName(db, schemaName, parser.ignoreCase) {
+			return true
+		}
+	}
+	return false
+}
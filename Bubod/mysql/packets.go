@@ -3,6 +3,8 @@
 package mysql
 
 import (
+	"bufio"
+	"crypto/tls"
 	"database/sql/driver"
 	"errors"
 	"fmt"
@@ -12,6 +14,15 @@ import (
 
 // Read packet to buffer
 func (mc *mysqlConn) readPacket() ([]byte, error) {
+	return mc.readPacketTo(nil)
+}
+
+// 读取 packet 到 buf，buf 容量不足时重新分配；buf 为 nil 时新分配
+func (mc *mysqlConn) readPacketTo(buf *[]byte) ([]byte, error) {
+	if mc.cfg.readTimeout > 0 {
+		mc.readStart = time.Now()
+		mc.netConn.SetReadDeadline(mc.readStart.Add(mc.cfg.readTimeout))
+	}
 	// Packet Length
 	pktLen, e := mc.readNumber(3)
 	if e != nil {
@@ -36,7 +47,15 @@ func (mc *mysqlConn) readPacket() ([]byte, error) {
 	mc.sequence++
 
 	// Read rest of packet
-	data := make([]byte, pktLen)
+	var data []byte
+	if buf == nil {
+		data = make([]byte, pktLen)
+	} else {
+		if cap(*buf) < int(pktLen) {
+			*buf = make([]byte, pktLen)
+		}
+		data = (*buf)[:pktLen]
+	}
 	var n, add int
 	for e == nil && n < int(pktLen) {
 		add, e = mc.bufReader.Read(data[n:])
@@ -46,7 +65,7 @@ func (mc *mysqlConn) readPacket() ([]byte, error) {
 		if e == nil {
 			e = fmt.Errorf("Length of read data (%d) does not match body length (%d)", n, pktLen)
 		}
-		errLog.Print(`packets:58 `, e)
+		errLog.WithError(e).Error("read packet")
 		return nil, driver.ErrBadConn
 	}
 	return data, e
@@ -66,7 +85,7 @@ func (mc *mysqlConn) readNumber(nr uint8) (uint64, error) {
 		if e == nil {
 			e = fmt.Errorf("Length of read data (%d) does not match header length (%d)", n, nr)
 		}
-		errLog.Print(`packets:78 `, e)
+		errLog.WithError(e).Error("read number")
 		return 0, driver.ErrBadConn
 	}
 
@@ -85,12 +104,15 @@ func (mc *mysqlConn) writePacket(data *[]byte) error {
 	}
 
 	// Write packet
+	if mc.cfg.writeTimeout > 0 {
+		mc.netConn.SetWriteDeadline(time.Now().Add(mc.cfg.writeTimeout))
+	}
 	n, e := mc.netConn.Write(*data)
 	if e != nil || n != len(*data) {
 		if e == nil {
 			e = errors.New("Length of send data does not match packet length")
 		}
-		errLog.Print(`packets:102 `, e)
+		errLog.WithError(e).Error("write packet")
 		return driver.ErrBadConn
 	}
 
@@ -169,6 +191,10 @@ func (mc *mysqlConn) readInitPacket() (e error) {
 	pos++
 
 	// Server status [16 bit uint]
+	// 高 16 位能力标志在状态之后
+	if len(data) >= pos+4 {
+		mc.server.flags |= ClientFlag(bytesToUint16(data[pos+2:pos+4])) << 16
+	}
 	pos += 15
 
 	mc.server.scrambleBuff = append(mc.server.scrambleBuff, data[pos:pos+12]...)
@@ -188,27 +214,22 @@ n (Length Coded Binary)      scramble_buff (1 + x bytes)
 n (Null-Terminated String)   databasename (optional)
 */
 func (mc *mysqlConn) writeAuthPacket() (e error) {
-	// Adjust client flags based on server support
-	clientFlags := uint32(  CLIENT_MULTI_STATEMENTS |
-							//CLIENT_MULTI_RESULTS  |
-							CLIENT_PROTOCOL_41 		|
-							CLIENT_SECURE_CONN 		|
-							CLIENT_LONG_PASSWORD 	|
-							CLIENT_TRANSACTIONS)
-	if mc.server.flags&CLIENT_LONG_FLAG > 0 {
-		clientFlags |= uint32(CLIENT_LONG_FLAG)
+	clientFlags := mc.clientFlags()
+	var attrs []byte
+	if clientFlags&uint32(CLIENT_CONNECT_ATTRS) > 0 {
+		attrs = mc.cfg.connectAttrs()
 	}
-	// To specify a db name
-	if len(mc.cfg.dbname) > 0 {
-		clientFlags |= uint32(CLIENT_CONNECT_WITH_DB)
+	// 使用外部凭据时声明认证插件，服务端可以切换到 mysql_clear_password，见 credential.go
+	var plugin []byte
+	if clientFlags&uint32(CLIENT_PLUGIN_AUTH) > 0 {
+		plugin = append([]byte("mysql_native_password"), 0)
 	}
-	
 
 	// User Password
 	scrambleBuff := scramblePassword(mc.server.scrambleBuff, []byte(mc.cfg.passwd))
 
 	// Calculate packet length and make buffer with that size
-	pktLen := 4 + 4 + 1 + 23 + len(mc.cfg.user) + 1 + 1 + len(scrambleBuff) + len(mc.cfg.dbname) + 1
+	pktLen := 4 + 4 + 1 + 23 + len(mc.cfg.user) + 1 + 1 + len(scrambleBuff) + len(mc.cfg.dbname) + 1 + len(plugin) + len(attrs)
 	data := make([]byte, 0, pktLen+4)
 
 	// Add the packet header
@@ -248,10 +269,152 @@ func (mc *mysqlConn) writeAuthPacket() (e error) {
 		data = append(data, 0x0)
 	}
 
+	// 认证插件
+	data = append(data, plugin...)
+
+	// 连接属性
+	data = append(data, attrs...)
+
 	// Send Auth packet
 	return mc.writePacket(&data)
 }
 
+// 握手时请求的能力标志，SSL 请求包和认证包相同
+func (mc *mysqlConn) clientFlags() uint32 {
+	// Adjust client flags based on server support
+	clientFlags := uint32(  CLIENT_MULTI_STATEMENTS |
+							//CLIENT_MULTI_RESULTS  |
+							CLIENT_PROTOCOL_41 		|
+							CLIENT_SECURE_CONN 		|
+							CLIENT_LONG_PASSWORD 	|
+							CLIENT_TRANSACTIONS)
+	if mc.server.flags&CLIENT_LONG_FLAG > 0 {
+		clientFlags |= uint32(CLIENT_LONG_FLAG)
+	}
+	// To specify a db name
+	if len(mc.cfg.dbname) > 0 {
+		clientFlags |= uint32(CLIENT_CONNECT_WITH_DB)
+	}
+	// 代理兼容模式只请求服务端声明支持的能力，支持时发送连接属性
+	if mc.cfg.proxy {
+		clientFlags &= uint32(mc.server.flags) | uint32(CLIENT_PROTOCOL_41)
+		if mc.server.flags&CLIENT_CONNECT_ATTRS > 0 {
+			clientFlags |= uint32(CLIENT_CONNECT_ATTRS)
+		}
+	}
+	// RDS/Aurora 模式需要读取存储过程返回的结果集，见 rds.go
+	if mc.cfg.rds {
+		clientFlags |= uint32(CLIENT_MULTI_RESULTS)
+	}
+	if mc.cfg.credential != "" && mc.server.flags&CLIENT_PLUGIN_AUTH > 0 {
+		clientFlags |= uint32(CLIENT_PLUGIN_AUTH)
+	}
+	if mc.cfg.tls != nil {
+		clientFlags |= uint32(CLIENT_SSL)
+	}
+	if mc.cfg.foundRows {
+		clientFlags |= uint32(CLIENT_FOUND_ROWS)
+	}
+	return clientFlags
+}
+
+/* SSL Request Packet
+Bytes                        Name
+-----                        ----
+4                            client_flags
+4                            max_packet_size
+1                            charset_number
+23                           (filler) always 0x00...
+*/
+// 发送 SSL 请求后升级为 TLS 连接，之后的认证包在 TLS 连接上发送
+func (mc *mysqlConn) startTLS() (e error) {
+	if mc.server.flags&CLIENT_SSL == 0 {
+		return errors.New("MySQL-Server does not support TLS")
+	}
+	pktLen := 4 + 4 + 1 + 23
+	data := make([]byte, 0, pktLen+4)
+	data = append(data, uint24ToBytes(uint32(pktLen))...)
+	data = append(data, mc.sequence)
+	data = append(data, uint32ToBytes(mc.clientFlags())...)
+	data = append(data, uint32ToBytes(MAX_PACKET_SIZE)...)
+	data = append(data, mc.server.charset)
+	data = append(data, make([]byte, 23)...)
+	if e = mc.writePacket(&data); e != nil {
+		return
+	}
+
+	tlsConn := tls.Client(mc.netConn, mc.cfg.tls)
+	if mc.cfg.timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(mc.cfg.timeout))
+	}
+	if e = tlsConn.Handshake(); e != nil {
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	mc.netConn = tlsConn
+	mc.bufReader = bufio.NewReader(tlsConn)
+	return
+}
+
+/* Auth Switch Request Packet
+Bytes                        Name
+-----                        ----
+1                            0xfe
+n (Null-Terminated String)   plugin name
+n                            auth plugin data
+*/
+// 读取认证结果，服务端要求切换认证方式时按新的认证方式重新发送密码
+func (mc *mysqlConn) readAuthResult() (e error) {
+	data, e := mc.readPacket()
+	if e != nil {
+		return
+	}
+	if data[0] != 254 || len(data) == 1 {
+		return mc.handleAuthResult(data)
+	}
+
+	plugin, e := readSlice(data[1:], 0x00)
+	if e != nil {
+		return errors.New("Malformed Auth Switch Request")
+	}
+	seed := data[1+len(plugin)+1:]
+	var resp []byte
+	switch string(plugin) {
+	case "mysql_clear_password":
+		// 只向外部凭据发送明文密码，外部凭据为短期令牌
+		if mc.cfg.credential == "" {
+			return errors.New("mysql_clear_password is only allowed with credentialProvider")
+		}
+		resp = append([]byte(mc.cfg.passwd), 0)
+	case "mysql_native_password":
+		if len(seed) > 20 {
+			seed = seed[:20]
+		}
+		resp = scramblePassword(seed, []byte(mc.cfg.passwd))
+	default:
+		return fmt.Errorf("auth plugin %s is not supported", plugin)
+	}
+	packet := make([]byte, 0, len(resp)+4)
+	packet = append(packet, uint24ToBytes(uint32(len(resp)))...)
+	packet = append(packet, mc.sequence)
+	packet = append(packet, resp...)
+	if e = mc.writePacket(&packet); e != nil {
+		return
+	}
+	return mc.readResultOK()
+}
+
+func (mc *mysqlConn) handleAuthResult(data []byte) error {
+	switch data[0] {
+	case 0:
+		return mc.handleOkPacket(data)
+	case 255:
+		return mc.handleErrorPacket(data)
+	default:
+		return errors.New("Invalid Result Packet-Type")
+	}
+}
+
 /******************************************************************************
 *                             Command Packets                                 *
 ******************************************************************************/
@@ -300,6 +463,21 @@ func (mc *mysqlConn) writeCommandPacket(command commandType, args ...interface{}
 		arg = append(arg, uint32ToBytes(args[2].(uint32))...)
 		arg = append(arg, []byte(args[3].(string))...)
 
+	// flags, server_id, binlog-filename, binlog-pos, gtid set
+	case COM_BINLOG_DUMP_GTID:
+		if len(args) != 5 {
+			return fmt.Errorf("Invalid arguments count (Got: %d Has: 5)", len(args))
+		}
+		filename := args[2].(string)
+		gtidData := args[4].([]byte)
+		arg = uint16ToBytes(args[0].(uint16))
+		arg = append(arg, uint32ToBytes(args[1].(uint32))...)
+		arg = append(arg, uint32ToBytes(uint32(len(filename)))...)
+		arg = append(arg, []byte(filename)...)
+		arg = append(arg, uint64ToBytes(args[3].(uint64))...)
+		arg = append(arg, uint32ToBytes(uint32(len(gtidData)))...)
+		arg = append(arg, gtidData...)
+
 	default:
 		return fmt.Errorf("Unknown command: %d", command)
 	}
@@ -433,7 +611,7 @@ The order of packets for a result set is:
 func (mc *mysqlConn) readResultSetHeaderPacket() (fieldCount int, e error) {
 	data, e := mc.readPacket()
 	if e != nil {
-		errLog.Print(`packets:437 `, e)
+		errLog.WithError(e).Error("read packet")
 		e = driver.ErrBadConn
 		return
 	}
@@ -1,13 +1,9 @@
 package mysql
 
-import (
-	"bytes"
-)
-
 func init() {}
 
 type paket struct {
-	buf     *bytes.Buffer
+	buf     *eventReader
 	buydata []byte
 }
 
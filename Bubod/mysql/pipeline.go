@@ -0,0 +1,309 @@
+// 流水线同步
+// 串行模式下读取、解析、投递在同一个循环中依次执行；PipelineDepth > 0 时拆分为三个协程，由有界 channel 连接，
+// 网络读取、事件解析与回调投递可以同时进行:
+//
+//	读取(readPacket) --packets--> 解析(parseEvent、表结构缓存、过滤) --events--> 投递(回调、记录位点)
+//
+// 各阶段间最多缓冲 PipelineDepth 个事件，读取和解析领先投递的部分不计入位点，重连时从最后投递的位点重新读取。
+// GTID 集合的更新随事件一起传递，在投递阶段执行，保证已执行集合不超前于已投递的事件。
+package mysql
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bubod/Bubod/metrics"
+	"bubod/Bubod/trace"
+)
+
+// 读取阶段的输出
+type pipelinePacket struct {
+	buf  *[]byte // 来自 packetPool，解析后放回
+	pkt  []byte
+	span *trace.Span
+	err  error // 读取失败，之后不再有 packet
+}
+
+// 解析阶段的输出
+type pipelineEvent struct {
+	event     *EventReslut // 需要投递的事件，为 nil 时只更新位点和 GTID 集合
+	eventName string
+	span      *trace.Span
+	fileName  string // 跳过解析失败的事件后的位点，position 为 0 时不更新
+	position  uint32
+	gtidOps   []func() // 投递后执行的 GTID 集合更新
+	notice    error    // 输出到 result，不结束同步
+	err       error    // 输出到 result 并结束同步
+	stop      bool     // 结束同步
+	completed bool     // 到达结束条件，结束同步
+}
+
+// 丢弃未投递的事件
+func (item *pipelineEvent) drop() {
+	item.span.Drop()
+	item.event.release()
+}
+
+// 流水线模式下 GTID 集合的更新延迟到投递阶段执行，串行模式下直接执行
+func (parser *eventParser) updateGTID(op func()) {
+	if parser.pipelineDepth > 0 {
+		parser.gtidOps = append(parser.gtidOps, op)
+		return
+	}
+	op()
+}
+
+// 投递阶段，在 dump 协程中执行，返回时读取和解析协程均已退出
+func (mc *mysqlConn) dumpPipeline(filename string, position uint32, parser *eventParser, callbackFun callback, result chan error) error {
+	packets := make(chan *pipelinePacket, parser.pipelineDepth)
+	events := make(chan *pipelineEvent, parser.pipelineDepth)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		mc.readStage(packets, parser.faults, parser.binlog_checksum, done)
+	}()
+	go func() {
+		defer wg.Done()
+		parser.parseStage(packets, events, done)
+	}()
+
+	// 最后投递的位点
+	deliveredFile, deliveredPos := filename, position
+	defer func() {
+		metrics.QueueDepth.Set(0, parser.name, "packets")
+		metrics.QueueDepth.Set(0, parser.name, "events")
+		// 中断阻塞中的读取，dump 连接退出后不再使用
+		close(done)
+		mc.interrupt()
+		for item := range events {
+			item.drop()
+		}
+		wg.Wait()
+		// 解析阶段已退出，位点恢复为最后投递的位点，重连时从该位点开始
+		parser.binlogFileName = deliveredFile
+		parser.binlogPosition = deliveredPos
+	}()
+
+	for item := range events {
+		// 各阶段间缓冲的事件数，持续接近 PipelineDepth 的阶段之后为瓶颈
+		metrics.QueueDepth.Set(float64(len(packets)), parser.name, "packets")
+		metrics.QueueDepth.Set(float64(len(events)), parser.name, "events")
+		// BinlogDump.Close() 会将状态置为 STATE_CLOSING，此时会退出同步。
+		if state := parser.state.Load(); state == STATE_CLOSING || state == STATE_CLOSED {
+			item.drop()
+			result <- fmt.Errorf("close")
+			return nil
+		}
+		// BinlogDump.SeekTo() 需要重新建立 dump 连接
+		if parser.seekPending() {
+			item.drop()
+			return nil
+		}
+		if item.notice != nil {
+			result <- item.notice
+		}
+		if item.err != nil {
+			item.drop()
+			result <- item.err
+			return item.err
+		}
+		if item.completed {
+			item.drop()
+			parser.complete(result)
+			return nil
+		}
+
+		if item.event != nil {
+			if !parser.deliverEvent(item.event, item.eventName, item.span, callbackFun, result) {
+				item.drop()
+				return nil
+			}
+			if file, pos, ok := item.event.nextPosition(deliveredFile); ok {
+				deliveredFile, deliveredPos = file, pos
+			}
+			item.event.release()
+		} else if item.position > 0 {
+			deliveredFile, deliveredPos = item.fileName, item.position
+		}
+		for _, op := range item.gtidOps {
+			op()
+		}
+		if parser.reachedStopGTID() {
+			parser.complete(result)
+			return nil
+		}
+		if item.stop {
+			return nil
+		}
+	}
+	return nil
+}
+
+// 读取阶段，每个 packet 使用独立的缓冲区，由解析阶段放回
+func (mc *mysqlConn) readStage(packets chan<- *pipelinePacket, faults *faultInjector, checksum bool, done <-chan struct{}) {
+	defer close(packets)
+	for {
+		span := trace.StartTrace("binlog.event")
+		readSpan := span.StartChild("binlog.read")
+		buf := getPacketBuffer()
+		pkt, e := mc.readPacketTo(buf)
+		readSpan.Finish()
+		if e == nil {
+			e = faults.afterRead(pkt, checksum)
+		}
+		if e != nil {
+			e = mc.dumpReadError(e)
+		}
+		select {
+		case packets <- &pipelinePacket{buf: buf, pkt: pkt, span: span, err: e}:
+		case <-done:
+			span.Drop()
+			putPacketBuffer(buf)
+			return
+		}
+		if e != nil {
+			return
+		}
+	}
+}
+
+// 解析阶段，解析协程独占解析器的表结构缓存和位点，投递阶段结束后位点由投递阶段恢复
+func (parser *eventParser) parseStage(packets <-chan *pipelinePacket, events chan<- *pipelineEvent, done <-chan struct{}) {
+	defer close(events)
+	defer func() {
+		// 丢弃未解析的 packet，直到读取阶段退出
+		for p := range packets {
+			p.span.Drop()
+			putPacketBuffer(p.buf)
+		}
+	}()
+	for p := range packets {
+		item := parser.parsePacket(p)
+		putPacketBuffer(p.buf)
+		if item == nil {
+			continue
+		}
+		select {
+		case events <- item:
+		case <-done:
+			item.drop()
+			return
+		}
+		if item.err != nil || item.stop || item.completed {
+			return
+		}
+	}
+}
+
+// 解析一个 packet，返回 nil 时不需要传给投递阶段
+func (parser *eventParser) parsePacket(p *pipelinePacket) *pipelineEvent {
+	pkt, span := p.pkt, p.span
+	if p.err != nil {
+		span.Drop()
+		return &pipelineEvent{err: p.err}
+	}
+	if len(pkt) == 0 {
+		span.Drop()
+		return nil
+	}
+
+	// EOF packet
+	if pkt[0] == 254 {
+		span.Drop()
+		return &pipelineEvent{notice: fmt.Errorf("EOF packet"), stop: true}
+	}
+
+	metrics.BytesRead.Add(float64(len(pkt)), parser.name)
+
+	if pkt[0] != 0 {
+		span.Drop()
+		item := &pipelineEvent{notice: fmt.Errorf("Unknown packet:\n%s\n\n", hex.Dump(pkt))}
+		if strings.Contains(string(pkt), "Could not find first log file name in binary log index file") {
+			// 交由 BinlogDump 按 PurgedPolicy 处理
+			parser.binlogPurged = true
+			item.stop = true
+		}
+		return item
+	}
+
+	eventName := "UNKNOWN_EVENT"
+	if len(pkt) > 5 {
+		eventName = (&EventHeader{EventType: EventType(pkt[5])}).EventName()
+	}
+	metrics.EventsReceived.Inc(parser.name, eventName)
+	span.SetAttribute("bubod.source", parser.name)
+	span.SetAttribute("binlog.event_type", eventName)
+	span.SetAttribute("binlog.bytes", len(pkt))
+
+	parseSpan := span.StartChild("binlog.parse")
+	event, _, e := parser.safeParseEvent(pkt[1:])
+	parseSpan.Finish()
+	item := &pipelineEvent{gtidOps: parser.gtidOps}
+	parser.gtidOps = nil
+	if e != nil {
+		metrics.ParseErrors.Inc(parser.name, eventName)
+		span.SetAttribute("error", e)
+		span.Finish()
+		// 按 errorPolicy 处理，跳过时位点前移到下一个事件
+		errorEvent := parser.newErrorEvent(pkt[1:], e)
+		if !parser.handleErrorEvent(errorEvent) {
+			item.err = e
+			return item
+		}
+		if errorEvent.Header.LogPos > 0 {
+			parser.binlogPosition = errorEvent.Header.LogPos
+			item.fileName, item.position = parser.binlogFileName, parser.binlogPosition
+		}
+		return item
+	}
+	if event == nil {
+		span.Drop()
+		if len(item.gtidOps) == 0 {
+			return nil
+		}
+		return item
+	}
+	metrics.EventsParsed.Inc(parser.name, eventName)
+	event.Source, event.ParsedAt = parser.name, time.Now()
+
+	// 到达结束位点或时间，该事件及其 GTID 集合更新均不投递
+	if parser.reachedStopPosition(event) {
+		span.Drop()
+		event.release()
+		item.gtidOps = nil
+		item.completed = true
+		return item
+	}
+
+	filterSpan := span.StartChild("binlog.filter")
+	looped := parser.looped(event)
+	deliver, e := parser.checkTransaction(event)
+	if e != nil {
+		span.Drop()
+		event.release()
+		item.gtidOps = nil
+		item.err = e
+		return item
+	}
+	if !deliver || !parser.filterEvent(event) || looped {
+		span.Drop()
+		event.release()
+		if len(item.gtidOps) == 0 {
+			return nil
+		}
+		return item
+	}
+	filterSpan.Finish()
+
+	// 解析阶段的位点，后续事件的 BinlogPosition 与串行模式一致
+	if file, pos, ok := event.nextPosition(parser.binlogFileName); ok {
+		parser.binlogFileName, parser.binlogPosition = file, pos
+	}
+	item.event, item.eventName, item.span = event, eventName, span
+	return item
+}
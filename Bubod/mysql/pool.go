@@ -0,0 +1,74 @@
+// 对象池，减少 binlog 读取和解析时的内存分配
+//
+// packet 缓冲区: dump 连接读取事件时复用，解析结果中不能引用缓冲区(需要保留的字段已复制)。
+// 行数据: EventReslut.Rows 中的 map 在回调返回后回收(slice 格式的 Values 不回收)，回调之后仍需使用 Rows(如异步写入、批量聚合)时
+// 需要在回调中调用 Retain，此时由 GC 回收。
+package mysql
+
+import (
+	"database/sql/driver"
+	"sync"
+)
+
+// 超过该大小的 packet 缓冲区不放回池中，避免大事件长期占用内存
+const MAX_POOLED_PACKET_SIZE = 1 << 20
+
+// 超过该列数的行不放回池中
+const MAX_POOLED_ROW_COLUMNS = 256
+
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+func getPacketBuffer() *[]byte {
+	return packetPool.Get().(*[]byte)
+}
+
+func putPacketBuffer(b *[]byte) {
+	if b == nil || cap(*b) > MAX_POOLED_PACKET_SIZE {
+		return
+	}
+	*b = (*b)[:0]
+	packetPool.Put(b)
+}
+
+var rowPool = sync.Pool{
+	New: func() interface{} {
+		return make(map[string]driver.Value)
+	},
+}
+
+func getRow() map[string]driver.Value {
+	return rowPool.Get().(map[string]driver.Value)
+}
+
+func putRow(row map[string]driver.Value) {
+	if row == nil || len(row) > MAX_POOLED_ROW_COLUMNS {
+		return
+	}
+	for k := range row {
+		delete(row, k)
+	}
+	rowPool.Put(row)
+}
+
+// 回调之后继续使用 Rows，此时 Rows 不会被回收
+func (event *EventReslut) Retain() {
+	if event != nil {
+		event.retained = true
+	}
+}
+
+// 回调返回后回收 Rows，调用后不能再访问 Rows
+func (event *EventReslut) release() {
+	if event == nil || event.retained {
+		return
+	}
+	for _, row := range event.Rows {
+		putRow(row)
+	}
+	event.Rows = nil
+}
@@ -0,0 +1,99 @@
+// binlog 位点
+// binlog 文件名为 basename.序号，如 mysql-bin.000123，序号至少 6 位，超过 999999 后位数增加(mysql-bin.1000000)，
+// 按字符串比较时 mysql-bin.1000000 早于 mysql-bin.999999。位点先按 basename 比较，再按序号数值比较，最后比较文件内偏移。
+package mysql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// binlog 文件开头的 4 字节魔数之后为第一个事件
+const BINLOG_FIRST_POSITION = 4
+
+// 文件位点
+type BinlogPosition struct {
+	File string
+	Pos  uint32
+}
+
+// 解析 file:pos 格式的位点，如 mysql-bin.000123:4
+func ParseBinlogPosition(s string) (BinlogPosition, error) {
+	s = strings.TrimSpace(s)
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return BinlogPosition{}, fmt.Errorf("invalid binlog position %q, must be file:pos", s)
+	}
+	pos, err := strconv.ParseUint(s[i+1:], 10, 32)
+	if err != nil {
+		return BinlogPosition{}, fmt.Errorf("invalid binlog position %q, must be file:pos", s)
+	}
+	position := BinlogPosition{File: s[:i], Pos: uint32(pos)}
+	if err := position.Validate(); err != nil {
+		return BinlogPosition{}, err
+	}
+	return position, nil
+}
+
+// 拆分 binlog 文件名为 basename 和序号
+func ParseBinlogFileName(name string) (base string, seq uint64, err error) {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 || i == len(name)-1 {
+		return "", 0, fmt.Errorf("invalid binlog file name %q, must be basename.sequence", name)
+	}
+	seq, err = strconv.ParseUint(name[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid binlog file name %q, must be basename.sequence", name)
+	}
+	return name[:i], seq, nil
+}
+
+// 检查文件名和偏移，偏移不小于 4
+func (position BinlogPosition) Validate() error {
+	if _, _, err := ParseBinlogFileName(position.File); err != nil {
+		return err
+	}
+	if position.Pos < BINLOG_FIRST_POSITION {
+		return fmt.Errorf("invalid binlog position %s, pos must be at least %d", position, BINLOG_FIRST_POSITION)
+	}
+	return nil
+}
+
+// 比较位点，早于 other 时返回 -1，相同返回 0，晚于返回 1
+// 文件名不是 basename.序号 格式时按长度和字符串比较
+func (position BinlogPosition) Compare(other BinlogPosition) int {
+	if position.File != other.File {
+		baseA, seqA, errA := ParseBinlogFileName(position.File)
+		baseB, seqB, errB := ParseBinlogFileName(other.File)
+		switch {
+		case errA == nil && errB == nil && baseA == baseB:
+			if seqA != seqB {
+				return compareUint(seqA, seqB)
+			}
+		case len(position.File) != len(other.File):
+			return compareUint(uint64(len(position.File)), uint64(len(other.File)))
+		default:
+			return strings.Compare(position.File, other.File)
+		}
+	}
+	return compareUint(uint64(position.Pos), uint64(other.Pos))
+}
+
+func (position BinlogPosition) IsZero() bool {
+	return position.File == ""
+}
+
+func (position BinlogPosition) String() string {
+	return fmt.Sprintf("%s:%d", position.File, position.Pos)
+}
+
+func compareUint(a uint64, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,136 @@
+// 起始位点检查
+// 从保存或修改的位点开始同步前，使用独立连接试读该位点处的第一个事件，事件的起始位置应等于该位点。
+// 位点超过文件大小或不在事件边界上(如位点文件损坏、手工修改错误)时按 InvalidPositionPolicy 处理，
+// 避免从事件中间开始读取，将后续数据解析为错误的事件；文件已被清除时仍由 PurgedPolicy 处理。
+// 断线重连时的位点为已投递事件的结束位置，不再检查。
+package mysql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"bubod/Bubod/logger"
+)
+
+// 起始位点无效时的处理策略
+const (
+	POSITION_INVALID_FAIL    = "fail"    // 停止同步(默认)
+	POSITION_INVALID_REWIND  = "rewind"  // 从该位点之前最近的事务边界开始，可能重复投递
+	POSITION_INVALID_CURRENT = "current" // 从 master 当前位点开始，会丢失事件
+)
+
+// 起始位点无效
+type InvalidPositionError struct {
+	File     string
+	Position uint32
+	Reason   string
+}
+
+func (e *InvalidPositionError) Error() string {
+	return fmt.Sprintf("invalid binlog position %s:%d: %s", e.File, e.Position, e.Reason)
+}
+
+// 试读 filename:position 处的第一个事件，位点无效时返回 *InvalidPositionError
+// 文件不存在时返回 nil，由 dump 按 PurgedPolicy 处理
+func (This *BinlogDump) checkPosition(filename string, position uint32) error {
+	if position <= 4 {
+		return nil
+	}
+	var invalid error
+	err := scanMasterBinlog(This.master, This.parser.ServerId, filename, position, func(header *EventHeader, data []byte) bool {
+		// 开头的 ROTATE_EVENT 和 FORMAT_DESCRIPTION_EVENT 由 master 生成，log_pos 为 0
+		if header.LogPos == 0 {
+			return true
+		}
+		// 位点为已切换文件的结尾，master 从下一个文件开头继续发送
+		if header.EventType == FORMAT_DESCRIPTION_EVENT {
+			return false
+		}
+		if header.EventSize < 19 || header.LogPos != position+header.EventSize {
+			invalid = &InvalidPositionError{File: filename, Position: position,
+				Reason: fmt.Sprintf("not an event boundary, read event type %d size %d next position %d", header.EventType, header.EventSize, header.LogPos)}
+		}
+		return false
+	})
+	if invalid != nil {
+		return invalid
+	}
+	if err != nil {
+		msg := err.Error()
+		if strings.Contains(msg, "Could not find first log file name") {
+			return nil
+		}
+		// 位点超过文件大小、master 读取到错误的事件
+		if strings.HasPrefix(msg, "Error 1236:") {
+			return &InvalidPositionError{File: filename, Position: position, Reason: msg}
+		}
+	}
+	return err
+}
+
+// filename 中 position 之前最近的事务边界
+func (This *BinlogDump) previousBoundary(filename string, position uint32) (uint32, error) {
+	tracker := &boundaryTracker{parser: This.parser, boundary: 4}
+	err := This.scanBinlog(filename, func(header *EventHeader, data []byte) bool {
+		if header.LogPos == 0 {
+			return true
+		}
+		if header.EventType == ROTATE_EVENT || header.LogPos > position {
+			return false
+		}
+		tracker.next(header, data)
+		return true
+	})
+	return tracker.boundary, err
+}
+
+// 检查起始位点，无效时按 InvalidPositionPolicy 重新定位，返回 false 时停止同步
+func (This *BinlogDump) recoverInvalidPosition(result chan error) bool {
+	fromFile, fromPos := This.parser.binlogFileName, This.parser.binlogPosition
+	err := This.checkPosition(fromFile, fromPos)
+	invalid, ok := err.(*InvalidPositionError)
+	if !ok {
+		// master 暂时无法读取时不检查，由 dump 重连
+		if err != nil {
+			This.logEntry().WithError(err).Warn("check start position")
+		}
+		return true
+	}
+
+	var toFile string
+	var toPos uint32
+	switch This.InvalidPositionPolicy {
+	case POSITION_INVALID_REWIND:
+		pos, err := This.previousBoundary(fromFile, fromPos)
+		if err != nil {
+			This.logEntry().WithError(err).Error("find previous transaction boundary")
+		} else {
+			toFile, toPos = fromFile, pos
+		}
+	case POSITION_INVALID_CURRENT:
+		filepos := This.getMasterFilePosition()
+		if len(filepos) >= 2 {
+			pos, err := strconv.ParseUint(filepos[1], 10, 64)
+			if err == nil {
+				toFile = filepos[0]
+				toPos = uint32(pos)
+			}
+		}
+	}
+
+	if toFile == "" {
+		err := fmt.Errorf("%s, policy: %s", invalid, This.InvalidPositionPolicy)
+		This.logEntry().Error(err.Error())
+		result <- err
+		This.state.Transition(STATE_CLOSING)
+		return false
+	}
+
+	err = fmt.Errorf("%s, restart from %s:%d, policy: %s", invalid, toFile, toPos, This.InvalidPositionPolicy)
+	This.logEntry().With(logger.Fields{"binlog_file": toFile, "binlog_pos": toPos}).Warn(err.Error())
+	result <- err
+	This.parser.binlogFileName = toFile
+	This.parser.binlogPosition = toPos
+	return true
+}
@@ -0,0 +1,261 @@
+package mysql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 前置检查未通过，Problems 为各项失败原因及处理方法
+type PreflightError struct {
+	Problems []string
+}
+
+func (e *PreflightError) Error() string {
+	return "preflight check failed: " + strings.Join(e.Problems, "; ")
+}
+
+// 检查选项
+type PreflightOptions struct {
+	GTID    bool // 按 GTID 同步
+	Replica bool // 从从库 dump，需要 log_slave_updates=ON 和 gtid_mode=ON 才能切换到其他实例续传
+}
+
+// 服务端版本
+type ServerVersion struct {
+	Major   int
+	Minor   int
+	Patch   int
+	MariaDB bool
+	TiDB    bool // 5.7.25-TiDB-v7.1.0
+	Vitess  bool // vtgate，8.0.30-Vitess
+}
+
+// 解析 5.7.30-log、8.0.21、5.5.5-10.4.12-MariaDB 等版本号
+func ParseServerVersion(version string) (*ServerVersion, error) {
+	v := &ServerVersion{
+		MariaDB: strings.Contains(version, "MariaDB"),
+		TiDB:    strings.Contains(version, "TiDB"),
+		Vitess:  strings.Contains(strings.ToLower(version), "vitess"),
+	}
+	// MariaDB 10 以后握手包中的版本带 5.5.5- 前缀
+	if v.MariaDB {
+		version = strings.TrimPrefix(version, "5.5.5-")
+	}
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid server version %q", version)
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server version %q", version)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+// 版本是否不低于 major.minor.patch
+func (v *ServerVersion) AtLeast(major int, minor int, patch int) bool {
+	if v.Major != major {
+		return v.Major > major
+	}
+	if v.Minor != minor {
+		return v.Minor > minor
+	}
+	return v.Patch >= patch
+}
+
+func (v *ServerVersion) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	switch {
+	case v.MariaDB:
+		s += "-MariaDB"
+	case v.TiDB:
+		s += "-TiDB"
+	case v.Vitess:
+		s += "-Vitess"
+	}
+	return s
+}
+
+// 同步前检查 master 是否满足复制条件:
+//  1. 版本: MySQL 5.1 以上，GTID 需要 MySQL 5.6 以上且 gtid_mode=ON，不支持 MariaDB GTID
+//  2. log_bin=ON，binlog_format=ROW，binlog_row_image=FULL
+//  3. 账号有 REPLICATION SLAVE、REPLICATION CLIENT 权限
+//  4. 从库: log_slave_updates=ON，gtid_mode=ON
+//  5. RDS/Aurora: 设置了 binlog retention hours，见 rds.go
+//  6. 上游不是 TiDB、vtgate，Vitess 管理的 mysqld 需要按 GTID 同步，见 compat.go
+//
+// 检查项不满足时返回 *PreflightError，包含所有未通过的项；连接或查询失败时返回其他错误。
+func Preflight(dataSource string, opts *PreflightOptions) error {
+	dbopen := &mysqlDriver{}
+	conn, err := dbopen.Open(dataSource)
+	if err != nil {
+		return err
+	}
+	mc := conn.(*mysqlConn)
+	defer mc.Close()
+
+	problems := make([]string, 0)
+	gtid := opts.GTID || opts.Replica
+	rds := mc.cfg.rds
+
+	version, err := ParseServerVersion(mc.server.version)
+	if err != nil {
+		return err
+	}
+	// 其余检查项对这些上游没有意义
+	if problem := version.unsupportedProblem(); problem != "" {
+		return &PreflightError{Problems: []string{problem}}
+	}
+	if vitess, err := mc.managedByVitess(); err != nil {
+		return err
+	} else if vitess && !gtid {
+		problems = append(problems, "mysqld is managed by Vitess (_vt database exists) and the primary changes on reparent, configure gtid_set to resume on the new primary")
+	}
+	switch {
+	case !version.MariaDB && !version.AtLeast(5, 1, 0):
+		problems = append(problems, fmt.Sprintf("server version %s is not supported, MySQL 5.1 or later is required", version))
+	case gtid && version.MariaDB:
+		problems = append(problems, fmt.Sprintf("GTID of %s is not supported, use binlog file and position instead of gtid_set", version))
+	case gtid && !version.AtLeast(5, 6, 5):
+		problems = append(problems, fmt.Sprintf("server version %s does not support GTID, MySQL 5.6.5 or later is required", version))
+	case gtid:
+		mode, err := mc.getSystemVar("gtid_mode")
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(mode, "ON") {
+			where := "in my.cnf"
+			if rds {
+				where = "in the DB parameter group"
+			}
+			problems = append(problems, fmt.Sprintf("gtid_mode is %s, set gtid_mode=ON and enforce_gtid_consistency=ON %s, or use binlog file and position instead of gtid_set", mode, where))
+		}
+	}
+
+	if opts.Replica {
+		updates, err := mc.getSystemVar("log_slave_updates")
+		if err != nil {
+			return err
+		}
+		if updates != "1" && !strings.EqualFold(updates, "ON") {
+			if rds {
+				problems = append(problems, "log_slave_updates is disabled on the read replica, enable automated backups on the read replica")
+			} else {
+				problems = append(problems, "log_slave_updates is disabled on the replica, set log_slave_updates=ON in my.cnf and restart mysqld")
+			}
+		}
+	}
+
+	logBin, err := mc.getSystemVar("log_bin")
+	if err != nil {
+		return err
+	}
+	if logBin != "1" && !strings.EqualFold(logBin, "ON") {
+		if rds {
+			problems = append(problems, "binary log is disabled, enable automated backups (RDS) or set binlog_format=ROW in the DB cluster parameter group and reboot the writer (Aurora)")
+		} else {
+			problems = append(problems, "binary log is disabled, set log-bin and server-id in my.cnf and restart mysqld")
+		}
+	}
+
+	format, err := mc.getSystemVar("binlog_format")
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(format, "ROW") {
+		problems = append(problems, fmt.Sprintf("binlog_format is %s, ROW is required: %s", format, setVariableHint(rds, "binlog_format", "ROW")))
+	}
+
+	// 5.6.2 / MariaDB 10.1.6 之前只有完整行镜像
+	if (!version.MariaDB && version.AtLeast(5, 6, 2)) || (version.MariaDB && version.AtLeast(10, 1, 6)) {
+		image, err := mc.getSystemVar("binlog_row_image")
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(image, "FULL") {
+			problems = append(problems, fmt.Sprintf("binlog_row_image is %s, FULL is required: %s", image, setVariableHint(rds, "binlog_row_image", "FULL")))
+		}
+	}
+
+	grants, err := mc.queryFirstColumn("SHOW GRANTS FOR CURRENT_USER()")
+	if err != nil {
+		return err
+	}
+	for _, privilege := range missingReplicationPrivileges(grants) {
+		problems = append(problems, fmt.Sprintf("account lacks %s privilege: GRANT REPLICATION SLAVE, REPLICATION CLIENT ON *.* TO <user>", privilege))
+	}
+
+	if rds {
+		if _, set, err := mc.rdsRetentionHours(); err != nil {
+			return err
+		} else if !set {
+			problems = append(problems, "binlog retention hours is not set, binlogs are purged soon after they are written: CALL mysql.rds_set_configuration('binlog retention hours', 24)")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &PreflightError{Problems: problems}
+	}
+	return nil
+}
+
+// 复制需要的全局权限中缺少的项
+func missingReplicationPrivileges(grants []string) []string {
+	has := map[string]bool{}
+	for _, grant := range grants {
+		grant = strings.ToUpper(grant)
+		i := strings.Index(grant, " ON *.* TO ")
+		if !strings.HasPrefix(grant, "GRANT ") || i < 0 {
+			continue
+		}
+		for _, privilege := range strings.Split(grant[len("GRANT "):i], ",") {
+			has[strings.TrimSpace(privilege)] = true
+		}
+	}
+	if has["ALL"] || has["ALL PRIVILEGES"] {
+		return nil
+	}
+	missing := make([]string, 0)
+	for _, privilege := range []string{"REPLICATION SLAVE", "REPLICATION CLIENT"} {
+		// MariaDB 10.5 以后 REPLICATION CLIENT 更名为 BINLOG MONITOR
+		if privilege == "REPLICATION CLIENT" && has["BINLOG MONITOR"] {
+			continue
+		}
+		if !has[privilege] {
+			missing = append(missing, privilege)
+		}
+	}
+	return missing
+}
+
+// 执行查询，返回所有行的第一列
+func (mc *mysqlConn) queryFirstColumn(query string) (vals []string, e error) {
+	e = mc.writeCommandPacket(COM_QUERY, query)
+	if e != nil {
+		return
+	}
+	resLen, e := mc.readResultSetHeaderPacket()
+	if e != nil || resLen == 0 {
+		return
+	}
+	n, e := mc.readUntilEOF()
+	if e != nil {
+		return
+	}
+	rows, e := mc.readRows(int(n))
+	if e != nil {
+		return
+	}
+	for _, row := range rows {
+		vals = append(vals, string((*row)[0]))
+	}
+	return
+}
@@ -0,0 +1,82 @@
+// 代理兼容模式
+// 通过 ProxySQL(fast_forward 用户)、MySQL Router 等代理连接 master 时，DSN 配置 proxy=true:
+//
+//  1. 握手时只请求代理声明支持的能力标志，不强制请求 CLIENT_MULTI_STATEMENTS 等代理可能不支持的能力
+//  2. 代理支持 CLIENT_CONNECT_ATTRS 时发送连接属性(_client_name、program_name 等)，
+//     便于代理按属性路由，以及在 performance_schema.session_connect_attrs 中识别 bubod 的连接；
+//     connectionAttributes=k1:v1,k2:v2 可以追加自定义属性
+//  3. 不 kill master 上的 Binlog Dump 线程: 经过代理时 connection_id() 是后端连接的线程 id，
+//     KILL 可能被路由到其他后端或被代理拦截，只关闭客户端连接，由代理和 master 的会话超时清理
+//
+// bubod 不发送 COM_REGISTER_SLAVE，master 的 SHOW SLAVE HOSTS 中不会出现 bubod，代理模式下同样不需要。
+package mysql
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	bubodConfig "bubod/Bubod/config"
+)
+
+// 解析连接属性 k1:v1,k2:v2
+func ParseConnAttrs(val string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid connection attributes %q", val)
+		}
+		attrs[kv[0]] = kv[1]
+	}
+	return attrs, nil
+}
+
+// 连接属性，按名称排序
+func (cfg *config) connectAttrs() []byte {
+	attrs := map[string]string{
+		"_client_name":    "bubod",
+		"_client_version": bubodConfig.VERSION,
+		"_os":             runtime.GOOS,
+		"_platform":       runtime.GOARCH,
+		"_pid":            strconv.Itoa(os.Getpid()),
+		"program_name":    "bubod",
+	}
+	for k, v := range cfg.connAttrs {
+		attrs[k] = v
+	}
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var body []byte
+	for _, k := range keys {
+		body = append(body, lengthEncodedString(k)...)
+		body = append(body, lengthEncodedString(attrs[k])...)
+	}
+	return append(lengthEncodedInt(uint64(len(body))), body...)
+}
+
+func lengthEncodedInt(n uint64) []byte {
+	switch {
+	case n < 251:
+		return []byte{byte(n)}
+	case n < 1<<16:
+		return []byte{0xfc, byte(n), byte(n >> 8)}
+	case n < 1<<24:
+		return []byte{0xfd, byte(n), byte(n >> 8), byte(n >> 16)}
+	default:
+		return append([]byte{0xfe}, uint64ToBytes(n)...)
+	}
+}
+
+func lengthEncodedString(s string) []byte {
+	return append(lengthEncodedInt(uint64(len(s))), s...)
+}
@@ -0,0 +1,72 @@
+// AWS RDS / Aurora 兼容模式
+// 连接 RDS MySQL、Aurora MySQL 时 DSN 配置 rds=true:
+//
+//  1. 账号没有 SUPER 权限，不能 SET GLOBAL 也不能修改 my.cnf，前置检查的处理方法改为修改参数组、开启自动备份；
+//     binlog 保留时间由 mysql.rds_set_configuration 设置，未设置(NULL)时 binlog 会被尽快清除，前置检查不通过
+//  2. 保留时间从 CALL mysql.rds_show_configuration 的 binlog retention hours 读取，
+//     不使用 binlog_expire_logs_seconds/expire_logs_days，binlog_retention 配置仍然优先
+//  3. Aurora 在 binlog 空闲时不保证按 @master_heartbeat_period 发送心跳，dump 连接的读超时不再按心跳周期推算，
+//     失联由 TCP keepalive 和显式配置的 readTimeout 检测
+//  4. 没有 KILL 其他账号线程的权限时也能清理 dump 线程，使用 CALL mysql.rds_kill(id) 代替 KILL
+package mysql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// binlog retention hours 为 NULL 时按此估计保留时间
+const RDS_NULL_RETENTION = 5 * time.Minute
+
+// 查询 RDS 的 binlog 保留小时数，未设置时 set 为 false
+func (mc *mysqlConn) rdsRetentionHours() (hours int64, set bool, e error) {
+	rows, e := mc.callQuery("CALL mysql.rds_show_configuration")
+	if e != nil {
+		return
+	}
+	// name, value, description
+	for _, row := range rows {
+		if len(*row) < 2 || !strings.EqualFold(string((*row)[0]), "binlog retention hours") {
+			continue
+		}
+		if (*row)[1] == nil {
+			return 0, false, nil
+		}
+		hours, e = strconv.ParseInt(string((*row)[1]), 10, 64)
+		return hours, e == nil && hours > 0, e
+	}
+	return 0, false, fmt.Errorf("binlog retention hours not found in mysql.rds_show_configuration")
+}
+
+// 执行返回结果集的存储过程，返回第一个结果集的所有行
+// 需要 CLIENT_MULTI_RESULTS，结果集之后还有一个表示 CALL 执行结果的 OK 包
+func (mc *mysqlConn) callQuery(query string) (rows []*[][]byte, e error) {
+	e = mc.writeCommandPacket(COM_QUERY, query)
+	if e != nil {
+		return
+	}
+	resLen, e := mc.readResultSetHeaderPacket()
+	if e != nil || resLen == 0 {
+		return
+	}
+	n, e := mc.readUntilEOF()
+	if e != nil {
+		return
+	}
+	rows, e = mc.readRows(int(n))
+	if e != nil {
+		return
+	}
+	e = mc.readResultOK()
+	return
+}
+
+// 前置检查中修改系统变量的处理方法
+func setVariableHint(rds bool, name string, value string) string {
+	if rds {
+		return fmt.Sprintf("set %s=%s in the DB parameter group (DB cluster parameter group for Aurora)", name, value)
+	}
+	return fmt.Sprintf("SET GLOBAL %s=%s and set %s=%s in my.cnf", name, value, name, value)
+}
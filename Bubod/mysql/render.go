@@ -0,0 +1,277 @@
+// 字段值渲染方案
+// parseEventRow 按固定方式解码: 日期时间为 MySQL 格式字符串(2006-01-02 15:04:05)，DECIMAL 为字符串，tinyint(1) 为 bool。
+// 不同输出需要不同的表示，渲染方案在序列化时按字段类型转换，不影响回调中的 Rows:
+//
+//   - Time:    mysql(默认) 原样输出；rfc3339 将 DATETIME/TIMESTAMP 转为 2006-01-02T15:04:05+08:00
+//   - Decimal: string(默认) 原样输出；float 转为 float64，超出精度的部分丢失
+//   - Bool:    bool(默认) 原样输出；tinyint 将 tinyint(1) 的 true/false 输出为 1/0
+//   - UUID:    off(默认) 原样输出；standard 将 BINARY(16) 输出为 8-4-4-4-12 格式的 UUID；
+//     swapped 用于以 UUID_TO_BIN(uuid, 1) 保存的 UUIDv1(时间高位在前)，转换时还原字节顺序
+//
+// 字段类型取自 EventReslut.Columns，没有字段信息的事件不转换。
+//
+// Columns 按字段覆盖以上设置，不需要字段信息，见 ParseColumnRenders:
+//
+//   - string: 数字转为字符串，避免 JavaScript 等丢失 BIGINT 精度
+//   - number: 数字字符串(如 DECIMAL)转为 json 数字，不丢失精度
+//   - hex/base64: 二进制字符串转为十六进制/base64
+//   - uuid: 16 字节的 BINARY(16) 转为 8-4-4-4-12 格式，uuid_swapped 同 UUID swapped
+//   - raw: 原样输出
+package mysql
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RENDER_TIME_MYSQL     = "mysql"
+	RENDER_TIME_RFC3339   = "rfc3339"
+	RENDER_DECIMAL_STRING = "string"
+	RENDER_DECIMAL_FLOAT  = "float"
+	RENDER_BOOL_BOOL      = "bool"
+	RENDER_BOOL_TINYINT   = "tinyint"
+	RENDER_UUID_OFF       = "off"
+	RENDER_UUID_STANDARD  = "standard"
+	RENDER_UUID_SWAPPED   = "swapped"
+
+	RENDER_AS_STRING       = "string"
+	RENDER_AS_NUMBER       = "number"
+	RENDER_AS_HEX          = "hex"
+	RENDER_AS_BASE64       = "base64"
+	RENDER_AS_UUID         = "uuid"
+	RENDER_AS_UUID_SWAPPED = "uuid_swapped"
+	RENDER_AS_RAW          = "raw"
+)
+
+// 按字段覆盖渲染方式，库名、表名、字段名可以使用通配符，字段名不区分大小写
+type ColumnRender struct {
+	Schema string
+	Table  string
+	Column string
+	As     string // RENDER_AS_*
+}
+
+// 渲染方案，零值与 parseEventRow 的输出相同
+type RenderProfile struct {
+	Time     string          // RENDER_TIME_*
+	Decimal  string          // RENDER_DECIMAL_*
+	Bool     string          // RENDER_BOOL_*
+	UUID     string          // RENDER_UUID_*
+	Location *time.Location  // rfc3339 时 DATETIME/TIMESTAMP 所在时区，为 nil 时为本地时区
+	Columns  []*ColumnRender // 按字段覆盖，先配置的优先
+}
+
+var renderProfiles = struct {
+	sync.RWMutex
+	m map[string]*RenderProfile
+}{m: map[string]*RenderProfile{
+	"mysql":   {},
+	"iso":     {Time: RENDER_TIME_RFC3339},
+	"numeric": {Decimal: RENDER_DECIMAL_FLOAT, Bool: RENDER_BOOL_TINYINT},
+}}
+
+// 注册渲染方案，输出配置中以 render=name 引用，同名时覆盖
+// 内置 mysql(不转换)、iso(rfc3339 时间)、numeric(DECIMAL 为 float，bool 为 0/1)
+func RegisterRenderProfile(name string, profile *RenderProfile) {
+	renderProfiles.Lock()
+	defer renderProfiles.Unlock()
+	renderProfiles.m[name] = profile
+}
+
+// 获取已注册的渲染方案
+func GetRenderProfile(name string) (*RenderProfile, error) {
+	renderProfiles.RLock()
+	defer renderProfiles.RUnlock()
+	profile, ok := renderProfiles.m[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown render profile %q", name)
+	}
+	return profile, nil
+}
+
+func (profile *RenderProfile) Validate() error {
+	switch profile.Time {
+	case "", RENDER_TIME_MYSQL, RENDER_TIME_RFC3339:
+	default:
+		return fmt.Errorf("invalid render time %q, must be mysql or rfc3339", profile.Time)
+	}
+	switch profile.Decimal {
+	case "", RENDER_DECIMAL_STRING, RENDER_DECIMAL_FLOAT:
+	default:
+		return fmt.Errorf("invalid render decimal %q, must be string or float", profile.Decimal)
+	}
+	switch profile.Bool {
+	case "", RENDER_BOOL_BOOL, RENDER_BOOL_TINYINT:
+	default:
+		return fmt.Errorf("invalid render bool %q, must be bool or tinyint", profile.Bool)
+	}
+	switch profile.UUID {
+	case "", RENDER_UUID_OFF, RENDER_UUID_STANDARD, RENDER_UUID_SWAPPED:
+	default:
+		return fmt.Errorf("invalid render uuid %q, must be off, standard or swapped", profile.UUID)
+	}
+	for _, column := range profile.Columns {
+		switch column.As {
+		case RENDER_AS_STRING, RENDER_AS_NUMBER, RENDER_AS_HEX, RENDER_AS_BASE64, RENDER_AS_UUID, RENDER_AS_UUID_SWAPPED, RENDER_AS_RAW:
+		default:
+			return fmt.Errorf("invalid render %q for column %s.%s.%s, must be string, number, hex, base64, uuid, uuid_swapped or raw",
+				column.As, column.Schema, column.Table, column.Column)
+		}
+	}
+	return nil
+}
+
+// 解析按字段覆盖的渲染方式，逗号分隔的 db.table.column:as，如 shop.orders.id:string,*.*.uuid:uuid
+func ParseColumnRenders(s string) ([]*ColumnRender, error) {
+	columns := make([]*ColumnRender, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndexByte(item, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid column render %q, must be db.table.column:as", item)
+		}
+		names := strings.Split(item[:i], ".")
+		if len(names) != 3 {
+			return nil, fmt.Errorf("invalid column render %q, must be db.table.column:as", item)
+		}
+		for _, name := range names {
+			if name == "" {
+				return nil, fmt.Errorf("invalid column render %q, must be db.table.column:as", item)
+			}
+			if err := ValidateNamePattern(name); err != nil {
+				return nil, err
+			}
+		}
+		columns = append(columns, &ColumnRender{Schema: names[0], Table: names[1], Column: names[2], As: strings.TrimSpace(item[i+1:])})
+	}
+	return columns, nil
+}
+
+// 库名、表名匹配的按字段覆盖的渲染方式
+func (profile *RenderProfile) tableColumnRenders(schemaName string, tableName string) []*ColumnRender {
+	if profile == nil {
+		return nil
+	}
+	var columns []*ColumnRender
+	for _, column := range profile.Columns {
+		if MatchName(column.Schema, schemaName, false) && MatchName(column.Table, tableName, false) {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// 是否与 parseEventRow 的输出相同
+func (profile *RenderProfile) identity() bool {
+	return profile == nil ||
+		(profile.Time == "" || profile.Time == RENDER_TIME_MYSQL) &&
+			(profile.Decimal == "" || profile.Decimal == RENDER_DECIMAL_STRING) &&
+			(profile.Bool == "" || profile.Bool == RENDER_BOOL_BOOL) &&
+			(profile.UUID == "" || profile.UUID == RENDER_UUID_OFF) &&
+			len(profile.Columns) == 0
+}
+
+// 按渲染方案转换行，返回新的 map，columns 为字段名 => 字段信息，overrides 为表中按字段覆盖的渲染方式
+func (profile *RenderProfile) renderRow(row map[string]driver.Value, columns map[string]*ColumnInfo, overrides []*ColumnRender) map[string]driver.Value {
+	rendered := make(map[string]driver.Value, len(row))
+rowLoop:
+	for name, value := range row {
+		for _, override := range overrides {
+			if MatchName(override.Column, name, true) {
+				rendered[name] = renderAs(value, override.As)
+				continue rowLoop
+			}
+		}
+		rendered[name] = profile.Render(value, columns[name])
+	}
+	return rendered
+}
+
+// 按字段覆盖的渲染方式转换，无法转换时原样返回
+func renderAs(value driver.Value, as string) driver.Value {
+	switch v := value.(type) {
+	case string:
+		switch as {
+		case RENDER_AS_NUMBER:
+			if _, err := strconv.ParseFloat(v, 64); err == nil {
+				return json.Number(v)
+			}
+		case RENDER_AS_HEX:
+			return hex.EncodeToString([]byte(v))
+		case RENDER_AS_BASE64:
+			return base64.StdEncoding.EncodeToString([]byte(v))
+		case RENDER_AS_UUID:
+			if len(v) == 16 {
+				return FormatUUID([]byte(v), false)
+			}
+		case RENDER_AS_UUID_SWAPPED:
+			if len(v) == 16 {
+				return FormatUUID([]byte(v), true)
+			}
+		}
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64, int, uint, float32, float64:
+		if as == RENDER_AS_STRING {
+			return fmt.Sprint(v)
+		}
+	}
+	return value
+}
+
+// 16 字节转为 8-4-4-4-12 格式的 UUID
+// swapped 为 UUID_TO_BIN(uuid, 1) 的存储顺序: time_hi(2 字节) time_mid(2) time_low(4) 在前，转换时还原为 time_low time_mid time_hi
+func FormatUUID(b []byte, swapped bool) string {
+	if swapped {
+		b = append(append(append(append([]byte{}, b[4:8]...), b[2:4]...), b[0:2]...), b[8:16]...)
+	}
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+// 按渲染方案转换字段值，column 为 nil 或值无法转换时原样返回
+func (profile *RenderProfile) Render(value driver.Value, column *ColumnInfo) driver.Value {
+	if profile.identity() || column == nil || value == nil {
+		return value
+	}
+	columnType := strings.ToLower(column.Type)
+	switch v := value.(type) {
+	case string:
+		switch {
+		case profile.Time == RENDER_TIME_RFC3339 && (strings.HasPrefix(columnType, "datetime") || strings.HasPrefix(columnType, "timestamp")):
+			location := profile.Location
+			if location == nil {
+				location = time.Local
+			}
+			// 0000-00-00 00:00:00 等无法解析的值原样输出
+			if t, err := time.ParseInLocation("2006-01-02 15:04:05.999999999", v, location); err == nil {
+				return t.Format(time.RFC3339Nano)
+			}
+		case profile.Decimal == RENDER_DECIMAL_FLOAT && strings.HasPrefix(columnType, "decimal"):
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f
+			}
+		case profile.UUID == RENDER_UUID_STANDARD || profile.UUID == RENDER_UUID_SWAPPED:
+			if columnType == "binary(16)" && len(v) == 16 {
+				return FormatUUID([]byte(v), profile.UUID == RENDER_UUID_SWAPPED)
+			}
+		}
+	case bool:
+		if profile.Bool == RENDER_BOOL_TINYINT {
+			if v {
+				return int8(1)
+			}
+			return int8(0)
+		}
+	}
+	return value
+}
@@ -0,0 +1,69 @@
+// master 重启
+// MySQL 启动时创建新的 binlog 文件，其 FORMAT_DESCRIPTION_EVENT 的 create_timestamp 非 0(滚动生成的文件为 0)。
+// 正常关闭时在当前文件末尾写入 STOP_EVENT 并清除文件头 FDE 的 LOG_EVENT_BINLOG_IN_USE_F；
+// 异常退出时没有 STOP_EVENT，读取该文件时 FDE 仍带 LOG_EVENT_BINLOG_IN_USE_F。
+//
+// 同步过程中从上一个文件进入 create_timestamp 非 0 的文件即为 master 重启，此时:
+//
+//  1. tableId 在重启后重新分配，清空按 tableId 的缓存，之后的 TABLE_MAP_EVENT 重新获取表结构
+//  2. 异常退出时未提交的事务不会再有后续事件，丢弃当前事务的状态
+//  3. 投递 MasterRestartEvent，不受库、事件类型过滤
+//
+// 重连后再次读取同一文件的 FDE 不视为重启，启动后读到的第一个 FDE 无法判断，也不视为重启。
+package mysql
+
+import (
+	"bubod/Bubod/logger"
+)
+
+// master 重启事件
+type MasterRestartEvent struct {
+	ServerId   uint32 `json:"server_id"`
+	BinlogFile string `json:"binlog_file"` // 重启后的第一个 binlog 文件
+	StartTime  uint32 `json:"start_time"`  // 该文件的创建时间(秒)，即 master 启动时间
+	PrevFile   string `json:"prev_file"`   // 重启前的最后一个 binlog 文件
+	Clean      bool   `json:"clean"`       // 正常关闭: 上一个文件以 STOP_EVENT 结束，或其 FDE 不带 LOG_EVENT_BINLOG_IN_USE_F
+}
+
+// 当前 binlog 文件的关闭状态
+type restartTracker struct {
+	file    string // 最近一个 FDE 所在的文件，为空时尚未读到 FDE
+	inUse   bool   // 该 FDE 带 LOG_EVENT_BINLOG_IN_USE_F
+	stopped bool   // 该文件中读到了 STOP_EVENT
+}
+
+// 读到 FDE 时检查 master 是否重启，重启时清空 tableId 相关的状态并返回重启事件
+func (parser *eventParser) checkRestart(format *FormatDescriptionEvent) *MasterRestartEvent {
+	tracker := &parser.restart
+	prev := *tracker
+	if prev.file == parser.binlogFileName {
+		// 重连后重新读取同一文件
+		return nil
+	}
+	tracker.file = parser.binlogFileName
+	tracker.inUse = format.header.Flags&LOG_EVENT_BINLOG_IN_USE_F != 0
+	tracker.stopped = false
+	if prev.file == "" || format.createTimestamp == 0 {
+		return nil
+	}
+
+	restart := &MasterRestartEvent{
+		ServerId:   format.header.ServerId,
+		BinlogFile: parser.binlogFileName,
+		StartTime:  format.createTimestamp,
+		PrevFile:   prev.file,
+		Clean:      prev.stopped || !prev.inUse,
+	}
+	parser.logEntry().With(logger.Fields{
+		"server_id":  restart.ServerId,
+		"start_time": restart.StartTime,
+		"prev_file":  restart.PrevFile,
+		"clean":      restart.Clean,
+	}).Warn("master restarted, reset table map")
+
+	parser.tableMap = make(map[uint64]*TableMapEvent)
+	parser.schemas.invalidate()
+	parser.txn.reset()
+	parser.txnGTID = ""
+	return restart
+}
@@ -0,0 +1,81 @@
+// 行数据格式
+// map: 每行一个 map[字段名]值，即 EventReslut.Rows(默认)
+// slice: 每行一个按字段顺序的 []driver.Value，即 EventReslut.Values，字段信息在 EventReslut.Columns 中，
+// 同一张表的所有事件共享，避免每行分配 map 和计算字段名哈希。
+package mysql
+
+import (
+	"database/sql/driver"
+)
+
+const (
+	ROW_FORMAT_MAP   = "map"
+	ROW_FORMAT_SLICE = "slice"
+)
+
+// 字段信息，只读，表结构变化前所有事件共享
+type ColumnInfo struct {
+	Name              string  `json:"name"`
+	Type              string  `json:"type"` // 如 int(10) unsigned
+	Key               string  `json:"key"`  // PRI/UNI/MUL
+	Unsigned          bool    `json:"unsigned"`
+	IsPrimary         bool    `json:"is_primary"`
+	Nullable          bool    `json:"nullable"`
+	Default           *string `json:"default,omitempty"`            // 默认值，nil 为没有默认值或默认值为 NULL
+	DatetimePrecision int     `json:"datetime_precision,omitempty"` // datetime/timestamp/time 的小数秒位数
+}
+
+// 字段序号，不存在时返回 -1
+func (event *EventReslut) ColumnIndex(name string) int {
+	for i, column := range event.Columns {
+		if column.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// 按 map 格式返回所有行，map 格式时直接返回 Rows，slice 格式时由 Values 和 Columns 生成
+func (event *EventReslut) RowMaps() []map[string]driver.Value {
+	if len(event.Values) == 0 {
+		return event.Rows
+	}
+	rows := make([]map[string]driver.Value, 0, len(event.Values))
+	for _, values := range event.Values {
+		row := make(map[string]driver.Value, len(event.Columns))
+		for i, column := range event.Columns {
+			if i < len(values) {
+				row[column.Name] = values[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// 行数，两种格式通用
+func (event *EventReslut) RowCount() int {
+	if len(event.Values) > 0 {
+		return len(event.Values)
+	}
+	return len(event.Rows)
+}
+
+// map 格式解析时复用的行缓冲区，值复制到 map 后即可复用
+func (parser *eventParser) rowValues(n int) []driver.Value {
+	if cap(parser.rowBuffer) < n {
+		parser.rowBuffer = make([]driver.Value, n)
+	}
+	return parser.rowBuffer[:n]
+}
+
+// 按字段名生成 map 格式的行
+func newRowMap(schema []*column_schema_type, values []driver.Value) map[string]driver.Value {
+	row := getRow()
+	for i, column := range schema {
+		if i < len(values) {
+			row[column.COLUMN_NAME] = values[i]
+		}
+	}
+	return row
+}
@@ -0,0 +1,101 @@
+// 行的主键
+// 按 EventReslut.PrimaryKeys 从行数据中取主键值，联合主键按字段顺序，map、slice 两种行格式通用。
+// 规范字符串为主键值的 json 数组，如 [1]、[1,"a"]，同一行的各次变更得到相同的字符串，
+// 输出按其分区可以保证同一行的变更有序，下游按其去重可以做到幂等写入。
+// update 修改了主键时 OldKey 返回变更前的主键，下游(如 Elasticsearch)需要先删除旧主键的文档再写入新主键的文档。
+package mysql
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+)
+
+// 一个行变更的主键
+type RowKey struct {
+	Columns []string       `json:"columns"`
+	Values  []driver.Value `json:"values"`
+}
+
+// 规范字符串，主键值的 json 数组，[]byte 按字符串处理
+func (key *RowKey) String() string {
+	values := make([]interface{}, len(key.Values))
+	for i, value := range key.Values {
+		if b, ok := value.([]byte); ok {
+			values[i] = string(b)
+		} else {
+			values[i] = value
+		}
+	}
+	b, _ := json.Marshal(values)
+	return string(b)
+}
+
+// 行变更数，update 的变更前、变更后两行为一个变更
+func (event *EventReslut) ChangeCount() int {
+	switch event.Header.EventType {
+	case UPDATE_ROWS_EVENTv0, UPDATE_ROWS_EVENTv1, UPDATE_ROWS_EVENTv2:
+		return event.RowCount() / 2
+	}
+	return event.RowCount()
+}
+
+// 第 i 个行变更的主键，没有主键或 i 越界时返回 nil
+// insert 取插入的行，delete 取删除前的行，update 取变更后的行，
+// 变更后的行中没有主键字段或为 NULL 时(binlog_row_image=MINIMAL)取变更前的值
+func (event *EventReslut) Key(i int) *RowKey {
+	if len(event.PrimaryKeys) == 0 || i < 0 || i >= event.ChangeCount() {
+		return nil
+	}
+	row, before := i, -1
+	if event.ChangeCount() != event.RowCount() {
+		row, before = i*2+1, i*2
+	}
+	key := &RowKey{Columns: event.PrimaryKeys, Values: make([]driver.Value, len(event.PrimaryKeys))}
+	for k, column := range event.PrimaryKeys {
+		value, ok := event.rowValue(row, column)
+		if (!ok || value == nil) && before >= 0 {
+			value, ok = event.rowValue(before, column)
+		}
+		if !ok {
+			return nil
+		}
+		key.Values[k] = value
+	}
+	return key
+}
+
+// 第 i 个行变更修改了主键时返回变更前的主键，非 update、未修改主键或没有主键时返回 nil
+func (event *EventReslut) OldKey(i int) *RowKey {
+	if event.ChangeCount() == event.RowCount() {
+		return nil
+	}
+	key := event.Key(i)
+	if key == nil {
+		return nil
+	}
+	old := &RowKey{Columns: key.Columns, Values: make([]driver.Value, len(key.Columns))}
+	for k, column := range key.Columns {
+		value, ok := event.rowValue(i*2, column)
+		if !ok {
+			return nil
+		}
+		old.Values[k] = value
+	}
+	if old.String() == key.String() {
+		return nil
+	}
+	return old
+}
+
+// 第 row 行的字段值，行中没有该字段时返回 false
+func (event *EventReslut) rowValue(row int, column string) (driver.Value, bool) {
+	if len(event.Values) > 0 {
+		i := event.ColumnIndex(column)
+		if i < 0 || i >= len(event.Values[row]) {
+			return nil, false
+		}
+		return event.Values[row][i], true
+	}
+	value, ok := event.Rows[row][column]
+	return value, ok
+}
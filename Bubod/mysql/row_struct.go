@@ -0,0 +1,420 @@
+// 行数据映射到结构体
+// 按字段标签 `db:"column"` 将一行 map[字段名]值 映射到调用方的结构体，标签为空时按字段名不区分大小写匹配，
+// `db:"-"` 忽略该字段，匿名嵌入的结构体按其字段展开。
+// 解码器将 DECIMAL、日期时间等输出为字符串，映射时按目标字段类型转换:
+//
+//   - 整数、浮点数: 由整数、浮点数、数字字符串(DECIMAL)转换，溢出时返回错误
+//   - bool: 整数非 0、字符串 1/true 为 true
+//   - string: 整数、浮点数格式化，SET 以逗号连接
+//   - time.Time: 由 2006-01-02 15:04:05[.000000]、2006-01-02 格式的字符串按本地时区解析(与 TIMESTAMP 解码一致)
+//   - []byte、[]string: 由字符串、SET 转换
+//   - 结构体、map、切片: 由 JSON 字符串反序列化
+//   - sql.Scanner: 调用 Scan，可以使用 sql.NullString 或第三方 decimal 类型
+//   - 指针: 值为 NULL 时为 nil，否则分配后按指向的类型转换；非指针字段的 NULL 为零值
+//
+// 行中不存在的字段保持原值，行中多出的字段忽略。
+package mysql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 结构体字段与列名的对应关系，按类型缓存
+var structFieldsCache sync.Map // reflect.Type => map[string][]int
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+)
+
+// 将一行映射到 dest，dest 为结构体指针
+func ScanRow(row map[string]driver.Value, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("scan row: dest must be a non-nil pointer to struct, got %T", dest)
+	}
+	return scanStruct(row, v.Elem())
+}
+
+// 将事件的所有行映射到 dest，dest 为 *[]T 或 *[]*T，T 为结构体
+// update 事件的行依次为变更前、变更后，与 Rows 相同
+func (event *EventReslut) ScanRows(dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("scan rows: dest must be a pointer to slice, got %T", dest)
+	}
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return fmt.Errorf("scan rows: slice element must be struct or pointer to struct, got %s", slice.Type().Elem())
+	}
+	rows := event.RowMaps()
+	result := reflect.MakeSlice(slice.Type(), 0, len(rows))
+	for i, row := range rows {
+		elem := reflect.New(elemType)
+		if err := scanStruct(row, elem.Elem()); err != nil {
+			return fmt.Errorf("scan rows: row %d: %s", i, err)
+		}
+		if isPtr {
+			result = reflect.Append(result, elem)
+		} else {
+			result = reflect.Append(result, elem.Elem())
+		}
+	}
+	slice.Set(result)
+	return nil
+}
+
+func scanStruct(row map[string]driver.Value, v reflect.Value) error {
+	fields := structFields(v.Type())
+	for column, value := range row {
+		index, ok := fields[strings.ToLower(column)]
+		if !ok {
+			continue
+		}
+		if err := setField(fieldByIndex(v, index), value); err != nil {
+			return fmt.Errorf("column %s: %s", column, err)
+		}
+	}
+	return nil
+}
+
+// 按序号取字段，经过 nil 的匿名结构体指针时分配
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// 列名(小写) => 字段序号
+func structFields(t reflect.Type) map[string][]int {
+	if fields, ok := structFieldsCache.Load(t); ok {
+		return fields.(map[string][]int)
+	}
+	fields := make(map[string][]int)
+	collectFields(t, nil, fields)
+	structFieldsCache.Store(t, fields)
+	return fields
+}
+
+func collectFields(t reflect.Type, parent []int, fields map[string][]int) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("db")
+		if tag == "-" {
+			continue
+		}
+		index := append(append([]int{}, parent...), i)
+		embedded := field.Type
+		if embedded.Kind() == reflect.Ptr {
+			embedded = embedded.Elem()
+		}
+		if field.Anonymous && tag == "" && embedded.Kind() == reflect.Struct && embedded != timeType {
+			collectFields(embedded, index, fields)
+			continue
+		}
+		// 未导出字段
+		if field.PkgPath != "" {
+			continue
+		}
+		name := tag
+		if name == "" {
+			name = field.Name
+		}
+		name = strings.ToLower(name)
+		// 外层字段优先于嵌入结构体中的同名字段
+		if existing, ok := fields[name]; ok && len(existing) <= len(index) {
+			continue
+		}
+		fields[name] = index
+	}
+}
+
+// 按字段类型转换并赋值
+func setField(field reflect.Value, value driver.Value) error {
+	if field.CanAddr() && field.Addr().Type().Implements(scannerType) {
+		return field.Addr().Interface().(sql.Scanner).Scan(value)
+	}
+	if field.Kind() == reflect.Ptr {
+		if value == nil {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		elem := reflect.New(field.Type().Elem())
+		if err := setField(elem.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	}
+	if value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	if field.Type() == timeType {
+		t, err := toTime(value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(toString(value))
+		return nil
+	case reflect.Bool:
+		b, err := toBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := toInt64(value)
+		if err != nil {
+			return err
+		}
+		if field.OverflowInt(n) {
+			return fmt.Errorf("value %d overflows %s", n, field.Type())
+		}
+		field.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := toUint64(value)
+		if err != nil {
+			return err
+		}
+		if field.OverflowUint(n) {
+			return fmt.Errorf("value %d overflows %s", n, field.Type())
+		}
+		field.SetUint(n)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := toFloat64(value)
+		if err != nil {
+			return err
+		}
+		if field.OverflowFloat(f) {
+			return fmt.Errorf("value %v overflows %s", f, field.Type())
+		}
+		field.SetFloat(f)
+		return nil
+	case reflect.Slice:
+		switch field.Type().Elem().Kind() {
+		case reflect.Uint8:
+			switch val := value.(type) {
+			case []byte:
+				field.SetBytes(append([]byte{}, val...))
+				return nil
+			case string:
+				field.SetBytes([]byte(val))
+				return nil
+			}
+		case reflect.String:
+			switch val := value.(type) {
+			case []string:
+				field.Set(reflect.ValueOf(append([]string{}, val...)))
+				return nil
+			case string:
+				if val == "" {
+					field.Set(reflect.ValueOf([]string{}))
+				} else {
+					field.Set(reflect.ValueOf(strings.Split(val, ",")))
+				}
+				return nil
+			}
+		}
+	}
+
+	// JSON 字段
+	if s, ok := value.(string); ok {
+		switch field.Kind() {
+		case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array, reflect.Interface:
+			return json.Unmarshal([]byte(s), field.Addr().Interface())
+		}
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Type().AssignableTo(field.Type()) {
+		field.Set(rv)
+		return nil
+	}
+	return fmt.Errorf("cannot convert %T to %s", value, field.Type())
+}
+
+func toString(value driver.Value) string {
+	switch val := value.(type) {
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	case []string:
+		return strings.Join(val, ",")
+	case float32:
+		return strconv.FormatFloat(float64(val), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case time.Time:
+		return val.Format(TIME_FORMAT)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func toInt64(value driver.Value) (int64, error) {
+	switch val := value.(type) {
+	case int:
+		return int64(val), nil
+	case int8:
+		return int64(val), nil
+	case int16:
+		return int64(val), nil
+	case int32:
+		return int64(val), nil
+	case int64:
+		return val, nil
+	case uint8:
+		return int64(val), nil
+	case uint16:
+		return int64(val), nil
+	case uint32:
+		return int64(val), nil
+	case uint64:
+		if val > math.MaxInt64 {
+			return 0, fmt.Errorf("value %d overflows int64", val)
+		}
+		return int64(val), nil
+	case float32, float64:
+		f, _ := toFloat64(val)
+		if f != math.Trunc(f) || f < math.MinInt64 || f > math.MaxInt64 {
+			return 0, fmt.Errorf("cannot convert %v to integer", f)
+		}
+		return int64(f), nil
+	case bool:
+		if val {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return parseIntString(val)
+	case []byte:
+		return parseIntString(string(val))
+	}
+	return 0, fmt.Errorf("cannot convert %T to integer", value)
+}
+
+// DECIMAL 的小数部分为 0 时同样可以转换为整数
+func parseIntString(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if i := strings.IndexByte(s, '.'); i >= 0 && strings.Trim(s[i+1:], "0") == "" {
+		return strconv.ParseInt(s[:i], 10, 64)
+	}
+	return 0, fmt.Errorf("cannot convert %q to integer", s)
+}
+
+func toUint64(value driver.Value) (uint64, error) {
+	switch val := value.(type) {
+	case uint8:
+		return uint64(val), nil
+	case uint16:
+		return uint64(val), nil
+	case uint32:
+		return uint64(val), nil
+	case uint64:
+		return val, nil
+	case string:
+		if n, err := strconv.ParseUint(val, 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	n, err := toInt64(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("value %d overflows unsigned integer", n)
+	}
+	return uint64(n), nil
+}
+
+func toFloat64(value driver.Value) (float64, error) {
+	switch val := value.(type) {
+	case float32:
+		return float64(val), nil
+	case float64:
+		return val, nil
+	case string:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot convert %q to float", val)
+		}
+		return f, nil
+	case []byte:
+		return toFloat64(string(val))
+	case uint64:
+		return float64(val), nil
+	}
+	n, err := toInt64(value)
+	if err != nil {
+		return 0, err
+	}
+	return float64(n), nil
+}
+
+func toBool(value driver.Value) (bool, error) {
+	switch val := value.(type) {
+	case bool:
+		return val, nil
+	case string:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return false, fmt.Errorf("cannot convert %q to bool", val)
+		}
+		return b, nil
+	}
+	n, err := toInt64(value)
+	if err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
+
+// 日期时间字符串，按本地时区解析
+func toTime(value driver.Value) (time.Time, error) {
+	switch val := value.(type) {
+	case time.Time:
+		return val, nil
+	case string:
+		for _, layout := range []string{"2006-01-02 15:04:05.999999", "2006-01-02"} {
+			if t, err := time.ParseInLocation(layout, val, time.Local); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("cannot convert %q to time.Time", val)
+	}
+	return time.Time{}, fmt.Errorf("cannot convert %T to time.Time", value)
+}
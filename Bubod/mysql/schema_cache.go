@@ -0,0 +1,158 @@
+// 表结构缓存
+// 按 tableId 缓存表结构，每次更新生成新版本的不可变条目，读写由读写锁保护，
+// HTTP 查询、预加载与 dump 协程同时访问时不会出现 map 并发读写。
+// rows 事件解析开始时取得当前条目，整个事件按同一版本解码，期间 DDL 更新缓存不影响正在解码的事件。
+package mysql
+
+import (
+	"sync"
+)
+
+// 某一版本的表结构，创建后只读
+type tableSchema struct {
+	tableId uint64
+	name    string // database.table
+	version uint64 // 缓存内单调递增，每次更新表结构时分配
+	columns []*column_schema_type
+	infos   []*ColumnInfo // slice 格式的字段信息，同一版本的所有事件共享
+	primary string        // 主键字段
+	keys    []string      // 主键字段，联合主键时按字段顺序
+}
+
+func newTableSchema(tableId uint64, name string, version uint64, columns []*column_schema_type) *tableSchema {
+	schema := &tableSchema{
+		tableId: tableId,
+		name:    name,
+		version: version,
+		columns: columns,
+		infos:   make([]*ColumnInfo, 0, len(columns)),
+	}
+	for _, column := range columns {
+		schema.infos = append(schema.infos, &ColumnInfo{
+			Name:              column.COLUMN_NAME,
+			Type:              column.COLUMN_TYPE,
+			Key:               column.COLUMN_KEY,
+			Unsigned:          column.unsigned,
+			IsPrimary:         column.is_primary,
+			Nullable:          column.nullable,
+			Default:           column.defaultValue(),
+			DatetimePrecision: column.datetimePrecision(),
+		})
+		// 判断设置的 COLUMN_KEY 约束类型，来获取主键字段
+		if column.is_primary && column.COLUMN_KEY == "PRI" {
+			schema.primary = column.COLUMN_NAME
+			schema.keys = append(schema.keys, column.COLUMN_NAME)
+		}
+	}
+	return schema
+}
+
+type schemaCache struct {
+	sync.RWMutex
+	version   uint64
+	tables    map[uint64]*tableSchema          // tableId => *tableSchema
+	names     map[string]uint64                // database.table => tableId
+	preloaded map[string][]*column_schema_type // database.table => []*column_schema_type，预加载的表结构，未开启时为 nil
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{
+		tables: make(map[uint64]*tableSchema),
+		names:  make(map[string]uint64),
+	}
+}
+
+// tableId 当前版本的表结构，不存在时返回 nil
+func (cache *schemaCache) get(tableId uint64) *tableSchema {
+	cache.RLock()
+	defer cache.RUnlock()
+	return cache.tables[tableId]
+}
+
+// database.table 对应的 tableId，不存在时返回 0
+func (cache *schemaCache) tableId(name string) uint64 {
+	cache.RLock()
+	defer cache.RUnlock()
+	return cache.names[name]
+}
+
+// 预加载的表结构
+func (cache *schemaCache) preloadedColumns(name string) ([]*column_schema_type, bool) {
+	cache.RLock()
+	defer cache.RUnlock()
+	columns, ok := cache.preloaded[name]
+	return columns, ok
+}
+
+// 更新表结构，生成新版本，开启预加载时同时更新按库表名的缓存
+func (cache *schemaCache) set(tableId uint64, name string, columns []*column_schema_type) *tableSchema {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.version++
+	schema := newTableSchema(tableId, name, cache.version, columns)
+	// tableId 分配给了其他表
+	if old, ok := cache.tables[tableId]; ok && old.name != name && cache.names[old.name] == tableId {
+		delete(cache.names, old.name)
+	}
+	cache.names[name] = tableId
+	cache.tables[tableId] = schema
+	if cache.preloaded != nil {
+		cache.preloaded[name] = columns
+	}
+	return schema
+}
+
+// 删除 database.table 的表结构，返回其原 tableId
+func (cache *schemaCache) remove(name string) uint64 {
+	cache.Lock()
+	defer cache.Unlock()
+	tableId, ok := cache.names[name]
+	if !ok {
+		return 0
+	}
+	delete(cache.names, name)
+	delete(cache.tables, tableId)
+	delete(cache.preloaded, name)
+	return tableId
+}
+
+// 清空按 tableId 的缓存，切换 binlog 文件时调用（不同binlog文件可能 Tableid 对应关系不同）
+func (cache *schemaCache) reset() {
+	cache.Lock()
+	cache.tables = make(map[uint64]*tableSchema)
+	cache.Unlock()
+}
+
+// 清空按 tableId 和库表名的缓存，master 重启后 tableId 重新分配时调用，预加载的表结构保留
+func (cache *schemaCache) invalidate() {
+	cache.Lock()
+	cache.tables = make(map[uint64]*tableSchema)
+	cache.names = make(map[string]uint64)
+	cache.Unlock()
+}
+
+// 替换预加载的表结构，已缓存的 tableId 同时刷新为新版本
+func (cache *schemaCache) preload(schemas map[string][]*column_schema_type) {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.preloaded = schemas
+	for tableId, schema := range cache.tables {
+		if columns, ok := schemas[schema.name]; ok {
+			cache.version++
+			cache.tables[tableId] = newTableSchema(tableId, schema.name, cache.version, columns)
+		}
+	}
+}
+
+// 当前缓存的所有表结构
+func (cache *schemaCache) all() []*tableSchema {
+	cache.RLock()
+	defer cache.RUnlock()
+	tables := make([]*tableSchema, 0, len(cache.names))
+	for name, tableId := range cache.names {
+		if schema, ok := cache.tables[tableId]; ok && schema.name == name {
+			tables = append(tables, schema)
+		}
+	}
+	return tables
+}
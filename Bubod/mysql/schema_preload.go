@@ -0,0 +1,109 @@
+// 表结构预加载
+// 默认在每张表的第一个 TABLE_MAP_EVENT 时查询 information_schema，表多时会逐表阻塞同步；
+// 开启 PreloadSchema 后在建立 dump 连接时一次查询所有表的结构，按库表名缓存，
+// TABLE_MAP_EVENT 直接使用缓存，缓存中没有的表(如之后新建的表)仍按表查询。
+package mysql
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"bubod/Bubod/logger"
+)
+
+// 不预加载的系统库
+var systemSchemas = []string{"mysql", "information_schema", "performance_schema", "sys"}
+
+// 加载 ReplicateDoDb 中所有表的结构，ReplicateDoDb 为空时加载除系统库外的所有库
+// 已缓存的 tableId 同时刷新，避免重连后沿用重连前查询的旧结构
+func (parser *eventParser) preloadSchemas() (errs error) {
+	parser.connLock.Lock()
+	defer parser.connLock.Unlock()
+	defer func() {
+		if err := recover(); err != nil {
+			if atomic.CompareAndSwapInt32(&parser.connStatus, 1, 0) {
+				parser.conn.Close()
+			}
+			errs = fmt.Errorf("%v", err)
+		}
+	}()
+
+	if atomic.LoadInt32(&parser.connStatus) == 0 {
+		parser.initConn()
+	}
+
+	sql := "SELECT TABLE_SCHEMA,TABLE_NAME," + parser.columnSchemaFields() + " FROM information_schema.columns"
+	args := make([]driver.Value, 0)
+	if parser.exactDoDb() {
+		for db := range parser.replicateDoDb {
+			args = append(args, db)
+		}
+		sql += " WHERE table_schema IN (?" + strings.Repeat(",?", len(args)-1) + ")"
+	} else {
+		for _, db := range systemSchemas {
+			args = append(args, db)
+		}
+		sql += " WHERE table_schema NOT IN (?" + strings.Repeat(",?", len(args)-1) + ")"
+	}
+	sql += " ORDER BY TABLE_SCHEMA,TABLE_NAME,ORDINAL_POSITION"
+
+	stmt, err := parser.conn.Prepare(sql)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	schemas := make(map[string][]*column_schema_type)
+	for {
+		dest := make([]driver.Value, 12)
+		if err := rows.Next(dest); err != nil {
+			break
+		}
+		// 库名含通配符或不区分大小写时查询所有库后过滤
+		if !parser.isSyncDb(string(dest[0].([]byte))) {
+			continue
+		}
+		name := string(dest[0].([]byte)) + "." + string(dest[1].([]byte))
+		schemas[name] = append(schemas[name], newColumnSchema(dest[2:]))
+	}
+
+	parser.schemas.preload(schemas)
+	parser.logEntry().With(logger.Fields{"tables": len(schemas)}).Info("preload table schema")
+	return nil
+}
+
+// ReplicateDoDb 不为空、不含通配符且区分大小写时，可以直接按库名查询
+func (parser *eventParser) exactDoDb() bool {
+	if len(parser.replicateDoDb) == 0 || parser.ignoreCase {
+		return false
+	}
+	for db := range parser.replicateDoDb {
+		if IsNamePattern(db) {
+			return false
+		}
+	}
+	return true
+}
+
+// 使用预加载的表结构，没有时返回 false
+func (parser *eventParser) usePreloadedSchema(tableId uint64, database string, tablename string) bool {
+	name := database + "." + tablename
+	columns, ok := parser.schemas.preloadedColumns(name)
+	if !ok {
+		return false
+	}
+	parser.setTableSchema(tableId, name, columns)
+	return true
+}
+
+// 更新表结构缓存，生成新版本的表结构
+func (parser *eventParser) setTableSchema(tableId uint64, name string, columns []*column_schema_type) {
+	parser.schemas.set(tableId, name, columns)
+}
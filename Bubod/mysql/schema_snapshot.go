@@ -0,0 +1,225 @@
+// 表结构快照
+// 将表结构导出为 json 文件，启动时或离线解析时导入，作为预加载的表结构使用(见 schema_preload.go)，
+// TABLE_MAP_EVENT 直接使用快照中的表结构，不查询 information_schema，
+// 用于离线解析没有 master 的 binlog，以及没有 information_schema 查询权限的部署。
+//
+// 快照中没有的表、快照之后执行了 DDL 的表仍按表查询；字段数与 TABLE_MAP_EVENT 不一致时重新查询(见 compat.go)。
+// 开启 PreloadSchema 时连接后查询到的表结构覆盖快照。
+package mysql
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 表结构快照文件
+type SchemaSnapshot struct {
+	Time   string         `json:"time"` // 导出时间
+	Tables []*TableSchema `json:"tables"`
+}
+
+// 字段描述转为缓存中的字段，类型相关的属性按 COLUMN_TYPE 解析，同 information_schema 查询
+func (column *ColumnSchema) schemaType() *column_schema_type {
+	extra, nullable, precision := "", "NO", ""
+	if column.AutoIncrement {
+		extra = "auto_increment"
+	}
+	if column.Nullable {
+		nullable = "YES"
+	}
+	if column.DatetimePrecision > 0 {
+		precision = strconv.Itoa(column.DatetimePrecision)
+	}
+	var value []byte // NULL
+	if column.Default != nil {
+		value = []byte(*column.Default)
+	}
+	return newColumnSchema([]driver.Value{
+		[]byte(column.Name),
+		[]byte(column.Key),
+		[]byte(column.Type),
+		[]byte(column.CharacterSet),
+		[]byte(column.Collation),
+		[]byte(column.NumericScale),
+		[]byte(extra),
+		[]byte(nullable),
+		value,
+		[]byte(precision),
+	})
+}
+
+func newSchemaSnapshot(schemas map[string][]*column_schema_type) *SchemaSnapshot {
+	snapshot := &SchemaSnapshot{Time: time.Now().Format("2006-01-02 15:04:05"), Tables: make([]*TableSchema, 0, len(schemas))}
+	for name, columns := range schemas {
+		table := &TableSchema{Columns: make([]*ColumnSchema, 0, len(columns))}
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			table.SchemaName, table.TableName = name[0:i], name[i+1:]
+		}
+		for _, column := range columns {
+			table.Columns = append(table.Columns, newColumnInfoSchema(column))
+		}
+		snapshot.Tables = append(snapshot.Tables, table)
+	}
+	sort.Slice(snapshot.Tables, func(i, j int) bool {
+		if snapshot.Tables[i].SchemaName != snapshot.Tables[j].SchemaName {
+			return snapshot.Tables[i].SchemaName < snapshot.Tables[j].SchemaName
+		}
+		return snapshot.Tables[i].TableName < snapshot.Tables[j].TableName
+	})
+	return snapshot
+}
+
+// 按库表名的表结构
+func (snapshot *SchemaSnapshot) columns() map[string][]*column_schema_type {
+	schemas := make(map[string][]*column_schema_type, len(snapshot.Tables))
+	for _, table := range snapshot.Tables {
+		columns := make([]*column_schema_type, 0, len(table.Columns))
+		for _, column := range table.Columns {
+			columns = append(columns, column.schemaType())
+		}
+		schemas[table.SchemaName+"."+table.TableName] = columns
+	}
+	return schemas
+}
+
+// 读取表结构快照文件
+func ReadSchemaSnapshot(path string) (*SchemaSnapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &SchemaSnapshot{}
+	if err := json.Unmarshal(b, snapshot); err != nil {
+		return nil, fmt.Errorf("parse schema snapshot %s: %s", path, err)
+	}
+	for _, table := range snapshot.Tables {
+		if table.SchemaName == "" || table.TableName == "" || len(table.Columns) == 0 {
+			return nil, fmt.Errorf("parse schema snapshot %s: invalid table %s.%s", path, table.SchemaName, table.TableName)
+		}
+		for _, column := range table.Columns {
+			if column.Name == "" || column.Type == "" {
+				return nil, fmt.Errorf("parse schema snapshot %s: invalid column in %s.%s", path, table.SchemaName, table.TableName)
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// 写入表结构快照文件，先写临时文件再重命名
+func (snapshot *SchemaSnapshot) WriteFile(path string) error {
+	b, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 导入表结构快照，作为预加载的表结构
+func (parser *eventParser) importSchemaSnapshot(snapshot *SchemaSnapshot) {
+	if snapshot == nil {
+		return
+	}
+	parser.schemas.preload(snapshot.columns())
+}
+
+// 当前缓存和预加载的所有表结构，同一张表以缓存中的版本为准
+func (parser *eventParser) cachedSchemas() map[string][]*column_schema_type {
+	schemas := make(map[string][]*column_schema_type)
+	parser.schemas.RLock()
+	for name, columns := range parser.schemas.preloaded {
+		schemas[name] = columns
+	}
+	parser.schemas.RUnlock()
+	for _, schema := range parser.schemas.all() {
+		schemas[schema.name] = schema.columns
+	}
+	return schemas
+}
+
+// 一次查询所有同步的表的结构，经 replicateDoDb 和 tableFilter 过滤
+func (parser *eventParser) querySchemas() (map[string][]*column_schema_type, error) {
+	defer func() {
+		if atomic.CompareAndSwapInt32(&parser.connStatus, 1, 0) {
+			parser.conn.Close()
+		}
+	}()
+	if err := parser.preloadSchemas(); err != nil {
+		return nil, err
+	}
+	schemas := make(map[string][]*column_schema_type)
+	for name, columns := range parser.cachedSchemas() {
+		i := strings.IndexByte(name, '.')
+		if i > 0 && parser.isSyncTable(name[0:i], name[i+1:]) {
+			schemas[name] = columns
+		}
+	}
+	return schemas, nil
+}
+
+// 当前缓存和预加载的所有表结构，未开始同步时为导入的快照
+func (This *BinlogDump) SchemaSnapshot() *SchemaSnapshot {
+	parser := This.currentParser()
+	if parser == nil {
+		if This.ImportSchema != nil {
+			return This.ImportSchema
+		}
+		return newSchemaSnapshot(nil)
+	}
+	return newSchemaSnapshot(parser.cachedSchemas())
+}
+
+// 查询 master 上所有同步的表的结构，与当前缓存合并，同一张表以缓存中的版本为准:
+// 缓存中的表结构与已同步的位点一致，可能旧于 master 上的表结构
+func (This *BinlogDump) QuerySchemaSnapshot() (*SchemaSnapshot, error) {
+	current := This.currentParser()
+	if current == nil {
+		return nil, fmt.Errorf("binlog dump not started")
+	}
+	parser := newEventParser()
+	parser.name = This.Name
+	parser.dataSource = &This.master
+	parser.replicateDoDb = This.ReplicateDoDb
+	parser.ignoreCase = This.IgnoreCase
+	parser.tableFilter = This.TableFilter
+	schemas, err := parser.querySchemas()
+	if err != nil {
+		return nil, err
+	}
+	for name, columns := range current.cachedSchemas() {
+		schemas[name] = columns
+	}
+	return newSchemaSnapshot(schemas), nil
+}
+
+// 查询 master 上 databases 中所有表的结构，databases 为空时为除系统库外的所有库，库名可以使用通配符
+func QuerySchemaSnapshot(dataSource string, databases []string) (*SchemaSnapshot, error) {
+	parser := newEventParser()
+	parser.dataSource = &dataSource
+	parser.replicateDoDb = make(map[string]uint8, len(databases))
+	for _, db := range databases {
+		parser.replicateDoDb[db] = 1
+	}
+	schemas, err := parser.querySchemas()
+	if err != nil {
+		return nil, err
+	}
+	return newSchemaSnapshot(schemas), nil
+}
@@ -0,0 +1,193 @@
+// 按时间定位起始位点
+// 设置 BinlogDump.StartTime 且没有起始位点和 GTID 集合时，首次连接前在 master 上查找时间对应的位点:
+//
+//  1. SHOW BINARY LOGS 获取所有 binlog 文件
+//  2. 按文件开头 FORMAT_DESCRIPTION_EVENT 的时间(文件创建时间)二分查找最后一个不晚于该时间的文件
+//  3. 扫描该文件，返回第一个不早于该时间的事务的起始位点
+//
+// 扫描使用独立连接和非阻塞 dump(读完已有事件后 master 返回 EOF packet)，只读取事件头和 QUERY_EVENT 的语句。
+// 返回的位点总是事务边界，事件时间为事务第一个事件的时间，定位是近似的。
+package mysql
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"bubod/Bubod/logger"
+)
+
+// COM_BINLOG_DUMP flags，没有更多事件时返回 EOF packet 而不是等待
+const BINLOG_DUMP_NON_BLOCK = 0x01
+
+// 查找 t 之后第一个事务的位点，t 早于最早的 binlog 时返回最早的 binlog 开头，晚于所有事件时返回 master 当前位点
+func (This *BinlogDump) locateTime(t time.Time) (filename string, position uint32, err error) {
+	logs, err := This.parser.showBinaryLogs()
+	if err != nil {
+		return "", 0, err
+	}
+	if len(logs) == 0 {
+		return "", 0, fmt.Errorf("no binary log on master")
+	}
+	timestamp := uint32(t.Unix())
+
+	// 最后一个创建时间不晚于 t 的文件
+	index := -1
+	low, high := 0, len(logs)-1
+	for low <= high {
+		mid := (low + high) / 2
+		created, err := This.binlogCreateTime(logs[mid].Name)
+		if err != nil {
+			return "", 0, err
+		}
+		if created <= timestamp {
+			index = mid
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+	if index < 0 {
+		This.logEntry().With(logger.Fields{"binlog_file": logs[0].Name}).Warn("start time is earlier than the first binary log")
+		return logs[0].Name, 4, nil
+	}
+
+	position, end, err := This.findTimePosition(logs[index].Name, timestamp)
+	if err != nil {
+		return "", 0, err
+	}
+	if position > 0 {
+		return logs[index].Name, position, nil
+	}
+	// 文件中没有更晚的事务，从下一个文件开头开始
+	if index+1 < len(logs) {
+		return logs[index+1].Name, 4, nil
+	}
+	return logs[index].Name, end, nil
+}
+
+// binlog 文件的创建时间，即文件开头 FORMAT_DESCRIPTION_EVENT 的时间
+func (This *BinlogDump) binlogCreateTime(filename string) (uint32, error) {
+	var created uint32
+	found := false
+	err := This.scanBinlog(filename, func(header *EventHeader, data []byte) bool {
+		if header.EventType != FORMAT_DESCRIPTION_EVENT {
+			return true
+		}
+		created, found = header.Timestamp, true
+		return false
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("binlog %s has no format description event", filename)
+	}
+	return created, err
+}
+
+// 扫描 filename，返回第一个事件时间不早于 timestamp 的事务的起始位点，没有时 position 为 0，end 为文件中最后一个事件的结束位点
+func (This *BinlogDump) findTimePosition(filename string, timestamp uint32) (position uint32, end uint32, err error) {
+	tracker := &boundaryTracker{parser: This.parser, boundary: 4}
+	end = 4
+	err = This.scanBinlog(filename, func(header *EventHeader, data []byte) bool {
+		// master 生成的 ROTATE_EVENT 等没有位点
+		if header.LogPos == 0 {
+			return true
+		}
+		// 文件结束
+		if header.EventType == ROTATE_EVENT {
+			return false
+		}
+		end = header.LogPos
+		if !tracker.inTransaction && header.LogPos-header.EventSize == tracker.boundary && header.Timestamp >= timestamp {
+			position = tracker.boundary
+			return false
+		}
+		tracker.next(header, data)
+		return true
+	})
+	return
+}
+
+// 事务边界，按顺序传入文件中的事件，boundary 为最近的事务边界
+type boundaryTracker struct {
+	parser        *eventParser
+	boundary      uint32
+	inTransaction bool
+}
+
+func (tracker *boundaryTracker) next(header *EventHeader, data []byte) {
+	switch header.EventType {
+	case FORMAT_DESCRIPTION_EVENT, PREVIOUS_GTIDS_EVENT:
+		if !tracker.inTransaction {
+			tracker.boundary = header.LogPos
+		}
+	case XID_EVENT:
+		tracker.inTransaction = false
+		tracker.boundary = header.LogPos
+	case QUERY_EVENT:
+		query := ""
+		if event, err := tracker.parser.parseQueryEvent(newEventReader(data)); err == nil {
+			query = strings.ToUpper(strings.TrimSpace(event.query))
+		}
+		switch {
+		case query == "BEGIN":
+			tracker.inTransaction = true
+		case query == "COMMIT" || !tracker.inTransaction:
+			// 非事务表的提交，或事务外的 DDL
+			tracker.inTransaction = false
+			tracker.boundary = header.LogPos
+		}
+	}
+}
+
+// 从 filename 开头非阻塞地读取已有的事件，fn 返回 false 时停止，data 为不含校验和的事件
+func (This *BinlogDump) scanBinlog(filename string, fn func(header *EventHeader, data []byte) bool) error {
+	return scanMasterBinlog(This.master, This.parser.ServerId, filename, 4, fn)
+}
+
+// 使用独立连接从 filename 的 position 处非阻塞地读取 master 上已有的事件
+func scanMasterBinlog(dataSource string, serverId uint32, filename string, position uint32, fn func(header *EventHeader, data []byte) bool) error {
+	conn, err := (&mysqlDriver{}).Open(dataSource)
+	if err != nil {
+		return err
+	}
+	mc := conn.(*mysqlConn)
+	defer mc.Close()
+
+	checksum := false
+	if val, err := mc.getSystemVar("binlog_checksum"); err == nil && val != "" && !strings.EqualFold(val, "NONE") {
+		if _, err := mc.Exec("SET @master_binlog_checksum=@@global.binlog_checksum", make([]driver.Value, 0)); err != nil {
+			return err
+		}
+		checksum = true
+	}
+	if err := mc.writeCommandPacket(COM_BINLOG_DUMP, position, uint16(BINLOG_DUMP_NON_BLOCK), serverId, filename); err != nil {
+		return err
+	}
+	for {
+		pkt, err := mc.readPacket()
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(pkt) == 0:
+			continue
+		// 已读完
+		case pkt[0] == 254:
+			return nil
+		case pkt[0] == 255:
+			return mc.handleErrorPacket(pkt)
+		}
+		data := pkt[1:]
+		if checksum && len(data) >= 23 {
+			data = data[:len(data)-4]
+		}
+		header := new(EventHeader)
+		if err := header.Read(data); err != nil {
+			return err
+		}
+		if !fn(header, data) {
+			return nil
+		}
+	}
+}
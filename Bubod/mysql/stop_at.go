@@ -0,0 +1,103 @@
+// 有界回放
+// 设置 BinlogDump.StopAt 后同步到结束条件为止，之后状态变为 STATE_COMPLETED 并不再重连，用于按时间点补数据、排查问题等。
+// 结束条件可以组合，任一满足即结束:
+//
+//	位点: 同 mysqlbinlog --stop-position，从该位点(或之后的文件)开始的事件不再投递
+//	时间: 同 mysqlbinlog --stop-datetime，事件时间晚于该时间时结束，该事件不投递
+//	GTID 集合: 已执行的 GTID 集合包含该集合时结束，集合中的事务全部投递
+package mysql
+
+import (
+	"fmt"
+	"time"
+)
+
+// 结束条件，零值字段不生效
+type StopCondition struct {
+	BinlogFileName string
+	BinlogPosition uint32
+	GTIDSet        string
+	Time           time.Time
+}
+
+// 检查 GTID 集合格式
+func (stop *StopCondition) Validate() error {
+	_, err := newStopCondition(stop)
+	return err
+}
+
+// 结束条件对应的状态消息
+var errCompleted = fmt.Errorf("completed")
+
+// 解析后的结束条件
+type stopCondition struct {
+	binlogFileName string
+	binlogPosition uint32
+	gtid           []*gtidSid
+	timestamp      uint32
+}
+
+func newStopCondition(stop *StopCondition) (*stopCondition, error) {
+	if stop == nil {
+		return nil, nil
+	}
+	cond := &stopCondition{binlogFileName: stop.BinlogFileName, binlogPosition: stop.BinlogPosition}
+	if stop.GTIDSet != "" {
+		sids, err := parseGTIDSet(stop.GTIDSet)
+		if err != nil {
+			return nil, err
+		}
+		cond.gtid = sids
+	}
+	if !stop.Time.IsZero() {
+		cond.timestamp = uint32(stop.Time.Unix())
+	}
+	if cond.binlogFileName == "" && len(cond.gtid) == 0 && cond.timestamp == 0 {
+		return nil, nil
+	}
+	return cond, nil
+}
+
+// 比较两个位点，见 BinlogPosition.Compare
+func compareBinlogPosition(fileA string, posA uint32, fileB string, posB uint32) int {
+	return BinlogPosition{File: fileA, Pos: posA}.Compare(BinlogPosition{File: fileB, Pos: posB})
+}
+
+// 投递前检查位点和时间条件，event 为解析成功的事件(含过滤掉的事件)
+func (parser *eventParser) reachedStopPosition(event *EventReslut) bool {
+	cond := parser.stopAt
+	if cond == nil {
+		return false
+	}
+	if cond.timestamp > 0 && event.Header.Timestamp > cond.timestamp {
+		return true
+	}
+	// ROTATE_EVENT 的位点属于上一个文件，由新文件的第一个事件判断
+	if cond.binlogFileName == "" || event.Header.EventType == ROTATE_EVENT || event.Header.LogPos == 0 {
+		return false
+	}
+	start := event.Header.LogPos - event.Header.EventSize
+	if event.Header.EventSize > event.Header.LogPos {
+		start = event.Header.LogPos
+	}
+	return compareBinlogPosition(parser.binlogFileName, start, cond.binlogFileName, cond.binlogPosition) >= 0
+}
+
+// 已执行的 GTID 集合是否包含结束集合，需要在 GTID 集合更新后检查
+func (parser *eventParser) reachedStopGTID() bool {
+	cond := parser.stopAt
+	return cond != nil && len(cond.gtid) > 0 && parser.gtid.contains(cond.gtid)
+}
+
+// 到达结束条件，结束同步
+func (parser *eventParser) complete(result chan error) {
+	parser.completed = true
+	parser.state.Transition(STATE_CLOSING)
+	parser.logEntry().Info("stop condition reached")
+	result <- errCompleted
+}
+
+// 是否已到达结束条件
+func (This *BinlogDump) Completed() bool {
+	return This.State() == STATE_COMPLETED
+}
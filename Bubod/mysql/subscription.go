@@ -0,0 +1,183 @@
+// 事件订阅
+// 以链式调用描述同步的库、表、事件和回调，代替直接设置 ReplicateDoDb、TableFilter、OnlyEvent、CallbackFun:
+//
+//	err := dump.Subscription().
+//		Database("shop").
+//		Tables("orders", "order_items").
+//		Events(mysql.Insert, mysql.Update).
+//		Handler(h)
+//
+// 库名、表名可以使用通配符(见 name_filter.go)，表名可以写成 db.table 只匹配该库中的表。
+// Handler 之前的调用只记录订阅条件，Handler 检查条件并写入 BinlogDump，需要在 StartDumpBinlog 之前调用。
+// BinlogDump.Subscribe 为同步状态订阅，事件订阅使用 Subscription。
+package mysql
+
+import (
+	"fmt"
+)
+
+// 订阅的事件类别
+type EventKind int
+
+const (
+	Insert EventKind = iota // WRITE_ROWS_EVENT v0/v1/v2
+	Update                  // UPDATE_ROWS_EVENT v0/v1/v2
+	Delete                  // DELETE_ROWS_EVENT v0/v1/v2
+	DDL                     // QUERY_EVENT，DDL 以外的语句不会投递
+)
+
+func (kind EventKind) String() string {
+	switch kind {
+	case Insert:
+		return "insert"
+	case Update:
+		return "update"
+	case Delete:
+		return "delete"
+	case DDL:
+		return "ddl"
+	}
+	return fmt.Sprintf("%d", int(kind))
+}
+
+// 类别对应的 binlog 事件类型
+func (kind EventKind) eventTypes() []EventType {
+	switch kind {
+	case Insert:
+		return InsertEvents()
+	case Update:
+		return UpdateEvents()
+	case Delete:
+		return DeleteEvents()
+	case DDL:
+		return DDLEvents()
+	}
+	return nil
+}
+
+// 事件订阅条件
+type Subscription struct {
+	dump      *BinlogDump
+	databases []string
+	tables    []string
+	events    []EventType
+	err       error // 第一个无效的条件，Handler 时返回
+}
+
+// 创建事件订阅，见 subscription.go
+func (This *BinlogDump) Subscription() *Subscription {
+	return &Subscription{dump: This}
+}
+
+// 同步的库，可以多次调用，未调用时同步所有库
+func (sub *Subscription) Database(names ...string) *Subscription {
+	for _, name := range names {
+		sub.checkName(name)
+		sub.databases = append(sub.databases, name)
+	}
+	return sub
+}
+
+// 同步的表，table 匹配所有同步库中的同名表，db.table 只匹配该库；未调用时同步所有表
+func (sub *Subscription) Tables(names ...string) *Subscription {
+	for _, name := range names {
+		db, table := splitTableName(name)
+		if db != "" {
+			sub.checkName(db)
+		}
+		sub.checkName(table)
+		sub.tables = append(sub.tables, name)
+	}
+	return sub
+}
+
+// 订阅的事件类别，未调用时订阅 Insert、Update、Delete、DDL
+func (sub *Subscription) Events(kinds ...EventKind) *Subscription {
+	for _, kind := range kinds {
+		types := kind.eventTypes()
+		if types == nil && sub.err == nil {
+			sub.err = fmt.Errorf("unknown event kind %s", kind)
+		}
+		sub.events = append(sub.events, types...)
+	}
+	return sub
+}
+
+// 按 binlog 事件类型订阅，与 Events 合并
+func (sub *Subscription) EventTypes(types ...EventType) *Subscription {
+	sub.events = append(sub.events, types...)
+	return sub
+}
+
+// 设置回调并将订阅条件写入 BinlogDump
+// ReplicateDoDb、OnlyEvent 被订阅条件替换；已设置的 TableFilter 保留，两者都通过的表才同步
+func (sub *Subscription) Handler(fn func(data *EventReslut)) error {
+	if sub.err != nil {
+		return sub.err
+	}
+	if fn == nil {
+		return fmt.Errorf("subscription handler is nil")
+	}
+	dump := sub.dump
+
+	doDb := make(map[string]uint8, 0)
+	if len(sub.databases) > 0 {
+		for _, db := range sub.databases {
+			doDb[db] = 1
+		}
+		// db.table 的库同样需要同步
+		for _, name := range sub.tables {
+			if db, _ := splitTableName(name); db != "" {
+				doDb[db] = 1
+			}
+		}
+	}
+	dump.ReplicateDoDb = doDb
+
+	if len(sub.tables) > 0 {
+		tables := sub.tables
+		previous := dump.TableFilter
+		ignoreCase := dump.IgnoreCase
+		dump.TableFilter = func(schemaName string, tableName string) bool {
+			if previous != nil && !previous(schemaName, tableName) {
+				return false
+			}
+			return matchTables(tables, schemaName, tableName, ignoreCase)
+		}
+	}
+
+	events := sub.events
+	if len(events) == 0 {
+		for _, kind := range []EventKind{Insert, Update, Delete, DDL} {
+			events = append(events, kind.eventTypes()...)
+		}
+	}
+	dump.OnlyEvent = events
+	dump.CallbackFun = fn
+	return nil
+}
+
+func (sub *Subscription) checkName(name string) {
+	if sub.err != nil {
+		return
+	}
+	if name == "" {
+		sub.err = fmt.Errorf("empty name in subscription")
+		return
+	}
+	sub.err = ValidateNamePattern(name)
+}
+
+// 表是否与 tables 中的任一名称匹配
+func matchTables(tables []string, schemaName string, tableName string, ignoreCase bool) bool {
+	for _, name := range tables {
+		db, table := splitTableName(name)
+		if db != "" && !MatchName(db, schemaName, ignoreCase) {
+			continue
+		}
+		if MatchName(table, tableName, ignoreCase) {
+			return true
+		}
+	}
+	return false
+}
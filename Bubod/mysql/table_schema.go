@@ -0,0 +1,94 @@
+// 表结构缓存查询
+package mysql
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 字段描述
+type ColumnSchema struct {
+	Name              string  `json:"name"`
+	Type              string  `json:"type"` // 如 int(10) unsigned
+	Key               string  `json:"key"`  // PRI/UNI/MUL
+	CharacterSet      string  `json:"character_set"`
+	Collation         string  `json:"collation"`
+	NumericScale      string  `json:"numeric_scale,omitempty"` // 小数位数，如 decimal(10,2) 为 2
+	Unsigned          bool    `json:"unsigned"`
+	AutoIncrement     bool    `json:"auto_increment"`
+	Nullable          bool    `json:"nullable"`
+	Default           *string `json:"default,omitempty"`            // 默认值，nil 为没有默认值或默认值为 NULL，如 CURRENT_TIMESTAMP
+	DatetimePrecision int     `json:"datetime_precision,omitempty"` // datetime/timestamp/time 的小数秒位数
+}
+
+// 表结构
+type TableSchema struct {
+	TableId    uint64          `json:"table_id"`
+	SchemaName string          `json:"db"`
+	TableName  string          `json:"table"`
+	Version    uint64          `json:"version"` // 表结构版本，表结构更新后递增
+	Columns    []*ColumnSchema `json:"columns"`
+}
+
+func newColumnInfoSchema(column *column_schema_type) *ColumnSchema {
+	return &ColumnSchema{
+		Name:              column.COLUMN_NAME,
+		Type:              column.COLUMN_TYPE,
+		Key:               column.COLUMN_KEY,
+		CharacterSet:      column.CHARACTER_SET_NAME,
+		Collation:         column.COLLATION_NAME,
+		NumericScale:      column.NUMERIC_SCALE,
+		Unsigned:          column.unsigned,
+		AutoIncrement:     column.auto_increment,
+		Nullable:          column.nullable,
+		Default:           column.defaultValue(),
+		DatetimePrecision: column.datetimePrecision(),
+	}
+}
+
+// 默认值，没有默认值或默认值为 NULL 时返回 nil
+func (column *column_schema_type) defaultValue() *string {
+	if !column.has_default {
+		return nil
+	}
+	value := column.COLUMN_DEFAULT
+	return &value
+}
+
+func (column *column_schema_type) datetimePrecision() int {
+	precision, _ := strconv.Atoi(column.DATETIME_PRECISION)
+	return precision
+}
+
+// 当前缓存的所有表结构，按库表名排序
+func (parser *eventParser) TableSchemas() []*TableSchema {
+	schemas := parser.schemas.all()
+	tables := make([]*TableSchema, 0, len(schemas))
+	for _, schema := range schemas {
+		table := &TableSchema{TableId: schema.tableId, Version: schema.version, Columns: make([]*ColumnSchema, 0, len(schema.columns))}
+		if i := strings.IndexByte(schema.name, '.'); i >= 0 {
+			table.SchemaName, table.TableName = schema.name[0:i], schema.name[i+1:]
+		}
+		for _, column := range schema.columns {
+			table.Columns = append(table.Columns, newColumnInfoSchema(column))
+		}
+		tables = append(tables, table)
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].SchemaName != tables[j].SchemaName {
+			return tables[i].SchemaName < tables[j].SchemaName
+		}
+		return tables[i].TableName < tables[j].TableName
+	})
+	return tables
+}
+
+// 当前缓存的所有表结构，未开始同步时返回空
+func (This *BinlogDump) TableSchemas() []*TableSchema {
+	parser := This.currentParser()
+	if parser == nil {
+		return make([]*TableSchema, 0)
+	}
+	return parser.TableSchemas()
+}
@@ -3,26 +3,24 @@ package mysql
 import (
 	"bytes"
 	"crypto/sha1"
-	"encoding/binary"
+	"crypto/tls"
 	"errors"
 	"io"
-	"log"
+	"bubod/Bubod/logger"
 	"math"
-	"os"
 	"regexp"
 	"strconv"
-	"strings"
 )
 
 // Logger
 var (
-	errLog *log.Logger
-	dbgLog *log.Logger
+	errLog *logger.Entry
+	dbgLog *logger.Entry
 )
 
 func init() {
-	errLog = log.New(os.Stderr, "[MySQL] ", log.LstdFlags)
-	dbgLog = log.New(os.Stdout, "[MySQL] ", log.LstdFlags)
+	errLog = logger.With(logger.Fields{"component": "mysql"})
+	dbgLog = errLog
 
 	dsnPattern = regexp.MustCompile(
 		`^(?:(?P<user>.*?)(?::(?P<passwd>.*))?@)?` + 		// [user[:password]@]
@@ -34,47 +32,42 @@ func init() {
 // Data Source Name Parser
 var dsnPattern *regexp.Regexp
 
-func parseDSN(dsn string) *config {
-	cfg := new(config)
-	cfg.params = make(map[string]string)
-
-	matches := dsnPattern.FindStringSubmatch(dsn)
-	names := dsnPattern.SubexpNames()
-
-	for i, match := range matches {
-		switch names[i] {
-		case "user":
-			cfg.user = match
-		case "passwd":
-			cfg.passwd = match
-		case "net":
-			cfg.net = match
-		case "addr":
-			cfg.addr = match
-		case "dbname":
-			cfg.dbname = match
-		case "params":
-			for _, v := range strings.Split(match, "&") {
-				param := strings.SplitN(v, "=", 2)
-				if len(param) != 2 {
-					continue
-				}
-				cfg.params[param[0]] = param[1]
-			}
-		}
+func parseDSN(dsn string) (*config, error) {
+	d, e := ParseDSN(dsn)
+	if e != nil {
+		return nil, e
 	}
-
-	// Set default network if empty
-	if cfg.net == "" {
-		cfg.net = "tcp"
+	cfg := &config{
+		user:         d.User,
+		passwd:       d.Password,
+		dbname:       d.DBName,
+		params:       d.Params,
+		timeout:      d.Timeout,
+		readTimeout:  d.ReadTimeout,
+		writeTimeout: d.WriteTimeout,
+		tcpKeepalive: d.TCPKeepalive,
+		proxy:        d.Proxy,
+		connAttrs:    d.ConnAttrs,
+		rds:          d.RDS,
+		credential:   d.Credential,
+		foundRows:    d.FoundRows,
 	}
-
-	// Set default adress if empty
-	if cfg.addr == "" {
-		cfg.addr = "127.0.0.1:3306"
+	cfg.net, cfg.addr = d.Addr()
+	switch d.TLS {
+	case "true":
+		cfg.tls = &tls.Config{ServerName: d.Host}
+	case "skip-verify":
+		cfg.tls = &tls.Config{InsecureSkipVerify: true}
 	}
 
-	return cfg
+	// 以下参数由 handleParams 处理
+	if d.Charset != "" {
+		cfg.params["charset"] = d.Charset
+	}
+	if d.Keepalive != 0 {
+		cfg.params["keepalive"] = strconv.FormatInt(d.Keepalive, 10)
+	}
+	return cfg, nil
 }
 
 // Encrypt password using 4.1+ method
@@ -168,7 +161,7 @@ func readAndDropLengthCodedBinary(data []byte) (n int, e error) {
 	return
 }
 
-func readLengthEncodedInt(buf *bytes.Buffer) (num uint64, isNull bool, e error) {
+func readLengthEncodedInt(buf *eventReader) (num uint64, isNull bool, e error) {
 	var b byte
 
 	b, e = buf.ReadByte()
@@ -192,7 +185,7 @@ func readLengthEncodedInt(buf *bytes.Buffer) (num uint64, isNull bool, e error)
 	// 252: value of following 2
 	case b == 252:
 		var num16 uint16
-		binary.Read(buf, binary.LittleEndian, &num16)
+		num16, _ = buf.Uint16()
 		num = uint64(num16)
 		return
 
@@ -203,7 +196,7 @@ func readLengthEncodedInt(buf *bytes.Buffer) (num uint64, isNull bool, e error)
 
 	// 254: value of following 8
 	case b == 254:
-		e = binary.Read(buf, binary.LittleEndian, &num)
+		num, e = buf.Uint64()
 		return
 
 	default:
@@ -244,7 +237,7 @@ func uint24ToBytes(n uint32) (b []byte) {
 	return
 }
 
-func readFixedLengthInteger(buf *bytes.Buffer, size int) (num uint64, err error) {
+func readFixedLengthInteger(buf *eventReader, size int) (num uint64, err error) {
 	var b byte
 	num = 0
 	if buf.Len() < size {
@@ -0,0 +1,351 @@
+// 对象存储
+// 通过 S3 兼容接口访问 S3、GCS、OSS 和 MinIO，不依赖各云厂商的 SDK。
+// 用于没有持久磁盘的部署(如 Serverless、无状态容器)保存位点和归档输出。
+//
+//	type=s3   endpoint 默认为 s3.{region}.amazonaws.com
+//	type=gcs  endpoint 默认为 storage.googleapis.com，使用 HMAC 密钥(互操作性访问)
+//	type=oss  endpoint 默认为 oss-{region}.aliyuncs.com
+//
+// access_key/secret_key 未配置时读取环境变量 AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY/AWS_SESSION_TOKEN。
+// 大对象通过 Writer 分片上传，Close 时完成上传，之前对象不可见。
+package objstore
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"bubod/Bubod/config"
+)
+
+const (
+	TYPE_S3  = "s3"
+	TYPE_GCS = "gcs"
+	TYPE_OSS = "oss"
+
+	// S3 要求除最后一个分片外每个分片不小于 5MB
+	MIN_PART_SIZE     = 5 << 20
+	DEFAULT_PART_SIZE = 8 << 20
+	DEFAULT_TIMEOUT   = 30 * time.Second
+
+	UPLOAD_RETRY_INTERVAL = 5 * time.Second
+)
+
+// 对象不存在
+var ErrNotExist = errors.New("object does not exist")
+
+type Client struct {
+	endpoint     string // scheme://host
+	bucket       string
+	region       string
+	pathStyle    bool   // 路径风格 endpoint/bucket/key，否则为 bucket.endpoint/key
+	prefix       string // 所有 key 的前缀，不以 / 开头，非空时以 / 结尾
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	PartSize     int
+	http         *http.Client
+}
+
+// 根据 [ObjectStorage] 配置组创建
+func New(conf map[string]string) (*Client, error) {
+	section := config.Section(conf)
+	typ := section.GetString("type", TYPE_S3)
+	client := &Client{
+		bucket:       section.GetString("bucket", ""),
+		region:       section.GetString("region", ""),
+		prefix:       strings.Trim(section.GetString("prefix", ""), "/"),
+		accessKey:    section.GetString("access_key", os.Getenv("AWS_ACCESS_KEY_ID")),
+		secretKey:    section.GetString("secret_key", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		sessionToken: section.GetString("session_token", os.Getenv("AWS_SESSION_TOKEN")),
+	}
+	if client.bucket == "" {
+		return nil, fmt.Errorf("object storage bucket is required")
+	}
+	if client.accessKey == "" || client.secretKey == "" {
+		return nil, fmt.Errorf("object storage access_key and secret_key are required")
+	}
+	if client.prefix != "" {
+		client.prefix += "/"
+	}
+	endpoint := section.GetString("endpoint", "")
+	switch typ {
+	case TYPE_S3:
+		if client.region == "" {
+			client.region = "us-east-1"
+		}
+		if endpoint == "" {
+			endpoint = "s3." + client.region + ".amazonaws.com"
+		}
+	case TYPE_GCS:
+		if client.region == "" {
+			client.region = "auto"
+		}
+		if endpoint == "" {
+			endpoint = "storage.googleapis.com"
+		}
+	case TYPE_OSS:
+		if client.region == "" {
+			return nil, fmt.Errorf("object storage region is required for oss")
+		}
+		if endpoint == "" {
+			endpoint = "oss-" + client.region + ".aliyuncs.com"
+		}
+	default:
+		return nil, fmt.Errorf("unknown object storage type %q, must be s3, gcs or oss", typ)
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	client.endpoint = strings.TrimRight(endpoint, "/")
+
+	var err error
+	// 自建的 MinIO 等通常不支持虚拟主机风格
+	if client.pathStyle, err = section.GetBool("path_style", false); err != nil {
+		return nil, err
+	}
+	partSize, err := section.GetInt("part_size", DEFAULT_PART_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	if partSize < MIN_PART_SIZE {
+		return nil, fmt.Errorf("object storage part_size must be at least %d", MIN_PART_SIZE)
+	}
+	client.PartSize = int(partSize)
+	timeout, err := section.GetDuration("timeout", DEFAULT_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	client.http = &http.Client{Timeout: timeout}
+	return client, nil
+}
+
+func (client *Client) Bucket() string {
+	return client.bucket
+}
+
+// 对象的完整 key
+func (client *Client) Key(key string) string {
+	return client.prefix + strings.TrimLeft(key, "/")
+}
+
+// 对象的 URL，用于日志
+func (client *Client) URL(key string) string {
+	return client.objectURL(client.Key(key)).String()
+}
+
+func (client *Client) objectURL(fullKey string) *url.URL {
+	u, _ := url.Parse(client.endpoint)
+	if client.pathStyle {
+		u.Path = "/" + client.bucket + "/" + fullKey
+	} else {
+		u.Host = client.bucket + "." + u.Host
+		u.Path = "/" + fullKey
+	}
+	// 按签名使用的编码发送，避免 = 等字符编码不一致导致签名错误
+	u.RawPath = uriEncode(u.Path, false)
+	return u
+}
+
+// 发送签名请求，返回状态码和响应体，非 2xx 时返回错误
+func (client *Client) do(method string, fullKey string, query url.Values, header map[string]string, body []byte) (int, []byte, http.Header, error) {
+	u := client.objectURL(fullKey)
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	// http.NewRequest 会重新解析 URL
+	req.URL = u
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	client.sign(req, body, time.Now())
+	resp, err := client.http.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, data, resp.Header, ErrNotExist
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, data, resp.Header, fmt.Errorf("%s %s: %s %s", method, u.String(), resp.Status, bytes.TrimSpace(data))
+	}
+	return resp.StatusCode, data, resp.Header, nil
+}
+
+// 写入对象，覆盖已有对象
+func (client *Client) Put(key string, data []byte) error {
+	_, _, _, err := client.do("PUT", client.Key(key), nil, nil, data)
+	return err
+}
+
+// 读取对象，不存在时返回 ErrNotExist
+func (client *Client) Get(key string) ([]byte, error) {
+	_, data, _, err := client.do("GET", client.Key(key), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (client *Client) Delete(key string) error {
+	_, _, _, err := client.do("DELETE", client.Key(key), nil, nil, nil)
+	if err == ErrNotExist {
+		return nil
+	}
+	return err
+}
+
+// 分片上传
+// Write 缓冲到 PartSize 后上传一个分片，Close 上传剩余数据并完成上传，Abort 放弃已上传的分片。
+// 分片上传失败时数据保留在缓冲中，Write 不返回错误(可以包装在 gzip 等遇错即失效的 Writer 之下)，
+// 错误通过 Err 获取，间隔 UPLOAD_RETRY_INTERVAL 后在下次 Write 时重试，Close 时再重试一次。
+// 未完成的分片上传不可见，建议在 bucket 上配置清理未完成分片上传的生命周期规则。
+type Writer struct {
+	client   *Client
+	key      string // 完整 key
+	uploadId string
+	buf      bytes.Buffer
+	parts    []completedPart
+	size     int64
+	err      error     // 已关闭
+	partErr  error     // 最近一次分片上传失败的错误
+	retryAt  time.Time // 分片上传失败后的下次重试时间
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// 创建分片上传，第一个分片写满时才向对象存储发起上传
+func (client *Client) NewWriter(key string) *Writer {
+	return &Writer{client: client, key: client.Key(key)}
+}
+
+func (w *Writer) Key() string {
+	return w.key
+}
+
+// 已写入的字节数
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	w.size += int64(len(p))
+	if w.buf.Len() >= w.client.PartSize && time.Now().After(w.retryAt) {
+		if w.partErr = w.uploadPart(); w.partErr != nil {
+			w.retryAt = time.Now().Add(UPLOAD_RETRY_INTERVAL)
+		}
+	}
+	return len(p), nil
+}
+
+// 最近一次分片上传的错误，成功后为 nil
+func (w *Writer) Err() error {
+	return w.partErr
+}
+
+func (w *Writer) initiate() error {
+	_, data, _, err := w.client.do("POST", w.key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	if result.UploadId == "" {
+		return fmt.Errorf("initiate multipart upload %s: empty upload id", w.key)
+	}
+	w.uploadId = result.UploadId
+	return nil
+}
+
+func (w *Writer) uploadPart() error {
+	if w.uploadId == "" {
+		if err := w.initiate(); err != nil {
+			return err
+		}
+	}
+	number := len(w.parts) + 1
+	query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {w.uploadId}}
+	_, _, header, err := w.client.do("PUT", w.key, query, nil, w.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, completedPart{PartNumber: number, ETag: header.Get("ETag")})
+	w.buf.Reset()
+	return nil
+}
+
+// 完成上传，数据不足一个分片时直接 PUT
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.uploadId == "" {
+		_, _, _, err := w.client.do("PUT", w.key, nil, nil, w.buf.Bytes())
+		w.buf.Reset()
+		w.err = errors.New("writer closed")
+		return err
+	}
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	_, data, _, err := w.client.do("POST", w.key, url.Values{"uploadId": {w.uploadId}}, nil, body)
+	// 完成上传可能返回 200 但响应体为错误
+	if err == nil && bytes.Contains(data, []byte("<Error>")) {
+		err = fmt.Errorf("complete multipart upload %s: %s", w.key, data)
+	}
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	w.err = errors.New("writer closed")
+	return nil
+}
+
+// 放弃上传
+func (w *Writer) Abort() error {
+	w.buf.Reset()
+	if w.uploadId == "" {
+		return nil
+	}
+	uploadId := w.uploadId
+	w.uploadId = ""
+	_, _, _, err := w.client.do("DELETE", w.key, url.Values{"uploadId": {uploadId}}, nil, nil)
+	return err
+}
@@ -0,0 +1,395 @@
+// 最小的 Parquet 文件写入
+// 所有字段可空，PLAIN 编码、不压缩，每 RowGroupSize 行一个 row group，每个 column chunk 一个 data page(v1)。
+// 行的值均为字符串，按字段类型(Column.Type)转换后写入，无法转换的值(如 0000-00-00)写入 NULL。
+// 不依赖第三方库，足以被 Spark、Trino、DuckDB、pandas 等读取，用于导出变更数据。
+// https://github.com/apache/parquet-format
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 每个 row group 的默认行数
+const DEFAULT_ROW_GROUP_SIZE = 100000
+
+var magic = []byte("PAR1")
+
+// 字段类型
+const (
+	STRING    = "STRING"    // UTF8 字符串，默认
+	BYTES     = "BYTES"     // 二进制
+	INT64     = "INT64"     // 整数
+	DOUBLE    = "DOUBLE"    // 浮点数
+	DECIMAL   = "DECIMAL"   // 定点数 DECIMAL(Precision, Scale)，保存为二进制补码
+	DATE      = "DATE"      // 2006-01-02
+	TIMESTAMP = "TIMESTAMP" // 2006-01-02 15:04:05[.999999]，按 UTC 保存为微秒
+)
+
+// parquet.thrift 中用到的枚举值
+const (
+	typeInt32              = 1
+	typeInt64              = 2
+	typeDouble             = 5
+	typeByteArray          = 6
+	repetitionOptional     = 1
+	convertedTypeUTF8      = 0
+	convertedTypeDecimal   = 5
+	convertedTypeDate      = 6
+	convertedTypeTimestamp = 10 // TIMESTAMP_MICROS
+	encodingPlain          = 0
+	encodingRLE            = 3
+	codecUncompressed      = 0
+	pageTypeData           = 0
+	thriftCreatedBy        = "bubod"
+	fileMetaDataVersion    = 1
+	definitionLevelBitSize = 1
+)
+
+type Writer struct {
+	RowGroupSize int // 每个 row group 的行数，默认 DEFAULT_ROW_GROUP_SIZE
+
+	w         io.Writer
+	offset    int64
+	columns   []Column
+	rows      [][]*string // 当前 row group 缓存的行，nil 为 NULL
+	rowGroups []*rowGroup
+	numRows   int64
+	closed    bool
+}
+
+type rowGroup struct {
+	numRows   int64
+	totalSize int64
+	chunks    []*columnChunk
+}
+
+type columnChunk struct {
+	offset    int64
+	size      int64
+	numValues int64
+}
+
+// 字段
+type Column struct {
+	Name      string
+	Type      string // 为空时为 STRING
+	Precision int    // DECIMAL
+	Scale     int
+}
+
+// 物理类型
+func (column *Column) physicalType() int32 {
+	switch column.Type {
+	case INT64, TIMESTAMP:
+		return typeInt64
+	case DOUBLE:
+		return typeDouble
+	case DATE:
+		return typeInt32
+	}
+	return typeByteArray
+}
+
+// 按字段类型编码一个值(PLAIN)，无法转换时返回 nil
+func (column *Column) encode(value string) []byte {
+	buf := make([]byte, 8)
+	switch column.Type {
+	case INT64:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil
+		}
+		binary.LittleEndian.PutUint64(buf, uint64(v))
+		return buf
+	case DOUBLE:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil
+		}
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(v))
+		return buf
+	case DATE:
+		t, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return nil
+		}
+		binary.LittleEndian.PutUint32(buf, uint32(int32(t.Unix()/86400)))
+		return buf[:4]
+	case TIMESTAMP:
+		t, err := time.Parse("2006-01-02 15:04:05.999999999", value)
+		if err != nil {
+			return nil
+		}
+		binary.LittleEndian.PutUint64(buf, uint64(t.UnixNano()/1000))
+		return buf
+	case DECIMAL:
+		unscaled := decimalUnscaled(value, column.Scale)
+		if unscaled == nil {
+			return nil
+		}
+		return lengthPrefixed(twosComplement(unscaled))
+	}
+	return lengthPrefixed([]byte(value))
+}
+
+// 去掉小数点后的整数，小数位按 scale 补零或截断
+func decimalUnscaled(value string, scale int) *big.Int {
+	integer, fraction := value, ""
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		integer, fraction = value[:i], value[i+1:]
+	}
+	if len(fraction) > scale {
+		fraction = fraction[:scale]
+	}
+	fraction += strings.Repeat("0", scale-len(fraction))
+	unscaled, ok := new(big.Int).SetString(integer+fraction, 10)
+	if !ok {
+		return nil
+	}
+	return unscaled
+}
+
+// 大端二进制补码，最少字节数
+func twosComplement(v *big.Int) []byte {
+	if v.Sign() >= 0 {
+		b := v.Bytes()
+		if len(b) == 0 || b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return b
+	}
+	// 负数: 2^(8n) + v，n 为能表示 v 的最少字节数
+	n := (new(big.Int).Not(v).BitLen() + 8) / 8
+	b := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), uint(n*8)), v).Bytes()
+	for len(b) < n {
+		b = append([]byte{0xff}, b...)
+	}
+	return b
+}
+
+func lengthPrefixed(b []byte) []byte {
+	buf := make([]byte, 4+len(b))
+	binary.LittleEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	return buf
+}
+
+// 创建写入器，columns 为字段名，所有字段为 UTF8 字符串
+func NewWriter(w io.Writer, columns []string) (*Writer, error) {
+	typed := make([]Column, len(columns))
+	for i, name := range columns {
+		typed[i] = Column{Name: name, Type: STRING}
+	}
+	return NewTypedWriter(w, typed)
+}
+
+// 创建按字段类型写入的写入器
+func NewTypedWriter(w io.Writer, columns []Column) (*Writer, error) {
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("parquet: no column")
+	}
+	for _, column := range columns {
+		switch column.Type {
+		case "", STRING, BYTES, INT64, DOUBLE, DATE, TIMESTAMP:
+		case DECIMAL:
+			if column.Precision <= 0 || column.Scale < 0 || column.Scale > column.Precision {
+				return nil, fmt.Errorf("parquet: column %s invalid DECIMAL(%d,%d)", column.Name, column.Precision, column.Scale)
+			}
+		default:
+			return nil, fmt.Errorf("parquet: column %s unknown type %s", column.Name, column.Type)
+		}
+	}
+	if _, err := w.Write(magic); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, offset: int64(len(magic)), columns: columns}, nil
+}
+
+// 写入一行，字段数需要与 columns 一致，nil 为 NULL
+func (writer *Writer) Write(row []*string) error {
+	if writer.closed {
+		return fmt.Errorf("parquet: writer closed")
+	}
+	if len(row) != len(writer.columns) {
+		return fmt.Errorf("parquet: row has %d values, want %d", len(row), len(writer.columns))
+	}
+	writer.rows = append(writer.rows, row)
+	size := writer.RowGroupSize
+	if size <= 0 {
+		size = DEFAULT_ROW_GROUP_SIZE
+	}
+	if len(writer.rows) >= size {
+		return writer.flush()
+	}
+	return nil
+}
+
+// 写入缓存的行作为一个 row group
+func (writer *Writer) flush() error {
+	if len(writer.rows) == 0 {
+		return nil
+	}
+	group := &rowGroup{numRows: int64(len(writer.rows))}
+	for i := range writer.columns {
+		page := encodeDataPage(writer.rows, i, &writer.columns[i])
+		header := encodePageHeader(len(writer.rows), len(page))
+		chunk := &columnChunk{offset: writer.offset, size: int64(len(header) + len(page)), numValues: int64(len(writer.rows))}
+		for _, b := range [][]byte{header, page} {
+			if _, err := writer.w.Write(b); err != nil {
+				return err
+			}
+		}
+		writer.offset += chunk.size
+		group.totalSize += chunk.size
+		group.chunks = append(group.chunks, chunk)
+	}
+	writer.rowGroups = append(writer.rowGroups, group)
+	writer.numRows += group.numRows
+	writer.rows = writer.rows[:0]
+	return nil
+}
+
+// 写入剩余的行和文件尾，不关闭底层 io.Writer
+func (writer *Writer) Close() error {
+	if writer.closed {
+		return nil
+	}
+	if err := writer.flush(); err != nil {
+		return err
+	}
+	writer.closed = true
+	footer := writer.encodeFileMetaData()
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(footer)))
+	for _, b := range [][]byte{footer, length, magic} {
+		if _, err := writer.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// data page v1: 定义级别(4 字节长度 + RLE) + 非空值(PLAIN)
+func encodeDataPage(rows [][]*string, index int, column *Column) []byte {
+	values := make([][]byte, len(rows))
+	for i, row := range rows {
+		if row[index] != nil {
+			values[i] = column.encode(*row[index])
+		}
+	}
+	levels := new(bytes.Buffer)
+	for i := 0; i < len(values); {
+		defined := values[i] != nil
+		run := 1
+		for i+run < len(values) && (values[i+run] != nil) == defined {
+			run++
+		}
+		// RLE run: varint(run << 1) + 值(位宽 1，占 1 字节)
+		writeUvarint(levels, uint64(run)<<1)
+		if defined {
+			levels.WriteByte(1)
+		} else {
+			levels.WriteByte(0)
+		}
+		i += run
+	}
+	page := new(bytes.Buffer)
+	binary.Write(page, binary.LittleEndian, uint32(levels.Len()))
+	page.Write(levels.Bytes())
+	for _, value := range values {
+		page.Write(value)
+	}
+	return page.Bytes()
+}
+
+func encodePageHeader(numValues int, size int) []byte {
+	t := newThriftWriter()
+	t.i32(1, pageTypeData)
+	t.i32(2, int32(size))
+	t.i32(3, int32(size))
+	t.structBegin(5)
+	t.i32(1, int32(numValues))
+	t.i32(2, encodingPlain)
+	t.i32(3, encodingRLE)
+	t.i32(4, encodingRLE)
+	t.structEnd()
+	t.stop()
+	return t.buf.Bytes()
+}
+
+func (writer *Writer) encodeFileMetaData() []byte {
+	t := newThriftWriter()
+	t.i32(1, fileMetaDataVersion)
+
+	// schema: 根节点 + 每个字段
+	t.listBegin(2, thriftStruct, len(writer.columns)+1)
+	t.elemBegin()
+	t.binary(4, []byte("schema"))
+	t.i32(5, int32(len(writer.columns)))
+	t.structEnd()
+	for _, column := range writer.columns {
+		t.elemBegin()
+		t.i32(1, column.physicalType())
+		t.i32(3, repetitionOptional)
+		t.binary(4, []byte(column.Name))
+		switch column.Type {
+		case "", STRING:
+			t.i32(6, convertedTypeUTF8)
+		case DECIMAL:
+			t.i32(6, convertedTypeDecimal)
+			t.i32(7, int32(column.Scale))
+			t.i32(8, int32(column.Precision))
+		case DATE:
+			t.i32(6, convertedTypeDate)
+		case TIMESTAMP:
+			t.i32(6, convertedTypeTimestamp)
+		}
+		t.structEnd()
+	}
+
+	t.i64(3, writer.numRows)
+
+	t.listBegin(4, thriftStruct, len(writer.rowGroups))
+	for _, group := range writer.rowGroups {
+		t.elemBegin()
+		t.listBegin(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			t.elemBegin()
+			t.i64(2, chunk.offset)
+			t.structBegin(3)
+			t.i32(1, writer.columns[i].physicalType())
+			t.listBegin(2, thriftI32, 2)
+			t.listI32(encodingPlain)
+			t.listI32(encodingRLE)
+			t.listBegin(3, thriftBinary, 1)
+			t.listBinary([]byte(writer.columns[i].Name))
+			t.i32(4, codecUncompressed)
+			t.i64(5, chunk.numValues)
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.structEnd()
+			t.structEnd()
+		}
+		t.i64(2, group.totalSize)
+		t.i64(3, group.numRows)
+		t.structEnd()
+	}
+
+	t.binary(6, []byte(thriftCreatedBy))
+	t.stop()
+	return t.buf.Bytes()
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutUvarint(b, v)])
+}
@@ -0,0 +1,163 @@
+package testmysql
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"bubod/Bubod/mysql"
+)
+
+const (
+	EVENT_HEADER_SIZE = 19
+	BINLOG_MAGIC      = "\xfebin"
+
+	// 事件头 flags
+	LOG_EVENT_ARTIFICIAL_F = 0x20
+
+	// binlog 中 5.7 各类事件的 post-header 长度，下标为事件类型 - 1
+	postHeaderLengths = "\x38\x0d\x00\x08\x00\x12\x00\x04\x04\x04\x04\x12\x00\x00\x5f\x00\x04\x1a\x08\x00\x00\x00\x08\x08\x08\x02\x00\x00\x00\x0a\x0a\x0a\x2a\x2a\x00\x12\x34\x00"
+)
+
+// 内存中的 binlog 文件，data 以 magic 开头，依次为完整的事件(含校验和)
+type binlogFile struct {
+	name string
+	data []byte
+}
+
+func (file *binlogFile) size() uint32 {
+	return uint32(len(file.data))
+}
+
+// 按 offset 读取一个事件，返回事件数据和下一个事件的位置
+func (file *binlogFile) eventAt(offset uint32) ([]byte, uint32, error) {
+	if offset+EVENT_HEADER_SIZE > file.size() {
+		return nil, 0, fmt.Errorf("bogus data in log event at %d", offset)
+	}
+	size := binary.LittleEndian.Uint32(file.data[offset+9:])
+	if size < EVENT_HEADER_SIZE || offset+size > file.size() {
+		return nil, 0, fmt.Errorf("bogus data in log event at %d", offset)
+	}
+	return file.data[offset : offset+size], offset + size, nil
+}
+
+// 编码事件: 事件头 + body + CRC32 校验和(开启时)
+// logPos 为下一个事件的位置，0 为不占用文件位置的事件(artificial rotate、heartbeat)
+func encodeEvent(eventType mysql.EventType, serverId uint32, timestamp uint32, logPos uint32, flags uint16, body []byte, checksum bool) []byte {
+	size := EVENT_HEADER_SIZE + len(body)
+	if checksum {
+		size += 4
+	}
+	event := make([]byte, EVENT_HEADER_SIZE, size)
+	binary.LittleEndian.PutUint32(event[0:], timestamp)
+	event[4] = byte(eventType)
+	binary.LittleEndian.PutUint32(event[5:], serverId)
+	binary.LittleEndian.PutUint32(event[9:], uint32(size))
+	binary.LittleEndian.PutUint32(event[13:], logPos)
+	binary.LittleEndian.PutUint16(event[17:], flags)
+	event = append(event, body...)
+	if checksum {
+		event = append(event, uint32Bytes(crc32.ChecksumIEEE(event))...)
+	}
+	return event
+}
+
+// 修改事件的 log_pos，重新计算校验和
+func setEventLogPos(event []byte, logPos uint32, checksum bool) []byte {
+	event = append([]byte(nil), event...)
+	binary.LittleEndian.PutUint32(event[13:], logPos)
+	if checksum {
+		n := len(event) - 4
+		binary.LittleEndian.PutUint32(event[n:], crc32.ChecksumIEEE(event[:n]))
+	}
+	return event
+}
+
+// FORMAT_DESCRIPTION_EVENT body，5.6.1 之后总是带校验和算法和 4 字节校验和
+func formatDescriptionBody(version string, created uint32, checksum bool) []byte {
+	body := uint16Bytes(4)
+	serverVersion := make([]byte, 50)
+	copy(serverVersion, version)
+	body = append(body, serverVersion...)
+	body = append(body, uint32Bytes(created)...)
+	body = append(body, EVENT_HEADER_SIZE)
+	body = append(body, postHeaderLengths...)
+	if checksum {
+		return append(body, 1)
+	}
+	// 关闭校验和时同样保留 4 字节校验和
+	return append(body, 0, 0, 0, 0, 0)
+}
+
+// QUERY_EVENT body: thread_id、执行时间、库名长度、错误码、status vars 长度 + 库名 + 语句
+func queryBody(database string, query string) []byte {
+	body := make([]byte, 13, 13+len(database)+1+len(query))
+	binary.LittleEndian.PutUint32(body[0:], 1)
+	body[8] = byte(len(database))
+	body = append(body, database...)
+	body = append(body, 0)
+	return append(body, query...)
+}
+
+// TABLE_MAP_EVENT body
+func tableMapBody(t *table) []byte {
+	body := make([]byte, 0, 64)
+	body = append(body, uint64Bytes(t.tableId)[:6]...)
+	body = append(body, 1, 0)
+	body = append(body, byte(len(t.database)))
+	body = append(body, t.database...)
+	body = append(body, 0, byte(len(t.name)))
+	body = append(body, t.name...)
+	body = append(body, 0)
+	body = append(body, lengthEncodedInt(uint64(len(t.columns)))...)
+	meta := make([]byte, 0, len(t.columns)*2)
+	for _, ct := range t.types {
+		body = append(body, byte(ct.fieldType))
+		meta = append(meta, ct.meta...)
+	}
+	body = append(body, lengthEncodedInt(uint64(len(meta)))...)
+	body = append(body, meta...)
+	// 主键以外的字段可为 NULL
+	nullable := make([]byte, (len(t.columns)+7)/8)
+	for i, column := range t.columns {
+		if !column.Primary {
+			nullable[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return append(body, nullable...)
+}
+
+// ROWS_EVENT v2 body，rows 为已编码的行，update 事件按 变更前、变更后 成对出现
+func rowsBody(eventType mysql.EventType, t *table, rows [][]byte) []byte {
+	body := make([]byte, 0, 64)
+	body = append(body, uint64Bytes(t.tableId)[:6]...)
+	// flags: STMT_END_F，extra data 长度(包含自身 2 字节)
+	body = append(body, 1, 0, 2, 0)
+	body = append(body, lengthEncodedInt(uint64(len(t.columns)))...)
+	present := make([]byte, (len(t.columns)+7)/8)
+	for i := range t.columns {
+		present[i/8] |= 1 << uint(i%8)
+	}
+	body = append(body, present...)
+	if eventType == mysql.UPDATE_ROWS_EVENTv2 {
+		body = append(body, present...)
+	}
+	for _, row := range rows {
+		body = append(body, row...)
+	}
+	return body
+}
+
+// ROTATE_EVENT body: 新文件的位置 + 文件名
+func rotateBody(filename string, position uint64) []byte {
+	return append(uint64Bytes(position), filename...)
+}
+
+func xidBody(xid uint64) []byte {
+	return uint64Bytes(xid)
+}
+
+func eventTimestamp() uint32 {
+	return uint32(time.Now().Unix())
+}
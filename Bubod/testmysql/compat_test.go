@@ -0,0 +1,100 @@
+package testmysql_test
+
+import (
+	"strings"
+	"testing"
+
+	"bubod/Bubod/mysql"
+	"bubod/Bubod/testmysql"
+)
+
+func TestPreflightUpstream(t *testing.T) {
+	vt := &testmysql.Table{Database: "_vt", Name: "heartbeat", Columns: []testmysql.Column{{Name: "keyspaceShard", Type: "varchar(255)", Primary: true}}}
+	tests := []struct {
+		name    string
+		version string
+		tables  []*testmysql.Table
+		flavor  string
+		problem string // 为空时检查通过
+	}{
+		{"mysql", testmysql.DEFAULT_VERSION, nil, mysql.FLAVOR_MYSQL, ""},
+		{"tidb", "5.7.25-TiDB-v7.1.0", nil, mysql.FLAVOR_TIDB, "TiDB does not support binlog dump"},
+		{"vtgate", "8.0.30-Vitess", nil, mysql.FLAVOR_VITESS, "vtgate does not support binlog dump"},
+		{"vitess mysqld", "8.0.30", []*testmysql.Table{vt}, mysql.FLAVOR_MYSQL, "mysqld is managed by Vitess"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, err := mysql.ParseServerVersion(test.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if flavor := version.Flavor(); flavor != test.flavor {
+				t.Errorf("flavor of %s is %s, want %s", test.version, flavor, test.flavor)
+			}
+
+			server := startServer(t, testmysql.Config{Version: test.version, Tables: test.tables})
+			err = mysql.Preflight(server.DataSource("db"), &mysql.PreflightOptions{})
+			if test.problem == "" {
+				if err != nil {
+					t.Fatalf("preflight: %s", err)
+				}
+				return
+			}
+			if _, ok := err.(*mysql.PreflightError); !ok {
+				t.Fatalf("preflight returned %v, want *PreflightError", err)
+			}
+			if !strings.Contains(err.Error(), test.problem) {
+				t.Fatalf("preflight returned %q, want %q", err, test.problem)
+			}
+		})
+	}
+}
+
+// tableId 分配给其他表、或表结构变化后沿用原 tableId 时重新获取表结构，不按缓存的表结构解码
+func TestTableIdReuse(t *testing.T) {
+	server := startServer(t, testmysql.Config{
+		Checksum: true,
+		Tables: []*testmysql.Table{
+			{Database: "db", Name: "a", Rows: 1, Columns: testColumns},
+			{Database: "db", Name: "b", Columns: []testmysql.Column{
+				{Name: "id", Type: "bigint", Primary: true},
+				{Name: "score", Type: "double"},
+			}},
+		},
+	})
+	events := startDump(t, server, 0)
+	expectEvents(t, events, "WRITE_ROWS_EVENTv2 db.a [map[id:1 name:name-1]]")
+
+	// a 的 tableId 分配给 b
+	if err := server.SetTableId("db", "b", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Insert("db", "b", []interface{}{1, 1.5}); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events, "WRITE_ROWS_EVENTv2 db.b [map[id:1 score:1.5]]")
+
+	// binlog 中没有 DDL 的表结构变化，之后沿用原 tableId
+	err := server.Exec(&testmysql.DDL{Table: &testmysql.Table{Database: "db", Name: "b", Columns: []testmysql.Column{
+		{Name: "id", Type: "bigint", Primary: true},
+		{Name: "score", Type: "double"},
+		{Name: "note", Type: "text"},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetTableId("db", "b", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Insert("db", "b", []interface{}{2, 2.5, "x"}); err != nil {
+		t.Fatal(err)
+	}
+	// a 仍使用 tableId 100
+	if err := server.Insert("db", "a", []interface{}{2, "b"}); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events,
+		"WRITE_ROWS_EVENTv2 db.b [map[id:2 note:x score:2.5]]",
+		"WRITE_ROWS_EVENTv2 db.a [map[id:2 name:b]]",
+	)
+}
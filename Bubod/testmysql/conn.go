@@ -0,0 +1,355 @@
+package testmysql
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"time"
+
+	"bubod/Bubod/mysql"
+)
+
+// COM_BINLOG_DUMP flags
+const BINLOG_DUMP_NON_BLOCK = 1
+
+// 预处理语句
+type stmt struct {
+	query      string
+	paramCount int
+	columns    []string
+	paramTypes []byte
+}
+
+func (c *conn) serve() {
+	defer c.netConn.Close()
+	if err := c.handshake(); err != nil {
+		return
+	}
+	stmts := make(map[uint32]*stmt)
+	var nextStmtId uint32
+	for {
+		data, err := c.readPacket()
+		if err != nil || len(data) == 0 {
+			return
+		}
+		command, data := data[0], data[1:]
+		switch command {
+		case byte(mysql.COM_QUIT):
+			return
+		case byte(mysql.COM_PING), byte(mysql.COM_INIT_DB):
+			err = c.writeOK()
+		case byte(mysql.COM_QUERY):
+			result, queryErr := c.query(string(data), nil)
+			if queryErr != nil {
+				err = c.writeError(queryErr)
+			} else {
+				err = c.writeTextResult(result)
+			}
+		case byte(mysql.COM_STMT_PREPARE):
+			nextStmtId++
+			var s *stmt
+			if s, err = c.prepare(string(data)); err != nil {
+				err = c.writeError(err)
+				break
+			}
+			stmts[nextStmtId] = s
+			err = c.writePrepareOK(nextStmtId, s)
+		case byte(mysql.COM_STMT_EXECUTE):
+			err = c.execute(stmts, data)
+		case byte(mysql.COM_STMT_CLOSE):
+			if len(data) >= 4 {
+				delete(stmts, binary.LittleEndian.Uint32(data))
+			}
+			continue
+		case byte(mysql.COM_BINLOG_DUMP):
+			if len(data) < 10 {
+				err = c.writeError(newError(1064, "malformed binlog dump"))
+				break
+			}
+			position := binary.LittleEndian.Uint32(data)
+			flags := binary.LittleEndian.Uint16(data[4:])
+			err = c.dump(string(data[10:]), position, flags)
+		case byte(mysql.COM_BINLOG_DUMP_GTID):
+			// flags(2) server_id(4) 文件名长度(4) 文件名 position(8) GTID 集合，不生成 GTID 事件，只按文件位置发送
+			if len(data) < 10 {
+				err = c.writeError(newError(1064, "malformed binlog dump"))
+				break
+			}
+			flags := binary.LittleEndian.Uint16(data)
+			n := int(binary.LittleEndian.Uint32(data[6:]))
+			if len(data) < 10+n+8 {
+				err = c.writeError(newError(1064, "malformed binlog dump"))
+				break
+			}
+			position := binary.LittleEndian.Uint64(data[10+n:])
+			err = c.dump(string(data[10:10+n]), uint32(position), flags)
+		default:
+			err = c.writeError(newError(1047, "Unknown command"))
+		}
+		if err == nil {
+			err = c.flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 预处理: 按空参数执行一次得到结果集的字段
+func (c *conn) prepare(query string) (*stmt, error) {
+	s := &stmt{query: query, paramCount: countPlaceholders(query)}
+	args := make([]interface{}, s.paramCount)
+	for i := range args {
+		args[i] = ""
+	}
+	result, err := c.query(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		s.columns = result.columns
+	}
+	return s, nil
+}
+
+// ? 占位符的个数，忽略引号中的内容
+func countPlaceholders(query string) int {
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		switch ch := query[i]; {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			quote = ch
+		case ch == '?':
+			n++
+		}
+	}
+	return n
+}
+
+func (c *conn) writePrepareOK(id uint32, s *stmt) error {
+	data := []byte{0}
+	data = append(data, uint32Bytes(id)...)
+	data = append(data, uint16Bytes(uint16(len(s.columns)))...)
+	data = append(data, uint16Bytes(uint16(s.paramCount))...)
+	data = append(data, 0, 0, 0)
+	if err := c.writePacket(data); err != nil {
+		return err
+	}
+	if s.paramCount > 0 {
+		for i := 0; i < s.paramCount; i++ {
+			if err := c.writePacket(columnDefinition("?")); err != nil {
+				return err
+			}
+		}
+		if err := c.writeEOF(); err != nil {
+			return err
+		}
+	}
+	if len(s.columns) > 0 {
+		for _, name := range s.columns {
+			if err := c.writePacket(columnDefinition(name)); err != nil {
+				return err
+			}
+		}
+		return c.writeEOF()
+	}
+	return nil
+}
+
+// COM_STMT_EXECUTE: stmt_id(4) flags(1) iteration_count(4) null_bitmap new_params_bound_flag(1) 参数类型 参数值
+func (c *conn) execute(stmts map[uint32]*stmt, data []byte) error {
+	if len(data) < 9 {
+		return c.writeError(newError(1064, "malformed execute"))
+	}
+	s, ok := stmts[binary.LittleEndian.Uint32(data)]
+	if !ok {
+		return c.writeError(newError(1243, "Unknown prepared statement handler given to mysqld_stmt_execute"))
+	}
+	args, err := s.readArgs(data[9:])
+	if err != nil {
+		return c.writeError(newError(1210, "Incorrect arguments to mysqld_stmt_execute"))
+	}
+	result, err := c.query(s.query, args)
+	if err != nil {
+		return c.writeError(err)
+	}
+	return c.writeBinaryResult(result)
+}
+
+func (s *stmt) readArgs(data []byte) ([]interface{}, error) {
+	args := make([]interface{}, s.paramCount)
+	if s.paramCount == 0 {
+		return args, nil
+	}
+	n := (s.paramCount + 7) / 8
+	if len(data) < n+1 {
+		return nil, errMalformed
+	}
+	nullBitmap, bound := data[:n], data[n]
+	pos := n + 1
+	if bound == 1 {
+		if len(data) < pos+s.paramCount*2 {
+			return nil, errMalformed
+		}
+		s.paramTypes = append([]byte(nil), data[pos:pos+s.paramCount*2]...)
+		pos += s.paramCount * 2
+	}
+	if len(s.paramTypes) != s.paramCount*2 {
+		return nil, errMalformed
+	}
+	for i := range args {
+		if nullBitmap[i/8]&(1<<uint(i%8)) != 0 {
+			continue
+		}
+		size := 0
+		switch mysql.FieldType(s.paramTypes[i*2]) {
+		case mysql.FIELD_TYPE_NULL:
+			continue
+		case mysql.FIELD_TYPE_TINY:
+			size = 1
+		case mysql.FIELD_TYPE_SHORT, mysql.FIELD_TYPE_YEAR:
+			size = 2
+		case mysql.FIELD_TYPE_LONG, mysql.FIELD_TYPE_INT24, mysql.FIELD_TYPE_FLOAT:
+			size = 4
+		case mysql.FIELD_TYPE_LONGLONG, mysql.FIELD_TYPE_DOUBLE:
+			size = 8
+		default:
+			value, m, err := readLengthEncodedString(data[pos:])
+			if err != nil {
+				return nil, err
+			}
+			args[i] = value
+			pos += m
+			continue
+		}
+		if len(data) < pos+size {
+			return nil, errMalformed
+		}
+		var v uint64
+		for k := size - 1; k >= 0; k-- {
+			v = v<<8 | uint64(data[pos+k])
+		}
+		switch mysql.FieldType(s.paramTypes[i*2]) {
+		case mysql.FIELD_TYPE_DOUBLE:
+			args[i] = math.Float64frombits(v)
+		case mysql.FIELD_TYPE_FLOAT:
+			args[i] = float64(math.Float32frombits(uint32(v)))
+		default:
+			// 有符号数按位宽扩展
+			shift := uint(64 - size*8)
+			args[i] = int64(v<<shift) >> shift
+		}
+		pos += size
+	}
+	return args, nil
+}
+
+var errMalformed = newError(1064, "malformed packet")
+
+// 发送 binlog: artificial ROTATE、FORMAT_DESCRIPTION_EVENT，之后依次发送事件，
+// 到达最新位置后等待新事件(按 @master_heartbeat_period 发送心跳)，NON_BLOCK 时发送 EOF 结束
+func (c *conn) dump(filename string, position uint32, flags uint16) error {
+	server := c.server
+	checksum := server.conf.Checksum
+	server.mu.Lock()
+	index := -1
+	for i, file := range server.files {
+		if file.name == filename || (filename == "" && i == 0) {
+			index = i
+		}
+	}
+	var file *binlogFile
+	var data []byte
+	if index >= 0 {
+		file, data = server.files[index], server.files[index].data
+	}
+	server.mu.Unlock()
+
+	if file == nil {
+		return c.writeError(newError(1236, "Could not find first log file name in binary log index file"))
+	}
+	if position < uint32(len(BINLOG_MAGIC)) {
+		position = uint32(len(BINLOG_MAGIC))
+	}
+	if int(position) > len(data) {
+		return c.writeError(newError(1236, "Client requested master to start replication from position > file size"))
+	}
+
+	send := func(event []byte) error {
+		return c.writePacket(append([]byte{0}, event...))
+	}
+	artificial := func(eventType mysql.EventType, logPos uint32, body []byte) error {
+		return send(encodeEvent(eventType, server.conf.ServerId, 0, logPos, LOG_EVENT_ARTIFICIAL_F, body, checksum))
+	}
+	if err := artificial(mysql.ROTATE_EVENT, 0, rotateBody(file.name, uint64(position))); err != nil {
+		return err
+	}
+	fde, next, err := (&binlogFile{data: data}).eventAt(uint32(len(BINLOG_MAGIC)))
+	if err != nil {
+		return c.writeError(newError(1236, "%s", err))
+	}
+	if position > next {
+		// 从文件中间开始时 FORMAT_DESCRIPTION_EVENT 的 log_pos 为 0，客户端不更新位点
+		fde = setEventLogPos(fde, 0, checksum)
+	} else {
+		position = next
+	}
+	if err := send(fde); err != nil {
+		return err
+	}
+
+	for {
+		server.mu.Lock()
+		data = file.data
+		if int(position) == len(data) && index+1 < len(server.files) {
+			// 当前文件已发送完(以 ROTATE 结束)，继续发送下一个文件
+			index++
+			file, data, position = server.files[index], server.files[index].data, uint32(len(BINLOG_MAGIC))
+		}
+		notify, closed := server.notify, server.closed
+		server.mu.Unlock()
+		if closed {
+			return nil
+		}
+
+		if int(position) < len(data) {
+			event, next, err := (&binlogFile{data: data}).eventAt(position)
+			if err != nil {
+				return c.writeError(newError(1236, "%s", err))
+			}
+			if err := send(event); err != nil {
+				return err
+			}
+			position = next
+			continue
+		}
+
+		if flags&BINLOG_DUMP_NON_BLOCK != 0 {
+			return c.writeEOF()
+		}
+		if err := c.flush(); err != nil {
+			return err
+		}
+		var timeout <-chan time.Time
+		if c.heartbeat > 0 {
+			timeout = time.After(c.heartbeat)
+		}
+		select {
+		case <-notify:
+		case <-timeout:
+			if err := artificial(mysql.HEARTBEAT_EVENT, position, []byte(file.name)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// 去掉首尾空白和结尾的分号
+func normalizeQuery(query string) string {
+	return strings.TrimRight(strings.TrimSpace(query), "; \t\r\n")
+}
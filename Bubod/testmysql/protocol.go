@@ -0,0 +1,341 @@
+package testmysql
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"bubod/Bubod/mysql"
+)
+
+const (
+	PROTOCOL_VERSION = 10
+	MAX_PACKET_SIZE  = 1<<24 - 1
+	CHARSET_UTF8     = 33
+	SERVER_STATUS    = 0x0002 // SERVER_STATUS_AUTOCOMMIT
+
+	CLIENT_PLUGIN_AUTH = 1 << 19
+
+	// 结果集中的字段统一为 VAR_STRING
+	fieldTypeVarString = 253
+)
+
+// 返回给客户端的错误
+type sqlError struct {
+	code    uint16
+	state   string
+	message string
+}
+
+func (e *sqlError) Error() string {
+	return fmt.Sprintf("Error %d: %s", e.code, e.message)
+}
+
+func newError(code uint16, format string, args ...interface{}) *sqlError {
+	return &sqlError{code: code, state: "HY000", message: fmt.Sprintf(format, args...)}
+}
+
+// 查询结果，values 中 nil 为 NULL
+type resultSet struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+// 一个客户端连接
+type conn struct {
+	server    *Server
+	id        uint32
+	netConn   net.Conn
+	reader    *bufio.Reader
+	writer    *bufio.Writer
+	sequence  uint8
+	scramble  []byte
+	heartbeat time.Duration // SET @master_heartbeat_period
+}
+
+func newConn(server *Server, id uint32, netConn net.Conn) *conn {
+	return &conn{
+		server:  server,
+		id:      id,
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriterSize(netConn, 64<<10),
+	}
+}
+
+func (c *conn) readPacket() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return nil, err
+	}
+	size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	c.sequence = header[3] + 1
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// 写入缓冲，需要 flush
+func (c *conn) writePacket(data []byte) error {
+	if len(data) > MAX_PACKET_SIZE {
+		return fmt.Errorf("testmysql: packet too large")
+	}
+	header := []byte{byte(len(data)), byte(len(data) >> 8), byte(len(data) >> 16), c.sequence}
+	c.sequence++
+	if _, err := c.writer.Write(header); err != nil {
+		return err
+	}
+	_, err := c.writer.Write(data)
+	return err
+}
+
+func (c *conn) flush() error {
+	return c.writer.Flush()
+}
+
+func (c *conn) writeOK() error {
+	return c.writePacket([]byte{0, 0, 0, byte(SERVER_STATUS), byte(SERVER_STATUS >> 8), 0, 0})
+}
+
+func (c *conn) writeEOF() error {
+	return c.writePacket([]byte{0xfe, 0, 0, byte(SERVER_STATUS), byte(SERVER_STATUS >> 8)})
+}
+
+func (c *conn) writeError(err error) error {
+	e, ok := err.(*sqlError)
+	if !ok {
+		e = newError(1105, "%s", err)
+	}
+	data := []byte{0xff, byte(e.code), byte(e.code >> 8), '#'}
+	data = append(data, e.state...)
+	data = append(data, e.message...)
+	return c.writePacket(data)
+}
+
+// 握手: Handshake V10，认证方式 mysql_native_password
+func (c *conn) handshake() error {
+	c.scramble = make([]byte, 20)
+	for i := range c.scramble {
+		// 不含 0，客户端按 0 结尾读取
+		c.scramble[i] = byte(1 + (int(c.id)*31+i*17)%126)
+	}
+	capabilities := uint32(mysql.CLIENT_LONG_PASSWORD | mysql.CLIENT_LONG_FLAG | mysql.CLIENT_CONNECT_WITH_DB |
+		mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_TRANSACTIONS | mysql.CLIENT_SECURE_CONN | CLIENT_PLUGIN_AUTH)
+	data := []byte{PROTOCOL_VERSION}
+	data = append(data, c.server.conf.Version...)
+	data = append(data, 0)
+	data = append(data, uint32Bytes(c.id)...)
+	data = append(data, c.scramble[:8]...)
+	data = append(data, 0)
+	data = append(data, uint16Bytes(uint16(capabilities))...)
+	data = append(data, CHARSET_UTF8)
+	data = append(data, uint16Bytes(SERVER_STATUS)...)
+	data = append(data, uint16Bytes(uint16(capabilities>>16))...)
+	data = append(data, byte(len(c.scramble)+1))
+	data = append(data, make([]byte, 10)...)
+	data = append(data, c.scramble[8:]...)
+	data = append(data, 0)
+	data = append(data, "mysql_native_password"...)
+	data = append(data, 0)
+	c.sequence = 0
+	if err := c.writePacket(data); err != nil {
+		return err
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	auth, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if err := c.checkAuth(auth); err != nil {
+		c.writeError(err)
+		c.flush()
+		return err
+	}
+	if err := c.writeOK(); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// 校验 Handshake Response 41 中的用户名和密码
+func (c *conn) checkAuth(data []byte) error {
+	conf := c.server.conf
+	if conf.User == "" {
+		return nil
+	}
+	pos := 4 + 4 + 1 + 23
+	if len(data) < pos {
+		return newError(1043, "Bad handshake")
+	}
+	end := pos
+	for end < len(data) && data[end] != 0 {
+		end++
+	}
+	user := string(data[pos:end])
+	pos = end + 1
+	var response []byte
+	if pos < len(data) {
+		n := int(data[pos])
+		if pos+1+n <= len(data) {
+			response = data[pos+1 : pos+1+n]
+		}
+	}
+	if user != conf.User || string(response) != string(scramblePassword(c.scramble, conf.Password)) {
+		return &sqlError{code: 1045, state: "28000", message: fmt.Sprintf("Access denied for user '%s'", user)}
+	}
+	return nil
+}
+
+// mysql_native_password: SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+func scramblePassword(scramble []byte, password string) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stage2[:])
+	result := h.Sum(nil)
+	for i := range result {
+		result[i] ^= stage1[i]
+	}
+	return result
+}
+
+// 字段定义
+func columnDefinition(name string) []byte {
+	data := make([]byte, 0, 32+len(name))
+	data = append(data, lengthEncodedString("def")...)
+	for i := 0; i < 3; i++ {
+		data = append(data, 0) // schema, table, org_table
+	}
+	data = append(data, lengthEncodedString(name)...)
+	data = append(data, lengthEncodedString(name)...)
+	data = append(data, 0x0c)
+	data = append(data, uint16Bytes(CHARSET_UTF8)...)
+	data = append(data, uint32Bytes(1024)...)
+	data = append(data, fieldTypeVarString)
+	data = append(data, 0, 0, 0, 0, 0)
+	return data
+}
+
+// 文本协议结果集(COM_QUERY)，result 为 nil 时返回 OK
+func (c *conn) writeTextResult(result *resultSet) error {
+	if result == nil {
+		return c.writeOK()
+	}
+	if err := c.writeColumns(result.columns); err != nil {
+		return err
+	}
+	for _, row := range result.rows {
+		data := make([]byte, 0, 64)
+		for _, value := range row {
+			if value == nil {
+				data = append(data, 0xfb)
+			} else {
+				data = append(data, lengthEncodedString(toString(value))...)
+			}
+		}
+		if err := c.writePacket(data); err != nil {
+			return err
+		}
+	}
+	return c.writeEOF()
+}
+
+// 二进制协议结果集(COM_STMT_EXECUTE)
+func (c *conn) writeBinaryResult(result *resultSet) error {
+	if result == nil {
+		return c.writeOK()
+	}
+	if err := c.writeColumns(result.columns); err != nil {
+		return err
+	}
+	for _, row := range result.rows {
+		// null bitmap 偏移 2 位
+		nullBitmap := make([]byte, (len(row)+7+2)/8)
+		values := make([]byte, 0, 64)
+		for i, value := range row {
+			if value == nil {
+				nullBitmap[(i+2)/8] |= 1 << uint((i+2)%8)
+				continue
+			}
+			values = append(values, lengthEncodedString(toString(value))...)
+		}
+		data := append([]byte{0}, nullBitmap...)
+		if err := c.writePacket(append(data, values...)); err != nil {
+			return err
+		}
+	}
+	return c.writeEOF()
+}
+
+func (c *conn) writeColumns(columns []string) error {
+	if err := c.writePacket(lengthEncodedInt(uint64(len(columns)))); err != nil {
+		return err
+	}
+	for _, name := range columns {
+		if err := c.writePacket(columnDefinition(name)); err != nil {
+			return err
+		}
+	}
+	return c.writeEOF()
+}
+
+func lengthEncodedInt(n uint64) []byte {
+	switch {
+	case n < 251:
+		return []byte{byte(n)}
+	case n < 1<<16:
+		return []byte{0xfc, byte(n), byte(n >> 8)}
+	case n < 1<<24:
+		return []byte{0xfd, byte(n), byte(n >> 8), byte(n >> 16)}
+	}
+	return append([]byte{0xfe}, uint64Bytes(n)...)
+}
+
+func lengthEncodedString(s string) []byte {
+	return append(lengthEncodedInt(uint64(len(s))), s...)
+}
+
+// 读取 length encoded string，返回字符串和占用的字节数
+func readLengthEncodedString(data []byte) (string, int, error) {
+	if len(data) == 0 {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+	var n uint64
+	pos := 1
+	switch data[0] {
+	case 0xfc:
+		if len(data) < 3 {
+			return "", 0, io.ErrUnexpectedEOF
+		}
+		n, pos = uint64(binary.LittleEndian.Uint16(data[1:])), 3
+	case 0xfd:
+		if len(data) < 4 {
+			return "", 0, io.ErrUnexpectedEOF
+		}
+		n, pos = uint64(data[1])|uint64(data[2])<<8|uint64(data[3])<<16, 4
+	case 0xfe:
+		if len(data) < 9 {
+			return "", 0, io.ErrUnexpectedEOF
+		}
+		n, pos = binary.LittleEndian.Uint64(data[1:]), 9
+	default:
+		n = uint64(data[0])
+	}
+	if uint64(len(data)-pos) < n {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+	return string(data[pos : pos+int(n)]), pos + int(n), nil
+}
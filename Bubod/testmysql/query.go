@@ -0,0 +1,300 @@
+package testmysql
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bubod/Bubod/mysql"
+)
+
+var (
+	setHeartbeatPattern  = regexp.MustCompile(`(?i)@master_heartbeat_period\s*=\s*(\d+)`)
+	killPattern          = regexp.MustCompile(`(?i)^KILL\s+(?:CONNECTION\s+|QUERY\s+)?(\d+)$`)
+	selectVarPattern     = regexp.MustCompile(`(?i)^SELECT\s+@@(?:GLOBAL\.|SESSION\.)?(\w+)$`)
+	showVarsPattern      = regexp.MustCompile(`(?i)^SHOW\s+(?:GLOBAL\s+|SESSION\s+)?VARIABLES(?:\s+LIKE\s+'([^']*)')?$`)
+	showDatabasesPattern = regexp.MustCompile(`(?i)^SHOW\s+DATABASES(?:\s+LIKE\s+'([^']*)')?$`)
+	selectAllPattern     = regexp.MustCompile("(?i)^SELECT\\s+\\*\\s+FROM\\s+`?(\\w+)`?\\.`?(\\w+)`?$")
+	selectListPattern    = regexp.MustCompile(`(?is)^SELECT\s+(.+?)\s+FROM\s+information_schema\.columns(?:\s+WHERE\s+(.+?))?(?:\s+ORDER\s+BY\s+.+)?$`)
+	andPattern           = regexp.MustCompile(`(?i)\s+AND\s+`)
+	conditionPattern     = regexp.MustCompile(`(?is)^(\w+)\s*(=|NOT\s+IN|IN)\s*\(?(.+?)\)?$`)
+)
+
+// 执行查询，args 为预处理语句的参数，返回 nil 结果为 OK
+func (c *conn) query(query string, args []interface{}) (*resultSet, error) {
+	server := c.server
+	query = normalizeQuery(query)
+	upper := strings.ToUpper(query)
+	switch {
+	case strings.HasPrefix(upper, "SET "):
+		if m := setHeartbeatPattern.FindStringSubmatch(query); m != nil {
+			period, _ := strconv.ParseInt(m[1], 10, 64)
+			c.heartbeat = time.Duration(period)
+		}
+		return nil, nil
+	case upper == "BEGIN" || upper == "COMMIT" || upper == "ROLLBACK" || strings.HasPrefix(upper, "USE "):
+		return nil, nil
+	case killPattern.MatchString(query):
+		id, _ := strconv.ParseUint(killPattern.FindStringSubmatch(query)[1], 10, 32)
+		if !server.kill(uint32(id)) {
+			return nil, newError(1094, "Unknown thread id: %d", id)
+		}
+		return nil, nil
+	case upper == "SELECT CONNECTION_ID()":
+		return &resultSet{columns: []string{"connection_id()"}, rows: [][]interface{}{{c.id}}}, nil
+	case selectVarPattern.MatchString(query):
+		name := strings.ToLower(selectVarPattern.FindStringSubmatch(query)[1])
+		value, ok := server.variables()[name]
+		if !ok {
+			return nil, newError(1193, "Unknown system variable '%s'", name)
+		}
+		return &resultSet{columns: []string{query[len("SELECT "):]}, rows: [][]interface{}{{value}}}, nil
+	case showVarsPattern.MatchString(query):
+		pattern := showVarsPattern.FindStringSubmatch(query)[1]
+		result := &resultSet{columns: []string{"Variable_name", "Value"}}
+		vars := server.variables()
+		for _, name := range sortedKeys(vars) {
+			if pattern == "" || likeMatch(pattern, name) {
+				result.rows = append(result.rows, []interface{}{name, vars[name]})
+			}
+		}
+		return result, nil
+	case showDatabasesPattern.MatchString(query):
+		return server.showDatabases(showDatabasesPattern.FindStringSubmatch(query)[1]), nil
+	case upper == "SHOW MASTER STATUS":
+		file, position := server.Position()
+		return &resultSet{
+			columns: []string{"File", "Position", "Binlog_Do_DB", "Binlog_Ignore_DB", "Executed_Gtid_Set"},
+			rows:    [][]interface{}{{file, position, "", "", ""}},
+		}, nil
+	case upper == "SHOW BINARY LOGS" || upper == "SHOW MASTER LOGS":
+		result := &resultSet{columns: []string{"Log_name", "File_size"}}
+		server.mu.Lock()
+		for _, file := range server.files {
+			result.rows = append(result.rows, []interface{}{file.name, file.size()})
+		}
+		server.mu.Unlock()
+		return result, nil
+	case strings.HasPrefix(upper, "SHOW GRANTS"):
+		user := server.conf.User
+		if user == "" {
+			user = DEFAULT_USER
+		}
+		return &resultSet{
+			columns: []string{"Grants for " + user + "@%"},
+			rows:    [][]interface{}{{"GRANT ALL PRIVILEGES ON *.* TO '" + user + "'@'%'"}},
+		}, nil
+	case selectAllPattern.MatchString(query):
+		m := selectAllPattern.FindStringSubmatch(query)
+		return server.selectAll(m[1], m[2])
+	case selectListPattern.MatchString(query):
+		m := selectListPattern.FindStringSubmatch(query)
+		return server.selectColumns(m[1], m[2], args)
+	}
+	return nil, newError(1064, "testmysql: unsupported query %q", query)
+}
+
+// 系统变量，名称为小写
+func (server *Server) variables() map[string]string {
+	conf := server.conf
+	checksum := "NONE"
+	if conf.Checksum {
+		checksum = "CRC32"
+	}
+	return map[string]string{
+		"version":                conf.Version,
+		"version_comment":        "testmysql",
+		"server_id":              strconv.FormatUint(uint64(conf.ServerId), 10),
+		"server_uuid":            conf.ServerUUID,
+		"log_bin":                "1",
+		"binlog_format":          "ROW",
+		"binlog_row_image":       "FULL",
+		"binlog_checksum":        checksum,
+		"gtid_mode":              "OFF",
+		"log_slave_updates":      "1",
+		"read_only":              "0",
+		"wait_timeout":           "28800",
+		"net_write_timeout":      "60",
+		"max_allowed_packet":     "67108864",
+		"character_set_server":   "utf8mb4",
+		"lower_case_table_names": "0",
+		"expire_logs_days":       "0",
+	}
+}
+
+// SHOW DATABASES，库为配置的表所在的库
+func (server *Server) showDatabases(pattern string) *resultSet {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	databases := make(map[string]string)
+	for _, t := range server.tables {
+		if pattern == "" || likeMatch(pattern, t.database) {
+			databases[t.database] = t.database
+		}
+	}
+	result := &resultSet{columns: []string{"Database"}}
+	for _, database := range sortedKeys(databases) {
+		result.rows = append(result.rows, []interface{}{database})
+	}
+	return result
+}
+
+// SELECT * FROM db.table
+func (server *Server) selectAll(database, tableName string) (*resultSet, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	t, ok := server.tables[database+"."+tableName]
+	if !ok {
+		return nil, &sqlError{code: 1146, state: "42S02", message: fmt.Sprintf("Table '%s.%s' doesn't exist", database, tableName)}
+	}
+	result := &resultSet{}
+	for _, column := range t.columns {
+		result.columns = append(result.columns, column.Name)
+	}
+	for _, row := range t.rows {
+		result.rows = append(result.rows, append([]interface{}(nil), row...))
+	}
+	return result, nil
+}
+
+// SELECT ... FROM information_schema.columns [WHERE cond [AND cond]]
+// 条件只支持 field = v、field IN (v, ...)、field NOT IN (v, ...)，v 为 ? 或 '字符串'
+func (server *Server) selectColumns(selectList string, where string, args []interface{}) (*resultSet, error) {
+	result := &resultSet{}
+	for _, field := range strings.Split(selectList, ",") {
+		result.columns = append(result.columns, strings.ToUpper(strings.Trim(strings.TrimSpace(field), "`")))
+	}
+
+	type condition struct {
+		field  string
+		not    bool
+		values map[string]bool
+	}
+	conditions := make([]*condition, 0)
+	if where != "" {
+		for _, expr := range andPattern.Split(where, -1) {
+			m := conditionPattern.FindStringSubmatch(strings.TrimSpace(expr))
+			if m == nil {
+				return nil, newError(1064, "testmysql: unsupported condition %q", expr)
+			}
+			cond := &condition{field: strings.ToUpper(m[1]), not: strings.HasPrefix(strings.ToUpper(m[2]), "NOT"), values: make(map[string]bool)}
+			for _, v := range strings.Split(m[3], ",") {
+				v = strings.TrimSpace(v)
+				if v == "?" {
+					if len(args) == 0 {
+						return nil, newError(1210, "Incorrect arguments to mysqld_stmt_execute")
+					}
+					v, args = toString(args[0]), args[1:]
+				} else {
+					v = strings.Trim(v, "'\"")
+				}
+				cond.values[v] = true
+			}
+			conditions = append(conditions, cond)
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, t := range server.sortedTables() {
+		for i, column := range t.columns {
+			fields := columnFields(t, i, column)
+			match := true
+			for _, cond := range conditions {
+				value, ok := fields[cond.field]
+				if !ok {
+					return nil, &sqlError{code: 1054, state: "42S22", message: fmt.Sprintf("Unknown column '%s'", cond.field)}
+				}
+				if cond.values[toString(value)] == cond.not {
+					match = false
+				}
+			}
+			if !match {
+				continue
+			}
+			row := make([]interface{}, len(result.columns))
+			for k, name := range result.columns {
+				value, ok := fields[name]
+				if !ok {
+					return nil, &sqlError{code: 1054, state: "42S22", message: fmt.Sprintf("Unknown column '%s'", name)}
+				}
+				row[k] = value
+			}
+			result.rows = append(result.rows, row)
+		}
+	}
+	return result, nil
+}
+
+// information_schema.columns 中一个字段的信息
+func columnFields(t *table, i int, column Column) map[string]interface{} {
+	ct := t.types[i]
+	fields := map[string]interface{}{
+		"TABLE_CATALOG":      "def",
+		"TABLE_SCHEMA":       t.database,
+		"TABLE_NAME":         t.name,
+		"COLUMN_NAME":        column.Name,
+		"ORDINAL_POSITION":   i + 1,
+		"COLUMN_KEY":         "",
+		"COLUMN_TYPE":        ct.columnType(column.Type),
+		"DATA_TYPE":          strings.SplitN(strings.ToLower(strings.TrimSpace(column.Type)), "(", 2)[0],
+		"IS_NULLABLE":        "YES",
+		"CHARACTER_SET_NAME": nil,
+		"COLLATION_NAME":     nil,
+		"NUMERIC_SCALE":      nil,
+		"EXTRA":              "",
+		"COLUMN_DEFAULT":     nil,
+		"DATETIME_PRECISION": nil,
+	}
+	if column.Default != nil {
+		fields["COLUMN_DEFAULT"] = *column.Default
+	}
+	if ct.fieldType == mysql.FIELD_TYPE_DATETIME2 {
+		fields["DATETIME_PRECISION"] = 0
+	}
+	if column.Primary {
+		fields["COLUMN_KEY"], fields["IS_NULLABLE"] = "PRI", "NO"
+	}
+	if ct.isString() {
+		fields["CHARACTER_SET_NAME"], fields["COLLATION_NAME"] = "utf8mb4", "utf8mb4_general_ci"
+	}
+	if ct.isInteger() {
+		fields["NUMERIC_SCALE"] = 0
+	}
+	return fields
+}
+
+// LIKE 匹配，% 为任意个字符，_ 为一个字符，\ 转义，不区分大小写
+func likeMatch(pattern string, s string) bool {
+	expr := ""
+	escaped := false
+	for _, r := range strings.ToLower(pattern) {
+		switch {
+		case escaped:
+			expr += regexp.QuoteMeta(string(r))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			expr += ".*"
+		case r == '_':
+			expr += "."
+		default:
+			expr += regexp.QuoteMeta(string(r))
+		}
+	}
+	matched, _ := regexp.MatchString("^"+expr+"$", strings.ToLower(s))
+	return matched
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,445 @@
+// 模拟 MySQL master 的测试服务
+// 通过 MySQL 协议提供合成的 binlog 流(可配置表、行数、DDL 注入、校验和开关)，以及 bubod 同步时用到的查询
+// (系统变量、SHOW MASTER STATUS、SHOW BINARY LOGS、information_schema.columns 等)，
+// 用于在没有真实 MySQL 的环境中为回调和输出编写集成测试:
+//
+//	server, _ := testmysql.NewServer(testmysql.Config{
+//		Checksum: true,
+//		Tables: []*testmysql.Table{{
+//			Database: "db", Name: "t", Rows: 100,
+//			Columns: []testmysql.Column{{Name: "id", Type: "int", Primary: true}, {Name: "name", Type: "varchar(32)"}},
+//		}},
+//	})
+//	server.Listen("127.0.0.1:0")
+//	defer server.Close()
+//	dump := &mysql.BinlogDump{DataSource: server.DataSource("db"), OnlyEvent: events, CallbackFun: callback}
+//	go dump.StartDumpBinlog(testmysql.DEFAULT_BINLOG_FILE, 4, 2, result, "", 0)
+//	server.Insert("db", "t", []interface{}{101, "a"})
+//
+// binlog 只保存在内存中，不生成 GTID 事件；information_schema 返回当前的表结构，与真实 master 一致。
+package testmysql
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bubod/Bubod/mysql"
+)
+
+const (
+	DEFAULT_VERSION     = "5.7.30-log"
+	DEFAULT_BINLOG_FILE = "mysql-bin.000001"
+	DEFAULT_USER        = "root"
+)
+
+// 注入的 DDL
+type DDL struct {
+	After    int    // 生成第 After 行之后执行，0 为生成数据之前
+	Database string // 执行 DDL 时的默认库
+	Query    string // 为空时不写入 binlog，模拟 sql_log_bin=0 执行的 DDL
+	Table    *Table // 执行后的表结构，建表、改表时设置；为 nil 时表结构不变(DROP TABLE 删除表)
+}
+
+type Config struct {
+	Version    string // 服务端版本，默认 DEFAULT_VERSION
+	ServerId   uint32 // 默认 1
+	ServerUUID string
+	User       string // 为空时不校验用户名和密码
+	Password   string
+	Checksum   bool   // binlog_checksum=CRC32，否则为 NONE
+	BinlogFile string // 第一个 binlog 文件，默认 DEFAULT_BINLOG_FILE
+	Tables     []*Table
+	DDLs       []*DDL
+}
+
+type Server struct {
+	conf Config
+
+	mu          sync.Mutex
+	files       []*binlogFile
+	tables      map[string]*table // db.table
+	nextTableId uint64
+	xid         uint64
+	notify      chan struct{} // 写入新事件时关闭，唤醒 dump 连接
+
+	listener   net.Listener
+	conns      map[uint32]*conn
+	nextConnId uint32
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// 创建服务并生成配置的数据，Listen 之后才能连接
+func NewServer(conf Config) (*Server, error) {
+	if conf.Version == "" {
+		conf.Version = DEFAULT_VERSION
+	}
+	if conf.ServerId == 0 {
+		conf.ServerId = 1
+	}
+	if conf.ServerUUID == "" {
+		conf.ServerUUID = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	}
+	if conf.BinlogFile == "" {
+		conf.BinlogFile = DEFAULT_BINLOG_FILE
+	}
+	server := &Server{
+		conf:        conf,
+		tables:      make(map[string]*table),
+		nextTableId: 100,
+		notify:      make(chan struct{}),
+		conns:       make(map[uint32]*conn),
+	}
+	server.newFile(conf.BinlogFile)
+	for _, def := range conf.Tables {
+		if err := server.createTable(def); err != nil {
+			return nil, err
+		}
+	}
+	if err := server.generate(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// 按表轮流生成 insert，每生成一行检查需要注入的 DDL
+func (server *Server) generate() error {
+	ddls := append([]*DDL(nil), server.conf.DDLs...)
+	sort.SliceStable(ddls, func(i, j int) bool { return ddls[i].After < ddls[j].After })
+	n := 0
+	inject := func(all bool) error {
+		for len(ddls) > 0 && (all || ddls[0].After <= n) {
+			if err := server.execDDL(ddls[0]); err != nil {
+				return err
+			}
+			ddls = ddls[1:]
+		}
+		return nil
+	}
+	if err := inject(false); err != nil {
+		return err
+	}
+	rows := 0
+	for _, def := range server.conf.Tables {
+		if def.Rows > rows {
+			rows = def.Rows
+		}
+	}
+	for i := 1; i <= rows; i++ {
+		for _, def := range server.conf.Tables {
+			t := server.tables[def.Database+"."+def.Name]
+			if i > def.Rows || t == nil {
+				continue
+			}
+			if err := server.writeRows(mysql.WRITE_ROWS_EVENTv2, t, [][]interface{}{t.syntheticRow(i)}); err != nil {
+				return err
+			}
+			n++
+			if err := inject(false); err != nil {
+				return err
+			}
+		}
+	}
+	return inject(true)
+}
+
+// 开始监听，addr 为 127.0.0.1:0 时使用随机端口
+func (server *Server) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server.mu.Lock()
+	server.listener = listener
+	server.mu.Unlock()
+	server.wg.Add(1)
+	go server.serve(listener)
+	return nil
+}
+
+func (server *Server) serve(listener net.Listener) {
+	defer server.wg.Done()
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		server.mu.Lock()
+		if server.closed {
+			server.mu.Unlock()
+			netConn.Close()
+			return
+		}
+		server.nextConnId++
+		c := newConn(server, server.nextConnId, netConn)
+		server.conns[c.id] = c
+		server.mu.Unlock()
+
+		server.wg.Add(1)
+		go func() {
+			defer server.wg.Done()
+			c.serve()
+			server.mu.Lock()
+			delete(server.conns, c.id)
+			server.mu.Unlock()
+		}()
+	}
+}
+
+// 监听地址
+func (server *Server) Addr() string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.listener == nil {
+		return ""
+	}
+	return server.listener.Addr().String()
+}
+
+// 连接服务的 DSN
+func (server *Server) DataSource(dbname string) string {
+	user := server.conf.User
+	if user == "" {
+		user = DEFAULT_USER
+	}
+	if server.conf.Password != "" {
+		user += ":" + server.conf.Password
+	}
+	return fmt.Sprintf("%s@tcp(%s)/%s", user, server.Addr(), dbname)
+}
+
+// 关闭监听和所有连接
+func (server *Server) Close() error {
+	server.mu.Lock()
+	if server.closed {
+		server.mu.Unlock()
+		return nil
+	}
+	server.closed = true
+	var err error
+	if server.listener != nil {
+		err = server.listener.Close()
+	}
+	for _, c := range server.conns {
+		c.netConn.Close()
+	}
+	close(server.notify)
+	server.mu.Unlock()
+	server.wg.Wait()
+	return err
+}
+
+// 关闭连接，用于 KILL
+func (server *Server) kill(id uint32) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	c, ok := server.conns[id]
+	if ok {
+		c.netConn.Close()
+	}
+	return ok
+}
+
+// 当前 binlog 位点
+func (server *Server) Position() (string, uint32) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	file := server.files[len(server.files)-1]
+	return file.name, file.size()
+}
+
+// 写入一个 insert 事务，每行为表字段的值，nil 为 NULL
+func (server *Server) Insert(database, tableName string, rows ...[]interface{}) error {
+	return server.change(mysql.WRITE_ROWS_EVENTv2, database, tableName, rows)
+}
+
+// 写入一个 update 事务，rows 按 变更前、变更后 成对传入
+func (server *Server) Update(database, tableName string, rows ...[]interface{}) error {
+	if len(rows)%2 != 0 {
+		return fmt.Errorf("testmysql: update rows must be before/after pairs")
+	}
+	return server.change(mysql.UPDATE_ROWS_EVENTv2, database, tableName, rows)
+}
+
+// 写入一个 delete 事务
+func (server *Server) Delete(database, tableName string, rows ...[]interface{}) error {
+	return server.change(mysql.DELETE_ROWS_EVENTv2, database, tableName, rows)
+}
+
+func (server *Server) change(eventType mysql.EventType, database, tableName string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	t, ok := server.tables[database+"."+tableName]
+	if !ok {
+		return fmt.Errorf("testmysql: table %s.%s doesn't exist", database, tableName)
+	}
+	return server.writeRows(eventType, t, rows)
+}
+
+// 执行 DDL
+func (server *Server) Exec(ddl *DDL) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.execDDL(ddl)
+}
+
+// 修改表的 table_id，模拟 tableId 被重新分配(表定义缓存淘汰后分配给其他表，或经过中转的上游)，
+// 之后写入的行变更使用新的 table_id
+func (server *Server) SetTableId(database, tableName string, tableId uint64) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	t, ok := server.tables[database+"."+tableName]
+	if !ok {
+		return fmt.Errorf("testmysql: table %s.%s doesn't exist", database, tableName)
+	}
+	t.tableId = tableId
+	return nil
+}
+
+// 切换到新的 binlog 文件，返回新文件名
+func (server *Server) Rotate() string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	last := server.files[len(server.files)-1]
+	name := nextBinlogName(last.name)
+	server.appendEvent(mysql.ROTATE_EVENT, rotateBody(name, 4))
+	server.newFile(name)
+	server.wake()
+	return name
+}
+
+// mysql-bin.000001 => mysql-bin.000002
+func nextBinlogName(name string) string {
+	i := strings.LastIndex(name, ".")
+	seq, err := strconv.Atoi(name[i+1:])
+	if i < 0 || err != nil {
+		return name + ".000001"
+	}
+	return fmt.Sprintf("%s.%0*d", name[:i], len(name)-i-1, seq+1)
+}
+
+func (server *Server) newFile(name string) {
+	file := &binlogFile{name: name, data: []byte(BINLOG_MAGIC)}
+	server.files = append(server.files, file)
+	server.appendEvent(mysql.FORMAT_DESCRIPTION_EVENT, formatDescriptionBody(server.conf.Version, eventTimestamp(), server.conf.Checksum))
+}
+
+// 追加事件到当前文件，调用方持有锁
+func (server *Server) appendEvent(eventType mysql.EventType, body []byte) {
+	file := server.files[len(server.files)-1]
+	size := uint32(EVENT_HEADER_SIZE + len(body))
+	if server.conf.Checksum {
+		size += 4
+	}
+	event := encodeEvent(eventType, server.conf.ServerId, eventTimestamp(), file.size()+size, 0, body, server.conf.Checksum)
+	file.data = append(file.data, event...)
+}
+
+// 唤醒等待新事件的 dump 连接
+func (server *Server) wake() {
+	if server.closed {
+		return
+	}
+	close(server.notify)
+	server.notify = make(chan struct{})
+}
+
+// 写入行变更事务: BEGIN、TABLE_MAP、ROWS、XID，并更新表数据
+func (server *Server) writeRows(eventType mysql.EventType, t *table, rows [][]interface{}) error {
+	encoded := make([][]byte, len(rows))
+	for i, row := range rows {
+		b, err := t.encodeRow(row)
+		if err != nil {
+			return err
+		}
+		encoded[i] = b
+	}
+	server.xid++
+	server.appendEvent(mysql.QUERY_EVENT, queryBody(t.database, "BEGIN"))
+	server.appendEvent(mysql.TABLE_MAP_EVENT, tableMapBody(t))
+	server.appendEvent(eventType, rowsBody(eventType, t, encoded))
+	server.appendEvent(mysql.XID_EVENT, xidBody(server.xid))
+
+	switch eventType {
+	case mysql.WRITE_ROWS_EVENTv2:
+		for _, row := range rows {
+			t.rows = append(t.rows, append([]interface{}(nil), row...))
+		}
+	case mysql.UPDATE_ROWS_EVENTv2:
+		for i := 0; i+1 < len(rows); i += 2 {
+			if k := t.findRow(rows[i]); k >= 0 {
+				t.rows[k] = append([]interface{}(nil), rows[i+1]...)
+			}
+		}
+	case mysql.DELETE_ROWS_EVENTv2:
+		for _, row := range rows {
+			if k := t.findRow(row); k >= 0 {
+				t.rows = append(t.rows[:k], t.rows[k+1:]...)
+			}
+		}
+	}
+	server.wake()
+	return nil
+}
+
+// 写入 DDL 并更新表结构
+func (server *Server) execDDL(ddl *DDL) error {
+	if ddl.Table != nil {
+		name := ddl.Table.Database + "." + ddl.Table.Name
+		if t, ok := server.tables[name]; ok {
+			if err := t.setColumns(ddl.Table.Columns); err != nil {
+				return err
+			}
+			// 表结构变化后 table_id 随之变化
+			t.tableId = server.nextTableId
+			server.nextTableId++
+		} else if err := server.createTable(ddl.Table); err != nil {
+			return err
+		}
+	} else if parsed := mysql.ParseDDL(ddl.Query, ddl.Database); parsed != nil {
+		switch parsed.Operation {
+		case mysql.DDL_DROP_TABLE:
+			for _, table := range parsed.DropTables() {
+				delete(server.tables, table.SchemaName+"."+table.TableName)
+			}
+		case mysql.DDL_DROP_DATABASE:
+			for name, t := range server.tables {
+				if t.database == parsed.SchemaName {
+					delete(server.tables, name)
+				}
+			}
+		}
+	}
+	if ddl.Query != "" {
+		server.appendEvent(mysql.QUERY_EVENT, queryBody(ddl.Database, ddl.Query))
+		server.wake()
+	}
+	return nil
+}
+
+func (server *Server) createTable(def *Table) error {
+	t, err := newTable(def, server.nextTableId)
+	if err != nil {
+		return err
+	}
+	server.nextTableId++
+	server.tables[t.fullName()] = t
+	return nil
+}
+
+// 按库名、表名排序的表
+func (server *Server) sortedTables() []*table {
+	tables := make([]*table, 0, len(server.tables))
+	for _, t := range server.tables {
+		tables = append(tables, t)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].fullName() < tables[j].fullName() })
+	return tables
+}
@@ -0,0 +1,179 @@
+package testmysql_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"bubod/Bubod/mysql"
+	"bubod/Bubod/testmysql"
+)
+
+// 回调中复制出的事件，回调返回后事件会被回收
+type event struct {
+	eventType mysql.EventType
+	table     string
+	rows      string
+	query     string
+}
+
+func (e event) String() string {
+	if e.query != "" {
+		return fmt.Sprintf("%s %s", e.eventType, e.query)
+	}
+	return fmt.Sprintf("%s %s %s", e.eventType, e.table, e.rows)
+}
+
+var testColumns = []testmysql.Column{
+	{Name: "id", Type: "int", Primary: true},
+	{Name: "name", Type: "varchar(32)"},
+}
+
+func startServer(t *testing.T, conf testmysql.Config) *testmysql.Server {
+	server, err := testmysql.NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+	})
+	return server
+}
+
+// 从 testmysql 同步 db 库，返回回调收到的事件
+func startDump(t *testing.T, server *testmysql.Server, pipelineDepth int) <-chan event {
+	events := make(chan event, 64)
+	dump := &mysql.BinlogDump{
+		DataSource:    server.DataSource("db"),
+		ReplicateDoDb: map[string]uint8{"db": 1},
+		OnlyEvent: []mysql.EventType{
+			mysql.QUERY_EVENT,
+			mysql.WRITE_ROWS_EVENTv2, mysql.UPDATE_ROWS_EVENTv2, mysql.DELETE_ROWS_EVENTv2,
+		},
+		CallbackFun: func(e *mysql.EventReslut) {
+			ev := event{eventType: e.Header.EventType, table: e.SchemaName + "." + e.TableName}
+			if e.Header.EventType == mysql.QUERY_EVENT {
+				// 只比较 DDL，跳过事务的 BEGIN
+				if e.DDL == nil {
+					return
+				}
+				ev.query = e.Query
+			} else {
+				ev.rows = fmt.Sprint(e.Rows)
+			}
+			events <- ev
+		},
+		PipelineDepth: pipelineDepth,
+	}
+	result := make(chan error, 16)
+	go dump.StartDumpBinlog(testmysql.DEFAULT_BINLOG_FILE, 4, 2, result, "", 0)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case err := <-result:
+				// starting、running 是状态通知
+				if msg := err.Error(); msg != "starting" && msg != "running" {
+					t.Errorf("dump: %s", msg)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+		dump.Close()
+	})
+	return events
+}
+
+func expectEvents(t *testing.T, events <-chan event, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case ev := <-events:
+			if got := ev.String(); got != w {
+				t.Fatalf("got event %q, want %q", got, w)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for event %q", w)
+		}
+	}
+}
+
+func TestBinlogDump(t *testing.T) {
+	for _, checksum := range []bool{false, true} {
+		for _, depth := range []int{0, 16} {
+			t.Run(fmt.Sprintf("checksum=%v/pipeline=%d", checksum, depth), func(t *testing.T) {
+				testBinlogDump(t, checksum, depth)
+			})
+		}
+	}
+}
+
+func testBinlogDump(t *testing.T, checksum bool, pipelineDepth int) {
+	alter := "ALTER TABLE t ADD COLUMN score bigint"
+	server := startServer(t, testmysql.Config{
+		Checksum: checksum,
+		Tables:   []*testmysql.Table{{Database: "db", Name: "t", Rows: 2, Columns: testColumns}},
+	})
+	events := startDump(t, server, pipelineDepth)
+
+	// 生成的数据
+	expectEvents(t, events,
+		"WRITE_ROWS_EVENTv2 db.t [map[id:1 name:name-1]]",
+		"WRITE_ROWS_EVENTv2 db.t [map[id:2 name:name-2]]",
+	)
+
+	if err := server.Insert("db", "t", []interface{}{3, "c"}, []interface{}{4, "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Update("db", "t", []interface{}{3, "c"}, []interface{}{3, "cc"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Delete("db", "t", []interface{}{4, "d"}); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events,
+		"WRITE_ROWS_EVENTv2 db.t [map[id:3 name:c] map[id:4 name:d]]",
+		"UPDATE_ROWS_EVENTv2 db.t [map[id:3 name:c] map[id:3 name:cc]]",
+		"DELETE_ROWS_EVENTv2 db.t [map[id:4 name:d]]",
+	)
+
+	// DDL 之后的行按新的表结构解码
+	err := server.Exec(&testmysql.DDL{
+		Database: "db",
+		Query:    alter,
+		Table: &testmysql.Table{
+			Database: "db", Name: "t",
+			Columns: append(append([]testmysql.Column(nil), testColumns...), testmysql.Column{Name: "score", Type: "bigint"}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Insert("db", "t", []interface{}{5, "e", 50}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Update("db", "t", []interface{}{3, "cc", nil}, []interface{}{3, "cc", 30}); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events,
+		"QUERY_EVENT "+alter,
+		"WRITE_ROWS_EVENTv2 db.t [map[id:5 name:e score:50]]",
+		"UPDATE_ROWS_EVENTv2 db.t [map[id:3 name:cc score:<nil>] map[id:3 name:cc score:30]]",
+	)
+
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %q", ev.String())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
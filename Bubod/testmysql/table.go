@@ -0,0 +1,356 @@
+package testmysql
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"bubod/Bubod/mysql"
+)
+
+const DATETIME_FORMAT = "2006-01-02 15:04:05"
+
+// 生成数据中 datetime 字段的起始时间
+var syntheticTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// 表字段
+type Column struct {
+	Name    string
+	Type    string // tinyint/smallint/int/bigint[ unsigned]、double、varchar(N)、text、datetime
+	Primary bool
+	Default *string // 默认值，为 nil 时 information_schema 中为 NULL
+}
+
+// 表定义
+type Table struct {
+	Database string
+	Name     string
+	Columns  []Column
+	Rows     int // 启动时生成的 insert 行数，每行一个事务
+}
+
+// 字段在 binlog 中的类型
+type columnType struct {
+	fieldType mysql.FieldType
+	meta      []byte
+	unsigned  bool
+	size      int // 整数的字节数、varchar 的最大字符数
+}
+
+func parseColumnType(t string) (*columnType, error) {
+	t = strings.ToLower(strings.TrimSpace(t))
+	ct := &columnType{}
+	if strings.HasSuffix(t, " unsigned") {
+		ct.unsigned = true
+		t = strings.TrimSpace(strings.TrimSuffix(t, " unsigned"))
+	}
+	name, length := t, 0
+	if i := strings.Index(t, "("); i > 0 && strings.HasSuffix(t, ")") {
+		n, err := strconv.Atoi(t[i+1 : len(t)-1])
+		if err != nil {
+			return nil, fmt.Errorf("testmysql: invalid column type %q", t)
+		}
+		name, length = t[:i], n
+	}
+	switch name {
+	case "tinyint":
+		ct.fieldType, ct.size = mysql.FIELD_TYPE_TINY, 1
+	case "smallint":
+		ct.fieldType, ct.size = mysql.FIELD_TYPE_SHORT, 2
+	case "int":
+		ct.fieldType, ct.size = mysql.FIELD_TYPE_LONG, 4
+	case "bigint":
+		ct.fieldType, ct.size = mysql.FIELD_TYPE_LONGLONG, 8
+	case "double":
+		ct.fieldType, ct.meta = mysql.FIELD_TYPE_DOUBLE, []byte{8}
+	case "varchar":
+		if length <= 0 {
+			return nil, fmt.Errorf("testmysql: varchar length required")
+		}
+		// utf8mb4，最大字节数超过 255 时行数据中用 2 字节保存长度
+		ct.fieldType, ct.size = mysql.FIELD_TYPE_VARCHAR, length
+		ct.meta = uint16Bytes(uint16(length * 4))
+	case "text":
+		ct.fieldType, ct.meta = mysql.FIELD_TYPE_BLOB, []byte{2}
+	case "datetime":
+		ct.fieldType, ct.meta = mysql.FIELD_TYPE_DATETIME2, []byte{0}
+	default:
+		return nil, fmt.Errorf("testmysql: unsupported column type %q", t)
+	}
+	if ct.unsigned && !ct.isInteger() {
+		return nil, fmt.Errorf("testmysql: unsupported column type %q", t)
+	}
+	return ct, nil
+}
+
+// information_schema 中的 COLUMN_TYPE，整数未指定显示宽度时补上默认宽度，如 int => int(11)
+func (ct *columnType) columnType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	if !ct.isInteger() || strings.Contains(t, "(") {
+		return t
+	}
+	width := map[mysql.FieldType][2]int{
+		mysql.FIELD_TYPE_TINY:     {4, 3},
+		mysql.FIELD_TYPE_SHORT:    {6, 5},
+		mysql.FIELD_TYPE_LONG:     {11, 10},
+		mysql.FIELD_TYPE_LONGLONG: {20, 20},
+	}[ct.fieldType]
+	name := strings.TrimSpace(strings.TrimSuffix(t, " unsigned"))
+	if ct.unsigned {
+		return fmt.Sprintf("%s(%d) unsigned", name, width[1])
+	}
+	return fmt.Sprintf("%s(%d)", name, width[0])
+}
+
+func (ct *columnType) isString() bool {
+	return ct.fieldType == mysql.FIELD_TYPE_VARCHAR || ct.fieldType == mysql.FIELD_TYPE_BLOB
+}
+
+func (ct *columnType) isInteger() bool {
+	switch ct.fieldType {
+	case mysql.FIELD_TYPE_TINY, mysql.FIELD_TYPE_SHORT, mysql.FIELD_TYPE_LONG, mysql.FIELD_TYPE_LONGLONG:
+		return true
+	}
+	return false
+}
+
+// 服务端的表，rows 为当前数据，用于 SELECT *
+type table struct {
+	database string
+	name     string
+	columns  []Column
+	types    []*columnType
+	tableId  uint64
+	rows     [][]interface{}
+}
+
+func newTable(def *Table, tableId uint64) (*table, error) {
+	if def.Database == "" || def.Name == "" || len(def.Columns) == 0 {
+		return nil, fmt.Errorf("testmysql: table database, name and columns are required")
+	}
+	t := &table{database: def.Database, name: def.Name, tableId: tableId}
+	return t, t.setColumns(def.Columns)
+}
+
+func (t *table) fullName() string {
+	return t.database + "." + t.name
+}
+
+// 设置表字段，已有数据按字段名保留，新增字段为 NULL
+func (t *table) setColumns(columns []Column) error {
+	types := make([]*columnType, len(columns))
+	for i, column := range columns {
+		ct, err := parseColumnType(column.Type)
+		if err != nil {
+			return err
+		}
+		types[i] = ct
+	}
+	for i, row := range t.rows {
+		values := make([]interface{}, len(columns))
+		for j, column := range columns {
+			for k, old := range t.columns {
+				if old.Name == column.Name {
+					values[j] = row[k]
+				}
+			}
+		}
+		t.rows[i] = values
+	}
+	t.columns = append([]Column(nil), columns...)
+	t.types = types
+	return nil
+}
+
+// 第 n 行生成的数据
+func (t *table) syntheticRow(n int) []interface{} {
+	values := make([]interface{}, len(t.columns))
+	for i, column := range t.columns {
+		ct := t.types[i]
+		switch {
+		case column.Primary && ct.isInteger():
+			values[i] = int64(n)
+		case ct.fieldType == mysql.FIELD_TYPE_TINY:
+			values[i] = int64(n % 100)
+		case ct.isInteger():
+			values[i] = int64(n) * 1000
+		case ct.fieldType == mysql.FIELD_TYPE_DOUBLE:
+			values[i] = float64(n) + 0.5
+		case ct.fieldType == mysql.FIELD_TYPE_DATETIME2:
+			values[i] = syntheticTime.Add(time.Duration(n) * time.Second)
+		default:
+			s := fmt.Sprintf("%s-%d", column.Name, n)
+			if ct.fieldType == mysql.FIELD_TYPE_VARCHAR && len(s) > ct.size {
+				s = s[len(s)-ct.size:]
+			}
+			values[i] = s
+		}
+	}
+	return values
+}
+
+// 按主键查找行，没有主键时比较所有字段，找不到时返回 -1
+func (t *table) findRow(values []interface{}) int {
+	primary := false
+	for _, column := range t.columns {
+		primary = primary || column.Primary
+	}
+	for k, row := range t.rows {
+		match := true
+		for i, column := range t.columns {
+			if (column.Primary || !primary) && i < len(values) && !equalValue(row[i], values[i]) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return k
+		}
+	}
+	return -1
+}
+
+func equalValue(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return toString(a) == toString(b)
+}
+
+// 按表字段编码一行数据: null bitmap + 非空字段值
+func (t *table) encodeRow(values []interface{}) ([]byte, error) {
+	if len(values) != len(t.columns) {
+		return nil, fmt.Errorf("testmysql: %s has %d columns, got %d values", t.fullName(), len(t.columns), len(values))
+	}
+	nullBitmap := make([]byte, (len(values)+7)/8)
+	data := make([]byte, 0, 64)
+	for i, value := range values {
+		if value == nil {
+			nullBitmap[i/8] |= 1 << uint(i%8)
+			continue
+		}
+		b, err := encodeValue(t.types[i], value)
+		if err != nil {
+			return nil, fmt.Errorf("testmysql: %s.%s %v", t.fullName(), t.columns[i].Name, err)
+		}
+		data = append(data, b...)
+	}
+	return append(nullBitmap, data...), nil
+}
+
+func encodeValue(ct *columnType, value interface{}) ([]byte, error) {
+	switch ct.fieldType {
+	case mysql.FIELD_TYPE_TINY, mysql.FIELD_TYPE_SHORT, mysql.FIELD_TYPE_LONG, mysql.FIELD_TYPE_LONGLONG:
+		n, err := toInt64(value)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, ct.size)
+		for i := range b {
+			b[i] = byte(uint64(n) >> uint(8*i))
+		}
+		return b, nil
+	case mysql.FIELD_TYPE_DOUBLE:
+		f, err := toFloat64(value)
+		if err != nil {
+			return nil, err
+		}
+		return uint64Bytes(math.Float64bits(f)), nil
+	case mysql.FIELD_TYPE_VARCHAR:
+		s := toString(value)
+		if ct.size*4 > 255 {
+			return append(uint16Bytes(uint16(len(s))), s...), nil
+		}
+		if len(s) > 255 {
+			return nil, fmt.Errorf("value too long")
+		}
+		return append([]byte{byte(len(s))}, s...), nil
+	case mysql.FIELD_TYPE_BLOB:
+		s := toString(value)
+		if len(s) > math.MaxUint16 {
+			return nil, fmt.Errorf("value too long")
+		}
+		return append(uint16Bytes(uint16(len(s))), s...), nil
+	case mysql.FIELD_TYPE_DATETIME2:
+		t, err := toTime(value)
+		if err != nil {
+			return nil, err
+		}
+		// 1 bit 符号 + 17 bit 年*13+月 + 5 bit 日 + 5 bit 时 + 6 bit 分 + 6 bit 秒，大端
+		v := uint64(1)<<39 | uint64(t.Year()*13+int(t.Month()))<<22 | uint64(t.Day())<<17 |
+			uint64(t.Hour())<<12 | uint64(t.Minute())<<6 | uint64(t.Second())
+		return []byte{byte(v >> 32), byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}, nil
+	}
+	return nil, fmt.Errorf("unsupported field type %d", ct.fieldType)
+}
+
+func toInt64(value interface{}) (int64, error) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint()), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return 1, nil
+		}
+		return 0, nil
+	case reflect.String:
+		return strconv.ParseInt(v.String(), 10, 64)
+	}
+	return 0, fmt.Errorf("invalid integer %v", value)
+}
+
+func toFloat64(value interface{}) (float64, error) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return strconv.ParseFloat(v.String(), 64)
+	}
+	n, err := toInt64(value)
+	return float64(n), err
+}
+
+func toTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return time.Parse(DATETIME_FORMAT, v)
+	}
+	return time.Time{}, fmt.Errorf("invalid datetime %v", value)
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(DATETIME_FORMAT)
+	}
+	return fmt.Sprint(value)
+}
+
+func uint16Bytes(v uint16) []byte {
+	return []byte{byte(v), byte(v >> 8)}
+}
+
+func uint32Bytes(v uint32) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	for i := range b {
+		b[i] = byte(v >> uint(8*i))
+	}
+	return b
+}
@@ -0,0 +1,162 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bubod/Bubod/logger"
+)
+
+// 输出到日志
+type LogExporter struct{}
+
+func (e *LogExporter) Export(spans []*Span) {
+	for _, span := range spans {
+		fields := logger.Fields{
+			"trace_id":  hex.EncodeToString(span.TraceId[:]),
+			"span_id":   hex.EncodeToString(span.SpanId[:]),
+			"parent_id": hex.EncodeToString(span.ParentId[:]),
+			"duration":  span.Duration().String(),
+		}
+		for key, value := range span.Attributes {
+			fields["attr."+key] = value
+		}
+		logger.With(fields).Info(span.Name)
+	}
+}
+
+// OTLP/HTTP json 导出，可直接发送到 OpenTelemetry Collector、Jaeger、Tempo
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp
+// span 先写入队列，由后台协程按批发送，队列满时丢弃，不阻塞同步
+type OTLPExporter struct {
+	Endpoint  string // 如 http://127.0.0.1:4318/v1/traces
+	queue     chan []*Span
+	client    *http.Client
+	batchSize int
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimRight(endpoint, "/") + "/v1/traces"
+	}
+	e := &OTLPExporter{
+		Endpoint:  endpoint,
+		queue:     make(chan []*Span, 1024),
+		client:    &http.Client{Timeout: 5 * time.Second},
+		batchSize: 64,
+	}
+	go e.run()
+	return e
+}
+
+func (e *OTLPExporter) Export(spans []*Span) {
+	select {
+	case e.queue <- spans:
+	default:
+	}
+}
+
+func (e *OTLPExporter) run() {
+	batch := make([]*Span, 0, e.batchSize)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case spans := <-e.queue:
+			batch = append(batch, spans...)
+			if len(batch) < e.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		e.send(batch)
+		batch = make([]*Span, 0, e.batchSize)
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []*otlpKeyValue `json:"attributes,omitempty"`
+}
+
+func newKeyValue(key string, value string) *otlpKeyValue {
+	kv := &otlpKeyValue{Key: key}
+	kv.Value.StringValue = value
+	return kv
+}
+
+func (e *OTLPExporter) send(spans []*Span) {
+	otlpSpans := make([]*otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		s := &otlpSpan{
+			TraceId:           hex.EncodeToString(span.TraceId[:]),
+			SpanId:            hex.EncodeToString(span.SpanId[:]),
+			Name:              span.Name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.ParentId != [8]byte{} {
+			s.ParentSpanId = hex.EncodeToString(span.ParentId[:])
+		}
+		keys := make([]string, 0, len(span.Attributes))
+		for key := range span.Attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s.Attributes = append(s.Attributes, newKeyValue(key, span.Attributes[key]))
+		}
+		otlpSpans = append(otlpSpans, s)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []*otlpKeyValue{newKeyValue("service.name", serviceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "bubod"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	resp, err := e.client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.WithError(err).Error("export trace")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Error("export trace", resp.Status)
+	}
+}
@@ -0,0 +1,179 @@
+// 事件处理链路追踪
+// 每个 binlog 事件是一个 trace，根 span 为 binlog.event，子 span 依次为 read、parse、filter、transform、sink。
+// 子 span 结束时只记录时间，根 span Finish 时整个 trace 一起导出；被过滤掉的事件调用 Drop 丢弃，不导出。
+// trace 上下文使用 W3C traceparent 格式，写入下游消息(json 字段 / kafka header)。
+// https://www.w3.org/TR/trace-context/
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const TRACEPARENT_HEADER = "traceparent"
+
+type Span struct {
+	TraceId    [16]byte
+	SpanId     [8]byte
+	ParentId   [8]byte // 根 span 为空
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+
+	root     *Span
+	lock     sync.Mutex
+	children []*Span // 只在根 span 上记录
+}
+
+// 导出器
+type Exporter interface {
+	Export(spans []*Span)
+}
+
+var (
+	exporter    Exporter
+	sampleRatio float64
+	serviceName = "bubod"
+)
+
+// 初始化，exporter 为 nil 时不追踪
+// ratio 为采样比例 0~1
+func Init(e Exporter, ratio float64, service string) {
+	exporter = e
+	sampleRatio = ratio
+	if service != "" {
+		serviceName = service
+	}
+}
+
+func Enabled() bool {
+	return exporter != nil && sampleRatio > 0
+}
+
+func ServiceName() string {
+	return serviceName
+}
+
+func randomBytes(b []byte) {
+	rand.Read(b)
+}
+
+// 按采样比例决定是否追踪
+func sampled() bool {
+	if sampleRatio >= 1 {
+		return true
+	}
+	var b [8]byte
+	randomBytes(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/float64(1<<53) < sampleRatio
+}
+
+// 开始一个根 span，不追踪时返回 nil，Span 的方法都可以在 nil 上调用
+func StartTrace(name string) *Span {
+	if !Enabled() || !sampled() {
+		return nil
+	}
+	span := &Span{Name: name, Start: time.Now()}
+	randomBytes(span.TraceId[:])
+	randomBytes(span.SpanId[:])
+	span.root = span
+	return span
+}
+
+// 开始一个子 span
+func (parent *Span) StartChild(name string) *Span {
+	if parent == nil {
+		return nil
+	}
+	span := &Span{
+		TraceId:  parent.TraceId,
+		ParentId: parent.SpanId,
+		Name:     name,
+		Start:    time.Now(),
+		root:     parent.root,
+	}
+	randomBytes(span.SpanId[:])
+	root := parent.root
+	root.lock.Lock()
+	root.children = append(root.children, span)
+	root.lock.Unlock()
+	return span
+}
+
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.lock.Lock()
+	if span.Attributes == nil {
+		span.Attributes = make(map[string]string)
+	}
+	span.Attributes[key] = fmt.Sprint(value)
+	span.lock.Unlock()
+}
+
+// 结束 span，根 span 结束时导出整个 trace
+func (span *Span) Finish() {
+	if span == nil || !span.End.IsZero() {
+		return
+	}
+	span.End = time.Now()
+	if span.root != span {
+		return
+	}
+	span.lock.Lock()
+	spans := append([]*Span{span}, span.children...)
+	span.children = nil
+	span.lock.Unlock()
+	for _, s := range spans {
+		if s.End.IsZero() {
+			s.End = span.End
+		}
+	}
+	if e := exporter; e != nil {
+		e.Export(spans)
+	}
+}
+
+// 丢弃整个 trace，已结束的 trace 不受影响
+func (span *Span) Drop() {
+	if span == nil || span.root == nil {
+		return
+	}
+	root := span.root
+	if !root.End.IsZero() {
+		return
+	}
+	root.lock.Lock()
+	root.children = nil
+	root.lock.Unlock()
+	root.End = time.Now()
+}
+
+// W3C traceparent: 00-{trace-id}-{span-id}-01，不追踪时返回空
+func (span *Span) Traceparent() string {
+	if span == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(span.TraceId[:]) + "-" + hex.EncodeToString(span.SpanId[:]) + "-01"
+}
+
+// 写入下游消息头(如 kafka header)的 trace 上下文
+func (span *Span) Headers() map[string]string {
+	if span == nil {
+		return nil
+	}
+	return map[string]string{TRACEPARENT_HEADER: span.Traceparent()}
+}
+
+func (span *Span) Duration() time.Duration {
+	if span == nil || span.End.IsZero() {
+		return 0
+	}
+	return span.End.Sub(span.Start)
+}
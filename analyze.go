@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"bubod/Bubod/mysql"
+)
+
+const ANALYZE_TIME_LAYOUT = "2006-01-02 15:04:05"
+
+// bubod analyze [flags] mysql-bin.000001 [mysql-bin.000002 ...]
+// 统计 binlog 中每张表的事件数、行数、字节数和所在事务的大小，用于找出 binlog 增长的来源。
+// 读取本地文件，-remote 时读取 master 上的文件，-remote 且不指定文件时读取 master 上的所有 binlog。
+// -start-datetime/-stop-datetime 按事件时间过滤，仍需读取范围之外的事件。
+//
+// 字节数为 rows 事件、TABLE_MAP_EVENT 和 DDL 的事件大小；事务为 BEGIN 到 XID/COMMIT，
+// 表的事务数为修改了该表的事务数，事务大小为整个事务的行数和字节数。
+func analyzeCommand(args []string) error {
+	fs := newFlagSet("analyze")
+	tool := defineBinlogToolFlags(fs)
+	startDatetime := fs.String("start-datetime", "", "只统计该时间(2006-01-02 15:04:05，本地时区)之后的事件")
+	stopDatetime := fs.String("stop-datetime", "", "只统计该时间之前的事件")
+	sortBy := fs.String("sort", "bytes", "表的排序 bytes/rows/events/txns")
+	limit := fs.Int("limit", 20, "只显示前 N 张表和最大的 N 个事务，0 为全部")
+	asJson := fs.Bool("json", false, "输出完整 json")
+	fs.Parse(args)
+
+	analyzer := &binlogAnalyzer{tables: make(map[string]*AnalyzeTable), mapBytes: make(map[string]int64), limit: *limit}
+	var err error
+	if analyzer.start, err = parseAnalyzeTime(*startDatetime); err != nil {
+		return err
+	}
+	if analyzer.stop, err = parseAnalyzeTime(*stopDatetime); err != nil {
+		return err
+	}
+	switch *sortBy {
+	case "bytes", "rows", "events", "txns":
+	default:
+		return fmt.Errorf("unknown sort %s", *sortBy)
+	}
+	// 事务边界事件不属于任何表，读取全部事件后再按表和事件类型过滤
+	analyzer.filter = newEventFilter(*tool.tables, *tool.types)
+	*tool.tables, *tool.types = "", ""
+
+	files := fs.Args()
+	if len(files) == 0 && *tool.remote && *tool.dsn != "" {
+		retention, err := mysql.ShowBinlogRetention(*tool.dsn)
+		if err != nil {
+			return err
+		}
+		for _, log := range retention.Logs {
+			files = append(files, log.Name)
+		}
+	}
+	if err := tool.read(files, mysql.ROW_FORMAT_SLICE, analyzer.add); err != nil {
+		return err
+	}
+	report := analyzer.report(*sortBy, *limit)
+	if *asJson {
+		return printJson(report)
+	}
+	printAnalyzeReport(report)
+	return nil
+}
+
+func parseAnalyzeTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation(ANALYZE_TIME_LAYOUT, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid datetime %q, must be %s", s, ANALYZE_TIME_LAYOUT)
+	}
+	return t, nil
+}
+
+// 一张表的统计
+type AnalyzeTable struct {
+	Table    string           `json:"table"` // db.table
+	Events   int64            `json:"events"`
+	Rows     int64            `json:"rows"` // 行变更数，update 的变更前、变更后为一行
+	Bytes    int64            `json:"bytes"`
+	Ops      map[string]int64 `json:"ops"`       // insert/update/delete 的行数，ddl 的语句数
+	Txns     int64            `json:"txns"`      // 修改了该表的事务数
+	MaxRows  int64            `json:"max_rows"`  // 最大的事务行数
+	MaxBytes int64            `json:"max_bytes"` // 最大的事务字节数
+}
+
+// 一个事务
+type AnalyzeTxn struct {
+	Position string   `json:"position"` // BEGIN 的位点
+	GTID     string   `json:"gtid,omitempty"`
+	Time     string   `json:"time"`
+	Rows     int64    `json:"rows"`
+	Bytes    int64    `json:"bytes"`
+	Tables   []string `json:"tables"`
+}
+
+type AnalyzeReport struct {
+	First    string          `json:"first"` // 统计范围内第一个和最后一个事件的时间
+	Last     string          `json:"last"`
+	Events   int64           `json:"events"`
+	Bytes    int64           `json:"bytes"` // 所有事件的字节数，包括不属于表的事件
+	Txns     int64           `json:"txns"`
+	Tables   []*AnalyzeTable `json:"tables"`
+	Largest  []*AnalyzeTxn   `json:"largest"` // 字节数最大的事务
+	AvgRows  float64         `json:"avg_txn_rows"`
+	AvgBytes float64         `json:"avg_txn_bytes"`
+}
+
+type binlogAnalyzer struct {
+	filter      *eventFilter
+	start, stop time.Time
+	first, last uint32
+	events      int64
+	bytes       int64
+	txns        int64
+	txnRows     int64 // 所有事务的行数、字节数之和
+	txnBytes    int64
+	tables      map[string]*AnalyzeTable
+	largest     []*AnalyzeTxn // 字节数最大的事务，limit 大于 0 时最多保留 2*limit 个
+	limit       int
+	txn         *AnalyzeTxn // 当前事务，不在事务中时为 nil
+	txnTables   map[string]bool
+	mapBytes    map[string]int64 // 尚未计入表的 TABLE_MAP_EVENT 大小
+}
+
+func (analyzer *binlogAnalyzer) inRange(timestamp uint32) bool {
+	t := time.Unix(int64(timestamp), 0)
+	if !analyzer.start.IsZero() && t.Before(analyzer.start) {
+		return false
+	}
+	return analyzer.stop.IsZero() || t.Before(analyzer.stop)
+}
+
+func (analyzer *binlogAnalyzer) table(name string) *AnalyzeTable {
+	table, ok := analyzer.tables[name]
+	if !ok {
+		table = &AnalyzeTable{Table: name, Ops: make(map[string]int64)}
+		analyzer.tables[name] = table
+	}
+	return table
+}
+
+func (analyzer *binlogAnalyzer) add(event *mysql.EventReslut) error {
+	header := event.Header
+	// 伪事件和时间为 0 的事件不统计
+	if header.Timestamp == 0 || !analyzer.inRange(header.Timestamp) {
+		return nil
+	}
+	if analyzer.first == 0 {
+		analyzer.first = header.Timestamp
+	}
+	analyzer.last = header.Timestamp
+	analyzer.events++
+	analyzer.bytes += int64(header.EventSize)
+
+	typ := eventTypeName(event)
+	query := strings.ToUpper(strings.TrimSpace(event.Query))
+	switch {
+	case typ == "query" && query == "BEGIN":
+		analyzer.txn = &AnalyzeTxn{
+			Position: fmt.Sprintf("%s:%d", event.BinlogFileName, header.LogPos-header.EventSize),
+			GTID:     event.GTID,
+			Time:     time.Unix(int64(header.Timestamp), 0).Format(ANALYZE_TIME_LAYOUT),
+			Bytes:    int64(header.EventSize),
+		}
+		analyzer.txnTables = make(map[string]bool)
+		return nil
+	case header.EventType == mysql.XID_EVENT || (typ == "query" && (query == "COMMIT" || query == "ROLLBACK")):
+		if analyzer.txn != nil {
+			analyzer.txn.Bytes += int64(header.EventSize)
+		}
+		analyzer.commit()
+		return nil
+	}
+	if event.TableName == "" {
+		return nil
+	}
+	name := event.SchemaName + "." + event.TableName
+	// TABLE_MAP_EVENT 的大小在其后的 rows 事件被统计时计入表，不计入事件数
+	if header.EventType == mysql.TABLE_MAP_EVENT {
+		analyzer.mapBytes[name] += int64(header.EventSize)
+		if analyzer.txn != nil {
+			analyzer.txn.Bytes += int64(header.EventSize)
+		}
+		return nil
+	}
+	rows := int64(event.RowCount())
+	if analyzer.txn != nil {
+		analyzer.txn.Rows += rows
+		analyzer.txn.Bytes += int64(header.EventSize)
+	}
+	mapBytes := analyzer.mapBytes[name]
+	delete(analyzer.mapBytes, name)
+	if !analyzer.filter.match(event) {
+		return nil
+	}
+	table := analyzer.table(name)
+	table.Events++
+	table.Rows += rows
+	table.Bytes += int64(header.EventSize) + mapBytes
+	if typ == "ddl" {
+		table.Ops[typ]++
+	} else {
+		table.Ops[typ] += rows
+	}
+	if analyzer.txn != nil {
+		analyzer.txnTables[name] = true
+	}
+	return nil
+}
+
+// 事务结束，更新事务涉及的表
+func (analyzer *binlogAnalyzer) commit() {
+	txn := analyzer.txn
+	if txn == nil {
+		return
+	}
+	analyzer.txn = nil
+	analyzer.txns++
+	analyzer.txnRows += txn.Rows
+	analyzer.txnBytes += txn.Bytes
+	for name := range analyzer.txnTables {
+		txn.Tables = append(txn.Tables, name)
+		table := analyzer.tables[name]
+		table.Txns++
+		if txn.Rows > table.MaxRows {
+			table.MaxRows = txn.Rows
+		}
+		if txn.Bytes > table.MaxBytes {
+			table.MaxBytes = txn.Bytes
+		}
+	}
+	if len(txn.Tables) == 0 {
+		return
+	}
+	sort.Strings(txn.Tables)
+	analyzer.largest = append(analyzer.largest, txn)
+	if analyzer.limit > 0 && len(analyzer.largest) >= 2*analyzer.limit {
+		analyzer.sortLargest()
+		analyzer.largest = analyzer.largest[:analyzer.limit]
+	}
+}
+
+func (analyzer *binlogAnalyzer) sortLargest() {
+	sort.Slice(analyzer.largest, func(i, j int) bool {
+		return analyzer.largest[i].Bytes > analyzer.largest[j].Bytes
+	})
+}
+
+func (analyzer *binlogAnalyzer) report(sortBy string, limit int) *AnalyzeReport {
+	report := &AnalyzeReport{
+		Events: analyzer.events,
+		Bytes:  analyzer.bytes,
+		Txns:   analyzer.txns,
+	}
+	if analyzer.first > 0 {
+		report.First = time.Unix(int64(analyzer.first), 0).Format(ANALYZE_TIME_LAYOUT)
+		report.Last = time.Unix(int64(analyzer.last), 0).Format(ANALYZE_TIME_LAYOUT)
+	}
+	if analyzer.txns > 0 {
+		report.AvgRows = float64(analyzer.txnRows) / float64(analyzer.txns)
+		report.AvgBytes = float64(analyzer.txnBytes) / float64(analyzer.txns)
+	}
+	for _, table := range analyzer.tables {
+		report.Tables = append(report.Tables, table)
+	}
+	sort.Slice(report.Tables, func(i, j int) bool {
+		a, b := report.Tables[i], report.Tables[j]
+		switch sortBy {
+		case "rows":
+			return a.Rows > b.Rows
+		case "events":
+			return a.Events > b.Events
+		case "txns":
+			return a.Txns > b.Txns
+		}
+		return a.Bytes > b.Bytes
+	})
+	analyzer.sortLargest()
+	report.Largest = analyzer.largest
+	if limit > 0 && len(report.Tables) > limit {
+		report.Tables = report.Tables[:limit]
+	}
+	if limit > 0 && len(report.Largest) > limit {
+		report.Largest = report.Largest[:limit]
+	}
+	return report
+}
+
+func printAnalyzeReport(report *AnalyzeReport) {
+	fmt.Printf("from %s to %s, %d events, %d bytes, %d transactions, avg %.1f rows %.0f bytes per transaction\n",
+		report.First, report.Last, report.Events, report.Bytes, report.Txns, report.AvgRows, report.AvgBytes)
+	fmt.Printf("%-40s %10s %12s %14s %10s %10s %10s %10s %8s %12s %14s\n",
+		"TABLE", "EVENTS", "ROWS", "BYTES", "INSERT", "UPDATE", "DELETE", "DDL", "TXNS", "TXN_MAX_ROWS", "TXN_MAX_BYTES")
+	for _, table := range report.Tables {
+		fmt.Printf("%-40s %10d %12d %14d %10d %10d %10d %10d %8d %12d %14d\n",
+			table.Table, table.Events, table.Rows, table.Bytes, table.Ops["insert"], table.Ops["update"], table.Ops["delete"], table.Ops["ddl"],
+			table.Txns, table.MaxRows, table.MaxBytes)
+	}
+	if len(report.Largest) == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Printf("%-32s %-19s %10s %14s  %s\n", "TRANSACTION", "TIME", "ROWS", "BYTES", "TABLES")
+	for _, txn := range report.Largest {
+		fmt.Printf("%-32s %-19s %10d %14d  %s\n", txn.Position, txn.Time, txn.Rows, txn.Bytes, strings.Join(txn.Tables, ","))
+	}
+}
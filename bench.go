@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/lib"
+	"bubod/Bubod/logger"
+)
+
+// bubod bench -c bubod.ini [-source name] [-tables 4] [-row-size 256] [-update 0.3] [-delete 0.1] [-events N|-duration 30s] [-rate N]
+// 不连接 MySQL，生成合成的行变更事件写入数据源配置的输出并保存位点，用于测试输出吞吐和位点保存
+func benchCommand(args []string) error {
+	fs := newFlagSet("bench")
+	configFile := fs.String("c", "bubod.ini", "配置文件，使用数据源的表过滤和 [sink.N] 输出")
+	profile := fs.String("profile", os.Getenv(config.PROFILE_ENV), "配置覆盖文件，如 prod 加载 bubod.prod.ini")
+	source := fs.String("source", "", "数据源配置组，默认为第一个数据源")
+	opts := lib.LoadOptions{}
+	fs.StringVar(&opts.Database, "db", "bench", "生成事件的库名，表名为 t1...tN，需要在数据源的同步范围内")
+	fs.IntVar(&opts.Tables, "tables", 4, "表的个数")
+	fs.IntVar(&opts.Columns, "columns", 4, "每行字符串字段的个数")
+	fs.IntVar(&opts.RowSize, "row-size", 256, "每行字符串字段的总字节数")
+	fs.IntVar(&opts.RowsPerEvent, "rows", 1, "每个事件的行数")
+	fs.Float64Var(&opts.UpdateRatio, "update", 0.3, "update 事件的比例")
+	fs.Float64Var(&opts.DeleteRatio, "delete", 0.1, "delete 事件的比例，其余为 insert")
+	fs.IntVar(&opts.Events, "events", 100000, "生成的事件数，0 为不限")
+	fs.DurationVar(&opts.Duration, "duration", 0, "持续时间，0 为不限")
+	fs.IntVar(&opts.Rate, "rate", 0, "每秒事件数，0 为最快速度")
+	fs.Int64Var(&opts.Seed, "seed", 1, "随机数种子")
+	fs.StringVar(&opts.RowFormat, "row-format", "", "行格式 map/slice，默认使用数据源的 row_format")
+	fs.Parse(args)
+
+	if opts.Events == 0 && opts.Duration == 0 {
+		return fmt.Errorf("-events or -duration is required")
+	}
+	conf := config.LoadConfProfile(*configFile, *profile)
+	logger.SetLevel(config.GetConfigVal("Bubod", "log_level"))
+	logger.SetFormat(config.GetConfigVal("Bubod", "log_format"))
+	name := *source
+	if name == "" {
+		name = lib.GetSourceNames(conf)[0]
+	}
+
+	// Ctrl-C 提前结束并输出结果
+	quit := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(c)
+	go func() {
+		if _, ok := <-c; ok {
+			close(quit)
+		}
+	}()
+
+	stats, err := lib.RunLoad(conf, name, opts, quit)
+	if stats != nil {
+		fmt.Println(stats)
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"bubod/Bubod/mysql"
+)
+
+// 离线读取 binlog 的命令共用的参数: 读取本地文件或 master 上的 binlog，按位点、表、事件类型过滤
+type binlogToolFlags struct {
+	dsn      *string
+	remote   *bool
+	startPos *uint
+	stopPos  *uint
+	tables   *string
+	types    *string
+	schema   *string
+}
+
+func defineBinlogToolFlags(fs *flag.FlagSet) *binlogToolFlags {
+	return &binlogToolFlags{
+		dsn:      fs.String("dsn", "", "master DSN，如 user:pass@tcp(127.0.0.1:3306)/，读取本地文件时用于查询表结构，为空时字段名为 @1、@2..."),
+		remote:   fs.Bool("remote", false, "从 master 读取参数中的 binlog 文件，而不是本地文件"),
+		startPos: fs.Uint("start-pos", 4, "第一个文件的起始位点"),
+		stopPos:  fs.Uint("stop-pos", 0, "最后一个文件的结束位点，从该位点开始的事件不再读取，0 为读到文件结束"),
+		tables:   fs.String("table", "", "只处理这些表，逗号分隔，db.table 或 table"),
+		types:    fs.String("type", "", "只处理这些事件，逗号分隔: insert/update/delete/ddl/query"),
+		schema:   fs.String("schema", "", "表结构快照文件(bubod schema export 导出)，快照中的表不查询 -dsn"),
+	}
+}
+
+// 依次读取 files，符合过滤条件的事件回调 fn
+func (o *binlogToolFlags) read(files []string, rowFormat string, fn func(event *mysql.EventReslut) error) error {
+	if len(files) == 0 {
+		return fmt.Errorf("binlog file is required")
+	}
+	if *o.remote && *o.dsn == "" {
+		return fmt.Errorf("-remote requires -dsn")
+	}
+	var snapshot *mysql.SchemaSnapshot
+	if *o.schema != "" {
+		var err error
+		if snapshot, err = mysql.ReadSchemaSnapshot(*o.schema); err != nil {
+			return err
+		}
+	}
+	filter := newEventFilter(*o.tables, *o.types)
+	for i, file := range files {
+		reader := &mysql.BinlogReader{DataSource: *o.dsn, RowFormat: rowFormat, ImportSchema: snapshot}
+		start := uint32(4)
+		if i == 0 {
+			start = uint32(*o.startPos)
+		}
+		if i == len(files)-1 {
+			reader.StopPosition = uint32(*o.stopPos)
+		}
+		callback := func(event *mysql.EventReslut) error {
+			if !filter.match(event) {
+				return nil
+			}
+			return fn(event)
+		}
+		var err error
+		if *o.remote {
+			err = reader.ReadMaster(file, start, callback)
+		} else {
+			err = reader.ReadFile(file, start, callback)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按表和事件类型过滤
+type eventFilter struct {
+	tables map[string]bool // db.table 或 table
+	types  map[string]bool
+}
+
+func newEventFilter(tables string, types string) *eventFilter {
+	filter := &eventFilter{tables: splitSet(tables), types: splitSet(types)}
+	return filter
+}
+
+func splitSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// 事件类型 insert/update/delete/ddl/query，其他事件为事件名
+func eventTypeName(event *mysql.EventReslut) string {
+	switch event.Header.EventType {
+	case mysql.QUERY_EVENT:
+		if event.DDL != nil {
+			return "ddl"
+		}
+		return "query"
+	case mysql.WRITE_ROWS_EVENTv0, mysql.WRITE_ROWS_EVENTv1, mysql.WRITE_ROWS_EVENTv2,
+		mysql.UPDATE_ROWS_EVENTv0, mysql.UPDATE_ROWS_EVENTv1, mysql.UPDATE_ROWS_EVENTv2,
+		mysql.DELETE_ROWS_EVENTv0, mysql.DELETE_ROWS_EVENTv1, mysql.DELETE_ROWS_EVENTv2:
+		return mysql.EvenTypeName(event.Header.EventType)
+	}
+	return event.Header.EventName()
+}
+
+func (filter *eventFilter) match(event *mysql.EventReslut) bool {
+	if len(filter.types) > 0 && !filter.types[eventTypeName(event)] {
+		return false
+	}
+	if len(filter.tables) > 0 {
+		if event.TableName == "" {
+			return false
+		}
+		if !filter.tables[event.SchemaName+"."+event.TableName] && !filter.tables[event.TableName] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"bubod/Bubod/lib"
+	"bubod/Bubod/mysql"
+)
+
+// 管理接口默认地址，与 [Bubod] listen 默认值一致
+const DEFAULT_ADMIN_ADDR = "127.0.0.1:9167"
+
+const usage = `bubod <command> [flags]
+
+commands:
+  run        启动同步服务 bubod run -c bubod.ini
+  status     实例状态 bubod status [name]
+  seek       修改起始位点 bubod seek -source name -file mysql-bin.000003 -pos 4 | -gtid set
+  position   查看/修改位点 bubod position get|set
+  snapshot   全量导出表数据 bubod snapshot table db.t
+  binlogs    master 上的 binlog 文件和已同步位点的清除状态 bubod binlogs [-source name]
+  tables     按表统计的同步流量 bubod tables [-source name] [-limit 20]
+  savepoint  位点历史和保存点 bubod savepoint list|history|create|remove [name]
+  rewind     回退到保存点或某个时间 bubod rewind [-source name] name | -time "2006-01-02 15:04:05"
+  schema     导出表结构快照 bubod schema export [-source name] [-all] -o schema.json | -dsn dsn [-databases db1,db2]
+             按快照生成目标库建表语句 bubod schema ddl -dialect mysql|postgres|clickhouse|sqlite schema.json
+  analyze    按表统计 binlog 的事件数、行数、字节数和事务大小 bubod analyze [-start-datetime t] [-stop-datetime t] mysql-bin.000001
+  inspect    解析并输出 binlog bubod inspect [-table db.t] [-type insert] mysql-bin.000001
+  flashback  生成回滚语句 bubod flashback -dsn dsn -table db.t -start-pos 4 -stop-pos 1024 mysql-bin.000001
+  export     按表导出变更 bubod export -format ndjson|csv|parquet [-partition] -o dir mysql-bin.000001
+  replay     回放归档的事件到输出 bubod replay -c bubod.ini -speed 2x [-input ndjson] mysql-bin.000001
+             回放 Maxwell/Canal/Debezium 消息(文件或标准输入，不直接消费 Kafka) kafka-console-consumer --topic t | bubod replay -input maxwell|canal|debezium -speed max -
+  bench      生成合成事件压测输出和位点保存 bubod bench -c bubod.ini -events 100000 [-rate 5000]
+  help       显示帮助
+
+analyze/inspect/flashback/export/replay 读取本地 binlog 文件，-remote 时从 -dsn 指定的 master 读取
+status/seek/position/snapshot/binlogs/tables/savepoint/rewind/schema 通过管理接口操作运行中的 bubod，-addr 指定地址，默认 ` + DEFAULT_ADMIN_ADDR + `，
+配置了 [Bubod] admin_token 时通过 -token 或环境变量 BUBOD_ADMIN_TOKEN 指定
+不带命令或第一个参数为 flag 时等同于 run，兼容原有启动方式
+`
+
+// 执行子命令，返回进程退出码
+func runCommand(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		runServer(args)
+		return 0
+	}
+	var err error
+	switch args[0] {
+	case "run":
+		runServer(args[1:])
+		return 0
+	case "status":
+		err = statusCommand(args[1:])
+	case "seek":
+		err = seekCommand(args[1:])
+	case "position":
+		err = positionCommand(args[1:])
+	case "snapshot":
+		err = snapshotCommand(args[1:])
+	case "binlogs":
+		err = binlogsCommand(args[1:])
+	case "tables":
+		err = tablesCommand(args[1:])
+	case "savepoint":
+		err = savepointCommand(args[1:])
+	case "rewind":
+		err = rewindCommand(args[1:])
+	case "schema":
+		err = schemaCommand(args[1:])
+	case "analyze":
+		err = analyzeCommand(args[1:])
+	case "inspect":
+		err = inspectCommand(args[1:])
+	case "flashback":
+		err = flashbackCommand(args[1:])
+	case "export":
+		err = exportCommand(args[1:])
+	case "replay":
+		err = replayCommand(args[1:])
+	case "bench":
+		err = benchCommand(args[1:])
+	case "help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n%s", args[0], usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// 管理接口客户端
+type adminClient struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("bubod "+name, flag.ExitOnError)
+}
+
+func newCommandFlags(name string) (*flag.FlagSet, *adminClient) {
+	fs := newFlagSet(name)
+	c := &adminClient{client: &http.Client{}}
+	fs.StringVar(&c.addr, "addr", DEFAULT_ADMIN_ADDR, "bubod 管理接口地址 host:port")
+	fs.StringVar(&c.token, "token", os.Getenv("BUBOD_ADMIN_TOKEN"), "管理接口 token，同 [Bubod] admin_token，默认为环境变量 BUBOD_ADMIN_TOKEN")
+	return fs, c
+}
+
+// 请求管理接口，data 非 nil 时解析返回的 data 字段
+func (c *adminClient) do(method string, path string, body interface{}, data interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	addr := c.addr
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(addr, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if u, err := user.Current(); err == nil {
+		req.Header.Set(lib.AUDIT_ACTOR_HEADER, u.Username)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	result := &struct {
+		Code int             `json:"code"`
+		Msg  string          `json:"msg"`
+		Data json.RawMessage `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if result.Code != 0 {
+		return fmt.Errorf("%s", result.Msg)
+	}
+	if data != nil && len(result.Data) > 0 {
+		return json.Unmarshal(result.Data, data)
+	}
+	return nil
+}
+
+// 未指定实例时使用唯一的实例
+func (c *adminClient) instance(name string) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+	list := make([]*lib.SourceStatus, 0)
+	if err := c.do(http.MethodGet, "/instances", nil, &list); err != nil {
+		return "", err
+	}
+	if len(list) != 1 {
+		return "", fmt.Errorf("%d instances, specify one with -source", len(list))
+	}
+	return list[0].Name, nil
+}
+
+// 修改起始位点，restart 时先停止实例，修改后重新启动
+func (c *adminClient) seek(name string, file string, position uint32, gtid string, restart bool) error {
+	if restart {
+		if err := c.do(http.MethodPost, "/instances/"+name+"/stop", nil, nil); err != nil {
+			return err
+		}
+	}
+	req := map[string]interface{}{"file": file, "position": position, "gtid": gtid}
+	if err := c.do(http.MethodPost, "/instances/"+name+"/seek", req, nil); err != nil {
+		return err
+	}
+	if restart {
+		return c.do(http.MethodPost, "/instances/"+name+"/start", nil, nil)
+	}
+	return nil
+}
+
+func printJson(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// bubod status [-json] [name]
+func statusCommand(args []string) error {
+	fs, c := newCommandFlags("status")
+	asJson := fs.Bool("json", false, "输出完整 json")
+	fs.Parse(args)
+
+	list := make([]*lib.SourceStatus, 0)
+	if name := fs.Arg(0); name != "" {
+		status := &lib.SourceStatus{}
+		if err := c.do(http.MethodGet, "/instances/"+name, nil, status); err != nil {
+			return err
+		}
+		list = append(list, status)
+	} else if err := c.do(http.MethodGet, "/instances", nil, &list); err != nil {
+		return err
+	}
+	if *asJson {
+		return printJson(list)
+	}
+	for _, status := range list {
+		fmt.Printf("%-16s %-10s %s:%d delay=%ds lag_bytes=%d", status.Name, status.State,
+			status.BinlogDumpFileName, status.BinlogDumpPosition, status.Delay, status.LagBytes)
+		if status.ExecutedGTIDSet != "" {
+			fmt.Printf(" gtid=%s", status.ExecutedGTIDSet)
+		}
+		if status.ConnErr != "" {
+			fmt.Printf(" (%s)", status.ConnErr)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// bubod seek -source name -file mysql-bin.000003 -pos 4 | -gtid set
+func seekCommand(args []string) error {
+	fs, c := newCommandFlags("seek")
+	source := fs.String("source", "", "实例名称，只有一个实例时可省略")
+	file := fs.String("file", "", "binlog 文件")
+	pos := fs.Uint("pos", 4, "binlog 位置")
+	gtid := fs.String("gtid", "", "从该 GTID 集合之后开始同步")
+	restart := fs.Bool("restart", false, "先停止实例，修改后重新启动")
+	fs.Parse(args)
+
+	if (*file == "") == (*gtid == "") {
+		return fmt.Errorf("one of -file or -gtid is required")
+	}
+	name, err := c.instance(*source)
+	if err != nil {
+		return err
+	}
+	return c.seek(name, *file, uint32(*pos), *gtid, *restart)
+}
+
+// bubod position get [-source name]
+// bubod position set [-source name] [-restart] mysql-bin.000003:4 | -gtid set
+func positionCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "get" && args[0] != "set") {
+		return fmt.Errorf("usage: bubod position get|set")
+	}
+	fs, c := newCommandFlags("position " + args[0])
+	source := fs.String("source", "", "实例名称，只有一个实例时可省略")
+	gtid := fs.String("gtid", "", "set: 从该 GTID 集合之后开始同步")
+	restart := fs.Bool("restart", false, "set: 先停止实例，修改后重新启动")
+	fs.Parse(args[1:])
+
+	name, err := c.instance(*source)
+	if err != nil {
+		return err
+	}
+	if args[0] == "get" {
+		status := &lib.SourceStatus{}
+		if err := c.do(http.MethodGet, "/instances/"+name, nil, status); err != nil {
+			return err
+		}
+		fmt.Printf("%s:%d\n", status.BinlogDumpFileName, status.BinlogDumpPosition)
+		if status.ExecutedGTIDSet != "" {
+			fmt.Println(status.ExecutedGTIDSet)
+		}
+		return nil
+	}
+
+	if *gtid != "" {
+		return c.seek(name, "", 0, *gtid, *restart)
+	}
+	filePos := fs.Arg(0)
+	i := strings.LastIndexByte(filePos, ':')
+	if i <= 0 {
+		return fmt.Errorf("position must be file:pos, got %q", filePos)
+	}
+	position, err := strconv.ParseUint(filePos[i+1:], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid position %q", filePos)
+	}
+	return c.seek(name, filePos[:i], uint32(position), "", *restart)
+}
+
+// bubod snapshot table [-source name] db.t
+func snapshotCommand(args []string) error {
+	if len(args) == 0 || args[0] != "table" {
+		return fmt.Errorf("usage: bubod snapshot table db.t")
+	}
+	fs, c := newCommandFlags("snapshot table")
+	source := fs.String("source", "", "实例名称，只有一个实例时可省略")
+	fs.Parse(args[1:])
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: bubod snapshot table db.t")
+	}
+	name, err := c.instance(*source)
+	if err != nil {
+		return err
+	}
+	for _, table := range fs.Args() {
+		start := time.Now()
+		result := &struct {
+			Rows int `json:"rows"`
+		}{}
+		if err := c.do(http.MethodPost, "/instances/"+name+"/snapshot", map[string]string{"table": table}, result); err != nil {
+			return fmt.Errorf("%s: %s", table, err)
+		}
+		fmt.Printf("%s %d rows in %s\n", table, result.Rows, time.Since(start).Truncate(time.Millisecond))
+	}
+	return nil
+}
+
+// bubod binlogs [-source name] [-json]
+func binlogsCommand(args []string) error {
+	fs, c := newCommandFlags("binlogs")
+	source := fs.String("source", "", "实例名称，只有一个实例时可省略")
+	asJson := fs.Bool("json", false, "输出完整 json")
+	fs.Parse(args)
+
+	name, err := c.instance(*source)
+	if err != nil {
+		return err
+	}
+	status := &lib.PurgeStatus{}
+	if err := c.do(http.MethodGet, "/instances/"+name+"/binlogs", nil, status); err != nil {
+		return err
+	}
+	if *asJson {
+		return printJson(status)
+	}
+	if status.BinlogRetention != nil {
+		for _, binaryLog := range status.Logs {
+			mark := ""
+			if binaryLog.Name == status.BinlogFile {
+				mark = fmt.Sprintf(" <- %s:%d", status.BinlogFile, status.BinlogPosition)
+			}
+			fmt.Printf("%s %d%s\n", binaryLog.Name, binaryLog.Size, mark)
+		}
+		fmt.Printf("earliest %s:%d, expire %ds\n", status.EarliestFile, status.EarliestPosition, status.ExpireSeconds)
+	}
+	switch {
+	case status.Purged:
+		fmt.Printf("synced binlog %s has been purged\n", status.BinlogFile)
+	case status.PurgeIn >= 0:
+		fmt.Printf("synced binlog %s may be purged in %s\n", status.BinlogFile, time.Duration(status.PurgeIn)*time.Second)
+	}
+	return nil
+}
+
+// bubod tables [-source name] [-limit 20] [-json]
+func tablesCommand(args []string) error {
+	fs, c := newCommandFlags("tables")
+	source := fs.String("source", "", "实例名称，只有一个实例时可省略")
+	limit := fs.Int("limit", 20, "只显示字节数最多的前 N 张表，0 为全部")
+	asJson := fs.Bool("json", false, "输出完整 json")
+	fs.Parse(args)
+
+	name, err := c.instance(*source)
+	if err != nil {
+		return err
+	}
+	report := &lib.TableStatsReport{}
+	if err := c.do(http.MethodGet, "/instances/"+name+"/tables?limit="+strconv.Itoa(*limit), nil, report); err != nil {
+		return err
+	}
+	if *asJson {
+		return printJson(report)
+	}
+	fmt.Printf("since %s\n", report.Since.Format("2006-01-02 15:04:05"))
+	fmt.Printf("%-40s %10s %12s %14s %12s %12s\n", "TABLE", "EVENTS", "ROWS", "BYTES", "ROWS/1M", "BYTES/1M")
+	for _, table := range report.Tables {
+		window := table.Windows["1m"]
+		fmt.Printf("%-40s %10d %12d %14d %12d %12d\n", table.Table, table.Total.Events, table.Total.Rows, table.Total.Bytes, window.Rows, window.Bytes)
+	}
+	return nil
+}
+
+func printCheckpoints(list []*lib.Checkpoint) {
+	for _, checkpoint := range list {
+		if checkpoint.Name != "" {
+			fmt.Printf("%-20s ", checkpoint.Name)
+		}
+		fmt.Printf("%s %s:%d", checkpoint.Time, checkpoint.File, checkpoint.Position)
+		if checkpoint.GTIDSet != "" {
+			fmt.Printf(" gtid=%s", checkpoint.GTIDSet)
+		}
+		fmt.Println()
+	}
+}
+
+// bubod savepoint list|history [-source name] [-json]
+// bubod savepoint create [-source name] [-time "2006-01-02 15:04:05"] name
+// bubod savepoint remove [-source name] name
+func savepointCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "history" && args[0] != "create" && args[0] != "remove") {
+		return fmt.Errorf("usage: bubod savepoint list|history|create|remove")
+	}
+	fs, c := newCommandFlags("savepoint " + args[0])
+	source := fs.String("source", "", "实例名称，只有一个实例时可省略")
+	at := fs.String("time", "", "create: 使用该时间之前最后保存的位点，默认为最近保存的位点")
+	asJson := fs.Bool("json", false, "输出完整 json")
+	fs.Parse(args[1:])
+
+	name, err := c.instance(*source)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "list", "history":
+		path := "/instances/" + name + "/savepoints"
+		if args[0] == "history" {
+			path = "/instances/" + name + "/checkpoints"
+		}
+		list := make([]*lib.Checkpoint, 0)
+		if err := c.do(http.MethodGet, path, nil, &list); err != nil {
+			return err
+		}
+		if *asJson {
+			return printJson(list)
+		}
+		printCheckpoints(list)
+		return nil
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: bubod savepoint %s name", args[0])
+	}
+	if args[0] == "remove" {
+		return c.do(http.MethodDelete, "/instances/"+name+"/savepoints/"+fs.Arg(0), nil, nil)
+	}
+	savepoint := &lib.Checkpoint{}
+	if err := c.do(http.MethodPost, "/instances/"+name+"/savepoints", map[string]string{"name": fs.Arg(0), "time": *at}, savepoint); err != nil {
+		return err
+	}
+	printCheckpoints([]*lib.Checkpoint{savepoint})
+	return nil
+}
+
+// bubod rewind [-source name] savepoint | -time "2006-01-02 15:04:05"
+func rewindCommand(args []string) error {
+	fs, c := newCommandFlags("rewind")
+	source := fs.String("source", "", "实例名称，只有一个实例时可省略")
+	at := fs.String("time", "", "回退到该时间之前最后保存的位点")
+	fs.Parse(args)
+
+	if (fs.Arg(0) == "") == (*at == "") {
+		return fmt.Errorf("one of savepoint or -time is required")
+	}
+	name, err := c.instance(*source)
+	if err != nil {
+		return err
+	}
+	checkpoint := &lib.Checkpoint{}
+	if err := c.do(http.MethodPost, "/instances/"+name+"/rewind", map[string]string{"savepoint": fs.Arg(0), "time": *at}, checkpoint); err != nil {
+		return err
+	}
+	fmt.Print("rewound to ")
+	printCheckpoints([]*lib.Checkpoint{checkpoint})
+	return nil
+}
+
+// bubod schema export [-source name] [-all] -o schema.json
+// bubod schema export -dsn dsn [-databases db1,db2] -o schema.json
+// 导出表结构快照，数据源配置 schema_snapshot 或离线读取时 -schema 导入
+func schemaCommand(args []string) error {
+	if len(args) > 0 && args[0] == "ddl" {
+		return schemaDDLCommand(args[1:])
+	}
+	if len(args) == 0 || args[0] != "export" {
+		return fmt.Errorf("usage: bubod schema export|ddl")
+	}
+	fs, c := newCommandFlags("schema export")
+	source := fs.String("source", "", "实例名称，只有一个实例时可省略")
+	all := fs.Bool("all", false, "查询 master 上所有同步的表，与缓存的表结构合并，默认只导出缓存的表结构")
+	dsn := fs.String("dsn", "", "直接查询该 master 的表结构，不通过管理接口")
+	databases := fs.String("databases", "", "-dsn 时导出的库，逗号分隔，可以使用通配符，默认为除系统库外的所有库")
+	output := fs.String("o", "", "写入的文件，为空时输出到标准输出")
+	fs.Parse(args[1:])
+
+	var snapshot *mysql.SchemaSnapshot
+	if *dsn != "" {
+		var dbs []string
+		for _, db := range strings.Split(*databases, ",") {
+			if db = strings.TrimSpace(db); db != "" {
+				dbs = append(dbs, db)
+			}
+		}
+		var err error
+		if snapshot, err = mysql.QuerySchemaSnapshot(*dsn, dbs); err != nil {
+			return err
+		}
+	} else {
+		name, err := c.instance(*source)
+		if err != nil {
+			return err
+		}
+		snapshot = &mysql.SchemaSnapshot{}
+		if err := c.do(http.MethodGet, "/instances/"+name+"/schemas/snapshot?all="+strconv.FormatBool(*all), nil, snapshot); err != nil {
+			return err
+		}
+	}
+	if *output == "" {
+		return printJson(snapshot)
+	}
+	if err := snapshot.WriteFile(*output); err != nil {
+		return err
+	}
+	fmt.Printf("%d tables written to %s\n", len(snapshot.Tables), *output)
+	return nil
+}
+
+// bubod schema ddl -dialect mysql|postgres|clickhouse|sqlite schema.json
+// 按表结构快照生成目标库的建表语句，类型转换同 applier 输出的 auto_ddl
+func schemaDDLCommand(args []string) error {
+	fs := newFlagSet("schema ddl")
+	dialect := fs.String("dialect", lib.TARGET_MYSQL, "目标库类型 mysql/postgres/clickhouse/sqlite")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: bubod schema ddl -dialect mysql|postgres|clickhouse|sqlite schema.json")
+	}
+	snapshot, err := mysql.ReadSchemaSnapshot(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	statements, err := lib.TargetCreateTables(*dialect, snapshot)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		fmt.Println(statement + ";")
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"bubod/Bubod/lib"
+	"bubod/Bubod/mysql"
+	"bubod/Bubod/parquet"
+)
+
+const (
+	EXPORT_FORMAT_NDJSON  = "ndjson"
+	EXPORT_FORMAT_CSV     = "csv"
+	EXPORT_FORMAT_PARQUET = "parquet"
+)
+
+// 导出文件中每行变更附带的字段
+var exportMetaColumns = []string{"_binlog", "_timestamp", "_event_type"}
+
+// bubod export -format ndjson|csv|parquet -o dir [-partition] [flags] mysql-bin.000001 [mysql-bin.000002 ...]
+// 将 binlog 中的行变更按表写入 dir/db.table.{ndjson,csv,parquet}
+//
+//	ndjson:       每行一条同步时写入输出的 json 消息
+//	csv/parquet:  _binlog,_timestamp,_event_type + 表字段，insert/update 为变更后的值，delete 为删除前的值；
+//	              表字段变化(DDL)后写入新文件 db.table.N.csv
+//	parquet:      字段类型按表结构转换，同 file 输出的 format=parquet
+//
+// -partition 时按表和事件日期(UTC)分区写入 dir/db.table/dt=2006-01-02/part-N.{ndjson,csv,parquet}，
+// 可以直接作为 Spark、Trino 的 Hive 分区表
+func exportCommand(args []string) error {
+	fs := newFlagSet("export")
+	tool := defineBinlogToolFlags(fs)
+	format := fs.String("format", EXPORT_FORMAT_NDJSON, "文件格式 ndjson/csv/parquet")
+	dir := fs.String("o", ".", "输出目录")
+	partition := fs.Bool("partition", false, "按表和日期分区 db.table/dt=YYYY-MM-DD/")
+	fs.Parse(args)
+
+	switch *format {
+	case EXPORT_FORMAT_NDJSON, EXPORT_FORMAT_CSV, EXPORT_FORMAT_PARQUET:
+	default:
+		return fmt.Errorf("unknown format %s", *format)
+	}
+	if *tool.types == "" {
+		*tool.types = "insert,update,delete"
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	exporter := &exporter{dir: *dir, format: *format, partition: *partition, tables: make(map[string]*exportTable)}
+	err := tool.read(fs.Args(), mysql.ROW_FORMAT_SLICE, exporter.write)
+	if closeErr := exporter.close(); err == nil {
+		err = closeErr
+	}
+	for _, table := range exporter.tables {
+		fmt.Printf("%s %d rows\n", table.name, table.rows)
+	}
+	return err
+}
+
+type exporter struct {
+	dir       string
+	format    string
+	partition bool
+	tables    map[string]*exportTable // db.table
+}
+
+// 一个表的导出文件
+type exportTable struct {
+	name    string
+	columns []string         // 当前文件的表字段
+	typed   []parquet.Column // 当前文件的表字段类型
+	date    string           // 分区时当前文件的日期
+	part    int              // 表字段或日期变化后的文件序号
+	rows    int
+	file    *os.File
+	buf     *bufio.Writer
+	csv     *csv.Writer
+	parquet *parquet.Writer
+}
+
+func (exporter *exporter) write(event *mysql.EventReslut) error {
+	if event.RowCount() == 0 {
+		return nil
+	}
+	name := event.SchemaName + "." + event.TableName
+	table, ok := exporter.tables[name]
+	if !ok {
+		table = &exportTable{name: name}
+		exporter.tables[name] = table
+	}
+
+	date := ""
+	if exporter.partition {
+		date = time.Unix(int64(event.Header.Timestamp), 0).UTC().Format("2006-01-02")
+	}
+
+	if exporter.format == EXPORT_FORMAT_NDJSON {
+		if table.file == nil || date != table.date {
+			if err := exporter.reopen(table, date); err != nil {
+				return err
+			}
+		}
+		for _, message := range mysql.FormatEventData(event) {
+			table.buf.WriteString(message)
+			table.buf.WriteByte('\n')
+		}
+		table.rows += event.RowCount()
+		return nil
+	}
+
+	columns := make([]string, len(event.Columns))
+	for i, column := range event.Columns {
+		columns[i] = column.Name
+	}
+	typed := lib.ParquetColumns(event.Columns)
+	if table.file == nil || date != table.date || strings.Join(columns, ",") != strings.Join(table.columns, ",") ||
+		(exporter.format == EXPORT_FORMAT_PARQUET && !reflect.DeepEqual(typed, table.typed)) {
+		table.columns, table.typed = columns, typed
+		if err := exporter.reopen(table, date); err != nil {
+			return err
+		}
+	}
+
+	eventType := eventTypeName(event)
+	binlog := fmt.Sprintf("%s:%d", event.BinlogFileName, event.Header.LogPos-event.Header.EventSize)
+	timestamp := strconv.FormatUint(uint64(event.Header.Timestamp), 10)
+	for i, values := range event.Values {
+		// update 事件按 变更前、变更后 成对出现，只导出变更后的值
+		if eventType == "update" && i%2 == 0 {
+			continue
+		}
+		row := make([]*string, 0, len(exportMetaColumns)+len(values))
+		row = append(row, &binlog, &timestamp, &eventType)
+		for _, value := range values {
+			row = append(row, exportValue(value))
+		}
+		if err := table.writeRow(row); err != nil {
+			return err
+		}
+		table.rows++
+	}
+	return nil
+}
+
+// 完成当前文件，创建表的下一个导出文件
+func (exporter *exporter) reopen(table *exportTable, date string) error {
+	if table.file != nil {
+		if err := table.close(); err != nil {
+			return err
+		}
+		table.part++
+	}
+	table.date = date
+	return exporter.open(table)
+}
+
+// 创建表的导出文件
+func (exporter *exporter) open(table *exportTable) error {
+	path := filepath.Join(exporter.dir, table.name)
+	if table.part > 0 {
+		path += "." + strconv.Itoa(table.part)
+	}
+	path += "." + exporter.format
+	if exporter.partition {
+		dir := filepath.Join(exporter.dir, table.name, "dt="+table.date)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		path = filepath.Join(dir, fmt.Sprintf("part-%d.%s", table.part, exporter.format))
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	table.file = file
+	table.buf = bufio.NewWriterSize(file, 1<<20)
+	header := append(append([]string(nil), exportMetaColumns...), table.columns...)
+	switch exporter.format {
+	case EXPORT_FORMAT_CSV:
+		table.csv = csv.NewWriter(table.buf)
+		err = table.csv.Write(header)
+	case EXPORT_FORMAT_PARQUET:
+		table.parquet, err = parquet.NewTypedWriter(table.buf, append(append([]parquet.Column(nil), lib.ParquetMetaColumns...), table.typed...))
+	}
+	return err
+}
+
+func (table *exportTable) writeRow(row []*string) error {
+	if table.parquet != nil {
+		return table.parquet.Write(row)
+	}
+	record := make([]string, len(row))
+	for i, value := range row {
+		if value != nil {
+			record[i] = *value
+		}
+	}
+	return table.csv.Write(record)
+}
+
+func (table *exportTable) close() error {
+	var err error
+	if table.csv != nil {
+		table.csv.Flush()
+		err = table.csv.Error()
+	}
+	if table.parquet != nil {
+		err = table.parquet.Close()
+	}
+	if flushErr := table.buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := table.file.Close(); err == nil {
+		err = closeErr
+	}
+	table.file, table.buf, table.csv, table.parquet = nil, nil, nil, nil
+	return err
+}
+
+func (exporter *exporter) close() error {
+	var err error
+	for _, table := range exporter.tables {
+		if table.file == nil {
+			continue
+		}
+		if closeErr := table.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// 导出的字段值，NULL 为 nil
+func exportValue(value driver.Value) *string {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case []string:
+		s = strings.Join(v, ",")
+	default:
+		s = fmt.Sprint(v)
+	}
+	return &s
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"bubod/Bubod/lib"
+)
+
+// 命令行覆盖配置文件中的配置项，用于临时重放、调试
+type overrideFlags struct {
+	source    *string
+	startFile *string
+	startPos  *string
+	gtid      *string
+	serverId  *string
+	logLevel  *string
+	sets      setFlags
+}
+
+// -set section.key=value，可重复
+type setFlags []string
+
+func (s *setFlags) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *setFlags) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i < 0 || strings.LastIndexByte(value[:i], '.') <= 0 {
+		return fmt.Errorf("must be section.key=value")
+	}
+	*s = append(*s, value)
+	return nil
+}
+
+func defineOverrideFlags(fs *flag.FlagSet) *overrideFlags {
+	o := &overrideFlags{
+		source:    fs.String("source", "", "-start-file/-start-pos/-gtid/-server-id 作用的数据源配置组，默认为第一个数据源"),
+		startFile: fs.String("start-file", "", "开始同步的 binlog 文件，优先于已保存的位点"),
+		startPos:  fs.String("start-pos", "", "开始同步的 binlog 位置，默认 4"),
+		gtid:      fs.String("gtid", "", "从该 GTID 集合之后开始同步，忽略 binlog 文件和位置"),
+		serverId:  fs.String("server-id", "", "dump 使用的 server_id"),
+		logLevel:  fs.String("log-level", "", "日志级别 debug/info/warn/error"),
+	}
+	fs.Var(&o.sets, "set", "覆盖任意配置项 section.key=value，可重复，如 -set Database.host=127.0.0.1")
+	return o
+}
+
+// 将命令行参数写入配置
+func (o *overrideFlags) apply(conf map[string]map[string]string) error {
+	for _, set := range o.sets {
+		i := strings.IndexByte(set, '=')
+		j := strings.LastIndexByte(set[:i], '.')
+		section, key, value := set[:j], set[j+1:i], set[i+1:]
+		if _, ok := conf[section]; !ok {
+			conf[section] = make(map[string]string)
+		}
+		conf[section][key] = value
+	}
+	if *o.logLevel != "" {
+		if _, ok := conf["Bubod"]; !ok {
+			conf["Bubod"] = make(map[string]string)
+		}
+		conf["Bubod"]["log_level"] = *o.logLevel
+	}
+
+	if *o.startFile == "" && *o.startPos == "" && *o.gtid == "" && *o.serverId == "" {
+		return nil
+	}
+	source := *o.source
+	if source == "" {
+		names := lib.GetSourceNames(conf)
+		if len(names) == 0 {
+			return fmt.Errorf("no source configured")
+		}
+		source = names[0]
+	}
+	if _, ok := conf[source]; !ok {
+		return fmt.Errorf("config section [%s] not found", source)
+	}
+	if *o.serverId != "" {
+		conf[source]["server_id"] = *o.serverId
+	}
+	if *o.startFile != "" || *o.startPos != "" {
+		if *o.startFile == "" {
+			return fmt.Errorf("-start-pos requires -start-file")
+		}
+		pos := *o.startPos
+		if pos == "" {
+			pos = "4"
+		}
+		conf[source]["binlog_dump_file_name"] = *o.startFile
+		conf[source]["binlog_dump_position"] = pos
+		conf[source]["binlog_dump_force"] = "true"
+	}
+	if *o.gtid != "" {
+		conf[source]["gtid_set"] = *o.gtid
+		// 优先于已保存的 GTID 集合
+		conf[source]["binlog_dump_force"] = "true"
+	}
+	return nil
+}
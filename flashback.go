@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"strings"
+
+	"bubod/Bubod/mysql"
+)
+
+// bubod flashback -dsn dsn [flags] mysql-bin.000001 [mysql-bin.000002 ...]
+// 生成回滚语句，用于误操作后恢复: insert 生成 DELETE，delete 生成 INSERT，update 按变更前的值生成 UPDATE
+// 语句按变更的逆序输出，先回滚最后的变更；DDL 无法回滚，只输出注释
+func flashbackCommand(args []string) error {
+	fs := newFlagSet("flashback")
+	tool := defineBinlogToolFlags(fs)
+	output := fs.String("o", "", "输出文件，默认标准输出")
+	fs.Parse(args)
+
+	if *tool.types == "" {
+		*tool.types = "insert,update,delete,ddl"
+	}
+	statements := make([]string, 0)
+	err := tool.read(fs.Args(), mysql.ROW_FORMAT_SLICE, func(event *mysql.EventReslut) error {
+		sqls, err := flashbackSQL(event)
+		if err != nil {
+			return err
+		}
+		statements = append(statements, sqls...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+	for i := len(statements) - 1; i >= 0; i-- {
+		fmt.Fprintln(w, statements[i])
+	}
+	return w.Flush()
+}
+
+// 事件的回滚语句，按原顺序返回，每条语句前带位点注释
+func flashbackSQL(event *mysql.EventReslut) ([]string, error) {
+	position := fmt.Sprintf("-- %s:%d %s", event.BinlogFileName, event.Header.LogPos-event.Header.EventSize, eventTypeName(event))
+	if event.DDL != nil {
+		return []string{position + "\n-- DDL cannot be flashed back: " + strings.Replace(event.Query, "\n", " ", -1)}, nil
+	}
+	if event.RowCount() == 0 {
+		return nil, nil
+	}
+	for _, column := range event.Columns {
+		if strings.HasPrefix(column.Name, "@") {
+			return nil, fmt.Errorf("table %s.%s schema unknown, use -dsn to query column names", event.SchemaName, event.TableName)
+		}
+	}
+
+	table := quoteName(event.SchemaName) + "." + quoteName(event.TableName)
+	sqls := make([]string, 0, event.RowCount())
+	switch eventTypeName(event) {
+	case "insert":
+		for _, values := range event.Values {
+			sqls = append(sqls, fmt.Sprintf("%s\nDELETE FROM %s WHERE %s LIMIT 1;", position, table, whereClause(event.Columns, values)))
+		}
+	case "delete":
+		for _, values := range event.Values {
+			names := make([]string, len(event.Columns))
+			literals := make([]string, len(event.Columns))
+			for i, column := range event.Columns {
+				names[i], literals[i] = quoteName(column.Name), sqlValue(values[i])
+			}
+			sqls = append(sqls, fmt.Sprintf("%s\nINSERT INTO %s (%s) VALUES (%s);", position, table,
+				strings.Join(names, ","), strings.Join(literals, ",")))
+		}
+	case "update":
+		for i := 0; i+1 < len(event.Values); i += 2 {
+			before, after := event.Values[i], event.Values[i+1]
+			sets := make([]string, len(event.Columns))
+			for j, column := range event.Columns {
+				sets[j] = quoteName(column.Name) + "=" + sqlValue(before[j])
+			}
+			sqls = append(sqls, fmt.Sprintf("%s\nUPDATE %s SET %s WHERE %s LIMIT 1;", position, table,
+				strings.Join(sets, ","), whereClause(event.Columns, after)))
+		}
+	}
+	return sqls, nil
+}
+
+// 有主键时按主键定位，否则按所有字段
+func whereClause(columns []*mysql.ColumnInfo, values []driver.Value) string {
+	conds := make([]string, 0)
+	for i, column := range columns {
+		if column.Key == "PRI" {
+			conds = append(conds, condition(column.Name, values[i]))
+		}
+	}
+	if len(conds) == 0 {
+		for i, column := range columns {
+			conds = append(conds, condition(column.Name, values[i]))
+		}
+	}
+	return strings.Join(conds, " AND ")
+}
+
+func condition(name string, value driver.Value) string {
+	if value == nil {
+		return quoteName(name) + " IS NULL"
+	}
+	return quoteName(name) + "=" + sqlValue(value)
+}
+
+func quoteName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+var sqlEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`)
+
+// SQL 字面量
+func sqlValue(value driver.Value) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case string:
+		return "'" + sqlEscaper.Replace(v) + "'"
+	case []byte:
+		return fmt.Sprintf("X'%X'", v)
+	case []string:
+		// SET 类型
+		return "'" + sqlEscaper.Replace(strings.Join(v, ",")) + "'"
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"bubod/Bubod/mysql"
+)
+
+// bubod inspect [flags] mysql-bin.000001 [mysql-bin.000002 ...]
+// 使用同步时的解码器解析 binlog 并输出，类似 mysqlbinlog -vv；-json 时输出同步时写入输出的消息
+func inspectCommand(args []string) error {
+	fs := newFlagSet("inspect")
+	tool := defineBinlogToolFlags(fs)
+	asJson := fs.Bool("json", false, "输出同步时写入输出的 json 消息")
+	verbose := fs.Bool("v", false, "输出字段类型")
+	fs.Parse(args)
+
+	return tool.read(fs.Args(), mysql.ROW_FORMAT_SLICE, func(event *mysql.EventReslut) error {
+		if *asJson {
+			for _, message := range mysql.FormatEventData(event) {
+				fmt.Println(message)
+			}
+			return nil
+		}
+		printEvent(event, *verbose)
+		return nil
+	})
+}
+
+func printEvent(event *mysql.EventReslut, verbose bool) {
+	header := event.Header
+	fmt.Printf("# at %d\n", header.LogPos-header.EventSize)
+	fmt.Printf("#%s server id %d end_log_pos %d %s", time.Unix(int64(header.Timestamp), 0).Format("2006-01-02 15:04:05"),
+		header.ServerId, header.LogPos, header.EventName())
+	if event.TableName != "" {
+		fmt.Printf(" %s.%s", event.SchemaName, event.TableName)
+	}
+	if event.SchemaVersion > 0 {
+		fmt.Printf(" schema_version %d", event.SchemaVersion)
+	}
+	fmt.Println()
+	if event.Query != "" {
+		fmt.Printf("%s\n", event.Query)
+	}
+
+	table := fmt.Sprintf("`%s`.`%s`", event.SchemaName, event.TableName)
+	switch eventTypeName(event) {
+	case "insert":
+		for _, values := range event.Values {
+			fmt.Printf("### INSERT INTO %s\n### SET\n", table)
+			printValues(event.Columns, values, verbose)
+		}
+	case "delete":
+		for _, values := range event.Values {
+			fmt.Printf("### DELETE FROM %s\n### WHERE\n", table)
+			printValues(event.Columns, values, verbose)
+		}
+	case "update":
+		for i := 0; i+1 < len(event.Values); i += 2 {
+			fmt.Printf("### UPDATE %s\n### WHERE\n", table)
+			printValues(event.Columns, event.Values[i], verbose)
+			fmt.Printf("### SET\n")
+			printValues(event.Columns, event.Values[i+1], verbose)
+		}
+	}
+}
+
+func printValues(columns []*mysql.ColumnInfo, values []driver.Value, verbose bool) {
+	for i, column := range columns {
+		if i >= len(values) {
+			break
+		}
+		fmt.Printf("###   %s=%s", column.Name, formatValue(values[i]))
+		if verbose {
+			fmt.Printf(" /* %s */", column.Type)
+		}
+		fmt.Println()
+	}
+}
+
+// 字符串加引号，其他按 %v 输出
+func formatValue(value driver.Value) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.Replace(v, "'", "''", -1) + "'"
+	case []byte:
+		return fmt.Sprintf("X'%X'", v)
+	}
+	return fmt.Sprint(value)
+}
@@ -16,11 +16,15 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"log"
 	"bubod/Bubod/config"
 	"bubod/Bubod/lib"
+	"bubod/Bubod/logger"
 	"flag"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"io"
 	"sync"
@@ -34,7 +38,6 @@ import (
 var l sync.Mutex
 
 var Conf map[string]map[string]string
-var Daemon string
 var Pid string
 var ConfigFile *string 
 
@@ -57,29 +60,51 @@ func printLogo(cluster string, node_name string){
 }
 
 func main() {
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// 启动同步服务，bubod run
+func runServer(args []string) {
 	defer func() {
 		if Pid != ""{
 			os.Remove(Pid)
-			log.Println("Remove Pid:", Pid, os.Getppid())
+			logger.Info("Remove Pid:", Pid, os.Getppid())
 		}
 	}()
 
 	execDir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
 
-	ConfigFile = flag.String("config", "", "配置文件路径")
-	flag.Parse()
+	fs := flag.NewFlagSet("bubod run", flag.ExitOnError)
+	ConfigFile = fs.String("config", "", "配置文件路径")
+	fs.StringVar(ConfigFile, "c", "", "同 -config")
+	profile := fs.String("profile", os.Getenv(config.PROFILE_ENV), "配置覆盖文件，如 prod 加载 bubod.prod.ini")
+	overrides := defineOverrideFlags(fs)
+	fs.Parse(args)
 
 	if *ConfigFile == "" {
 		*ConfigFile = execDir+"/bubod.ini" // 默认为跟目录
-		log.Println("ConfigFile:",*ConfigFile)
+		logger.Info("ConfigFile:",*ConfigFile)
 	}
 	
 	// 指向config.MyConf
-	Conf = config.LoadConf(*ConfigFile)
+	Conf = config.LoadConfProfile(*ConfigFile, *profile)
+	// 命令行参数覆盖配置
+	if err := overrides.apply(Conf); err != nil {
+		fmt.Println("flag error:", err)
+		os.Exit(1)
+	}
+
+	// 日志级别 debug/info/warn/error，格式 json/text
+	logger.SetLevel(config.GetConfigVal("Bubod","log_level"))
+	logger.SetFormat(config.GetConfigVal("Bubod","log_format"))
 
 	cluster_name := config.GetConfigVal("Bubod","cluster_name")
 	server_id := config.GetConfigVal("Database","server_id")
-	Daemon = config.GetConfigVal("Bubod","daemon")
+	daemon, err := config.GetBool("Bubod","daemon",false)
+	if err != nil {
+		logger.WithError(err).Error("config file error")
+		os.Exit(1)
+	}
 
 
 	dataDir := config.GetConfigVal("Bubod","data_dir")
@@ -102,8 +127,10 @@ func main() {
 	// config.SetConfigVal("Bubod","bubod_dump_pos_tmp", dataDir+"/filepos-"+node_name+".bubod.tmp")
 	Conf["Bubod"]["bubod_dump_pos"] = dataDir+"/filepos-"+node_name+".bubod"
 	Conf["Bubod"]["bubod_dump_pos_tmp"] = dataDir+"/filepos-"+node_name+".bubod.tmp"
+	// 解析失败事件的死信文件
+	Conf["Bubod"]["bubod_dlq"] = dataDir+"/dlq-"+node_name+".bubod"
 
-	if Daemon == "true"{
+	if daemon {
 		if os.Getppid() != 1{
 			filePath,_:=filepath.Abs(os.Args[0])  //将命令行参数中执行文件路径转换成可用路径
 			args:=append([]string{filePath},os.Args[1:]...)
@@ -130,8 +157,37 @@ func main() {
 		WritePid()
 	}
 
-	log.Println("Server started...")
+	shutdownTimeout, err := config.GetDuration("Bubod","shutdown_timeout",30*time.Second)
+	if err != nil {
+		logger.WithError(err).Error("config file error")
+		os.Exit(1)
+	}
+	go handleSignal(shutdownTimeout)
+
+	logger.Info("Server started...")
 	lib.Run(Conf)
+	logger.Info("Server stopped")
+}
+
+// SIGINT/SIGTERM 优雅退出，等待事件写完并保存位点；退出过程中再次收到信号则直接退出
+func handleSignal(timeout time.Duration){
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-c
+	logger.With(logger.Fields{"signal": sig.String(), "timeout": timeout.String()}).Info("Server shutting down...")
+	go func(){
+		<-c
+		logger.Warn("Server force quit")
+		if Pid != ""{
+			os.Remove(Pid)
+		}
+		os.Exit(1)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := lib.Shutdown(ctx); err != nil {
+		logger.WithError(err).Error("shutdown")
+	}
 }
 
 // 记录输出日志
@@ -151,22 +207,24 @@ func initLog(){
 	LogFileName := log_dir+"/bubod_"+t+".log"
 	f, err := os.OpenFile(LogFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0777) //打开文件
 	if err != nil{
-		log.Println("log init error:",err)
+		logger.WithError(err).Error("log init error")
+		return
 	}
 	log.SetOutput(f)
+	logger.SetOutput(f)
 }
 
 // 写入pid文件
 func WritePid(){
 	f, err2 := os.OpenFile(Pid, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0777) //打开文件
 	if err2 !=nil {
-		log.Println("Open Pid Error; File:",Pid,"; Error:",err2)
+		logger.With(logger.Fields{"file": Pid}).WithError(err2).Error("Open Pid Error")
 		os.Exit(1)
 		return
 	}
 	pidContent, err2 := ioutil.ReadAll(f)
 	if string(pidContent) != "" {
-		log.Println("bubod server quit without delete PID file; File:",Pid, string(pidContent),"; Error:",err2)
+		logger.With(logger.Fields{"file": Pid, "pid": string(pidContent)}).WithError(err2).Error("bubod server quit without delete PID file")
 		os.Exit(1)
 	}
 	defer f.Close()
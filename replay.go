@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"bubod/Bubod/config"
+	"bubod/Bubod/lib"
+	"bubod/Bubod/logger"
+	"bubod/Bubod/mysql"
+)
+
+const (
+	REPLAY_INPUT_BINLOG = "binlog"
+	REPLAY_INPUT_NDJSON = "ndjson"
+)
+
+// bubod replay -c bubod.ini [-sinks sink.1] [-speed 1|2x|max] [-input binlog|ndjson|maxwell|canal|debezium] [-schema schema.json] [flags] file [file ...]
+// 将归档的事件重新写入配置的输出: binlog 为 binlog/relay log 文件，ndjson 为每行一条同步消息的文件(如 export -format ndjson 的输出)，
+// maxwell/canal/debezium 为每行一条对应格式的消息；文件为 - 时读取标准输入，
+// 如 kafka-console-consumer --topic t | bubod replay -input maxwell -speed max -，将消息队列中的变更通过 applier 写入目标库。
+// 不直接消费 Kafka，没有消费组和 offset，见 format_cdc.go
+func replayCommand(args []string) error {
+	fs := newFlagSet("replay")
+	configFile := fs.String("c", "bubod.ini", "配置文件，使用其中的 [sink.N] 输出")
+	profile := fs.String("profile", os.Getenv(config.PROFILE_ENV), "配置覆盖文件，如 prod 加载 bubod.prod.ini")
+	sinks := fs.String("sinks", "", "写入的输出，逗号分隔，默认所有输出")
+	speed := fs.String("speed", "1", "回放速度: 1 为原速，2x 为 2 倍速，max 为最快速度")
+	input := fs.String("input", REPLAY_INPUT_BINLOG, "输入格式 binlog/ndjson/maxwell/canal/debezium")
+	schemaFile := fs.String("schema", "", "表结构快照文件，消息格式的输入按快照生成字段信息和主键")
+	tool := defineBinlogToolFlags(fs)
+	fs.Parse(args)
+
+	rate, err := parseReplaySpeed(*speed)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("file is required")
+	}
+	conf := config.LoadConfProfile(*configFile, *profile)
+	logger.SetLevel(config.GetConfigVal("Bubod", "log_level"))
+	logger.SetFormat(config.GetConfigVal("Bubod", "log_format"))
+	names := make([]string, 0)
+	for name := range splitSet(*sinks) {
+		names = append(names, name)
+	}
+	replayer, err := lib.NewReplayer(conf, names, rate)
+	if err != nil {
+		return err
+	}
+
+	switch *input {
+	case REPLAY_INPUT_BINLOG:
+		err = tool.read(fs.Args(), "", func(event *mysql.EventReslut) error {
+			// 同同步时的回调，只回放行变更和 DDL
+			if event.RowCount() > 0 || event.DDL != nil {
+				replayer.Write(event, nil)
+			}
+			return nil
+		})
+	case REPLAY_INPUT_NDJSON, mysql.CDC_FORMAT_MAXWELL, mysql.CDC_FORMAT_CANAL, mysql.CDC_FORMAT_DEBEZIUM:
+		err = replayMessages(replayer, fs.Args(), *input, *schemaFile, newEventFilter(*tool.tables, *tool.types))
+	default:
+		err = fmt.Errorf("unknown input %s", *input)
+	}
+	if closeErr := replayer.Close(); err == nil {
+		err = closeErr
+	}
+	fmt.Printf("%d events replayed\n", replayer.Count())
+	return err
+}
+
+// 速度: max 为 0(最快)，1、2x、0.5 为倍数
+func parseReplaySpeed(s string) (float64, error) {
+	if s == "max" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid speed %q", s)
+	}
+	return rate, nil
+}
+
+// 回放 json 消息文件，每行一条消息，bubod 的消息原样写入输出，其他格式按输出重新生成
+func replayMessages(replayer *lib.Replayer, files []string, format string, schemaFile string, filter *eventFilter) error {
+	if format == REPLAY_INPUT_NDJSON {
+		format = mysql.CDC_FORMAT_BUBOD
+	}
+	var snapshot *mysql.SchemaSnapshot
+	if schemaFile != "" {
+		var err error
+		if snapshot, err = mysql.ReadSchemaSnapshot(schemaFile); err != nil {
+			return err
+		}
+	}
+	decoder, err := mysql.NewCDCDecoder(format, snapshot)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		f := os.Stdin
+		if file != "-" {
+			if f, err = os.Open(file); err != nil {
+				return err
+			}
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 1<<20), 64<<20)
+		line := 0
+		for scanner.Scan() {
+			line++
+			message := scanner.Bytes()
+			if len(strings.TrimSpace(string(message))) == 0 {
+				continue
+			}
+			event, err := decoder.Decode(message)
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("%s:%d %s", file, line, err)
+			}
+			if event == nil || !filter.match(event) {
+				continue
+			}
+			var messages []string
+			if format == mysql.CDC_FORMAT_BUBOD {
+				messages = []string{string(message)}
+			}
+			replayer.Write(event, messages)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}